@@ -0,0 +1,196 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/xo"
+)
+
+// A clientReader reads from a client's connection, and can watch it for the
+// client going away while its request is being served.
+type clientReader struct {
+	conn net.Conn
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	watching bool
+	stopping bool
+
+	// A byte read while watching the connection, or the error it failed
+	// with, returned by the next read.
+	b    [1]byte
+	held bool
+	err  error
+}
+
+func newClientReader(conn net.Conn) *clientReader {
+	cr := &clientReader{conn: conn}
+	cr.cond = sync.NewCond(&cr.mu)
+	return cr
+}
+
+func (cr *clientReader) Read(p []byte) (int, error) {
+	cr.mu.Lock()
+	if cr.held {
+		cr.held = false
+		cr.mu.Unlock()
+		return copy(p, cr.b[:]), nil
+	}
+	if err := cr.err; err != nil {
+		cr.mu.Unlock()
+		return 0, err
+	}
+	cr.mu.Unlock()
+
+	return cr.conn.Read(p)
+}
+
+// buffered reports whether the client has sent more data while it was
+// being watched.
+func (cr *clientReader) buffered() bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.held
+}
+
+// halfClosed reports whether the client shut down its side of the
+// connection while being watched. The response can still be sent, but no
+// further requests will follow.
+func (cr *clientReader) halfClosed() bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.err == io.EOF
+}
+
+// watch starts waiting for the client to drop the connection, in which case
+// gone is called. A client merely shutting down its side of the connection
+// (a half-close) hasn't gone away, and still gets its response. Nothing else
+// may read from the connection until unwatch has been called.
+func (cr *clientReader) watch(gone func()) {
+	cr.mu.Lock()
+	cr.watching = true
+	cr.mu.Unlock()
+
+	go func() {
+		n, err := cr.conn.Read(cr.b[:])
+
+		cr.mu.Lock()
+		defer cr.mu.Unlock()
+
+		switch {
+		case n > 0:
+			cr.held = true
+		case err == io.EOF:
+			cr.err = err
+		case err != nil && !cr.stopping:
+			cr.err = err
+			gone()
+		}
+
+		cr.watching = false
+		cr.cond.Broadcast()
+	}()
+}
+
+// unwatch stops watching the connection, returning the error the client
+// went away with, if it did. A half-close isn't such an error; it's seen by
+// the next read instead.
+func (cr *clientReader) unwatch() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if cr.watching {
+		// Interrupt the pending read.
+		cr.stopping = true
+		cr.conn.SetReadDeadline(time.Unix(1, 0))
+		for cr.watching {
+			cr.cond.Wait()
+		}
+		cr.conn.SetReadDeadline(time.Time{})
+		cr.stopping = false
+	}
+
+	if cr.err == io.EOF {
+		return nil
+	}
+	return cr.err
+}
+
+type interruptKey struct{}
+
+// withInterrupt returns a copy of ctx carrying fn, which interrupts reads
+// of the request's body from the client.
+func withInterrupt(ctx context.Context, fn func()) context.Context {
+	return context.WithValue(ctx, interruptKey{}, fn)
+}
+
+// interrupter returns the function carried by ctx which interrupts reads of
+// the request's body, if any.
+func interrupter(ctx context.Context) func() {
+	fn, _ := ctx.Value(interruptKey{}).(func())
+	return fn
+}
+
+// interruptClient interrupts reads from the client's connection, such as of
+// a request body which is no longer wanted. The connection can't be kept
+// alive afterwards.
+func (s *Session) interruptClient() {
+	atomic.StoreInt32(&s.interrupted, 1)
+	s.Conn.SetReadDeadline(time.Unix(1, 0))
+}
+
+// clientInterrupted reports whether reads from the client's connection have
+// been interrupted.
+func (s *Session) clientInterrupted() bool {
+	return atomic.LoadInt32(&s.interrupted) != 0
+}
+
+// errClientGone is the cause of the cancellation of requests whose client
+// went away.
+var errClientGone = errors.New("relay: client went away")
+
+// watchClient cancels the work done on a request's behalf if the client
+// drops its connection while the response is on its way. The returned
+// function stops watching, returning the error the client went away with,
+// if it did.
+//
+// The connection can only be watched once the client has sent the whole
+// request, and nothing more, so requests with bodies (or which are to
+// switch protocols) aren't watched.
+func (p *Proxy) watchClient(s *Session, cr *clientReader, r xo.Reader, req *heat.Request, body *bodyReader) func() error {
+	if body != nil || pipelined(r) || cr.buffered() {
+		return func() error { return nil }
+	}
+	if _, ok := fieldValue(req.Fields, "Upgrade"); ok {
+		return func() error { return nil }
+	}
+
+	base := s.base
+	parent := base
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	ctx, cancel := context.WithCancelCause(parent)
+	s.base = ctx
+
+	cr.watch(func() {
+		p.count("client.aborted", 1)
+		cancel(errClientGone)
+	})
+
+	// The context isn't canceled once the client is no longer watched, as
+	// the response body may still be on its way.
+	return func() error {
+		err := cr.unwatch()
+		s.base = base
+		return err
+	}
+}
@@ -0,0 +1,71 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+	"github.com/erkl/relay/relaytest"
+)
+
+func TestClientHalfClose(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		// Give the proxy time to notice the half-close.
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	})
+
+	conn := serveTCP(t, &relay.Proxy{})
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	conn.CloseWrite()
+
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "ok" {
+		t.Fatalf("got body %q (%v), want \"ok\"", body, err)
+	}
+	if !resp.Close {
+		t.Errorf("response to a half-closed client doesn't close the connection")
+	}
+}
+
+func TestClientGone(t *testing.T) {
+	canceled := make(chan struct{})
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		// Wait for the proxy to give up on the request.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := r.ReadByte(); err == io.EOF {
+			close(canceled)
+		}
+	})
+
+	conn := serveTCP(t, &relay.Proxy{})
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	time.Sleep(50 * time.Millisecond)
+
+	// Reset the connection rather than close it cleanly.
+	conn.SetLinger(0)
+	conn.Close()
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request wasn't canceled after the client went away")
+	}
+}
+
+func TestServeBytesLastRequest(t *testing.T) {
+	out := relaytest.ServeBytes(&relay.Proxy{},
+		[]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		[]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+
+	if !bytes.HasPrefix(out, []byte("HTTP/1.1 200 ")) || !bytes.HasSuffix(out, []byte("hello")) {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// An AltSvcAction says what an AltSvcRule does with the Alt-Svc header
+// fields of responses.
+type AltSvcAction int
+
+const (
+	// Forward Alt-Svc fields unchanged.
+	AltSvcPass AltSvcAction = iota
+
+	// Remove Alt-Svc fields.
+	AltSvcStrip
+
+	// Replace Alt-Svc fields with "clear", making clients forget any
+	// alternatives advertised earlier, such as before they started using
+	// the proxy.
+	AltSvcClear
+
+	// Keep only alternatives using one of the rule's Protocols.
+	AltSvcFilter
+)
+
+// An AltSvcRule controls which alternative services (RFC 7838) upstream
+// servers may advertise to clients. Alternatives such as HTTP/3 endpoints
+// let clients bypass the proxy, or fail when the alternative isn't reachable
+// from their network.
+type AltSvcRule struct {
+	// Requests whose responses the rule applies to. If nil, everything
+	// matches.
+	Match *Match
+
+	Action AltSvcAction
+
+	// ALPN protocol IDs (such as "h2") of the alternatives kept by
+	// AltSvcFilter.
+	Protocols []string
+}
+
+// apply enforces the rule on a response's header, reporting whether it was
+// changed.
+func (r *AltSvcRule) apply(fields *heat.Fields) bool {
+	if r.Action == AltSvcPass {
+		return false
+	}
+
+	var values []string
+	for _, f := range *fields {
+		if f.Is("Alt-Svc") {
+			values = append(values, f.Value)
+		}
+	}
+	if len(values) == 0 {
+		return false
+	}
+
+	var keep []string
+
+	switch r.Action {
+	case AltSvcClear:
+		keep = []string{"clear"}
+
+	case AltSvcFilter:
+		for _, value := range values {
+			for _, alt := range splitAltSvc(value) {
+				if alt == "clear" || contains(r.Protocols, altSvcProtocol(alt)) {
+					keep = append(keep, alt)
+				}
+			}
+		}
+	}
+
+	changed := len(values) != 1 || len(keep) == 0 || keep[0] != values[0]
+
+	fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Alt-Svc")
+	})
+	if len(keep) > 0 {
+		fields.Set("Alt-Svc", strings.Join(keep, ", "))
+	}
+
+	return changed
+}
+
+// applyAltSvcRules enforces the first rule in p.AltSvc matching req on its
+// response.
+func (p *Proxy) applyAltSvcRules(s *Session, req *heat.Request, resp *heat.Response) {
+	for i := range p.AltSvc {
+		r := &p.AltSvc[i]
+		if !r.Match.Request(s, req) {
+			continue
+		}
+
+		if r.apply(&resp.Fields) {
+			p.decide(s, req, "", &DecisionRecord{
+				Action:  "rewrite",
+				Rule:    "AltSvc[" + strconv.Itoa(i) + "]",
+				Pattern: r.Match.String(),
+			})
+		}
+
+		return
+	}
+}
+
+// splitAltSvc splits the value of an Alt-Svc field into its alternatives,
+// leaving commas inside quoted strings alone.
+func splitAltSvc(value string) []string {
+	var alts []string
+	var quoted, escaped bool
+
+	start := 0
+	for i := 0; i <= len(value); i++ {
+		if i < len(value) {
+			c := value[i]
+			switch {
+			case escaped:
+				escaped = false
+				continue
+			case quoted && c == '\\':
+				escaped = true
+				continue
+			case c == '"':
+				quoted = !quoted
+				continue
+			case c != ',' || quoted:
+				continue
+			}
+		}
+
+		if alt := strings.TrimSpace(value[start:i]); alt != "" {
+			alts = append(alts, alt)
+		}
+		start = i + 1
+	}
+
+	return alts
+}
+
+// altSvcProtocol returns the ALPN protocol ID of an alternative, such as
+// "h3" for `h3=":443"; ma=86400`.
+func altSvcProtocol(alt string) string {
+	id := alt
+	if i := strings.IndexByte(id, '='); i >= 0 {
+		id = id[:i]
+	}
+	id = strings.TrimSpace(id)
+
+	// Protocol IDs are percent-encoded.
+	if s, err := url.PathUnescape(id); err == nil {
+		id = s
+	}
+
+	return id
+}
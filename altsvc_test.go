@@ -0,0 +1,74 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestAltSvc(t *testing.T) {
+	match := func(path string) *relay.Match {
+		m, err := relay.ParseMatch("path=" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	var rules []string
+	p := &relay.Proxy{
+		AltSvc: []relay.AltSvcRule{
+			{Match: match("/pass"), Action: relay.AltSvcPass},
+			{Match: match("/strip"), Action: relay.AltSvcStrip},
+			{Match: match("/clear"), Action: relay.AltSvcClear},
+			{Match: match("/filter"), Action: relay.AltSvcFilter, Protocols: []string{"h2", "h3-29"}},
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			resp.Fields.Add("Alt-Svc", `h3=":443"; ma=86400, h2="alt.example:443"; persist=1`)
+			resp.Fields.Add("Alt-Svc", `h3%2D29=":443", quic=":443"; v="46,43"`)
+			return resp, nil
+		},
+		AuditDecision: func(r *relay.DecisionRecord) {
+			rules = append(rules, r.Rule)
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	original := []string{
+		`h3=":443"; ma=86400, h2="alt.example:443"; persist=1`,
+		`h3%2D29=":443", quic=":443"; v="46,43"`,
+	}
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/pass", original},
+		{"/strip", nil},
+		{"/clear", []string{"clear"}},
+		{"/filter", []string{`h2="alt.example:443"; persist=1, h3%2D29=":443"`}},
+		{"/other", original},
+	}
+
+	for _, tt := range tests {
+		io.WriteString(conn, "GET http://origin.test"+tt.path+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		if got := resp.Header.Values("Alt-Svc"); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: got Alt-Svc %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	// Only responses which were changed are audited.
+	if want := "AltSvc[1] AltSvc[2] AltSvc[3]"; strings.Join(rules, " ") != want {
+		t.Errorf("audited %q, want %q", rules, want)
+	}
+}
@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"context"
+)
+
+// Annotate attaches a value to the session under a key, for the rest of the
+// session's lifetime. As with context.WithValue, keys should be of types
+// private to the package defining them, to avoid collisions.
+//
+// Annotations are visible to all hooks through Session.Annotation, to
+// RoundTripContext through the context's Value method, and are recorded in
+// the flow store.
+func (s *Session) Annotate(key, value interface{}) {
+	if s.annotations == nil {
+		s.annotations = make(map[interface{}]interface{})
+	}
+	s.annotations[key] = value
+}
+
+// AnnotateRequest is like Annotate, but the annotation only lasts until the
+// current request has been served.
+func (s *Session) AnnotateRequest(key, value interface{}) {
+	if s.reqAnnotations == nil {
+		s.reqAnnotations = make(map[interface{}]interface{})
+	}
+	s.reqAnnotations[key] = value
+}
+
+// Annotation returns the value stored under key by either Annotate or
+// AnnotateRequest, preferring the latter, or nil if there is none.
+func (s *Session) Annotation(key interface{}) interface{} {
+	if v, ok := s.reqAnnotations[key]; ok {
+		return v
+	}
+	return s.annotations[key]
+}
+
+// Annotations returns a copy of all of the session's current annotations.
+func (s *Session) Annotations() map[interface{}]interface{} {
+	if len(s.annotations) == 0 && len(s.reqAnnotations) == 0 {
+		return nil
+	}
+
+	m := make(map[interface{}]interface{}, len(s.annotations)+len(s.reqAnnotations))
+	for k, v := range s.annotations {
+		m[k] = v
+	}
+	for k, v := range s.reqAnnotations {
+		m[k] = v
+	}
+
+	return m
+}
+
+// The annotatedContext type exposes a session's annotations through a
+// context's Value method.
+type annotatedContext struct {
+	context.Context
+	s *Session
+}
+
+func (c annotatedContext) Value(key interface{}) interface{} {
+	if _, ok := key.(intentKey); ok {
+		return c.s.intent
+	}
+	if v := c.s.Annotation(key); v != nil {
+		return v
+	}
+	return c.Context.Value(key)
+}
@@ -0,0 +1,90 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+type userKey struct{}
+type pathKey struct{}
+
+func TestAnnotations(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+
+	record := func(where string, user, path interface{}) {
+		mu.Lock()
+		seen = append(seen, fmt.Sprintf("%s %v %v", where, user, path))
+		mu.Unlock()
+	}
+
+	fs := &relay.FlowStore{}
+	p := &relay.Proxy{
+		Flows: fs,
+		OnSession: func(s *relay.Session) {
+			s.Annotate(userKey{}, "alice")
+		},
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			record("request", s.Annotation(userKey{}), s.Annotation(pathKey{}))
+			if req.URI == "/tagged" {
+				s.AnnotateRequest(pathKey{}, req.URI)
+			}
+			return nil
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			record("round trip", ctx.Value(userKey{}), ctx.Value(pathKey{}))
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			return resp, nil
+		},
+		OnResponse: func(s *relay.Session, req *heat.Request, resp *heat.Response) {
+			record("response", s.Annotation(userKey{}), s.Annotation(pathKey{}))
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	// Request annotations don't outlive their request.
+	for _, path := range []string{"/tagged", "/plain"} {
+		io.WriteString(conn, "GET http://example.com"+path+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		readFinal(t, conn, r)
+	}
+
+	want := []string{
+		"request alice <nil>",
+		"round trip alice /tagged",
+		"response alice /tagged",
+		"request alice <nil>",
+		"round trip alice <nil>",
+		"response alice <nil>",
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("hooks saw:\n%q\nwant:\n%q", seen, want)
+	}
+
+	// The flow store records them too.
+	flows := fs.Flows(nil)
+	if len(flows) != 2 {
+		t.Fatalf("got %d flows, want 2", len(flows))
+	}
+	for _, f := range flows {
+		if f.Annotations[userKey{}] != "alice" {
+			t.Errorf("flow %s lacks the session annotation: %v", f.Request.URI, f.Annotations)
+		}
+		if tagged := f.Annotations[pathKey{}] != nil; tagged != (f.Request.URI == "/tagged") {
+			t.Errorf("flow %s has request annotations %v", f.Request.URI, f.Annotations)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// A CertRecord describes a certificate forged by the proxy.
+type CertRecord struct {
+	Time        time.Time `json:"time"`
+	Host        string    `json:"host"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	IPAddresses []string  `json:"ip_addresses,omitempty"`
+	Serial      string    `json:"serial"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+
+	// Hex-encoded SHA-256 digests of the certificate's public key (in its
+	// SubjectPublicKeyInfo form), and of the signing authority's certificate.
+	KeyHash       string `json:"key_hash"`
+	AuthorityHash string `json:"authority_hash"`
+}
+
+// CertAuditLog returns a function suitable for Proxy.AuditCertificate, which
+// appends every record to w as a line of JSON. Writes are serialized, so w
+// doesn't need to be safe for concurrent use. Write errors are ignored.
+func CertAuditLog(w io.Writer) func(r *CertRecord) {
+	write := jsonLines(w)
+	return func(r *CertRecord) { write(r) }
+}
+
+// A DecisionRecord describes a decision made by one of the proxy's policies
+// about a request or tunnel.
+type DecisionRecord struct {
+	Time time.Time `json:"time"`
+
+	// One of "allow", "deny", "throttle" or "rewrite".
+	Action string `json:"action"`
+
+	// The setting which made the decision, such as "HeaderRules[2]",
+	// "Users" or "OnConnect", and the match expression (in the syntax of
+	// ParseMatch) responsible, if any.
+	Rule    string `json:"rule"`
+	Pattern string `json:"pattern,omitempty"`
+
+	// The client's authenticated user name, if any, and address.
+	User   string `json:"user,omitempty"`
+	Client string `json:"client,omitempty"`
+
+	// The request's method and URL, or "CONNECT" and the tunnel's address.
+	Method      string `json:"method"`
+	Destination string `json:"destination"`
+
+	// Further detail, such as the reason for a denial.
+	Reason string `json:"reason,omitempty"`
+}
+
+// DecisionAuditLog returns a function suitable for Proxy.AuditDecision,
+// which appends every record to w as a line of JSON. Like CertAuditLog, it
+// serializes writes and ignores errors.
+func DecisionAuditLog(w io.Writer) func(r *DecisionRecord) {
+	write := jsonLines(w)
+	return func(r *DecisionRecord) { write(r) }
+}
+
+// jsonLines returns a function appending values to w as lines of JSON.
+func jsonLines(w io.Writer) func(v interface{}) {
+	var mu sync.Mutex
+
+	return func(v interface{}) {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		w.Write(append(line, '\n'))
+		mu.Unlock()
+	}
+}
+
+// audit reports a freshly forged certificate to p.AuditCertificate.
+func (p *Proxy) audit(host string, cert, ca *x509.Certificate) {
+	key := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	auth := sha256.Sum256(ca.Raw)
+
+	r := &CertRecord{
+		Time:          time.Now(),
+		Host:          host,
+		DNSNames:      cert.DNSNames,
+		Serial:        cert.SerialNumber.Text(16),
+		NotBefore:     cert.NotBefore,
+		NotAfter:      cert.NotAfter,
+		KeyHash:       hex.EncodeToString(key[:]),
+		AuthorityHash: hex.EncodeToString(auth[:]),
+	}
+
+	for _, ip := range cert.IPAddresses {
+		r.IPAddresses = append(r.IPAddresses, ip.String())
+	}
+
+	p.AuditCertificate(r)
+}
+
+// decide reports a decision about a request (or, if req is nil, a tunnel to
+// addr) to p.AuditDecision. The record's common fields are filled in.
+func (p *Proxy) decide(s *Session, req *heat.Request, addr string, r *DecisionRecord) {
+	if p.AuditDecision == nil {
+		return
+	}
+
+	r.Time = p.clock().Now()
+
+	if s != nil {
+		r.User = s.User
+		if s.ClientAddr != nil {
+			r.Client = s.ClientAddr.String()
+		}
+	}
+
+	if req == nil {
+		r.Method, r.Destination = "CONNECT", addr
+	} else if u := requestURL(req); u != nil && req.Remote != "" {
+		r.Method, r.Destination = req.Method, p.Redact.URL(u.String())
+	} else {
+		r.Method, r.Destination = req.Method, p.Redact.URL(req.URI)
+	}
+
+	p.AuditDecision(r)
+}
+
+// decideDeny reports that a request or tunnel was refused with err.
+func (p *Proxy) decideDeny(s *Session, req *heat.Request, addr, rule string, m *Match, err error) {
+	p.decide(s, req, addr, &DecisionRecord{Action: "deny", Rule: rule, Pattern: m.String(), Reason: err.Error()})
+}
@@ -0,0 +1,163 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestAuditCertificate(t *testing.T) {
+	ca, cfg := testAuthority(t)
+	cfg.ServerName = "example.com"
+
+	var buf bytes.Buffer
+	write := relay.CertAuditLog(&buf)
+
+	records := make(chan *relay.CertRecord, 1)
+	p := &relay.Proxy{
+		Authority: ca,
+		AuditCertificate: func(r *relay.CertRecord) {
+			write(r)
+			records <- r
+		},
+	}
+
+	conn, err := connect(t, p, "example.com:443", cfg)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	r := <-records
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	key := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	auth := sha256.Sum256(ca.Certificate[0])
+
+	switch {
+	case r.Host != "example.com":
+		t.Errorf("got host %q", r.Host)
+	case r.Serial != leaf.SerialNumber.Text(16):
+		t.Errorf("got serial %s, want %x", r.Serial, leaf.SerialNumber)
+	case !r.NotBefore.Equal(leaf.NotBefore) || !r.NotAfter.Equal(leaf.NotAfter):
+		t.Errorf("got validity %v to %v, want %v to %v", r.NotBefore, r.NotAfter, leaf.NotBefore, leaf.NotAfter)
+	case r.KeyHash != hex.EncodeToString(key[:]):
+		t.Errorf("key hash doesn't match the presented certificate")
+	case r.AuthorityHash != hex.EncodeToString(auth[:]):
+		t.Errorf("authority hash doesn't match the signing certificate")
+	}
+
+	// The log holds the same record, as a line of JSON.
+	var logged relay.CertRecord
+	if err := json.Unmarshal(buf.Bytes(), &logged); err != nil {
+		t.Fatalf("parsing %q: %v", buf.Bytes(), err)
+	}
+	if logged.Serial != r.Serial || logged.KeyHash != r.KeyHash || !bytes.HasSuffix(buf.Bytes(), []byte("}\n")) {
+		t.Errorf("logged %q", buf.Bytes())
+	}
+}
+
+func TestAuditDecisions(t *testing.T) {
+	origin, err := relay.ParseMatch("host=origin.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var buf bytes.Buffer
+	var records []*relay.DecisionRecord
+	write := relay.DecisionAuditLog(&buf)
+
+	p := &relay.Proxy{
+		Auth:  &relay.ProxyAuth{Basic: func(user, password string) bool { return true }},
+		Users: relay.UserPolicies{"alice": {Allow: origin}},
+		HeaderRules: []relay.HeaderRule{
+			{Request: true, Match: origin, Action: relay.RemoveHeader, Name: "Cookie"},
+		},
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			if strings.HasSuffix(req.URI, "/blocked") {
+				resp := heat.NewResponse(403, "Blocked")
+				resp.Fields.Set("Content-Length", "0")
+				return resp
+			}
+			return nil
+		},
+		OnConnect: func(s *relay.Session, req *heat.Request) *heat.Response {
+			resp := heat.NewResponse(403, "No Tunnels")
+			resp.Fields.Set("Content-Length", "0")
+			return resp
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			return resp, nil
+		},
+		AuditDecision: func(r *relay.DecisionRecord) {
+			write(r)
+			mu.Lock()
+			records = append(records, r)
+			mu.Unlock()
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	auth := "Proxy-Authorization: " + basic("alice", "x") + "\r\n"
+	for _, req := range []string{
+		"GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\nCookie: a=b\r\n" + auth + "\r\n",
+		"GET http://other.test/ HTTP/1.1\r\nHost: other.test\r\n\r\n",
+		"GET http://origin.test/blocked HTTP/1.1\r\nHost: origin.test\r\n\r\n",
+		"CONNECT origin.test:443 HTTP/1.1\r\nHost: origin.test:443\r\n\r\n",
+	} {
+		io.WriteString(conn, req)
+		resp := readFinal(t, conn, r)
+		io.ReadAll(resp.Body)
+	}
+
+	want := []string{
+		"rewrite HeaderRules[0] host=origin.test GET http://origin.test/ request remove Cookie",
+		"allow Users host=origin.test GET http://origin.test/ ",
+		"deny Users host=origin.test GET http://other.test/ relay: denied: alice may not access other.test",
+		"rewrite HeaderRules[0] host=origin.test GET http://origin.test/blocked request remove Cookie",
+		"deny OnRequest  GET http://origin.test/blocked Blocked",
+		"allow Users host=origin.test CONNECT origin.test:443 ",
+		"deny OnConnect  CONNECT origin.test:443 No Tunnels",
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var got []string
+	for _, r := range records {
+		got = append(got, strings.Join([]string{r.Action, r.Rule, r.Pattern, r.Method, r.Destination, r.Reason}, " "))
+		if r.User != "alice" || r.Client == "" || r.Time.IsZero() {
+			t.Errorf("record lacks common fields: %+v", r)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got records:\n%q\nwant:\n%q", got, want)
+	}
+
+	// The log holds the same records, as lines of JSON.
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(records) {
+		t.Fatalf("logged %d lines for %d records", len(lines), len(records))
+	}
+	var logged relay.DecisionRecord
+	if err := json.Unmarshal([]byte(lines[2]), &logged); err != nil {
+		t.Fatalf("parsing %q: %v", lines[2], err)
+	}
+	if logged.Action != "deny" || logged.Destination != "http://other.test/" || logged.User != "alice" {
+		t.Errorf("logged %q", lines[2])
+	}
+}
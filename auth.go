@@ -0,0 +1,159 @@
+package relay
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// A ProxyAuth makes clients authenticate themselves to the proxy before
+// making requests or opening tunnels. Authentication is per connection; the
+// authenticated user is reported by Session.User.
+type ProxyAuth struct {
+	// Realm sent in Basic and Bearer challenges. Defaults to "relay".
+	Realm string
+
+	// Optional function checking credentials sent using the Basic scheme.
+	// If nil, the Basic scheme isn't offered.
+	Basic func(user, password string) bool
+
+	// Optional GSSAPI implementation used to accept credentials sent using
+	// the Negotiate (SPNEGO) scheme, typically Kerberos tickets. If nil,
+	// the Negotiate scheme isn't offered.
+	Negotiate GSSAPI
+
+	// Optional validator for JSON Web Tokens sent using the Bearer scheme.
+	// The token's claims are reported by Session.Claims, and clients must
+	// authenticate again once it expires. If nil, the Bearer scheme isn't
+	// offered.
+	Bearer *JWTValidator
+}
+
+// A GSSAPI implementation accepts security contexts initiated by clients
+// using SPNEGO, verifying their Kerberos (or other) credentials. It lets the
+// Negotiate scheme be backed by anything from a pure Go Kerberos library to
+// the system's GSSAPI library.
+type GSSAPI interface {
+	// AcceptContext begins accepting a new security context.
+	AcceptContext() (GSSContext, error)
+}
+
+// A GSSContext is a security context being established with a client.
+type GSSContext interface {
+	// Step processes a token sent by the client. It returns a token to send
+	// back, which may be nil, and once the context has been established,
+	// the name of the authenticated client principal. Tokens returned along
+	// with a name are discarded, so mutual authentication isn't supported.
+	Step(token []byte) (out []byte, user string, err error)
+}
+
+// authenticate checks a client's credentials, if p.Auth is set and the
+// session isn't authenticated yet. It returns the response with which the
+// request should be rejected, or nil to let it through.
+func (p *Proxy) authenticate(s *Session, req *heat.Request) *heat.Response {
+	a := p.Auth
+	if a == nil || (s.User != "" && (s.authExpiry.IsZero() || time.Now().Before(s.authExpiry))) {
+		return nil
+	}
+	s.User, s.Claims, s.authExpiry = "", nil, time.Time{}
+
+	value, _ := fieldValue(req.Fields, "Proxy-Authorization")
+	scheme, creds := value, ""
+	if i := strings.IndexByte(value, ' '); i >= 0 {
+		scheme, creds = value[:i], strings.TrimSpace(value[i+1:])
+	}
+
+	switch {
+	case strings.EqualFold(scheme, "Basic") && a.Basic != nil:
+		raw, err := base64.StdEncoding.DecodeString(creds)
+		if err != nil {
+			break
+		}
+
+		user, pass, _ := strings.Cut(string(raw), ":")
+		if user != "" && a.Basic(user, pass) {
+			s.User = user
+			return nil
+		}
+
+	case strings.EqualFold(scheme, "Negotiate") && a.Negotiate != nil:
+		token, err := base64.StdEncoding.DecodeString(creds)
+		if err != nil {
+			s.gss = nil
+			break
+		}
+
+		if s.gss == nil {
+			if s.gss, err = a.Negotiate.AcceptContext(); err != nil {
+				return statusResponse(500, "Can't authenticate: %s.", err)
+			}
+		}
+
+		out, user, err := s.gss.Step(token)
+		if err != nil {
+			s.gss = nil
+			break
+		}
+
+		if user != "" {
+			s.User, s.gss = user, nil
+			return nil
+		}
+
+		// More rounds are needed.
+		return p.authChallenge(out)
+
+	case strings.EqualFold(scheme, "Bearer") && a.Bearer != nil:
+		ctx, cancel := context.WithTimeout(s.Context(), 10*time.Second)
+		claims, err := a.Bearer.Validate(ctx, creds)
+		cancel()
+		if err != nil {
+			break
+		}
+
+		s.User, s.Claims = a.Bearer.user(claims), claims
+		s.authExpiry = a.Bearer.expiry(claims)
+		return nil
+	}
+
+	return p.authChallenge(nil)
+}
+
+// authChallenge returns a "407 Proxy Authentication Required" response. It
+// continues a Negotiate exchange if token is non-nil, and offers the
+// configured authentication schemes otherwise.
+func (p *Proxy) authChallenge(token []byte) *heat.Response {
+	resp := statusResponse(407, "Proxy authentication required.")
+
+	// Leave the connection open, as Negotiate authenticates connections.
+	resp.Fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Connection")
+	})
+
+	if token != nil {
+		resp.Fields.Add("Proxy-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(token))
+		return resp
+	}
+
+	if p.Auth.Negotiate != nil {
+		resp.Fields.Add("Proxy-Authenticate", "Negotiate")
+	}
+
+	realm := p.Auth.Realm
+	if realm == "" {
+		realm = "relay"
+	}
+
+	if p.Auth.Bearer != nil {
+		resp.Fields.Add("Proxy-Authenticate", `Bearer realm="`+realm+`"`)
+	}
+
+	if p.Auth.Basic != nil {
+		resp.Fields.Add("Proxy-Authenticate", `Basic realm="`+realm+`"`)
+	}
+
+	return resp
+}
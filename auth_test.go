@@ -0,0 +1,221 @@
+package relay_test
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func basic(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func TestBasicAuth(t *testing.T) {
+	seen := make(chan *http.Request, 2)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		seen <- req
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	users := make(chan string, 2)
+	p := &relay.Proxy{
+		Auth: &relay.ProxyAuth{
+			Realm: "corp",
+			Basic: func(user, password string) bool {
+				return user == "alice" && password == "secret"
+			},
+		},
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			users <- s.User
+			return nil
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	send := func(auth string) *http.Response {
+		t.Helper()
+		if auth != "" {
+			auth = "Proxy-Authorization: " + auth + "\r\n"
+		}
+		io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n"+auth+"\r\n")
+		resp := readFinal(t, conn, r)
+		io.ReadAll(resp.Body)
+		return resp
+	}
+
+	// Clients are challenged until they present valid credentials, without
+	// the connection being closed.
+	for _, auth := range []string{"", basic("alice", "wrong"), "Basic !!!"} {
+		resp := send(auth)
+		if resp.StatusCode != 407 || resp.Close {
+			t.Fatalf("got status %d (closing: %v) for %q, want 407", resp.StatusCode, resp.Close, auth)
+		}
+		if got := resp.Header.Get("Proxy-Authenticate"); got != `Basic realm="corp"` {
+			t.Errorf("got challenge %q", got)
+		}
+	}
+
+	// Once authenticated, the connection stays authenticated.
+	for _, auth := range []string{basic("alice", "secret"), ""} {
+		if resp := send(auth); resp.StatusCode != 200 {
+			t.Fatalf("got status %d after authenticating", resp.StatusCode)
+		}
+		if user := <-users; user != "alice" {
+			t.Errorf("session user is %q, want alice", user)
+		}
+		if req := <-seen; req.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("credentials were forwarded upstream")
+		}
+	}
+}
+
+func TestAuthConnect(t *testing.T) {
+	p := &relay.Proxy{
+		Auth: &relay.ProxyAuth{Basic: func(user, password string) bool { return false }},
+	}
+
+	conn := serve(t, p)
+	io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 407 {
+		t.Errorf("got status %d for an unauthenticated tunnel, want 407", resp.StatusCode)
+	}
+}
+
+// The fakeGSSAPI type accepts contexts which take two rounds to establish.
+type fakeGSSAPI struct{}
+
+func (fakeGSSAPI) AcceptContext() (relay.GSSContext, error) {
+	return new(fakeGSSContext), nil
+}
+
+type fakeGSSContext struct {
+	round int
+}
+
+func (c *fakeGSSContext) Step(token []byte) ([]byte, string, error) {
+	c.round++
+	switch {
+	case c.round == 1 && string(token) == "hello":
+		return []byte("challenge"), "", nil
+	case c.round == 2 && string(token) == "response":
+		return nil, "bob@CORP.EXAMPLE", nil
+	}
+	return nil, "", errors.New("bad token")
+}
+
+func TestNegotiateAuth(t *testing.T) {
+	users := make(chan string, 1)
+	p := &relay.Proxy{
+		Auth: &relay.ProxyAuth{Negotiate: fakeGSSAPI{}},
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			users <- s.User
+			return heat.NewResponse(204, "No Content")
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	send := func(token string) *http.Response {
+		t.Helper()
+		auth := ""
+		if token != "" {
+			auth = "Proxy-Authorization: Negotiate " + base64.StdEncoding.EncodeToString([]byte(token)) + "\r\n"
+		}
+		io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n"+auth+"\r\n")
+		resp := readFinal(t, conn, r)
+		io.ReadAll(resp.Body)
+		return resp
+	}
+
+	steps := []struct {
+		token     string
+		status    int
+		challenge string
+	}{
+		{"", 407, "Negotiate"},
+		{"bogus", 407, "Negotiate"},
+		{"hello", 407, "Negotiate " + base64.StdEncoding.EncodeToString([]byte("challenge"))},
+		{"response", 204, ""},
+	}
+
+	for _, step := range steps {
+		resp := send(step.token)
+		if resp.StatusCode != step.status {
+			t.Fatalf("%q: got status %d, want %d", step.token, resp.StatusCode, step.status)
+		}
+		if got := resp.Header.Get("Proxy-Authenticate"); got != step.challenge {
+			t.Errorf("%q: got challenge %q, want %q", step.token, got, step.challenge)
+		}
+	}
+
+	if user := <-users; user != "bob@CORP.EXAMPLE" {
+		t.Errorf("session user is %q", user)
+	}
+}
+
+func TestBearerThenBasicAuth(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p := &relay.Proxy{
+		Auth: &relay.ProxyAuth{
+			Basic: func(user, password string) bool {
+				return user == "alice" && password == "secret"
+			},
+			Bearer: &relay.JWTValidator{
+				Keys:   map[string]crypto.PublicKey{"k": key.Public()},
+				Leeway: time.Millisecond,
+			},
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	send := func(auth string) int {
+		t.Helper()
+		if auth != "" {
+			auth = "Proxy-Authorization: " + auth + "\r\n"
+		}
+		io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n"+auth+"\r\n")
+		resp := readFinal(t, conn, r)
+		io.ReadAll(resp.Body)
+		return resp.StatusCode
+	}
+
+	exp := time.Now().Add(time.Second).Truncate(time.Second)
+	token := signJWT(t, "ES256", crypto.SHA256, key, "k", map[string]interface{}{"sub": "bob", "exp": exp.Unix()})
+	if code := send("Bearer " + token); code != 200 {
+		t.Fatalf("got status %d for a valid token", code)
+	}
+
+	time.Sleep(time.Until(exp.Add(10 * time.Millisecond)))
+	if code := send(""); code != 407 {
+		t.Fatalf("got status %d once the token expired, want 407", code)
+	}
+
+	// Credentials which don't expire keep the connection authenticated,
+	// regardless of the token which came before them.
+	for _, auth := range []string{basic("alice", "secret"), ""} {
+		if code := send(auth); code != 200 {
+			t.Fatalf("got status %d after authenticating with Basic", code)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package relay
+
+import (
+	"crypto/tls"
+)
+
+// An AuthorityRule picks the certificate authority which signs forged
+// certificates for some tunnels, in place of Proxy.Authority.
+type AuthorityRule struct {
+	// Tunnels the rule applies to. Only host and client conditions are
+	// considered (see Match.Connect). If nil, all tunnels match.
+	Match *Match
+
+	// The signing certificate to use.
+	Authority *tls.Certificate
+}
+
+// selectAuthority returns the certificate authority which should sign
+// certificates for a tunnel to addr, requested in session s.
+func (p *Proxy) selectAuthority(s *Session, addr string) *tls.Certificate {
+	for _, r := range p.Authorities {
+		if r.Match.Connect(s, addr) {
+			return r.Authority
+		}
+	}
+	return p.authority()
+}
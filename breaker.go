@@ -0,0 +1,184 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned for requests to an upstream host whose circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("relay: upstream circuit breaker is open")
+
+// A CircuitState describes the state of the circuit breaker for one host.
+type CircuitState int
+
+const (
+	// Requests are forwarded as usual.
+	CircuitClosed CircuitState = iota
+
+	// Requests fail immediately with ErrCircuitOpen.
+	CircuitOpen
+
+	// A single probe request is let through. If it succeeds the circuit
+	// closes; otherwise it opens again.
+	CircuitHalfOpen
+)
+
+// A CircuitBreaker stops forwarding requests to upstream hosts which keep
+// failing, sparing both the proxy and the host from a storm of doomed
+// requests. All methods are safe for concurrent use.
+type CircuitBreaker struct {
+	// Number of consecutive failures (dial errors, TLS and protocol errors,
+	// and timeouts) after which a host's circuit opens. Zero means 5.
+	Failures int
+
+	// How long a circuit stays open before a probe request is let through.
+	// Zero means 30 seconds.
+	Cooldown time.Duration
+
+	// Optional function called whenever a host's circuit changes state.
+	// Called with the breaker's lock held; it must not call its methods.
+	OnChange func(host string, state CircuitState)
+
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+type circuit struct {
+	state    CircuitState
+	failures int
+	opened   time.Time
+	probing  bool
+}
+
+// State returns the state of a host's circuit.
+func (cb *CircuitBreaker) State(host string) CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if c := cb.hosts[strings.ToLower(host)]; c != nil {
+		return c.state
+	}
+	return CircuitClosed
+}
+
+// Reset closes a host's circuit.
+func (cb *CircuitBreaker) Reset(host string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	host = strings.ToLower(host)
+	if c := cb.hosts[host]; c != nil {
+		delete(cb.hosts, host)
+		if c.state != CircuitClosed {
+			cb.changed(host, CircuitClosed)
+		}
+	}
+}
+
+// allow decides whether a request to host may be forwarded. If it returns
+// true, the outcome must be reported with done.
+func (cb *CircuitBreaker) allow(host string) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c := cb.hosts[strings.ToLower(host)]
+	if c == nil {
+		return true
+	}
+
+	switch c.state {
+	case CircuitOpen:
+		cooldown := cb.Cooldown
+		if cooldown <= 0 {
+			cooldown = 30 * time.Second
+		}
+		if time.Since(c.opened) < cooldown {
+			return false
+		}
+		c.state = CircuitHalfOpen
+		cb.changed(strings.ToLower(host), CircuitHalfOpen)
+		fallthrough
+
+	case CircuitHalfOpen:
+		if c.probing {
+			return false
+		}
+		c.probing = true
+	}
+
+	return true
+}
+
+// done records the outcome of a request to host.
+func (cb *CircuitBreaker) done(host string, err error) {
+	host = strings.ToLower(host)
+	failed := upstreamFailure(err)
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	c := cb.hosts[host]
+
+	// A canceled request says nothing about the host.
+	if errors.Is(err, context.Canceled) {
+		if c != nil {
+			c.probing = false
+		}
+		return
+	}
+
+	if !failed {
+		if c != nil {
+			delete(cb.hosts, host)
+			if c.state != CircuitClosed {
+				cb.changed(host, CircuitClosed)
+			}
+		}
+		return
+	}
+
+	if c == nil {
+		if cb.hosts == nil {
+			cb.hosts = make(map[string]*circuit)
+		}
+		c = &circuit{}
+		cb.hosts[host] = c
+	}
+
+	c.failures++
+	c.probing = false
+
+	max := cb.Failures
+	if max <= 0 {
+		max = 5
+	}
+
+	if c.state == CircuitHalfOpen || (c.state == CircuitClosed && c.failures >= max) {
+		c.state = CircuitOpen
+		c.opened = time.Now()
+		cb.changed(host, CircuitOpen)
+	}
+}
+
+func (cb *CircuitBreaker) changed(host string, state CircuitState) {
+	if cb.OnChange != nil {
+		cb.OnChange(host, state)
+	}
+}
+
+// upstreamFailure reports whether an error suggests something is wrong with
+// the upstream server, as opposed to the request or the client.
+func upstreamFailure(err error) bool {
+	var (
+		dial     *DialError
+		tls      *TLSHandshakeError
+		protocol *UpstreamProtocolError
+	)
+
+	return errors.As(err, &dial) || errors.As(err, &tls) || errors.As(err, &protocol) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
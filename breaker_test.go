@@ -0,0 +1,182 @@
+package relay_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	live := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	// The upstream server is down until told otherwise.
+	var up atomic.Bool
+	var dials atomic.Int32
+
+	var mu sync.Mutex
+	var changes []relay.CircuitState
+
+	cb := &relay.CircuitBreaker{
+		Failures: 2,
+		Cooldown: 50 * time.Millisecond,
+		OnChange: func(host string, state relay.CircuitState) {
+			if host != "origin.test" {
+				t.Errorf("state change reported for %q", host)
+			}
+			mu.Lock()
+			changes = append(changes, state)
+			mu.Unlock()
+		},
+	}
+
+	p := &relay.Proxy{
+		Breaker: cb,
+		Transport: &relay.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				dials.Add(1)
+				if up.Load() {
+					return net.Dial(network, live)
+				}
+				return net.Dial(network, dead)
+			},
+		},
+	}
+
+	get := func() int {
+		t.Helper()
+		conn := serve(t, p)
+		io.WriteString(conn, "GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		return readFinal(t, conn, bufio.NewReader(conn)).StatusCode
+	}
+
+	// Consecutive failures open the circuit...
+	for i := 0; i < 2; i++ {
+		if status := get(); status != 502 {
+			t.Fatalf("got status %d, want 502", status)
+		}
+	}
+	if state := cb.State("origin.test"); state != relay.CircuitOpen {
+		t.Fatalf("circuit in state %d after failures", state)
+	}
+
+	// ...after which requests fail without being forwarded.
+	if status := get(); status != 502 || dials.Load() != 2 {
+		t.Errorf("got status %d after %d dials, want 502 after 2", status, dials.Load())
+	}
+
+	// Once the cooldown has passed, a successful probe closes it again.
+	up.Store(true)
+	time.Sleep(60 * time.Millisecond)
+
+	if status := get(); status != 200 {
+		t.Errorf("probe got status %d", status)
+	}
+	if state := cb.State("origin.test"); state != relay.CircuitClosed {
+		t.Errorf("circuit in state %d after recovery", state)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []relay.CircuitState{relay.CircuitOpen, relay.CircuitHalfOpen, relay.CircuitClosed}
+	if fmt.Sprint(changes) != fmt.Sprint(want) {
+		t.Errorf("got state changes %v, want %v", changes, want)
+	}
+}
+
+func TestCircuitBreakerLocalFailures(t *testing.T) {
+	live := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+
+	match := func(expr string) *relay.Match {
+		m, err := relay.ParseMatch(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	// Requests failing before they're sent, each of which would be the
+	// probe of a half-open circuit.
+	for _, tt := range []struct {
+		name    string
+		request string
+	}{
+		{"scan", "POST http://origin.test/scan HTTP/1.1\r\nHost: origin.test\r\nContent-Length: 4\r\n\r\nFAIL"},
+		{"sign", "GET http://origin.test/sign HTTP/1.1\r\nHost: origin.test\r\n\r\n"},
+		{"shape", "GET http://origin.test/shape HTTP/1.1\r\nHost: origin.test\r\nX-Timeout: 10ms\r\n\r\n"},
+	} {
+		var up atomic.Bool
+		cb := &relay.CircuitBreaker{Failures: 1, Cooldown: 20 * time.Millisecond}
+
+		p := &relay.Proxy{
+			Breaker:       cb,
+			TimeoutHeader: "X-Timeout",
+			Shaping: []relay.ShapingRule{{
+				Match:   match("path=/shape"),
+				Profile: relay.NetworkProfile{Latency: time.Minute},
+			}},
+			ScanRules: []relay.ScanRule{{Match: match("path=/scan"), Scanner: eicar, Requests: true}},
+			Signing: []relay.SigningRule{{
+				Match:  match("path=/sign"),
+				Signer: &relay.HMACSigner{KeyID: "k", Key: []byte("key"), Headers: []string{"x-tenant"}},
+			}},
+			Transport: &relay.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					if up.Load() {
+						return net.Dial(network, live)
+					}
+					return net.Dial(network, dead)
+				},
+			},
+		}
+
+		send := func(request string) int {
+			t.Helper()
+			conn := serve(t, p)
+			io.WriteString(conn, request)
+			return readFinal(t, conn, bufio.NewReader(conn)).StatusCode
+		}
+
+		const get = "GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n\r\n"
+		if status := send(get); status != 502 || cb.State("origin.test") != relay.CircuitOpen {
+			t.Fatalf("%s: got status %d, circuit in state %d", tt.name, status, cb.State("origin.test"))
+		}
+		time.Sleep(30 * time.Millisecond)
+
+		if status := send(tt.request); status == 200 {
+			t.Errorf("%s: request forwarded", tt.name)
+		}
+
+		// The failed request didn't use up the probe.
+		up.Store(true)
+		if status := send(get); status != 200 || cb.State("origin.test") != relay.CircuitClosed {
+			t.Errorf("%s: probe got status %d, circuit in state %d", tt.name, status, cb.State("origin.test"))
+		}
+	}
+}
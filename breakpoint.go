@@ -0,0 +1,190 @@
+package relay
+
+import (
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/erkl/heat"
+)
+
+// A Breakpoint describes exchanges to be paused, and handed to an external
+// controller through Proxy.Paused before they may continue.
+type Breakpoint struct {
+	// Whether to pause before forwarding the request, and before sending the
+	// response back to the client, respectively.
+	Request  bool
+	Response bool
+
+	// Requests the breakpoint applies to. If nil, all requests match.
+	Match *Match
+}
+
+// A Pause is an exchange stopped at a breakpoint. The controller may modify
+// Request (and Response, when pausing at a response) freely, including their
+// bodies, before calling either Continue or Reply. If a body is replaced, its
+// framing header fields are fixed up automatically.
+type Pause struct {
+	Session  *Session
+	Request  *heat.Request
+	Response *heat.Response
+
+	once    sync.Once
+	decided chan *heat.Response
+}
+
+// Continue lets the exchange carry on, using the (possibly edited) Request
+// or Response.
+func (pz *Pause) Continue() {
+	pz.decide(nil)
+}
+
+// Reply ends the exchange, sending resp to the client.
+func (pz *Pause) Reply(resp *heat.Response) {
+	pz.decide(resp)
+}
+
+func (pz *Pause) decide(resp *heat.Response) {
+	pz.once.Do(func() {
+		pz.decided <- resp
+	})
+}
+
+// breakpoint reports whether an exchange should be paused, either at the
+// request or at the response.
+func (p *Proxy) breakpoint(s *Session, req *heat.Request, response bool) bool {
+	if p.Paused == nil {
+		return false
+	}
+
+	for i := range p.Breakpoints {
+		b := &p.Breakpoints[i]
+		if (response && b.Response || !response && b.Request) && b.Match.Request(s, req) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pauseRequest pauses a request if it matches any breakpoints. Returns a
+// non-nil response if the controller chose to reply.
+func (p *Proxy) pauseRequest(s *Session, req *heat.Request) (*heat.Response, error) {
+	if !p.breakpoint(s, req, false) {
+		return nil, nil
+	}
+
+	pz := &Pause{Session: s, Request: cloneRequest(req)}
+
+	if req.Body != nil {
+		sp, err := s.SpoolRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		pz.Request.Body = sp.Open()
+	}
+
+	body := pz.Request.Body
+
+	resp, err := p.pause(s, pz)
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	*req = *pz.Request
+
+	if req.Body != body {
+		return nil, s.reframe(&req.Fields, &req.Body)
+	}
+
+	return nil, nil
+}
+
+// pauseResponse pauses a response if it matches any breakpoints, returning
+// the response to use in its place.
+func (p *Proxy) pauseResponse(s *Session, req *heat.Request, resp *heat.Response) (*heat.Response, error) {
+	if resp.Status == 101 || !p.breakpoint(s, req, true) {
+		return resp, nil
+	}
+
+	pz := &Pause{Session: s, Request: cloneRequest(req), Response: cloneResponse(resp)}
+
+	if resp.Body != nil {
+		sp, err := s.SpoolResponse(resp)
+		if err != nil {
+			return nil, err
+		}
+		pz.Response.Body = sp.Open()
+	}
+
+	body := pz.Response.Body
+
+	reply, err := p.pause(s, pz)
+	if err != nil {
+		return nil, err
+	}
+	if reply != nil {
+		return reply, nil
+	}
+
+	if pz.Response.Body != body {
+		if err := s.reframe(&pz.Response.Fields, &pz.Response.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	return pz.Response, nil
+}
+
+// pause hands a Pause to the controller, and waits for its decision. Gives
+// up if the request's context is done first, such as when its deadline
+// passes.
+func (p *Proxy) pause(s *Session, pz *Pause) (*heat.Response, error) {
+	pz.decided = make(chan *heat.Response, 1)
+	ctx := s.Context()
+
+	select {
+	case p.Paused <- pz:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case resp := <-pz.decided:
+		if resp != nil && resp.Body != nil {
+			if err := s.reframe(&resp.Fields, &resp.Body); err != nil {
+				return nil, err
+			}
+		}
+		return resp, nil
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// reframe spools a message body, and sets the message's Content-Length to
+// match, so it's safe to send on keep-alive connections.
+func (s *Session) reframe(fields *heat.Fields, body *io.ReadCloser) error {
+	if *body == nil {
+		fields.Filter(func(f heat.Field) bool {
+			return !f.Is("Transfer-Encoding")
+		})
+		fields.Set("Content-Length", "0")
+		return nil
+	}
+
+	sp, err := s.spool(*body)
+	if err != nil {
+		return err
+	}
+
+	*body = sp.Open()
+
+	fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Transfer-Encoding")
+	})
+	fields.Set("Content-Length", strconv.FormatInt(sp.Size(), 10))
+
+	return nil
+}
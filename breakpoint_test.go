@@ -0,0 +1,128 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestBreakpointEditRequest(t *testing.T) {
+	seen := make(chan string, 1)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		seen <- req.Header.Get("X-Edited") + " " + req.Header.Get("Content-Length") + " " + string(body)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	paused := make(chan *relay.Pause)
+	p := &relay.Proxy{
+		Breakpoints: []relay.Breakpoint{{Request: true}},
+		Paused:      paused,
+	}
+
+	go func() {
+		pz := <-paused
+		body, _ := io.ReadAll(pz.Request.Body)
+		pz.Request.Fields.Set("X-Edited", "yes")
+		pz.Request.Body = io.NopCloser(strings.NewReader(strings.ToUpper(string(body)) + "!"))
+		pz.Continue()
+	}()
+
+	conn := serve(t, p)
+	io.WriteString(conn, "POST http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n"+
+		"Transfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n")
+
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 200 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if got := <-seen; got != "yes 6 HELLO!" {
+		t.Errorf("upstream got %q, want the edited request", got)
+	}
+}
+
+func TestBreakpointEditResponse(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello")
+	})
+
+	match, err := (&relay.Matcher{PathPrefix: "/pause"}).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paused := make(chan *relay.Pause, 1)
+	p := &relay.Proxy{
+		Breakpoints: []relay.Breakpoint{{Response: true, Match: match}},
+		Paused:      paused,
+	}
+
+	go func() {
+		pz := <-paused
+		pz.Response.Status = 418
+		pz.Response.Body = io.NopCloser(strings.NewReader("edited"))
+		pz.Continue()
+	}()
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	// Only the matching request is paused, and the edited response keeps
+	// the connection usable.
+	for _, tt := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/pause", 418, "edited"},
+		{"/other", 200, "hello"},
+	} {
+		io.WriteString(conn, "GET http://"+addr+tt.path+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		body, _ := io.ReadAll(resp.Body)
+
+		if resp.StatusCode != tt.status || string(body) != tt.body {
+			t.Errorf("%s: got %d %q, want %d %q", tt.path, resp.StatusCode, body, tt.status, tt.body)
+		}
+	}
+}
+
+func TestBreakpointReply(t *testing.T) {
+	forwarded := make(chan struct{}, 1)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		forwarded <- struct{}{}
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	paused := make(chan *relay.Pause)
+	p := &relay.Proxy{
+		Breakpoints: []relay.Breakpoint{{Request: true}},
+		Paused:      paused,
+	}
+
+	go func() {
+		resp := heat.NewResponse(403, "Forbidden")
+		resp.Body = io.NopCloser(strings.NewReader("no"))
+		(<-paused).Reply(resp)
+	}()
+
+	conn := serve(t, p)
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != 403 || string(body) != "no" {
+		t.Errorf("got %d %q, want the controller's reply", resp.StatusCode, body)
+	}
+	select {
+	case <-forwarded:
+		t.Errorf("request forwarded despite the reply")
+	default:
+	}
+}
@@ -0,0 +1,51 @@
+package relay
+
+import (
+	"context"
+
+	"github.com/erkl/heat"
+)
+
+// The bridgeKey type marks the contexts of requests forwarded in bridge mode
+// (see Proxy.Bridge), so that the transport leaves them alone.
+type bridgeKey struct{}
+
+func withBridge(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bridgeKey{}, true)
+}
+
+func bridging(ctx context.Context) bool {
+	b, _ := ctx.Value(bridgeKey{}).(bool)
+	return b
+}
+
+// bridgeRequest prepares a request received in plain HTTP for forwarding in
+// bridge mode, removing only the header fields addressed to the proxy
+// itself.
+func bridgeRequest(req *heat.Request) {
+	req.Fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Proxy-Authorization") && !f.Is("Proxy-Connection")
+	})
+}
+
+// bridgeConnection decides whether the client's connection is to be closed
+// after a response relayed in bridge mode, given whether it could be kept
+// open. The response's Connection field is only changed when it doesn't
+// already imply the outcome.
+func bridgeConnection(resp *heat.Response, method string, keep bool) bool {
+	if heat.Closing(resp.Major, resp.Minor, resp.Fields) {
+		return true
+	}
+
+	// Bodies delimited by closing the connection need no announcement.
+	if size, err := heat.ResponseBodySize(resp, method); err == nil && size == heat.Unbounded {
+		return true
+	}
+
+	if !keep {
+		resp.Fields.Set("Connection", "close")
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,77 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+// readHead reads a message's header from r, as it was sent.
+func readHead(r *bufio.Reader) string {
+	var head strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		head.WriteString(line)
+		if err != nil || line == "\r\n" {
+			return head.String()
+		}
+	}
+}
+
+func TestBridge(t *testing.T) {
+	received := make(chan string, 1)
+	addr := rawUpstream(t, func(conn *net.TCPConn) {
+		received <- readHead(bufio.NewReader(conn))
+		io.WriteString(conn, "HTTP/1.0 200 OK\r\nX-Z: 1\r\nServer: origin\r\nX-A: 2\r\nContent-Length: 2\r\n\r\nok")
+	})
+
+	p := &relay.Proxy{Bridge: true}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := serve(t, p)
+	io.WriteString(conn, "GET http://"+addr+"/a HTTP/1.0\r\nUser-Agent: test\r\nHost: "+addr+"\r\n"+
+		"Proxy-Authorization: Basic Zm9vOmJhcg==\r\nX-B: 1\r\nProxy-Connection: keep-alive\r\nX-A: 2\r\n\r\n")
+
+	// The request is sent as HTTP/1.0, in its original order, without the
+	// fields addressed to the proxy.
+	want := "GET /a HTTP/1.0\r\nUser-Agent: test\r\nHost: " + addr + "\r\nX-B: 1\r\nX-A: 2\r\n\r\n"
+	if got := <-received; got != want {
+		t.Errorf("upstream received:\n%q\nwant:\n%q", got, want)
+	}
+
+	// The response is relayed untouched, and the connection closed.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, _ := io.ReadAll(conn)
+	if want := "HTTP/1.0 200 OK\r\nX-Z: 1\r\nServer: origin\r\nX-A: 2\r\nContent-Length: 2\r\n\r\nok"; string(got) != want {
+		t.Errorf("client received:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestBridgeClosing(t *testing.T) {
+	received := make(chan string, 1)
+	addr := rawUpstream(t, func(conn *net.TCPConn) {
+		received <- readHead(bufio.NewReader(conn))
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	})
+
+	conn := serve(t, &relay.Proxy{Bridge: true})
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\nConnection: close\r\n\r\n")
+
+	// The client's Connection field is forwarded as it is.
+	if got := <-received; !strings.Contains(got, "\r\nConnection: close\r\n") {
+		t.Errorf("upstream received %q", got)
+	}
+
+	// As the client's connection will be closed, the response says so.
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+	if !resp.Close {
+		t.Errorf("got Connection %q", resp.Header.Get("Connection"))
+	}
+}
@@ -0,0 +1,167 @@
+package relay
+
+import (
+	"io"
+	"sync"
+)
+
+// The bufferedBody type reads ahead from a message body in the background,
+// holding at most a fixed number of bytes. The sender can get ahead of the
+// receiver by that much, but no further, so a slow receiver throttles the
+// sender rather than having data pile up in memory.
+type bufferedBody struct {
+	src       io.ReadCloser
+	limit     int
+	interrupt bool
+	budget    *MemoryBudget
+
+	// If set, interrupts a read from src in progress, where interrupt is
+	// false. Called if the body is closed before src has ended.
+	stop func()
+
+	mu     sync.Mutex
+	cond   sync.Cond
+	data   []byte
+	err    error
+	closed bool
+	exited chan struct{}
+}
+
+// bufferBody starts reading ahead from a message body. If interrupt is
+// true, closing the body interrupts a read in progress rather than waiting
+// for it to complete, which the body must support: either by implementing
+// abort, or by allowing Close to be called during Read.
+func bufferBody(src io.ReadCloser, limit int, interrupt bool) *bufferedBody {
+	b := &bufferedBody{
+		src:       src,
+		limit:     limit,
+		interrupt: interrupt,
+		data:      make([]byte, 0, limit),
+		exited:    make(chan struct{}),
+	}
+
+	b.cond.L = &b.mu
+	go b.pump()
+
+	return b
+}
+
+// buffer relays a body through a buffer of p.BodyBuffer bytes, unless
+// p.Memory has no room for one. Unless interrupt is true, stop (if non-nil)
+// is called to interrupt a read in progress when the body is closed early.
+func (p *Proxy) buffer(body io.ReadCloser, interrupt bool, stop func()) io.ReadCloser {
+	if !p.Memory.reserve(MemoryBuffers, int64(p.BodyBuffer)) {
+		p.Memory.count("memory.buffers.shed", 1)
+		return body
+	}
+
+	b := bufferBody(body, p.BodyBuffer, interrupt)
+	b.budget = p.Memory
+	b.stop = stop
+	return b
+}
+
+// pump reads from the underlying body until it ends, or b is closed.
+func (b *bufferedBody) pump() {
+	defer close(b.exited)
+
+	chunk := make([]byte, min(b.limit, 32<<10))
+
+	for {
+		b.mu.Lock()
+		for len(b.data) == b.limit && !b.closed {
+			b.cond.Wait()
+		}
+		room := b.limit - len(b.data)
+		closed := b.closed
+		b.mu.Unlock()
+
+		if closed {
+			return
+		}
+
+		n, err := b.src.Read(chunk[:min(room, len(chunk))])
+
+		b.mu.Lock()
+		b.data = append(b.data, chunk[:n]...)
+		b.err = err
+		b.cond.Broadcast()
+		b.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (b *bufferedBody) Read(buf []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.data) == 0 && b.err == nil && !b.closed {
+		b.cond.Wait()
+	}
+
+	if b.closed {
+		return 0, errReadAfterClose
+	}
+	if len(b.data) == 0 {
+		return 0, b.err
+	}
+
+	n := copy(buf, b.data)
+	b.data = b.data[:copy(b.data, b.data[n:])]
+	b.cond.Broadcast()
+
+	return n, nil
+}
+
+func (b *bufferedBody) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.cond.Broadcast()
+	reading := b.err == nil
+	b.mu.Unlock()
+
+	defer b.budget.release(MemoryBuffers, int64(b.limit))
+
+	// The pump may be stuck reading from a sender which has stalled.
+	if !b.interrupt && reading && b.stop != nil {
+		b.stop()
+	}
+
+	if b.interrupt {
+		if a, ok := b.src.(aborter); ok {
+			a.abort()
+		} else {
+			err := b.src.Close()
+			<-b.exited
+			return err
+		}
+	}
+
+	<-b.exited
+	return b.src.Close()
+}
+
+// The closingBody type closes another body, such as the buffered body of
+// the request it answers, once it's closed itself.
+type closingBody struct {
+	io.ReadCloser
+	other io.Closer
+}
+
+func (b *closingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.other.Close()
+	return err
+}
+
+// An aborter is a body which can interrupt a read in progress.
+type aborter interface {
+	abort()
+}
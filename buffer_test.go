@@ -0,0 +1,82 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+func TestBufferedRequestStalledClient(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+	}{
+		{"early response", upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+			io.WriteString(conn, "HTTP/1.1 413 Payload Too Large\r\nContent-Length: 0\r\n\r\n")
+		})},
+		{"unreachable", closedAddr(t)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budget := &relay.MemoryBudget{}
+			conn := serve(t, &relay.Proxy{BodyBuffer: 1024, Memory: budget})
+			io.WriteString(conn, "POST http://"+tt.addr+"/ HTTP/1.1\r\n"+
+				"Host: "+tt.addr+"\r\n"+
+				"Content-Length: 1024\r\n\r\n"+
+				"only the first bytes")
+
+			// The rest of the body never comes.
+			resp := readFinal(t, conn, bufio.NewReader(conn))
+			if resp.StatusCode < 400 {
+				t.Fatalf("got status %d, want an error", resp.StatusCode)
+			}
+			if !resp.Close {
+				t.Errorf("connection kept alive with the request body unread")
+			}
+			waitReleased(t, budget)
+		})
+	}
+}
+
+func TestBufferedRequestReleased(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+string(body))
+	})
+
+	budget := &relay.MemoryBudget{}
+	conn := serve(t, &relay.Proxy{BodyBuffer: 1024, Memory: budget})
+	io.WriteString(conn, "POST http://"+addr+"/ HTTP/1.1\r\n"+
+		"Host: "+addr+"\r\n"+
+		"Content-Length: 5\r\n\r\n"+
+		"hello")
+
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello" {
+		t.Fatalf("got body %q, want \"hello\"", body)
+	}
+	waitReleased(t, budget)
+}
+
+// waitReleased waits for the buffers accounted for in a budget to be let go
+// of, failing the test if that takes more than a few seconds.
+func waitReleased(t *testing.T, budget *relay.MemoryBudget) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if budget.Usage(relay.MemoryBuffers) == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("%d bytes of buffers still in use", budget.Usage(relay.MemoryBuffers))
+}
@@ -0,0 +1,271 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// ErrAmbiguousURI is returned (wrapped, with details) by CanonicalURL for
+// URIs which upstream servers might interpret in different ways, such as
+// paths with encoded slashes.
+var ErrAmbiguousURI = errors.New("relay: ambiguous URI")
+
+// A URIPolicy decides how the URIs of requests are rewritten before they're
+// forwarded.
+type URIPolicy int
+
+const (
+	// Forward URIs as they were parsed, re-encoded as little as possible.
+	URIPreserve URIPolicy = iota
+
+	// Forward canonical URIs, as returned by CanonicalURL.
+	URICanonical
+
+	// Forward canonical URIs, and reject requests with ambiguous URIs with
+	// "400 Bad Request".
+	URIStrict
+)
+
+// CanonicalURL returns a copy of a URL in canonical form (see RFC 3986,
+// section 6), such that URLs which only differ in how they're written are
+// made identical:
+//
+//   - the host name is lower-cased, and the port dropped if it's the
+//     scheme's default;
+//   - percent-encoded unreserved characters (letters, digits, "-", ".",
+//     "_" and "~") are decoded, and other escapes use upper-case hex
+//     digits;
+//   - "." and ".." path segments are removed;
+//   - an empty path becomes "/".
+//
+// In strict mode, an error wrapping ErrAmbiguousURI is returned for URLs
+// whose paths contain encoded slashes, backslashes or NUL bytes, segments
+// which are encoded dot segments, ".." segments above the root, or whose
+// paths or queries contain double-encoded or malformed escapes.
+//
+// Only the path and query of URLs without a host (such as those of requests
+// in origin-form) are changed.
+func CanonicalURL(u *url.URL, strict bool) (*url.URL, error) {
+	c := *u
+
+	if c.Host != "" {
+		c.Host = canonicalHost(strings.ToLower(c.Host), strings.ToLower(c.Scheme))
+	}
+
+	if c.Opaque != "" {
+		return &c, nil
+	}
+
+	path := c.EscapedPath()
+	if path == "" && c.Host != "" {
+		path = "/"
+	}
+
+	if strings.HasPrefix(path, "/") {
+		if strict {
+			if err := checkPath(path); err != nil {
+				return nil, err
+			}
+		}
+
+		path, _ = canonicalEscapes(path, false)
+		path = removeDotSegments(path)
+
+		unescaped, err := url.PathUnescape(path)
+		if err != nil {
+			return nil, err
+		}
+		c.Path, c.RawPath = unescaped, path
+	}
+
+	if c.RawQuery != "" {
+		query, err := canonicalEscapes(c.RawQuery, strict)
+		if err != nil {
+			return nil, err
+		}
+		c.RawQuery = query
+	}
+
+	return &c, nil
+}
+
+// canonicalHost drops a host's port if it's the default for its scheme.
+func canonicalHost(host, scheme string) string {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+
+	var std string
+	switch scheme {
+	case "http", "ws":
+		std = "80"
+	case "https", "wss":
+		std = "443"
+	case "ftp":
+		std = "21"
+	}
+
+	if port != "" && port != std {
+		return host
+	}
+	if strings.Contains(name, ":") {
+		return "[" + name + "]"
+	}
+	return name
+}
+
+// Escapes which strict mode rejects in paths, as servers disagree on whether
+// they separate segments or end the path.
+var ambiguousEscapes = map[string]string{
+	"%2f": "slash",
+	"%5c": "backslash",
+	"%00": "NUL byte",
+}
+
+// checkPath looks for ambiguities in an escaped path.
+func checkPath(path string) error {
+	if strings.Contains(path, `\`) {
+		return fmt.Errorf("%w: backslash in path", ErrAmbiguousURI)
+	}
+
+	depth := 0
+	for _, seg := range strings.Split(path[1:], "/") {
+		if _, err := canonicalEscapes(seg, true); err != nil {
+			return err
+		}
+
+		lower := strings.ToLower(seg)
+		for esc, name := range ambiguousEscapes {
+			if strings.Contains(lower, esc) {
+				return fmt.Errorf("%w: encoded %s in path", ErrAmbiguousURI, name)
+			}
+		}
+
+		plain, _ := url.PathUnescape(seg)
+		if plain != seg && (plain == "." || plain == "..") {
+			return fmt.Errorf("%w: encoded dot segment in path", ErrAmbiguousURI)
+		}
+
+		switch seg {
+		case ".":
+		case "..":
+			if depth--; depth < 0 {
+				return fmt.Errorf("%w: path escapes its root", ErrAmbiguousURI)
+			}
+		default:
+			depth++
+		}
+	}
+
+	return nil
+}
+
+// canonicalEscapes decodes the percent-encoded unreserved characters in a
+// path or query, and upper-cases the hex digits of other escapes. Malformed
+// escapes are left alone, unless strict is set, in which case they're
+// rejected, as are double-encoded ones.
+func canonicalEscapes(s string, strict bool) (string, error) {
+	if !strings.Contains(s, "%") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			if strict {
+				return "", fmt.Errorf("%w: malformed escape", ErrAmbiguousURI)
+			}
+			b.WriteByte('%')
+			continue
+		}
+
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		switch {
+		case isUnreserved(c):
+			b.WriteByte(c)
+		case c == '%' && strict && i+4 < len(s) && isHex(s[i+3]) && isHex(s[i+4]):
+			return "", fmt.Errorf("%w: double-encoded escape", ErrAmbiguousURI)
+		default:
+			b.WriteByte('%')
+			b.WriteString(strings.ToUpper(s[i+1 : i+3]))
+		}
+		i += 2
+	}
+
+	return b.String(), nil
+}
+
+// removeDotSegments resolves the "." and ".." segments of an absolute path,
+// as described in section 5.2.4 of RFC 3986.
+func removeDotSegments(path string) string {
+	segs := strings.Split(path[1:], "/")
+	out := make([]string, 0, len(segs))
+
+	for i, seg := range segs {
+		switch seg {
+		case ".":
+		case "..":
+			if len(out) > 0 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, seg)
+			continue
+		}
+
+		// A trailing dot segment leaves a trailing slash.
+		if i == len(segs)-1 {
+			out = append(out, "")
+		}
+	}
+
+	return "/" + strings.Join(out, "/")
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// canonicalize rewrites a request's URL according to p.URIs. Returns nil and
+// a response rejecting the request if its URI is ambiguous.
+func (p *Proxy) canonicalize(s *Session, req *heat.Request, u *url.URL) (*url.URL, *heat.Response) {
+	if p.URIs == URIPreserve {
+		return u, nil
+	}
+
+	c, err := CanonicalURL(u, p.URIs == URIStrict)
+	if err != nil {
+		p.decide(s, req, "", &DecisionRecord{Action: "deny", Rule: "URIs", Reason: err.Error()})
+		return nil, statusResponse(400, "Ambiguous URI in request.")
+	}
+
+	return c, nil
+}
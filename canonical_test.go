@@ -0,0 +1,187 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestCanonicalURL(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"HTTP://Example.COM:80", "http://example.com/"},
+		{"https://example.com:443/a", "https://example.com/a"},
+		{"https://example.com:80/a", "https://example.com:80/a"},
+		{"http://example.com:8080/a", "http://example.com:8080/a"},
+		{"ws://[::1]:80/", "ws://[::1]/"},
+		{"http://example.com/%7euser/%2d%41", "http://example.com/~user/-A"},
+		{"http://example.com/a%2fb%c3%a9", "http://example.com/a%2Fb%C3%A9"},
+		{"http://example.com/a/./b/../c", "http://example.com/a/c"},
+		{"http://example.com/a/b/..", "http://example.com/a/"},
+		{"http://example.com/a/..", "http://example.com/"},
+		{"http://example.com/../a", "http://example.com/a"},
+		{"http://example.com/a?q=%7e%2f%zz", "http://example.com/a?q=~%2F%zz"},
+		{"/a/../b?x=%41", "/b?x=A"},
+	} {
+		u, err := url.Parse(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		before := u.String()
+		c, err := relay.CanonicalURL(u, false)
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+		} else if got := c.String(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.in, got, tt.want)
+		}
+
+		// The original is left alone.
+		if u.String() != before {
+			t.Errorf("%s: original changed to %s", tt.in, u)
+		}
+	}
+}
+
+func TestCanonicalURLStrict(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"/a%2fb", "encoded slash"},
+		{"/a%5Cb", "encoded backslash"},
+		{"/a%00", "encoded NUL byte"},
+		{"/%2e%2e/x", "encoded dot segment"},
+		{"/a/%2E", "encoded dot segment"},
+		{"/../x", "escapes its root"},
+		{"/a/../../x", "escapes its root"},
+		{"/a%252f", "double-encoded"},
+		{"/a?q=%2541", "double-encoded"},
+		{"/a?q=%zz", "malformed"},
+		{"/a?q=%4", "malformed"},
+	} {
+		u, err := url.Parse(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = relay.CanonicalURL(u, true)
+		if !errors.Is(err, relay.ErrAmbiguousURI) || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want an error about %s", tt.in, err, tt.want)
+		}
+
+		// Outside strict mode, the same URL is merely canonicalized.
+		if _, err := relay.CanonicalURL(u, false); err != nil {
+			t.Errorf("%s: got %v outside strict mode", tt.in, err)
+		}
+	}
+
+	// Unambiguous dot segments are fine.
+	u, _ := url.Parse("/a/./b/../c")
+	if c, err := relay.CanonicalURL(u, true); err != nil || c.String() != "/a/c" {
+		t.Errorf("got %v, %v, want /a/c", c, err)
+	}
+}
+
+func TestCanonicalRequests(t *testing.T) {
+	type forwarded struct{ remote, uri string }
+	sent := make(chan forwarded, 1)
+	decisions := make(chan *relay.DecisionRecord, 1)
+
+	p := &relay.Proxy{
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			sent <- forwarded{req.Remote, req.URI}
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			return resp, nil
+		},
+		AuditDecision: func(r *relay.DecisionRecord) { decisions <- r },
+	}
+
+	const target = "http://Origin.TEST:80/a/./%7ex/../b?q=%7e"
+
+	for _, tt := range []struct {
+		policy relay.URIPolicy
+		status int
+		want   forwarded
+	}{
+		{relay.URIPreserve, 200, forwarded{"origin.test:80", "/a/./%7ex/../b?q=%7e"}},
+		{relay.URICanonical, 200, forwarded{"origin.test", "/a/b?q=~"}},
+		{relay.URIStrict, 200, forwarded{"origin.test", "/a/b?q=~"}},
+	} {
+		p.URIs = tt.policy
+		conn := serve(t, p)
+		io.WriteString(conn, "GET "+target+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+		if resp.StatusCode != tt.status {
+			t.Errorf("policy %d: got status %d", tt.policy, resp.StatusCode)
+			continue
+		}
+		if got := <-sent; !strings.EqualFold(got.remote, tt.want.remote) || got.uri != tt.want.uri {
+			t.Errorf("policy %d: forwarded %+v, want %+v", tt.policy, got, tt.want)
+		}
+	}
+
+	// In strict mode, ambiguous URIs are rejected without being forwarded.
+	p.URIs = relay.URIStrict
+	conn := serve(t, p)
+	io.WriteString(conn, "GET http://origin.test/a%2fb HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 400 {
+		t.Errorf("got status %d, want 400", resp.StatusCode)
+	}
+	select {
+	case got := <-sent:
+		t.Errorf("forwarded %+v", got)
+	default:
+	}
+
+	d := <-decisions
+	if d.Action != "deny" || d.Rule != "URIs" || !strings.Contains(d.Reason, "encoded slash") {
+		t.Errorf("got decision %+v", d)
+	}
+}
+
+func TestCanonicalInterceptedRequests(t *testing.T) {
+	ca, cfg := testAuthority(t)
+	cfg.ServerName = "example.com"
+
+	sent := make(chan string, 1)
+	p := &relay.Proxy{
+		Authority: ca,
+		URIs:      relay.URIStrict,
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			sent <- req.URI
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			return resp, nil
+		},
+	}
+
+	conn, err := connect(t, p, "example.com:443", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET /a/%7eb/../c HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if resp := readFinal(t, conn, r); resp.StatusCode != 200 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if got := <-sent; got != "/a/c" {
+		t.Errorf("forwarded %s, want /a/c", got)
+	}
+
+	io.WriteString(conn, "GET /%2e%2e/etc HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if resp := readFinal(t, conn, r); resp.StatusCode != 400 {
+		t.Errorf("got status %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,194 @@
+package relay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// A charset converts between UTF-8 and one of the character encodings
+// commonly found on the web.
+type charset struct {
+	name string
+
+	// Code points of bytes 0x80 through 0xff, for single-byte encodings.
+	high *[128]rune
+
+	// Byte order, for UTF-16.
+	order binary.ByteOrder
+}
+
+var (
+	charsetUTF8    = &charset{name: "utf-8"}
+	charsetUTF16LE = &charset{name: "utf-16le", order: binary.LittleEndian}
+	charsetUTF16BE = &charset{name: "utf-16be", order: binary.BigEndian}
+
+	charsetWindows1252 = &charset{name: "windows-1252", high: highTable(map[byte]rune{
+		0x80: 0x20ac, 0x82: 0x201a, 0x83: 0x0192, 0x84: 0x201e, 0x85: 0x2026,
+		0x86: 0x2020, 0x87: 0x2021, 0x88: 0x02c6, 0x89: 0x2030, 0x8a: 0x0160,
+		0x8b: 0x2039, 0x8c: 0x0152, 0x8e: 0x017d, 0x91: 0x2018, 0x92: 0x2019,
+		0x93: 0x201c, 0x94: 0x201d, 0x95: 0x2022, 0x96: 0x2013, 0x97: 0x2014,
+		0x98: 0x02dc, 0x99: 0x2122, 0x9a: 0x0161, 0x9b: 0x203a, 0x9c: 0x0153,
+		0x9e: 0x017e, 0x9f: 0x0178,
+	})}
+
+	charsetISO885915 = &charset{name: "iso-8859-15", high: highTable(map[byte]rune{
+		0xa4: 0x20ac, 0xa6: 0x0160, 0xa8: 0x0161, 0xb4: 0x017d, 0xb8: 0x017e,
+		0xbc: 0x0152, 0xbd: 0x0153, 0xbe: 0x0178,
+	})}
+)
+
+// Charset labels, mapped as browsers do. Notably, ISO-8859-1 and US-ASCII
+// are treated as Windows-1252.
+var charsetLabels = map[string]*charset{
+	"utf-8":             charsetUTF8,
+	"utf8":              charsetUTF8,
+	"unicode-1-1-utf-8": charsetUTF8,
+	"utf-16":            charsetUTF16LE,
+	"utf-16le":          charsetUTF16LE,
+	"utf-16be":          charsetUTF16BE,
+	"windows-1252":      charsetWindows1252,
+	"cp1252":            charsetWindows1252,
+	"x-cp1252":          charsetWindows1252,
+	"iso-8859-1":        charsetWindows1252,
+	"iso8859-1":         charsetWindows1252,
+	"iso_8859-1":        charsetWindows1252,
+	"latin1":            charsetWindows1252,
+	"l1":                charsetWindows1252,
+	"cp819":             charsetWindows1252,
+	"ibm819":            charsetWindows1252,
+	"us-ascii":          charsetWindows1252,
+	"ascii":             charsetWindows1252,
+	"iso-8859-15":       charsetISO885915,
+	"iso8859-15":        charsetISO885915,
+	"iso_8859-15":       charsetISO885915,
+	"latin9":            charsetISO885915,
+	"l9":                charsetISO885915,
+	"csisolatin9":       charsetISO885915,
+	"iso-ir-100":        charsetWindows1252,
+	"csisolatin1":       charsetWindows1252,
+	"iso_8859-1:1987":   charsetWindows1252,
+	"ansi_x3.4-1968":    charsetWindows1252,
+}
+
+// highTable builds the table of a single-byte encoding which agrees with
+// ISO-8859-1 except for the given bytes.
+func highTable(diff map[byte]rune) *[128]rune {
+	var t [128]rune
+	for i := range t {
+		t[i] = rune(0x80 + i)
+	}
+	for b, r := range diff {
+		t[b-0x80] = r
+	}
+	return &t
+}
+
+// lookupCharset finds a charset by one of its labels.
+func lookupCharset(label string) (*charset, bool) {
+	cs, ok := charsetLabels[strings.ToLower(strings.TrimSpace(label))]
+	return cs, ok
+}
+
+// decode converts text in the charset to UTF-8. Invalid sequences are
+// replaced with U+FFFD.
+func (cs *charset) decode(data []byte) string {
+	switch {
+	case cs.high != nil:
+		var b strings.Builder
+		b.Grow(len(data))
+		for _, c := range data {
+			if c < 0x80 {
+				b.WriteByte(c)
+			} else {
+				b.WriteRune(cs.high[c-0x80])
+			}
+		}
+		return b.String()
+
+	case cs.order != nil:
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = cs.order.Uint16(data[2*i:])
+		}
+		s := string(utf16.Decode(units))
+		if len(data)%2 != 0 {
+			s += string(utf8.RuneError)
+		}
+		return s
+
+	default:
+		return strings.ToValidUTF8(string(data), string(utf8.RuneError))
+	}
+}
+
+// encode converts UTF-8 text to the charset. Characters the charset can't
+// represent are written as numeric character references if markup is true,
+// and are an error otherwise.
+func (cs *charset) encode(text string, markup bool) ([]byte, error) {
+	switch {
+	case cs.high != nil:
+		buf := make([]byte, 0, len(text))
+		for _, r := range text {
+			if c, ok := cs.single(r); ok {
+				buf = append(buf, c)
+			} else if markup {
+				buf = append(buf, "&#"+strconv.Itoa(int(r))+";"...)
+			} else {
+				return nil, fmt.Errorf("relay: %U can't be encoded in %s", r, cs.name)
+			}
+		}
+		return buf, nil
+
+	case cs.order != nil:
+		units := utf16.Encode([]rune(text))
+		buf := make([]byte, 2*len(units))
+		for i, u := range units {
+			cs.order.PutUint16(buf[2*i:], u)
+		}
+		return buf, nil
+
+	default:
+		return []byte(text), nil
+	}
+}
+
+// single returns the byte representing r in a single-byte charset.
+func (cs *charset) single(r rune) (byte, bool) {
+	if r < 0x80 {
+		return byte(r), true
+	}
+	for i, x := range cs.high {
+		if x == r {
+			return byte(0x80 + i), true
+		}
+	}
+	return 0, false
+}
+
+// byteOrderMark returns the BOM with which text in the charset begins.
+func (cs *charset) byteOrderMark() []byte {
+	switch cs {
+	case charsetUTF8:
+		return []byte{0xef, 0xbb, 0xbf}
+	case charsetUTF16LE:
+		return []byte{0xff, 0xfe}
+	case charsetUTF16BE:
+		return []byte{0xfe, 0xff}
+	}
+	return nil
+}
+
+// detectBOM returns the charset identified by a byte order mark at the
+// beginning of data, if any, along with the BOM's length.
+func detectBOM(data []byte) (*charset, int) {
+	for _, cs := range []*charset{charsetUTF8, charsetUTF16LE, charsetUTF16BE} {
+		if bom := cs.byteOrderMark(); len(data) >= len(bom) && string(data[:len(bom)]) == string(bom) {
+			return cs, len(bom)
+		}
+	}
+	return nil, 0
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// A Clock tells the time, and schedules functions to run in the future. It
+// lets tests drive the proxy's timeouts deterministically.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a function scheduled by a Clock.
+type Timer interface {
+	// Stop prevents the function from being called, if it hasn't been
+	// already. It returns false if the function has already been called.
+	Stop() bool
+}
+
+// The realClock type implements Clock using the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// clock returns the proxy's clock.
+func (p *Proxy) clock() Clock {
+	if p.Clock != nil {
+		return p.Clock
+	}
+	return realClock{}
+}
+
+// withTimeout is like context.WithTimeout, but measures time using clock.
+func withTimeout(parent context.Context, clock Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := clock.(realClock); ok {
+		return context.WithTimeout(parent, d)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	c := &clockContext{Context: ctx}
+
+	t := clock.AfterFunc(d, func() {
+		atomic.StoreInt32(&c.expired, 1)
+		cancel()
+	})
+
+	return c, func() {
+		t.Stop()
+		cancel()
+	}
+}
+
+// The clockContext type is a context canceled by a Clock's timer. Its
+// deadline is only reported if set, which it should only be when using the
+// system clock: the standard library compares deadlines against the system
+// clock when dialing and the like, so any other clock's would be enforced
+// at the wrong time.
+type clockContext struct {
+	context.Context
+	deadline time.Time
+	expired  int32
+}
+
+func (c *clockContext) Deadline() (time.Time, bool) {
+	if c.deadline.IsZero() {
+		return c.Context.Deadline()
+	}
+	return c.deadline, true
+}
+
+func (c *clockContext) Err() error {
+	err := c.Context.Err()
+	if err != nil && atomic.LoadInt32(&c.expired) != 0 {
+		return context.DeadlineExceeded
+	}
+	return err
+}
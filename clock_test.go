@@ -0,0 +1,130 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+	"github.com/erkl/relay/relaytest"
+)
+
+func TestClockTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	arrived := make(chan struct{})
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		close(arrived)
+		<-release
+	})
+
+	clock := relaytest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	contexts := make(chan context.Context, 1)
+	p := &relay.Proxy{
+		Clock:         clock,
+		TimeoutHeader: "X-Relay-Timeout",
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			contexts <- s.Context()
+			return nil
+		},
+	}
+
+	conn := serve(t, p)
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\nX-Relay-Timeout: 60\r\n\r\n")
+
+	// The clock's deadline lies in the past according to the system clock,
+	// which mustn't stop the request from reaching the upstream server.
+	ctx := <-contexts
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never reached the upstream server")
+	}
+
+	// Time only passes when the clock is advanced.
+	clock.Advance(59 * time.Second)
+	if ctx.Err() != nil {
+		t.Fatalf("request timed out early: %v", ctx.Err())
+	}
+
+	clock.Advance(time.Second)
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 504 {
+		t.Errorf("got status %d, want 504", resp.StatusCode)
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Errorf("got context error %v, want context.DeadlineExceeded", ctx.Err())
+	}
+}
+
+// The temporaryError type is a net.Error such as those caused by running
+// out of file descriptors.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// The failingListener type is a net.Listener whose Accept method returns
+// errors from a channel.
+type failingListener struct {
+	net.Listener
+	errs chan error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	return nil, <-l.errs
+}
+
+// The signalClock type reports the durations passed to AfterFunc.
+type signalClock struct {
+	*relaytest.Clock
+	scheduled chan time.Duration
+}
+
+func (c *signalClock) AfterFunc(d time.Duration, f func()) relay.Timer {
+	t := c.Clock.AfterFunc(d, f)
+	c.scheduled <- d
+	return t
+}
+
+func TestServeListenerBackoff(t *testing.T) {
+	clock := &signalClock{relaytest.NewClock(time.Now()), make(chan time.Duration)}
+	l := &failingListener{errs: make(chan error)}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- (&relay.Proxy{Clock: clock}).ServeListener(l, nil)
+	}()
+
+	// The delay between attempts doubles each time.
+	for _, want := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond} {
+		l.errs <- temporaryError{}
+
+		if d := <-clock.scheduled; d != want {
+			t.Fatalf("backing off for %v, want %v", d, want)
+		}
+
+		clock.Advance(want - time.Millisecond)
+		select {
+		case l.errs <- temporaryError{}:
+			t.Fatalf("Accept called again before %v passed", want)
+		default:
+		}
+		clock.Advance(time.Millisecond)
+	}
+
+	errClosed := errors.New("closed")
+	l.errs <- errClosed
+
+	if err := <-done; err != errClosed {
+		t.Errorf("got %v, want the permanent error", err)
+	}
+}
@@ -0,0 +1,233 @@
+// Command relay runs a man-in-the-middle HTTP proxy.
+//
+// HTTPS traffic is intercepted using certificates signed by a CA, read from
+// the PEM file given by the -ca flag (which should hold both the certificate
+// and its private key). If the file doesn't exist, a new CA is generated and
+// saved there; clients must be configured to trust it.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+var (
+	listen   = flag.String("listen", "127.0.0.1:8080", "`address` to listen on (host:port or unix:/path)")
+	caPath   = flag.String("ca", "relay-ca.pem", "PEM `file` holding the CA certificate and key; generated if missing")
+	upstream = flag.String("upstream", "", "`URL` of an HTTP proxy to forward all traffic through")
+	ntlm     = flag.Bool("upstream-ntlm", false, "authenticate with the upstream proxy using NTLM")
+	headers  = flag.String("headers", "", "`file` holding header rules")
+	allow    = flag.String("allow", "", "comma-separated host `patterns` to allow (default all)")
+	deny     = flag.String("deny", "", "comma-separated host `patterns` to deny")
+	certLog  = flag.String("cert-log", "", "`file` to append a record of every forged certificate to")
+	auditLog = flag.String("audit-log", "", "`file` to append a record of every policy decision to")
+	tunnel   = flag.Bool("tunnel", false, "relay HTTPS traffic without intercepting it")
+	guard    = flag.Bool("guard", false, "refuse connections to loopback, private and link-local addresses")
+	network  = flag.String("network", "", "emulate network conditions: 2g, slow-3g, 3g, 4g, dsl or wifi")
+	verbose  = flag.Bool("v", false, "log every request")
+	redact   = flag.String("redact", "", "comma-separated query `parameters` to redact from logs")
+)
+
+func main() {
+	flag.Parse()
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	p := &relay.Proxy{
+		Transport: &relay.Transport{},
+		Schemes:   []string{"http", "https", "ftp"},
+	}
+
+	if !*tunnel {
+		ca, err := loadAuthority(*caPath)
+		if err != nil {
+			return err
+		}
+		p.Authority = ca
+	} else {
+		p.Intercept = func(s *relay.Session, addr string) bool {
+			return false
+		}
+	}
+
+	if *guard {
+		p.Transport.Guard = &relay.AddressGuard{}
+	}
+
+	if *network != "" {
+		np, ok := relay.LookupNetworkProfile(*network)
+		if !ok {
+			return fmt.Errorf("unknown network profile: %s", *network)
+		}
+		p.Shaping = []relay.ShapingRule{{Profile: np}}
+	}
+
+	if *certLog != "" {
+		f, err := os.OpenFile(*certLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		p.AuditCertificate = relay.CertAuditLog(f)
+	}
+
+	if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		p.AuditDecision = relay.DecisionAuditLog(f)
+	}
+
+	if *upstream != "" {
+		u, err := url.Parse(*upstream)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid upstream proxy URL: %s", *upstream)
+		}
+		p.Transport.Proxy = u
+		p.Transport.ProxyNTLM = *ntlm
+	}
+
+	if *headers != "" {
+		f, err := os.Open(*headers)
+		if err != nil {
+			return err
+		}
+
+		p.HeaderRules, err = relay.ParseHeaderRules(f)
+		f.Close()
+
+		if err != nil {
+			return fmt.Errorf("%s: %s", *headers, err)
+		}
+	}
+
+	// Apply the allow and deny lists.
+	f, err := newFilter(*allow, *deny)
+	if err != nil {
+		return err
+	}
+
+	p.OnConnect = func(s *relay.Session, req *heat.Request) *heat.Response {
+		return f.check(s, req, req.URI)
+	}
+	p.OnRequest = func(s *relay.Session, req *heat.Request) *heat.Response {
+		return f.check(s, req, req.Remote)
+	}
+
+	if *redact != "" {
+		p.Redact = &relay.Redactor{
+			Fields:      relay.SensitiveFields,
+			QueryParams: strings.Split(*redact, ","),
+		}
+	}
+
+	if *verbose {
+		p.OnComplete = func(s *relay.Session, req *heat.Request, resp *heat.Response, t relay.Timings) {
+			log.Printf("%s %s %s://%s%s %d %s (connect %s, ttfb %s)", s.ClientAddr, req.Method, req.Scheme, req.Remote, p.Redact.URL(req.URI), resp.Status,
+				t.Total, t.DNS+t.Dial+t.TLS, t.TTFB)
+		}
+	}
+
+	p.ErrorHandler = func(s *relay.Session, req *heat.Request, err error) *heat.Response {
+		log.Printf("%s: %s", s.ClientAddr, err)
+		return nil
+	}
+
+	l, err := relay.Listen(*listen)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("listening on %s", *listen)
+
+	return p.ServeListener(l, nil)
+}
+
+// The filter type implements the allow and deny lists.
+type filter struct {
+	allow *relay.Match
+	deny  *relay.Match
+}
+
+func newFilter(allow, deny string) (*filter, error) {
+	var f filter
+	var err error
+
+	if hosts := split(allow); len(hosts) > 0 {
+		if f.allow, err = (&relay.Matcher{Hosts: hosts}).Compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	if hosts := split(deny); len(hosts) > 0 {
+		if f.deny, err = (&relay.Matcher{Hosts: hosts}).Compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &f, nil
+}
+
+func split(s string) []string {
+	var list []string
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); x != "" {
+			list = append(list, x)
+		}
+	}
+	return list
+}
+
+// check returns a "403 Forbidden" response if requests to addr aren't
+// allowed, and nil otherwise.
+func (f *filter) check(s *relay.Session, req *heat.Request, addr string) *heat.Response {
+	if f.allow.Connect(s, addr) && (f.deny == nil || !f.deny.Connect(s, addr)) {
+		return nil
+	}
+
+	if *verbose {
+		log.Printf("%s %s %s denied", s.ClientAddr, req.Method, addr)
+	}
+
+	body := "Access to " + addr + " is not allowed.\n"
+
+	resp := heat.NewResponse(403, heat.ReasonPhrase(403))
+	resp.Fields.Set("Connection", "close")
+	resp.Fields.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Fields.Set("Content-Length", fmt.Sprint(len(body)))
+	resp.Body = ioutil.NopCloser(strings.NewReader(body))
+
+	return resp
+}
+
+// loadAuthority reads a CA certificate and key from a PEM file, generating
+// and saving a new one if the file doesn't exist.
+func loadAuthority(file string) (*tls.Certificate, error) {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		log.Printf("generating a new CA in %s", file)
+		if err := generateAuthority(file); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(file, file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestFilter(t *testing.T) {
+	f, err := newFilter("*.example.com, example.com", "bad.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"example.com:443", true},
+		{"www.example.com:443", true},
+		{"WWW.EXAMPLE.COM:80", true},
+		{"bad.example.com:443", false},
+		{"example.org:443", false},
+	}
+
+	s := &relay.Session{}
+	req := heat.NewRequest("CONNECT", "")
+
+	for _, tt := range tests {
+		resp := f.check(s, req, tt.addr)
+		if allowed := resp == nil; allowed != tt.allowed {
+			t.Errorf("%s: allowed is %v, want %v", tt.addr, allowed, tt.allowed)
+		} else if resp != nil && resp.Status != 403 {
+			t.Errorf("%s: got status %d, want 403", tt.addr, resp.Status)
+		}
+	}
+
+	if _, err := newFilter("[", ""); err == nil {
+		t.Errorf("invalid pattern accepted")
+	}
+}
+
+func TestLoadAuthority(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ca.pem")
+
+	// The first call generates a new CA...
+	ca, err := loadAuthority(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		t.Errorf("generated certificate can't sign certificates")
+	}
+	if fi, err := os.Stat(file); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("CA file has mode %v (%v), want 0600", fi.Mode().Perm(), err)
+	}
+
+	// ...which later calls load.
+	again, err := loadAuthority(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again.Certificate[0]) != string(ca.Certificate[0]) {
+		t.Errorf("CA regenerated although the file exists")
+	}
+}
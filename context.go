@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// Context returns the context of the request currently being served in the
+// session. It's canceled once the response has been written to the client,
+// or when the request's deadline passes.
+func (s *Session) Context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// begin sets up the context of a new request in the session.
+func (s *Session) begin(ctx context.Context, cancel context.CancelFunc) {
+	s.end()
+	s.ctx, s.cancel = annotatedContext{ctx, s}, cancel
+}
+
+// end cancels the context of the current request, and forgets its
+// annotations.
+func (s *Session) end() {
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	s.reqAnnotations = nil
+}
+
+// requestContext derives the context for a request in a session, stripping
+// the timeout header field (if any) on the way.
+func (p *Proxy) requestContext(s *Session, req *heat.Request) (context.Context, context.CancelFunc) {
+	ctx := s.base
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if p.TimeoutHeader == "" {
+		return context.WithCancel(ctx)
+	}
+
+	var timeout time.Duration
+
+	req.Fields.Filter(func(f heat.Field) bool {
+		if !f.Is(p.TimeoutHeader) {
+			return true
+		}
+		if d, ok := parseTimeout(f.Value); ok && (timeout == 0 || d < timeout) {
+			timeout = d
+		}
+		return false
+	})
+
+	if timeout > 0 {
+		return withTimeout(ctx, p.clock(), timeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// parseTimeout parses a timeout given either as a number of seconds, or as
+// a string accepted by time.ParseDuration.
+func parseTimeout(s string) (time.Duration, bool) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), f > 0
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, d > 0
+	}
+	return 0, false
+}
+
+// send passes a request to the handler registered for its scheme if there is
+// one, p.RoundTripContext if set, p.RoundTrip if set, or the proxy's
+// transport otherwise. When calling p.RoundTrip the context's deadline is
+// enforced by abandoning the call once it passes.
+func (p *Proxy) send(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+	if h := p.schemeHandler(req.Scheme); h != nil {
+		return h(ctx, req)
+	}
+
+	if p.RoundTripContext != nil {
+		return p.RoundTripContext(ctx, req)
+	}
+
+	if p.RoundTrip == nil {
+		return p.transport().RoundTripContext(ctx, req)
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		return p.RoundTrip(req)
+	}
+
+	type result struct {
+		resp *heat.Response
+		err  error
+	}
+
+	ch := make(chan result, 1)
+
+	go func() {
+		var r result
+		func() {
+			defer recoverPanic(&r.err)
+			r.resp, r.err = p.RoundTrip(req)
+		}()
+		ch <- r
+	}()
+
+	select {
+	case r := <-ch:
+		return r.resp, r.err
+
+	case <-ctx.Done():
+		// Clean up after the abandoned call once it returns.
+		go func() {
+			if r := <-ch; r.resp != nil && r.resp.Body != nil {
+				r.resp.Body.Close()
+			}
+		}()
+
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,62 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestTimeoutHeader(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	seen := make(chan *http.Request, 2)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		seen <- req
+		if req.URL.Path == "/slow" {
+			<-release
+		}
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	var deadline time.Time
+	p := &relay.Proxy{
+		RoundTrip:     roundTrip,
+		TimeoutHeader: "X-Relay-Timeout",
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			deadline, _ = s.Context().Deadline()
+			return nil
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	// The field bounds the request, and isn't forwarded.
+	start := time.Now()
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\nX-Relay-Timeout: 30\r\n\r\n")
+	readFinal(t, conn, r)
+
+	if req := <-seen; req.Header.Get("X-Relay-Timeout") != "" {
+		t.Errorf("timeout field was forwarded")
+	}
+	if d := deadline.Sub(start); d < 29*time.Second || d > 31*time.Second {
+		t.Errorf("request deadline %v away, want 30s", d)
+	}
+
+	// Requests taking too long fail with a gateway timeout.
+	io.WriteString(conn, "GET http://"+addr+"/slow HTTP/1.1\r\nHost: "+addr+"\r\nX-Relay-Timeout: 100ms\r\n\r\n")
+	resp := readFinal(t, conn, r)
+	if resp.StatusCode != 504 {
+		t.Errorf("got status %d, want 504", resp.StatusCode)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("timeout wasn't enforced")
+	}
+}
@@ -0,0 +1,199 @@
+package relay
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// A CookieFlag says what a CookieRule does with a boolean cookie attribute.
+type CookieFlag int
+
+const (
+	// Leave the attribute as the server sent it.
+	CookieKeep CookieFlag = iota
+
+	// Add the attribute.
+	CookieSet
+
+	// Remove the attribute.
+	CookieClear
+)
+
+// A CookieRule rewrites the attributes of cookies set by upstream servers,
+// such as for serving an application under another hostname or path than
+// the one it was deployed with.
+type CookieRule struct {
+	// Requests whose responses the rule applies to. If nil, everything
+	// matches.
+	Match *Match
+
+	// Names of the cookies the rule applies to. If empty, all cookies.
+	Names []string
+
+	// Replacements for the Domain and Path attributes. Empty values leave
+	// the attributes alone. If StripDomain is set, the Domain attribute is
+	// removed instead, making cookies host-only.
+	Domain      string
+	StripDomain bool
+	Path        string
+
+	// What to do with the Secure attribute.
+	Secure CookieFlag
+
+	// Replacement for the SameSite attribute: "Strict", "Lax" or "None".
+	// Cookies with "SameSite=None" must also be Secure.
+	SameSite string
+}
+
+// apply rewrites a cookie's attributes.
+func (r *CookieRule) apply(c *setCookie) {
+	switch {
+	case r.StripDomain:
+		c.del("Domain")
+	case r.Domain != "":
+		c.set("Domain", r.Domain)
+	}
+
+	if r.Path != "" {
+		c.set("Path", r.Path)
+	}
+
+	switch r.Secure {
+	case CookieSet:
+		c.set("Secure", "")
+	case CookieClear:
+		c.del("Secure")
+	}
+
+	if r.SameSite != "" {
+		c.set("SameSite", r.SameSite)
+	}
+}
+
+// applyCookieRules rewrites each cookie set by a response using the first
+// rule in p.Cookies matching both the request and the cookie's name.
+func (p *Proxy) applyCookieRules(s *Session, req *heat.Request, resp *heat.Response) {
+	if len(p.Cookies) == 0 {
+		return
+	}
+
+	// Which rules match the request at all?
+	var rules []int
+	for i := range p.Cookies {
+		if p.Cookies[i].Match.Request(s, req) {
+			rules = append(rules, i)
+		}
+	}
+	if len(rules) == 0 {
+		return
+	}
+
+	for j := range resp.Fields {
+		f := &resp.Fields[j]
+		if !f.Is("Set-Cookie") {
+			continue
+		}
+
+		c := parseSetCookie(f.Value)
+
+		for _, i := range rules {
+			r := &p.Cookies[i]
+			if len(r.Names) > 0 && !contains(r.Names, c.name()) {
+				continue
+			}
+
+			orig := c.String()
+			r.apply(c)
+
+			if v := c.String(); v != orig {
+				f.Value = v
+				p.decide(s, req, "", &DecisionRecord{
+					Action:  "rewrite",
+					Rule:    "Cookies[" + strconv.Itoa(i) + "]",
+					Pattern: r.Match.String(),
+					Reason:  "cookie " + c.name() + " rewritten",
+				})
+			}
+
+			break
+		}
+	}
+}
+
+// A setCookie is the value of a Set-Cookie header field, split into the
+// cookie itself and its attributes.
+type setCookie struct {
+	pair  string   // "name=value"
+	attrs []string // such as "Path=/" or "Secure", as sent
+}
+
+func parseSetCookie(value string) *setCookie {
+	parts := strings.Split(value, ";")
+
+	c := &setCookie{pair: strings.TrimSpace(parts[0])}
+	for _, part := range parts[1:] {
+		if part = strings.TrimSpace(part); part != "" {
+			c.attrs = append(c.attrs, part)
+		}
+	}
+
+	return c
+}
+
+// name returns the cookie's name.
+func (c *setCookie) name() string {
+	name, _, _ := strings.Cut(c.pair, "=")
+	return strings.TrimSpace(name)
+}
+
+// index returns the position of an attribute in c.attrs, or -1.
+func (c *setCookie) index(name string) int {
+	for i, attr := range c.attrs {
+		n, _, _ := strings.Cut(attr, "=")
+		if strings.EqualFold(strings.TrimSpace(n), name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// attr returns the value of an attribute.
+func (c *setCookie) attr(name string) (string, bool) {
+	i := c.index(name)
+	if i < 0 {
+		return "", false
+	}
+	_, value, _ := strings.Cut(c.attrs[i], "=")
+	return strings.TrimSpace(value), true
+}
+
+// set adds an attribute, or replaces its value. Attributes without values,
+// such as Secure, are set with an empty value.
+func (c *setCookie) set(name, value string) {
+	attr := name
+	if value != "" {
+		attr += "=" + value
+	}
+
+	if i := c.index(name); i >= 0 {
+		c.attrs[i] = attr
+	} else {
+		c.attrs = append(c.attrs, attr)
+	}
+}
+
+// del removes an attribute.
+func (c *setCookie) del(name string) {
+	for i := c.index(name); i >= 0; i = c.index(name) {
+		c.attrs = append(c.attrs[:i], c.attrs[i+1:]...)
+	}
+}
+
+func (c *setCookie) String() string {
+	if len(c.attrs) == 0 {
+		return c.pair
+	}
+	return c.pair + "; " + strings.Join(c.attrs, "; ")
+}
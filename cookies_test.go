@@ -0,0 +1,64 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestCookieRules(t *testing.T) {
+	legacy, err := relay.ParseMatch("path=/legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &relay.Proxy{
+		Cookies: []relay.CookieRule{
+			{Names: []string{"sid"}, Domain: "app.test", Path: "/app", Secure: relay.CookieSet, SameSite: "None"},
+			{Match: legacy, StripDomain: true, Secure: relay.CookieClear},
+			{SameSite: "Lax"},
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			resp.Fields.Add("Set-Cookie", "sid=1; Domain=origin.test; Path=/; HttpOnly")
+			resp.Fields.Add("Set-Cookie", "pref=dark; domain=origin.test; secure")
+			resp.Fields.Add("Set-Cookie", "theme=x; SameSite=Strict")
+			return resp, nil
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		// Each cookie is rewritten by the first rule matching it, even if
+		// that leaves it as it was.
+		{"/legacy", []string{
+			"sid=1; Domain=app.test; Path=/app; HttpOnly; Secure; SameSite=None",
+			"pref=dark",
+			"theme=x; SameSite=Strict",
+		}},
+		{"/other", []string{
+			"sid=1; Domain=app.test; Path=/app; HttpOnly; Secure; SameSite=None",
+			"pref=dark; domain=origin.test; secure; SameSite=Lax",
+			"theme=x; SameSite=Lax",
+		}},
+	}
+
+	for _, tt := range tests {
+		io.WriteString(conn, "GET http://origin.test"+tt.path+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		if got := resp.Header.Values("Set-Cookie"); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: got cookies\n%q\nwant\n%q", tt.path, got, tt.want)
+		}
+	}
+}
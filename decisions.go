@@ -0,0 +1,248 @@
+package relay
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// A DecisionCache remembers the decisions made about tunnels opened by each
+// client: whether to intercept them, and if so with which authority and
+// forged certificate. Clients reconnecting to the same host within the TTL
+// skip evaluating Intercept and certificate rules, and forging another
+// certificate. Changes to those rules only take effect for cached tunnels
+// once their entries expire, or the cache is purged.
+type DecisionCache struct {
+	// How long decisions are remembered. Defaults to 10 minutes.
+	TTL time.Duration
+
+	// Maximum number of decisions remembered. When it's reached, expired
+	// entries are dropped, and then the oldest. The limit is split evenly
+	// between the cache's shards, which evict their entries independently,
+	// so fewer entries may be remembered. Defaults to 10000.
+	MaxEntries int
+
+	// Function identifying clients, such that decisions are shared between
+	// their connections. Defaults to the client's IP address, along with
+	// the name of the user it authenticated as, if any.
+	Identify func(s *Session) string
+
+	// If set, the certificates forged for cached decisions are accounted
+	// for in this budget. Once it's exceeded, certificates are forged anew
+	// for every tunnel rather than kept.
+	Memory *MemoryBudget
+
+	shards [shardCount]decisionShard
+}
+
+// A decisionShard holds some of the entries in a DecisionCache.
+type decisionShard struct {
+	mu      sync.Mutex
+	entries map[string]*tunnelDecision
+}
+
+// A tunnelDecision is the outcome of deciding how to serve a tunnel.
+type tunnelDecision struct {
+	intercept bool
+	ca        *tls.Certificate
+	opts      forgeOptions
+	created   time.Time
+
+	// The certificate forged for the tunnel's host, once there is one.
+	mu   sync.Mutex
+	cert *tls.Certificate
+
+	// The budget the certificate is accounted for in, how much of it is
+	// held, and whether the decision has been dropped from the cache.
+	acct    sync.Mutex
+	budget  *MemoryBudget
+	held    int64
+	dropped bool
+}
+
+func (c *DecisionCache) ttl() time.Duration {
+	if c.TTL > 0 {
+		return c.TTL
+	}
+	return 10 * time.Minute
+}
+
+// key returns the key under which decisions about tunnels to addr opened
+// in session s are cached.
+func (c *DecisionCache) key(s *Session, addr string) string {
+	if c.Identify != nil {
+		return c.Identify(s) + " " + addr
+	}
+
+	client := ""
+	if s.ClientAddr != nil {
+		client = s.ClientAddr.String()
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+	}
+
+	return client + " " + s.User + " " + addr
+}
+
+// get returns the decision cached under key, if it hasn't expired.
+func (c *DecisionCache) get(key string, now time.Time) *tunnelDecision {
+	sh := &c.shards[shardOf(key)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	d := sh.entries[key]
+	if d == nil {
+		return nil
+	}
+	if now.Sub(d.created) >= c.ttl() {
+		delete(sh.entries, key)
+		d.drop()
+		return nil
+	}
+
+	return d
+}
+
+// put caches a decision under key.
+func (c *DecisionCache) put(key string, d *tunnelDecision) {
+	sh := &c.shards[shardOf(key)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.entries == nil {
+		sh.entries = make(map[string]*tunnelDecision)
+	}
+
+	limit := c.MaxEntries
+	if limit <= 0 {
+		limit = 10000
+	}
+	limit = (limit + shardCount - 1) / shardCount
+
+	if old, ok := sh.entries[key]; ok {
+		old.drop()
+	} else if len(sh.entries) >= limit {
+		sh.evict(d.created, c.ttl(), limit)
+	}
+
+	sh.entries[key] = d
+}
+
+// evict drops expired entries, and then the oldest one if there are still
+// limit entries.
+func (sh *decisionShard) evict(now time.Time, ttl time.Duration, limit int) {
+	var oldest string
+
+	for key, d := range sh.entries {
+		if now.Sub(d.created) >= ttl {
+			delete(sh.entries, key)
+			d.drop()
+		} else if oldest == "" || d.created.Before(sh.entries[oldest].created) {
+			oldest = key
+		}
+	}
+
+	if len(sh.entries) >= limit {
+		sh.entries[oldest].drop()
+		delete(sh.entries, oldest)
+	}
+}
+
+// Purge forgets all decisions, such as after the rules they were based on
+// have changed.
+func (c *DecisionCache) Purge() {
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		for _, d := range sh.entries {
+			d.drop()
+		}
+		sh.entries = nil
+		sh.mu.Unlock()
+	}
+}
+
+// decideTunnel decides whether to intercept a tunnel to addr, and if so,
+// with which authority, consulting p.Decisions if set.
+func (p *Proxy) decideTunnel(s *Session, addr string) *tunnelDecision {
+	c := p.Decisions
+	now := p.clock().Now()
+
+	var key string
+	if c != nil {
+		key = c.key(s, addr)
+
+		// Decisions to intercept only hold for as long as the authority
+		// they were made with is still the one selected, such that
+		// rotating it takes effect at once.
+		if d := c.get(key, now); d != nil && (!d.intercept || d.ca == p.selectAuthority(s, addr)) {
+			p.count("decisions.hit", 1)
+			return d
+		}
+		p.count("decisions.miss", 1)
+	}
+
+	d := &tunnelDecision{intercept: p.intercept(s, addr), created: now}
+	if d.intercept {
+		d.ca = p.selectAuthority(s, addr)
+		d.opts = p.forgeOptions(s, addr)
+	}
+
+	if c != nil {
+		d.budget = c.Memory
+		c.put(key, d)
+	}
+
+	return d
+}
+
+// certificate returns the certificate to present for the tunnel's host,
+// forging it unless it's been forged before.
+func (d *tunnelDecision) certificate(p *Proxy, host string) (*tls.Certificate, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.cert != nil {
+		return d.cert, nil
+	}
+
+	cert, err := p.forge(d.ca, host, "", d.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.hold(certSize(cert)) {
+		d.cert = cert
+	}
+	return cert, nil
+}
+
+// hold accounts for n bytes kept along with a cached decision, reporting
+// whether its budget has room for them.
+func (d *tunnelDecision) hold(n int64) bool {
+	d.acct.Lock()
+	defer d.acct.Unlock()
+
+	if d.dropped {
+		return true
+	}
+	if !d.budget.reserve(MemoryCaches, n) {
+		d.budget.count("memory.caches.shed", 1)
+		return false
+	}
+
+	d.held += n
+	return true
+}
+
+// drop releases the memory held along with a decision once it's no longer
+// cached.
+func (d *tunnelDecision) drop() {
+	d.acct.Lock()
+	d.dropped = true
+	d.budget.release(MemoryCaches, d.held)
+	d.held = 0
+	d.acct.Unlock()
+}
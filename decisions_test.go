@@ -0,0 +1,137 @@
+package relay_test
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+	"github.com/erkl/relay/relaytest"
+)
+
+func TestDecisionCache(t *testing.T) {
+	ca, cfg := testAuthority(t)
+	clock := relaytest.NewClock(time.Now())
+	m := new(counters)
+
+	var mu sync.Mutex
+	calls := make(map[string]int)
+
+	p := &relay.Proxy{
+		Authority: ca,
+		Clock:     clock,
+		Metrics:   m,
+		Decisions: &relay.DecisionCache{TTL: time.Minute},
+		Intercept: func(s *relay.Session, addr string) bool {
+			mu.Lock()
+			calls[addr]++
+			mu.Unlock()
+			return true
+		},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// handshake intercepts a tunnel to host, returning the certificate
+	// presented and the number of times Intercept has been called for it.
+	handshake := func(host string) ([]byte, int) {
+		cfg := cfg.Clone()
+		cfg.ServerName = host
+		conn, err := connect(t, p, host+":443", cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", host, err)
+		}
+		defer conn.Close()
+
+		mu.Lock()
+		defer mu.Unlock()
+		return conn.ConnectionState().PeerCertificates[0].Raw, calls[host+":443"]
+	}
+
+	// Reconnecting clients are served the same certificate, without Intercept
+	// being consulted again.
+	first, n := handshake("a.example")
+	if again, n := handshake("a.example"); n != 1 || !bytes.Equal(first, again) {
+		t.Errorf("reconnecting: %d Intercept calls, same certificate: %v", n, bytes.Equal(first, again))
+	}
+	if n != 1 || m.get("decisions.miss") != 1 || m.get("decisions.hit") != 1 {
+		t.Errorf("got %d calls, %d misses and %d hits", n, m.get("decisions.miss"), m.get("decisions.hit"))
+	}
+
+	// Decisions expire.
+	clock.Advance(time.Minute)
+	if _, n := handshake("a.example"); n != 2 {
+		t.Errorf("after expiring: %d Intercept calls, want 2", n)
+	}
+
+	// Purging forgets everything.
+	p.Decisions.Purge()
+	if _, n := handshake("a.example"); n != 3 {
+		t.Errorf("after purging: %d Intercept calls, want 3", n)
+	}
+}
+
+func TestDecisionCacheIdentify(t *testing.T) {
+	ca, cfg := testAuthority(t)
+	cfg.ServerName = "example.com"
+
+	var mu sync.Mutex
+	var calls, clients int
+
+	// Each session counts as a different client.
+	p := &relay.Proxy{
+		Authority: ca,
+		Decisions: &relay.DecisionCache{Identify: func(s *relay.Session) string {
+			mu.Lock()
+			defer mu.Unlock()
+			clients++
+			return strconv.Itoa(clients)
+		}},
+		Intercept: func(s *relay.Session, addr string) bool {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			return true
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		conn, err := connect(t, p, "example.com:443", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Errorf("got %d Intercept calls, want 2", calls)
+	}
+}
+
+func TestDecisionCacheRotation(t *testing.T) {
+	oldCA, oldCfg := testAuthority(t)
+	newCA, newCfg := testAuthority(t)
+	oldCfg.ServerName = "example.com"
+	newCfg.ServerName = "example.com"
+
+	p := &relay.Proxy{Authority: oldCA, Decisions: &relay.DecisionCache{}}
+
+	if _, err := connect(t, p, "example.com:443", oldCfg); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	// Cached decisions don't outlive the authority they were made with.
+	p.SetAuthority(newCA)
+
+	if _, err := connect(t, p, "example.com:443", newCfg); err != nil {
+		t.Fatalf("handshake with new authority failed: %v", err)
+	}
+	if _, err := connect(t, p, "example.com:443", oldCfg); err == nil {
+		t.Errorf("old authority still trusted after rotation")
+	}
+}
@@ -0,0 +1,160 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/erkl/heat"
+)
+
+var (
+	errSniffed      = errors.New("relay: sniffed client hello")
+	errNoServerName = errors.New("relay: TLS client sent no server name")
+)
+
+// serveDetected sniffs the first byte a client sends, and serves the
+// connection accordingly: a TLS handshake is intercepted or tunneled based
+// on the server name it asks for, and anything else is served as HTTP (which
+// includes HTTP/2 clients with prior knowledge, see serveH2C).
+func (p *Proxy) serveDetected(s *Session, conn net.Conn) error {
+	var b [1]byte
+
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		if err == io.EOF {
+			return nil
+		}
+		return &ClientAbort{err}
+	}
+
+	conn = &prefixed{conn, []byte{b[0]}}
+
+	// Handshake records begin with content type 22.
+	if b[0] == 0x16 {
+		return p.serveTLS(s, conn)
+	}
+
+	return p.serveHTTP(s, conn)
+}
+
+// serveTLS serves a connection which begins with a TLS handshake, as sent by
+// clients whose traffic has been transparently redirected to the proxy. The
+// destination is taken to be port 443 of the host named in the handshake.
+func (p *Proxy) serveTLS(s *Session, conn net.Conn) error {
+	hello, conn, err := sniffClientHello(conn)
+	if err != nil {
+		return &ClientAbort{err}
+	}
+
+	host := hello.ServerName
+	if host == "" {
+		return &TLSHandshakeError{Err: errNoServerName}
+	}
+
+	addr := net.JoinHostPort(host, "443")
+	p.label(host, phaseHandshake)
+
+	// Run the tunnel past the same hook as CONNECT requests. As the client
+	// doesn't speak HTTP yet, a rejection can only close the connection.
+	if p.OnConnect != nil {
+		req := heat.NewRequest("CONNECT", addr)
+		req.Major, req.Minor = 1, 1
+		req.Fields.Set("Host", addr)
+
+		if resp := p.OnConnect(s, req); resp != nil {
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+			err := &PolicyDenied{"tunnel to " + addr + " rejected"}
+			p.decideDeny(s, nil, addr, "OnConnect", nil, err)
+			return err
+		}
+	}
+
+	d := p.decideTunnel(s, addr)
+	if !d.intercept {
+		upstream, err := p.dialOpaque(s, addr)
+		if err != nil {
+			return err
+		}
+		p.label(host, phaseTunnel)
+		return splice(conn, upstream)
+	}
+
+	ca, opts := d.ca, d.opts
+	if ca == nil || len(ca.Certificate) == 0 {
+		return &TLSHandshakeError{Host: host, Err: errors.New("no signing authority")}
+	}
+
+	cert, err := d.certificate(p, host)
+	if err != nil {
+		return &TLSHandshakeError{Host: host, Err: err}
+	}
+
+	tlsConn, err := p.handshake(conn, ca, cert, host, opts)
+	if err != nil {
+		return err
+	}
+
+	return p.serveHTTPS(s, tlsConn, addr)
+}
+
+// sniffClientHello reads a TLS ClientHello from conn without responding to
+// it, returning a connection which replays the data read.
+func sniffClientHello(conn net.Conn) (*tls.ClientHelloInfo, net.Conn, error) {
+	var hello *tls.ClientHelloInfo
+
+	rc := &recordingConn{Conn: conn}
+
+	err := tls.Server(rc, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errSniffed
+		},
+	}).Handshake()
+
+	if hello == nil {
+		return nil, nil, err
+	}
+
+	return hello, &prefixed{conn, rc.buf.Bytes()}, nil
+}
+
+// The recordingConn type records everything read from a connection, while
+// discarding anything written to it.
+type recordingConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordingConn) Read(buf []byte) (int, error) {
+	n, err := c.Conn.Read(buf)
+	c.buf.Write(buf[:n])
+	return n, err
+}
+
+func (c *recordingConn) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+// readOptionalProxyHeader is like readProxyHeader, but lets connections
+// without a PROXY protocol header through untouched.
+func readOptionalProxyHeader(conn net.Conn) (net.Conn, error) {
+	// Both versions' headers are at least 12 bytes long, as is anything
+	// else a client might sensibly begin with.
+	buf := make([]byte, 12)
+
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	conn = &prefixed{conn, buf}
+
+	if bytes.Equal(buf, proxySignature) || bytes.HasPrefix(buf, []byte("PROXY ")) {
+		return readProxyHeader(conn)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,109 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestDetectProtocols(t *testing.T) {
+	ca, cfg := testAuthority(t)
+
+	sent := make(chan string, 1)
+	p := &relay.Proxy{
+		Authority:           ca,
+		DetectProtocols:     true,
+		AcceptProxyProtocol: true,
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			sent <- req.Scheme + "://" + req.Remote
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			return resp, nil
+		},
+	}
+
+	// Connections beginning with a TLS handshake are intercepted, with the
+	// destination taken from the server name.
+	cfg.ServerName = "example.com"
+	conn := tls.Client(serve(t, p), cfg)
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	readFinal(t, conn, bufio.NewReader(conn))
+
+	if got := <-sent; got != "https://example.com:443" {
+		t.Errorf("intercepted request sent to %q", got)
+	}
+
+	// Anything else is HTTP, with or without a PROXY protocol header.
+	var client net.Addr
+	p.OnSession = func(s *relay.Session) { client = s.ClientAddr }
+
+	for _, prefix := range []string{"", "PROXY TCP4 203.0.113.7 192.0.2.1 51234 80\r\n"} {
+		plain := serve(t, p)
+		io.WriteString(plain, prefix+"GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		readFinal(t, plain, bufio.NewReader(plain))
+
+		if got := <-sent; got != "http://example.com" {
+			t.Errorf("plain request sent to %q", got)
+		}
+	}
+	if client == nil || client.String() != "203.0.113.7:51234" {
+		t.Errorf("got client address %v, want 203.0.113.7:51234", client)
+	}
+}
+
+func TestDetectProtocolsTunnel(t *testing.T) {
+	record := make(chan byte, 1)
+	addr := rawUpstream(t, func(conn *net.TCPConn) {
+		var b [1]byte
+		io.ReadFull(conn, b[:])
+		record <- b[0]
+	})
+
+	dialed := make(chan string, 1)
+	p := &relay.Proxy{
+		DetectProtocols: true,
+		Intercept:       func(s *relay.Session, addr string) bool { return false },
+		Transport: &relay.Transport{
+			Dial: func(network, a string) (net.Conn, error) {
+				dialed <- a
+				return net.Dial(network, addr)
+			},
+		},
+	}
+
+	conn := serve(t, p)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go tls.Client(conn, &tls.Config{ServerName: "example.com"}).Handshake()
+
+	// The upstream server receives the client's handshake as it was sent.
+	if b := <-record; b != 0x16 {
+		t.Errorf("upstream got record type %#x, want a handshake", b)
+	}
+	if got := <-dialed; got != "example.com:443" {
+		t.Errorf("tunnel dialed %q, want example.com:443", got)
+	}
+}
+
+func TestDetectProtocolsNoServerName(t *testing.T) {
+	ca, _ := testAuthority(t)
+	p := &relay.Proxy{Authority: ca, DetectProtocols: true}
+
+	conn := serve(t, p)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Without a server name there's nowhere to send the connection.
+	err := tls.Client(conn, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	if err == nil {
+		t.Errorf("handshake succeeded without a server name")
+	}
+}
@@ -0,0 +1,232 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// A DNSCache resolves host names on behalf of a Transport, remembering both
+// successful and failed lookups for a while. Names which are looked up while
+// their entries are about to expire are refreshed in the background, so that
+// busy hosts never have to wait for the resolver. DNSCaches are safe for
+// concurrent use.
+type DNSCache struct {
+	// Function used to resolve host names, returning the addresses found
+	// along with their time to live. A zero TTL means the TTL is unknown.
+	// Defaults to net.DefaultResolver, which doesn't report TTLs.
+	Lookup func(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+
+	// Bounds applied to record TTLs. Unknown TTLs are replaced by MinTTL.
+	// MinTTL defaults to 30 seconds, and MaxTTL to 5 minutes.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// How long failed lookups are remembered. Defaults to 5 seconds. A
+	// negative value disables negative caching.
+	NegativeTTL time.Duration
+
+	// Entries used within this long of their expiry are refreshed in the
+	// background. Defaults to 10% of the entry's TTL.
+	Refresh time.Duration
+
+	// If set, receives "dns.hit", "dns.miss", "dns.negative", "dns.refresh"
+	// and "dns.error" counters.
+	Metrics Metrics
+
+	shards [shardCount]dnsShard
+}
+
+// A dnsShard holds the entries for some of the hosts in a DNSCache.
+type dnsShard struct {
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	ready      chan struct{}
+	ips        []net.IP
+	err        error
+	expires    time.Time
+	ttl        time.Duration
+	refreshing bool
+}
+
+// Resolve returns the IP addresses of a host.
+func (c *DNSCache) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	now := time.Now()
+	sh := &c.shards[shardOf(host)]
+
+	sh.mu.Lock()
+	if sh.entries == nil {
+		sh.entries = make(map[string]*dnsEntry)
+	}
+
+	e := sh.entries[host]
+
+	// Start a fresh lookup if there's no usable entry.
+	if e == nil || (e.expires.Before(now) && isClosed(e.ready)) {
+		e = &dnsEntry{ready: make(chan struct{})}
+		sh.entries[host] = e
+		sh.mu.Unlock()
+
+		c.count("dns.miss")
+		c.lookup(ctx, host, e)
+		return e.ips, e.err
+	}
+
+	// Refresh entries about to expire.
+	if isClosed(e.ready) && e.err == nil && !e.refreshing && now.Add(c.refresh(e.ttl)).After(e.expires) {
+		e.refreshing = true
+		go c.refreshEntry(host, e)
+	}
+	sh.mu.Unlock()
+
+	select {
+	case <-e.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if e.err != nil {
+		c.count("dns.negative")
+	} else {
+		c.count("dns.hit")
+	}
+
+	return e.ips, e.err
+}
+
+// Forget removes all cached entries.
+func (c *DNSCache) Forget() {
+	for i := range c.shards {
+		sh := &c.shards[i]
+		sh.mu.Lock()
+		sh.entries = nil
+		sh.mu.Unlock()
+	}
+}
+
+// lookup resolves host, and stores the result in e.
+func (c *DNSCache) lookup(ctx context.Context, host string, e *dnsEntry) {
+	ips, ttl, err := c.resolve(ctx, host)
+
+	sh := &c.shards[shardOf(host)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e.ips, e.err = ips, err
+	e.ttl = c.clamp(ttl)
+
+	if err != nil {
+		e.ttl = c.NegativeTTL
+		if e.ttl == 0 {
+			e.ttl = 5 * time.Second
+		}
+
+		// Don't remember failures caused by the caller giving up.
+		if e.ttl < 0 || ctx.Err() != nil {
+			if sh.entries[host] == e {
+				delete(sh.entries, host)
+			}
+		}
+	}
+
+	e.expires = time.Now().Add(e.ttl)
+	close(e.ready)
+}
+
+// refreshEntry replaces a cached entry with a fresh one in the background.
+// The old entry stays in use until the lookup succeeds.
+func (c *DNSCache) refreshEntry(host string, old *dnsEntry) {
+	c.count("dns.refresh")
+
+	ips, ttl, err := c.resolve(context.Background(), host)
+
+	sh := &c.shards[shardOf(host)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	old.refreshing = false
+
+	if err != nil || sh.entries[host] != old {
+		return
+	}
+
+	e := &dnsEntry{ready: make(chan struct{}), ips: ips, ttl: c.clamp(ttl)}
+	e.expires = time.Now().Add(e.ttl)
+	close(e.ready)
+
+	sh.entries[host] = e
+}
+
+func (c *DNSCache) resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+
+	if c.Lookup != nil {
+		ips, ttl, err = c.Lookup(ctx, host)
+	} else {
+		var addrs []net.IPAddr
+		if addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host); err == nil {
+			for _, addr := range addrs {
+				ips = append(ips, addr.IP)
+			}
+		}
+	}
+
+	if err != nil {
+		c.count("dns.error")
+	}
+
+	return ips, ttl, err
+}
+
+// clamp applies the cache's TTL bounds.
+func (c *DNSCache) clamp(ttl time.Duration) time.Duration {
+	min, max := c.MinTTL, c.MaxTTL
+	if min <= 0 {
+		min = 30 * time.Second
+	}
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+
+	if ttl < min {
+		ttl = min
+	}
+	if ttl > max {
+		ttl = max
+	}
+
+	return ttl
+}
+
+func (c *DNSCache) refresh(ttl time.Duration) time.Duration {
+	if c.Refresh > 0 {
+		return c.Refresh
+	}
+	return ttl / 10
+}
+
+func (c *DNSCache) count(name string) {
+	if c.Metrics != nil {
+		c.Metrics.Add(name, 1)
+	}
+}
+
+// isClosed reports whether a channel has been closed.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,146 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+// The lookups type is a DNSCache.Lookup function counting its calls, which
+// resolves every host to the address stored in ip.
+type lookups struct {
+	calls atomic.Int32
+	ip    atomic.Value
+	err   error
+	ttl   time.Duration
+}
+
+func (l *lookups) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	l.calls.Add(1)
+	if l.err != nil {
+		return nil, 0, l.err
+	}
+	return []net.IP{l.ip.Load().(net.IP)}, l.ttl, nil
+}
+
+func TestDNSCacheHits(t *testing.T) {
+	l := &lookups{ttl: time.Hour}
+	l.ip.Store(net.ParseIP("192.0.2.1"))
+
+	m := new(counters)
+	c := &relay.DNSCache{Lookup: l.lookup, Metrics: m}
+
+	// Concurrent lookups of a new host share one query.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := c.Resolve(context.Background(), "example.com")
+			if err != nil || len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+				t.Errorf("got %v, %v", ips, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := l.calls.Load(); n != 1 {
+		t.Errorf("%d lookups, want 1", n)
+	}
+	if m.get("dns.miss") != 1 || m.get("dns.hit") != 9 {
+		t.Errorf("got %d misses and %d hits, want 1 and 9", m.get("dns.miss"), m.get("dns.hit"))
+	}
+
+	// IP addresses aren't looked up at all.
+	if ips, _ := c.Resolve(context.Background(), "192.0.2.7"); len(ips) != 1 || l.calls.Load() != 1 {
+		t.Errorf("IP address resolved to %v after %d lookups", ips, l.calls.Load())
+	}
+}
+
+func TestDNSCacheNegative(t *testing.T) {
+	errNX := errors.New("no such host")
+
+	for _, tt := range []struct {
+		negativeTTL time.Duration
+		calls       int32
+	}{
+		{0, 1},
+		{-1, 2},
+	} {
+		l := &lookups{err: errNX}
+		c := &relay.DNSCache{Lookup: l.lookup, NegativeTTL: tt.negativeTTL}
+
+		for i := 0; i < 2; i++ {
+			if _, err := c.Resolve(context.Background(), "nx.example.com"); err != errNX {
+				t.Errorf("NegativeTTL %v: got error %v", tt.negativeTTL, err)
+			}
+		}
+		if n := l.calls.Load(); n != tt.calls {
+			t.Errorf("NegativeTTL %v: %d lookups, want %d", tt.negativeTTL, n, tt.calls)
+		}
+	}
+}
+
+func TestDNSCacheRefresh(t *testing.T) {
+	l := &lookups{}
+	l.ip.Store(net.ParseIP("192.0.2.1"))
+
+	ttl := 300 * time.Millisecond
+	c := &relay.DNSCache{Lookup: l.lookup, MinTTL: ttl, MaxTTL: ttl, Refresh: ttl - 50*time.Millisecond}
+
+	c.Resolve(context.Background(), "example.com")
+	l.ip.Store(net.ParseIP("192.0.2.2"))
+
+	// Once within the refresh window, the cached address is still returned,
+	// while a new one is looked up in the background.
+	time.Sleep(100 * time.Millisecond)
+	if ips, _ := c.Resolve(context.Background(), "example.com"); !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("got %v, want the cached address", ips)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ips, _ := c.Resolve(context.Background(), "example.com")
+		if ips[0].Equal(net.ParseIP("192.0.2.2")) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("entry wasn't refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := l.calls.Load(); n != 2 {
+		t.Errorf("%d lookups, want 2", n)
+	}
+}
+
+func TestTransportResolver(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+	_, port, _ := net.SplitHostPort(addr)
+
+	l := &lookups{}
+	l.ip.Store(net.ParseIP("127.0.0.1"))
+
+	p := &relay.Proxy{Transport: &relay.Transport{Resolver: &relay.DNSCache{Lookup: l.lookup}}}
+	conn := serve(t, p)
+
+	io.WriteString(conn, "GET http://upstream.test:"+port+"/ HTTP/1.1\r\nHost: upstream.test\r\n\r\n")
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 200 {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+	if n := l.calls.Load(); n != 1 {
+		t.Errorf("%d lookups, want 1", n)
+	}
+}
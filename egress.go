@@ -0,0 +1,80 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+
+	"github.com/erkl/heat"
+)
+
+// An EgressRule picks the local address from which upstream connections are
+// made for some requests and tunnels, cycling through a pool of addresses.
+type EgressRule struct {
+	// Requests and tunnels the rule applies to. For tunnels, only host and
+	// client conditions are considered. If nil, everything matches.
+	Match *Match
+
+	// Local addresses to use in turn.
+	Addrs []net.IP
+
+	next uint32
+}
+
+// pick returns the next address in the rule's pool.
+func (r *EgressRule) pick() net.IP {
+	return pickAddr(r.Addrs, &r.next)
+}
+
+// egress applies the first of p.Egress matching a request, returning the
+// context in which it should be sent.
+func (p *Proxy) egress(ctx context.Context, s *Session, req *heat.Request) context.Context {
+	for i := range p.Egress {
+		if r := &p.Egress[i]; r.Match.Request(s, req) {
+			if ip := r.pick(); ip != nil {
+				return WithLocalAddr(ctx, ip)
+			}
+			break
+		}
+	}
+	return ctx
+}
+
+// egressTunnel is like egress, for tunnels to addr.
+func (p *Proxy) egressTunnel(ctx context.Context, s *Session, addr string) context.Context {
+	for i := range p.Egress {
+		if r := &p.Egress[i]; r.Match.Connect(s, addr) {
+			if ip := r.pick(); ip != nil {
+				return WithLocalAddr(ctx, ip)
+			}
+			break
+		}
+	}
+	return ctx
+}
+
+type localAddrKey struct{}
+
+// WithLocalAddr returns a context which makes Transport connect to upstream
+// servers from a particular local address.
+func WithLocalAddr(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, localAddrKey{}, ip)
+}
+
+// localAddr returns the local address to dial from in ctx, falling back on
+// the transport's own pool.
+func (t *Transport) localAddr(ctx context.Context) net.IP {
+	if ip, ok := ctx.Value(localAddrKey{}).(net.IP); ok {
+		return ip
+	}
+	return pickAddr(t.LocalAddrs, &t.nextLocal)
+}
+
+// pickAddr returns addresses from a list in round-robin order.
+func pickAddr(addrs []net.IP, next *uint32) net.IP {
+	if len(addrs) == 0 {
+		return nil
+	}
+	n := atomic.AddUint32(next, 1) - 1
+	return addrs[n%uint32(len(addrs))]
+}
@@ -0,0 +1,76 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+// These tests rely on all of 127.0.0.0/8 being usable as local addresses,
+// which is only a given on Linux.
+
+func TestEgress(t *testing.T) {
+	sources := make(chan string, 4)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		sources <- host
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	match, err := (&relay.Matcher{PathPrefix: "/egress"}).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &relay.Proxy{
+		Egress: []relay.EgressRule{
+			{Match: match, Addrs: []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3")}},
+		},
+		Transport: &relay.Transport{
+			LocalAddrs: []net.IP{net.ParseIP("127.0.0.4")},
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	// Matching requests cycle through the rule's pool; others use the
+	// transport's.
+	paths := []string{"/egress", "/egress", "/egress", "/other"}
+	want := []string{"127.0.0.2", "127.0.0.3", "127.0.0.2", "127.0.0.4"}
+
+	for i, path := range paths {
+		io.WriteString(conn, "GET http://"+addr+path+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		readFinal(t, conn, r)
+		if got := <-sources; got != want[i] {
+			t.Errorf("request %d (%s) came from %s, want %s", i, path, got, want[i])
+		}
+	}
+}
+
+func TestEgressTunnel(t *testing.T) {
+	source := make(chan string, 1)
+	addr := rawUpstream(t, func(conn *net.TCPConn) {
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		source <- host
+	})
+
+	p := &relay.Proxy{
+		Intercept: func(s *relay.Session, addr string) bool { return false },
+		Egress:    []relay.EgressRule{{Addrs: []net.IP{net.ParseIP("127.0.0.5")}}},
+	}
+
+	conn := serve(t, p)
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 200 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	if got := <-source; got != "127.0.0.5" {
+		t.Errorf("tunnel came from %s, want 127.0.0.5", got)
+	}
+}
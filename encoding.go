@@ -0,0 +1,136 @@
+package relay
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// restrictEncodings rewrites a request's Accept-Encoding header field so that
+// it only lists content codings found in allowed.
+func restrictEncodings(req *heat.Request, allowed []string) {
+	if _, ok := fieldValue(req.Fields, "Accept-Encoding"); !ok {
+		return
+	}
+
+	var codings []string
+	var wildcard bool
+
+	req.Fields.Split("Accept-Encoding", ',', func(s string) bool {
+		name := strings.ToLower(strings.TrimSpace(s))
+		if i := strings.IndexByte(name, ';'); i >= 0 {
+			name = strings.TrimSpace(name[:i])
+		}
+
+		switch {
+		case name == "*":
+			wildcard = true
+		case name == "identity" || acceptsEncoding(allowed, name):
+			codings = append(codings, strings.TrimSpace(s))
+		}
+
+		return true
+	})
+
+	// Spell out what a wildcard would have let through.
+	if wildcard {
+		for _, name := range allowed {
+			codings = append(codings, name)
+		}
+	}
+
+	req.Fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Accept-Encoding")
+	})
+
+	if len(codings) > 0 {
+		req.Fields.Set("Accept-Encoding", strings.Join(codings, ", "))
+	} else {
+		req.Fields.Set("Accept-Encoding", "identity")
+	}
+}
+
+// decodeResponse strips content codings not found in allowed from a response
+// body, for servers which ignore the request's Accept-Encoding header field.
+// Codings the proxy can't decode itself are left alone.
+func decodeResponse(resp *heat.Response, allowed []string) {
+	if resp.Body == nil || resp.Status == 101 {
+		return
+	}
+
+	coding, ok := fieldValue(resp.Fields, "Content-Encoding")
+	if !ok {
+		return
+	}
+
+	coding = strings.ToLower(strings.TrimSpace(coding))
+	if coding == "identity" || acceptsEncoding(allowed, coding) {
+		return
+	}
+
+	body, ok := decoder(coding, resp.Body)
+	if !ok {
+		return
+	}
+
+	resp.Body = body
+	resp.Fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Content-Encoding") && !f.Is("Content-Length")
+	})
+	resp.Fields.Set("Transfer-Encoding", "chunked")
+}
+
+// decoder wraps a body compressed with a single content coding in a reader
+// producing the uncompressed data.
+func decoder(coding string, body io.ReadCloser) (io.ReadCloser, bool) {
+	switch coding {
+	case "gzip", "x-gzip":
+		return &decodedBody{body: body, open: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		}}, true
+
+	case "deflate":
+		return &decodedBody{body: body, open: func(r io.Reader) (io.Reader, error) {
+			return zlib.NewReader(r)
+		}}, true
+	}
+
+	return nil, false
+}
+
+// The decodedBody type lazily sets up a decompressor on first read, so that
+// no upstream data is consumed before the body is actually wanted.
+type decodedBody struct {
+	body io.ReadCloser
+	open func(r io.Reader) (io.Reader, error)
+	r    io.Reader
+}
+
+func (db *decodedBody) Read(buf []byte) (int, error) {
+	if db.r == nil {
+		r, err := db.open(db.body)
+		if err != nil {
+			return 0, &UpstreamProtocolError{err}
+		}
+		db.r = r
+	}
+
+	return db.r.Read(buf)
+}
+
+func (db *decodedBody) Close() error {
+	return db.body.Close()
+}
+
+// acceptsEncoding reports whether a content coding appears in a list.
+func acceptsEncoding(list []string, coding string) bool {
+	for _, name := range list {
+		if strings.EqualFold(name, coding) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+func TestAcceptEncoding(t *testing.T) {
+	seen := make(chan string, 1)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		seen <- req.Header.Get("Accept-Encoding")
+		io.WriteString(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+	})
+
+	conn := serve(t, &relay.Proxy{AcceptEncoding: []string{"gzip"}})
+	r := bufio.NewReader(conn)
+
+	tests := []struct {
+		accept, want string
+	}{
+		{"br, gzip;q=0.8, zstd", "gzip;q=0.8"},
+		{"identity, deflate", "identity"},
+		{"zstd", "identity"},
+		{"*", "gzip"},
+	}
+
+	for _, tt := range tests {
+		io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\nAccept-Encoding: "+tt.accept+"\r\n\r\n")
+		readFinal(t, conn, r)
+
+		if got := <-seen; got != tt.want {
+			t.Errorf("%q: upstream got %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	var gz, zl bytes.Buffer
+
+	w := gzip.NewWriter(&gz)
+	io.WriteString(w, "hello")
+	w.Close()
+
+	w2 := zlib.NewWriter(&zl)
+	io.WriteString(w2, "hello")
+	w2.Close()
+
+	bodies := map[string][]byte{
+		"gzip":    gz.Bytes(),
+		"deflate": zl.Bytes(),
+		"br":      []byte("opaque"),
+	}
+
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		coding := req.URL.Path[1:]
+		fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Encoding: %s\r\nContent-Length: %d\r\n\r\n%s",
+			coding, len(bodies[coding]), bodies[coding])
+	})
+
+	conn := serve(t, &relay.Proxy{AcceptEncoding: []string{"gzip"}})
+	r := bufio.NewReader(conn)
+
+	// Allowed codings, and codings the proxy can't decode, are passed on.
+	tests := []struct {
+		coding, want string
+		body         []byte
+	}{
+		{"gzip", "gzip", gz.Bytes()},
+		{"deflate", "", []byte("hello")},
+		{"br", "br", []byte("opaque")},
+	}
+
+	for _, tt := range tests {
+		io.WriteString(conn, "GET http://"+addr+"/"+tt.coding+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		body, _ := io.ReadAll(resp.Body)
+
+		if got := resp.Header.Get("Content-Encoding"); got != tt.want {
+			t.Errorf("%s: got Content-Encoding %q, want %q", tt.coding, got, tt.want)
+		}
+		if !bytes.Equal(body, tt.body) {
+			t.Errorf("%s: got body %q, want %q", tt.coding, body, tt.body)
+		}
+	}
+}
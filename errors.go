@@ -0,0 +1,184 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// A DialError is returned when a connection to an upstream server couldn't
+// be established.
+type DialError struct {
+	Addr string
+	Err  error
+}
+
+func (e *DialError) Error() string {
+	return "relay: dial " + e.Addr + ": " + e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// A TLSHandshakeError is returned when a TLS handshake with either the
+// client or an upstream server fails.
+type TLSHandshakeError struct {
+	Host     string
+	Upstream bool
+	Err      error
+}
+
+func (e *TLSHandshakeError) Error() string {
+	if e.Upstream {
+		return "relay: upstream TLS handshake with " + e.Host + ": " + e.Err.Error()
+	}
+	return "relay: client TLS handshake for " + e.Host + ": " + e.Err.Error()
+}
+
+func (e *TLSHandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// An UpstreamProtocolError is returned when an upstream server responds with
+// a malformed message, or when reading its response body fails.
+type UpstreamProtocolError struct {
+	Err error
+}
+
+func (e *UpstreamProtocolError) Error() string {
+	return "relay: upstream protocol error: " + e.Err.Error()
+}
+
+func (e *UpstreamProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// A ClientAbort is returned when reading from or writing to the client's
+// connection fails.
+type ClientAbort struct {
+	Err error
+}
+
+func (e *ClientAbort) Error() string {
+	return "relay: client connection: " + e.Err.Error()
+}
+
+func (e *ClientAbort) Unwrap() error {
+	return e.Err
+}
+
+// A PolicyDenied error is returned when a request or connection is rejected
+// by the proxy's configuration or by one of its hooks.
+type PolicyDenied struct {
+	Reason string
+}
+
+func (e *PolicyDenied) Error() string {
+	return "relay: denied: " + e.Reason
+}
+
+// A PanicError is returned when RoundTrip or one of the proxy's hooks
+// panics. Stack holds the goroutine's stack trace at the time.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("relay: panic: %v", e.Value)
+}
+
+// recoverPanic converts a panic into a PanicError stored in *err. It must
+// be deferred directly.
+func recoverPanic(err *error) {
+	if v := recover(); v != nil {
+		*err = &PanicError{v, debug.Stack()}
+	}
+}
+
+// errorStatus picks a suitable HTTP status code for an error.
+func errorStatus(err error) int {
+	var (
+		dial     *DialError
+		tls      *TLSHandshakeError
+		protocol *UpstreamProtocolError
+		mismatch *IntegrityError
+		denied   *PolicyDenied
+		blocked  *ContentBlocked
+		quota    *QuotaExceeded
+		panicked *PanicError
+	)
+
+	switch {
+	case errors.As(err, &denied), errors.As(err, &blocked):
+		return 403
+	case errors.As(err, &quota):
+		if quota.Quota.Action == QuotaDeny {
+			return 403
+		}
+		return 429
+	case errors.As(err, &dial), errors.As(err, &tls), errors.As(err, &protocol), errors.As(err, &mismatch):
+		return 502
+	case errors.As(err, &panicked), errors.Is(err, ErrCircuitOpen):
+		return 502
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrResponseTimeout), errors.Is(err, ErrBodyTimeout):
+		return 504
+	case errors.Is(err, ErrLoopDetected):
+		return 508
+	default:
+		return 500
+	}
+}
+
+// errorResponse builds the response sent to a client when serving req failed
+// with err, consulting p.ErrorHandler if set.
+func (p *Proxy) errorResponse(s *Session, req *heat.Request, err error) *heat.Response {
+	if p.ErrorHandler != nil {
+		if resp := p.ErrorHandler(s, req, err); resp != nil {
+			return resp
+		}
+	}
+
+	resp := statusResponse(errorStatus(err), "%s.", err)
+
+	// Tell clients when they can try again.
+	var quota *QuotaExceeded
+	if errors.As(err, &quota) && quota.Quota.Action == QuotaBlock {
+		secs := int64(quota.Reset.Sub(p.clock().Now())/time.Second) + 1
+		resp.Fields.Set("Retry-After", strconv.FormatInt(secs, 10))
+	}
+
+	return resp
+}
+
+// clientError wraps errors from the client connection in a ClientAbort,
+// unless they're already of one of the types above.
+func clientError(err error) error {
+	switch err.(type) {
+	case nil, *DialError, *TLSHandshakeError, *UpstreamProtocolError, *ClientAbort, *PolicyDenied, *QuotaExceeded, *PanicError, *IntegrityError, *ContentBlocked:
+		return err
+	default:
+		return &ClientAbort{err}
+	}
+}
+
+// The upstreamBody type wraps a response body, turning read errors into
+// UpstreamProtocolErrors.
+type upstreamBody struct {
+	io.ReadCloser
+}
+
+func (b upstreamBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	if err != nil && err != io.EOF {
+		err = &UpstreamProtocolError{err}
+	}
+	return n, err
+}
@@ -0,0 +1,127 @@
+package relay_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestErrorKeepsConnection(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	})
+	closed := closedAddr(t)
+
+	var handled error
+	conn := serve(t, &relay.Proxy{
+		RoundTrip: roundTrip,
+		ErrorHandler: func(s *relay.Session, req *heat.Request, err error) *heat.Response {
+			handled = err
+			return nil
+		},
+	})
+	r := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET http://"+closed+"/ HTTP/1.1\r\nHost: "+closed+"\r\n\r\n")
+	resp := readFinal(t, conn, r)
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != 502 || resp.Close {
+		t.Fatalf("got status %d (closing: %v), want 502 on a kept connection", resp.StatusCode, resp.Close)
+	}
+
+	var dial *relay.DialError
+	if !errors.As(handled, &dial) {
+		t.Errorf("ErrorHandler got %v, want a DialError", handled)
+	}
+
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	resp = readFinal(t, conn, r)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "ok" {
+		t.Fatalf("got %d %q after the error, want 200 \"ok\"", resp.StatusCode, body)
+	}
+}
+
+func TestErrorClosingConnection(t *testing.T) {
+	closed := closedAddr(t)
+
+	conn := serve(t, &relay.Proxy{
+		Intercept: func(s *relay.Session, addr string) bool {
+			return false
+		},
+	})
+
+	// A tunnel which can't be opened ends the connection.
+	io.WriteString(conn, "CONNECT "+closed+" HTTP/1.1\r\nHost: "+closed+"\r\n\r\n")
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+	if resp.StatusCode != 502 {
+		t.Fatalf("got status %d, want 502", resp.StatusCode)
+	}
+	if !resp.Close {
+		t.Errorf("last response doesn't announce the connection closing")
+	}
+}
+
+func TestPanicInHook(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	})
+
+	var handled error
+	conn := serve(t, &relay.Proxy{
+		RoundTrip: roundTrip,
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			if req.URI == "/panic" {
+				panic("broken hook")
+			}
+			return nil
+		},
+		ErrorHandler: func(s *relay.Session, req *heat.Request, err error) *heat.Response {
+			handled = err
+			return nil
+		},
+	})
+	r := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET http://"+addr+"/panic HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	resp := readFinal(t, conn, r)
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != 502 {
+		t.Fatalf("got status %d, want 502", resp.StatusCode)
+	}
+
+	var panicked *relay.PanicError
+	if !errors.As(handled, &panicked) || panicked.Value != "broken hook" || len(panicked.Stack) == 0 {
+		t.Errorf("ErrorHandler got %#v, want a PanicError with a stack", handled)
+	}
+
+	// The connection survives the panic.
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	resp = readFinal(t, conn, r)
+	if resp.StatusCode != 200 {
+		t.Fatalf("got status %d after the panic, want 200", resp.StatusCode)
+	}
+}
+
+func TestPanicInSessionHook(t *testing.T) {
+	p := &relay.Proxy{
+		RoundTrip: roundTrip,
+		OnSession: func(s *relay.Session) {
+			panic("broken session hook")
+		},
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var panicked *relay.PanicError
+	if err := p.Serve(server); !errors.As(err, &panicked) {
+		t.Fatalf("Serve returned %v, want a PanicError", err)
+	}
+}
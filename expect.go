@@ -0,0 +1,82 @@
+package relay
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/xo"
+)
+
+// expectContinue deals with a request's Expect header field. The proxy
+// answers expectations itself: "100-continue" is removed from the request,
+// and the client is sent "100 Continue" once the request's body is first
+// read, such that a response arriving before then spares it sending the
+// body. Other expectations can't be met, in which case a response rejecting
+// the request is returned.
+func expectContinue(w xo.Writer, req *heat.Request) (*continueBody, *heat.Response) {
+	v, ok := fieldValue(req.Fields, "Expect")
+	if !ok {
+		return nil, nil
+	}
+
+	req.Fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Expect")
+	})
+
+	if !strings.EqualFold(strings.TrimSpace(v), "100-continue") {
+		return nil, statusResponse(417, "Unsupported expectation: %s.", v)
+	}
+
+	// HTTP/1.0 clients don't know of the expectation, and bodiless requests
+	// have nothing to wait for.
+	if req.Body == nil || req.Major < 1 || (req.Major == 1 && req.Minor == 0) {
+		return nil, nil
+	}
+
+	cb := &continueBody{ReadCloser: req.Body, w: w}
+	req.Body = cb
+	return cb, nil
+}
+
+// The continueBody type wraps the body of a request expecting "100-continue",
+// sending the client "100 Continue" when the body is first read.
+type continueBody struct {
+	io.ReadCloser
+	w xo.Writer
+
+	mu   sync.Mutex
+	done bool
+	err  error
+}
+
+func (b *continueBody) Read(buf []byte) (int, error) {
+	b.mu.Lock()
+	if !b.done {
+		b.done = true
+		if _, err := io.WriteString(b.w, "HTTP/1.1 100 Continue\r\n\r\n"); err == nil {
+			b.err = b.w.Flush()
+		} else {
+			b.err = err
+		}
+	}
+	err := b.err
+	b.mu.Unlock()
+
+	if err != nil {
+		return 0, &ClientAbort{err}
+	}
+
+	return b.ReadCloser.Read(buf)
+}
+
+// expire keeps "100 Continue" from being sent from now on, as the final
+// response is about to be.
+func (b *continueBody) expire() {
+	if b != nil {
+		b.mu.Lock()
+		b.done = true
+		b.mu.Unlock()
+	}
+}
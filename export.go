@@ -0,0 +1,150 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/erkl/heat"
+)
+
+// Header fields left out of exported requests, as the tools in question
+// will generate them on their own.
+var exportSkip = []string{
+	"Connection",
+	"Content-Length",
+	"Transfer-Encoding",
+	"Proxy-Connection",
+}
+
+// Curl returns a curl command line reproducing the flow's request.
+func (f *Flow) Curl() string {
+	return CurlCommand(f.Request, f.RequestBody)
+}
+
+// URL returns the absolute URL of the flow's request.
+func (f *Flow) URL() string {
+	return exportURL(f.Request)
+}
+
+// GoCode returns a snippet of Go code reproducing the flow's request.
+func (f *Flow) GoCode() string {
+	return GoSnippet(f.Request, f.RequestBody)
+}
+
+// CurlCommand returns a curl command line issuing the same request as req,
+// with the given body. The request's own Body field is ignored.
+func CurlCommand(req *heat.Request, body []byte) string {
+	var b bytes.Buffer
+
+	// Bodies which can't be quoted safely are piped in through printf, using
+	// octal escapes as POSIX doesn't require printf to support others.
+	binary := len(body) > 0 && (!utf8.Valid(body) || bytes.IndexByte(body, 0) >= 0)
+
+	if binary {
+		b.WriteString("printf '")
+		for _, c := range body {
+			fmt.Fprintf(&b, "\\%03o", c)
+		}
+		b.WriteString("' | ")
+	}
+
+	b.WriteString("curl")
+
+	switch {
+	case req.Method == "HEAD":
+		b.WriteString(" --head")
+	case req.Method == "GET" && len(body) == 0:
+	case req.Method == "POST" && len(body) > 0:
+	default:
+		b.WriteString(" -X " + shellQuote(req.Method))
+	}
+
+	b.WriteString(" " + shellQuote(exportURL(req)))
+
+	for _, f := range exportFields(req) {
+		b.WriteString(" -H " + shellQuote(f.Name+": "+f.Value))
+	}
+
+	if binary {
+		b.WriteString(" --data-binary @-")
+	} else if len(body) > 0 {
+		b.WriteString(" --data-binary " + shellQuote(string(body)))
+	}
+
+	return b.String()
+}
+
+// GoSnippet returns Go code issuing the same request as req using net/http,
+// with the given body. The request's own Body field is ignored.
+func GoSnippet(req *heat.Request, body []byte) string {
+	var b bytes.Buffer
+
+	reader := "nil"
+	if len(body) > 0 {
+		fmt.Fprintf(&b, "body := strings.NewReader(%s)\n", strconv.Quote(string(body)))
+		reader = "body"
+	}
+
+	fmt.Fprintf(&b, "req, err := http.NewRequest(%s, %s, %s)\n",
+		strconv.Quote(req.Method), strconv.Quote(exportURL(req)), reader)
+	b.WriteString("if err != nil {\n\tlog.Fatal(err)\n}\n")
+
+	for _, f := range exportFields(req) {
+		if f.Is("Host") {
+			fmt.Fprintf(&b, "req.Host = %s\n", strconv.Quote(f.Value))
+		} else {
+			fmt.Fprintf(&b, "req.Header.Add(%s, %s)\n", strconv.Quote(f.Name), strconv.Quote(f.Value))
+		}
+	}
+
+	b.WriteString("resp, err := http.DefaultClient.Do(req)\n")
+	b.WriteString("if err != nil {\n\tlog.Fatal(err)\n}\n")
+	b.WriteString("defer resp.Body.Close()\n")
+
+	return b.String()
+}
+
+// exportURL reconstructs the absolute URL of a request.
+func exportURL(req *heat.Request) string {
+	if strings.Contains(req.URI, "://") {
+		return req.URI
+	}
+
+	scheme := req.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	return scheme + "://" + req.Remote + req.URI
+}
+
+// exportFields returns the header fields worth exporting. The Host field is
+// only included if it differs from the host in the URL.
+func exportFields(req *heat.Request) []heat.Field {
+	var fields []heat.Field
+
+outer:
+	for _, f := range req.Fields {
+		for _, name := range exportSkip {
+			if f.Is(name) {
+				continue outer
+			}
+		}
+
+		if f.Is("Host") && (f.Value == req.Remote || f.Value == hostname(req.Remote)) {
+			continue
+		}
+
+		fields = append(fields, f)
+	}
+
+	return fields
+}
+
+// shellQuote quotes a string for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,83 @@
+package relay_test
+
+import (
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func exportRequest(method string) *heat.Request {
+	req := heat.NewRequest(method, "/search?q=it's")
+	req.Scheme = "https"
+	req.Remote = "example.com:443"
+	req.Fields.Set("Host", "example.com")
+	req.Fields.Set("X-Quote", `it's "quoted"`)
+	req.Fields.Set("Content-Length", "4")
+	return req
+}
+
+func TestCurlCommand(t *testing.T) {
+	// A fake curl, printing its arguments and standard input.
+	dir := t.TempDir()
+	script := "#!/bin/sh\nfor arg; do printf '[%s]\\n' \"$arg\"; done\ncat\n"
+	if err := os.WriteFile(filepath.Join(dir, "curl"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	tests := []struct {
+		method string
+		body   string
+		want   string
+	}{
+		{"GET", "", "[https://example.com:443/search?q=it's]\n[-H]\n[X-Quote: it's \"quoted\"]\n"},
+		{"HEAD", "", "[--head]\n[https://example.com:443/search?q=it's]\n[-H]\n[X-Quote: it's \"quoted\"]\n"},
+		{"PUT", "a'b\n", "[-X]\n[PUT]\n[https://example.com:443/search?q=it's]\n[-H]\n[X-Quote: it's \"quoted\"]\n[--data-binary]\n[a'b\n]\n"},
+		{"POST", "\x00\xff'\n", "[https://example.com:443/search?q=it's]\n[-H]\n[X-Quote: it's \"quoted\"]\n[--data-binary]\n[@-]\n\x00\xff'\n"},
+	}
+
+	for _, tt := range tests {
+		cmd := relay.CurlCommand(exportRequest(tt.method), []byte(tt.body))
+
+		out, err := exec.Command("sh", "-c", cmd).Output()
+		if err != nil {
+			t.Errorf("%s: running %s: %v", tt.method, cmd, err)
+			continue
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s: %s\nran with %q, want %q", tt.method, cmd, out, tt.want)
+		}
+	}
+}
+
+func TestGoSnippet(t *testing.T) {
+	req := exportRequest("POST")
+	req.Fields.Set("Host", "www.example.com")
+
+	code := relay.GoSnippet(req, []byte("a\"b\n"))
+
+	if _, err := parser.ParseFile(token.NewFileSet(), "", "package p\nfunc f() {\n"+code+"}\n", 0); err != nil {
+		t.Fatalf("invalid Go code: %v\n%s", err, code)
+	}
+
+	for _, want := range []string{
+		`body := strings.NewReader("a\"b\n")`,
+		`http.NewRequest("POST", "https://example.com:443/search?q=it's", body)`,
+		`req.Host = "www.example.com"`,
+		`req.Header.Add("X-Quote", "it's \"quoted\"")`,
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("code lacks %s:\n%s", want, code)
+		}
+	}
+	if strings.Contains(code, "Content-Length") {
+		t.Errorf("code sets Content-Length:\n%s", code)
+	}
+}
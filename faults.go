@@ -0,0 +1,304 @@
+package relay
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+var errInjectedFault = errors.New("relay: connection dropped by fault rule")
+
+// A CertFault is a deliberate defect in a forged certificate, for testing
+// how clients handle certificate errors.
+type CertFault int
+
+const (
+	// No defect.
+	CertOK CertFault = iota
+
+	// The certificate expired a day ago.
+	CertExpired
+
+	// The certificate is issued for another host name.
+	CertWrongHost
+
+	// The certificate is self-signed, rather than signed by the proxy's
+	// authority.
+	CertSelfSigned
+
+	// The certificate has a 1024-bit RSA key.
+	CertWeakKey
+)
+
+// A CertFaultRule makes the proxy present defective certificates for some
+// tunnels. It should only ever be used in test environments.
+type CertFaultRule struct {
+	// Tunnels the rule applies to. Only host and client conditions are
+	// considered (see Match.Connect). If nil, all tunnels match.
+	Match *Match
+
+	// The defect to introduce.
+	Fault CertFault
+}
+
+// certFault returns the defect, if any, to introduce in certificates for a
+// tunnel to addr, requested in session s.
+func (p *Proxy) certFault(s *Session, addr string) CertFault {
+	for _, r := range p.CertFaults {
+		if r.Match.Connect(s, addr) {
+			return r.Fault
+		}
+	}
+	return CertOK
+}
+
+// forgeOptions says how to forge certificates for a tunnel.
+type forgeOptions struct {
+	fault CertFault
+	skew  time.Duration
+}
+
+// forgeOptions returns the defect and clock skew, if any, to introduce in
+// certificates for a tunnel to addr, requested in session s.
+func (p *Proxy) forgeOptions(s *Session, addr string) forgeOptions {
+	opts := forgeOptions{fault: p.certFault(s, addr)}
+
+	for _, r := range p.ClockSkew {
+		if r.Match.Connect(s, addr) {
+			if r.Certificates {
+				opts.skew = r.Skew
+			}
+			break
+		}
+	}
+
+	return opts
+}
+
+// apply introduces the defects which only affect a certificate's template.
+func (f CertFault) apply(template *x509.Certificate) {
+	switch f {
+	case CertExpired:
+		now := time.Now()
+		template.NotBefore = now.AddDate(-1, 0, 0)
+		template.NotAfter = now.AddDate(0, 0, -1)
+
+	case CertWrongHost:
+		template.DNSNames = []string{"wrong.host.invalid"}
+		template.IPAddresses = nil
+	}
+}
+
+// A FaultRule makes the proxy misbehave when forwarding some requests, for
+// chaos testing of clients and the services behind the proxy. It should only
+// ever be used in test environments.
+type FaultRule struct {
+	// Requests the rule applies to. If nil, everything matches.
+	Match *Match
+
+	// Fraction of matching requests affected, from 0 to 1. Zero means all
+	// of them.
+	Probability float64
+
+	// Time to wait before forwarding the request.
+	Delay time.Duration
+
+	// If non-zero, the request isn't forwarded at all, and a response with
+	// this status code, such as 500 or 503, is returned instead.
+	Status int
+
+	// If Abort is set, the client's connection is dropped once AbortAfter
+	// bytes of the response body have been sent.
+	Abort      bool
+	AbortAfter int64
+
+	// Number of bytes of the response body to corrupt, at random positions
+	// within its Content-Length, or its first 4 KiB.
+	Corrupt int
+}
+
+// fault returns the index of the rule in p.Faults deciding to affect req,
+// or -1. Only the first rule matching a request gets to decide.
+func (p *Proxy) fault(s *Session, req *heat.Request) int {
+	for i := range p.Faults {
+		r := &p.Faults[i]
+		if !r.Match.Request(s, req) {
+			continue
+		}
+		if r.Probability > 0 && r.Probability < 1 && rand.Float64() >= r.Probability {
+			return -1
+		}
+		return i
+	}
+	return -1
+}
+
+// sendFaulty is like sendTimed, but first applies the delay and status of
+// p.Faults[i], if i isn't -1.
+func (p *Proxy) sendFaulty(ctx context.Context, s *Session, req *heat.Request, i int) (*heat.Response, error) {
+	if i < 0 {
+		return p.sendTimed(ctx, s, req)
+	}
+
+	r := &p.Faults[i]
+
+	var what []string
+	if r.Delay > 0 {
+		what = append(what, "delay "+r.Delay.String())
+	}
+	if r.Status != 0 {
+		what = append(what, "status "+strconv.Itoa(r.Status))
+	}
+	if r.Abort {
+		what = append(what, "abort after "+strconv.FormatInt(r.AbortAfter, 10)+" bytes")
+	}
+	if r.Corrupt > 0 {
+		what = append(what, "corrupt "+strconv.Itoa(r.Corrupt)+" bytes")
+	}
+
+	p.count("faults.injected", 1)
+	p.decide(s, req, "", &DecisionRecord{
+		Action:  "rewrite",
+		Rule:    "Faults[" + strconv.Itoa(i) + "]",
+		Pattern: r.Match.String(),
+		Reason:  strings.Join(what, ", "),
+	})
+
+	if r.Delay > 0 {
+		if err := p.wait(ctx, r.Delay); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.Status != 0 {
+		return statusResponse(r.Status, "Fault injected by the proxy."), nil
+	}
+
+	return p.sendTimed(ctx, s, req)
+}
+
+// wait pauses for a duration according to the proxy's clock, unless ctx is
+// done first.
+func (p *Proxy) wait(ctx context.Context, d time.Duration) error {
+	wake := make(chan struct{})
+	t := p.clock().AfterFunc(d, func() { close(wake) })
+
+	select {
+	case <-wake:
+		return nil
+	case <-ctx.Done():
+		t.Stop()
+		return ctx.Err()
+	}
+}
+
+// apply arranges for a response's body to be corrupted or cut short.
+func (r *FaultRule) apply(resp *heat.Response) {
+	if resp.Body == nil || resp.Status == 101 || (!r.Abort && r.Corrupt <= 0) {
+		return
+	}
+
+	b := &faultBody{ReadCloser: resp.Body, abort: -1}
+	if r.Abort {
+		b.abort = r.AbortAfter
+	}
+
+	if r.Corrupt > 0 {
+		size := int64(4096)
+		if v, ok := fieldValue(resp.Fields, "Content-Length"); ok {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+				size = n
+			}
+		}
+		for i := 0; i < r.Corrupt; i++ {
+			b.corrupt = append(b.corrupt, rand.Int63n(size))
+		}
+		sort.Slice(b.corrupt, func(i, j int) bool { return b.corrupt[i] < b.corrupt[j] })
+	}
+
+	resp.Body = b
+}
+
+// The faultBody type corrupts bytes at given offsets of a body, and fails
+// once a given number of bytes have been read.
+type faultBody struct {
+	io.ReadCloser
+	read    int64
+	abort   int64   // -1 for never
+	corrupt []int64 // offsets, in order
+}
+
+func (b *faultBody) Read(buf []byte) (int, error) {
+	if b.abort >= 0 {
+		if b.read >= b.abort {
+			return 0, errInjectedFault
+		}
+		if room := b.abort - b.read; int64(len(buf)) > room {
+			buf = buf[:room]
+		}
+	}
+
+	n, err := b.ReadCloser.Read(buf)
+
+	for len(b.corrupt) > 0 && b.corrupt[0] < b.read+int64(n) {
+		buf[b.corrupt[0]-b.read] ^= byte(1 + rand.Intn(255))
+		b.corrupt = b.corrupt[1:]
+	}
+
+	b.read += int64(n)
+	return n, err
+}
+
+// A ClockSkewRule makes the proxy act as if upstream servers' clocks were
+// off, so that clients' handling of clock skew can be tested. It should
+// only ever be used in test environments.
+type ClockSkewRule struct {
+	// Requests and tunnels the rule applies to. Only host and client
+	// conditions are considered for tunnels (see Match.Connect). If nil,
+	// everything matches.
+	Match *Match
+
+	// How far ahead of the proxy's clock servers' clocks are. Negative
+	// values put them behind.
+	Skew time.Duration
+
+	// If set, forged certificates are valid from an hour before the skewed
+	// time until 90 days after it, rather than for the authority's validity
+	// period. A large enough skew makes them not yet valid, or expired.
+	Certificates bool
+
+	// If set, the Date field of responses is replaced with the skewed time.
+	Date bool
+}
+
+// applyClockSkew replaces the Date field of a response according to the
+// first rule in p.ClockSkew matching its request.
+func (p *Proxy) applyClockSkew(s *Session, req *heat.Request, resp *heat.Response) {
+	for i := range p.ClockSkew {
+		r := &p.ClockSkew[i]
+		if !r.Match.Request(s, req) {
+			continue
+		}
+
+		if r.Date {
+			resp.Fields.Set("Date", p.clock().Now().Add(r.Skew).UTC().Format(http.TimeFormat))
+			p.decide(s, req, "", &DecisionRecord{
+				Action:  "rewrite",
+				Rule:    "ClockSkew[" + strconv.Itoa(i) + "]",
+				Pattern: r.Match.String(),
+				Reason:  "Date skewed by " + r.Skew.String(),
+			})
+		}
+
+		return
+	}
+}
@@ -0,0 +1,276 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+	"github.com/erkl/relay/relaytest"
+)
+
+func TestCertFaults(t *testing.T) {
+	ca, cfg := testAuthority(t)
+
+	p := &relay.Proxy{Authority: ca}
+	for host, fault := range map[string]relay.CertFault{
+		"expired.example":    relay.CertExpired,
+		"wrong.example":      relay.CertWrongHost,
+		"selfsigned.example": relay.CertSelfSigned,
+		"weak.example":       relay.CertWeakKey,
+	} {
+		match, err := (&relay.Matcher{Hosts: []string{host}}).Compile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.CertFaults = append(p.CertFaults, relay.CertFaultRule{Match: match, Fault: fault})
+	}
+
+	tests := []struct {
+		host  string
+		err   interface{}
+		check func(cert *x509.Certificate) bool
+	}{
+		{"expired.example", &x509.CertificateInvalidError{}, func(cert *x509.Certificate) bool {
+			return cert.NotAfter.Before(time.Now())
+		}},
+		{"wrong.example", &x509.HostnameError{}, func(cert *x509.Certificate) bool {
+			return cert.VerifyHostname("wrong.example") != nil
+		}},
+		{"selfsigned.example", &x509.UnknownAuthorityError{}, func(cert *x509.Certificate) bool {
+			return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+		}},
+		{"weak.example", nil, func(cert *x509.Certificate) bool {
+			return cert.PublicKey.(*rsa.PublicKey).N.BitLen() == 1024
+		}},
+		{"fine.example", nil, func(cert *x509.Certificate) bool {
+			return cert.PublicKey.(*rsa.PublicKey).N.BitLen() == 2048
+		}},
+	}
+
+	for _, tt := range tests {
+		strict := cfg.Clone()
+		strict.ServerName = tt.host
+
+		_, err := connect(t, p, tt.host+":443", strict)
+		switch {
+		case tt.err == nil && err != nil:
+			t.Errorf("%s: handshake failed: %v", tt.host, err)
+		case tt.err != nil && (err == nil || !errors.As(err, tt.err)):
+			t.Errorf("%s: got error %v, want %T", tt.host, err, tt.err)
+		}
+
+		// Look at the certificate without verifying it.
+		conn, err := connect(t, p, tt.host+":443", &tls.Config{ServerName: tt.host, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("%s: handshake failed: %v", tt.host, err)
+		}
+		if cert := conn.ConnectionState().PeerCertificates[0]; !tt.check(cert) {
+			t.Errorf("%s: certificate lacks the expected defect", tt.host)
+		}
+	}
+}
+
+func TestFaults(t *testing.T) {
+	clock := relaytest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	start := clock.Now()
+
+	match := func(expr string) *relay.Match {
+		m, err := relay.ParseMatch(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	var calls int32
+	sent := make(chan time.Time, 1)
+	decisions := make(chan *relay.DecisionRecord, 1)
+
+	p := &relay.Proxy{
+		Clock: clock,
+		Faults: []relay.FaultRule{
+			{Match: match("path=/status"), Status: 503},
+			{Match: match("path=/delay"), Delay: 2 * time.Second},
+			{Match: match("path=/abort"), Abort: true, AbortAfter: 5},
+			{Match: match("path=/corrupt"), Corrupt: 3},
+			{Match: match("path=/maybe"), Probability: 0.5, Status: 500},
+		},
+		AuditDecision: func(r *relay.DecisionRecord) {
+			select {
+			case decisions <- r:
+			default:
+			}
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			if strings.HasSuffix(req.URI, "/delay") {
+				sent <- clock.Now()
+			}
+
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "100")
+			resp.Body = io.NopCloser(bytes.NewReader(make([]byte, 100)))
+			return resp, nil
+		},
+	}
+
+	get := func(path string) (int, []byte, error) {
+		conn := serve(t, p)
+		defer conn.Close()
+
+		io.WriteString(conn, "GET http://origin.test"+path+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+		body, err := io.ReadAll(resp.Body)
+		return resp.StatusCode, body, err
+	}
+
+	// Failed requests aren't forwarded.
+	if status, _, _ := get("/status"); status != 503 || atomic.LoadInt32(&calls) != 0 {
+		t.Errorf("/status: got status %d after %d calls", status, calls)
+	}
+	if r := <-decisions; r.Rule != "Faults[0]" || r.Action != "rewrite" || r.Reason != "status 503" {
+		t.Errorf("got decision %+v", r)
+	}
+
+	// Delayed requests are forwarded once the proxy's clock has advanced.
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+				clock.Advance(500 * time.Millisecond)
+			}
+		}
+	}()
+	if status, _, _ := get("/delay"); status != 200 {
+		t.Errorf("/delay: got status %d", status)
+	}
+	close(stop)
+	if at := <-sent; at.Sub(start) < 2*time.Second {
+		t.Errorf("/delay: forwarded after %v", at.Sub(start))
+	}
+
+	// Aborted responses are cut short.
+	if _, body, err := get("/abort"); len(body) != 5 || err == nil {
+		t.Errorf("/abort: got %d bytes, %v", len(body), err)
+	}
+
+	// Corrupted responses keep their length.
+	_, body, err := get("/corrupt")
+	if err != nil || len(body) != 100 {
+		t.Fatalf("/corrupt: got %d bytes, %v", len(body), err)
+	}
+	if n := 100 - bytes.Count(body, []byte{0}); n < 1 || n > 3 {
+		t.Errorf("/corrupt: %d bytes corrupted, want 1 to 3", n)
+	}
+
+	// Only some requests are affected by probabilistic rules.
+	failed := 0
+	for i := 0; i < 200; i++ {
+		if status, _, _ := get("/maybe"); status == 500 {
+			failed++
+		}
+	}
+	if failed < 60 || failed > 140 {
+		t.Errorf("/maybe: %d of 200 requests failed, want about half", failed)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	ca, cfg := testAuthority(t)
+	clock := relaytest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	match := func(expr string) *relay.Match {
+		m, err := relay.ParseMatch(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	year := 365 * 24 * time.Hour
+	decisions := make(chan *relay.DecisionRecord, 1)
+
+	p := &relay.Proxy{
+		Authority: ca,
+		Clock:     clock,
+		ClockSkew: []relay.ClockSkewRule{
+			{Match: match("host=ahead.example"), Skew: year, Certificates: true},
+			{Match: match("host=behind.example"), Skew: -year, Certificates: true},
+			{Match: match("host=near.example"), Skew: 10 * time.Minute, Certificates: true},
+			{Match: match("host=date.example"), Skew: 2 * time.Hour, Date: true},
+		},
+		AuditDecision: func(r *relay.DecisionRecord) { decisions <- r },
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			resp := heat.NewResponse(204, "No Content")
+			resp.Fields.Set("Date", "Wed, 01 Jan 2020 00:00:00 GMT")
+			return resp, nil
+		},
+	}
+
+	for _, tt := range []struct {
+		host  string
+		skew  time.Duration
+		valid bool
+	}{
+		{"ahead.example", year, false},
+		{"behind.example", -year, false},
+		{"near.example", 10 * time.Minute, true},
+	} {
+		strict := cfg.Clone()
+		strict.ServerName = tt.host
+
+		_, err := connect(t, p, tt.host+":443", strict)
+		var invalid x509.CertificateInvalidError
+		if tt.valid && err != nil {
+			t.Errorf("%s: handshake failed: %v", tt.host, err)
+		} else if !tt.valid && !errors.As(err, &invalid) {
+			t.Errorf("%s: got error %v, want an invalid certificate", tt.host, err)
+		}
+
+		// Certificates are valid from an hour before the skewed time.
+		conn, err := connect(t, p, tt.host+":443", &tls.Config{ServerName: tt.host, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("%s: handshake failed: %v", tt.host, err)
+		}
+		cert := conn.ConnectionState().PeerCertificates[0]
+		if d := cert.NotBefore.Sub(time.Now().Add(tt.skew - time.Hour)); d < -time.Minute || d > time.Minute {
+			t.Errorf("%s: certificate is valid from %v", tt.host, cert.NotBefore)
+		}
+		if d := cert.NotAfter.Sub(cert.NotBefore); d != 90*24*time.Hour+time.Hour {
+			t.Errorf("%s: certificate is valid for %v", tt.host, d)
+		}
+	}
+
+	// Only rules with Date set change the Date field.
+	for _, host := range []string{"near.example", "date.example"} {
+		conn := serve(t, p)
+		io.WriteString(conn, "GET http://"+host+"/ HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+
+		want := "Wed, 01 Jan 2020 00:00:00 GMT"
+		if host == "date.example" {
+			want = "Wed, 01 Jan 2020 02:00:00 GMT"
+		}
+		if got := resp.Header.Get("Date"); got != want {
+			t.Errorf("%s: got Date %q, want %q", host, got, want)
+		}
+	}
+
+	if r := <-decisions; r.Rule != "ClockSkew[3]" || r.Reason != "Date skewed by 2h0m0s" {
+		t.Errorf("got decision %+v", r)
+	}
+}
@@ -0,0 +1,830 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+var errUnknownFlow = errors.New("relay: no such held flow")
+
+// A FlowState describes how far along a Flow is.
+type FlowState int
+
+const (
+	// The request has been forwarded, and the response is (or will be)
+	// on its way.
+	FlowActive FlowState = iota
+
+	// The request has been intercepted, and is waiting to be resumed or
+	// dropped.
+	FlowHeld
+
+	// The exchange is over.
+	FlowDone
+
+	// The exchange failed, see Flow.Err.
+	FlowFailed
+)
+
+// A Flow is a record of a single exchange which passed through a proxy.
+type Flow struct {
+	ID         uint64
+	ClientAddr net.Addr
+	State      FlowState
+	Start      time.Time
+	End        time.Time
+
+	// The request's header, and up to FlowStore.MaxBodySize bytes of its
+	// body. The Request's own Body field is always nil. RequestTruncated
+	// is set if the body was longer than that, or wasn't captured at all.
+	Request          *heat.Request
+	RequestBody      []byte
+	RequestTruncated bool
+
+	// Same as above, for the response. Nil until the response arrives.
+	Response          *heat.Response
+	ResponseBody      []byte
+	ResponseTruncated bool
+
+	// Set if the response took the fast path (see Proxy.Passthrough), in
+	// which case its body isn't captured.
+	Passthrough bool
+
+	// For WebSocket connections, the messages relayed after the handshake,
+	// each with up to FlowStore.MaxBodySize bytes of its payload. Such flows
+	// stay active until the connection closes. MessagesTruncated is set if
+	// there were more than FlowStore.MaxMessages.
+	Messages          []FlowMessage
+	MessagesTruncated bool
+
+	// Set if the exchange failed.
+	Err error
+
+	// The session's annotations, as of when the response arrived.
+	Annotations map[interface{}]interface{}
+
+	size   int64
+	redact *Redactor
+
+	// Digests of the flow's shared bodies, if any, and whether the flow
+	// has been evicted (and its bodies released).
+	requestSum, responseSum bodySum
+	evicted                 bool
+
+	resume chan *heat.Request
+	drop   chan struct{}
+}
+
+// A FlowMessage is a record of a WebSocket message relayed over a flow's
+// connection, reassembled from its fragments, or of a control frame. Unless
+// Proxy.OnWebSocketMessage is set, connections may negotiate extensions,
+// in which case payloads are recorded as sent, such as compressed.
+type FlowMessage struct {
+	Time       time.Time `json:"time"`
+	FromClient bool      `json:"from_client,omitempty"`
+
+	// The opcode of the message, as defined in section 5.2 of RFC 6455,
+	// such as 1 for text or 9 for ping.
+	Opcode int `json:"opcode"`
+
+	// The message's payload, its full size, and whether it was truncated.
+	Data      []byte `json:"data,omitempty"`
+	Size      int    `json:"size"`
+	Truncated bool   `json:"truncated,omitempty"`
+
+	// Set if Proxy.OnWebSocketMessage dropped the message.
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+// A FlowStore keeps a record of recent exchanges, and can hold requests
+// until they're resumed or dropped, as needed when building interactive
+// tools on top of a proxy. Set Proxy.Flows to start recording.
+//
+// Identical captured bodies, as are common for static assets, are stored
+// (and count towards MaxBytes) only once, and shared between flows. They
+// must not be modified.
+//
+// All methods are safe for concurrent use.
+type FlowStore struct {
+	// Optional condition for which requests to record.
+	Capture *Match
+
+	// If set, only the requests it samples among those matching Capture
+	// are recorded. The rest are counted by the "flows.unsampled" metric.
+	Sample *Sampler
+
+	// Maximum number of flows kept. Zero means 1000. Held flows aren't
+	// evicted, so may push the count beyond it.
+	MaxFlows int
+
+	// Maximum number of captured body bytes kept, across all flows. Zero
+	// means no limit.
+	MaxBytes int64
+
+	// Maximum number of bytes captured per request or response body, or
+	// WebSocket message. Zero means bodies aren't captured.
+	MaxBodySize int
+
+	// Maximum number of WebSocket messages recorded per flow. Zero means
+	// 1000.
+	MaxMessages int
+
+	// Optional function deciding which requests to hold, until Resume or
+	// Drop is called with the flow's ID. The Flow must not be modified.
+	Hold func(f *Flow) bool
+
+	// Optional function called whenever a flow is added or changes state.
+	// Called with the store's lock held; it must not call the store's
+	// methods.
+	OnChange func(f *Flow)
+
+	// If set, flows evicted from memory are archived in Storage under
+	// "flows/<id>", where Get still finds them. Archived flows have no
+	// annotations, and their errors only keep their messages.
+	Storage Storage
+
+	// If set, captured bodies and messages are accounted for in this
+	// budget. Once it's exceeded, response bodies stop being captured, and
+	// the oldest flows are evicted.
+	Memory *MemoryBudget
+
+	mu     sync.Mutex
+	flows  []*Flow
+	bodies map[bodySum]*sharedBody
+	bytes  int64
+	next   uint64
+
+	// Evicted flows yet to be archived in Storage, and whether they're
+	// being archived.
+	archiving []*Flow
+	flushing  bool
+}
+
+// Flows returns copies of all retained flows for which filter returns true,
+// oldest first. If filter is nil, all flows are returned.
+func (fs *FlowStore) Flows(filter func(f *Flow) bool) []Flow {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var list []Flow
+
+	for _, f := range fs.flows {
+		if filter == nil || filter(f) {
+			list = append(list, *f)
+		}
+	}
+
+	return list
+}
+
+// Get returns a copy of the flow with a given ID, if it's still retained or
+// has been archived in fs.Storage.
+func (fs *FlowStore) Get(id uint64) (Flow, bool) {
+	fs.mu.Lock()
+	if f := fs.find(id); f != nil {
+		defer fs.mu.Unlock()
+		return *f, true
+	}
+	for _, f := range fs.archiving {
+		if f.ID == id {
+			defer fs.mu.Unlock()
+			return *f, true
+		}
+	}
+	fs.mu.Unlock()
+
+	if fs.Storage != nil {
+		if f, err := fs.unarchive(id); err == nil {
+			return *f, true
+		}
+	}
+
+	return Flow{}, false
+}
+
+// Resume lets a held request continue. If req is non-nil it replaces the
+// held request in its entirety (including its body), and must have correct
+// framing header fields.
+func (fs *FlowStore) Resume(id uint64, req *heat.Request) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f := fs.find(id)
+	if f == nil || f.State != FlowHeld {
+		return errUnknownFlow
+	}
+
+	f.State = FlowActive
+	f.resume <- req
+	fs.changed(f)
+
+	return nil
+}
+
+// Drop rejects a held request, answering it with "403 Forbidden".
+func (fs *FlowStore) Drop(id uint64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f := fs.find(id)
+	if f == nil || f.State != FlowHeld {
+		return errUnknownFlow
+	}
+
+	f.State = FlowFailed
+	f.Err = &PolicyDenied{"request dropped"}
+	f.End = time.Now()
+	close(f.drop)
+	fs.changed(f)
+
+	return nil
+}
+
+func (fs *FlowStore) find(id uint64) *Flow {
+	for _, f := range fs.flows {
+		if f.ID == id {
+			return f
+		}
+	}
+	return nil
+}
+
+func (fs *FlowStore) changed(f *Flow) {
+	if fs.OnChange != nil {
+		fs.OnChange(f)
+	}
+}
+
+// begin records a new request, and holds it if fs.Hold says so. Returns an
+// error if the request was dropped, or the request's context is done. The
+// flow's record of the exchange is redacted by r (which may be nil).
+func (fs *FlowStore) begin(s *Session, req *heat.Request, r *Redactor) (*Flow, error) {
+	f := &Flow{
+		ClientAddr: s.ClientAddr,
+		Start:      time.Now(),
+		Request:    r.Request(req),
+		redact:     r,
+	}
+
+	if fs.MaxBodySize > 0 && req.Body != nil {
+		sp, err := s.SpoolRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		f.RequestBody = readPrefix(sp.Open(), fs.MaxBodySize)
+		f.RequestTruncated = sp.Size() > int64(len(f.RequestBody))
+		f.RequestBody = r.body(&f.Request.Fields, f.RequestBody)
+	} else if req.Body != nil {
+		f.RequestTruncated = true
+	}
+
+	// Once added, the flow may be resumed at any moment.
+	held := fs.Hold != nil && fs.Hold(f)
+	if held {
+		f.State = FlowHeld
+		f.resume = make(chan *heat.Request, 1)
+		f.drop = make(chan struct{})
+	}
+
+	fs.add(f)
+
+	if !held {
+		return f, nil
+	}
+
+	select {
+	case edited := <-f.resume:
+		if edited != nil {
+			*req = *edited
+
+			fs.mu.Lock()
+			f.Request = f.redact.Request(req)
+			fs.mu.Unlock()
+		}
+		return f, nil
+
+	case <-f.drop:
+		return nil, f.Err
+
+	case <-s.Context().Done():
+		fs.finish(s, f, nil, s.Context().Err())
+		return nil, s.Context().Err()
+	}
+}
+
+// add stores a new flow, evicting old ones as necessary.
+func (fs *FlowStore) add(f *Flow) {
+	defer fs.flush()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.next++
+	f.ID = fs.next
+	f.size = int64(len(f.RequestBody))
+
+	fs.flows = append(fs.flows, f)
+	fs.grow(f.size)
+	f.requestSum = fs.share(f, &f.RequestBody)
+	fs.evict()
+	fs.changed(f)
+}
+
+// grow accounts for n more bytes being captured. Must be called with the
+// store's lock held.
+func (fs *FlowStore) grow(n int64) {
+	fs.bytes += n
+	fs.Memory.add(MemoryCaptures, n)
+}
+
+// evict evicts the oldest flows until the store is within its limits,
+// queueing them to be archived by flush. Must be called with the store's
+// lock held.
+func (fs *FlowStore) evict() {
+	max := fs.MaxFlows
+	if max <= 0 {
+		max = 1000
+	}
+
+	left := len(fs.flows)
+	kept := fs.flows[:0]
+
+	for i, f := range fs.flows {
+		if left <= max && (left == 1 || !fs.overBytes()) {
+			kept = append(kept, fs.flows[i:]...)
+			break
+		}
+
+		// Held flows are kept until they're resumed or dropped, as nothing
+		// else would let their requests continue.
+		if f.State == FlowHeld {
+			kept = append(kept, f)
+			continue
+		}
+
+		fs.grow(-f.size)
+		if fs.Storage != nil {
+			fs.archiving = append(fs.archiving, f)
+		}
+		fs.release(f)
+		f.evicted = true
+		left--
+	}
+
+	for i := len(kept); i < len(fs.flows); i++ {
+		fs.flows[i] = nil
+	}
+	fs.flows = kept
+}
+
+// overBytes reports whether the store holds more captured bytes than
+// fs.MaxBytes, or fs.Memory, allows. Must be called with the store's lock
+// held.
+func (fs *FlowStore) overBytes() bool {
+	if fs.MaxBytes > 0 && fs.bytes > fs.MaxBytes {
+		return true
+	}
+	if fs.Memory.over(MemoryCaptures) {
+		fs.Memory.count("memory.captures.shed", 1)
+		return true
+	}
+	return false
+}
+
+// finish records the outcome of an exchange. If a response was received,
+// its body is wrapped to capture its first bytes.
+func (fs *FlowStore) finish(s *Session, f *Flow, resp *heat.Response, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f.Annotations = s.Annotations()
+
+	if err != nil {
+		f.State = FlowFailed
+		f.Err = err
+		f.End = time.Now()
+	} else {
+		f.Response = f.redact.Response(resp)
+		if resp.Status == 101 && isWebSocket(resp.Fields) {
+			s.upgraded = f
+		} else if resp.Body == nil || resp.Status == 101 {
+			f.State = FlowDone
+			f.End = time.Now()
+		} else {
+			resp.Body = &flowBody{ReadCloser: resp.Body, fs: fs, f: f}
+		}
+	}
+
+	fs.changed(f)
+}
+
+// message records a WebSocket message relayed over a flow's connection.
+func (fs *FlowStore) message(f *Flow, m FlowMessage) {
+	defer fs.flush()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	max := fs.MaxMessages
+	if max <= 0 {
+		max = 1000
+	}
+	if len(f.Messages) >= max {
+		f.MessagesTruncated = true
+		return
+	}
+
+	m.Time = time.Now()
+	m.Size = len(m.Data)
+	m.Data = f.redact.message(m.Data)
+	if len(m.Data) > fs.MaxBodySize {
+		m.Data, m.Truncated = m.Data[:fs.MaxBodySize], true
+	}
+	m.Data = append([]byte(nil), m.Data...)
+
+	f.Messages = append(f.Messages, m)
+
+	if !f.evicted {
+		f.size += int64(len(m.Data))
+		fs.grow(int64(len(m.Data)))
+		fs.evict()
+	}
+	fs.changed(f)
+}
+
+// closeUpgraded marks the flow of a WebSocket connection as done, once the
+// connection has closed.
+func (fs *FlowStore) closeUpgraded(f *Flow, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f.End = time.Now()
+	if err != nil {
+		f.State = FlowFailed
+		f.Err = err
+	} else {
+		f.State = FlowDone
+	}
+
+	fs.changed(f)
+}
+
+// skipBody keeps a flow's response body from being captured.
+func (fs *FlowStore) skipBody(f *Flow) {
+	fs.mu.Lock()
+	f.Passthrough = true
+	fs.mu.Unlock()
+}
+
+// The flowBody type captures the first bytes of a response body, and marks
+// its flow as done once the body has been consumed. Bodies which need to be
+// redacted are only added to the flow once complete.
+type flowBody struct {
+	io.ReadCloser
+	fs   *FlowStore
+	f    *Flow
+	raw  []byte
+	done bool
+}
+
+// captured returns the body captured so far.
+func (b *flowBody) captured() *[]byte {
+	if b.f.redact.redactsBodies() {
+		return &b.raw
+	}
+	return &b.f.ResponseBody
+}
+
+func (b *flowBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+
+	b.fs.mu.Lock()
+
+	body := b.captured()
+
+	room := b.fs.MaxBodySize - len(*body)
+	if b.f.Passthrough || b.fs.Memory.over(MemoryCaptures) {
+		room = 0
+	}
+
+	m := n
+	if m > room {
+		b.f.ResponseTruncated = true
+		m = room
+	}
+
+	if m > 0 {
+		*body = append(*body, buf[:m]...)
+		if !b.f.evicted {
+			b.f.size += int64(m)
+			b.fs.grow(int64(m))
+		}
+	}
+
+	if err != nil && !b.done {
+		b.end(err)
+		b.fs.mu.Unlock()
+		b.fs.flush()
+		return n, err
+	}
+
+	b.fs.mu.Unlock()
+	return n, err
+}
+
+func (b *flowBody) Close() error {
+	b.fs.mu.Lock()
+	if !b.done {
+		b.end(nil)
+	}
+	b.fs.mu.Unlock()
+	b.fs.flush()
+
+	return b.ReadCloser.Close()
+}
+
+// end marks the flow as done. Must be called with the store's lock held.
+func (b *flowBody) end(err error) {
+	b.done = true
+	b.f.End = time.Now()
+
+	if b.f.redact.redactsBodies() {
+		// Copies of the flow handed out so far share its response header,
+		// so it's replaced rather than modified.
+		resp := cloneResponse(b.f.Response)
+		body := b.f.redact.body(&resp.Fields, b.raw)
+		b.f.Response, b.f.ResponseBody = resp, body
+		if !b.f.evicted {
+			b.f.size += int64(len(body) - len(b.raw))
+			b.fs.grow(int64(len(body) - len(b.raw)))
+		}
+		b.raw = nil
+	}
+
+	b.f.responseSum = b.fs.share(b.f, &b.f.ResponseBody)
+
+	if err != nil && err != io.EOF {
+		b.f.State = FlowFailed
+		b.f.Err = err
+	} else {
+		b.f.State = FlowDone
+	}
+
+	b.fs.evict()
+	b.fs.changed(b.f)
+}
+
+// cloneRequest copies a request's header.
+func cloneRequest(req *heat.Request) *heat.Request {
+	c := *req
+	c.Fields = append(heat.Fields(nil), req.Fields...)
+	c.Body = nil
+	return &c
+}
+
+// cloneResponse copies a response's header.
+func cloneResponse(resp *heat.Response) *heat.Response {
+	c := *resp
+	c.Fields = append(heat.Fields(nil), resp.Fields...)
+	c.Body = nil
+	return &c
+}
+
+// readPrefix reads up to n bytes from r, and closes it.
+func readPrefix(r io.ReadCloser, n int) []byte {
+	defer r.Close()
+
+	buf := make([]byte, n)
+	n, _ = io.ReadFull(r, buf)
+
+	return buf[:n]
+}
+
+// A bodySum is the SHA-256 digest of a captured body.
+type bodySum [sha256.Size]byte
+
+// A sharedBody is a captured body shared between flows.
+type sharedBody struct {
+	data []byte
+	refs int
+}
+
+// share replaces a flow's freshly captured body, already accounted for in
+// f.size and fs.bytes, with an identical one captured before, if any. The
+// body's bytes are then accounted for by the store rather than the flow.
+// Returns the body's digest. Must be called with the store's lock held.
+func (fs *FlowStore) share(f *Flow, body *[]byte) bodySum {
+	if len(*body) == 0 || f.evicted {
+		return bodySum{}
+	}
+
+	sum := bodySum(sha256.Sum256(*body))
+	size := int64(len(*body))
+
+	if fs.bodies == nil {
+		fs.bodies = make(map[bodySum]*sharedBody)
+	}
+
+	f.size -= size
+
+	if sb := fs.bodies[sum]; sb != nil {
+		sb.refs++
+		fs.grow(-size)
+		*body = sb.data
+	} else {
+		fs.bodies[sum] = &sharedBody{data: *body, refs: 1}
+	}
+
+	return sum
+}
+
+// release gives up a flow's references to shared bodies. Must be called
+// with the store's lock held.
+func (fs *FlowStore) release(f *Flow) {
+	for _, sum := range []bodySum{f.requestSum, f.responseSum} {
+		sb := fs.bodies[sum]
+		if sum == (bodySum{}) || sb == nil {
+			continue
+		}
+		if sb.refs--; sb.refs == 0 {
+			fs.grow(-int64(len(sb.data)))
+			delete(fs.bodies, sum)
+		}
+	}
+}
+
+// A flowRecord is the form in which a Flow is archived.
+type flowRecord struct {
+	ID         uint64    `json:"id"`
+	ClientAddr string    `json:"client_addr,omitempty"`
+	State      FlowState `json:"state"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end,omitempty"`
+
+	Request           *heat.Request  `json:"request"`
+	RequestBody       []byte         `json:"request_body,omitempty"`
+	RequestBodySum    string         `json:"request_body_sum,omitempty"`
+	RequestTruncated  bool           `json:"request_truncated,omitempty"`
+	Response          *heat.Response `json:"response,omitempty"`
+	ResponseBody      []byte         `json:"response_body,omitempty"`
+	ResponseBodySum   string         `json:"response_body_sum,omitempty"`
+	ResponseTruncated bool           `json:"response_truncated,omitempty"`
+	Passthrough       bool           `json:"passthrough,omitempty"`
+	Messages          []FlowMessage  `json:"messages,omitempty"`
+	MessagesTruncated bool           `json:"messages_truncated,omitempty"`
+	Err               string         `json:"error,omitempty"`
+}
+
+// flush archives the flows evicted so far in fs.Storage. It's called
+// without the store's lock held, so that slow storage doesn't hold up
+// other flows.
+func (fs *FlowStore) flush() {
+	if fs.Storage == nil {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Whoever is already archiving flows will get to these too.
+	if fs.flushing {
+		return
+	}
+	fs.flushing = true
+
+	for len(fs.archiving) > 0 {
+		// Flows evicted mid-response keep changing, so they're archived as
+		// they were at this point.
+		flows := make([]Flow, len(fs.archiving))
+		for i, f := range fs.archiving {
+			flows[i] = *f
+		}
+
+		fs.mu.Unlock()
+		for i := range flows {
+			fs.archive(&flows[i])
+		}
+		fs.mu.Lock()
+
+		n := copy(fs.archiving, fs.archiving[len(flows):])
+		for i := n; i < len(fs.archiving); i++ {
+			fs.archiving[i] = nil
+		}
+		fs.archiving = fs.archiving[:n]
+	}
+
+	fs.flushing = false
+}
+
+// archive writes a flow to fs.Storage. Its bodies are stored separately,
+// under "bodies/<digest>", so that identical ones are only stored once.
+// Failures are ignored, as the flow would have been forgotten anyway.
+func (fs *FlowStore) archive(f *Flow) {
+	r := flowRecord{
+		ID:                f.ID,
+		State:             f.State,
+		Start:             f.Start,
+		End:               f.End,
+		Request:           f.Request,
+		RequestBodySum:    fs.archiveBody(f.requestSum, f.RequestBody),
+		RequestTruncated:  f.RequestTruncated,
+		Response:          f.Response,
+		ResponseBodySum:   fs.archiveBody(f.responseSum, f.ResponseBody),
+		ResponseTruncated: f.ResponseTruncated,
+		Passthrough:       f.Passthrough,
+		Messages:          f.Messages,
+		MessagesTruncated: f.MessagesTruncated,
+	}
+	if f.ClientAddr != nil {
+		r.ClientAddr = f.ClientAddr.String()
+	}
+	if f.Err != nil {
+		r.Err = f.Err.Error()
+	}
+
+	if data, err := json.Marshal(&r); err == nil {
+		fs.Storage.Put("flows/"+strconv.FormatUint(f.ID, 10), data, 0)
+	}
+}
+
+// archiveBody writes a body to fs.Storage, unless it's already there, and
+// returns its hex-encoded digest. Bodies which weren't shared, such as those
+// of flows evicted before their response was complete, have no digest yet.
+func (fs *FlowStore) archiveBody(sum bodySum, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	if sum == (bodySum{}) {
+		sum = sha256.Sum256(body)
+	}
+
+	key := hex.EncodeToString(sum[:])
+	if r, err := fs.Storage.Open("bodies/" + key); err == nil {
+		r.Close()
+	} else {
+		fs.Storage.Put("bodies/"+key, body, 0)
+	}
+
+	return key
+}
+
+// unarchive reads a flow from fs.Storage.
+func (fs *FlowStore) unarchive(id uint64) (*Flow, error) {
+	data, err := fs.Storage.Get("flows/" + strconv.FormatUint(id, 10))
+	if err != nil {
+		return nil, err
+	}
+
+	var r flowRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+
+	f := &Flow{
+		ID:                r.ID,
+		State:             r.State,
+		Start:             r.Start,
+		End:               r.End,
+		Request:           r.Request,
+		RequestBody:       r.RequestBody,
+		RequestTruncated:  r.RequestTruncated,
+		Response:          r.Response,
+		ResponseBody:      r.ResponseBody,
+		ResponseTruncated: r.ResponseTruncated,
+		Passthrough:       r.Passthrough,
+		Messages:          r.Messages,
+		MessagesTruncated: r.MessagesTruncated,
+	}
+	if r.RequestBodySum != "" {
+		if f.RequestBody, err = fs.Storage.Get("bodies/" + r.RequestBodySum); err != nil {
+			return nil, err
+		}
+	}
+	if r.ResponseBodySum != "" {
+		if f.ResponseBody, err = fs.Storage.Get("bodies/" + r.ResponseBodySum); err != nil {
+			return nil, err
+		}
+	}
+	if r.ClientAddr != "" {
+		f.ClientAddr = archivedAddr(r.ClientAddr)
+	}
+	if r.Err != "" {
+		f.Err = errors.New(r.Err)
+	}
+
+	return f, nil
+}
+
+// The archivedAddr type stands in for the client address of an archived
+// flow.
+type archivedAddr string
+
+func (a archivedAddr) Network() string { return "tcp" }
+func (a archivedAddr) String() string  { return string(a) }
@@ -0,0 +1,143 @@
+package relay_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+	"github.com/erkl/relay/relaytest"
+)
+
+func TestFlowStoreKeepsHeldFlows(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+
+	fs := &relay.FlowStore{
+		MaxFlows: 1,
+		Hold: func(f *relay.Flow) bool {
+			return strings.HasSuffix(f.Request.URI, "/held")
+		},
+	}
+
+	client := proxyClient(t, &relay.Proxy{Flows: fs})
+
+	done := make(chan string, 1)
+	go func() {
+		resp, err := client.Get(srv.URL + "/held")
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		done <- string(body)
+	}()
+
+	held := waitHeld(t, fs)
+
+	// Evicts flows beyond MaxFlows, but must skip the held one.
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL + "/other")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if err := fs.Resume(held, nil); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	select {
+	case body := <-done:
+		if body != "/held" {
+			t.Fatalf("held request got %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("held request never completed")
+	}
+}
+
+func waitHeld(t *testing.T, fs *relay.FlowStore) uint64 {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		flows := fs.Flows(func(f *relay.Flow) bool {
+			return f.State == relay.FlowHeld
+		})
+		if len(flows) > 0 {
+			return flows[0].ID
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatal("request wasn't held")
+	return 0
+}
+
+func TestFlowStoreArchivesPartialBodies(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat(r.URL.Path[1:], 5)))
+		if r.URL.Path != "/c" {
+			w.(http.Flusher).Flush()
+			<-release
+		}
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	ids := make(map[string]uint64)
+
+	fs := &relay.FlowStore{
+		MaxFlows:    1,
+		MaxBodySize: 1024,
+		Storage:     &relay.MemoryStorage{},
+		OnChange: func(f *relay.Flow) {
+			mu.Lock()
+			ids[f.Request.URI] = f.ID
+			mu.Unlock()
+		},
+	}
+
+	s := relaytest.NewServer(&relay.Proxy{Flows: fs})
+	defer s.Close()
+	defer close(release)
+
+	// Each request evicts the previous one's flow while its response is
+	// still on its way.
+	for _, path := range []string{"/a", "/b", "/c"} {
+		resp, err := s.Client().Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(resp.Body, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range []string{"/a", "/b"} {
+		mu.Lock()
+		id := ids[path]
+		mu.Unlock()
+
+		f, ok := fs.Get(id)
+		if !ok {
+			t.Fatalf("flow for %s wasn't archived", path)
+		}
+		if want := strings.Repeat(path[1:], 5); string(f.ResponseBody) != want {
+			t.Errorf("archived flow for %s has body %q, want %q", path, f.ResponseBody, want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+
+	"github.com/erkl/heat"
+)
+
+// A FormPart is a single part of a multipart/form-data request body, such
+// as a form field or an uploaded file.
+type FormPart struct {
+	// The part's header, and the form field name and file name (if any)
+	// from its Content-Disposition field.
+	Header   textproto.MIMEHeader
+	Name     string
+	FileName string
+
+	// The part's content, whose size is only known once it's been read.
+	// Whatever is read from it is buffered, such that it's still forwarded
+	// unless the part is dropped or replaced.
+	Body io.Reader
+
+	// Set to drop the part, or to replace its content. The part's header
+	// may be modified too.
+	Drop    bool
+	Replace io.Reader
+}
+
+// A teeBody keeps a copy of what's read from a part.
+type teeBody struct {
+	r   io.Reader
+	buf bytes.Buffer
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.buf.Write(p[:n])
+	return n, err
+}
+
+// FilterMultipart rewrites a multipart/form-data request body as it's
+// forwarded, passing each of its parts to fn, which may inspect, modify,
+// drop or replace it. The body is parsed as it's read, so large uploads
+// needn't be held in memory, unless fn reads them. The rewritten body is sent
+// chunked, and keeps its boundary. Requests of other types are left alone,
+// and false is returned.
+//
+// If fn returns an error, or the body is malformed, reading the rewritten
+// body fails, so that the request is abandoned.
+func FilterMultipart(req *heat.Request, fn func(part *FormPart) error) bool {
+	if req.Body == nil {
+		return false
+	}
+
+	v, ok := fieldValue(req.Fields, "Content-Type")
+	if !ok {
+		return false
+	}
+	mediaType, params, err := mime.ParseMediaType(v)
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return false
+	}
+
+	body := req.Body
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(filterParts(body, pw, params["boundary"], fn))
+	}()
+
+	req.Body = &pipedBody{pr, body}
+	req.Fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Content-Length") && !f.Is("Content-MD5") && !f.Is("Digest")
+	})
+	req.Fields.Set("Transfer-Encoding", "chunked")
+
+	return true
+}
+
+// filterParts copies the parts of a multipart body from r to w, through fn.
+func filterParts(r io.Reader, w io.Writer, boundary string, fn func(part *FormPart) error) error {
+	mr := multipart.NewReader(r, boundary)
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		body := &teeBody{r: p}
+		part := &FormPart{
+			Header:   p.Header,
+			Name:     p.FormName(),
+			FileName: p.FileName(),
+			Body:     body,
+		}
+
+		if err := fn(part); err != nil {
+			return err
+		}
+		if part.Drop {
+			continue
+		}
+
+		out, err := mw.CreatePart(part.Header)
+		if err != nil {
+			return err
+		}
+
+		if part.Replace != nil {
+			_, err = io.Copy(out, part.Replace)
+		} else if _, err = out.Write(body.buf.Bytes()); err == nil {
+			_, err = io.Copy(out, p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+// A pipedBody reads a body rewritten by another goroutine.
+type pipedBody struct {
+	*io.PipeReader
+	src io.Closer
+}
+
+func (b *pipedBody) Close() error {
+	b.PipeReader.CloseWithError(errors.New("relay: body closed"))
+	return b.src.Close()
+}
+
+// filterForm passes the parts of multipart/form-data request bodies through
+// p.OnFormPart.
+func (p *Proxy) filterForm(s *Session, req *heat.Request) {
+	if p.OnFormPart == nil {
+		return
+	}
+
+	FilterMultipart(req, func(part *FormPart) error {
+		return p.OnFormPart(s, req, part)
+	})
+}
@@ -0,0 +1,164 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strings"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+// multipartBody returns a multipart/form-data body with a form field, an
+// uploaded file, and another form field, along with its boundary.
+func multipartBody() (string, string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("name", "alice")
+	w, _ := mw.CreateFormFile("upload", "notes.txt")
+	io.WriteString(w, "SECRET plans")
+	mw.WriteField("comment", "hi")
+	mw.Close()
+	return buf.String(), mw.Boundary()
+}
+
+// readParts parses a multipart body, returning its parts' names, file
+// names, header fields and content.
+func readParts(t *testing.T, r io.Reader, boundary string) []string {
+	t.Helper()
+
+	var parts []string
+	mr := multipart.NewReader(r, boundary)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return parts
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, fmt.Sprintf("%s %q %q %s", p.FormName(), p.FileName(), p.Header.Get("X-Checked"), body))
+	}
+}
+
+func TestFilterMultipart(t *testing.T) {
+	body, boundary := multipartBody()
+
+	req := heat.NewRequest("POST", "/upload")
+	req.Fields.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+	req.Fields.Set("Content-Length", fmt.Sprint(len(body)))
+	req.Body = io.NopCloser(strings.NewReader(body))
+
+	var seen []string
+	ok := relay.FilterMultipart(req, func(part *relay.FormPart) error {
+		seen = append(seen, part.Name+"/"+part.FileName)
+
+		switch part.Name {
+		case "name":
+			// Parts which have been read partly are still forwarded whole.
+			buf := make([]byte, 2)
+			io.ReadFull(part.Body, buf)
+			part.Header.Set("X-Checked", string(buf))
+		case "upload":
+			if content, _ := io.ReadAll(part.Body); bytes.Contains(content, []byte("SECRET")) {
+				part.Replace = strings.NewReader("[removed]")
+			}
+		case "comment":
+			part.Drop = true
+		}
+		return nil
+	})
+	if !ok {
+		t.Fatal("FilterMultipart returned false")
+	}
+
+	if field(req.Fields, "Content-Length") != "" || field(req.Fields, "Transfer-Encoding") != "chunked" {
+		t.Errorf("got header %v", req.Fields)
+	}
+
+	got := readParts(t, req.Body, boundary)
+	want := []string{`name "" "al" alice`, `upload "notes.txt" "" [removed]`}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got parts %q, want %q", got, want)
+	}
+	if fmt.Sprint(seen) != "[name/ upload/notes.txt comment/]" {
+		t.Errorf("saw parts %q", seen)
+	}
+	req.Body.Close()
+}
+
+func TestFilterMultipartFailures(t *testing.T) {
+	body, boundary := multipartBody()
+
+	newRequest := func(contentType, body string) *heat.Request {
+		req := heat.NewRequest("POST", "/upload")
+		req.Fields.Set("Content-Type", contentType)
+		req.Body = io.NopCloser(strings.NewReader(body))
+		return req
+	}
+
+	// Other bodies are left alone.
+	for _, ct := range []string{"application/x-www-form-urlencoded", "multipart/form-data", "multipart/mixed; boundary=" + boundary} {
+		if relay.FilterMultipart(newRequest(ct, body), func(*relay.FormPart) error { return nil }) {
+			t.Errorf("%s: filtered", ct)
+		}
+	}
+
+	// Errors abandon the body.
+	denied := errors.New("denied")
+	req := newRequest("multipart/form-data; boundary="+boundary, body)
+	relay.FilterMultipart(req, func(part *relay.FormPart) error {
+		if part.FileName != "" {
+			return denied
+		}
+		return nil
+	})
+	if _, err := io.ReadAll(req.Body); err != denied {
+		t.Errorf("got %v, want the hook's error", err)
+	}
+
+	// As do truncated bodies.
+	req = newRequest("multipart/form-data; boundary="+boundary, body[:strings.Index(body, "plans")])
+	relay.FilterMultipart(req, func(*relay.FormPart) error { return nil })
+	if _, err := io.ReadAll(req.Body); err == nil {
+		t.Error("got no error for a truncated body")
+	}
+}
+
+func TestOnFormPart(t *testing.T) {
+	body, boundary := multipartBody()
+
+	sent := make(chan []string, 1)
+	p := &relay.Proxy{
+		OnFormPart: func(s *relay.Session, req *heat.Request, part *relay.FormPart) error {
+			part.Drop = part.FileName != ""
+			return nil
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			sent <- readParts(t, req.Body, boundary)
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			return resp, nil
+		},
+	}
+
+	conn := serve(t, p)
+	fmt.Fprintf(conn, "POST http://origin.test/upload HTTP/1.1\r\nHost: origin.test\r\n"+
+		"Content-Type: multipart/form-data; boundary=%s\r\nContent-Length: %d\r\n\r\n%s", boundary, len(body), body)
+
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 200 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if got := <-sent; fmt.Sprint(got) != `[name "" "" alice comment "" "" hi]` {
+		t.Errorf("forwarded parts %q", got)
+	}
+}
@@ -0,0 +1,379 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// Maximum size of a directory listing rendered as HTML.
+const maxFTPListing = 4 << 20
+
+// ftp serves a GET or HEAD request for an ftp:// URL, acting as an FTP
+// client. Files are streamed back as they're retrieved, and directories are
+// rendered as HTML listings. Credentials may be given using basic
+// authentication; otherwise the anonymous account is used.
+func (t *Transport) ftp(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		resp := statusResponse(405, "Only GET and HEAD are supported for FTP URLs.")
+		resp.Fields.Set("Allow", "GET, HEAD")
+		return resp, nil
+	}
+
+	u, err := url.ParseRequestURI(req.URI)
+	if err != nil {
+		return statusResponse(400, "Invalid URI in request."), nil
+	}
+
+	addr := withPort(req.Remote, "ftp")
+
+	conn, err := t.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	c := &ftpConn{Conn: textproto.NewConn(conn), t: t, ctx: ctx, conn: conn, addr: addr}
+
+	resp, err := c.get(req, u.Path)
+
+	// Keep the session open while a file is being transferred.
+	if err == nil {
+		if data, ok := resp.Body.(net.Conn); ok {
+			resp.Body = &ftpBody{ReadCloser: data, c: c, stop: stop}
+			return resp, nil
+		}
+	}
+
+	stop()
+	c.quit()
+
+	return resp, err
+}
+
+// The ftpConn type is an FTP control connection.
+type ftpConn struct {
+	*textproto.Conn
+	t    *Transport
+	ctx  context.Context
+	conn net.Conn
+	addr string
+}
+
+// cmd sends a command, and reads the reply.
+func (c *ftpConn) cmd(format string, args ...interface{}) (int, string, error) {
+	if _, err := c.Cmd(format, args...); err != nil {
+		return 0, "", &DialError{c.addr, err}
+	}
+	return c.reply()
+}
+
+// reply reads a (possibly multi-line) reply.
+func (c *ftpConn) reply() (int, string, error) {
+	code, msg, err := c.ReadResponse(0)
+	if err != nil {
+		if _, ok := err.(*textproto.Error); !ok {
+			return 0, "", &UpstreamProtocolError{err}
+		}
+	}
+	return code, msg, nil
+}
+
+func (c *ftpConn) quit() {
+	c.Cmd("QUIT")
+	c.Close()
+}
+
+// get logs in, and retrieves the file or directory at p.
+func (c *ftpConn) get(req *heat.Request, p string) (*heat.Response, error) {
+	if code, msg, err := c.reply(); err != nil {
+		return nil, err
+	} else if code != 220 {
+		return nil, &UpstreamProtocolError{fmt.Errorf("ftp: greeting: %d %s", code, msg)}
+	}
+
+	if resp, err := c.login(req); resp != nil || err != nil {
+		return resp, err
+	}
+
+	if _, _, err := c.cmd("TYPE I"); err != nil {
+		return nil, err
+	}
+
+	name, err := url.PathUnescape(p)
+	if err != nil || strings.ContainsAny(name, "\r\n") {
+		return statusResponse(400, "Invalid FTP path."), nil
+	}
+	if name = strings.TrimSuffix(name, "/"); name == "" {
+		name = "/"
+	}
+
+	// Is it a directory?
+	if code, _, err := c.cmd("CWD %s", name); err != nil {
+		return nil, err
+	} else if code/100 == 2 {
+		if !strings.HasSuffix(p, "/") {
+			resp := statusResponse(301, "Moved.")
+			resp.Fields.Set("Location", p+"/")
+			return resp, nil
+		}
+		return c.list(req, name)
+	}
+
+	return c.retrieve(req, name)
+}
+
+// login authenticates using the request's basic authentication credentials,
+// or anonymously. It returns a response if the server refused to log in.
+func (c *ftpConn) login(req *heat.Request) (*heat.Response, error) {
+	user, pass := "anonymous", "relay@"
+
+	if value, ok := fieldValue(req.Fields, "Authorization"); ok && len(value) > 6 && strings.EqualFold(value[:6], "basic ") {
+		if b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[6:])); err == nil {
+			if i := bytes.IndexByte(b, ':'); i >= 0 {
+				user, pass = string(b[:i]), string(b[i+1:])
+			}
+		}
+	}
+
+	if strings.ContainsAny(user+pass, "\r\n") {
+		return statusResponse(400, "Invalid FTP credentials."), nil
+	}
+
+	code, _, err := c.cmd("USER %s", user)
+	if err == nil && code == 331 {
+		code, _, err = c.cmd("PASS %s", pass)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if code/100 != 2 {
+		resp := statusResponse(401, "FTP login failed.")
+		resp.Fields.Set("WWW-Authenticate", `Basic realm="FTP"`)
+		return resp, nil
+	}
+
+	return nil, nil
+}
+
+// list renders the listing of the current directory as HTML.
+func (c *ftpConn) list(req *heat.Request, dir string) (*heat.Response, error) {
+	data, err := c.open("LIST")
+	if err != nil || data == nil {
+		return statusResponse(502, "FTP server refused to list directory."), err
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(data, maxFTPListing))
+	data.Close()
+	if err != nil {
+		return nil, &UpstreamProtocolError{err}
+	}
+
+	if _, _, err := c.reply(); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+
+	title := html.EscapeString(dir)
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<title>Index of %s</title>\n<h1>Index of %s</h1>\n<pre>\n", title, title)
+
+	if dir != "/" {
+		b.WriteString("<a href=\"../\">../</a>\n")
+	}
+
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if name, isDir, ok := parseListLine(line); ok {
+			href := url.PathEscape(name)
+			if isDir {
+				href += "/"
+				name += "/"
+			}
+			fmt.Fprintf(&b, "<a href=\"%s\">%s</a>\n", html.EscapeString(href), html.EscapeString(name))
+		}
+	}
+
+	b.WriteString("</pre>\n")
+
+	resp := heat.NewResponse(200, heat.ReasonPhrase(200))
+	resp.Fields.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Fields.Set("Content-Length", strconv.Itoa(b.Len()))
+	if req.Method != "HEAD" {
+		resp.Body = ioutil.NopCloser(&b)
+	}
+
+	return resp, nil
+}
+
+// parseListLine extracts the file name from a line of a Unix style LIST
+// listing, the de facto standard.
+func parseListLine(line string) (name string, isDir, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 9 || strings.HasPrefix(line, "total ") {
+		return "", false, false
+	}
+
+	// The name is everything after the eighth field, spaces included.
+	rest := line
+	for i := 0; i < 8; i++ {
+		rest = strings.TrimLeft(rest, " ")
+		j := strings.IndexByte(rest, ' ')
+		if j < 0 {
+			return "", false, false
+		}
+		rest = rest[j:]
+	}
+	name = strings.TrimLeft(rest, " ")
+
+	if line[0] == 'l' {
+		if i := strings.Index(name, " -> "); i >= 0 {
+			name = name[:i]
+		}
+	}
+
+	if name == "." || name == ".." {
+		return "", false, false
+	}
+
+	return name, line[0] == 'd', true
+}
+
+// retrieve streams the file at name.
+func (c *ftpConn) retrieve(req *heat.Request, name string) (*heat.Response, error) {
+	size := int64(-1)
+	if code, msg, err := c.cmd("SIZE %s", name); err != nil {
+		return nil, err
+	} else if code == 213 {
+		if n, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err == nil {
+			size = n
+		}
+	}
+
+	resp := heat.NewResponse(200, heat.ReasonPhrase(200))
+
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	resp.Fields.Set("Content-Type", ctype)
+
+	if size >= 0 {
+		resp.Fields.Set("Content-Length", strconv.FormatInt(size, 10))
+	} else {
+		resp.Fields.Set("Transfer-Encoding", "chunked")
+	}
+
+	if req.Method == "HEAD" {
+		if size < 0 {
+			return statusResponse(404, "No such file."), nil
+		}
+		return resp, nil
+	}
+
+	data, err := c.open("RETR %s", name)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return statusResponse(404, "No such file."), nil
+	}
+
+	resp.Body = data
+	return resp, nil
+}
+
+// open sets up a passive data connection, and issues a transfer command. It
+// returns a nil connection if the server refused the command.
+func (c *ftpConn) open(format string, args ...interface{}) (net.Conn, error) {
+	port, err := c.passive()
+	if err != nil {
+		return nil, err
+	}
+
+	// Always connect to the control connection's host, whatever the server
+	// says, to rule out FTP bounce attacks.
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+
+	data, err := c.t.dial(c.ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	code, _, err := c.cmd(format, args...)
+	if err != nil || code/100 != 1 {
+		data.Close()
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// passive asks the server for a data connection port.
+func (c *ftpConn) passive() (int, error) {
+	code, msg, err := c.cmd("EPSV")
+	if err != nil {
+		return 0, err
+	}
+
+	if code == 229 {
+		i, j := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if i >= 0 && j > i+4 {
+			if port, err := strconv.Atoi(msg[i+4 : j]); err == nil {
+				return port, nil
+			}
+		}
+	}
+
+	code, msg, err = c.cmd("PASV")
+	if err != nil {
+		return 0, err
+	}
+
+	if code == 227 {
+		i, j := strings.IndexByte(msg, '('), strings.IndexByte(msg, ')')
+		if i >= 0 && j > i {
+			parts := strings.Split(msg[i+1:j], ",")
+			if len(parts) == 6 {
+				hi, err1 := strconv.Atoi(strings.TrimSpace(parts[4]))
+				lo, err2 := strconv.Atoi(strings.TrimSpace(parts[5]))
+				if err1 == nil && err2 == nil {
+					return hi<<8 | lo, nil
+				}
+			}
+		}
+	}
+
+	return 0, &UpstreamProtocolError{fmt.Errorf("ftp: passive mode refused: %d %s", code, msg)}
+}
+
+// The ftpBody type closes an FTP session once a retrieved file has been
+// read.
+type ftpBody struct {
+	io.ReadCloser
+	c    *ftpConn
+	stop func() bool
+}
+
+func (b *ftpBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.stop()
+	b.c.reply()
+	b.c.quit()
+	return err
+}
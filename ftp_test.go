@@ -0,0 +1,191 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+// ftpServer starts a minimal FTP server holding a directory /pub, with a
+// subdirectory and a file. Logins are accepted for anonymous and alice (with
+// password "secret").
+func ftpServer(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFTP(conn)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func serveFTP(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	var user string
+	var data net.Listener
+
+	// transfer writes s over the data connection.
+	transfer := func(s string) {
+		if data == nil {
+			reply("425 No data connection")
+			return
+		}
+		defer data.Close()
+
+		reply("150 Opening data connection")
+		if c, err := data.Accept(); err == nil {
+			io.WriteString(c, s)
+			c.Close()
+		}
+		reply("226 Transfer complete")
+	}
+
+	reply("220 Welcome")
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+
+		switch cmd {
+		case "USER":
+			user = arg
+			reply("331 Password required")
+		case "PASS":
+			if user == "anonymous" || (user == "alice" && arg == "secret") {
+				reply("230 Logged in")
+			} else {
+				reply("530 Login incorrect")
+			}
+		case "TYPE":
+			reply("200 Type set")
+		case "CWD":
+			if arg == "/pub" {
+				reply("250 Directory changed")
+			} else {
+				reply("550 No such directory")
+			}
+		case "SIZE":
+			if arg == "/pub/file name.txt" {
+				reply("213 11")
+			} else {
+				reply("550 No such file")
+			}
+		case "EPSV":
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 Can't open data connection")
+				continue
+			}
+			reply("229 Entering Extended Passive Mode (|||%d|)", data.Addr().(*net.TCPAddr).Port)
+		case "LIST":
+			transfer("total 8\r\n" +
+				"drwxr-xr-x 2 ftp ftp 4096 Jan 01 00:00 sub\r\n" +
+				"-rw-r--r-- 1 ftp ftp   11 Jan 01 00:00 file name.txt\r\n")
+		case "RETR":
+			transfer("hello world")
+		case "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Not implemented")
+		}
+	}
+}
+
+// responseField returns the value of a response's header field.
+func responseField(resp *heat.Response, name string) string {
+	for _, f := range resp.Fields {
+		if f.Is(name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+func TestFTP(t *testing.T) {
+	addr := ftpServer(t)
+	tr := &relay.Transport{}
+
+	get := func(method, uri, auth string) (*heat.Response, string) {
+		t.Helper()
+
+		req := heat.NewRequest(method, uri)
+		req.Scheme, req.Remote = "ftp", addr
+		if auth != "" {
+			req.Fields.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+		}
+
+		resp, err := tr.RoundTripContext(context.Background(), req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, uri, err)
+		}
+
+		var body []byte
+		if resp.Body != nil {
+			body, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		return resp, string(body)
+	}
+
+	// Directories are rendered as HTML, at URLs ending with a slash.
+	resp, _ := get("GET", "/pub", "")
+	if location := responseField(resp, "Location"); resp.Status != 301 || location != "/pub/" {
+		t.Errorf("got status %d and Location %q, want a redirect to /pub/", resp.Status, location)
+	}
+
+	resp, body := get("GET", "/pub/", "")
+	if resp.Status != 200 || !strings.Contains(body, `<a href="sub/">sub/</a>`) ||
+		!strings.Contains(body, `<a href="file%20name.txt">file name.txt</a>`) {
+		t.Errorf("got status %d and listing:\n%s", resp.Status, body)
+	}
+
+	// Files are retrieved as they are.
+	resp, body = get("GET", "/pub/file%20name.txt", "alice:secret")
+	if length := responseField(resp, "Content-Length"); resp.Status != 200 || body != "hello world" || length != "11" {
+		t.Errorf("got status %d, Content-Length %q and body %q", resp.Status, length, body)
+	}
+	if ctype := responseField(resp, "Content-Type"); !strings.HasPrefix(ctype, "text/plain") {
+		t.Errorf("got Content-Type %q", ctype)
+	}
+
+	// Failed logins ask for credentials.
+	if resp, _ := get("GET", "/pub/", "alice:wrong"); resp.Status != 401 {
+		t.Errorf("got status %d for bad credentials, want 401", resp.Status)
+	}
+
+	// Only reading is supported.
+	if resp, _ := get("PUT", "/pub/new.txt", ""); resp.Status != 405 {
+		t.Errorf("got status %d for PUT, want 405", resp.Status)
+	}
+}
@@ -0,0 +1,154 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/xo"
+)
+
+// hopByHop lists the fields which must never survive scrubbing, other than
+// those added back for framing and protocol upgrades.
+var hopByHop = []string{
+	"Keep-Alive",
+	"Public",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailers",
+}
+
+func FuzzScrubHeaderFields(f *testing.F) {
+	f.Add("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: keep-alive, X-Secret\r\nX-Secret: 1\r\n\r\n")
+	f.Add("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\n")
+	f.Add("POST / HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: gzip, chunked\r\nTE: trailers\r\n\r\n")
+	f.Add("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nProxy-Authorization: Basic Zm9vOmJhcg==\r\n\r\n")
+	f.Add("GET / HTTP/1.0\r\nProxy-Connection: keep-alive\r\nKeep-Alive: timeout=5\r\n\r\n")
+
+	f.Fuzz(func(t *testing.T, head string) {
+		req, err := heat.ReadRequestHeader(xo.NewReader(bytes.NewReader([]byte(head)), nil))
+		if err != nil {
+			return
+		}
+
+		var tokens []string
+		req.Fields.Split("Connection", ',', func(s string) bool {
+			tokens = append(tokens, s)
+			return true
+		})
+
+		if err := scrubRequest(req, nil); err != nil {
+			return
+		}
+
+		for _, name := range append(hopByHop, tokens...) {
+			if strings.EqualFold(name, "Upgrade") || strings.EqualFold(name, "Connection") {
+				continue
+			}
+			if _, ok := fieldValue(req.Fields, name); ok && !isFraming(name) {
+				t.Fatalf("%q survived scrubbing: %q", name, req.Fields)
+			}
+		}
+
+		checkFraming(t, req.Fields)
+	})
+}
+
+func FuzzBodyFraming(f *testing.F) {
+	f.Add("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", "GET")
+	f.Add("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n", "GET")
+	f.Add("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n3;x=y\r\nabc\r\n0\r\nTrailer: 1\r\n\r\n", "GET")
+	f.Add("HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nuntil the connection closes", "GET")
+	f.Add("HTTP/1.1 204 No Content\r\nContent-Length: 5\r\n\r\n", "GET")
+	f.Add("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n", "HEAD")
+
+	f.Fuzz(func(t *testing.T, msg, method string) {
+		r := xo.NewReader(bytes.NewReader([]byte(msg)), nil)
+		resp, err := heat.ReadResponseHeader(r)
+		if err != nil || resp.Status == 101 {
+			return
+		}
+
+		size, err := heat.ResponseBodySize(resp, method)
+		if err != nil {
+			return
+		}
+		src, err := heat.OpenBody(r, size)
+		if err != nil {
+			return
+		}
+		body, err := io.ReadAll(src)
+		if err != nil {
+			return
+		}
+
+		if err := scrubResponse(resp, method, nil); err != nil {
+			t.Fatalf("scrubbing a readable response: %v", err)
+		}
+		checkFraming(t, resp.Fields)
+
+		// What's relayed must read back as the same body.
+		size, err = heat.ResponseBodySize(resp, method)
+		if err != nil {
+			t.Fatalf("scrubbed response has invalid framing: %v", err)
+		}
+
+		var buf bytes.Buffer
+		w := xo.NewWriter(&buf, nil)
+		if err := heat.WriteResponseHeader(w, resp); err != nil {
+			t.Fatal(err)
+		}
+		if err := heat.WriteBody(w, bytes.NewReader(body), size); err != nil {
+			t.Fatal(err)
+		}
+		w.Flush()
+
+		r = xo.NewReader(&buf, nil)
+		if resp, err = heat.ReadResponseHeader(r); err != nil {
+			t.Fatalf("relayed response unreadable: %v", err)
+		}
+		if size, err = heat.ResponseBodySize(resp, method); err != nil {
+			t.Fatalf("relayed response has invalid framing: %v", err)
+		}
+		src, _ = heat.OpenBody(r, size)
+		relayed, err := io.ReadAll(src)
+		if err != nil {
+			t.Fatalf("relayed body unreadable: %v", err)
+		}
+		if !bytes.Equal(relayed, body) {
+			t.Fatalf("relayed body %q, want %q", relayed, body)
+		}
+	})
+}
+
+func isFraming(name string) bool {
+	return strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Transfer-Encoding")
+}
+
+// checkFraming fails the test unless a scrubbed message is framed by
+// exactly one Content-Length, or a chunked Transfer-Encoding.
+func checkFraming(t *testing.T, fields heat.Fields) {
+	t.Helper()
+
+	var lengths, encodings int
+	for _, f := range fields {
+		switch {
+		case f.Is("Content-Length"):
+			if _, err := strconv.ParseUint(f.Value, 10, 63); err != nil {
+				t.Fatalf("invalid Content-Length %q", f.Value)
+			}
+			lengths++
+		case f.Is("Transfer-Encoding"):
+			encodings++
+		}
+	}
+
+	if lengths+encodings != 1 {
+		t.Fatalf("ambiguous framing: %q", fields)
+	}
+}
@@ -0,0 +1,405 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// A GraphQLOperation is a GraphQL operation found in a request.
+type GraphQLOperation struct {
+	// "query", "mutation" or "subscription".
+	Type string
+
+	// The operation's name, or "" for anonymous operations.
+	Name string
+
+	// The GraphQL document, and the operation's variables.
+	Query     string
+	Variables map[string]interface{}
+}
+
+// A GraphQLConfig enables the detection of GraphQL operations in requests,
+// so that they can be matched on (see Matcher.Operations), logged (see
+// Session.GraphQL) and measured.
+//
+// Operations are found in GET requests' query parameters, and in
+// application/json (including batches) and application/graphql request
+// bodies. The "graphql.requests" and "graphql.errors" metrics count
+// requests carrying operations, and those answered with an error status or
+// a JSON body with top-level errors. The same metrics, and the total time
+// taken in microseconds, are counted per operation as
+// "graphql.op.NAME.requests", "graphql.op.NAME.errors" and
+// "graphql.op.NAME.time", with anonymous operations named "anonymous".
+type GraphQLConfig struct {
+	// Requests inspected. If nil, all requests are.
+	Match *Match
+
+	// Maximum size of request and response bodies inspected. Defaults to
+	// 1 MiB.
+	MaxBody int64
+}
+
+func (g *GraphQLConfig) maxBody() int64 {
+	if g.MaxBody > 0 {
+		return g.MaxBody
+	}
+	return 1 << 20
+}
+
+// A graphqlRequest holds the operations found in a request, and whether it
+// failed.
+type graphqlRequest struct {
+	ops []*GraphQLOperation
+
+	mu     sync.Mutex
+	failed bool
+}
+
+func (g *graphqlRequest) fail() {
+	g.mu.Lock()
+	g.failed = true
+	g.mu.Unlock()
+}
+
+// GraphQL returns the GraphQL operations found in the request currently
+// being served (or, in OnComplete, just served), if Proxy.GraphQL is set.
+func (s *Session) GraphQL() []*GraphQLOperation {
+	if s.graphql != nil {
+		return s.graphql.ops
+	}
+	return nil
+}
+
+// detectGraphQL looks for GraphQL operations in a request.
+func (p *Proxy) detectGraphQL(s *Session, req *heat.Request) {
+	s.graphql = nil
+
+	g := p.GraphQL
+	if g == nil || !g.Match.Request(s, req) {
+		return
+	}
+
+	var ops []*GraphQLOperation
+
+	switch req.Method {
+	case "GET":
+		_, query, _ := strings.Cut(req.URI, "?")
+		values, err := url.ParseQuery(query)
+		if err != nil || values.Get("query") == "" {
+			return
+		}
+		var vars map[string]interface{}
+		if v := values.Get("variables"); v != "" {
+			json.Unmarshal([]byte(v), &vars)
+		}
+		ops = append(ops, graphqlOperation(values.Get("query"), values.Get("operationName"), vars))
+
+	case "POST":
+		v, ok := fieldValue(req.Fields, "Content-Type")
+		if !ok || req.Body == nil {
+			return
+		}
+		mediaType, _, err := mime.ParseMediaType(v)
+		if err != nil || (mediaType != "application/json" && mediaType != "application/graphql") {
+			return
+		}
+
+		data, ok := readJSONBody(req.Fields, &req.Body, g.maxBody())
+		if !ok {
+			return
+		}
+
+		if mediaType == "application/graphql" {
+			ops = append(ops, graphqlOperation(string(data), "", nil))
+			break
+		}
+
+		type request struct {
+			Query         string                 `json:"query"`
+			OperationName string                 `json:"operationName"`
+			Variables     map[string]interface{} `json:"variables"`
+		}
+
+		var batch []request
+		if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+			json.Unmarshal(data, &batch)
+		} else {
+			var r request
+			if json.Unmarshal(data, &r) == nil {
+				batch = append(batch, r)
+			}
+		}
+
+		for _, r := range batch {
+			if r.Query != "" {
+				ops = append(ops, graphqlOperation(r.Query, r.OperationName, r.Variables))
+			}
+		}
+	}
+
+	if len(ops) > 0 {
+		s.graphql = &graphqlRequest{ops: ops}
+	}
+}
+
+// watchGraphQL arranges for GraphQL errors in a response to be noticed.
+func (p *Proxy) watchGraphQL(s *Session, resp *heat.Response) {
+	g := s.graphql
+	if g == nil {
+		return
+	}
+
+	if resp.Status >= 400 {
+		g.fail()
+		return
+	}
+
+	if resp.Body == nil || resp.Status == 101 || !isJSONResponse(resp.Fields) {
+		return
+	}
+
+	coding, _ := fieldValue(resp.Fields, "Content-Encoding")
+	resp.Body = &graphqlBody{
+		ReadCloser: resp.Body,
+		g:          g,
+		coding:     strings.ToLower(strings.TrimSpace(coding)),
+		limit:      p.GraphQL.maxBody(),
+	}
+}
+
+func isJSONResponse(fields heat.Fields) bool {
+	v, ok := fieldValue(fields, "Content-Type")
+	if !ok {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(v)
+	return err == nil && isJSONType(mediaType)
+}
+
+// The graphqlBody type looks for top-level errors in a GraphQL response as
+// it's read.
+type graphqlBody struct {
+	io.ReadCloser
+	g      *graphqlRequest
+	coding string
+	limit  int64
+
+	buf  bytes.Buffer
+	over bool
+	done bool
+}
+
+func (b *graphqlBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	if !b.over {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.over, b.buf = true, bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+
+	if err == io.EOF && !b.over && !b.done {
+		b.done = true
+		b.check()
+	}
+
+	return n, err
+}
+
+// Close checks the response if that hasn't happened yet, as bodies of known
+// length are read no further than their last byte, so their EOF may never
+// be seen.
+func (b *graphqlBody) Close() error {
+	if !b.over && !b.done {
+		b.done = true
+		b.check()
+	}
+	return b.ReadCloser.Close()
+}
+
+// check decodes the response, failing the request if it reports errors.
+func (b *graphqlBody) check() {
+	var r io.Reader = &b.buf
+	if b.coding != "" && b.coding != "identity" {
+		dec, ok := decoder(b.coding, ioutil.NopCloser(r))
+		if !ok {
+			return
+		}
+		r = io.LimitReader(dec, b.limit)
+	}
+
+	var resp struct {
+		Errors []json.RawMessage `json:"errors"`
+	}
+
+	data, _ := ioutil.ReadAll(r)
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+		var batch []struct {
+			Errors []json.RawMessage `json:"errors"`
+		}
+		if json.Unmarshal(data, &batch) == nil {
+			for _, r := range batch {
+				resp.Errors = append(resp.Errors, r.Errors...)
+			}
+		}
+	} else {
+		json.Unmarshal(data, &resp)
+	}
+
+	if len(resp.Errors) > 0 {
+		b.g.fail()
+	}
+}
+
+// countGraphQL counts the metrics of a completed request carrying GraphQL
+// operations.
+func (p *Proxy) countGraphQL(s *Session, total time.Duration) {
+	g := s.graphql
+	if g == nil || p.Metrics == nil {
+		return
+	}
+
+	g.mu.Lock()
+	failed := g.failed
+	g.mu.Unlock()
+
+	var errors int64
+	if failed {
+		errors = 1
+	}
+
+	p.count("graphql.requests", 1)
+	p.count("graphql.errors", errors)
+
+	for _, op := range g.ops {
+		name := op.Name
+		if name == "" {
+			name = "anonymous"
+		}
+		p.count("graphql.op."+name+".requests", 1)
+		p.count("graphql.op."+name+".errors", errors)
+		p.count("graphql.op."+name+".time", total.Microseconds())
+	}
+}
+
+// graphqlOperation describes the operation a request executes from a
+// document.
+func graphqlOperation(query, name string, vars map[string]interface{}) *GraphQLOperation {
+	op := &GraphQLOperation{Type: "query", Name: name, Query: query, Variables: vars}
+
+	defs := graphqlDefinitions(query)
+	for _, d := range defs {
+		if name == "" || d.Name == name {
+			op.Type, op.Name = d.Type, d.Name
+			break
+		}
+	}
+
+	return op
+}
+
+// graphqlDefinitions lists the operations defined in a GraphQL document,
+// with only their types and names filled in.
+func graphqlDefinitions(doc string) []GraphQLOperation {
+	var defs []GraphQLOperation
+
+	depth, parens := 0, 0
+	inDef := false
+
+	for i := 0; i < len(doc); i++ {
+		c := doc[i]
+
+		switch {
+		case c == '#':
+			for i < len(doc) && doc[i] != '\n' {
+				i++
+			}
+
+		case c == '"':
+			if strings.HasPrefix(doc[i:], `"""`) {
+				end := strings.Index(doc[i+3:], `"""`)
+				if end < 0 {
+					return defs
+				}
+				i += end + 5
+				continue
+			}
+			for i++; i < len(doc) && doc[i] != '"'; i++ {
+				if doc[i] == '\\' {
+					i++
+				}
+			}
+
+		case c == '(':
+			parens++
+		case c == ')':
+			parens--
+
+		case c == '{' && parens == 0:
+			if depth == 0 {
+				if !inDef {
+					defs = append(defs, GraphQLOperation{Type: "query"})
+				}
+				inDef = false
+			}
+			depth++
+		case c == '}' && parens == 0:
+			depth--
+
+		case isNameStart(c) && depth == 0 && parens == 0:
+			j := i
+			for j < len(doc) && isNameChar(doc[j]) {
+				j++
+			}
+			word := doc[i:j]
+			i = j - 1
+
+			if inDef {
+				continue
+			}
+
+			switch word {
+			case "query", "mutation", "subscription":
+				name := ""
+				k := j
+				for k < len(doc) && strings.IndexByte(" \t\r\n,", doc[k]) >= 0 {
+					k++
+				}
+				if k < len(doc) && isNameStart(doc[k]) {
+					l := k
+					for l < len(doc) && isNameChar(doc[l]) {
+						l++
+					}
+					name = doc[k:l]
+					i = l - 1
+				}
+				defs = append(defs, GraphQLOperation{Type: word, Name: name})
+				inDef = true
+
+			case "fragment":
+				inDef = true
+			}
+		}
+	}
+
+	return defs
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || '0' <= c && c <= '9'
+}
@@ -0,0 +1,174 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestGraphQLOperations(t *testing.T) {
+	ops := make(chan []*relay.GraphQLOperation, 1)
+	sent := make(chan string, 1)
+
+	p := &relay.Proxy{
+		GraphQL: &relay.GraphQLConfig{},
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			ops <- s.GraphQL()
+			return nil
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			var body []byte
+			if req.Body != nil {
+				body, _ = io.ReadAll(req.Body)
+			}
+			sent <- string(body)
+			return heat.NewResponse(204, "No Content"), nil
+		},
+	}
+
+	get := func(params ...string) string {
+		v := url.Values{}
+		for i := 0; i < len(params); i += 2 {
+			v.Set(params[i], params[i+1])
+		}
+		return v.Encode()
+	}
+
+	for _, tt := range []struct {
+		method, query, contentType, body string
+		want                             string
+	}{
+		{"GET", get("query", "{ me { id } }"), "", "", "[query  map[]]"},
+		{"GET", get("query", "mutation Like($id: ID!) { like(id: $id) }", "operationName", "Like", "variables", `{"id": 7}`), "", "",
+			"[mutation Like map[id:7]]"},
+		{"POST", "", "application/json", `{"query": "query A { a } mutation B($x: Int) { b(x: $x) }", "operationName": "B", "variables": {"x": 1}}`,
+			"[mutation B map[x:1]]"},
+		{"POST", "", "application/json; charset=utf-8", `[{"query": "query A { a }"}, {"query": "{ b }"}, {"query": ""}]`,
+			"[query A map[] query  map[]]"},
+		{"POST", "", "application/graphql", "subscription OnEvent { event { id } }", "[subscription OnEvent map[]]"},
+		{"POST", "", "application/json", `{"query": "fragment F on User { id } query Q { me { ...F } }"}`, "[query Q map[]]"},
+		{"POST", "", "application/json", `{"query": "# mutation X\n{ a(s: \"mutation Y\", t: \"\"\"query Z\"\"\") }"}`, "[query  map[]]"},
+
+		// Other requests carry no operations.
+		{"GET", get("q", "{ me }"), "", "", "[]"},
+		{"POST", "", "text/plain", `{"query": "{ a }"}`, "[]"},
+		{"POST", "", "application/json", `{"query": `, "[]"},
+	} {
+		conn := serve(t, p)
+		fmt.Fprintf(conn, "%s http://origin.test/graphql?%s HTTP/1.1\r\nHost: origin.test\r\n", tt.method, tt.query)
+		if tt.method == "POST" {
+			fmt.Fprintf(conn, "Content-Type: %s\r\nContent-Length: %d\r\n", tt.contentType, len(tt.body))
+		}
+		io.WriteString(conn, "\r\n"+tt.body)
+
+		if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 204 {
+			t.Fatalf("got status %d", resp.StatusCode)
+		}
+
+		var got []string
+		for _, op := range <-ops {
+			got = append(got, fmt.Sprintf("%s %s %v", op.Type, op.Name, op.Variables))
+		}
+		if s := "[" + strings.Join(got, " ") + "]"; s != tt.want {
+			t.Errorf("%s %s%s: got %s, want %s", tt.method, tt.query, tt.body, s, tt.want)
+		}
+
+		// Bodies are still forwarded.
+		if body := <-sent; body != tt.body {
+			t.Errorf("%s %s: forwarded %q", tt.method, tt.body, body)
+		}
+	}
+}
+
+func TestGraphQLMatchAndMetrics(t *testing.T) {
+	likes, err := relay.ParseMatch("op=Like*,anonymous")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := likes.String(); !strings.Contains(s, "op=Like*,anonymous") {
+		t.Errorf("got match %s", s)
+	}
+
+	m := new(counters)
+	p := &relay.Proxy{
+		Metrics: m,
+		GraphQL: &relay.GraphQLConfig{},
+		HeaderRules: []relay.HeaderRule{
+			{Request: true, Match: likes, Action: relay.SetHeader, Name: "X-Op", Value: "matched"},
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			io.Copy(io.Discard, req.Body)
+
+			// Echo the matched header, and fail some operations.
+			body := `{"data": {"op": "` + field(req.Fields, "X-Op") + `"}}`
+			status := 200
+			switch {
+			case strings.Contains(req.URI, "failing"):
+				status = 500
+			case strings.Contains(req.URI, "erroring"):
+				body = `{"data": null, "errors": [{"message": "nope"}]}`
+			}
+
+			resp := heat.NewResponse(status, heat.ReasonPhrase(status))
+			resp.Fields.Set("Content-Type", "application/json")
+			resp.Fields.Set("Content-Length", fmt.Sprint(len(body)))
+			resp.Body = io.NopCloser(strings.NewReader(body))
+			return resp, nil
+		},
+	}
+
+	for _, tt := range []struct {
+		path, query, want string
+	}{
+		{"/ok", "query LikeCount { n }", `{"data": {"op": "matched"}}`},
+		{"/ok", "{ n }", `{"data": {"op": "matched"}}`},
+		{"/ok", "query Other { n }", `{"data": {"op": ""}}`},
+		{"/erroring", "mutation LikePost { like }", ""},
+		{"/failing", "mutation LikePost { like }", ""},
+	} {
+		body := fmt.Sprintf(`{"query": %q}`, tt.query)
+		conn := serve(t, p)
+		fmt.Fprintf(conn, "POST http://origin.test%s HTTP/1.1\r\nHost: origin.test\r\n"+
+			"Content-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", tt.path, len(body), body)
+
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+		got, _ := io.ReadAll(resp.Body)
+		if tt.want != "" && string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	want := map[string]int64{
+		"graphql.requests":              5,
+		"graphql.errors":                2,
+		"graphql.op.LikeCount.requests": 1,
+		"graphql.op.anonymous.requests": 1,
+		"graphql.op.Other.errors":       0,
+		"graphql.op.LikePost.requests":  2,
+		"graphql.op.LikePost.errors":    2,
+		"graphql.op.LikeCount.errors":   0,
+		"graphql.op.anonymous.errors":   0,
+		"graphql.op.Other.requests":     1,
+	}
+
+	// Requests are counted once they're complete.
+	for deadline := time.Now().Add(5 * time.Second); m.get("graphql.requests") < 5 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	for name, n := range want {
+		if got := m.get(name); got != n {
+			t.Errorf("%s = %d, want %d", name, got, n)
+		}
+	}
+	if m.get("graphql.op.LikePost.time") <= 0 {
+		t.Error("graphql.op.LikePost.time wasn't counted")
+	}
+}
@@ -0,0 +1,167 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/erkl/heat"
+)
+
+// An AddressGuard keeps a Transport from connecting to internal addresses,
+// protecting the networks behind a proxy from its clients. Addresses are
+// checked once more right before connecting, after host names have been
+// resolved, so a host name can't pass the check with a public address and
+// then be dialed at an internal one.
+type AddressGuard struct {
+	// Networks which may be connected to regardless of the rules below.
+	Allow []*net.IPNet
+
+	// Networks which may not be connected to, in addition to loopback,
+	// private, link-local, multicast, unspecified and reserved addresses.
+	Deny []*net.IPNet
+}
+
+// Reserved IPv4 ranges which the net.IP methods don't cover.
+var reservedNets = parseNets(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+)
+
+// Permits reports whether the guard allows connecting to an address.
+func (g *AddressGuard) Permits(ip net.IP) bool {
+	if inNets(g.Allow, ip) {
+		return true
+	}
+
+	return !inNets(g.Deny, ip) && !internal(ip)
+}
+
+// check returns a PolicyDenied error unless the guard allows connecting to
+// ip.
+func (g *AddressGuard) check(ip net.IP) error {
+	if !g.Permits(ip) {
+		return &PolicyDenied{"connecting to " + ip.String() + " is not allowed"}
+	}
+	return nil
+}
+
+// control returns a net.Dialer Control function which checks the address
+// being connected to before calling next, if set.
+func (g *AddressGuard) control(next func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+
+		// Strip IPv6 zones.
+		if i := strings.IndexByte(host, '%'); i >= 0 {
+			host = host[:i]
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return &PolicyDenied{"connecting to " + host + " is not allowed"}
+		}
+		if err := g.check(ip); err != nil {
+			return err
+		}
+
+		if next != nil {
+			return next(network, address, c)
+		}
+		return nil
+	}
+}
+
+// checkConn checks the remote address of a connection established by a
+// custom Dial function. Connections which aren't TCP connections are left
+// alone.
+func (g *AddressGuard) checkConn(conn net.Conn) error {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return g.check(addr.IP)
+	}
+	return nil
+}
+
+// checkAddr resolves an upstream address and checks all of its IP
+// addresses against t.Guard, so that requests and tunnels to internal hosts
+// can be refused before anything is sent. Addresses mapped to UNIX sockets
+// are exempt.
+func (t *Transport) checkAddr(ctx context.Context, addr string) error {
+	if t.Guard == nil {
+		return nil
+	}
+	if _, ok := t.unixSocket(addr); ok {
+		return nil
+	}
+
+	host := hostname(addr)
+
+	var ips []net.IP
+	var err error
+
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if t.Resolver != nil {
+		ips, err = t.Resolver.Resolve(ctx, host)
+	} else {
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+	if err != nil {
+		return &DialError{addr, err}
+	}
+
+	for _, ip := range ips {
+		if err := t.Guard.check(ip); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkGuard is like checkAddr for the proxy's transport, reporting denials
+// to p.AuditDecision.
+func (p *Proxy) checkGuard(ctx context.Context, s *Session, req *heat.Request, addr string) error {
+	err := p.transport().checkAddr(ctx, addr)
+	if _, ok := err.(*PolicyDenied); ok {
+		p.decideDeny(s, req, addr, "Transport.Guard", nil, err)
+	}
+	return err
+}
+
+// internal reports whether an address belongs to one of the ranges an
+// AddressGuard refuses by default.
+func internal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		inNets(reservedNets, ip)
+}
+
+func inNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseNets(list ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(list))
+	for i, s := range list {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
@@ -0,0 +1,109 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+func TestAddressGuardPermits(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.1.0.0/16")
+	_, denied, _ := net.ParseCIDR("198.51.100.0/24")
+
+	g := &relay.AddressGuard{Allow: []*net.IPNet{allowed}, Deny: []*net.IPNet{denied}}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"240.0.0.1", false},
+		{"10.1.2.3", true},
+		{"198.51.100.7", false},
+	}
+
+	for _, tt := range tests {
+		if got := g.Permits(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Permits(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestAddressGuard(t *testing.T) {
+	var reached atomic.Int32
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		reached.Add(1)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+
+	tests := []struct {
+		name   string
+		tr     *relay.Transport
+		target string
+		status int
+	}{
+		// Internal addresses are refused up front...
+		{"request", &relay.Transport{Guard: &relay.AddressGuard{}}, addr, 403},
+
+		// ...unless explicitly allowed.
+		{"allowed", &relay.Transport{Guard: &relay.AddressGuard{Allow: []*net.IPNet{loopback}}}, addr, 200},
+
+		// A public address which leads somewhere internal is caught when
+		// the connection is made.
+		{"rebound", &relay.Transport{
+			Guard: &relay.AddressGuard{},
+			Dial: func(network, _ string) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		}, "93.184.216.34:80", 403},
+	}
+
+	for _, tt := range tests {
+		before := reached.Load()
+
+		conn := serve(t, &relay.Proxy{Transport: tt.tr})
+		io.WriteString(conn, "GET http://"+tt.target+"/ HTTP/1.1\r\nHost: "+tt.target+"\r\n\r\n")
+
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		if sent := reached.Load() != before; sent != (tt.status == 200) {
+			t.Errorf("%s: request reached the upstream server: %v", tt.name, sent)
+		}
+	}
+}
+
+func TestAddressGuardTunnel(t *testing.T) {
+	addr := rawUpstream(t, func(conn *net.TCPConn) {})
+
+	p := &relay.Proxy{
+		Intercept: func(s *relay.Session, addr string) bool { return false },
+		Transport: &relay.Transport{Guard: &relay.AddressGuard{}},
+	}
+
+	conn := serve(t, p)
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 403 {
+		t.Errorf("got status %d, want 403", resp.StatusCode)
+	}
+}
@@ -0,0 +1,301 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/xo"
+)
+
+// The connection preface sent by HTTP/2 clients, as described in section 3.5
+// of RFC 7540. Clients with prior knowledge of HTTP/2 support send it on
+// plaintext connections straight away.
+var h2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// isH2C reports whether a client connection begins with the HTTP/2 preface.
+// The PRI method is reserved for this purpose, so peeking at the first three
+// bytes is enough to tell without risking blocking on an HTTP/1 request.
+func isH2C(r xo.Reader) bool {
+	buf, err := r.Peek(3)
+	if err != nil || !bytes.HasPrefix(buf, h2Preface[:3]) {
+		return false
+	}
+
+	// Peek returns everything buffered, which may be more than asked for.
+	buf, err = r.Peek(len(h2Preface))
+	return err == nil && bytes.HasPrefix(buf, h2Preface)
+}
+
+// serveH2C deals with an HTTP/2 client connection, either by handing it to
+// p.ServeH2C (preface included), or by turning the client away with a
+// GOAWAY frame: asking for HTTP/1.1 if there's no ServeH2C, or if clients
+// must authenticate, and refusing the connection if the proxy is shedding
+// load.
+func (p *Proxy) serveH2C(s *Session, conn net.Conn, rw xo.ReadWriter) error {
+	if p.ServeH2C == nil || p.Auth != nil {
+		return goAway(conn, rw, 0xd)
+	}
+
+	// The connection is admitted as a single request, for as long as
+	// ServeH2C serves it.
+	if resp := p.admit(s); resp != nil {
+		return goAway(conn, rw, 0x7)
+	}
+	defer p.done()
+
+	peek, err := rw.Peek(0)
+	if err != nil {
+		return &ClientAbort{err}
+	}
+	return p.ServeH2C(s, &prefixed{conn, peek})
+}
+
+// goAway says goodbye to an HTTP/2 client with the given error code, such
+// as HTTP_1_1_REQUIRED (0xd) or REFUSED_STREAM (0x7).
+func goAway(conn net.Conn, rw xo.ReadWriter, code byte) error {
+	// A server's preface is a SETTINGS frame, here an empty one, after
+	// which we can send the GOAWAY frame.
+	frames := []byte{
+		0, 0, 0, 0x4, 0, 0, 0, 0, 0,
+		0, 0, 8, 0x7, 0, 0, 0, 0, 0,
+		0, 0, 0, 0,
+		0, 0, 0, code,
+	}
+
+	if _, err := rw.Write(frames); err != nil {
+		return &ClientAbort{err}
+	}
+	if err := rw.Flush(); err != nil {
+		return &ClientAbort{err}
+	}
+
+	// Give the client a chance to read the frames before the connection
+	// is closed, by briefly draining whatever it sends. Closing with unread
+	// data would reset the connection.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(io.Discard, io.LimitReader(rw, 1<<16))
+
+	return nil
+}
+
+// isH2CHost reports whether requests to addr are to be sent using h2c (see
+// Transport.H2CHosts).
+func (t *Transport) isH2CHost(addr string) bool {
+	if len(t.H2CHosts) == 0 {
+		return false
+	}
+	return t.H2CHosts[withPort(addr, "http")] || t.H2CHosts[hostname(addr)]
+}
+
+// h2cTransport returns the client used for H2CHosts. Its connections are
+// dialed like the transport's own, through any parent proxy.
+func (t *Transport) h2cTransport() *http.Transport {
+	t.h2cOnce.Do(func() {
+		var protocols http.Protocols
+		protocols.SetUnencryptedHTTP2(true)
+
+		max := t.MaxIdlePerHost
+		if max <= 0 {
+			max = 2
+		}
+
+		t.h2cClient = &http.Transport{
+			Protocols: &protocols,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return t.dialTunnel(ctx, addr)
+			},
+			MaxIdleConnsPerHost: max,
+			IdleConnTimeout:     t.IdleTimeout,
+			DisableCompression:  true,
+		}
+	})
+	return t.h2cClient
+}
+
+// h2c forwards a plain HTTP request using HTTP/2 with prior knowledge, and
+// turns the response into an HTTP/1.1 one.
+func (t *Transport) h2c(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+	size, err := heat.RequestBodySize(req)
+	if err != nil {
+		return nil, err
+	}
+
+	uri := req.URI
+	if u, err := url.ParseRequestURI(uri); err == nil && u.Host != "" {
+		uri = u.RequestURI()
+	}
+
+	// The body belongs to the caller, which closes it.
+	var body io.Reader
+	if size != 0 && req.Body != nil {
+		body = io.NopCloser(req.Body)
+	}
+
+	rctx, cancel := context.WithCancelCause(ctx)
+
+	hreq, err := http.NewRequestWithContext(rctx, req.Method, "http://"+withPort(req.Remote, "http")+uri, body)
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+
+	hreq.ContentLength = int64(size)
+	if size == heat.Chunked {
+		hreq.ContentLength = -1
+	}
+
+	hreq.Host = req.Remote
+	if host, ok := fieldValue(req.Fields, "Host"); ok {
+		hreq.Host = host
+	}
+
+	// HTTP/2 has no use for connection-specific fields.
+	var tokens []string
+	req.Fields.Split("Connection", ',', func(s string) bool {
+		tokens = append(tokens, s)
+		return true
+	})
+
+	for _, f := range req.Fields {
+		if f.Is("Host") || f.Is("Content-Length") || connectionSpecific(f, tokens) {
+			continue
+		}
+		hreq.Header.Add(f.Name, f.Value)
+	}
+
+	// Don't let net/http add a User-Agent of its own.
+	if _, ok := hreq.Header["User-Agent"]; !ok {
+		hreq.Header["User-Agent"] = []string{""}
+	}
+
+	var timer *time.Timer
+	if t.ResponseHeaderTimeout > 0 {
+		timer = time.AfterFunc(t.ResponseHeaderTimeout, func() {
+			cancel(ErrResponseTimeout)
+		})
+	}
+
+	hresp, err := t.h2cTransport().RoundTrip(hreq)
+	if timer != nil {
+		timer.Stop()
+	}
+	if err != nil {
+		cause := context.Cause(rctx)
+		cancel(nil)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if cause == ErrResponseTimeout {
+			return nil, ErrResponseTimeout
+		}
+		return nil, err
+	}
+
+	resp := heat.NewResponse(hresp.StatusCode, heat.ReasonPhrase(hresp.StatusCode))
+
+	names := make([]string, 0, len(hresp.Header))
+	for name := range hresp.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := heat.Field{Name: name}
+		if f.Is("Content-Length") || connectionSpecific(f, nil) {
+			continue
+		}
+		for _, v := range hresp.Header[name] {
+			resp.Fields.Add(name, v)
+		}
+	}
+
+	// Frame the body for HTTP/1.1.
+	switch {
+	case resp.Status < 200 || resp.Status == 204:
+	case hresp.ContentLength >= 0:
+		resp.Fields.Set("Content-Length", strconv.FormatInt(hresp.ContentLength, 10))
+	case req.Method == "HEAD" || resp.Status == 304:
+	case hresp.Body == http.NoBody:
+		resp.Fields.Set("Content-Length", "0")
+	default:
+		resp.Fields.Set("Transfer-Encoding", "chunked")
+	}
+
+	if n, err := heat.ResponseBodySize(resp, req.Method); err != nil || n == 0 {
+		hresp.Body.Close()
+		cancel(nil)
+		return resp, nil
+	}
+
+	resp.Body = newH2CBody(rctx, cancel, hresp.Body, t.BodyTimeout, t.BodyIdleTimeout)
+	return resp, nil
+}
+
+// connectionSpecific reports whether a field is removed by default when
+// scrubbing a message whose Connection field lists tokens.
+func connectionSpecific(f heat.Field, tokens []string) bool {
+	var sp *ScrubPolicy
+	return sp.removes(f, tokens)
+}
+
+// The h2cBody type wraps the body of a response received using h2c, failing
+// reads with ErrBodyTimeout once the Transport's body timeouts are exceeded.
+type h2cBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	idle  time.Duration
+	timer *time.Timer // idle timer
+	limit *time.Timer // overall timer
+}
+
+func newH2CBody(ctx context.Context, cancel context.CancelCauseFunc, body io.ReadCloser, timeout, idle time.Duration) *h2cBody {
+	b := &h2cBody{ReadCloser: body, ctx: ctx, cancel: cancel, idle: idle}
+
+	expire := func() {
+		cancel(ErrBodyTimeout)
+	}
+	if timeout > 0 {
+		b.limit = time.AfterFunc(timeout, expire)
+	}
+	if idle > 0 {
+		b.timer = time.AfterFunc(idle, expire)
+	}
+
+	return b
+}
+
+func (b *h2cBody) Read(buf []byte) (int, error) {
+	if b.timer != nil {
+		b.timer.Reset(b.idle)
+	}
+
+	n, err := b.ReadCloser.Read(buf)
+	if err != nil && err != io.EOF && context.Cause(b.ctx) == ErrBodyTimeout {
+		err = ErrBodyTimeout
+	}
+
+	return n, err
+}
+
+func (b *h2cBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	if b.limit != nil {
+		b.limit.Stop()
+	}
+
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
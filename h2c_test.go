@@ -0,0 +1,164 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+// h2cUpstream starts a server speaking nothing but HTTP/2 with prior
+// knowledge, returning its address.
+func h2cUpstream(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+
+	s := httptest.NewUnstartedServer(handler)
+	s.Config.Protocols = &protocols
+	s.Start()
+	t.Cleanup(s.Close)
+
+	return s.Listener.Addr().String()
+}
+
+func TestH2CUpstream(t *testing.T) {
+	addr := h2cUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("request sent as %s", r.Proto)
+		}
+		if ua, ok := r.Header["User-Agent"]; ok {
+			t.Errorf("User-Agent added: %q", ua)
+		}
+		if r.Header.Get("Keep-Alive") != "" {
+			t.Errorf("Keep-Alive was forwarded")
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Echo", r.Method+" "+r.Host+" "+r.URL.Path)
+		w.Write(body)
+	})
+
+	p := &relay.Proxy{Transport: &relay.Transport{H2CHosts: map[string]bool{addr: true}}}
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	io.WriteString(conn, "POST http://"+addr+"/echo HTTP/1.1\r\n"+
+		"Host: "+addr+"\r\n"+
+		"Keep-Alive: timeout=5\r\n"+
+		"Transfer-Encoding: chunked\r\n\r\n"+
+		"5\r\nhello\r\n0\r\n\r\n")
+
+	resp := readFinal(t, conn, r)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.ProtoMajor != 1 || resp.StatusCode != 200 {
+		t.Errorf("got %s %d, want HTTP/1.1 200", resp.Proto, resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("X-Echo"), "POST "+addr+" /echo"; got != want {
+		t.Errorf("upstream saw %q, want %q", got, want)
+	}
+	if string(body) != "hello" {
+		t.Errorf("got body %q, want %q", body, "hello")
+	}
+}
+
+func TestH2CUpstreamStreaming(t *testing.T) {
+	addr := h2cUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		// Flushing before the handler returns leaves the length unknown.
+		io.WriteString(w, "one,")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "two")
+	})
+
+	p := &relay.Proxy{Transport: &relay.Transport{H2CHosts: map[string]bool{strings.Split(addr, ":")[0]: true}}}
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	for i := 0; i < 2; i++ {
+		io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+
+		resp := readFinal(t, conn, r)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+			t.Errorf("response %d: got transfer encoding %q, want chunked", i+1, resp.TransferEncoding)
+		}
+		if string(body) != "one,two" {
+			t.Errorf("response %d: got body %q, want %q", i+1, body, "one,two")
+		}
+	}
+}
+
+func TestH2CClients(t *testing.T) {
+	const preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+	served := make(chan string, 2)
+	release := make(chan struct{})
+	defer close(release)
+
+	p := &relay.Proxy{
+		MaxRequests: 1,
+		ServeH2C: func(s *relay.Session, conn net.Conn) error {
+			buf := make([]byte, len(preface))
+			io.ReadFull(conn, buf)
+			served <- string(buf)
+			<-release
+			return nil
+		},
+	}
+
+	// goAway returns the error code of the GOAWAY frame a client is sent,
+	// or -1 if its connection is handed to ServeH2C.
+	goAway := func() int {
+		conn := serve(t, p)
+		go io.WriteString(conn, preface)
+
+		frames := make(chan []byte, 1)
+		go func() {
+			buf := make([]byte, 26)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				buf = nil
+			}
+			frames <- buf
+		}()
+
+		select {
+		case got := <-served:
+			if got != preface {
+				t.Errorf("ServeH2C read %q", got)
+			}
+			return -1
+		case buf := <-frames:
+			if buf == nil || buf[12] != 0x7 {
+				t.Fatalf("got frames %x, want SETTINGS and GOAWAY", buf)
+			}
+			return int(buf[25])
+		}
+	}
+
+	// The first connection is served, taking up the only request slot.
+	if code := goAway(); code != -1 {
+		t.Fatalf("got GOAWAY %#x, want the connection served", code)
+	}
+	if code := goAway(); code != 0x7 {
+		t.Errorf("at capacity: got %d, want REFUSED_STREAM", code)
+	}
+
+	// Clients which must authenticate are asked to use HTTP/1.1.
+	p.Auth = &relay.ProxyAuth{Basic: func(user, password string) bool { return true }}
+	if code := goAway(); code != 0xd {
+		t.Errorf("with Auth: got %d, want HTTP_1_1_REQUIRED", code)
+	}
+}
@@ -0,0 +1,249 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// A HeaderAction describes what a HeaderRule does to matching messages.
+type HeaderAction int
+
+const (
+	// Add a header field, leaving existing fields of the same name intact.
+	AddHeader HeaderAction = iota
+
+	// Set a header field, replacing existing fields of the same name.
+	SetHeader
+
+	// Remove all header fields with the given name.
+	RemoveHeader
+
+	// Rename all header fields with the given name.
+	RenameHeader
+)
+
+var headerActions = map[string]HeaderAction{
+	"add":    AddHeader,
+	"set":    SetHeader,
+	"remove": RemoveHeader,
+	"rename": RenameHeader,
+}
+
+// A HeaderRule describes a modification to the header of forwarded requests
+// or responses.
+type HeaderRule struct {
+	// Which messages the rule applies to.
+	Request  bool
+	Response bool
+
+	// Optional condition the request must match.
+	Match *Match
+
+	// The modification to make. When renaming, Value holds the new name.
+	// In request rules, Value may reference secrets provided by
+	// Proxy.Secrets, as in "Bearer ${secret:api-token}".
+	Action HeaderAction
+	Name   string
+	Value  string
+}
+
+// apply carries out the rule's modification.
+func (r *HeaderRule) apply(fields *heat.Fields) {
+	switch r.Action {
+	case AddHeader:
+		fields.Add(r.Name, r.Value)
+
+	case SetHeader:
+		fields.Set(r.Name, r.Value)
+
+	case RemoveHeader:
+		fields.Filter(func(f heat.Field) bool {
+			return !f.Is(r.Name)
+		})
+
+	case RenameHeader:
+		for i := range *fields {
+			if (*fields)[i].Is(r.Name) {
+				(*fields)[i].Name = r.Value
+			}
+		}
+	}
+}
+
+// applyRequestRules applies the request rules in p.HeaderRules to req,
+// failing if a secret they reference can't be looked up.
+func (p *Proxy) applyRequestRules(s *Session, req *heat.Request) error {
+	for i := range p.HeaderRules {
+		if r := &p.HeaderRules[i]; r.Request && r.Match.Request(s, req) {
+			if hasSecrets(r.Value) {
+				value, err := s.expandSecrets(r.Value)
+				if err != nil {
+					return err
+				}
+				expanded := *r
+				expanded.Value = value
+				r = &expanded
+			}
+
+			r.apply(&req.Fields)
+			p.decideRewrite(s, req, i, "request")
+		}
+	}
+	return nil
+}
+
+// applyResponseRules applies the response rules in p.HeaderRules to resp.
+func (p *Proxy) applyResponseRules(s *Session, req *heat.Request, resp *heat.Response) {
+	for i := range p.HeaderRules {
+		if r := &p.HeaderRules[i]; r.Response && r.Match.Request(s, req) {
+			r.apply(&resp.Fields)
+			p.decideRewrite(s, req, i, "response")
+		}
+	}
+}
+
+// decideRewrite reports the application of a header rule to p.AuditDecision.
+func (p *Proxy) decideRewrite(s *Session, req *heat.Request, i int, direction string) {
+	if p.AuditDecision == nil {
+		return
+	}
+
+	r := &p.HeaderRules[i]
+
+	var action string
+	for name, a := range headerActions {
+		if a == r.Action {
+			action = name
+		}
+	}
+
+	p.decide(s, req, "", &DecisionRecord{
+		Action:  "rewrite",
+		Rule:    "HeaderRules[" + strconv.Itoa(i) + "]",
+		Pattern: r.Match.String(),
+		Reason:  direction + " " + action + " " + r.Name,
+	})
+}
+
+// ParseHeaderRules reads a list of header rules, one per line, in the form:
+//
+//	<direction> <action> <name> [<value>] [<match term>...]
+//
+// Direction is one of "request", "response" or "both", and action one of
+// "add", "set", "remove" or "rename". The rule only applies to requests
+// matching the terms, as described by ParseMatch. Values containing spaces
+// may be written as double-quoted Go strings. Empty lines and lines starting
+// with '#' are ignored.
+func ParseHeaderRules(r io.Reader) ([]HeaderRule, error) {
+	var rules []HeaderRule
+	var scanner = bufio.NewScanner(r)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		rule, err := parseHeaderRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("relay: line %d: %s", n, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func parseHeaderRule(line string) (HeaderRule, error) {
+	var rule HeaderRule
+
+	words, err := splitWords(line)
+	if err != nil {
+		return rule, err
+	}
+	if len(words) < 3 {
+		return rule, fmt.Errorf("too few words")
+	}
+
+	switch words[0] {
+	case "request":
+		rule.Request = true
+	case "response":
+		rule.Response = true
+	case "both":
+		rule.Request, rule.Response = true, true
+	default:
+		return rule, fmt.Errorf("invalid direction %q", words[0])
+	}
+
+	action, ok := headerActions[words[1]]
+	if !ok {
+		return rule, fmt.Errorf("invalid action %q", words[1])
+	}
+
+	rule.Action = action
+	rule.Name = words[2]
+	words = words[3:]
+
+	// Everything but "remove" takes a value.
+	if action != RemoveHeader {
+		if len(words) == 0 {
+			return rule, fmt.Errorf("missing value")
+		}
+		rule.Value, words = words[0], words[1:]
+	}
+
+	if len(words) > 0 {
+		m, err := parseMatcher(words)
+		if err != nil {
+			return rule, err
+		}
+		if rule.Match, err = m.Compile(); err != nil {
+			return rule, err
+		}
+	}
+
+	return rule, nil
+}
+
+// splitWords splits a line into space-separated words, unquoting any
+// double-quoted ones.
+func splitWords(line string) ([]string, error) {
+	var words []string
+
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return words, nil
+		}
+
+		if line[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted string")
+			}
+
+			word, _ := strconv.Unquote(quoted)
+			words = append(words, word)
+			line = line[len(quoted):]
+		} else {
+			i := strings.IndexAny(line, " \t")
+			if i < 0 {
+				i = len(line)
+			}
+
+			words = append(words, line[:i])
+			line = line[i:]
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+const testHeaderRules = `
+# Rules for the tests below.
+request set X-Env "test env" host=*.example.com
+request remove X-Debug
+request rename X-Old X-New path=/api/
+response add X-Proxy relay
+both set X-Both yes method=POST
+`
+
+func TestHeaderRules(t *testing.T) {
+	rules, err := relay.ParseHeaderRules(strings.NewReader(testHeaderRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(chan *http.Request, 2)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		seen <- req
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	conn := serve(t, &relay.Proxy{RoundTrip: routeTo(addr), HeaderRules: rules})
+	r := bufio.NewReader(conn)
+
+	send := func(rawurl string) *http.Response {
+		t.Helper()
+		u, _ := url.Parse(rawurl)
+		io.WriteString(conn, "GET "+rawurl+" HTTP/1.1\r\nHost: "+u.Host+"\r\n"+
+			"X-Debug: 1\r\nX-Old: value\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		io.Copy(io.Discard, resp.Body)
+		return resp
+	}
+
+	resp := send("http://api.example.com/api/users")
+	req := <-seen
+
+	if got := req.Header.Get("X-Env"); got != "test env" {
+		t.Errorf("X-Env: got %q, want %q", got, "test env")
+	}
+	if req.Header.Get("X-Debug") != "" {
+		t.Errorf("X-Debug wasn't removed")
+	}
+	if req.Header.Get("X-Old") != "" || req.Header.Get("X-New") != "value" {
+		t.Errorf("X-Old wasn't renamed to X-New: %v", req.Header)
+	}
+	if req.Header.Get("X-Both") != "" {
+		t.Errorf("rule for POST requests applied to GET")
+	}
+	if got := resp.Header.Get("X-Proxy"); got != "relay" {
+		t.Errorf("X-Proxy: got %q, want %q", got, "relay")
+	}
+
+	// Rules with conditions only apply to matching requests.
+	send("http://other.test/web")
+	req = <-seen
+
+	if req.Header.Get("X-Env") != "" {
+		t.Errorf("host-specific rule applied to other.test")
+	}
+	if req.Header.Get("X-Old") != "value" {
+		t.Errorf("path-specific rule applied to /web")
+	}
+}
+
+func TestParseHeaderRulesError(t *testing.T) {
+	_, err := relay.ParseHeaderRules(strings.NewReader("request set X-A a\n\nrequest frobnicate X-B\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("got error %v, want one for line 3", err)
+	}
+}
@@ -0,0 +1,306 @@
+package relay
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// An HSTSEntry records what a host has said about its HTTPS policy.
+type HSTSEntry struct {
+	// When the host's Strict-Transport-Security policy expires, and
+	// whether it covers subdomains. Expires is zero if the host has no
+	// such policy.
+	Expires           time.Time `json:"expires,omitempty"`
+	IncludeSubdomains bool      `json:"include_subdomains,omitempty"`
+
+	// When the host's Public-Key-Pins policy expires. Clients honoring it
+	// will refuse intercepted connections outright.
+	PinExpires time.Time `json:"pin_expires,omitempty"`
+}
+
+// An HSTSStore tracks the Strict-Transport-Security and Public-Key-Pins
+// header fields of responses passing through a proxy, so that deployments
+// can avoid downgrading hosts to plain HTTP, and avoid intercepting hosts
+// which clients expect to present pinned keys. Set Proxy.HSTS to start
+// tracking.
+//
+// The store's contents can be persisted with Save and Load, or kept in a
+// Storage as they change. All methods are safe for concurrent use.
+type HSTSStore struct {
+	// If set, entries are written to Storage under "hsts/<host>" as they're
+	// observed, and read back when the store is first used.
+	Storage Storage
+
+	mu     sync.Mutex
+	hosts  map[string]*HSTSEntry
+	loaded bool
+}
+
+// Lookup returns the policy in effect for host, including policies
+// inherited from parent domains.
+func (st *HSTSStore) Lookup(host string) (HSTSEntry, bool) {
+	host = strings.ToLower(hostname(host))
+	now := time.Now()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.load()
+
+	var found HSTSEntry
+	var ok bool
+
+	for name, sub := host, false; name != ""; sub = true {
+		if e := st.hosts[name]; e != nil {
+			if e.Expires.After(now) && (!sub || e.IncludeSubdomains) && found.Expires.IsZero() {
+				found.Expires, found.IncludeSubdomains = e.Expires, e.IncludeSubdomains
+				ok = true
+			}
+			if !sub && e.PinExpires.After(now) {
+				found.PinExpires = e.PinExpires
+				ok = true
+			}
+		}
+
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+
+	return found, ok
+}
+
+// Strict reports whether clients will insist on HTTPS for host.
+func (st *HSTSStore) Strict(host string) bool {
+	e, _ := st.Lookup(host)
+	return !e.Expires.IsZero()
+}
+
+// Pinned reports whether clients may refuse intercepted connections to
+// host, because of a Public-Key-Pins policy.
+func (st *HSTSStore) Pinned(host string) bool {
+	e, _ := st.Lookup(host)
+	return !e.PinExpires.IsZero()
+}
+
+// Intercept returns false for pinned hosts, and true otherwise. Its
+// signature fits Proxy.Intercept.
+func (st *HSTSStore) Intercept(s *Session, addr string) bool {
+	return !st.Pinned(addr)
+}
+
+// observe records the policies announced by a response from host.
+func (st *HSTSStore) observe(host string, fields heat.Fields) {
+	host = strings.ToLower(hostname(host))
+
+	// Policies are meaningless for IP addresses.
+	if net.ParseIP(host) != nil {
+		return
+	}
+
+	sts, hasSTS := fieldValue(fields, "Strict-Transport-Security")
+	pkp, hasPKP := fieldValue(fields, "Public-Key-Pins")
+	if !hasSTS && !hasPKP {
+		return
+	}
+
+	now := time.Now()
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.load()
+
+	if st.hosts == nil {
+		st.hosts = make(map[string]*HSTSEntry)
+	}
+
+	e := st.hosts[host]
+	if e == nil {
+		e = &HSTSEntry{}
+	}
+
+	if hasSTS {
+		if maxAge, sub, ok := parsePolicy(sts); ok {
+			e.Expires, e.IncludeSubdomains = now.Add(maxAge), sub
+			if maxAge == 0 {
+				e.Expires, e.IncludeSubdomains = time.Time{}, false
+			}
+		}
+	}
+
+	if hasPKP {
+		if maxAge, _, ok := parsePolicy(pkp); ok {
+			e.PinExpires = now.Add(maxAge)
+			if maxAge == 0 {
+				e.PinExpires = time.Time{}
+			}
+		}
+	}
+
+	if e.Expires.IsZero() && e.PinExpires.IsZero() {
+		delete(st.hosts, host)
+	} else {
+		st.hosts[host] = e
+	}
+
+	st.persist(host, e, now)
+}
+
+// load reads the entries kept in st.Storage, the first time it's called.
+// Entries already in the store take precedence. The caller must hold st.mu.
+func (st *HSTSStore) load() {
+	if st.loaded || st.Storage == nil {
+		return
+	}
+	st.loaded = true
+
+	keys, err := st.Storage.Keys("hsts/")
+	if err != nil {
+		return
+	}
+
+	if st.hosts == nil {
+		st.hosts = make(map[string]*HSTSEntry)
+	}
+
+	for _, key := range keys {
+		data, err := st.Storage.Get(key)
+		if err != nil {
+			continue
+		}
+
+		var e HSTSEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			continue
+		}
+
+		if name := key[len("hsts/"):]; st.hosts[name] == nil {
+			st.hosts[name] = &e
+		}
+	}
+}
+
+// persist writes a host's entry to st.Storage, or removes it once it no
+// longer holds a policy. Failures are ignored; the entry is still tracked in
+// memory.
+func (st *HSTSStore) persist(host string, e *HSTSEntry, now time.Time) {
+	if st.Storage == nil {
+		return
+	}
+
+	key := "hsts/" + host
+
+	expires := e.Expires
+	if e.PinExpires.After(expires) {
+		expires = e.PinExpires
+	}
+
+	if !expires.After(now) {
+		st.Storage.Delete(key)
+		return
+	}
+
+	if data, err := json.Marshal(e); err == nil {
+		st.Storage.Put(key, data, expires.Sub(now))
+	}
+}
+
+// parsePolicy extracts the max-age and includeSubDomains directives from a
+// Strict-Transport-Security or Public-Key-Pins header field value.
+func parsePolicy(s string) (maxAge time.Duration, sub, ok bool) {
+	for _, d := range strings.Split(s, ";") {
+		name, value := strings.TrimSpace(d), ""
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+		}
+
+		switch strings.ToLower(name) {
+		case "max-age":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return 0, false, false
+			}
+			if n > int64(1<<63-1)/int64(time.Second) {
+				n = int64(1<<63-1) / int64(time.Second)
+			}
+			maxAge, ok = time.Duration(n)*time.Second, true
+
+		case "includesubdomains":
+			sub = true
+		}
+	}
+
+	return maxAge, sub, ok
+}
+
+// Save writes the store's unexpired entries to w, as JSON.
+func (st *HSTSStore) Save(w io.Writer) error {
+	now := time.Now()
+	hosts := make(map[string]HSTSEntry)
+
+	st.mu.Lock()
+	st.load()
+	for name, e := range st.hosts {
+		if e.Expires.After(now) || e.PinExpires.After(now) {
+			hosts[name] = *e
+		}
+	}
+	st.mu.Unlock()
+
+	return json.NewEncoder(w).Encode(hosts)
+}
+
+// Load adds entries previously written by Save to the store, replacing any
+// existing entries for the same hosts.
+func (st *HSTSStore) Load(r io.Reader) error {
+	var hosts map[string]HSTSEntry
+	if err := json.NewDecoder(r).Decode(&hosts); err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.load()
+
+	if st.hosts == nil {
+		st.hosts = make(map[string]*HSTSEntry)
+	}
+
+	now := time.Now()
+	for name, e := range hosts {
+		e := e
+		name = strings.ToLower(name)
+		st.hosts[name] = &e
+		st.persist(name, &e, now)
+	}
+
+	return nil
+}
+
+// upgradeStrict sends plain HTTP requests for hosts with a known
+// Strict-Transport-Security policy upstream over HTTPS instead, reporting
+// whether the request was upgraded.
+func upgradeStrict(st *HSTSStore, req *heat.Request) bool {
+	if req.Scheme != "http" || !st.Strict(req.Remote) {
+		return false
+	}
+
+	req.Scheme = "https"
+
+	if host, port, err := net.SplitHostPort(req.Remote); err == nil && port == "80" {
+		req.Remote = net.JoinHostPort(host, "443")
+	}
+
+	return true
+}
@@ -0,0 +1,113 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestHSTS(t *testing.T) {
+	ca, cfg := testAuthority(t)
+
+	// Responses announce policies based on the host they come from.
+	policies := map[string][2]string{
+		"example.com":        {"Strict-Transport-Security", "max-age=3600; includeSubDomains"},
+		"pinned.example.org": {"Public-Key-Pins", `pin-sha256="AAAA"; max-age=3600`},
+		"gone.example.net":   {"Strict-Transport-Security", "max-age=0"},
+	}
+
+	var mu sync.Mutex
+	var sent []string
+
+	store := new(relay.HSTSStore)
+	p := &relay.Proxy{
+		Authority:   ca,
+		HSTS:        store,
+		HSTSUpgrade: true,
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			mu.Lock()
+			sent = append(sent, req.Scheme+"://"+req.Remote)
+			mu.Unlock()
+
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			host, _, _ := net.SplitHostPort(req.Remote)
+			if h, ok := policies[host]; ok {
+				resp.Fields.Set(h[0], h[1])
+			}
+			return resp, nil
+		},
+	}
+
+	// A max-age of zero clears a policy loaded earlier.
+	store.Load(bytes.NewBufferString(`{"gone.example.net": {"expires": "2999-01-01T00:00:00Z"}}`))
+
+	for _, host := range []string{"example.com", "pinned.example.org", "gone.example.net"} {
+		cfg := cfg.Clone()
+		cfg.ServerName = host
+
+		conn, err := connect(t, p, host+":443", cfg)
+		if err != nil {
+			t.Fatalf("%s: handshake failed: %v", host, err)
+		}
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		readFinal(t, conn, bufio.NewReader(conn))
+	}
+
+	tests := []struct {
+		host           string
+		strict, pinned bool
+	}{
+		{"example.com", true, false},
+		{"www.example.com", true, false},
+		{"example.org", false, false},
+		{"pinned.example.org", false, true},
+		{"gone.example.net", false, false},
+	}
+	for _, tt := range tests {
+		if got := store.Strict(tt.host); got != tt.strict {
+			t.Errorf("Strict(%q) = %v, want %v", tt.host, got, tt.strict)
+		}
+		if got := store.Pinned(tt.host); got != tt.pinned {
+			t.Errorf("Pinned(%q) = %v, want %v", tt.host, got, tt.pinned)
+		}
+		if got := store.Intercept(nil, tt.host+":443"); got == tt.pinned {
+			t.Errorf("Intercept(%q) = %v", tt.host, got)
+		}
+	}
+
+	// Plain HTTP requests for strict hosts are upgraded.
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+	for _, host := range []string{"www.example.com", "example.org"} {
+		io.WriteString(conn, "GET http://"+host+"/ HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		readFinal(t, conn, r)
+	}
+
+	mu.Lock()
+	got := sent[len(sent)-2:]
+	mu.Unlock()
+	if got[0] != "https://www.example.com" || got[1] != "http://example.org" {
+		t.Errorf("requests sent to %q", got)
+	}
+
+	// Saved policies can be loaded into another store.
+	var buf bytes.Buffer
+	if err := store.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := new(relay.HSTSStore)
+	if err := restored.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Strict("www.example.com") || !restored.Pinned("pinned.example.org") {
+		t.Errorf("policies lost when saving and loading")
+	}
+}
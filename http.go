@@ -1,33 +1,51 @@
 package relay
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
 	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/erkl/heat"
 	"github.com/erkl/xo"
 )
 
-func (p *Proxy) serveHTTP(conn net.Conn) error {
+func (p *Proxy) serveHTTP(s *Session, conn net.Conn) error {
+	cr := newClientReader(conn)
 	rw := xo.NewReadWriter(
-		xo.NewReader(conn, make([]byte, 4096)),
+		xo.NewReader(cr, make([]byte, 4096)),
 		xo.NewWriter(conn, make([]byte, 4096)),
 	)
 
+	// Clients with prior knowledge of HTTP/2 don't bother with HTTP/1.1.
+	if isH2C(rw) {
+		return p.serveH2C(s, conn, rw)
+	}
+
+	var reject bool
+	var pf *prefetch
+
 	for {
 		// Read the next request.
-		req, body, err := readRequest(rw)
+		p.label("", phaseRead)
+		req, body, err := s.nextRequest(rw, pf)
+		pf = nil
 		if err != nil {
 			switch err {
 			case heat.ErrRequestHeader:
 				resp := statusResponse(404, "Malformed HTTP request header.")
-				return writeResponse(rw, resp, req.Method)
+				return writeLast(rw, resp, "")
+
+			case errHeaderTooLarge:
+				resp := statusResponse(431, "HTTP request header too large.")
+				return writeLast(rw, resp, "")
 
 			case heat.ErrRequestVersion:
 				resp := statusResponse(505, "Unsupported HTTP version number.")
-				return writeResponse(rw, resp, req.Method)
+				return writeLast(rw, resp, "")
 
 			// If the connection terminated cleanly, stop.
 			case io.EOF:
@@ -36,38 +54,135 @@ func (p *Proxy) serveHTTP(conn net.Conn) error {
 			// Any other error would be from the underlying connection, and
 			// should be propagated.
 			default:
-				return err
+				return &ClientAbort{err}
 			}
 		}
 
+		host := p.labelHost(req)
+		p.label(host, phaseRequest)
+
+		// Was the request sent before the previous response?
+		if reject {
+			resp := statusResponse(400, "Pipelined requests are not supported.")
+			return writeLast(rw, resp, req.Method)
+		}
+
+		// Shed load if we're at capacity, or shutting down.
+		if resp := p.admit(s); resp != nil {
+			return writeLast(rw, resp, req.Method)
+		}
+
+		// Clients must authenticate before doing anything else.
+		if resp := p.authenticate(s, req); resp != nil {
+			p.done()
+			if req.Body != nil {
+				req.Body.Close()
+			}
+
+			// The request body would have to be skipped to keep going.
+			closing := heat.Closing(req.Major, req.Minor, req.Fields) ||
+				heat.Closing(resp.Major, resp.Minor, resp.Fields) ||
+				(body != nil && body.LastError() != io.EOF)
+			if closing {
+				resp.Fields.Set("Connection", "close")
+			}
+
+			if err := writeResponse(rw, resp, req.Method); err != nil {
+				return clientError(err)
+			}
+			if closing {
+				return nil
+			}
+			continue
+		}
+
+		s.intent = clientIntent(req)
+
 		// Support CONNECT tunneling.
 		if req.Method == "CONNECT" {
-			return p.connect(conn, rw, req)
+			p.done()
+			return p.connect(s, conn, rw, req)
+		}
+
+		// Answer the client's expectations ourselves.
+		cont, refuse := expectContinue(rw, req)
+		if refuse != nil {
+			p.done()
+			return writeLast(rw, refuse, req.Method)
 		}
 
 		// Will the client close this connection after receiving a response?
 		closing := heat.Closing(req.Major, req.Minor, req.Fields)
-
-		// Fetch the actual response from the upstream server.
-		resp, err := p.proxy(req)
+		major, minor := req.Major, req.Minor
+
+		// Fetch the actual response from the upstream server, giving up if
+		// the client goes away in the meantime.
+		unwatch := p.watchClient(s, cr, rw, req, body)
+		resp, err := p.proxy(s, req)
+		cont.expire()
+		if gone := unwatch(); gone != nil {
+			if resp != nil && resp.Body != nil {
+				resp.Body.Close()
+			}
+			p.done()
+			return &ClientAbort{gone}
+		}
 		if err != nil {
-			resp := statusResponse(500, "Unknown error: %s.", err)
-			return writeResponse(rw, resp, req.Method)
+			resp = p.errorResponse(s, req, err)
+
+			// An abandoned round-trip may still be reading the request
+			// body, so the connection can't be reused.
+			if errors.Is(err, context.DeadlineExceeded) {
+				closing = true
+			}
 		}
 
+		// Hand the connection over to the new protocol?
+		if resp.Status == 101 {
+			p.done()
+			return p.upgrade(s, conn, rw, req, resp)
+		}
+
+		// Make sure the client can parse the response.
+		if closing, err = s.fitResponse(resp, major, minor, req.Method, closing); err != nil {
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+			resp = p.errorResponse(s, req, err)
+			closing = true
+		}
+
+		// Pipelined requests are served in order, unless we're told to
+		// reject them.
+		reject = p.RejectPipelining && (pipelined(rw) || cr.buffered())
+
 		// Are we closing the connection after sending the response?
-		if !closing && (body == nil || body.LastError() == io.EOF) {
+		keep := !closing && (body == nil || body.LastError() == io.EOF) && !s.clientInterrupted() && !cr.halfClosed()
+		if p.Bridge {
+			closing = bridgeConnection(resp, req.Method, keep)
+		} else if keep {
 			resp.Fields.Set("Connection", "keep-alive")
 		} else {
 			resp.Fields.Set("Connection", "close")
 			closing = true
 		}
 
-		// Write the response.
+		if p.ServerTiming {
+			addServerTiming(resp, s.Timings())
+		}
+
+		// Write the response, reading the next request in the meantime if
+		// we've been told to.
+		p.label(host, phaseResponse)
+		pf = p.prefetchRequest(s, rw, closing)
+		write := s.timer.now()
 		err = writeResponse(rw, resp, req.Method)
+		s.release()
+		p.done()
 		if err != nil {
-			return err
+			return clientError(err)
 		}
+		p.complete(s, req, resp, write)
 
 		// Stop if the connection isn't keep-alive.
 		if closing {
@@ -76,7 +191,7 @@ func (p *Proxy) serveHTTP(conn net.Conn) error {
 	}
 }
 
-func (p *Proxy) proxy(req *heat.Request) (*heat.Response, error) {
+func (p *Proxy) proxy(s *Session, req *heat.Request) (*heat.Response, error) {
 	if req.Body != nil {
 		defer req.Body.Close()
 	}
@@ -89,36 +204,62 @@ func (p *Proxy) proxy(req *heat.Request) (*heat.Response, error) {
 
 	// Make sure the request's URI is absolute.
 	if !u.IsAbs() {
-		return statusResponse(400, "Request URI must be absolute."), nil
+		if u = p.resolveOriginForm(s, req, u); u == nil {
+			return statusResponse(400, "Request URI must be absolute."), nil
+		}
 	}
 
-	// Clean the request.
-	err = scrubRequest(req)
-	if err != nil {
+	// Never forward credentials embedded in the URI as they are.
+	if resp := p.handleUserinfo(s, req, u); resp != nil {
+		return resp, nil
+	}
+
+	// Only serve the schemes we've been told to.
+	if !p.allowScheme(u.Scheme) {
+		p.decide(s, req, "", &DecisionRecord{Action: "deny", Rule: "Schemes", Reason: "unsupported scheme " + u.Scheme})
+		return statusResponse(501, "Unsupported URI scheme: %s.", u.Scheme), nil
+	}
+
+	// Canonicalize the URI, if we've been told to.
+	u, reject := p.canonicalize(s, req, u)
+	if reject != nil {
+		return reject, nil
+	}
+
+	// Clean the request, or leave it be in bridge mode.
+	if p.Bridge {
+		bridgeRequest(req)
+	} else if err = scrubRequest(req, p.Scrub); err != nil {
 		return statusResponse(500, "Could not scrub request."), nil
 	}
+	p.prepareWebSocket(req)
 
 	// Update the request to reflect the actual destination.
 	req.URI = u.RequestURI()
-	req.Scheme = u.Scheme
+	req.Scheme = strings.ToLower(u.Scheme)
 	req.Remote = u.Host
 
 	// Issue the actual request.
-	resp, err := p.RoundTrip(req)
+	resp, err := p.roundTrip(s, req)
 	if err != nil {
-		return statusResponse(500, "Round-trip to upstream failed: %s.", err), nil
+		return nil, err
 	}
 
 	// Clean the response.
-	err = scrubResponse(resp, req.Method)
+	if !p.Bridge {
+		err = scrubResponse(resp, req.Method, p.Scrub)
+	}
 	if err != nil {
-		return statusResponse(500, "Could not scrub response."), nil
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		return nil, &UpstreamProtocolError{err}
 	}
 
 	return resp, nil
 }
 
-func scrubRequest(req *heat.Request) error {
+func scrubRequest(req *heat.Request, sp *ScrubPolicy) error {
 	// Only ever send HTTP/1.1 requests.
 	req.Major = 1
 	req.Minor = 1
@@ -129,11 +270,19 @@ func scrubRequest(req *heat.Request) error {
 		return err
 	}
 
-	scrubHeaderFields(&req.Fields, size)
+	upgrade := upgradeProtocol(req.Fields)
+	scrubHeaderFields(&req.Fields, size, sp)
+
+	// Let protocol upgrade requests through.
+	if upgrade != "" {
+		req.Fields.Set("Connection", "Upgrade")
+		req.Fields.Set("Upgrade", upgrade)
+	}
+
 	return nil
 }
 
-func scrubResponse(resp *heat.Response, method string) error {
+func scrubResponse(resp *heat.Response, method string, sp *ScrubPolicy) error {
 	// Only ever send HTTP/1.1 responses.
 	resp.Major = 1
 	resp.Minor = 1
@@ -144,7 +293,19 @@ func scrubResponse(resp *heat.Response, method string) error {
 		return err
 	}
 
-	scrubHeaderFields(&resp.Fields, size)
+	upgrade := upgradeProtocol(resp.Fields)
+	scrubHeaderFields(&resp.Fields, size, sp)
+
+	// Responses switching protocols have no body, and must keep their
+	// Upgrade header field.
+	if resp.Status == 101 {
+		resp.Fields.Filter(func(f heat.Field) bool {
+			return !f.Is("Content-Length")
+		})
+		resp.Fields.Set("Connection", "Upgrade")
+		resp.Fields.Set("Upgrade", upgrade)
+	}
+
 	return nil
 }
 
@@ -169,7 +330,7 @@ var blacklist = []string{
 	"Content-Length",
 }
 
-func scrubHeaderFields(fields *heat.Fields, size heat.BodySize) {
+func scrubHeaderFields(fields *heat.Fields, size heat.BodySize, sp *ScrubPolicy) {
 	// Prepare a list of "connection-tokens", describing header fields, to be
 	// removed as per section 14.10 of RFC 2616.
 	var tokens []string
@@ -179,27 +340,17 @@ func scrubHeaderFields(fields *heat.Fields, size heat.BodySize) {
 		return true
 	})
 
-	// Remove the header fields we don't want to forward.
+	// Remove the header fields we don't want to forward, along with any
+	// stale Content-Length.
 	fields.Filter(func(f heat.Field) bool {
-		for _, name := range blacklist {
-			if f.Is(name) {
-				return false
-			}
-		}
-
-		for _, name := range tokens {
-			if f.Is(name) {
-				return false
-			}
-		}
-
-		return true
+		return !f.Is("Content-Length") && !sp.removes(f, tokens)
 	})
 
-	// Indicate the transfer-length.
+	// Indicate the transfer-length, unless the original Transfer-Encoding
+	// field was kept.
 	if size >= 0 {
 		fields.Add("Content-Length", strconv.FormatInt(int64(size), 10))
-	} else {
+	} else if _, ok := fieldValue(*fields, "Transfer-Encoding"); !ok {
 		fields.Add("Transfer-Encoding", "chunked")
 	}
 }
@@ -0,0 +1,92 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/erkl/relay"
+	"github.com/erkl/relay/relaytest"
+)
+
+// Both requests arrive in a single read, before either response is sent.
+const pipelinedRequests = "GET http://example.com/one HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+	"GET http://example.com/two HTTP/1.1\r\nHost: example.com\r\n\r\n"
+
+// The upstream connection answers both requests, in order.
+const pipelinedResponses = "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\none" +
+	"HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\ntwo"
+
+// readResponses parses every response in out.
+func readResponses(t *testing.T, out []byte) ([]*http.Response, []string) {
+	var resps []*http.Response
+	var bodies []string
+
+	r := bufio.NewReader(bytes.NewReader(out))
+	for {
+		if _, err := r.Peek(1); err == io.EOF {
+			return resps, bodies
+		}
+
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("response %d: %s (output %q)", len(resps)+1, err, out)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("response %d: %s (output %q)", len(resps)+1, err, out)
+		}
+
+		resps = append(resps, resp)
+		bodies = append(bodies, string(body))
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	out := relaytest.ServeBytes(&relay.Proxy{}, []byte(pipelinedRequests), []byte(pipelinedResponses))
+
+	resps, bodies := readResponses(t, out)
+	if len(resps) != 2 {
+		t.Fatalf("got %d responses, want 2 (output %q)", len(resps), out)
+	}
+	for i, want := range []string{"one", "two"} {
+		if resps[i].StatusCode != 200 || bodies[i] != want {
+			t.Errorf("response %d: got %d %q, want 200 %q", i+1, resps[i].StatusCode, bodies[i], want)
+		}
+	}
+	if resps[0].Close {
+		t.Errorf("connection closed after the first response")
+	}
+}
+
+func TestRejectPipelining(t *testing.T) {
+	p := &relay.Proxy{RejectPipelining: true}
+	out := relaytest.ServeBytes(p, []byte(pipelinedRequests), []byte(pipelinedResponses))
+
+	resps, bodies := readResponses(t, out)
+	if len(resps) != 2 {
+		t.Fatalf("got %d responses, want 2 (output %q)", len(resps), out)
+	}
+	if resps[0].StatusCode != 200 || bodies[0] != "one" {
+		t.Errorf("first response: got %d %q, want 200 %q", resps[0].StatusCode, bodies[0], "one")
+	}
+	if resps[1].StatusCode != 400 {
+		t.Errorf("second response: got %d, want 400", resps[1].StatusCode)
+	}
+	if !resps[1].Close {
+		t.Errorf("connection kept open after rejecting a pipelined request")
+	}
+}
+
+func TestRejectPipeliningSequential(t *testing.T) {
+	// Requests sent one at a time aren't pipelined, and mustn't be rejected.
+	p := &relay.Proxy{RejectPipelining: true}
+	out := relaytest.ServeBytes(p, []byte("GET http://example.com/one HTTP/1.1\r\nHost: example.com\r\n\r\n"), []byte(pipelinedResponses))
+
+	resps, bodies := readResponses(t, out)
+	if len(resps) != 1 || resps[0].StatusCode != 200 || bodies[0] != "one" {
+		t.Fatalf("got %q, want a single 200 response", out)
+	}
+}
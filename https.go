@@ -1,44 +1,85 @@
 package relay
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
 	"io"
 	"math/big"
 	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/erkl/heat"
 	"github.com/erkl/xo"
 )
 
-func (p *Proxy) connect(conn net.Conn, rw xo.ReadWriter, req *heat.Request) error {
-	// Make sure we have a valid certificate.
-	if p.Authority == nil || len(p.Authority.Certificate) == 0 {
-		resp := statusResponse(500, "Can't serve CONNECT requests without Proxy.Authority.", req.URI)
-		return writeResponse(rw, resp, req.Method)
-	}
-
+func (p *Proxy) connect(s *Session, conn net.Conn, rw xo.ReadWriter, req *heat.Request) error {
 	// Validate the tunnel address.
 	host, port, err := net.SplitHostPort(req.URI)
-	if err != nil || port != "443" {
+	if err != nil {
 		resp := statusResponse(400, "Invalid CONNECT address: %s.", req.URI)
-		return writeResponse(rw, resp, req.Method)
+		return writeLast(rw, resp, req.Method)
+	}
+
+	p.label(host, phaseHandshake)
+
+	// Is the client's user allowed there?
+	if _, err := p.checkUser(s, nil, req.URI, 0); err != nil {
+		return writeLast(rw, p.errorResponse(s, req, err), req.Method)
+	}
+
+	// Give the user a chance to reject the tunnel.
+	if p.OnConnect != nil {
+		if resp := p.OnConnect(s, req); resp != nil {
+			p.decide(s, nil, req.URI, &DecisionRecord{Action: "deny", Rule: "OnConnect", Reason: resp.Reason})
+			return writeLast(rw, resp, req.Method)
+		}
+	}
+
+	// Should the tunnel be left alone?
+	d := p.decideTunnel(s, req.URI)
+	if !d.intercept {
+		return p.tunnel(s, conn, rw, req)
+	}
+
+	// Make sure we have a valid certificate. The authority is read once,
+	// so that it can't change halfway through the handshake.
+	ca := d.ca
+	if ca == nil || len(ca.Certificate) == 0 {
+		resp := statusResponse(500, "Can't serve CONNECT requests without Proxy.Authority.")
+		return writeLast(rw, resp, req.Method)
+	}
+
+	// Only port 443 can be intercepted.
+	if port != "443" {
+		resp := statusResponse(400, "Invalid CONNECT address: %s.", req.URI)
+		return writeLast(rw, resp, req.Method)
 	}
 
 	// Forge a certificate for the remote host.
-	cert, err := p.forge(host)
+	opts := d.opts
+
+	cert, err := d.certificate(p, host)
 	if err != nil {
 		resp := statusResponse(500, "Error when signing SSL certificate: %s.", err)
-		return writeResponse(rw, resp, req.Method)
+		return writeLast(rw, resp, req.Method)
 	}
 
 	// Grab the currently buffered data.
 	peek, err := rw.Peek(0)
 	if err != nil {
 		resp := statusResponse(500, "Internal error: %s.", err)
-		return writeResponse(rw, resp, req.Method)
+		return writeLast(rw, resp, req.Method)
 	}
 
 	if len(peek) > 0 {
@@ -47,41 +88,70 @@ func (p *Proxy) connect(conn net.Conn, rw xo.ReadWriter, req *heat.Request) erro
 
 	// Indicate that the tunnel is ready.
 	if _, err = rw.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err != nil {
-		return err
+		return &ClientAbort{err}
 	}
 	if err = rw.Flush(); err != nil {
+		return &ClientAbort{err}
+	}
+
+	tlsConn, err := p.handshake(conn, ca, cert, host, opts)
+	if err != nil {
 		return err
 	}
 
-	// Carry out the TLS handshake.
+	return p.serveHTTPS(s, tlsConn, req.URI)
+}
+
+// handshake carries out the TLS handshake with a client tunneling to host,
+// presenting cert. If the client asks for a server name other than the
+// tunnel's host, we may have to forge another certificate using ca.
+func (p *Proxy) handshake(conn net.Conn, ca, cert *tls.Certificate, host string, opts forgeOptions) (*tls.Conn, error) {
 	tlsConn := tls.Server(conn, &tls.Config{
-		Certificates: []tls.Certificate{*cert},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.certificate(ca, cert, host, hello.ServerName, opts)
+		},
 	})
 
-	if err = tlsConn.Handshake(); err != nil {
-		return err
+	if err := tlsConn.Handshake(); err != nil {
+		var denied *PolicyDenied
+		if errors.As(err, &denied) {
+			return nil, denied
+		}
+		return nil, &TLSHandshakeError{Host: host, Err: err}
 	}
 
-	return p.serveHTTPS(tlsConn, req.URI)
+	return tlsConn, nil
 }
 
-func (p *Proxy) serveHTTPS(conn net.Conn, addr string) error {
+func (p *Proxy) serveHTTPS(s *Session, conn net.Conn, addr string) error {
+	cr := newClientReader(conn)
 	rw := xo.NewReadWriter(
-		xo.NewReader(conn, make([]byte, 4096)),
+		xo.NewReader(cr, make([]byte, 4096)),
 		xo.NewWriter(conn, make([]byte, 4096)),
 	)
 
+	var reject bool
+	var pf *prefetch
+
+	host := hostname(addr)
+
 	for {
-		req, body, err := readRequest(rw)
+		p.label(host, phaseRead)
+		req, body, err := s.nextRequest(rw, pf)
+		pf = nil
 		if err != nil {
 			switch err {
 			case heat.ErrRequestHeader:
 				resp := statusResponse(404, "Malformed HTTP request header.")
-				return writeResponse(rw, resp, req.Method)
+				return writeLast(rw, resp, "")
+
+			case errHeaderTooLarge:
+				resp := statusResponse(431, "HTTP request header too large.")
+				return writeLast(rw, resp, "")
 
 			case heat.ErrRequestVersion:
 				resp := statusResponse(505, "Unsupported HTTP version number.")
-				return writeResponse(rw, resp, req.Method)
+				return writeLast(rw, resp, "")
 
 			// If the connection terminated cleanly, stop.
 			case io.EOF:
@@ -90,36 +160,107 @@ func (p *Proxy) serveHTTPS(conn net.Conn, addr string) error {
 			// Any other error would be from the underlying connection, and
 			// should be propagated.
 			default:
-				return err
+				return &ClientAbort{err}
 			}
 		}
 
+		p.label(host, phaseRequest)
+
+		// Was the request sent before the previous response?
+		if reject {
+			resp := statusResponse(400, "Pipelined requests are not supported.")
+			return writeLast(rw, resp, req.Method)
+		}
+
+		// Shed load if we're at capacity, or shutting down.
+		if resp := p.admit(s); resp != nil {
+			return writeLast(rw, resp, req.Method)
+		}
+
 		// Populate the scheme and remote address.
 		req.Scheme = "https"
 		req.Remote = addr
+		s.intent = clientIntent(req)
+
+		// Answer the client's expectations ourselves.
+		cont, refuse := expectContinue(rw, req)
+		if refuse != nil {
+			p.done()
+			return writeLast(rw, refuse, req.Method)
+		}
 
 		// Will the client close this connection after receiving a response?
 		closing := heat.Closing(req.Major, req.Minor, req.Fields)
-
-		// Forward the request to the upstream server.
-		resp, err := p.forward(req)
+		major, minor := req.Major, req.Minor
+
+		// Forward the request to the upstream server, giving up if the
+		// client goes away in the meantime.
+		unwatch := p.watchClient(s, cr, rw, req, body)
+		resp, err := p.forward(s, req)
+		cont.expire()
+		if gone := unwatch(); gone != nil {
+			if resp != nil && resp.Body != nil {
+				resp.Body.Close()
+			}
+			p.done()
+			return &ClientAbort{gone}
+		}
 		if err != nil {
-			resp = statusResponse(500, "Round-trip to upstream failed: %s.", err)
+			resp = p.errorResponse(s, req, err)
+
+			// An abandoned round-trip may still be reading the request
+			// body, so the connection can't be reused.
+			if errors.Is(err, context.DeadlineExceeded) {
+				closing = true
+			}
+		}
+
+		// Hand the connection over to the new protocol?
+		if resp.Status == 101 {
+			p.done()
+			return p.upgrade(s, conn, rw, req, resp)
 		}
 
+		// Make sure the client can parse the response.
+		if closing, err = s.fitResponse(resp, major, minor, req.Method, closing); err != nil {
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+			resp = p.errorResponse(s, req, err)
+			closing = true
+		}
+
+		// Pipelined requests are served in order, unless we're told to
+		// reject them.
+		reject = p.RejectPipelining && (pipelined(rw) || cr.buffered())
+
 		// Are we closing the connection after sending the response?
-		if !closing && (body == nil || body.LastError() == io.EOF) {
+		keep := !closing && (body == nil || body.LastError() == io.EOF) && !s.clientInterrupted() && !cr.halfClosed()
+		if p.Bridge {
+			closing = bridgeConnection(resp, req.Method, keep)
+		} else if keep {
 			resp.Fields.Set("Connection", "keep-alive")
 		} else {
 			resp.Fields.Set("Connection", "close")
 			closing = true
 		}
 
-		// Write the response.
+		if p.ServerTiming {
+			addServerTiming(resp, s.Timings())
+		}
+
+		// Write the response, reading the next request in the meantime if
+		// we've been told to.
+		p.label(host, phaseResponse)
+		pf = p.prefetchRequest(s, rw, closing)
+		write := s.timer.now()
 		err = writeResponse(rw, resp, req.Method)
+		s.release()
+		p.done()
 		if err != nil {
-			return err
+			return clientError(err)
 		}
+		p.complete(s, req, resp, write)
 
 		// Stop if the connection isn't keep-alive.
 		if closing {
@@ -128,43 +269,84 @@ func (p *Proxy) serveHTTPS(conn net.Conn, addr string) error {
 	}
 }
 
-func (p *Proxy) forward(req *heat.Request) (*heat.Response, error) {
+func (p *Proxy) forward(s *Session, req *heat.Request) (*heat.Response, error) {
 	if req.Body != nil {
 		defer req.Body.Close()
 	}
 
-	// Enable keep-alive connections for outgoing requests.
-	isKeepAlive := !heat.Closing(req.Major, req.Minor, req.Fields)
-	req.Fields.Set("Connection", "keep-alive")
+	p.prepareWebSocket(req)
 
-	// Issue the request.
-	resp, err := p.RoundTrip(req)
-	if err != nil {
-		return nil, err
+	// Canonicalize the URI, if we've been told to.
+	if p.URIs != URIPreserve {
+		u, err := url.ParseRequestURI(req.URI)
+		if err != nil {
+			return statusResponse(400, "Invalid URI in request."), nil
+		}
+		u, resp := p.canonicalize(s, req, u)
+		if resp != nil {
+			return resp, nil
+		}
+		req.URI = u.RequestURI()
 	}
 
-	// Does the client expect the connection to be closed?
-	if !isKeepAlive {
-		resp.Fields.Set("Connection", "close")
-	} else {
-		resp.Fields.Set("Connection", "keep-alive")
+	// Issue the request. Whether the connection to the client is kept open
+	// is decided by the caller, and whether the one to the upstream server
+	// is by the transport (see Session.Intent).
+	return p.roundTrip(s, req)
+}
+
+// certificate picks the certificate to present to a client which sent the
+// server name sni in its TLS handshake, after asking for a tunnel to host.
+func (p *Proxy) certificate(ca, cert *tls.Certificate, host, sni string, opts forgeOptions) (*tls.Certificate, error) {
+	if sni == "" || strings.EqualFold(sni, host) {
+		return cert, nil
 	}
 
-	return resp, nil
+	// Let the user decide whether the mismatch is acceptable.
+	if p.CheckServerName != nil {
+		if err := p.CheckServerName(host, sni); err != nil {
+			return nil, &PolicyDenied{err.Error()}
+		}
+	}
+
+	// When tunneling to an IP address, clients will verify the certificate
+	// against the server name they sent, so it has to be included.
+	if net.ParseIP(host) != nil {
+		return p.forge(ca, host, sni, opts)
+	}
+
+	return cert, nil
 }
 
-func (p *Proxy) forge(host string) (*tls.Certificate, error) {
-	x509ca, err := x509.ParseCertificate(p.Authority.Certificate[0])
+// forge creates a certificate for host, signed by ca. If sni is non-empty it
+// will be added to the certificate as an extra DNS name. Any fault or clock
+// skew in opts is introduced deliberately.
+func (p *Proxy) forge(ca *tls.Certificate, host, sni string, opts forgeOptions) (*tls.Certificate, error) {
+	fault := opts.fault
+
+	x509ca, err := x509.ParseCertificate(ca.Certificate[0])
 	if err != nil {
 		return nil, err
 	}
 
-	// By deriving a seed from the hostname we can use consistent serial
-	// numbers and encryption keys without having to store any state.
-	seed := sha256.Sum256([]byte(host))
+	// Derive the serial number and key from the host name, unless told
+	// otherwise. That way they're consistent without having to store any
+	// state.
+	name := host
+	if sni != "" {
+		name = host + " " + sni
+	}
+	if fault != CertOK {
+		name += " fault=" + strconv.Itoa(int(fault))
+	}
+	if opts.skew != 0 {
+		name += " skew=" + opts.skew.String()
+	}
 
-	serial := &big.Int{}
-	serial.SetBytes(seed[:])
+	serial, rng, err := p.forgeRandom(ca, name)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create a certificate template.
 	template := &x509.Certificate{
@@ -184,27 +366,216 @@ func (p *Proxy) forge(host string) (*tls.Certificate, error) {
 		template.DNSNames = []string{host}
 	}
 
+	if sni != "" {
+		template.DNSNames = append(template.DNSNames, sni)
+	}
+
+	if opts.skew != 0 {
+		now := time.Now().Add(opts.skew)
+		template.NotBefore = now.Add(-time.Hour)
+		template.NotAfter = now.AddDate(0, 0, 90)
+	}
+
+	fault.apply(template)
+
 	// Generate the certificate.
-	rng := &inf{append(([]byte)(nil), seed[:]...)}
+	bits := 2048
+	if fault == CertWeakKey {
+		bits = 1024
+	}
 
-	key, err := rsa.GenerateKey(rng, 2048)
+	key, err := generateKey(rng, bits)
 	if err != nil {
 		return nil, err
 	}
 
-	der, err := x509.CreateCertificate(rng, template, x509ca, &key.PublicKey, p.Authority.PrivateKey)
+	parent, signer := x509ca, ca.PrivateKey
+	chain := [][]byte{nil, ca.Certificate[0]}
+
+	if fault == CertSelfSigned {
+		template.Subject = pkix.Name{CommonName: host}
+		parent, signer = template, key
+		chain = chain[:1]
+	}
+
+	der, err := x509.CreateCertificate(rng, template, parent, &key.PublicKey, signer)
 	if err != nil {
 		return nil, err
 	}
 
+	chain[0] = der
+
+	if p.AuditCertificate != nil {
+		if leaf, err := x509.ParseCertificate(der); err == nil {
+			p.audit(host, leaf, x509ca)
+		}
+	}
+
 	return &tls.Certificate{
-		Certificate: [][]byte{der, p.Authority.Certificate[0]},
+		Certificate: chain,
 		PrivateKey:  key,
 	}, nil
 }
 
+// forgeRandom returns the serial number for a certificate for name, signed
+// by ca, along with the source of randomness for forging it.
+//
+// By default both come from a deterministic stream keyed by a secret
+// (ForgeSecret, or a digest of the authority's private key) and the name, so
+// that certificate keys are stable per host but can't be reproduced by anyone
+// who doesn't hold the secret. The stream is derived with HMAC-SHA256, which
+// takes the same time regardless of its inputs.
+func (p *Proxy) forgeRandom(ca *tls.Certificate, name string) (*big.Int, io.Reader, error) {
+	if p.LegacyForging {
+		seed := sha256.Sum256([]byte(name))
+		serial := new(big.Int).SetBytes(seed[:])
+		return serial, &inf{append(([]byte)(nil), seed[:]...)}, nil
+	}
+
+	var rng io.Reader = rand.Reader
+
+	if !p.RandomKeys {
+		secret := p.ForgeSecret
+		if len(secret) == 0 {
+			der, err := x509.MarshalPKCS8PrivateKey(ca.PrivateKey)
+			if err != nil {
+				return nil, nil, err
+			}
+			sum := sha256.Sum256(der)
+			secret = sum[:]
+		}
+
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(name))
+
+		rng = &drbg{key: mac.Sum(nil)}
+	}
+
+	var buf [16]byte
+	if _, err := io.ReadFull(rng, buf[:]); err != nil {
+		return nil, nil, err
+	}
+
+	return new(big.Int).SetBytes(buf[:]), rng, nil
+}
+
+// generateKey creates an RSA key from the randomness in rng. Given a
+// deterministic stream it always returns the same key, which rsa.GenerateKey
+// doesn't promise: it sometimes reads an extra byte, on purpose, to keep
+// callers from relying on its output.
+func generateKey(rng io.Reader, bits int) (*rsa.PrivateKey, error) {
+	if rng == rand.Reader {
+		return rsa.GenerateKey(rng, bits)
+	}
+
+	one := big.NewInt(1)
+	e := big.NewInt(65537)
+
+	for {
+		p, err := generatePrime(rng, bits-bits/2)
+		if err != nil {
+			return nil, err
+		}
+		q, err := generatePrime(rng, bits/2)
+		if err != nil {
+			return nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+
+		phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		d := new(big.Int).ModInverse(e, phi)
+		if d == nil {
+			continue
+		}
+
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: new(big.Int).Mul(p, q), E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		key.Precompute()
+
+		return key, nil
+	}
+}
+
+// generatePrime returns a prime of the given size read from rng. Its top two
+// bits are set, so that the product of two such primes has exactly twice as
+// many bits. Starting from a random odd number, it steps through candidates
+// which aren't divisible by any of smallPrimes, as rsa.GenerateKey would.
+func generatePrime(rng io.Reader, bits int) (*big.Int, error) {
+	buf := make([]byte, (bits+7)/8)
+	mods := make([]uint64, len(smallPrimes))
+
+	// Number of bits used in the first byte.
+	top := uint(bits % 8)
+	if top == 0 {
+		top = 8
+	}
+
+	for {
+		if _, err := io.ReadFull(rng, buf); err != nil {
+			return nil, err
+		}
+
+		buf[0] &= uint8(int(1<<top) - 1)
+		if top >= 2 {
+			buf[0] |= 3 << (top - 2)
+		} else {
+			buf[0] |= 1
+			buf[1] |= 0x80
+		}
+		buf[len(buf)-1] |= 1
+
+		base := new(big.Int).SetBytes(buf)
+		m := new(big.Int)
+		for i, q := range smallPrimes {
+			mods[i] = m.Mod(base, m.SetUint64(q)).Uint64()
+		}
+
+	next:
+		for delta := uint64(0); delta < 1<<20; delta += 2 {
+			for i, q := range smallPrimes {
+				if (mods[i]+delta)%q == 0 {
+					continue next
+				}
+			}
+
+			p := new(big.Int).Add(base, m.SetUint64(delta))
+			if p.BitLen() != bits {
+				break
+			}
+			if p.ProbablyPrime(20) {
+				return p, nil
+			}
+		}
+	}
+}
+
+// The odd primes below 4096.
+var smallPrimes = func() []uint64 {
+	const n = 4096
+
+	var primes []uint64
+	composite := make([]bool, n)
+
+	for i := 3; i < n; i += 2 {
+		if !composite[i] {
+			primes = append(primes, uint64(i))
+			for j := i * i; j < n; j += 2 * i {
+				composite[j] = true
+			}
+		}
+	}
+
+	return primes
+}()
+
 // The inf struct generates an infinite stream of "random-looking", but highly
-// predictable, data by repeatedly stretching its state SHA-256.
+// predictable, data by repeatedly stretching its state SHA-256. Only used by
+// Proxy.LegacyForging, as anyone can reproduce its output.
 type inf struct {
 	state []byte
 }
@@ -221,3 +592,33 @@ func (i inf) Read(buf []byte) (int, error) {
 
 	return len(buf), nil
 }
+
+// The drbg type generates an infinite stream of pseudo-random data from a
+// secret key, by running HMAC-SHA256 in counter mode.
+type drbg struct {
+	key   []byte
+	n     uint64
+	block []byte
+}
+
+func (d *drbg) Read(buf []byte) (int, error) {
+	mac := hmac.New(sha256.New, d.key)
+
+	for n := 0; n < len(buf); {
+		if len(d.block) == 0 {
+			var ctr [8]byte
+			binary.BigEndian.PutUint64(ctr[:], d.n)
+			d.n++
+
+			mac.Reset()
+			mac.Write(ctr[:])
+			d.block = mac.Sum(nil)
+		}
+
+		m := copy(buf[n:], d.block)
+		d.block = d.block[m:]
+		n += m
+	}
+
+	return len(buf), nil
+}
@@ -0,0 +1,272 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+// testAuthority returns a test certificate authority, along with a config
+// for clients trusting it.
+func testAuthority(t *testing.T) (*tls.Certificate, *tls.Config) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "relay test CA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, &tls.Config{RootCAs: roots}
+}
+
+// connect opens a tunnel to addr through a session of p, and starts a TLS
+// handshake in it using cfg.
+func connect(t *testing.T, p *relay.Proxy, addr string, cfg *tls.Config) (*tls.Conn, error) {
+	t.Helper()
+
+	conn := serve(t, p)
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	if resp := readFinal(t, conn, r); resp.StatusCode != 200 {
+		t.Fatalf("CONNECT %s: got status %d", addr, resp.StatusCode)
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	return tlsConn, tlsConn.Handshake()
+}
+
+func TestForgeIPWithServerName(t *testing.T) {
+	ca, cfg := testAuthority(t)
+	cfg.ServerName = "internal.example"
+
+	var checked []string
+	p := &relay.Proxy{
+		Authority: ca,
+		CheckServerName: func(host, sni string) error {
+			checked = append(checked, host, sni)
+			return nil
+		},
+	}
+
+	conn, err := connect(t, p, "192.0.2.1:443", cfg)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	cert := conn.ConnectionState().PeerCertificates[0]
+	if len(cert.IPAddresses) != 1 || !cert.IPAddresses[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("got IP SANs %v, want 192.0.2.1", cert.IPAddresses)
+	}
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != "internal.example" {
+		t.Errorf("got DNS SANs %v, want internal.example", cert.DNSNames)
+	}
+	if len(checked) != 2 || checked[0] != "192.0.2.1" || checked[1] != "internal.example" {
+		t.Errorf("CheckServerName called with %q", checked)
+	}
+}
+
+func TestCheckServerNameRejects(t *testing.T) {
+	ca, cfg := testAuthority(t)
+	cfg.ServerName = "other.example"
+
+	p := &relay.Proxy{
+		Authority: ca,
+		CheckServerName: func(host, sni string) error {
+			return errors.New("mismatch")
+		},
+	}
+
+	if _, err := connect(t, p, "example.com:443", cfg); err == nil {
+		t.Fatal("handshake succeeded despite CheckServerName")
+	}
+}
+
+func TestSetAuthority(t *testing.T) {
+	oldCA, oldCfg := testAuthority(t)
+	newCA, newCfg := testAuthority(t)
+	oldCfg.ServerName = "example.com"
+	newCfg.ServerName = "example.com"
+
+	p := &relay.Proxy{Authority: oldCA}
+
+	before, err := connect(t, p, "example.com:443", oldCfg)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+
+	// After a rotation, leaves are signed by the new authority only, and
+	// have new keys.
+	p.SetAuthority(newCA)
+
+	if _, err := connect(t, p, "example.com:443", oldCfg); err == nil {
+		t.Errorf("old authority still trusted after rotation")
+	}
+	after, err := connect(t, p, "example.com:443", newCfg)
+	if err != nil {
+		t.Fatalf("handshake with new authority failed: %v", err)
+	}
+
+	oldLeaf := before.ConnectionState().PeerCertificates[0]
+	newLeaf := after.ConnectionState().PeerCertificates[0]
+	if bytes.Equal(oldLeaf.RawSubjectPublicKeyInfo, newLeaf.RawSubjectPublicKeyInfo) {
+		t.Errorf("leaf key reused across authorities")
+	}
+
+	// Clearing the authority disables interception, even though the
+	// Authority field is still set.
+	p.SetAuthority(nil)
+
+	conn := serve(t, p)
+	io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 500 {
+		t.Errorf("got status %d without an authority, want 500", resp.StatusCode)
+	}
+}
+
+func TestAuthorityRules(t *testing.T) {
+	defaultCA, defaultCfg := testAuthority(t)
+	internalCA, internalCfg := testAuthority(t)
+
+	match, err := (&relay.Matcher{Hosts: []string{"*.internal.example"}}).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &relay.Proxy{
+		Authority:   defaultCA,
+		Authorities: []relay.AuthorityRule{{Match: match, Authority: internalCA}},
+	}
+
+	tests := []struct {
+		host    string
+		trusted *tls.Config
+		other   *tls.Config
+	}{
+		{"db.internal.example", internalCfg, defaultCfg},
+		{"example.com", defaultCfg, internalCfg},
+	}
+
+	for _, tt := range tests {
+		cfg := tt.trusted.Clone()
+		cfg.ServerName = tt.host
+		if _, err := connect(t, p, tt.host+":443", cfg); err != nil {
+			t.Errorf("%s: handshake failed: %v", tt.host, err)
+		}
+
+		cfg = tt.other.Clone()
+		cfg.ServerName = tt.host
+		if _, err := connect(t, p, tt.host+":443", cfg); err == nil {
+			t.Errorf("%s: signed by the wrong authority", tt.host)
+		}
+	}
+}
+
+func TestForgedKeys(t *testing.T) {
+	ca, cfg := testAuthority(t)
+	otherCA, otherCfg := testAuthority(t)
+
+	// leafKey returns the public key of the certificate p forges for
+	// example.com, when signing with the authority trusted by cfg.
+	leafKey := func(p *relay.Proxy, cfg *tls.Config) []byte {
+		t.Helper()
+		cfg = cfg.Clone()
+		cfg.ServerName = "example.com"
+		conn, err := connect(t, p, "example.com:443", cfg)
+		if err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		return conn.ConnectionState().PeerCertificates[0].RawSubjectPublicKeyInfo
+	}
+
+	// By default keys are stable for an authority, but not across them.
+	key := leafKey(&relay.Proxy{Authority: ca}, cfg)
+	if !bytes.Equal(key, leafKey(&relay.Proxy{Authority: ca}, cfg)) {
+		t.Errorf("default keys aren't deterministic")
+	}
+	if bytes.Equal(key, leafKey(&relay.Proxy{Authority: otherCA}, otherCfg)) {
+		t.Errorf("same key forged by different authorities")
+	}
+
+	// With a ForgeSecret, keys depend on it rather than the authority.
+	secret := []byte("correct horse battery staple")
+	key = leafKey(&relay.Proxy{Authority: ca, ForgeSecret: secret}, cfg)
+	if !bytes.Equal(key, leafKey(&relay.Proxy{Authority: otherCA, ForgeSecret: secret}, otherCfg)) {
+		t.Errorf("keys differ despite a shared ForgeSecret")
+	}
+	if bytes.Equal(key, leafKey(&relay.Proxy{Authority: ca, ForgeSecret: []byte("other")}, cfg)) {
+		t.Errorf("same key for different ForgeSecrets")
+	}
+
+	// RandomKeys gives every certificate a new key.
+	p := &relay.Proxy{Authority: ca, RandomKeys: true}
+	if bytes.Equal(leafKey(p, cfg), leafKey(p, cfg)) {
+		t.Errorf("RandomKeys reused a key")
+	}
+
+	// LegacyForging derives keys from the host name alone.
+	key = leafKey(&relay.Proxy{Authority: ca, LegacyForging: true}, cfg)
+	if !bytes.Equal(key, leafKey(&relay.Proxy{Authority: otherCA, LegacyForging: true}, otherCfg)) {
+		t.Errorf("LegacyForging keys depend on the authority")
+	}
+}
+
+func TestLegacyForgingPinned(t *testing.T) {
+	ca, cfg := testAuthority(t)
+	cfg.ServerName = "example.com"
+
+	conn, err := connect(t, &relay.Proxy{Authority: ca, LegacyForging: true}, "example.com:443", cfg)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	leaf := conn.ConnectionState().PeerCertificates[0]
+
+	// Legacy certificates must never change, whatever the authority or the
+	// version of the proxy: their serial is the SHA-256 digest of the host
+	// name, and their key is derived from it.
+	const (
+		serial = "a379a6f6eeafb9a55e378c118034e2751e682fab9f2d30ab13d2125586ce1947"
+		key    = "dc6948aa65979b843f0a2a63d946d6354ad3ea3c97417ae4c731d1c561a19760"
+	)
+	if got := hex.EncodeToString(leaf.SerialNumber.Bytes()); got != serial {
+		t.Errorf("got serial %s, want %s", got, serial)
+	}
+	if sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo); hex.EncodeToString(sum[:]) != key {
+		t.Errorf("got key digest %x, want %s", sum, key)
+	}
+}
@@ -0,0 +1,333 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// An InjectPosition says where an InjectRule's snippet is inserted.
+type InjectPosition int
+
+const (
+	// Before the closing </head> tag, or the closing </body> tag of pages
+	// without one.
+	InjectHead InjectPosition = iota
+
+	// Before the closing </body> tag.
+	InjectBody
+)
+
+// An InjectRule inserts a snippet of markup, such as the <script> element of
+// a debug toolbar, into HTML pages passing through the proxy.
+//
+// Only successful text/html responses are modified. Bodies compressed using
+// gzip or deflate are decompressed, and matching requests are restricted to
+// those codings. Tags inside comments, and inside <script>, <style> and
+// similar elements, are ignored. Pages without the closing tag, such as
+// fragments, are left alone, as are pages encoded in UTF-16. Unless a page
+// is known to be encoded in UTF-8, non-ASCII characters in the snippet are
+// written as numeric character references.
+type InjectRule struct {
+	// Requests whose responses the rule applies to. If nil, everything
+	// matches.
+	Match *Match
+
+	Snippet  string
+	Position InjectPosition
+}
+
+// Content codings the proxy can decode to inject snippets.
+var injectEncodings = []string{"gzip", "x-gzip", "deflate"}
+
+// Elements whose content isn't parsed as markup, so that closing tags inside
+// them don't count.
+var rawTextElements = []string{
+	"iframe",
+	"noembed",
+	"noframes",
+	"plaintext",
+	"script",
+	"style",
+	"textarea",
+	"title",
+	"xmp",
+}
+
+// injection returns the index of the first rule in p.Injections matching
+// req, or -1 if there is none.
+func (p *Proxy) injection(s *Session, req *heat.Request) int {
+	for i := range p.Injections {
+		if p.Injections[i].Match.Request(s, req) {
+			return i
+		}
+	}
+	return -1
+}
+
+// inject arranges for the snippet of p.Injections[i] to be inserted into a
+// response's body, if it's an HTML page.
+func (p *Proxy) inject(s *Session, req *heat.Request, resp *heat.Response, i int) {
+	if resp.Body == nil || req.Method == "HEAD" || resp.Status < 200 || resp.Status >= 300 || resp.Status == 206 {
+		return
+	}
+	if !matchContentType([]string{"text/html"}, resp.Fields) {
+		return
+	}
+
+	var charset string
+	if value, ok := fieldValue(resp.Fields, "Content-Type"); ok {
+		if _, params, err := mime.ParseMediaType(value); err == nil {
+			charset = strings.ToLower(params["charset"])
+		}
+	}
+	if strings.HasPrefix(charset, "utf-16") || strings.HasPrefix(charset, "utf-32") {
+		return
+	}
+
+	body := resp.Body
+	if coding, ok := fieldValue(resp.Fields, "Content-Encoding"); ok {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "identity" {
+			if body, ok = decoder(coding, body); !ok {
+				return
+			}
+		}
+	}
+
+	resp.Body = &injectedBody{body: body, rule: &p.Injections[i], charset: charset}
+	resp.Fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Content-Encoding") && !f.Is("Content-Length") &&
+			!f.Is("Content-MD5") && !f.Is("Digest")
+	})
+	resp.Fields.Set("Transfer-Encoding", "chunked")
+
+	weakenETag(&resp.Fields)
+
+	p.decide(s, req, "", &DecisionRecord{
+		Action:  "rewrite",
+		Rule:    "Injections[" + strconv.Itoa(i) + "]",
+		Pattern: p.Injections[i].Match.String(),
+	})
+}
+
+// The injectedBody type inserts a snippet into an HTML document as it's
+// read, scanning just enough of the markup to find the right closing tag.
+type injectedBody struct {
+	body    io.ReadCloser
+	rule    *InjectRule
+	charset string
+
+	buf  [4096]byte
+	head []byte // the beginning of the document, for finding its charset
+	in   []byte // data read, but not yet scanned
+	out  []byte // data scanned, but not yet returned
+	end  string // what ends the current comment or raw text element
+	err  error
+
+	sniffed bool
+	done    bool // the snippet has been inserted, or won't be
+}
+
+func (b *injectedBody) Read(buf []byte) (int, error) {
+	for len(b.out) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if b.done {
+			return b.body.Read(buf)
+		}
+
+		n, err := b.body.Read(b.buf[:])
+		if room := 1024 - len(b.head); room > 0 {
+			if room > n {
+				room = n
+			}
+			b.head = append(b.head, b.buf[:room]...)
+		}
+
+		b.in = append(b.in, b.buf[:n]...)
+		b.err = err
+		b.scan()
+	}
+
+	n := copy(buf, b.out)
+	b.out = b.out[n:]
+	return n, nil
+}
+
+func (b *injectedBody) Close() error {
+	return b.body.Close()
+}
+
+// scan moves data from b.in to b.out, up to the point where the snippet
+// should be inserted or the next tag which can't be classified without
+// more data.
+func (b *injectedBody) scan() {
+	final := b.err != nil
+
+	if !b.sniffed && (len(b.in) >= 3 || final) {
+		b.sniffed = true
+		switch {
+		case bytes.HasPrefix(b.in, []byte{0xef, 0xbb, 0xbf}):
+			b.charset = "utf-8"
+		case bytes.HasPrefix(b.in, []byte{0xfe, 0xff}), bytes.HasPrefix(b.in, []byte{0xff, 0xfe}):
+			b.done = true
+		}
+	}
+
+	i := 0
+	var inject bool
+
+	for !b.done && i < len(b.in) {
+		// Skip to the end of a comment or raw text element, keeping
+		// enough data to find an end which straddles two reads.
+		if b.end != "" {
+			j := indexFold(b.in[i:], b.end)
+			if j < 0 {
+				if k := len(b.in) - len(b.end) + 1; k > i {
+					i = k
+				}
+				break
+			}
+			i += j + len(b.end)
+			b.end = ""
+			continue
+		}
+
+		j := bytes.IndexByte(b.in[i:], '<')
+		if j < 0 {
+			i = len(b.in)
+			break
+		}
+		i += j
+
+		n, ok := b.tag(b.in[i:], final)
+		if !ok {
+			break
+		}
+		if n == 0 {
+			inject, b.done = true, true
+			break
+		}
+		i += n
+	}
+
+	b.out = append(b.out, b.in[:i]...)
+	if inject {
+		b.out = append(b.out, b.snippet()...)
+	}
+	if b.done || final {
+		b.out = append(b.out, b.in[i:]...)
+		i = len(b.in)
+	}
+
+	b.in = append(b.in[:0], b.in[i:]...)
+}
+
+// tag classifies the markup at the beginning of data, which starts with
+// '<'. It returns how many bytes can be skipped, or zero if the snippet
+// belongs right there. The result isn't ok if more data is needed.
+func (b *injectedBody) tag(data []byte, final bool) (int, bool) {
+	const longest = len("plaintext")
+
+	if len(data) < 4 && !final && bytes.HasPrefix([]byte("<!--"), data) {
+		return 0, false
+	}
+	if bytes.HasPrefix(data, []byte("<!--")) {
+		b.end = "-->"
+		return 4, true
+	}
+
+	closing := len(data) > 1 && data[1] == '/'
+	start := 1
+	if closing {
+		start = 2
+	}
+
+	// Read the tag name, which must be followed by whitespace, '/' or '>'.
+	n := start
+	for n < len(data) && n-start <= longest && isLetter(data[n]) {
+		n++
+	}
+	if n == len(data) && !final {
+		return 0, false
+	}
+	if n == start || n-start > longest || (n < len(data) && !isTagEnd(data[n])) {
+		return 1, true
+	}
+
+	name := strings.ToLower(string(data[start:n]))
+
+	if closing {
+		if name == "body" || (name == "head" && b.rule.Position == InjectHead) {
+			return 0, true
+		}
+		return n, true
+	}
+
+	if contains(rawTextElements, name) {
+		b.end = "</" + name
+	}
+
+	return n, true
+}
+
+// snippet returns the rule's snippet, encoded for the document.
+func (b *injectedBody) snippet() []byte {
+	label := b.charset
+	if label == "" {
+		label = sniffCharset(b.head)
+	}
+
+	// Pages read this far are ASCII-compatible, whatever they declare.
+	cs, ok := lookupCharset(label)
+	if ok && cs.order != nil {
+		cs = charsetUTF8
+	} else if !ok {
+		// Stick to ASCII, which any charset we'd get this far with agrees on.
+		cs = &charset{name: "us-ascii", high: &[128]rune{}}
+	}
+
+	buf, _ := cs.encode(b.rule.Snippet, true)
+	return buf
+}
+
+// sniffCharset looks for a charset declared in a <meta> element at the
+// beginning of an HTML document.
+func sniffCharset(head []byte) string {
+	i := indexFold(head, "charset=")
+	if i < 0 {
+		return ""
+	}
+
+	value := bytes.TrimLeft(head[i+len("charset="):], `"' `)
+	n := 0
+	for n < len(value) && (isLetter(value[n]) || value[n] >= '0' && value[n] <= '9' || value[n] == '-' || value[n] == '_') {
+		n++
+	}
+
+	return strings.ToLower(string(value[:n]))
+}
+
+// indexFold is like bytes.Index, but ignores the case of ASCII letters.
+func indexFold(data []byte, s string) int {
+	for i := 0; i+len(s) <= len(data); i++ {
+		if strings.EqualFold(string(data[i:i+len(s)]), s) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isTagEnd(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '/' || c == '>'
+}
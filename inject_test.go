@@ -0,0 +1,166 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+// The page type describes a response served by the injection test's
+// upstream server.
+type page struct {
+	status   int
+	ctype    string
+	encoding string
+	body     string
+}
+
+func TestInjections(t *testing.T) {
+	bodyOnly, _ := relay.ParseMatch("path=/body/")
+	unicode, _ := relay.ParseMatch("path=/unicode/")
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	io.WriteString(w, "<html><head></head></html>")
+	w.Close()
+
+	const html = "text/html"
+
+	tests := []struct {
+		path string
+		page page
+		want string
+	}{
+		// Closing tags inside comments and raw text elements don't count,
+		// even when split across reads.
+		{"/head/title", page{200, html, "", "<head><title></head></title></head><body></body>"},
+			"<head><title></head></title><x></head><body></body>"},
+		{"/body/comment", page{200, html, "", "<!-- </body> --><body></BODY>"},
+			"<!-- </body> --><body><x></BODY>"},
+		{"/body/script", page{200, html, "", "<script>'</body>'</SCRIPT ></body>"},
+			"<script>'</body>'</SCRIPT ><x></body>"},
+		{"/head/bodytags", page{200, html, "", "<bodyx></bodyx><body>hi</body >"},
+			"<bodyx></bodyx><body>hi<x></body >"},
+
+		// Pages without a head get the snippet at the end of their body,
+		// and fragments aren't touched.
+		{"/head/headless", page{200, html, "", "<body>hi</body>"}, "<body>hi<x></body>"},
+		{"/head/fragment", page{200, html, "", "<p>hi</p>"}, "<p>hi</p>"},
+
+		// Only successful HTML responses are modified.
+		{"/head/text", page{200, "text/plain", "", "<head></head>"}, "<head></head>"},
+		{"/head/missing", page{404, html, "", "<head></head>"}, "<head></head>"},
+		{"/head/utf16", page{200, html + "; charset=utf-16", "", "<head></head>"}, "<head></head>"},
+
+		// Compressed pages are decompressed.
+		{"/head/gzip", page{200, html, "gzip", gz.String()}, "<html><head><x></head></html>"},
+
+		// Non-ASCII characters are escaped unless the page's charset is
+		// known, whether from the header or a <meta> element.
+		{"/unicode/unknown", page{200, html, "", "<head></head>"}, "<head><!--&#252;--></head>"},
+		{"/unicode/header", page{200, html + "; charset=UTF-8", "", "<head></head>"}, "<head><!--ü--></head>"},
+		{"/unicode/meta", page{200, html, "", `<head><meta charset="utf-8"></head>`}, "<head><meta charset=\"utf-8\"><!--ü--></head>"},
+		{"/unicode/latin1", page{200, html + "; charset=iso-8859-1", "", "<head></head>"}, "<head><!--\xfc--></head>"},
+	}
+
+	pages := make(map[string]page)
+	for _, tt := range tests {
+		pages[tt.path] = tt.page
+	}
+
+	encodings := make(chan string, 1)
+	p := &relay.Proxy{
+		Injections: []relay.InjectRule{
+			{Match: bodyOnly, Snippet: "<x>", Position: relay.InjectBody},
+			{Match: unicode, Snippet: "<!--ü-->"},
+			{Snippet: "<x>"},
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			for _, f := range req.Fields {
+				if f.Is("Accept-Encoding") {
+					encodings <- f.Value
+				}
+			}
+
+			pg := pages[strings.TrimPrefix(req.URI, "http://origin.test")]
+			resp := heat.NewResponse(pg.status, "")
+			resp.Fields.Set("Content-Type", pg.ctype)
+			resp.Fields.Set("Content-Length", strconv.Itoa(len(pg.body)))
+			resp.Fields.Set("ETag", `"v1"`)
+			if pg.encoding != "" {
+				resp.Fields.Set("Content-Encoding", pg.encoding)
+			}
+			resp.Body = io.NopCloser(iotest.OneByteReader(strings.NewReader(pg.body)))
+			return resp, nil
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	for _, tt := range tests {
+		io.WriteString(conn, "GET http://origin.test"+tt.path+" HTTP/1.1\r\nHost: origin.test\r\nAccept-Encoding: br, gzip\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+
+		if string(body) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.path, body, tt.want)
+		}
+
+		// Pages which may be modified lose their framing, coding and strong
+		// validators.
+		rewritten := tt.page.status == 200 && strings.HasPrefix(tt.page.ctype, html) &&
+			!strings.Contains(tt.page.ctype, "utf-16")
+		if got := resp.Header.Get("ETag") == `W/"v1"`; got != rewritten {
+			t.Errorf("%s: got ETag %q", tt.path, resp.Header.Get("ETag"))
+		}
+		if rewritten && (resp.ContentLength != -1 || resp.Header.Get("Content-Encoding") != "") {
+			t.Errorf("%s: got Content-Length %d and Content-Encoding %q", tt.path, resp.ContentLength, resp.Header.Get("Content-Encoding"))
+		}
+
+		// Upstream servers are only offered codings the proxy can decode.
+		if got := <-encodings; got != "gzip" {
+			t.Errorf("%s: upstream got Accept-Encoding %q", tt.path, got)
+		}
+	}
+}
+
+func TestInjectionsHead(t *testing.T) {
+	p := &relay.Proxy{
+		Injections: []relay.InjectRule{{Snippet: "<x>"}},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Type", "text/html")
+			resp.Fields.Set("Content-Length", "13")
+			resp.Fields.Set("ETag", `"v1"`)
+			return resp, nil
+		},
+	}
+
+	conn := serve(t, p)
+	io.WriteString(conn, "HEAD http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+
+	// Responses to HEAD requests aren't touched.
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	tp.ReadLine()
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Get("ETag") != `"v1"` || header.Get("Transfer-Encoding") != "" {
+		t.Errorf("HEAD response reframed: %v", header)
+	}
+}
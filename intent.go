@@ -0,0 +1,52 @@
+package relay
+
+import (
+	"context"
+
+	"github.com/erkl/heat"
+)
+
+// A ClientIntent describes how a client means to use its connection, as
+// determined from the request it sent before the request was modified for
+// forwarding. RoundTrip implementations can consult it (see Session.Intent
+// and IntentFromContext) when deciding whether to keep upstream connections
+// around, rather than inspecting the request's Connection header field,
+// which the proxy leaves to them.
+type ClientIntent struct {
+	// HTTP version of the client's request.
+	Major, Minor int
+
+	// Whether the client means to keep its connection open once the
+	// response has been sent.
+	KeepAlive bool
+
+	// Protocol the client asked to switch to, if any.
+	Upgrade string
+}
+
+// clientIntent determines the intent of the client sending req.
+func clientIntent(req *heat.Request) ClientIntent {
+	return ClientIntent{
+		Major:     req.Major,
+		Minor:     req.Minor,
+		KeepAlive: !heat.Closing(req.Major, req.Minor, req.Fields),
+		Upgrade:   upgradeProtocol(req.Fields),
+	}
+}
+
+// Intent returns the intent of the client for the request currently being
+// served.
+func (s *Session) Intent() ClientIntent {
+	return s.intent
+}
+
+// The intentKey type is used to look up a ClientIntent in a request's
+// context.
+type intentKey struct{}
+
+// IntentFromContext returns the intent of the client for the request whose
+// context is ctx, as passed to RoundTripContext.
+func IntentFromContext(ctx context.Context) (ClientIntent, bool) {
+	intent, ok := ctx.Value(intentKey{}).(ClientIntent)
+	return intent, ok
+}
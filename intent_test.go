@@ -0,0 +1,120 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestClientIntent(t *testing.T) {
+	ca, cfg := testAuthority(t)
+	cfg.ServerName = "example.com"
+
+	type intents struct{ session, ctx relay.ClientIntent }
+	seen := make(chan intents, 1)
+	var session relay.ClientIntent
+
+	p := &relay.Proxy{
+		Authority: ca,
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			session = s.Intent()
+			return nil
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			intent, ok := relay.IntentFromContext(ctx)
+			if !ok {
+				t.Error("no intent in the request's context")
+			}
+			seen <- intents{session, intent}
+
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			return resp, nil
+		},
+	}
+
+	for _, tt := range []struct {
+		request string
+		want    relay.ClientIntent
+	}{
+		{"GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n\r\n", relay.ClientIntent{1, 1, true, ""}},
+		{"GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\nConnection: close\r\n\r\n", relay.ClientIntent{1, 1, false, ""}},
+		{"GET http://origin.test/ HTTP/1.0\r\nHost: origin.test\r\n\r\n", relay.ClientIntent{1, 0, false, ""}},
+		{"GET http://origin.test/ HTTP/1.0\r\nHost: origin.test\r\nConnection: keep-alive\r\n\r\n", relay.ClientIntent{1, 0, true, ""}},
+		{"GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n",
+			relay.ClientIntent{1, 1, true, "websocket"}},
+	} {
+		conn := serve(t, p)
+		io.WriteString(conn, tt.request)
+
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+		if got := <-seen; got.session != tt.want || got.ctx != tt.want {
+			t.Errorf("%q: got intents %+v, want %+v", tt.request, got, tt.want)
+		}
+
+		// Whether the client's connection is kept open is still up to it.
+		if resp.Close == tt.want.KeepAlive {
+			t.Errorf("%q: got Connection %q", tt.request, resp.Header.Get("Connection"))
+		}
+	}
+
+	// The same goes for intercepted requests.
+	conn, err := connect(t, p, "example.com:443", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET / HTTP/1.0\r\nHost: example.com\r\n\r\n")
+	readFinal(t, conn, bufio.NewReader(conn))
+	if got, want := <-seen, (relay.ClientIntent{1, 0, false, ""}); got.session != want || got.ctx != want {
+		t.Errorf("intercepted: got intents %+v, want %+v", got, want)
+	}
+}
+
+func TestTransportKeepAlive(t *testing.T) {
+	var mu sync.Mutex
+	conns := make(map[net.Conn]bool)
+	var headers []string
+
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		mu.Lock()
+		conns[conn] = true
+		headers = append(headers, req.Header.Get("Connection"))
+		mu.Unlock()
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	})
+
+	tr := &relay.Transport{}
+	for i := 0; i < 2; i++ {
+		req := heat.NewRequest("GET", "/")
+		req.Scheme, req.Remote = "http", addr
+		req.Fields.Set("Host", addr)
+		req.Fields.Set("Connection", "close")
+
+		resp, err := tr.RoundTripContext(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		// The request is left as it was.
+		if got := field(req.Fields, "Connection"); got != "close" {
+			t.Errorf("request's Connection changed to %q", got)
+		}
+	}
+
+	// The client's wish to close its connection doesn't stop the transport
+	// from reusing its own.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(conns) != 1 || len(headers) != 2 || headers[0] != "keep-alive" || headers[1] != "keep-alive" {
+		t.Errorf("got %d connections, with Connection fields %q", len(conns), headers)
+	}
+}
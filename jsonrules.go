@@ -0,0 +1,459 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// A JSONAction describes what a JSONPatch does.
+type JSONAction int
+
+const (
+	// Set the value at a path, creating any missing objects along it.
+	JSONSet JSONAction = iota
+
+	// Remove the value at a path.
+	JSONRemove
+)
+
+// A JSONPatch is a modification to a JSON document.
+type JSONPatch struct {
+	Action JSONAction
+
+	// Path of the value, as a list of object member names and array indices
+	// separated by dots, such as "user.name" or "items.0.price". A "*"
+	// segment stands for every member or element, such that "items.*.price"
+	// covers the price of every item.
+	Path string
+
+	// For JSONSet, the new value as JSON text, such as `"fixed"`, `42` or
+	// `{"enabled": true}`. It may contain templates, which are replaced
+	// within strings, or stand for the whole value when nothing else is
+	// given:
+	//
+	//	${body:PATH}    the value at PATH in the (unpatched) document
+	//	${query:NAME}   a query parameter of the request
+	//	${header:NAME}  a header field of the request
+	//	${method}       the request's method
+	//	${path}         the request's path
+	//	${now}          the current time, in RFC 3339 format
+	Value string
+}
+
+// A JSONCondition is a condition on a JSON document.
+type JSONCondition struct {
+	Path string
+
+	// JSON text the value at Path must equal, or "" for it to merely exist.
+	Equals string
+}
+
+// A JSONRule modifies the JSON bodies of forwarded requests or responses,
+// such as for mocking APIs. Bodies larger than Proxy.MaxJSONBody are left
+// alone, as are bodies which aren't valid JSON. Compressed bodies are
+// decompressed when they're modified.
+type JSONRule struct {
+	// Which messages the rule applies to.
+	Request  bool
+	Response bool
+
+	// Requests whose messages the rule applies to. If nil, everything
+	// matches.
+	Match *Match
+
+	// Conditions the document must meet for the rule to apply.
+	When []JSONCondition
+
+	// Modifications made, in order.
+	Patches []JSONPatch
+}
+
+// applies reports whether a document meets the rule's conditions.
+func (r *JSONRule) applies(doc interface{}) bool {
+	for _, c := range r.When {
+		var want interface{}
+		if c.Equals != "" {
+			want, _ = decodeJSON([]byte(c.Equals))
+		}
+
+		found := false
+		walkJSON(doc, splitJSONPath(c.Path), func(v interface{}) {
+			if c.Equals == "" || reflect.DeepEqual(v, want) {
+				found = true
+			}
+		})
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// patchJSONRequest applies the request rules in p.JSONRules to a request's
+// body.
+func (p *Proxy) patchJSONRequest(s *Session, req *heat.Request) {
+	p.patchJSON(s, req, &req.Fields, &req.Body, true)
+}
+
+// patchJSONResponse applies the response rules in p.JSONRules to a
+// response's body.
+func (p *Proxy) patchJSONResponse(s *Session, req *heat.Request, resp *heat.Response) {
+	if resp.Status == 101 || resp.Status == 206 || req.Method == "HEAD" {
+		return
+	}
+	p.patchJSON(s, req, &resp.Fields, &resp.Body, false)
+}
+
+func (p *Proxy) patchJSON(s *Session, req *heat.Request, fields *heat.Fields, body *io.ReadCloser, request bool) {
+	if *body == nil || len(p.JSONRules) == 0 {
+		return
+	}
+
+	var rules []int
+	for i := range p.JSONRules {
+		r := &p.JSONRules[i]
+		if ((request && r.Request) || (!request && r.Response)) && r.Match.Request(s, req) {
+			rules = append(rules, i)
+		}
+	}
+	if len(rules) == 0 {
+		return
+	}
+
+	v, ok := fieldValue(*fields, "Content-Type")
+	if !ok {
+		return
+	}
+	if mediaType, _, err := mime.ParseMediaType(v); err != nil || !isJSONType(mediaType) {
+		return
+	}
+
+	data, ok := readJSONBody(*fields, body, p.maxJSONBody())
+	if !ok {
+		return
+	}
+
+	doc, err := decodeJSON(data)
+	if err != nil {
+		return
+	}
+
+	// Templates see the document as it was received.
+	orig, _ := decodeJSON(data)
+	changed := false
+
+	for _, i := range rules {
+		r := &p.JSONRules[i]
+		if !r.applies(doc) {
+			continue
+		}
+
+		for _, patch := range r.Patches {
+			if patch.Action == JSONRemove {
+				doc = removeJSON(doc, splitJSONPath(patch.Path))
+			} else {
+				value, err := expandJSONTemplate(patch.Value, req, orig, p.clock().Now())
+				if err != nil {
+					continue
+				}
+				doc = setJSON(doc, splitJSONPath(patch.Path), value)
+			}
+		}
+
+		changed = true
+		p.decide(s, req, "", &DecisionRecord{
+			Action:  "rewrite",
+			Rule:    "JSONRules[" + strconv.Itoa(i) + "]",
+			Pattern: r.Match.String(),
+			Reason:  "patched JSON body",
+		})
+	}
+
+	if !changed {
+		return
+	}
+
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return
+	}
+
+	(*body).Close()
+	setBody(fields, body, out, true)
+}
+
+func (p *Proxy) maxJSONBody() int64 {
+	if p.MaxJSONBody > 0 {
+		return p.MaxJSONBody
+	}
+	return 1 << 20
+}
+
+// readJSONBody reads a body of at most limit bytes, decompressing it. If
+// it's too large, or its coding isn't understood, the body is restored and
+// false returned. Otherwise it's replaced with an undecoded copy.
+func readJSONBody(fields heat.Fields, body *io.ReadCloser, limit int64) ([]byte, bool) {
+	raw, err := ioutil.ReadAll(io.LimitReader(*body, limit+1))
+	if err != nil || int64(len(raw)) > limit {
+		*body = &pipedPrefix{io.MultiReader(bytes.NewReader(raw), *body), *body}
+		return nil, false
+	}
+
+	(*body).Close()
+	*body = ioutil.NopCloser(bytes.NewReader(raw))
+
+	coding, ok := fieldValue(fields, "Content-Encoding")
+	coding = strings.ToLower(strings.TrimSpace(coding))
+	if !ok || coding == "identity" {
+		return raw, true
+	}
+
+	dec, ok := decoder(coding, ioutil.NopCloser(bytes.NewReader(raw)))
+	if !ok {
+		return nil, false
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(dec, limit+1))
+	if err != nil || int64(len(data)) > limit {
+		return nil, false
+	}
+
+	return data, true
+}
+
+// A pipedPrefix is a body whose beginning has already been read.
+type pipedPrefix struct {
+	io.Reader
+	body io.Closer
+}
+
+func (b *pipedPrefix) Close() error {
+	return b.body.Close()
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func splitJSONPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// walkJSON calls fn with every value at path.
+func walkJSON(v interface{}, path []string, fn func(v interface{})) {
+	if len(path) == 0 {
+		fn(v)
+		return
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if path[0] == "*" || path[0] == key {
+				walkJSON(child, path[1:], fn)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				walkJSON(child, path[1:], fn)
+			}
+		}
+	}
+}
+
+// setJSON sets the values at path, returning the updated document.
+func setJSON(v interface{}, path []string, value interface{}) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if path[0] == "*" {
+			for key, child := range v {
+				v[key] = setJSON(child, path[1:], value)
+			}
+		} else {
+			v[path[0]] = setJSON(v[path[0]], path[1:], value)
+		}
+		return v
+
+	case []interface{}:
+		for i, child := range v {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				v[i] = setJSON(child, path[1:], value)
+			}
+		}
+		return v
+
+	case nil:
+		if path[0] == "*" {
+			return nil
+		}
+		return map[string]interface{}{path[0]: setJSON(nil, path[1:], value)}
+	}
+
+	return v
+}
+
+// removeJSON removes the values at path, returning the updated document.
+func removeJSON(v interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return nil
+	}
+
+	last := len(path) == 1
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if path[0] == "*" || path[0] == key {
+				if last {
+					delete(v, key)
+				} else {
+					v[key] = removeJSON(child, path[1:])
+				}
+			}
+		}
+		return v
+
+	case []interface{}:
+		kept := v[:0]
+		for i, child := range v {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				if last {
+					continue
+				}
+				child = removeJSON(child, path[1:])
+			}
+			kept = append(kept, child)
+		}
+		return kept
+	}
+
+	return v
+}
+
+// expandJSONTemplate decodes a patch's value, replacing its templates.
+func expandJSONTemplate(value string, req *heat.Request, doc interface{}, now time.Time) (interface{}, error) {
+	trimmed := strings.TrimSpace(value)
+	if strings.HasPrefix(trimmed, "${") && strings.Index(trimmed, "}") == len(trimmed)-1 {
+		return templateValue(trimmed[2:len(trimmed)-1], req, doc, now), nil
+	}
+
+	var b strings.Builder
+	for {
+		i := strings.Index(value, "${")
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(value[i:], '}')
+		if j < 0 {
+			break
+		}
+
+		v := templateValue(value[i+2:i+j], req, doc, now)
+		text, ok := v.(string)
+		if !ok {
+			data, _ := json.Marshal(v)
+			text = string(data)
+		}
+
+		// Templates are replaced within strings.
+		quoted, _ := json.Marshal(text)
+		b.WriteString(value[:i])
+		b.Write(quoted[1 : len(quoted)-1])
+		value = value[i+j+1:]
+	}
+	b.WriteString(value)
+
+	return decodeJSON([]byte(b.String()))
+}
+
+// templateValue returns the value a template stands for.
+func templateValue(name string, req *heat.Request, doc interface{}, now time.Time) interface{} {
+	kind, arg, _ := strings.Cut(name, ":")
+
+	switch kind {
+	case "body":
+		var found interface{}
+		walkJSON(doc, splitJSONPath(arg), func(v interface{}) {
+			if found == nil {
+				found = v
+			}
+		})
+		return found
+
+	case "query":
+		if _, query, ok := strings.Cut(req.URI, "?"); ok {
+			if values, err := url.ParseQuery(query); err == nil {
+				return values.Get(arg)
+			}
+		}
+		return ""
+
+	case "header":
+		v, _ := fieldValue(req.Fields, arg)
+		return v
+
+	case "method":
+		return req.Method
+
+	case "path":
+		if u, err := url.ParseRequestURI(req.URI); err == nil {
+			return u.Path
+		}
+		return req.URI
+
+	case "now":
+		return now.UTC().Format(time.RFC3339)
+	}
+
+	return nil
+}
+
+// Kinds of templates JSONPatch values may contain.
+var jsonTemplates = []string{"body", "query", "header", "method", "path", "now"}
+
+// validateJSONValue checks a patch's value, with its templates.
+func validateJSONValue(value string) bool {
+	var b strings.Builder
+	for {
+		i := strings.Index(value, "${")
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(value[i:], '}')
+		if j < 0 {
+			return false
+		}
+		kind, _, _ := strings.Cut(value[i+2:i+j], ":")
+		if !contains(jsonTemplates, kind) {
+			return false
+		}
+		b.WriteString(value[:i] + "0")
+		value = value[i+j+1:]
+	}
+	b.WriteString(value)
+
+	return json.Valid([]byte(b.String()))
+}
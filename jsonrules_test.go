@@ -0,0 +1,154 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+	"github.com/erkl/relay/relaytest"
+)
+
+func TestJSONRequestRules(t *testing.T) {
+	sent := make(chan string, 1)
+	decisions := make(chan *relay.DecisionRecord, 2)
+
+	p := &relay.Proxy{
+		MaxJSONBody:   100,
+		AuditDecision: func(r *relay.DecisionRecord) { decisions <- r },
+		JSONRules: []relay.JSONRule{
+			{
+				Request: true,
+				When:    []relay.JSONCondition{{Path: "type", Equals: `"order"`}, {Path: "items.*.price"}},
+				Patches: []relay.JSONPatch{
+					{Action: relay.JSONRemove, Path: "secret"},
+					{Action: relay.JSONSet, Path: "items.*.price", Value: "0"},
+					{Action: relay.JSONSet, Path: "meta.via", Value: `"relay"`},
+				},
+			},
+			{
+				// Response rules don't apply to requests.
+				Response: true,
+				Patches:  []relay.JSONPatch{{Action: relay.JSONSet, Path: "response", Value: "true"}},
+			},
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			body, _ := io.ReadAll(req.Body)
+			if n, _ := strconv.Atoi(field(req.Fields, "Content-Length")); n != len(body) {
+				t.Errorf("got Content-Length %d for %d bytes", n, len(body))
+			}
+			sent <- string(body)
+			return heat.NewResponse(204, "No Content"), nil
+		},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	order := `{"type": "order", "secret": "x", "items": [{"price": 5}, {"price": 7.25}]}`
+
+	for _, tt := range []struct {
+		contentType, body, want string
+	}{
+		{"application/json", order, `{"items":[{"price":0},{"price":0}],"meta":{"via":"relay"},"type":"order"}`},
+		{"application/vnd.api+json; charset=utf-8", order, `{"items":[{"price":0},{"price":0}],"meta":{"via":"relay"},"type":"order"}`},
+
+		// Bodies failing the conditions, of other types, too large or
+		// malformed are left alone.
+		{"application/json", `{"type": "user", "items": [{"price": 5}]}`, ""},
+		{"application/json", `{"type": "order", "items": []}`, ""},
+		{"text/plain", order, ""},
+		{"application/json", `{"type": "order", "items": [{"price": 5}], "pad": "` + strings.Repeat("x", 100) + `"}`, ""},
+		{"application/json", `{"type": "order", "items": [{"price": 5}]`, ""},
+	} {
+		conn := serve(t, p)
+		fmt.Fprintf(conn, "POST http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n"+
+			"Content-Type: %s\r\nContent-Length: %d\r\n\r\n%s", tt.contentType, len(tt.body), tt.body)
+
+		if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 204 {
+			t.Fatalf("got status %d", resp.StatusCode)
+		}
+
+		want := tt.want
+		if want == "" {
+			want = tt.body
+		}
+		if got := <-sent; got != want {
+			t.Errorf("%s %.30s: forwarded %s, want %s", tt.contentType, tt.body, got, want)
+		}
+
+		select {
+		case d := <-decisions:
+			if tt.want == "" || d.Action != "rewrite" || d.Rule != "JSONRules[0]" {
+				t.Errorf("%s %.30s: got decision %+v", tt.contentType, tt.body, d)
+			}
+		default:
+			if tt.want != "" {
+				t.Errorf("%s %.30s: got no decision", tt.contentType, tt.body)
+			}
+		}
+	}
+}
+
+func TestJSONResponseRules(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	io.WriteString(zw, `{"user": {"name": "bob"}, "items": [1, 2, 3]}`)
+	zw.Close()
+
+	p := &relay.Proxy{
+		Clock: relaytest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+		JSONRules: []relay.JSONRule{{
+			Response: true,
+			Patches: []relay.JSONPatch{
+				{Action: relay.JSONRemove, Path: "items.0"},
+				{Action: relay.JSONSet, Path: "user.name", Value: `"${header:X-User}"`},
+				{Action: relay.JSONSet, Path: "echo", Value: `"${method} ${path}?id=${query:id}"`},
+				{Action: relay.JSONSet, Path: "was", Value: "${body:user}"},
+				{Action: relay.JSONSet, Path: "at", Value: `{"time": "${now}", "count": ${body:items.2}}`},
+			},
+		}},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Type", "application/json")
+			resp.Fields.Set("Content-Encoding", "gzip")
+			resp.Fields.Set("Content-Length", strconv.Itoa(gz.Len()))
+			resp.Fields.Set("ETag", `"v1"`)
+			resp.Body = io.NopCloser(bytes.NewReader(gz.Bytes()))
+			return resp, nil
+		},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "GET http://origin.test/users?id=7 HTTP/1.1\r\nHost: origin.test\r\nX-User: \"alice\"\r\n\r\n")
+
+	resp := readFinal(t, conn, r)
+	body, _ := io.ReadAll(resp.Body)
+
+	want := `{"at":{"count":3,"time":"2020-01-01T00:00:00Z"},"echo":"GET /users?id=7",` +
+		`"items":[2,3],"user":{"name":"\"alice\""},"was":{"name":"bob"}}`
+	if string(body) != want {
+		t.Errorf("got body %s, want %s", body, want)
+	}
+	if resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("ETag") != `W/"v1"` {
+		t.Errorf("got header %v", resp.Header)
+	}
+
+	// HEAD responses are left alone.
+	io.WriteString(conn, "HEAD http://origin.test/users HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+	if resp := readFinal(t, conn, r); resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("got HEAD header %v", resp.Header)
+	}
+}
@@ -0,0 +1,453 @@
+package relay
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A JWTValidator validates JSON Web Tokens presented by clients as bearer
+// tokens, such as OpenID Connect ID tokens. Tokens must be signed using an
+// RSA, ECDSA or Ed25519 key. JWTValidators are safe for concurrent use.
+type JWTValidator struct {
+	// Expected "iss" claim. Unless JWKSURL or Keys is set, the issuer's
+	// keys are found through OpenID Connect discovery.
+	Issuer string
+
+	// Expected audience, which the "aud" claim must contain. If empty, the
+	// audience isn't checked.
+	Audience string
+
+	// URL of the JSON Web Key Set holding the issuer's signing keys.
+	JWKSURL string
+
+	// Fixed signing keys by key ID, used instead of fetching them.
+	Keys map[string]crypto.PublicKey
+
+	// Claim holding the name reported by Session.User. Defaults to "sub".
+	UserClaim string
+
+	// How long fetched keys are used before being fetched again. Defaults
+	// to an hour. Keys are also refetched when a token names an unknown
+	// key. Either way, and whether or not fetching succeeds, they're
+	// fetched at most once a minute (or once per CacheTTL, if shorter).
+	CacheTTL time.Duration
+
+	// Tolerated clock skew when checking "exp" and "nbf". Defaults to a
+	// minute.
+	Leeway time.Duration
+
+	// If true, tokens without an "exp" claim are accepted, and never
+	// expire. Otherwise they're rejected.
+	AllowNoExpiry bool
+
+	// Client used to fetch keys. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	tried    time.Time
+	fetching chan struct{} // closed once a fetch in progress ends
+}
+
+// Validate checks a token's signature and claims, returning its claims.
+func (v *JWTValidator) Validate(ctx context.Context, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("relay: malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("relay: malformed signature")
+	}
+
+	key, err := v.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWT(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// user returns the user name claimed by a validated token.
+func (v *JWTValidator) user(claims map[string]interface{}) string {
+	name := v.UserClaim
+	if name == "" {
+		name = "sub"
+	}
+	user, _ := claims[name].(string)
+	return user
+}
+
+// expiry returns the time at which a validated token expires, if known.
+func (v *JWTValidator) expiry(claims map[string]interface{}) time.Time {
+	if exp, ok := claims["exp"].(float64); ok {
+		return time.Unix(int64(exp), 0).Add(v.leeway())
+	}
+	return time.Time{}
+}
+
+func (v *JWTValidator) checkClaims(claims map[string]interface{}) error {
+	now := time.Now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok && !v.AllowNoExpiry {
+		return errors.New("relay: token has no expiry")
+	}
+	if ok && now.After(time.Unix(int64(exp), 0).Add(v.leeway())) {
+		return errors.New("relay: token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.leeway()).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("relay: token isn't valid yet")
+	}
+
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return errors.New("relay: unexpected issuer")
+	}
+
+	if v.Audience != "" {
+		var ok bool
+		switch aud := claims["aud"].(type) {
+		case string:
+			ok = aud == v.Audience
+		case []interface{}:
+			for _, a := range aud {
+				ok = ok || a == v.Audience
+			}
+		}
+		if !ok {
+			return errors.New("relay: unexpected audience")
+		}
+	}
+
+	if v.user(claims) == "" {
+		return errors.New("relay: token doesn't name a user")
+	}
+
+	return nil
+}
+
+func (v *JWTValidator) leeway() time.Duration {
+	if v.Leeway > 0 {
+		return v.Leeway
+	}
+	return time.Minute
+}
+
+// key returns the public key with a particular ID, fetching the issuer's
+// keys if necessary.
+func (v *JWTValidator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if v.Keys != nil {
+		if key, ok := v.Keys[kid]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("relay: unknown key %q", kid)
+	}
+
+	ttl := v.CacheTTL
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+
+	// Issuers which can't be reached aren't retried for every token.
+	backoff := time.Minute
+	if ttl < backoff {
+		backoff = ttl
+	}
+
+	v.mu.Lock()
+	key, ok := v.keys[kid]
+	stale := (!ok || time.Since(v.fetched) > ttl) && time.Since(v.tried) > backoff
+	fetching := v.fetching
+
+	switch {
+	case stale && fetching == nil:
+		// Fetch the keys without holding the lock, so that tokens signed
+		// with keys we have aren't held up by a slow issuer.
+		fetching = make(chan struct{})
+		v.fetching = fetching
+		v.mu.Unlock()
+
+		keys, err := v.fetch(ctx)
+
+		v.mu.Lock()
+		v.tried = time.Now()
+		if err == nil {
+			v.keys, v.fetched = keys, v.tried
+		}
+		v.fetching = nil
+		close(fetching)
+		key, ok = v.keys[kid]
+		v.mu.Unlock()
+
+		// Keep using the keys we have if the issuer is unreachable.
+		if err != nil && !ok {
+			return nil, err
+		}
+
+	case stale && !ok:
+		// Another token is having the keys fetched, which may include the
+		// one we need.
+		v.mu.Unlock()
+
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		v.mu.Lock()
+		key, ok = v.keys[kid]
+		v.mu.Unlock()
+
+	default:
+		v.mu.Unlock()
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("relay: unknown key %q", kid)
+	}
+
+	return key, nil
+}
+
+// fetch downloads the issuer's key set.
+func (v *JWTValidator) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	u := v.JWKSURL
+
+	if u == "" {
+		if v.Issuer == "" {
+			return nil, errors.New("relay: no issuer or key set URL")
+		}
+
+		var config struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		err := v.getJSON(ctx, strings.TrimSuffix(v.Issuer, "/")+"/.well-known/openid-configuration", &config)
+		if err != nil {
+			return nil, err
+		}
+		if config.JWKSURI == "" {
+			return nil, errors.New("relay: issuer has no jwks_uri")
+		}
+
+		u = config.JWKSURI
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(ctx, u, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+
+	return keys, nil
+}
+
+func (v *JWTValidator) getJSON(ctx context.Context, url string, dst interface{}) error {
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("relay: fetching keys: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("relay: fetching %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+// A jwk is a JSON Web Key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	dec := base64.RawURLEncoding
+
+	switch k.Kty {
+	case "RSA":
+		n, err1 := dec.DecodeString(k.N)
+		e, err2 := dec.DecodeString(k.E)
+		if err1 != nil || err2 != nil || len(e) > 4 {
+			return nil, errors.New("relay: malformed RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("relay: unsupported curve %q", k.Crv)
+		}
+
+		x, err1 := dec.DecodeString(k.X)
+		y, err2 := dec.DecodeString(k.Y)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("relay: malformed EC key")
+		}
+
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("relay: malformed EC key")
+		}
+		return key, nil
+
+	case "OKP":
+		x, err := dec.DecodeString(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("relay: malformed OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("relay: unsupported key type %q", k.Kty)
+	}
+}
+
+// A jwtAlg describes a signature algorithm tokens may be signed with.
+type jwtAlg struct {
+	kty   string      // type of key, as in JSON Web Keys
+	hash  crypto.Hash // digest signed, if any
+	pss   bool        // RSASSA-PSS rather than PKCS #1 v1.5
+	curve string      // name of the curve of ECDSA keys
+}
+
+// The signature algorithms accepted, from section 3.1 of RFC 7518 and
+// section 3.1 of RFC 8037. Each ties the key to a particular type, and the
+// curve of ECDSA keys to the digest.
+var jwtAlgs = map[string]jwtAlg{
+	"RS256": {kty: "RSA", hash: crypto.SHA256},
+	"RS384": {kty: "RSA", hash: crypto.SHA384},
+	"RS512": {kty: "RSA", hash: crypto.SHA512},
+	"PS256": {kty: "RSA", hash: crypto.SHA256, pss: true},
+	"PS384": {kty: "RSA", hash: crypto.SHA384, pss: true},
+	"PS512": {kty: "RSA", hash: crypto.SHA512, pss: true},
+	"ES256": {kty: "EC", hash: crypto.SHA256, curve: "P-256"},
+	"ES384": {kty: "EC", hash: crypto.SHA384, curve: "P-384"},
+	"ES512": {kty: "EC", hash: crypto.SHA512, curve: "P-521"},
+	"EdDSA": {kty: "OKP"},
+}
+
+// verifyJWT checks a token's signature.
+func verifyJWT(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	a, known := jwtAlgs[alg]
+	if !known {
+		return fmt.Errorf("relay: unsupported algorithm %q", alg)
+	}
+
+	var digest []byte
+	if a.hash != 0 {
+		h := a.hash.New()
+		h.Write([]byte(signed))
+		digest = h.Sum(nil)
+	}
+
+	var ok bool
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch {
+		case a.kty != "RSA":
+		case a.pss:
+			opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+			ok = rsa.VerifyPSS(key, a.hash, digest, sig, opts) == nil
+		default:
+			ok = rsa.VerifyPKCS1v15(key, a.hash, digest, sig) == nil
+		}
+
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if a.kty == "EC" && key.Curve.Params().Name == a.curve && len(sig) == 2*size {
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			ok = ecdsa.Verify(key, digest, r, s)
+		}
+
+	case ed25519.PublicKey:
+		ok = a.kty == "OKP" && ed25519.Verify(key, []byte(signed), sig)
+	}
+
+	if !ok {
+		return errors.New("relay: invalid signature")
+	}
+	return nil
+}
+
+func decodeSegment(s string, dst interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return errors.New("relay: malformed token")
+	}
+	if err := json.Unmarshal(buf, dst); err != nil {
+		return errors.New("relay: malformed token")
+	}
+	return nil
+}
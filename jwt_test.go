@@ -0,0 +1,214 @@
+package relay_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+// signJWT creates a token signed by key. The digest is picked by hash,
+// regardless of alg, so that mismatched algorithms can be tested.
+func signJWT(t *testing.T, alg string, hash crypto.Hash, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	t.Helper()
+
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+
+	var sig []byte
+	var err error
+
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(signed))
+
+	case *ecdsa.PrivateKey:
+		h := hash.New()
+		h.Write([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+
+	default:
+		h := hash.New()
+		h.Write([]byte(signed))
+		var opts crypto.SignerOpts = hash
+		if alg[0] == 'P' {
+			opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash}
+		}
+		sig, err = key.Sign(rand.Reader, h.Sum(nil), opts)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWTRequiresExpiry(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	v := &relay.JWTValidator{Keys: map[string]crypto.PublicKey{"k": key.Public()}}
+
+	token := signJWT(t, "ES256", crypto.SHA256, key, "k", map[string]interface{}{"sub": "alice"})
+
+	if _, err := v.Validate(context.Background(), token); err == nil {
+		t.Errorf("token without exp was accepted")
+	}
+
+	v.AllowNoExpiry = true
+	if _, err := v.Validate(context.Background(), token); err != nil {
+		t.Errorf("token without exp rejected despite AllowNoExpiry: %v", err)
+	}
+}
+
+func TestJWTAlgorithms(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p521, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		alg  string
+		hash crypto.Hash
+		key  crypto.Signer
+		ok   bool
+	}{
+		{"ES256", crypto.SHA256, p256, true},
+		{"ES512", crypto.SHA512, p521, true},
+		{"RS256", crypto.SHA256, rsaKey, true},
+		{"PS384", crypto.SHA384, rsaKey, true},
+		{"EdDSA", 0, edKey, true},
+
+		// The curve must match the algorithm.
+		{"ES512", crypto.SHA512, p256, false},
+		{"ES256", crypto.SHA256, p521, false},
+
+		// Only the exact names are accepted.
+		{"ES256K", crypto.SHA256, p256, false},
+		{"RSA256", crypto.SHA256, rsaKey, false},
+		{"rs256", crypto.SHA256, rsaKey, false},
+		{"none", crypto.SHA256, rsaKey, false},
+
+		// The key type must match the algorithm.
+		{"PS256", crypto.SHA256, p256, false},
+		{"ES256", crypto.SHA256, rsaKey, false},
+	}
+
+	for _, tt := range tests {
+		v := &relay.JWTValidator{Keys: map[string]crypto.PublicKey{"k": tt.key.Public()}}
+		token := signJWT(t, tt.alg, tt.hash, tt.key, "k", validClaims())
+
+		_, err := v.Validate(context.Background(), token)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s with a %T: got error %v, want ok=%t", tt.alg, tt.key, err, tt.ok)
+		}
+	}
+}
+
+func TestJWTFetchOutsideLock(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	pub := key.PublicKey
+
+	enc := base64.RawURLEncoding
+	set := fmt.Sprintf(`{"keys":[{"kty":"EC","crv":"P-256","kid":"k","x":%q,"y":%q}]}`,
+		enc.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+		enc.EncodeToString(pub.Y.FillBytes(make([]byte, 32))))
+
+	stall := make(chan struct{})
+	stalled := make(chan struct{}, 1)
+	first := true
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !first {
+			stalled <- struct{}{}
+			<-stall
+		}
+		first = false
+		fmt.Fprint(w, set)
+	}))
+	defer s.Close()
+	defer close(stall)
+
+	// Keys go stale at once, so every token has them fetched again.
+	v := &relay.JWTValidator{JWKSURL: s.URL, CacheTTL: time.Nanosecond}
+	token := signJWT(t, "ES256", crypto.SHA256, key, "k", validClaims())
+
+	if _, err := v.Validate(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+
+	// Have one token wait for the issuer...
+	go v.Validate(context.Background(), token)
+	<-stalled
+
+	// ...while another is validated using the keys already known.
+	done := make(chan error, 1)
+	go func() {
+		_, err := v.Validate(context.Background(), token)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("validation waited for a key fetch in progress")
+	}
+}
+
+func TestJWTFetchBackoff(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	var mu sync.Mutex
+	var fetches int
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	// While the issuer is down, tokens are rejected without each of them
+	// asking it for keys again.
+	v := &relay.JWTValidator{JWKSURL: s.URL}
+	for i := 0; i < 5; i++ {
+		token := signJWT(t, "ES256", crypto.SHA256, key, fmt.Sprint("k", i), validClaims())
+		if _, err := v.Validate(context.Background(), token); err == nil {
+			t.Fatal("token accepted without keys")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fetches != 1 {
+		t.Fatalf("keys fetched %d times, want 1", fetches)
+	}
+}
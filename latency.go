@@ -0,0 +1,213 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// ErrResponseTimeout is returned for requests whose upstream server didn't
+// respond within the time allowed by a LatencyRule.
+var ErrResponseTimeout = errors.New("relay: upstream server took too long to respond")
+
+// ErrBodyTimeout is returned when reading a response body from an upstream
+// server takes longer than a LatencyRule or the Transport allows.
+var ErrBodyTimeout = errors.New("relay: upstream server took too long to send the response body")
+
+// A LatencyRule sets limits on how long upstream servers may take to respond
+// to some requests. Times are measured from when the request is handed to
+// RoundTrip until its response header has been received, so they include
+// connecting and sending the request body, but not reading the response
+// body, which is limited separately.
+type LatencyRule struct {
+	// Requests the rule applies to. If nil, all requests match.
+	Match *Match
+
+	// If positive, requests whose response takes longer than this are
+	// aborted, and answered with "504 Gateway Timeout".
+	Timeout time.Duration
+
+	// If positive, how long relaying the response body may take as a whole,
+	// and how long the upstream server may go without sending any of it,
+	// respectively. Bodies running late are cut short by canceling the
+	// request's context, such that a RoundTrip function ignoring it isn't
+	// interrupted until it delivers more of the body. Long downloads are
+	// best limited by IdleTimeout alone, which only catches silent servers.
+	BodyTimeout time.Duration
+	IdleTimeout time.Duration
+
+	// If positive, responses taking longer than this (and requests timing
+	// out) are reported through Proxy.OnSlowResponse and the "upstream.slow"
+	// counter.
+	Slow time.Duration
+}
+
+// latencyRule returns the first of p.Latency matching a request, if any.
+func (p *Proxy) latencyRule(s *Session, req *heat.Request) *LatencyRule {
+	for i := range p.Latency {
+		if r := &p.Latency[i]; r.Match.Request(s, req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// sendTimed is like send, but enforces and reports on the response times
+// set by the first of p.Latency matching the request.
+func (p *Proxy) sendTimed(ctx context.Context, s *Session, req *heat.Request) (*heat.Response, error) {
+	r := p.latencyRule(s, req)
+	if r == nil {
+		return p.send(ctx, req)
+	}
+
+	clock := p.clock()
+	start := clock.Now()
+
+	var cancel context.CancelFunc
+	if r.BodyTimeout > 0 || r.IdleTimeout > 0 {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	var expired func() bool
+	if r.Timeout > 0 {
+		ctx, expired = responseDeadline(ctx, clock, r.Timeout)
+	}
+
+	resp, err := p.send(ctx, req)
+
+	// The deadline may pass just as the response arrives, in which case
+	// the connection has already been torn down.
+	if expired != nil && expired() {
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+		resp, err = nil, ErrResponseTimeout
+		p.count("upstream.timeout", 1)
+	}
+
+	if d := clock.Now().Sub(start); r.Slow > 0 && d > r.Slow {
+		p.count("upstream.slow", 1)
+		if p.OnSlowResponse != nil {
+			p.OnSlowResponse(s, req, d)
+		}
+	}
+
+	if cancel != nil {
+		if resp != nil && resp.Body != nil && resp.Status != 101 {
+			resp.Body = p.bodyDeadline(resp.Body, r, cancel)
+		} else if err != nil {
+			cancel()
+		}
+	}
+
+	return resp, err
+}
+
+// bodyDeadline enforces a rule's body timeouts on a response body, calling
+// cancel to interrupt it when one passes.
+func (p *Proxy) bodyDeadline(body io.ReadCloser, r *LatencyRule, cancel func()) io.ReadCloser {
+	b := &deadlineBody{ReadCloser: body, clock: p.clock(), idle: r.IdleTimeout}
+	b.expire = func() {
+		b.mu.Lock()
+		expired := !b.done && !b.expired
+		b.expired = true
+		b.mu.Unlock()
+
+		if expired {
+			p.count("upstream.body_timeout", 1)
+			cancel()
+		}
+	}
+
+	if r.BodyTimeout > 0 {
+		b.total = b.clock.AfterFunc(r.BodyTimeout, b.expire)
+	}
+
+	return b
+}
+
+// The deadlineBody type cuts a response body short once it has taken too
+// long to arrive.
+type deadlineBody struct {
+	io.ReadCloser
+	clock  Clock
+	idle   time.Duration
+	expire func()
+
+	mu         sync.Mutex
+	total, gap Timer
+	expired    bool
+	done       bool
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	// Only time spent waiting for the upstream server counts as idle, not
+	// time spent relaying what it sent.
+	b.mu.Lock()
+	if b.idle > 0 && !b.done && !b.expired {
+		b.gap = b.clock.AfterFunc(b.idle, b.expire)
+	}
+	b.mu.Unlock()
+
+	n, err := b.ReadCloser.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.gap != nil {
+		b.gap.Stop()
+		b.gap = nil
+	}
+
+	if b.expired {
+		return n, ErrBodyTimeout
+	}
+	if err != nil {
+		b.stop()
+	}
+
+	return n, err
+}
+
+func (b *deadlineBody) Close() error {
+	b.mu.Lock()
+	b.stop()
+	b.mu.Unlock()
+	return b.ReadCloser.Close()
+}
+
+// stop stops the body's timers, as it's no longer being read.
+func (b *deadlineBody) stop() {
+	b.done = true
+	if b.total != nil {
+		b.total.Stop()
+	}
+	if b.gap != nil {
+		b.gap.Stop()
+	}
+}
+
+// responseDeadline derives a context from ctx which is canceled once d has
+// passed, unless the returned function is called first. That function
+// reports whether the deadline had already passed.
+func responseDeadline(ctx context.Context, clock Clock, d time.Duration) (context.Context, func() bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &clockContext{Context: ctx}
+	if _, ok := clock.(realClock); ok {
+		c.deadline = clock.Now().Add(d)
+	}
+
+	t := clock.AfterFunc(d, func() {
+		atomic.StoreInt32(&c.expired, 1)
+		cancel()
+	})
+
+	return c, func() bool {
+		return !t.Stop()
+	}
+}
@@ -0,0 +1,178 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+	"github.com/erkl/relay/relaytest"
+)
+
+func TestLatencyRules(t *testing.T) {
+	arrived := make(chan string)
+	release := make(chan struct{})
+	defer close(release)
+
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		arrived <- req.URL.Path
+		<-release
+		if req.URL.Path == "/hang" {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	clock := relaytest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	m := new(counters)
+	slow := make(chan time.Duration, 2)
+
+	p := &relay.Proxy{
+		Clock:   clock,
+		Metrics: m,
+		Latency: []relay.LatencyRule{
+			{Timeout: 10 * time.Second, Slow: 2 * time.Second},
+		},
+		OnSlowResponse: func(s *relay.Session, req *heat.Request, d time.Duration) {
+			slow <- d
+		},
+	}
+
+	get := func(path string, wait time.Duration) int {
+		t.Helper()
+
+		conn := serve(t, p)
+		io.WriteString(conn, "GET http://"+addr+path+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+
+		select {
+		case <-arrived:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: request never reached the upstream server", path)
+		}
+		clock.Advance(wait)
+		if path != "/hang" {
+			release <- struct{}{}
+		}
+
+		return readFinal(t, conn, bufio.NewReader(conn)).StatusCode
+	}
+
+	// Slow responses are reported, but still delivered.
+	if status := get("/late", 3*time.Second); status != 200 {
+		t.Errorf("slow response got status %d, want 200", status)
+	}
+	if d := <-slow; d != 3*time.Second {
+		t.Errorf("slow response took %v, want 3s", d)
+	}
+
+	// Responses which don't arrive in time are replaced with a 504.
+	if status := get("/hang", 10*time.Second); status != 504 {
+		t.Errorf("hung request got status %d, want 504", status)
+	}
+	if d := <-slow; d != 10*time.Second {
+		t.Errorf("timed out response took %v, want 10s", d)
+	}
+
+	if n := m.get("upstream.slow"); n != 2 {
+		t.Errorf("upstream.slow: got %d, want 2", n)
+	}
+	if n := m.get("upstream.timeout"); n != 1 {
+		t.Errorf("upstream.timeout: got %d, want 1", n)
+	}
+}
+
+func TestLatencyBodyTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// Only the last body is ever completed.
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello")
+		if req.URL.Path != "/idle/ok" {
+			<-stop
+			return
+		}
+		<-release
+		io.WriteString(conn, "world")
+	})
+
+	clock := relaytest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	m := new(counters)
+
+	idle, err := relay.ParseMatch("path=/idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &relay.Proxy{
+		Clock:   clock,
+		Metrics: m,
+		Latency: []relay.LatencyRule{
+			{Match: idle, IdleTimeout: 5 * time.Second},
+			{BodyTimeout: 10 * time.Second},
+		},
+	}
+
+	get := func(path string) *http.Response {
+		t.Helper()
+
+		conn := serve(t, p)
+		io.WriteString(conn, "GET http://"+addr+path+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+		if resp.StatusCode != 200 {
+			t.Fatalf("%s: got status %d", path, resp.StatusCode)
+		}
+
+		buf := make([]byte, 5)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("%s: got %q, %v", path, buf, err)
+		}
+		return resp
+	}
+
+	// The body's whole transfer is limited. Its timer is running by the time
+	// the header arrives.
+	resp := get("/total")
+	clock.Advance(10 * time.Second)
+	if rest, err := io.ReadAll(resp.Body); err == nil || len(rest) != 0 {
+		t.Errorf("got %q, %v after the body timed out", rest, err)
+	}
+
+	// Gaps in the body's transfer are limited, but long transfers aren't.
+	// Whether the proxy is waiting for the rest of the body yet isn't known,
+	// so the clock is advanced until it gives up.
+	resp = get("/idle")
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				clock.Advance(5 * time.Second)
+			}
+		}
+	}()
+	rest, err := io.ReadAll(resp.Body)
+	close(done)
+	if err == nil || len(rest) != 0 {
+		t.Errorf("got %q, %v after the body idled", rest, err)
+	}
+
+	resp = get("/idle/ok")
+	clock.Advance(4 * time.Second)
+	release <- struct{}{}
+	if rest, err := io.ReadAll(resp.Body); err != nil || string(rest) != "world" {
+		t.Errorf("got %q, %v for a body which kept coming", rest, err)
+	}
+
+	if n := m.get("upstream.body_timeout"); n != 2 {
+		t.Errorf("upstream.body_timeout: got %d, want 2", n)
+	}
+}
@@ -0,0 +1,67 @@
+package relay
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	"github.com/erkl/heat"
+)
+
+// A Metrics value receives counters from a proxy. Implementations must be
+// safe for concurrent use.
+type Metrics interface {
+	Add(name string, delta int64)
+}
+
+// count increments one of p's counters, if p.Metrics is set.
+func (p *Proxy) count(name string, delta int64) {
+	if p.Metrics != nil {
+		p.Metrics.Add(name, delta)
+	}
+}
+
+// Shutdown makes the proxy stop serving new requests. Requests received after
+// the call are answered with "503 Service Unavailable", after which their
+// connections are closed. Requests already in progress are unaffected.
+func (p *Proxy) Shutdown() {
+	atomic.StoreInt32(&p.draining, 1)
+}
+
+// admit decides whether the proxy has capacity to serve another request in
+// a session. If so, it returns nil, and the caller must call p.done once the
+// request has been served. Otherwise it returns a response with which the
+// request should be rejected.
+func (p *Proxy) admit(s *Session) *heat.Response {
+	var reason string
+
+	switch {
+	case atomic.LoadInt32(&p.draining) != 0:
+		reason = "draining"
+	case s.shed:
+		reason = "conns"
+	default:
+		n := atomic.AddInt64(&p.requests, 1)
+		if p.MaxRequests <= 0 || n <= int64(p.MaxRequests) {
+			return nil
+		}
+		atomic.AddInt64(&p.requests, -1)
+		reason = "requests"
+	}
+
+	p.count("shed."+reason, 1)
+
+	retry := int64(p.RetryAfter.Seconds())
+	if retry < 1 {
+		retry = 1
+	}
+
+	resp := statusResponse(503, "The proxy is overloaded, please try again later.")
+	resp.Fields.Set("Retry-After", strconv.FormatInt(retry, 10))
+
+	return resp
+}
+
+// done marks a request admitted by p.admit as finished.
+func (p *Proxy) done() {
+	atomic.AddInt64(&p.requests, -1)
+}
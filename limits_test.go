@@ -0,0 +1,97 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+// The counters type collects metrics in memory.
+type counters struct {
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+func (c *counters) Add(name string, delta int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]int64)
+	}
+	c.m[name] += delta
+}
+
+func (c *counters) get(name string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.m[name]
+}
+
+// checkShed checks that resp rejects a request for lack of capacity.
+func checkShed(t *testing.T, resp *http.Response, retry string) {
+	t.Helper()
+
+	if resp.StatusCode != 503 {
+		t.Fatalf("got status %d, want 503", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != retry {
+		t.Errorf("Retry-After: got %q, want %q", got, retry)
+	}
+	if !resp.Close {
+		t.Errorf("connection kept open after shedding a request")
+	}
+}
+
+func TestShutdownSheds(t *testing.T) {
+	m := new(counters)
+	p := &relay.Proxy{RoundTrip: roundTrip, Metrics: m}
+	p.Shutdown()
+
+	conn := serve(t, p)
+	io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	checkShed(t, readFinal(t, conn, bufio.NewReader(conn)), "1")
+	if n := m.get("shed.draining"); n != 1 {
+		t.Errorf("shed.draining: got %d, want 1", n)
+	}
+}
+
+func TestMaxRequestsSheds(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	m := new(counters)
+	p := &relay.Proxy{RoundTrip: roundTrip, MaxRequests: 1, RetryAfter: 30 * time.Second, Metrics: m}
+	req := "GET http://" + addr + "/ HTTP/1.1\r\nHost: " + addr + "\r\n\r\n"
+
+	// Occupy the only slot...
+	first := serve(t, p)
+	unblock := sync.OnceFunc(func() { close(release) })
+	t.Cleanup(unblock)
+
+	io.WriteString(first, req)
+	<-arrived
+
+	// ...so that a second request is turned away.
+	second := serve(t, p)
+	io.WriteString(second, req)
+	checkShed(t, readFinal(t, second, bufio.NewReader(second)), "30")
+
+	unblock()
+	if resp := readFinal(t, first, bufio.NewReader(first)); resp.StatusCode != 200 {
+		t.Errorf("admitted request got status %d", resp.StatusCode)
+	}
+	if n := m.get("shed.requests"); n != 1 {
+		t.Errorf("shed.requests: got %d, want 1", n)
+	}
+}
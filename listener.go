@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor passed on by systemd, or by Handoff.
+const firstListenFD = 3
+
+// Listen listens on a TCP address ("host:port"), or on a UNIX domain socket
+// ("unix:/path/to/socket").
+func Listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return net.Listen("unix", strings.TrimPrefix(addr[5:], "//"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// ActivationListeners returns listeners for the sockets passed to the process
+// through systemd's socket activation protocol (LISTEN_PID, LISTEN_FDS and
+// LISTEN_FDNAMES), in order. If the process wasn't socket activated, both
+// return values are nil. The environment variables are unset afterwards, so
+// they aren't inherited by child processes.
+func ActivationListeners() ([]net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("relay: invalid LISTEN_FDS")
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	return fileListeners(n, names)
+}
+
+// InheritedListeners returns the listeners passed to the process by a parent
+// calling Handoff. If there are none, both return values are nil.
+func InheritedListeners() ([]net.Listener, error) {
+	s := os.Getenv("RELAY_LISTEN_FDS")
+	if s == "" {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("relay: invalid RELAY_LISTEN_FDS")
+	}
+
+	os.Unsetenv("RELAY_LISTEN_FDS")
+
+	return fileListeners(n, nil)
+}
+
+// fileListeners creates listeners for n consecutive inherited sockets.
+func fileListeners(n int, names []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(firstListenFD+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		// The net package duplicates the descriptor, so the original can
+		// be closed straight away.
+		f := os.NewFile(uintptr(firstListenFD+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("relay: inherited listener %s: %s", name, err)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	return listeners, nil
+}
+
+// Handoff starts a new process, running the executable at path with args,
+// which inherits the given listening sockets. The new process can recover
+// them (in order) by calling InheritedListeners.
+//
+// This allows a daemon to be upgraded without dropping connections: once the
+// new process is up, the old one can stop accepting connections, call
+// Shutdown, and exit when its remaining connections are done.
+func Handoff(path string, args []string, listeners ...net.Listener) (*os.Process, error) {
+	var files []*os.File
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, l := range listeners {
+		fl, ok := l.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return nil, fmt.Errorf("relay: can't hand off listener of type %T", l)
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), "RELAY_LISTEN_FDS="+strconv.Itoa(len(files)))
+	cmd.ExtraFiles = files
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return cmd.Process, nil
+}
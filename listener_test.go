@@ -0,0 +1,128 @@
+package relay_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+// TestListenerHelperProcess isn't a real test. It's run as a child process by
+// the tests below, recovering the listening socket passed to it, and greeting
+// the first client connecting to it.
+func TestListenerHelperProcess(t *testing.T) {
+	var listeners []net.Listener
+	var err error
+
+	switch os.Getenv("RELAY_TEST_LISTENER") {
+	case "activation":
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		listeners, err = relay.ActivationListeners()
+	case "handoff":
+		listeners, err = relay.InheritedListeners()
+	default:
+		return
+	}
+
+	if err != nil || len(listeners) != 1 {
+		os.Exit(2)
+	}
+
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		os.Exit(3)
+	}
+
+	io.WriteString(conn, "hello from "+strconv.Itoa(os.Getpid()))
+	conn.Close()
+	os.Exit(0)
+}
+
+// checkInherited checks that the child process proc is serving l.
+func checkInherited(t *testing.T, l net.Listener, proc *os.Process) {
+	t.Helper()
+
+	// The parent's copy isn't needed to keep the socket open.
+	l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	buf, _ := io.ReadAll(conn)
+
+	if want := "hello from " + strconv.Itoa(proc.Pid); string(buf) != want {
+		t.Errorf("got %q, want %q", buf, want)
+	}
+	if state, err := proc.Wait(); err != nil || !state.Success() {
+		t.Errorf("child process failed: %v %v", state, err)
+	}
+}
+
+func TestActivationListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestListenerHelperProcess$")
+	cmd.Env = append(os.Environ(), "RELAY_TEST_LISTENER=activation", "LISTEN_FDS=1", "LISTEN_FDNAMES=web")
+	cmd.ExtraFiles = []*os.File{f}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkInherited(t, l, cmd.Process)
+}
+
+func TestActivationListenersOtherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+
+	if ls, err := relay.ActivationListeners(); ls != nil || err != nil {
+		t.Errorf("got %v, %v for sockets meant for another process", ls, err)
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("RELAY_TEST_LISTENER", "handoff")
+	proc, err := relay.Handoff(os.Args[0], []string{"-test.run=^TestListenerHelperProcess$"}, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkInherited(t, l, proc)
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.sock")
+
+	l, err := relay.Listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if l.Addr().Network() != "unix" || l.Addr().String() != path {
+		t.Errorf("listening on %s %s, want unix %s", l.Addr().Network(), l.Addr(), path)
+	}
+}
@@ -0,0 +1,411 @@
+package relay
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// A Matcher describes a set of requests. A request matches if it satisfies
+// all non-empty fields. Within each list field, a single match suffices.
+type Matcher struct {
+	// Glob patterns (see path.Match) for the destination hostname.
+	Hosts []string
+
+	// Prefix the request URI must begin with, and a regular expression it
+	// must match.
+	PathPrefix string
+	Path       string
+
+	// Request methods.
+	Methods []string
+
+	// Header field conditions.
+	Headers []HeaderMatcher
+
+	// Media types for the request's Content-Type header field, optionally
+	// with a wildcard subtype ("text/*").
+	ContentTypes []string
+
+	// IP addresses or CIDR blocks the client's address must belong to.
+	Clients []string
+
+	// Glob patterns (see path.Match) for the name of a GraphQL operation in
+	// the request, or "anonymous". Operations are only detected when
+	// Proxy.GraphQL is set.
+	Operations []string
+}
+
+// A HeaderMatcher requires a header field to be present, and if Pattern is
+// non-empty, for its value to match that regular expression.
+type HeaderMatcher struct {
+	Name    string
+	Pattern string
+}
+
+// A Match is a compiled Matcher, ready to be evaluated. It's used by the
+// proxy's various rule and policy types.
+type Match struct {
+	conds []func(s *Session, req *heat.Request) bool
+	hosts []string
+	nets  []*net.IPNet
+	expr  string
+}
+
+// Compile validates a Matcher and prepares it for evaluation.
+func (m *Matcher) Compile() (*Match, error) {
+	var c = &Match{expr: m.String()}
+
+	// Checks are added roughly in order of increasing cost.
+	if len(m.Methods) > 0 {
+		methods := append([]string(nil), m.Methods...)
+		c.add(func(s *Session, req *heat.Request) bool {
+			return contains(methods, req.Method)
+		})
+	}
+
+	if len(m.Hosts) > 0 {
+		for _, h := range m.Hosts {
+			if _, err := path.Match(h, ""); err != nil {
+				return nil, fmt.Errorf("relay: invalid host pattern %q", h)
+			}
+		}
+
+		c.hosts = append([]string(nil), m.Hosts...)
+		c.add(func(s *Session, req *heat.Request) bool {
+			return c.host(req.Remote)
+		})
+	}
+
+	if m.PathPrefix != "" {
+		prefix := m.PathPrefix
+		c.add(func(s *Session, req *heat.Request) bool {
+			return strings.HasPrefix(req.URI, prefix)
+		})
+	}
+
+	if len(m.Clients) > 0 {
+		for _, client := range m.Clients {
+			n, err := parseNet(client)
+			if err != nil {
+				return nil, err
+			}
+			c.nets = append(c.nets, n)
+		}
+
+		c.add(func(s *Session, req *heat.Request) bool {
+			return c.client(s)
+		})
+	}
+
+	if len(m.ContentTypes) > 0 {
+		types := append([]string(nil), m.ContentTypes...)
+		c.add(func(s *Session, req *heat.Request) bool {
+			return matchContentType(types, req.Fields)
+		})
+	}
+
+	for _, h := range m.Headers {
+		name := h.Name
+
+		if h.Pattern == "" {
+			c.add(func(s *Session, req *heat.Request) bool {
+				_, ok := fieldValue(req.Fields, name)
+				return ok
+			})
+			continue
+		}
+
+		re, err := regexp.Compile(h.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("relay: header %s: %s", name, err)
+		}
+
+		c.add(func(s *Session, req *heat.Request) bool {
+			for _, f := range req.Fields {
+				if f.Is(name) && re.MatchString(f.Value) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+
+	if len(m.Operations) > 0 {
+		for _, op := range m.Operations {
+			if _, err := path.Match(op, ""); err != nil {
+				return nil, fmt.Errorf("relay: invalid operation pattern %q", op)
+			}
+		}
+
+		patterns := append([]string(nil), m.Operations...)
+		c.add(func(s *Session, req *heat.Request) bool {
+			if s == nil {
+				return false
+			}
+			for _, op := range s.GraphQL() {
+				name := op.Name
+				if name == "" {
+					name = "anonymous"
+				}
+				for _, pattern := range patterns {
+					if ok, _ := path.Match(pattern, name); ok {
+						return true
+					}
+				}
+			}
+			return false
+		})
+	}
+
+	if m.Path != "" {
+		re, err := regexp.Compile(m.Path)
+		if err != nil {
+			return nil, fmt.Errorf("relay: path: %s", err)
+		}
+
+		c.add(func(s *Session, req *heat.Request) bool {
+			return re.MatchString(req.URI)
+		})
+	}
+
+	return c, nil
+}
+
+// String describes the Matcher as a list of terms, in the syntax accepted by
+// ParseMatch.
+func (m *Matcher) String() string {
+	var terms []string
+
+	if len(m.Hosts) > 0 {
+		terms = append(terms, "host="+strings.Join(m.Hosts, ","))
+	}
+	if m.PathPrefix != "" {
+		terms = append(terms, "path="+m.PathPrefix)
+	}
+	if m.Path != "" {
+		terms = append(terms, "path~"+m.Path)
+	}
+	if len(m.Methods) > 0 {
+		terms = append(terms, "method="+strings.Join(m.Methods, ","))
+	}
+	for _, h := range m.Headers {
+		if h.Pattern == "" {
+			terms = append(terms, "header:"+h.Name)
+		} else {
+			terms = append(terms, "header:"+h.Name+"~"+h.Pattern)
+		}
+	}
+	if len(m.ContentTypes) > 0 {
+		terms = append(terms, "type="+strings.Join(m.ContentTypes, ","))
+	}
+	if len(m.Clients) > 0 {
+		terms = append(terms, "client="+strings.Join(m.Clients, ","))
+	}
+	if len(m.Operations) > 0 {
+		terms = append(terms, "op="+strings.Join(m.Operations, ","))
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// String returns the expression the Match was compiled from, in the syntax
+// accepted by ParseMatch. A nil Match yields the empty string.
+func (c *Match) String() string {
+	if c == nil {
+		return ""
+	}
+	return c.expr
+}
+
+func (c *Match) add(cond func(s *Session, req *heat.Request) bool) {
+	c.conds = append(c.conds, cond)
+}
+
+// Request reports whether a request, made in session s, matches. A nil
+// Match matches all requests. If s is nil, client conditions never match.
+func (c *Match) Request(s *Session, req *heat.Request) bool {
+	if c == nil {
+		return true
+	}
+
+	for _, cond := range c.conds {
+		if !cond(s, req) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Connect reports whether a CONNECT tunnel to addr, requested in session s,
+// matches. Only host and client conditions are considered. Its signature
+// fits Proxy.Intercept.
+func (c *Match) Connect(s *Session, addr string) bool {
+	if c == nil {
+		return true
+	}
+
+	if len(c.hosts) > 0 && !c.host(addr) {
+		return false
+	}
+
+	if len(c.nets) > 0 && !c.client(s) {
+		return false
+	}
+
+	return true
+}
+
+func (c *Match) host(addr string) bool {
+	host := strings.ToLower(hostname(addr))
+
+	for _, pattern := range c.hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Match) client(s *Session) bool {
+	if s == nil || s.ClientAddr == nil {
+		return false
+	}
+
+	ip := net.ParseIP(hostname(s.ClientAddr.String()))
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range c.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseMatch compiles a matcher from a space-separated list of terms, all
+// of which must be satisfied:
+//
+//	host=<glob>[,<glob>...]      destination hostname
+//	path=<prefix>                request URI prefix
+//	path~<regexp>                request URI regular expression
+//	method=<method>[,<method>...]
+//	header:<name>                header field presence
+//	header:<name>~<regexp>       header field value
+//	type=<media type>[,...]      request content type
+//	client=<ip or cidr>[,...]    client address
+//	op=<glob>[,<glob>...]        GraphQL operation name
+//
+// An empty expression matches all requests.
+func ParseMatch(expr string) (*Match, error) {
+	m, err := parseMatcher(strings.Fields(expr))
+	if err != nil {
+		return nil, err
+	}
+	return m.Compile()
+}
+
+func parseMatcher(terms []string) (*Matcher, error) {
+	var m Matcher
+
+	for _, term := range terms {
+		if !parseMatchTerm(&m, term) {
+			return nil, fmt.Errorf("relay: invalid match term %q", term)
+		}
+	}
+
+	return &m, nil
+}
+
+// parseMatchTerm adds a single term to m, reporting whether it was valid.
+func parseMatchTerm(m *Matcher, term string) bool {
+	switch {
+	case strings.HasPrefix(term, "host="):
+		m.Hosts = append(m.Hosts, strings.Split(strings.ToLower(term[5:]), ",")...)
+	case strings.HasPrefix(term, "path="):
+		m.PathPrefix = term[5:]
+	case strings.HasPrefix(term, "path~"):
+		m.Path = term[5:]
+	case strings.HasPrefix(term, "method="):
+		m.Methods = append(m.Methods, strings.Split(strings.ToUpper(term[7:]), ",")...)
+	case strings.HasPrefix(term, "type="):
+		m.ContentTypes = append(m.ContentTypes, strings.Split(strings.ToLower(term[5:]), ",")...)
+	case strings.HasPrefix(term, "client="):
+		m.Clients = append(m.Clients, strings.Split(term[7:], ",")...)
+	case strings.HasPrefix(term, "op="):
+		m.Operations = append(m.Operations, strings.Split(term[3:], ",")...)
+	case strings.HasPrefix(term, "header:"):
+		name, pattern := term[7:], ""
+		if i := strings.IndexByte(name, '~'); i >= 0 {
+			name, pattern = name[:i], name[i+1:]
+		}
+		if name == "" {
+			return false
+		}
+		m.Headers = append(m.Headers, HeaderMatcher{name, pattern})
+	default:
+		return false
+	}
+
+	return true
+}
+
+// matchContentType reports whether a message's media type is in a list.
+func matchContentType(types []string, fields heat.Fields) bool {
+	value, ok := fieldValue(fields, "Content-Type")
+	if !ok {
+		return false
+	}
+
+	mt, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range types {
+		if t == mt || strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseNet parses an IP address or CIDR block.
+func parseNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("relay: invalid IP address %q", s)
+	}
+
+	bits := 8 * len(ip)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
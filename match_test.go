@@ -0,0 +1,114 @@
+package relay_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func matchRequest(method, remote, uri string, fields ...string) *heat.Request {
+	req := heat.NewRequest(method, uri)
+	req.Remote = remote
+	for i := 0; i+1 < len(fields); i += 2 {
+		req.Fields.Add(fields[i], fields[i+1])
+	}
+	return req
+}
+
+func TestParseMatch(t *testing.T) {
+	s := &relay.Session{ClientAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5000}}
+
+	get := matchRequest("GET", "api.example.com:443", "/v1/users?id=7", "Accept", "application/json")
+	post := matchRequest("POST", "www.example.org:80", "/upload", "Content-Type", "Text/Plain; charset=utf-8", "X-Token", "abc123")
+
+	tests := []struct {
+		expr      string
+		get, post bool
+	}{
+		{"", true, true},
+		{"host=*.example.com", true, false},
+		{"host=WWW.EXAMPLE.ORG,nope", false, true},
+		{"path=/v1/", true, false},
+		{`path~^/v\d+/users\?`, true, false},
+		{"method=post,put", false, true},
+		{"header:accept", true, false},
+		{"header:X-Token~^[a-z]+[0-9]+$", false, true},
+		{"header:X-Token~^[0-9]+$", false, false},
+		{"type=text/*", false, true},
+		{"type=application/json", false, false},
+		{"client=10.0.0.0/8", true, true},
+		{"client=10.1.2.4,192.0.2.0/24", false, false},
+		{"method=GET host=api.example.com path=/v1/", true, false},
+		{"method=GET host=www.example.org", false, false},
+	}
+
+	for _, tt := range tests {
+		m, err := relay.ParseMatch(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := m.Request(s, get); got != tt.get {
+			t.Errorf("%q: matches GET request: %v, want %v", tt.expr, got, tt.get)
+		}
+		if got := m.Request(s, post); got != tt.post {
+			t.Errorf("%q: matches POST request: %v, want %v", tt.expr, got, tt.post)
+		}
+	}
+}
+
+func TestParseMatchErrors(t *testing.T) {
+	for _, expr := range []string{
+		"hostname=example.com",
+		"header:",
+		"header:X-A~(",
+		"path~[",
+		"host=[",
+		"client=10.0.0.300",
+		"client=10.0.0.0/33",
+	} {
+		if _, err := relay.ParseMatch(expr); err == nil {
+			t.Errorf("%q: no error", expr)
+		}
+	}
+}
+
+func TestMatchString(t *testing.T) {
+	expr := "host=*.example.com path=/api/ path~v[0-9] method=GET,HEAD header:X-A header:X-B~b+ type=text/* client=10.0.0.0/8 op=Get*"
+
+	m, err := relay.ParseMatch(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.String() != expr {
+		t.Errorf("got %q, want %q", m.String(), expr)
+	}
+
+	var none *relay.Match
+	if none.String() != "" || !none.Request(nil, matchRequest("GET", "example.com:80", "/")) {
+		t.Errorf("nil Match doesn't match everything")
+	}
+}
+
+func TestMatchConnect(t *testing.T) {
+	m, err := relay.ParseMatch("host=*.example.com client=10.0.0.0/8 method=POST path=/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inside := &relay.Session{ClientAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}}
+	outside := &relay.Session{ClientAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}}
+
+	// Only host and client conditions apply to tunnels.
+	if !m.Connect(inside, "www.example.com:443") {
+		t.Errorf("tunnel from inside to www.example.com doesn't match")
+	}
+	if m.Connect(inside, "example.org:443") {
+		t.Errorf("tunnel to example.org matches")
+	}
+	if m.Connect(outside, "www.example.com:443") || m.Connect(nil, "www.example.com:443") {
+		t.Errorf("tunnel from outside matches")
+	}
+}
@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/xo"
+)
+
+// Header fields never echoed back in responses to TRACE requests.
+var traceSkip = []string{
+	"Authorization",
+	"Cookie",
+	"Proxy-Authorization",
+}
+
+// maxForwards implements the Max-Forwards semantics of TRACE and OPTIONS
+// requests (section 5.1.2 of RFC 7231). It returns a non-nil response if the
+// request should be answered by the proxy itself.
+func (p *Proxy) maxForwards(s *Session, req *heat.Request) *heat.Response {
+	if req.Method == "TRACE" && p.DisableTrace {
+		p.decide(s, req, "", &DecisionRecord{Action: "deny", Rule: "DisableTrace"})
+		resp := statusResponse(405, "TRACE requests are not allowed.")
+		resp.Fields.Set("Allow", "GET, HEAD, POST, PUT, DELETE, CONNECT, OPTIONS, PATCH")
+		return resp
+	}
+
+	if req.Method != "TRACE" && req.Method != "OPTIONS" {
+		return nil
+	}
+
+	value, ok := fieldValue(req.Fields, "Max-Forwards")
+	if !ok {
+		return nil
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 31)
+	if err != nil {
+		return nil
+	}
+
+	if n > 0 {
+		req.Fields.Set("Max-Forwards", strconv.FormatUint(n-1, 10))
+		return nil
+	}
+
+	// We're the final recipient.
+	if req.Method == "OPTIONS" {
+		resp := heat.NewResponse(200, heat.ReasonPhrase(200))
+		resp.Fields.Set("Allow", "GET, HEAD, POST, PUT, DELETE, CONNECT, OPTIONS, TRACE, PATCH")
+		resp.Fields.Set("Content-Length", "0")
+		return resp
+	}
+
+	return traceResponse(req)
+}
+
+// traceResponse builds a response to a TRACE request, echoing its header.
+func traceResponse(req *heat.Request) *heat.Response {
+	echo := *req
+	echo.Fields = nil
+	echo.Body = nil
+
+	echo.Fields = append(echo.Fields, req.Fields...)
+	echo.Fields.Filter(func(f heat.Field) bool {
+		for _, name := range traceSkip {
+			if f.Is(name) {
+				return false
+			}
+		}
+		return true
+	})
+
+	var buf bytes.Buffer
+	w := xo.NewWriter(&buf, make([]byte, 4096))
+
+	if err := heat.WriteRequestHeader(w, &echo); err == nil {
+		w.Flush()
+	}
+
+	resp := heat.NewResponse(200, heat.ReasonPhrase(200))
+	resp.Fields.Set("Content-Type", "message/http")
+	resp.Fields.Set("Content-Length", strconv.Itoa(buf.Len()))
+	resp.Body = ioutil.NopCloser(&buf)
+
+	return resp
+}
@@ -0,0 +1,68 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+func TestMaxForwards(t *testing.T) {
+	seen := make(chan string, 2)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		seen <- req.Method + " " + req.Header.Get("Max-Forwards")
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nX-Upstream: yes\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	conn := serve(t, &relay.Proxy{})
+	r := bufio.NewReader(conn)
+
+	send := func(method, maxForwards string) *http.Response {
+		io.WriteString(conn, method+" http://"+addr+"/ HTTP/1.1\r\n"+
+			"Host: "+addr+"\r\n"+
+			"Max-Forwards: "+maxForwards+"\r\n"+
+			"Cookie: secret=1\r\n\r\n")
+		return readFinal(t, conn, r)
+	}
+
+	// Forwarded requests have Max-Forwards decremented.
+	for _, method := range []string{"OPTIONS", "TRACE"} {
+		resp := send(method, "2")
+		if resp.Header.Get("X-Upstream") != "yes" {
+			t.Errorf("%s with Max-Forwards 2 wasn't forwarded", method)
+		}
+		if got, want := <-seen, method+" 1"; got != want {
+			t.Errorf("upstream got %q, want %q", got, want)
+		}
+	}
+
+	// Requests are answered by the proxy once Max-Forwards reaches zero.
+	resp := send("OPTIONS", "0")
+	if resp.StatusCode != 200 || resp.Header.Get("X-Upstream") != "" || resp.Header.Get("Allow") == "" {
+		t.Errorf("OPTIONS with Max-Forwards 0: got status %d and header %v", resp.StatusCode, resp.Header)
+	}
+
+	resp = send("TRACE", "0")
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.Header.Get("Content-Type") != "message/http" || !strings.HasPrefix(string(body), "TRACE ") {
+		t.Errorf("TRACE with Max-Forwards 0: got %q", body)
+	}
+	if strings.Contains(string(body), "secret") {
+		t.Errorf("TRACE response echoes cookies: %q", body)
+	}
+}
+
+func TestDisableTrace(t *testing.T) {
+	conn := serve(t, &relay.Proxy{DisableTrace: true})
+	io.WriteString(conn, "TRACE http://example.com/ HTTP/1.1\r\nHost: example.com\r\nMax-Forwards: 0\r\n\r\n")
+
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+	if resp.StatusCode != 405 || strings.Contains(resp.Header.Get("Allow"), "TRACE") {
+		t.Errorf("got status %d allowing %q, want 405 without TRACE", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+}
@@ -0,0 +1,165 @@
+package relay
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+)
+
+// A MemoryCategory is a kind of memory accounted for by a MemoryBudget.
+type MemoryCategory int
+
+const (
+	// Buffers bodies are relayed through (see Proxy.BodyBuffer).
+	MemoryBuffers MemoryCategory = iota
+
+	// Bodies and messages captured by a FlowStore.
+	MemoryCaptures
+
+	// Certificates forged for tunnels, as kept by a DecisionCache.
+	MemoryCaches
+
+	// Spooled bodies (see Session.SpoolRequest), and bodies held while
+	// being scanned, which are kept in memory.
+	MemorySpools
+
+	memoryCategories
+)
+
+var memoryCategoryNames = [memoryCategories]string{"buffers", "captures", "caches", "spools"}
+
+func (c MemoryCategory) String() string {
+	if c < 0 || c >= memoryCategories {
+		return "unknown"
+	}
+	return memoryCategoryNames[c]
+}
+
+// A MemoryBudget accounts for the memory used by a proxy's buffers, captures,
+// caches and spools, and keeps it below configurable ceilings. What happens
+// when the ceiling of a category, or the total one, is reached depends on
+// the category:
+//
+//   - Bodies aren't relayed through buffers, as though Proxy.BodyBuffer
+//     was zero.
+//   - Response bodies stop being captured, and the oldest flows are
+//     evicted from the FlowStore.
+//   - Forged certificates aren't cached, and are forged again when needed.
+//   - Spooled bodies are written to temporary files.
+//
+// Only the memory held by data is accounted for, not that of the structures
+// around it, so the figures are approximate.
+//
+// A budget can be shared by several proxies, and by the FlowStore and
+// DecisionCache they use (see FlowStore.Memory and DecisionCache.Memory).
+// All methods are safe for concurrent use.
+type MemoryBudget struct {
+	// Ceiling on the memory used by all categories together, in bytes.
+	// Zero means no limit.
+	Total int64
+
+	// Ceilings per category, in bytes. Zero means no limit.
+	Buffers  int64
+	Captures int64
+	Caches   int64
+	Spools   int64
+
+	// If set, receives the bytes in use per category as "memory.buffers",
+	// "memory.captures", "memory.caches" and "memory.spools" (which go up
+	// and down), along with "memory.buffers.shed", "memory.captures.shed",
+	// "memory.caches.shed" and "memory.spools.spilled" counters.
+	Metrics Metrics
+
+	used  [memoryCategories]int64
+	total int64
+}
+
+// Usage returns the number of bytes used in a category.
+func (m *MemoryBudget) Usage(c MemoryCategory) int64 {
+	if c < 0 || c >= memoryCategories {
+		return 0
+	}
+	return atomic.LoadInt64(&m.used[c])
+}
+
+// TotalUsage returns the number of bytes used across all categories.
+func (m *MemoryBudget) TotalUsage() int64 {
+	return atomic.LoadInt64(&m.total)
+}
+
+func (m *MemoryBudget) limit(c MemoryCategory) int64 {
+	switch c {
+	case MemoryBuffers:
+		return m.Buffers
+	case MemoryCaptures:
+		return m.Captures
+	case MemoryCaches:
+		return m.Caches
+	case MemorySpools:
+		return m.Spools
+	}
+	return 0
+}
+
+// add accounts for n more bytes in use in a category, regardless of the
+// ceilings. A nil budget accounts for nothing.
+func (m *MemoryBudget) add(c MemoryCategory, n int64) {
+	if m == nil || n == 0 {
+		return
+	}
+	atomic.AddInt64(&m.used[c], n)
+	atomic.AddInt64(&m.total, n)
+	m.count("memory."+c.String(), n)
+}
+
+// release accounts for n bytes in a category no longer being used.
+func (m *MemoryBudget) release(c MemoryCategory, n int64) {
+	m.add(c, -n)
+}
+
+// reserve accounts for n more bytes in use in a category, unless that would
+// exceed one of the ceilings.
+func (m *MemoryBudget) reserve(c MemoryCategory, n int64) bool {
+	if m == nil {
+		return true
+	}
+
+	used := atomic.AddInt64(&m.used[c], n)
+	total := atomic.AddInt64(&m.total, n)
+
+	if (m.limit(c) > 0 && used > m.limit(c)) || (m.Total > 0 && total > m.Total) {
+		atomic.AddInt64(&m.used[c], -n)
+		atomic.AddInt64(&m.total, -n)
+		return false
+	}
+
+	m.count("memory."+c.String(), n)
+	return true
+}
+
+// over reports whether the memory used in a category, or in total, exceeds
+// its ceiling.
+func (m *MemoryBudget) over(c MemoryCategory) bool {
+	if m == nil {
+		return false
+	}
+	if limit := m.limit(c); limit > 0 && atomic.LoadInt64(&m.used[c]) > limit {
+		return true
+	}
+	return m.Total > 0 && atomic.LoadInt64(&m.total) > m.Total
+}
+
+func (m *MemoryBudget) count(name string, delta int64) {
+	if m != nil && m.Metrics != nil {
+		m.Metrics.Add(name, delta)
+	}
+}
+
+// certSize returns the number of bytes accounted for a certificate: the
+// size of its encoded chain.
+func certSize(cert *tls.Certificate) int64 {
+	var n int64
+	for _, der := range cert.Certificate {
+		n += int64(len(der))
+	}
+	return n
+}
@@ -0,0 +1,219 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+// waitUsage waits for the memory used in a category to drop to want,
+// failing the test if that takes more than a few seconds.
+func waitUsage(t *testing.T, budget *relay.MemoryBudget, c relay.MemoryCategory, want int64) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if budget.Usage(c) == want {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("%d bytes of %s in use, want %d", budget.Usage(c), c, want)
+}
+
+func TestMemoryBuffers(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello")
+	})
+
+	m := new(counters)
+	budget := &relay.MemoryBudget{Total: 1500, Metrics: m}
+	conn := serve(t, &relay.Proxy{BodyBuffer: 1024, Memory: budget})
+	r := bufio.NewReader(conn)
+
+	// Only the first of two buffers fits, but bodies are relayed either way.
+	for i := 0; i < 2; i++ {
+		io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		if body, _ := io.ReadAll(resp.Body); string(body) != "hello" {
+			t.Fatalf("got body %q", body)
+		}
+		waitUsage(t, budget, relay.MemoryBuffers, 0)
+
+		budget.Total = 500
+	}
+
+	if n := m.get("memory.buffers.shed"); n != 1 {
+		t.Errorf("memory.buffers.shed = %d, want 1", n)
+	}
+	if n := m.get("memory.buffers"); n != 0 {
+		t.Errorf("memory.buffers = %d, want 0", n)
+	}
+}
+
+func TestMemorySpools(t *testing.T) {
+	dir := t.TempDir()
+	m := new(counters)
+	budget := &relay.MemoryBudget{Spools: 50, Metrics: m}
+
+	type spooled struct {
+		size  int64
+		files int
+		usage int64
+	}
+	results := make(chan spooled, 1)
+
+	p := &relay.Proxy{
+		Memory:   budget,
+		SpoolDir: dir,
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			sp, err := s.SpoolRequest(req)
+			if err != nil {
+				t.Error(err)
+			}
+			files, _ := os.ReadDir(dir)
+			results <- spooled{sp.Size(), len(files), budget.Usage(relay.MemorySpools)}
+			return nil
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			io.ReadAll(req.Body)
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			return resp, nil
+		},
+	}
+
+	// Bodies are kept in memory while the budget allows, though well below
+	// SpoolMemory.
+	for _, tt := range []struct {
+		size int
+		want spooled
+	}{
+		{10, spooled{10, 0, 10}},
+		{100, spooled{100, 1, 0}},
+	} {
+		conn := serve(t, p)
+		io.WriteString(conn, "POST http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n"+
+			"Content-Length: "+strconv.Itoa(tt.size)+"\r\n\r\n"+strings.Repeat("x", tt.size))
+		readFinal(t, conn, bufio.NewReader(conn))
+
+		if got := <-results; got != tt.want {
+			t.Errorf("%d bytes: got %+v, want %+v", tt.size, got, tt.want)
+		}
+		waitUsage(t, budget, relay.MemorySpools, 0)
+	}
+
+	if n := m.get("memory.spools.spilled"); n != 1 {
+		t.Errorf("memory.spools.spilled = %d, want 1", n)
+	}
+}
+
+func TestMemoryCaptures(t *testing.T) {
+	m := new(counters)
+	budget := &relay.MemoryBudget{Captures: 150, Metrics: m}
+	fs := &relay.FlowStore{MaxBodySize: 1024, Memory: budget}
+
+	p := &relay.Proxy{
+		Flows: fs,
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "100")
+			resp.Body = io.NopCloser(strings.NewReader(strings.Repeat(req.URI[1:], 100)))
+			return resp, nil
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+	for _, path := range []string{"a", "b", "c"} {
+		io.WriteString(conn, "GET http://origin.test/"+path+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		io.ReadAll(resp.Body)
+	}
+
+	// The ceiling leaves room for a single flow, the latest.
+	var flows []relay.Flow
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		flows = fs.Flows(nil)
+		if len(flows) == 1 && flows[0].Request.URI == "/c" && flows[0].State == relay.FlowDone {
+			break
+		}
+	}
+	if len(flows) != 1 || flows[0].Request.URI != "/c" || len(flows[0].ResponseBody) != 100 {
+		t.Fatalf("got %d flows, the first with %d bytes", len(flows), len(flows[0].ResponseBody))
+	}
+
+	if n := budget.Usage(relay.MemoryCaptures); n != 100 || m.get("memory.captures") != 100 {
+		t.Errorf("%d bytes of captures in use (reported %d), want 100", n, m.get("memory.captures"))
+	}
+	if n := m.get("memory.captures.shed"); n != 2 {
+		t.Errorf("memory.captures.shed = %d, want 2", n)
+	}
+}
+
+func TestMemoryCaches(t *testing.T) {
+	ca, cfg := testAuthority(t)
+	cfg.ServerName = "example.com"
+
+	m := new(counters)
+	budget := &relay.MemoryBudget{Metrics: m}
+	p := &relay.Proxy{
+		Authority: ca,
+		Decisions: &relay.DecisionCache{Memory: budget},
+	}
+
+	handshake := func() {
+		conn, err := connect(t, p, "example.com:443", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	// The certificate kept with the cached decision is accounted for, until
+	// it's purged.
+	handshake()
+	if budget.Usage(relay.MemoryCaches) == 0 {
+		t.Error("no memory accounted for the cached certificate")
+	}
+	p.Decisions.Purge()
+	if n := budget.Usage(relay.MemoryCaches); n != 0 {
+		t.Errorf("%d bytes of caches in use after purging", n)
+	}
+
+	// Without room, certificates aren't kept.
+	budget.Caches = 1
+	handshake()
+	handshake()
+	if n := budget.Usage(relay.MemoryCaches); n != 0 {
+		t.Errorf("%d bytes of caches in use, want 0", n)
+	}
+	if n := m.get("memory.caches.shed"); n != 2 {
+		t.Errorf("memory.caches.shed = %d, want 2", n)
+	}
+}
+
+func TestMemoryCategories(t *testing.T) {
+	for c, want := range map[relay.MemoryCategory]string{
+		relay.MemoryBuffers:  "buffers",
+		relay.MemoryCaptures: "captures",
+		relay.MemoryCaches:   "caches",
+		relay.MemorySpools:   "spools",
+		-1:                   "unknown",
+		99:                   "unknown",
+	} {
+		if got := c.String(); got != want {
+			t.Errorf("%d: got %q, want %q", c, got, want)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/xo"
+)
+
+// NTLM negotiate flags.
+const (
+	ntlmUnicode         = 0x00000001
+	ntlmRequestTarget   = 0x00000004
+	ntlmNTLM            = 0x00000200
+	ntlmAlwaysSign      = 0x00008000
+	ntlmExtendedSession = 0x00080000
+	ntlmTargetInfo      = 0x00800000
+	ntlm128             = 0x20000000
+	ntlm56              = 0x80000000
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+var errNTLMChallenge = errors.New("malformed NTLM challenge")
+
+// ntlmHandshake authenticates a connection to a parent proxy using NTLM,
+// sending req (which mustn't have a body) once to negotiate and once more
+// to authenticate. It returns the response to the final attempt, or to the
+// first if the proxy doesn't ask for NTLM authentication.
+func ntlmHandshake(r xo.Reader, w xo.Writer, req *heat.Request, user *url.Userinfo) (*heat.Response, error) {
+	req.Fields.Set("Proxy-Authorization", "NTLM "+base64.StdEncoding.EncodeToString(ntlmNegotiate()))
+
+	resp, err := exchange(r, w, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var challenge []byte
+	if resp.Status == 407 {
+		resp.Fields.Split("Proxy-Authenticate", ',', func(s string) bool {
+			s = strings.TrimSpace(s)
+			if len(s) > 5 && strings.EqualFold(s[:5], "NTLM ") {
+				challenge, err = base64.StdEncoding.DecodeString(strings.TrimSpace(s[5:]))
+				return false
+			}
+			return true
+		})
+	}
+	if challenge == nil || err != nil {
+		return resp, err
+	}
+
+	// The connection must survive the challenge for the handshake to work.
+	size, err := heat.ResponseBodySize(resp, req.Method)
+	if err != nil {
+		return nil, err
+	}
+	if size == heat.Unbounded || heat.Closing(resp.Major, resp.Minor, resp.Fields) {
+		return nil, errors.New("parent proxy closed the connection during NTLM authentication")
+	}
+	if size != 0 {
+		body, err := heat.OpenBody(r, size)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return nil, err
+		}
+	}
+
+	msg, err := ntlmAuthenticate(challenge, user)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Fields.Set("Proxy-Authorization", "NTLM "+base64.StdEncoding.EncodeToString(msg))
+
+	return exchange(r, w, req)
+}
+
+// exchange writes a request header without a body, and reads the final
+// response header.
+func exchange(r xo.Reader, w xo.Writer, req *heat.Request) (*heat.Response, error) {
+	if err := heat.WriteRequestHeader(w, req); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readFinalResponse(r, nil)
+}
+
+// readFinalResponse reads a response header, skipping any informational
+// responses, and repairing the protocol violations t tolerates.
+func readFinalResponse(r xo.Reader, t *Tolerance) (*heat.Response, error) {
+	for {
+		resp, err := readResponseHeader(r, t)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Status >= 200 || resp.Status == 101 {
+			return resp, nil
+		}
+	}
+}
+
+// ntlmNegotiate returns an NTLM NEGOTIATE_MESSAGE.
+func ntlmNegotiate() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], ntlmUnicode|ntlmRequestTarget|ntlmNTLM|
+		ntlmAlwaysSign|ntlmExtendedSession|ntlmTargetInfo|ntlm128|ntlm56)
+	return msg
+}
+
+// ntlmAuthenticate returns an NTLM AUTHENTICATE_MESSAGE answering a
+// CHALLENGE_MESSAGE with an NTLMv2 response. The user name may be prefixed
+// by a domain ("DOMAIN\user").
+func ntlmAuthenticate(challenge []byte, user *url.Userinfo) ([]byte, error) {
+	if len(challenge) < 32 || !bytes.Equal(challenge[:8], ntlmSignature) ||
+		binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, errNTLMChallenge
+	}
+
+	flags := binary.LittleEndian.Uint32(challenge[20:])
+	serverChallenge := challenge[24:32]
+
+	var targetInfo []byte
+	if len(challenge) >= 48 {
+		n := int(binary.LittleEndian.Uint16(challenge[40:]))
+		off := int(binary.LittleEndian.Uint32(challenge[44:]))
+		if off > len(challenge) || n > len(challenge)-off {
+			return nil, errNTLMChallenge
+		}
+		targetInfo = challenge[off : off+n]
+	}
+
+	var name, password string
+	if user != nil {
+		name = user.Username()
+		password, _ = user.Password()
+	}
+
+	domain := ""
+	if i := strings.IndexByte(name, '\\'); i >= 0 {
+		domain, name = name[:i], name[i+1:]
+	}
+
+	// Prefer the server's idea of the time, to avoid clock skew issues.
+	timestamp := ntlmTimestamp(time.Now())
+	if ts := avPair(targetInfo, 7); len(ts) == 8 {
+		timestamp = ts
+	}
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	key := ntowfv2(name, password, domain)
+	nt := ntlmv2Response(key, serverChallenge, clientChallenge, timestamp, targetInfo)
+
+	mac := hmac.New(md5.New, key)
+	mac.Write(serverChallenge)
+	mac.Write(clientChallenge)
+	lm := append(mac.Sum(nil), clientChallenge...)
+
+	// Assemble the message: a fixed-size header of field descriptors,
+	// followed by their payloads.
+	fields := [][]byte{lm, nt, utf16le(domain), utf16le(name), nil, nil}
+
+	msg := make([]byte, 64)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+
+	for i, f := range fields {
+		binary.LittleEndian.PutUint16(msg[12+8*i:], uint16(len(f)))
+		binary.LittleEndian.PutUint16(msg[14+8*i:], uint16(len(f)))
+		binary.LittleEndian.PutUint32(msg[16+8*i:], uint32(len(msg)))
+		msg = append(msg, f...)
+	}
+
+	flags &= ntlmUnicode | ntlmNTLM | ntlmAlwaysSign | ntlmExtendedSession |
+		ntlmTargetInfo | ntlm128 | ntlm56
+	binary.LittleEndian.PutUint32(msg[60:], flags|ntlmUnicode)
+
+	return msg, nil
+}
+
+// ntowfv2 derives the NTLMv2 response key from a user's credentials.
+func ntowfv2(user, password, domain string) []byte {
+	mac := hmac.New(md5.New, md4(utf16le(password)))
+	mac.Write(utf16le(strings.ToUpper(user) + domain))
+	return mac.Sum(nil)
+}
+
+// ntlmv2Response computes an NTLMv2 response to a server challenge.
+func ntlmv2Response(key, serverChallenge, clientChallenge, timestamp, targetInfo []byte) []byte {
+	var blob []byte
+	blob = append(blob, 1, 1, 0, 0, 0, 0, 0, 0)
+	blob = append(blob, timestamp...)
+	blob = append(blob, clientChallenge...)
+	blob = append(blob, 0, 0, 0, 0)
+	blob = append(blob, targetInfo...)
+	blob = append(blob, 0, 0, 0, 0)
+
+	mac := hmac.New(md5.New, key)
+	mac.Write(serverChallenge)
+	mac.Write(blob)
+
+	return append(mac.Sum(nil), blob...)
+}
+
+// avPair returns the value of an attribute in an NTLM AV_PAIR list.
+func avPair(list []byte, id uint16) []byte {
+	for len(list) >= 4 {
+		typ := binary.LittleEndian.Uint16(list)
+		n := int(binary.LittleEndian.Uint16(list[2:]))
+		if typ == 0 || n > len(list)-4 {
+			break
+		}
+		if typ == id {
+			return list[4 : 4+n]
+		}
+		list = list[4+n:]
+	}
+	return nil
+}
+
+// ntlmTimestamp encodes a time as the number of 100 nanosecond intervals
+// since January 1, 1601.
+func ntlmTimestamp(t time.Time) []byte {
+	const epoch = 116444736000000000
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(t.UnixNano()/100+epoch))
+	return buf
+}
+
+func utf16le(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	buf := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(buf[2*i:], u)
+	}
+	return buf
+}
+
+// md4 computes the MD4 digest of data (see RFC 1320), as needed for NT
+// password hashes.
+func md4(data []byte) []byte {
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+
+	// Pad the message to a multiple of 64 bytes, ending with its length.
+	n := len(data)
+	msg := append(append([]byte(nil), data...), 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	msg = binary.LittleEndian.AppendUint64(msg, uint64(n)<<3)
+
+	var x [16]uint32
+
+	for len(msg) > 0 {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(msg[4*i:])
+		}
+		msg = msg[64:]
+
+		aa, bb, cc, dd := a, b, c, d
+
+		f := func(x, y, z uint32) uint32 { return x&y | ^x&z }
+		g := func(x, y, z uint32) uint32 { return x&y | x&z | y&z }
+		h := func(x, y, z uint32) uint32 { return x ^ y ^ z }
+
+		for _, i := range []int{0, 4, 8, 12} {
+			a = bits.RotateLeft32(a+f(b, c, d)+x[i], 3)
+			d = bits.RotateLeft32(d+f(a, b, c)+x[i+1], 7)
+			c = bits.RotateLeft32(c+f(d, a, b)+x[i+2], 11)
+			b = bits.RotateLeft32(b+f(c, d, a)+x[i+3], 19)
+		}
+
+		for _, i := range []int{0, 1, 2, 3} {
+			a = bits.RotateLeft32(a+g(b, c, d)+x[i]+0x5a827999, 3)
+			d = bits.RotateLeft32(d+g(a, b, c)+x[i+4]+0x5a827999, 5)
+			c = bits.RotateLeft32(c+g(d, a, b)+x[i+8]+0x5a827999, 9)
+			b = bits.RotateLeft32(b+g(c, d, a)+x[i+12]+0x5a827999, 13)
+		}
+
+		for _, i := range []int{0, 2, 1, 3} {
+			a = bits.RotateLeft32(a+h(b, c, d)+x[i]+0x6ed9eba1, 3)
+			d = bits.RotateLeft32(d+h(a, b, c)+x[i+8]+0x6ed9eba1, 9)
+			c = bits.RotateLeft32(c+h(d, a, b)+x[i+4]+0x6ed9eba1, 11)
+			b = bits.RotateLeft32(b+h(c, d, a)+x[i+12]+0x6ed9eba1, 15)
+		}
+
+		a, b, c, d = a+aa, b+bb, c+cc, d+dd
+	}
+
+	sum := make([]byte, 0, 16)
+	for _, v := range []uint32{a, b, c, d} {
+		sum = binary.LittleEndian.AppendUint32(sum, v)
+	}
+	return sum
+}
@@ -0,0 +1,276 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+// The NT hash of "Password", as given in the NTLM specification.
+const ntlmPasswordHash = "a4f49c406510bdcab6824ee7c30fd852"
+
+// The ntlmParent type is a fake parent proxy requiring NTLM authentication
+// for each connection, and logging the requests it receives.
+type ntlmParent struct {
+	t         *testing.T
+	challenge []byte
+
+	mu     sync.Mutex
+	authed map[net.Conn]bool
+	log    []string
+}
+
+func newNTLMParent(t *testing.T) (*ntlmParent, string) {
+	np := &ntlmParent{
+		t:         t,
+		challenge: []byte("\x01\x23\x45\x67\x89\xab\xcd\xef"),
+		authed:    make(map[net.Conn]bool),
+	}
+	return np, upstream(t, np.handle)
+}
+
+func (np *ntlmParent) handle(conn net.Conn, r *bufio.Reader, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	// Responses to HEAD requests mustn't have bodies.
+	reply := func(head, body string) {
+		if req.Method == "HEAD" {
+			body = ""
+		}
+		io.WriteString(conn, head+"\r\n\r\n"+body)
+	}
+
+	np.mu.Lock()
+	defer np.mu.Unlock()
+
+	// Entries are prefixed by the number of connections seen so far.
+	if _, ok := np.authed[conn]; !ok {
+		np.authed[conn] = false
+	}
+	entry := fmt.Sprintf("%d %s %s", len(np.authed), req.Method, req.URL.Path)
+
+	auth := req.Header.Get("Proxy-Authorization")
+	switch {
+	case np.authed[conn]:
+		np.log = append(np.log, entry+" "+string(body))
+		if req.Method == "CONNECT" {
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		} else {
+			reply("HTTP/1.1 200 OK\r\nContent-Length: 2", "ok")
+		}
+
+	case strings.HasPrefix(auth, "NTLM "):
+		msg, _ := base64.StdEncoding.DecodeString(auth[5:])
+		if len(msg) < 12 || !bytes.Equal(msg[:8], []byte("NTLMSSP\x00")) {
+			np.t.Errorf("malformed NTLM message %q", auth)
+			return
+		}
+
+		switch binary.LittleEndian.Uint32(msg[8:]) {
+		case 1:
+			np.log = append(np.log, entry+" negotiate")
+			reply("HTTP/1.1 407 Proxy Authentication Required\r\n"+
+				"Proxy-Authenticate: NTLM "+base64.StdEncoding.EncodeToString(np.challengeMessage())+"\r\n"+
+				"Content-Length: 4", "auth")
+		case 3:
+			user, ok := np.verify(msg)
+			np.log = append(np.log, fmt.Sprintf("%s authenticate %s %v", entry, user, ok))
+			if !ok {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+				return
+			}
+			np.authed[conn] = true
+			if req.Method == "CONNECT" {
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			} else {
+				reply("HTTP/1.1 200 OK\r\nContent-Length: 2", "ok")
+			}
+		}
+
+	default:
+		np.log = append(np.log, entry+" unauthenticated "+auth)
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM\r\nContent-Length: 0\r\n\r\n")
+	}
+}
+
+// challengeMessage returns a CHALLENGE_MESSAGE whose target information
+// carries a fixed timestamp.
+func (np *ntlmParent) challengeMessage() []byte {
+	info := []byte{7, 0, 8, 0, 1, 2, 3, 4, 5, 6, 7, 8, 0, 0, 0, 0}
+
+	msg := make([]byte, 48)
+	copy(msg, "NTLMSSP\x00")
+	binary.LittleEndian.PutUint32(msg[8:], 2)
+	binary.LittleEndian.PutUint32(msg[16:], 48)
+	binary.LittleEndian.PutUint32(msg[20:], 0x00880201)
+	copy(msg[24:], np.challenge)
+	binary.LittleEndian.PutUint16(msg[40:], uint16(len(info)))
+	binary.LittleEndian.PutUint16(msg[42:], uint16(len(info)))
+	binary.LittleEndian.PutUint32(msg[44:], 48)
+
+	return append(msg, info...)
+}
+
+// verify checks the NTLMv2 response in an AUTHENTICATE_MESSAGE against the
+// password "Password", returning the authenticated "DOMAIN\user" name.
+func (np *ntlmParent) verify(msg []byte) (string, bool) {
+	field := func(i int) []byte {
+		n := int(binary.LittleEndian.Uint16(msg[12+8*i:]))
+		off := int(binary.LittleEndian.Uint32(msg[16+8*i:]))
+		if len(msg) < 64 || off+n > len(msg) {
+			return nil
+		}
+		return msg[off : off+n]
+	}
+
+	// The names are ASCII, encoded as UTF-16LE.
+	ascii := func(b []byte) string {
+		var s []byte
+		for i := 0; i+1 < len(b); i += 2 {
+			s = append(s, b[i])
+		}
+		return string(s)
+	}
+
+	nt, domain, user := field(1), ascii(field(2)), ascii(field(3))
+	if len(nt) < 16+28 {
+		return domain + `\` + user, false
+	}
+
+	hash, _ := hex.DecodeString(ntlmPasswordHash)
+	mac := hmac.New(md5.New, hash)
+	mac.Write(utf16le(strings.ToUpper(user) + domain))
+	key := mac.Sum(nil)
+
+	proof, blob := nt[:16], nt[16:]
+	mac = hmac.New(md5.New, key)
+	mac.Write(np.challenge)
+	mac.Write(blob)
+
+	// The client should have used the timestamp from the challenge.
+	ok := hmac.Equal(proof, mac.Sum(nil)) && bytes.Equal(blob[8:16], []byte{1, 2, 3, 4, 5, 6, 7, 8})
+
+	return domain + `\` + user, ok
+}
+
+func (np *ntlmParent) requests() []string {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+	return append([]string(nil), np.log...)
+}
+
+func utf16le(s string) []byte {
+	var b []byte
+	for _, c := range s {
+		b = append(b, byte(c), 0)
+	}
+	return b
+}
+
+func ntlmProxy(addr, password string) *relay.Proxy {
+	return &relay.Proxy{
+		Transport: &relay.Transport{
+			Proxy:     &url.URL{Scheme: "http", Host: addr, User: url.UserPassword(`Domain\User`, password)},
+			ProxyNTLM: true,
+		},
+		Intercept: func(s *relay.Session, addr string) bool { return false },
+	}
+}
+
+func TestNTLM(t *testing.T) {
+	np, addr := newNTLMParent(t)
+
+	conn := serve(t, ntlmProxy(addr, "Password"))
+	r := bufio.NewReader(conn)
+
+	// The handshake is carried by the first request, and the connection
+	// stays authenticated for the next.
+	for i := 0; i < 2; i++ {
+		io.WriteString(conn, "GET http://origin.test/a HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != 200 || string(body) != "ok" {
+			t.Fatalf("got %d %q", resp.StatusCode, body)
+		}
+	}
+
+	// Requests with bodies are preceded by a HEAD request carrying the
+	// handshake, on a connection of their own.
+	conn = serve(t, ntlmProxy(addr, "Password"))
+	r = bufio.NewReader(conn)
+
+	io.WriteString(conn, "POST http://origin.test/b HTTP/1.1\r\nHost: origin.test\r\nContent-Length: 5\r\n\r\nhello")
+	resp := readFinal(t, conn, r)
+	io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		t.Fatalf("POST: got status %d", resp.StatusCode)
+	}
+
+	want := []string{
+		"1 GET /a negotiate",
+		`1 GET /a authenticate Domain\User true`,
+		"1 GET /a ",
+		"2 HEAD /b negotiate",
+		`2 HEAD /b authenticate Domain\User true`,
+		"2 POST /b hello",
+	}
+	if got := np.requests(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("parent proxy saw:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestNTLMRejected(t *testing.T) {
+	np, addr := newNTLMParent(t)
+
+	conn := serve(t, ntlmProxy(addr, "wrong"))
+	io.WriteString(conn, "GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 407 {
+		t.Errorf("got status %d, want 407", resp.StatusCode)
+	}
+	if got := np.requests(); len(got) != 2 || got[1] != `1 GET / authenticate Domain\User false` {
+		t.Errorf("parent proxy saw %q", got)
+	}
+}
+
+func TestNTLMTunnel(t *testing.T) {
+	np, addr := newNTLMParent(t)
+
+	conn := serve(t, ntlmProxy(addr, "Password"))
+	r := bufio.NewReader(conn)
+
+	io.WriteString(conn, "CONNECT origin.test:80 HTTP/1.1\r\nHost: origin.test:80\r\n\r\n")
+	if resp := readFinal(t, conn, r); resp.StatusCode != 200 {
+		t.Fatalf("CONNECT: got status %d", resp.StatusCode)
+	}
+
+	// The fake parent proxy answers requests sent through the tunnel.
+	io.WriteString(conn, "GET /tunneled HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+	resp := readFinal(t, conn, r)
+	if body, _ := io.ReadAll(io.LimitReader(resp.Body, 2)); string(body) != "ok" {
+		t.Errorf("got %q through the tunnel", body)
+	}
+
+	want := []string{
+		"1 CONNECT  negotiate",
+		`1 CONNECT  authenticate Domain\User true`,
+		"1 GET /tunneled ",
+	}
+	if got := np.requests(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("parent proxy saw:\n%q\nwant:\n%q", got, want)
+	}
+}
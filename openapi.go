@@ -0,0 +1,531 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/erkl/heat"
+)
+
+// An APIAnalyzer aggregates observed exchanges into a summary of each host's
+// endpoints, from which it can draft an OpenAPI description, as a starting
+// point for documenting undocumented APIs.
+//
+// It's fed flows, typically from a FlowStore's OnChange function once they
+// are done. Only bodies captured by the store (see FlowStore.MaxBodySize)
+// can be analyzed. Path segments which look like identifiers, such as
+// numbers and UUIDs, are turned into parameters. All methods are safe for
+// concurrent use.
+type APIAnalyzer struct {
+	// Optional condition for which requests to analyze.
+	Match *Match
+
+	mu        sync.Mutex
+	endpoints map[endpointKey]*Endpoint
+}
+
+type endpointKey struct {
+	host, method, path string
+}
+
+// An Endpoint summarizes the requests seen for a method and path template.
+type Endpoint struct {
+	Host   string
+	Method string
+	Path   string // such as "/users/{id}"
+
+	// Number of requests seen.
+	Count int
+
+	// Types of the path and query parameters seen, as JSON schema types.
+	PathParams  map[string]string
+	QueryParams map[string]string
+
+	// Media types of the request bodies seen, and the schema inferred from
+	// those in JSON.
+	RequestTypes  []string
+	RequestSchema *Schema
+
+	// Responses seen, by status code.
+	Responses map[int]*EndpointResponse
+}
+
+// An EndpointResponse summarizes the responses seen with a status code.
+type EndpointResponse struct {
+	Count  int
+	Types  []string
+	Schema *Schema
+}
+
+// A Schema is a JSON schema inferred from the bodies seen, as used by
+// OpenAPI. Values of conflicting types yield a Schema without a type.
+type Schema struct {
+	Type       string             `json:"type,omitempty"`
+	Format     string             `json:"format,omitempty"`
+	Nullable   bool               `json:"nullable,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Items      *Schema            `json:"items,omitempty"`
+}
+
+// ObserveFlow adds a finished flow to the summary. Flows which are still
+// active, or failed, are ignored.
+func (a *APIAnalyzer) ObserveFlow(f *Flow) {
+	if f.State != FlowDone || f.Request == nil || f.Response == nil {
+		return
+	}
+	if !a.Match.Request(&Session{ClientAddr: f.ClientAddr}, f.Request) {
+		return
+	}
+
+	var reqBody, respBody []byte
+	if !f.RequestTruncated {
+		reqBody = f.RequestBody
+	}
+	if !f.ResponseTruncated && !f.Passthrough {
+		respBody = f.ResponseBody
+	}
+
+	a.Observe(f.Request, reqBody, f.Response, respBody)
+}
+
+// Observe adds an exchange to the summary, given the request and response
+// headers and their complete bodies (or nil, if unknown).
+func (a *APIAnalyzer) Observe(req *heat.Request, reqBody []byte, resp *heat.Response, respBody []byte) {
+	u, err := url.ParseRequestURI(req.URI)
+	if err != nil {
+		return
+	}
+
+	host := strings.ToLower(req.Remote)
+	if host == "" {
+		host = strings.ToLower(u.Host)
+	}
+
+	path, params := templatePath(u.Path)
+	key := endpointKey{host, req.Method, path}
+
+	reqType, reqSchema := inferBody(req.Fields, reqBody)
+	respType, respSchema := inferBody(resp.Fields, respBody)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.endpoints == nil {
+		a.endpoints = make(map[endpointKey]*Endpoint)
+	}
+
+	e := a.endpoints[key]
+	if e == nil {
+		e = &Endpoint{
+			Host:        host,
+			Method:      req.Method,
+			Path:        path,
+			PathParams:  make(map[string]string),
+			QueryParams: make(map[string]string),
+			Responses:   make(map[int]*EndpointResponse),
+		}
+		a.endpoints[key] = e
+	}
+
+	e.Count++
+
+	for name, typ := range params {
+		e.PathParams[name] = mergeType(e.PathParams[name], typ, e.Count > 1)
+	}
+	for name, values := range u.Query() {
+		old, seen := e.QueryParams[name]
+		e.QueryParams[name] = mergeType(old, valueType(values[0]), seen)
+	}
+
+	if reqType != "" {
+		e.RequestTypes = addString(e.RequestTypes, reqType)
+		e.RequestSchema = mergeSchema(e.RequestSchema, reqSchema)
+	}
+
+	r := e.Responses[resp.Status]
+	if r == nil {
+		r = &EndpointResponse{}
+		e.Responses[resp.Status] = r
+	}
+	r.Count++
+	if respType != "" {
+		r.Types = addString(r.Types, respType)
+		r.Schema = mergeSchema(r.Schema, respSchema)
+	}
+}
+
+// Hosts lists the hosts seen, in order.
+func (a *APIAnalyzer) Hosts() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var hosts []string
+	for k := range a.endpoints {
+		hosts = addString(hosts, k.host)
+	}
+
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Endpoints returns copies of the summaries of a host's endpoints, ordered
+// by path and method.
+func (a *APIAnalyzer) Endpoints(host string) []Endpoint {
+	host = strings.ToLower(host)
+
+	a.mu.Lock()
+	var list []Endpoint
+	for k, e := range a.endpoints {
+		if k.host == host {
+			list = append(list, e.clone())
+		}
+	}
+	a.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Path != list[j].Path {
+			return list[i].Path < list[j].Path
+		}
+		return list[i].Method < list[j].Method
+	})
+
+	return list
+}
+
+// Reset forgets everything seen so far.
+func (a *APIAnalyzer) Reset() {
+	a.mu.Lock()
+	a.endpoints = nil
+	a.mu.Unlock()
+}
+
+// OpenAPI drafts an OpenAPI 3.0 description of a host's endpoints, as JSON.
+// The scheme in server URLs is taken to be HTTPS.
+func (a *APIAnalyzer) OpenAPI(host string) ([]byte, error) {
+	type object = map[string]interface{}
+
+	paths := object{}
+
+	for _, e := range a.Endpoints(host) {
+		op := object{
+			"summary":   e.Method + " " + e.Path,
+			"responses": openAPIResponses(e.Responses),
+		}
+
+		var params []object
+		for _, name := range sortedKeys(e.PathParams) {
+			params = append(params, object{
+				"name": name, "in": "path", "required": true,
+				"schema": object{"type": e.PathParams[name]},
+			})
+		}
+		for _, name := range sortedKeys(e.QueryParams) {
+			params = append(params, object{
+				"name": name, "in": "query",
+				"schema": object{"type": e.QueryParams[name]},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		if len(e.RequestTypes) > 0 {
+			op["requestBody"] = object{"content": openAPIContent(e.RequestTypes, e.RequestSchema)}
+		}
+
+		item, _ := paths[e.Path].(object)
+		if item == nil {
+			item = object{}
+			paths[e.Path] = item
+		}
+		item[strings.ToLower(e.Method)] = op
+	}
+
+	return json.MarshalIndent(object{
+		"openapi": "3.0.3",
+		"info":    object{"title": host, "version": "draft"},
+		"servers": []object{{"url": "https://" + host}},
+		"paths":   paths,
+	}, "", "  ")
+}
+
+func openAPIResponses(responses map[int]*EndpointResponse) map[string]interface{} {
+	out := make(map[string]interface{})
+
+	for status, r := range responses {
+		desc := statusClass(status)
+		resp := map[string]interface{}{"description": desc}
+		if len(r.Types) > 0 {
+			resp["content"] = openAPIContent(r.Types, r.Schema)
+		}
+		out[strconv.Itoa(status)] = resp
+	}
+
+	return out
+}
+
+func openAPIContent(types []string, schema *Schema) map[string]interface{} {
+	content := make(map[string]interface{})
+
+	for _, t := range types {
+		media := map[string]interface{}{}
+		if isJSONType(t) && schema != nil {
+			media["schema"] = schema
+		}
+		content[t] = media
+	}
+
+	return content
+}
+
+// statusClass describes a status code for OpenAPI, which requires every
+// response to have a description.
+func statusClass(status int) string {
+	switch {
+	case status < 200:
+		return "Informational"
+	case status < 300:
+		return "Success"
+	case status < 400:
+		return "Redirection"
+	case status < 500:
+		return "Client error"
+	}
+	return "Server error"
+}
+
+var (
+	uuidSegment = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hexSegment  = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+)
+
+// templatePath replaces the segments of a path which look like identifiers
+// with parameters, returning the template and the parameters' types.
+func templatePath(path string) (string, map[string]string) {
+	segments := strings.Split(path, "/")
+	params := make(map[string]string)
+
+	for i, seg := range segments {
+		var typ string
+		switch {
+		case seg == "":
+			continue
+		case isDigits(seg):
+			typ = "integer"
+		case uuidSegment.MatchString(seg), hexSegment.MatchString(seg):
+			typ = "string"
+		case len(seg) >= 20 && strings.IndexFunc(seg, isDigitRune) >= 0 && !strings.ContainsAny(seg, ".~"):
+			typ = "string"
+		default:
+			continue
+		}
+
+		name := "id"
+		if n := len(params); n > 0 {
+			name += strconv.Itoa(n + 1)
+		}
+
+		params[name] = typ
+		segments[i] = "{" + name + "}"
+	}
+
+	return strings.Join(segments, "/"), params
+}
+
+// inferBody returns the media type of a message body, and if it's JSON,
+// the schema of its content.
+func inferBody(fields heat.Fields, body []byte) (string, *Schema) {
+	value, ok := fieldValue(fields, "Content-Type")
+	if !ok || len(body) == 0 {
+		return "", nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(value)
+	if err != nil {
+		return "", nil
+	}
+	if !isJSONType(mediaType) {
+		return mediaType, nil
+	}
+
+	if coding, ok := fieldValue(fields, "Content-Encoding"); ok {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "identity" {
+			r, ok := decoder(coding, ioutil.NopCloser(bytes.NewReader(body)))
+			if !ok {
+				return mediaType, nil
+			}
+			if body, err = ioutil.ReadAll(r); err != nil {
+				return mediaType, nil
+			}
+		}
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return mediaType, nil
+	}
+
+	return mediaType, inferSchema(v)
+}
+
+// inferSchema describes a decoded JSON value.
+func inferSchema(v interface{}) *Schema {
+	switch v := v.(type) {
+	case nil:
+		return &Schema{Nullable: true}
+	case bool:
+		return &Schema{Type: "boolean"}
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return &Schema{Type: "integer"}
+		}
+		return &Schema{Type: "number"}
+	case string:
+		s := &Schema{Type: "string"}
+		if uuidSegment.MatchString(v) {
+			s.Format = "uuid"
+		}
+		return s
+	case []interface{}:
+		s := &Schema{Type: "array"}
+		for _, item := range v {
+			s.Items = mergeSchema(s.Items, inferSchema(item))
+		}
+		return s
+	case map[string]interface{}:
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		for name, prop := range v {
+			s.Properties[name] = inferSchema(prop)
+		}
+		return s
+	}
+	return &Schema{}
+}
+
+// mergeSchema combines the schemas of two values seen in the same place.
+func mergeSchema(a, b *Schema) *Schema {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	}
+
+	m := &Schema{Nullable: a.Nullable || b.Nullable}
+
+	// Null values only tell us the field is nullable.
+	switch {
+	case a.Type == "" && a.Nullable && a.Properties == nil:
+		m.Type, m.Format, m.Properties, m.Items = b.Type, b.Format, b.Properties, b.Items
+		return m
+	case b.Type == "" && b.Nullable && b.Properties == nil:
+		m.Type, m.Format, m.Properties, m.Items = a.Type, a.Format, a.Properties, a.Items
+		return m
+	}
+
+	m.Type = mergeType(a.Type, b.Type, true)
+	if a.Format == b.Format {
+		m.Format = a.Format
+	}
+
+	switch m.Type {
+	case "object":
+		m.Properties = make(map[string]*Schema)
+		for name, s := range a.Properties {
+			m.Properties[name] = s
+		}
+		for name, s := range b.Properties {
+			m.Properties[name] = mergeSchema(m.Properties[name], s)
+		}
+	case "array":
+		m.Items = mergeSchema(a.Items, b.Items)
+	}
+
+	return m
+}
+
+// mergeType combines two JSON schema types seen in the same place. Integers
+// widen to numbers; other conflicts yield no type at all.
+func mergeType(a, b string, seen bool) string {
+	switch {
+	case !seen || a == b:
+		return b
+	case a == "integer" && b == "number", a == "number" && b == "integer":
+		return "number"
+	}
+	return ""
+}
+
+// valueType guesses the JSON schema type of a parameter's value.
+func valueType(s string) string {
+	switch {
+	case isDigits(s) || (len(s) > 1 && s[0] == '-' && isDigits(s[1:])):
+		return "integer"
+	case s == "true" || s == "false":
+		return "boolean"
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return "number"
+	}
+	return "string"
+}
+
+func (e *Endpoint) clone() Endpoint {
+	c := *e
+	c.PathParams = make(map[string]string)
+	for k, v := range e.PathParams {
+		c.PathParams[k] = v
+	}
+	c.QueryParams = make(map[string]string)
+	for k, v := range e.QueryParams {
+		c.QueryParams[k] = v
+	}
+	c.RequestTypes = append([]string(nil), e.RequestTypes...)
+	c.Responses = make(map[int]*EndpointResponse)
+	for k, r := range e.Responses {
+		rc := *r
+		rc.Types = append([]string(nil), r.Types...)
+		c.Responses[k] = &rc
+	}
+	return c
+}
+
+func isJSONType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func isDigits(s string) bool {
+	return s != "" && strings.IndexFunc(s, func(r rune) bool { return !isDigitRune(r) }) < 0
+}
+
+func isDigitRune(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// addString adds s to a list, unless it's already there.
+func addString(list []string, s string) []string {
+	if contains(list, s) {
+		return list
+	}
+	return append(list, s)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
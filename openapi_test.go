@@ -0,0 +1,176 @@
+package relay_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestAPIAnalyzer(t *testing.T) {
+	var a relay.APIAnalyzer
+
+	exchange := func(method, uri, reqBody string, status int, respBody []byte, fields ...string) {
+		req := heat.NewRequest(method, uri)
+		req.Remote = "API.example"
+		if reqBody != "" {
+			req.Fields.Set("Content-Type", "application/json; charset=utf-8")
+		}
+
+		resp := heat.NewResponse(status, heat.ReasonPhrase(status))
+		resp.Fields.Set("Content-Type", "application/json")
+		for i := 0; i+1 < len(fields); i += 2 {
+			resp.Fields.Set(fields[i], fields[i+1])
+		}
+
+		a.Observe(req, []byte(reqBody), resp, respBody)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(`{"id": 8, "name": "bob", "email": null, "score": 1.5}`))
+	zw.Close()
+
+	exchange("GET", "/users/7?verbose=true", "", 200, []byte(`{"id": 7, "name": "alice", "email": "a@example", "score": 2}`))
+	exchange("GET", "http://api.example/users/8?verbose=1", "", 200, gz.Bytes(), "Content-Encoding", "gzip")
+	exchange("GET", "/users/9", "", 404, nil)
+	exchange("POST", "/users", `{"name": "carol", "tags": ["x"]}`, 201, []byte(`{"id": 10}`))
+	exchange("DELETE", "/orders/123e4567-e89b-12d3-a456-426614174000/items/2", "", 204, nil)
+
+	if hosts := a.Hosts(); !reflect.DeepEqual(hosts, []string{"api.example"}) {
+		t.Errorf("got hosts %q", hosts)
+	}
+
+	var got []string
+	endpoints := a.Endpoints("api.example")
+	for _, e := range endpoints {
+		got = append(got, e.Method+" "+e.Path)
+	}
+	want := []string{"DELETE /orders/{id}/items/{id2}", "POST /users", "GET /users/{id}"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got endpoints %q, want %q", got, want)
+	}
+
+	// Items and users are identified by integers, orders by UUIDs.
+	if p := endpoints[0].PathParams; p["id"] != "string" || p["id2"] != "integer" {
+		t.Errorf("got path parameters %v", p)
+	}
+
+	user := endpoints[2]
+	if user.Count != 3 || user.PathParams["id"] != "integer" {
+		t.Errorf("got %d requests with path parameters %v", user.Count, user.PathParams)
+	}
+
+	// Conflicting types leave a parameter without one.
+	if q := user.QueryParams; len(q) != 1 || q["verbose"] != "" {
+		t.Errorf("got query parameters %q", q)
+	}
+
+	// Bodies are decoded before being inspected, and their schemas merged.
+	ok := user.Responses[200]
+	if ok == nil || ok.Count != 2 || !reflect.DeepEqual(ok.Types, []string{"application/json"}) {
+		t.Fatalf("got 200 responses %+v", ok)
+	}
+	props := ok.Schema.Properties
+	if props["id"].Type != "integer" || props["score"].Type != "number" ||
+		props["email"].Type != "string" || !props["email"].Nullable {
+		t.Errorf("got properties %+v", props)
+	}
+	if r := user.Responses[404]; r == nil || r.Schema != nil || len(r.Types) != 0 {
+		t.Errorf("got 404 responses %+v", r)
+	}
+
+	create := endpoints[1]
+	if !reflect.DeepEqual(create.RequestTypes, []string{"application/json"}) ||
+		create.RequestSchema.Properties["tags"].Items.Type != "string" {
+		t.Errorf("got request types %q and schema %+v", create.RequestTypes, create.RequestSchema)
+	}
+
+	// Check the interesting parts of the OpenAPI draft.
+	data, err := a.OpenAPI("api.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		OpenAPI string
+		Servers []struct{ URL string }
+		Paths   map[string]map[string]struct {
+			Parameters []struct {
+				Name, In string
+				Required bool
+			}
+			RequestBody struct {
+				Content map[string]struct{ Schema *relay.Schema }
+			}
+			Responses map[string]struct{ Description string }
+		}
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.OpenAPI != "3.0.3" || len(doc.Servers) != 1 || doc.Servers[0].URL != "https://api.example" {
+		t.Errorf("got version %q and servers %+v", doc.OpenAPI, doc.Servers)
+	}
+
+	get := doc.Paths["/users/{id}"]["get"]
+	if len(get.Parameters) != 2 || get.Parameters[0].In != "path" || !get.Parameters[0].Required ||
+		get.Parameters[1].Name != "verbose" || get.Parameters[1].In != "query" {
+		t.Errorf("got parameters %+v", get.Parameters)
+	}
+	if len(get.Responses) != 2 || get.Responses["404"].Description != "Client error" {
+		t.Errorf("got responses %+v", get.Responses)
+	}
+
+	post := doc.Paths["/users"]["post"]
+	if s := post.RequestBody.Content["application/json"].Schema; s == nil || s.Type != "object" {
+		t.Errorf("got request body %+v", post.RequestBody)
+	}
+
+	a.Reset()
+	if hosts := a.Hosts(); len(hosts) != 0 {
+		t.Errorf("got hosts %q after Reset", hosts)
+	}
+}
+
+func TestAPIAnalyzerFlows(t *testing.T) {
+	match, err := relay.ParseMatch("path=/api/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &relay.APIAnalyzer{Match: match}
+
+	flow := func(state relay.FlowState, path string, truncated bool) *relay.Flow {
+		req := heat.NewRequest("POST", path)
+		req.Remote = "example.com"
+		req.Fields.Set("Content-Type", "application/json")
+		resp := heat.NewResponse(200, "OK")
+		resp.Fields.Set("Content-Type", "application/json")
+		return &relay.Flow{
+			State:             state,
+			Request:           req,
+			RequestBody:       []byte(`{"n": 1}`),
+			Response:          resp,
+			ResponseBody:      []byte(`{"ok": tr`),
+			ResponseTruncated: truncated,
+		}
+	}
+
+	a.ObserveFlow(flow(relay.FlowActive, "/api/a", false))
+	a.ObserveFlow(flow(relay.FlowDone, "/other", false))
+	a.ObserveFlow(flow(relay.FlowDone, "/api/b", true))
+
+	// Only done flows matching Match count, and truncated bodies are ignored.
+	endpoints := a.Endpoints("example.com")
+	if len(endpoints) != 1 || endpoints[0].Path != "/api/b" {
+		t.Fatalf("got endpoints %+v", endpoints)
+	}
+	if e := endpoints[0]; e.RequestSchema == nil || len(e.Responses[200].Types) != 0 {
+		t.Errorf("got request schema %+v and response %+v", e.RequestSchema, e.Responses[200])
+	}
+}
@@ -0,0 +1,62 @@
+package relay
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// Media types taking the fast path when PassthroughPolicy.Types is nil.
+var defaultPassthroughTypes = []string{"image/*", "video/*", "audio/*"}
+
+// A PassthroughPolicy sends large binary responses, such as images and
+// video, down a fast path which leaves their bodies alone. This keeps CPU and
+// memory use flat on media-heavy traffic.
+//
+// Responses on the fast path aren't decoded (see Proxy.AcceptEncoding),
+// injected into, or passed to the OnResponse hook or breakpoints, and their
+// bodies aren't captured in flows, which still record their headers. Header
+// rules, metering, quotas and throttling still apply. Each such response is
+// counted as "response.passthrough" in Proxy.Metrics.
+type PassthroughPolicy struct {
+	// Media types taking the fast path, optionally with a wildcard subtype
+	// ("video/*"). Defaults to image, video and audio types.
+	Types []string
+
+	// Minimum size of bodies taking the fast path, going by their
+	// Content-Length. Bodies of unknown length always qualify.
+	MinSize int64
+}
+
+// applies reports whether a response should take the fast path.
+func (pp *PassthroughPolicy) applies(resp *heat.Response) bool {
+	if resp.Body == nil || resp.Status == 101 {
+		return false
+	}
+
+	types := pp.Types
+	if types == nil {
+		types = defaultPassthroughTypes
+	}
+	if !matchContentType(types, resp.Fields) {
+		return false
+	}
+
+	if value, ok := fieldValue(resp.Fields, "Content-Length"); ok && pp.MinSize > 0 {
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		return err != nil || n >= pp.MinSize
+	}
+
+	return true
+}
+
+// passthrough reports whether a response should take the fast path.
+func (p *Proxy) passthrough(resp *heat.Response) bool {
+	if p.Passthrough == nil || !p.Passthrough.applies(resp) {
+		return false
+	}
+
+	p.count("response.passthrough", 1)
+	return true
+}
@@ -0,0 +1,101 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestPassthrough(t *testing.T) {
+	type page struct {
+		ctype string
+		size  int
+		fast  bool
+	}
+
+	pages := map[string]page{
+		"/big.jpg":   {"image/jpeg", 200, true},
+		"/small.png": {"image/png", 10, false},
+		"/page.html": {"text/html", 200, false},
+		"/movie.mp4": {"video/mp4", -1, true},
+	}
+
+	var mu sync.Mutex
+	hooked := make(map[string]bool)
+
+	m := new(counters)
+	fs := &relay.FlowStore{MaxBodySize: 1024}
+	p := &relay.Proxy{
+		Passthrough: &relay.PassthroughPolicy{MinSize: 100},
+		Flows:       fs,
+		Metrics:     m,
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			pg := pages[strings.TrimPrefix(req.URI, "http://origin.test")]
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Type", pg.ctype)
+
+			// Bodies of unknown length always take the fast path.
+			body := strings.Repeat("x", 200)
+			if pg.size >= 0 {
+				body = body[:pg.size]
+				resp.Fields.Set("Content-Length", strconv.Itoa(pg.size))
+			}
+			resp.Body = io.NopCloser(strings.NewReader(body))
+			return resp, nil
+		},
+		OnResponse: func(s *relay.Session, req *heat.Request, resp *heat.Response) {
+			mu.Lock()
+			hooked[strings.TrimPrefix(req.URI, "http://origin.test")] = true
+			mu.Unlock()
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	for path := range pages {
+		io.WriteString(conn, "GET http://origin.test"+path+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		if body, _ := io.ReadAll(resp.Body); len(body) != 200 && len(body) != pages[path].size {
+			t.Errorf("%s: got %d bytes", path, len(body))
+		}
+		resp.Body.Close()
+	}
+	conn.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for path, pg := range pages {
+		if hooked[path] == pg.fast {
+			t.Errorf("%s: OnResponse called: %v", path, hooked[path])
+		}
+	}
+
+	if n := m.get("response.passthrough"); n != 2 {
+		t.Errorf("counted %d responses on the fast path, want 2", n)
+	}
+
+	// Flows record the headers of fast responses, but not their bodies.
+	flows := fs.Flows(nil)
+	if len(flows) != len(pages) {
+		t.Fatalf("got %d flows, want %d", len(flows), len(pages))
+	}
+	for _, f := range flows {
+		path := strings.TrimPrefix(f.Request.URI, "http://origin.test")
+		pg := pages[path]
+		if f.Passthrough != pg.fast || f.Response == nil {
+			t.Errorf("%s: flow has Passthrough %v and response %v", path, f.Passthrough, f.Response)
+		}
+		if captured := len(f.ResponseBody) > 0; captured == pg.fast {
+			t.Errorf("%s: captured %d bytes of the response", path, len(f.ResponseBody))
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+)
+
+// A PooledConn describes an idle upstream connection kept by a Transport.
+type PooledConn struct {
+	// The scheme and address of the upstream server (or parent proxy) the
+	// connection leads to.
+	Scheme string
+	Addr   string
+
+	LocalAddr  net.Addr
+	RemoteAddr net.Addr
+
+	// The protocol spoken over the connection, such as "HTTP/1.1 over
+	// TLS 1.3".
+	Protocol string
+
+	// When the connection was established, and when it became idle.
+	Created   time.Time
+	IdleSince time.Time
+
+	// Whether the connection has been taken from the pool before.
+	Reused bool
+}
+
+// IdleConns lists the transport's idle connections.
+func (t *Transport) IdleConns() []PooledConn {
+	var list []PooledConn
+
+	for i := range t.idle {
+		sh := &t.idle[i]
+		sh.mu.Lock()
+		for _, conns := range sh.conns {
+			for _, pc := range conns {
+				list = append(list, pc.describe())
+			}
+		}
+		sh.mu.Unlock()
+	}
+
+	return list
+}
+
+// Evict closes all idle connections to a host, given either as "host" or
+// "host:port". It returns the number of connections closed.
+func (t *Transport) Evict(host string) int {
+	return t.evict(func(pc *persistConn) bool {
+		return strings.EqualFold(pc.addr, host) || strings.EqualFold(hostname(pc.addr), host)
+	})
+}
+
+// EvictAll closes all idle connections, returning how many were closed.
+// Idle h2c connections (see Transport.H2CHosts) are closed too, but aren't
+// counted.
+func (t *Transport) EvictAll() int {
+	if len(t.H2CHosts) > 0 {
+		t.h2cTransport().CloseIdleConnections()
+	}
+
+	return t.evict(func(pc *persistConn) bool {
+		return true
+	})
+}
+
+func (t *Transport) evict(match func(pc *persistConn) bool) int {
+	n := 0
+	for i := range t.idle {
+		n += t.idle[i].evict(match)
+	}
+	return n
+}
+
+func (sh *idleShard) evict(match func(pc *persistConn) bool) int {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	n := 0
+
+	for key, conns := range sh.conns {
+		kept := conns[:0]
+		for _, pc := range conns {
+			if match(pc) {
+				pc.conn.Close()
+				n++
+			} else {
+				kept = append(kept, pc)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(sh.conns, key)
+		} else {
+			sh.conns[key] = kept
+		}
+	}
+
+	return n
+}
+
+// describe returns a description of the connection.
+func (pc *persistConn) describe() PooledConn {
+	protocol := "HTTP/1.1"
+	if tc, ok := pc.conn.(*tls.Conn); ok {
+		protocol += " over " + tls.VersionName(tc.ConnectionState().Version)
+	}
+
+	return PooledConn{
+		Scheme:     pc.scheme,
+		Addr:       pc.addr,
+		LocalAddr:  pc.conn.LocalAddr(),
+		RemoteAddr: pc.conn.RemoteAddr(),
+		Protocol:   protocol,
+		Created:    pc.created,
+		IdleSince:  pc.idleSince,
+		Reused:     pc.reused,
+	}
+}
@@ -0,0 +1,100 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+// idleConns waits for the transport's pool to hold n connections, and
+// returns them.
+func idleConns(t *testing.T, tr *relay.Transport, n int) []relay.PooledConn {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conns := tr.IdleConns()
+		if len(conns) == n {
+			return conns
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d idle connections, want %d", len(conns), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIdleConns(t *testing.T) {
+	ok := func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	}
+	first, second := upstream(t, ok), upstream(t, ok)
+
+	tr := &relay.Transport{}
+	conn := serve(t, &relay.Proxy{Transport: tr})
+	r := bufio.NewReader(conn)
+
+	get := func(addr string) {
+		io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		readFinal(t, conn, r)
+	}
+
+	get(first)
+	pc := idleConns(t, tr, 1)[0]
+	if pc.Scheme != "http" || pc.Addr != first || pc.RemoteAddr.String() != first || pc.Protocol != "HTTP/1.1" {
+		t.Errorf("got %+v", pc)
+	}
+	if pc.Reused || pc.Created.IsZero() || pc.IdleSince.Before(pc.Created) {
+		t.Errorf("got %+v", pc)
+	}
+
+	// Connections taken from the pool are marked as reused.
+	get(first)
+	if pc := idleConns(t, tr, 1)[0]; !pc.Reused {
+		t.Errorf("connection not marked as reused")
+	}
+
+	get(second)
+	idleConns(t, tr, 2)
+
+	// Connections can be evicted by host, or all at once.
+	if n := tr.Evict(first); n != 1 {
+		t.Errorf("Evict closed %d connections, want 1", n)
+	}
+	if pc := idleConns(t, tr, 1)[0]; pc.Addr != second {
+		t.Errorf("evicted the wrong connection")
+	}
+	if n := tr.EvictAll(); n != 1 {
+		t.Errorf("EvictAll closed %d connections, want 1", n)
+	}
+	idleConns(t, tr, 0)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	clients := make(chan string, 2)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		clients <- conn.RemoteAddr().String()
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	tr := &relay.Transport{IdleTimeout: 50 * time.Millisecond}
+	conn := serve(t, &relay.Proxy{Transport: tr})
+	r := bufio.NewReader(conn)
+
+	for i := 0; i < 2; i++ {
+		io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+		readFinal(t, conn, r)
+		idleConns(t, tr, 1)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// The first connection sat idle for too long to be reused.
+	if a, b := <-clients, <-clients; a == b {
+		t.Errorf("expired connection was reused")
+	}
+}
@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"github.com/erkl/heat"
+	"github.com/erkl/xo"
+)
+
+// A prefetch is the next request on a client connection, read in the
+// background while the response to the previous one is being written.
+type prefetch struct {
+	done chan struct{}
+	req  *heat.Request
+	body *bodyReader
+	tm   *timer
+	err  error
+}
+
+// prefetchRequest starts reading the next request from r, if p.PrefetchRequests
+// is set and the connection will be kept open. Nothing else may read from
+// r until the request has been collected with nextRequest.
+func (p *Proxy) prefetchRequest(s *Session, r xo.Reader, closing bool) *prefetch {
+	if !p.PrefetchRequests || closing {
+		return nil
+	}
+
+	pf := &prefetch{done: make(chan struct{})}
+
+	go func() {
+		defer close(pf.done)
+		pf.req, pf.body, pf.tm, pf.err = s.readTimedRequest(r)
+	}()
+
+	return pf
+}
+
+// nextRequest returns the next request in the session, as prefetched by pf
+// if it's non-nil, or read from r otherwise.
+func (s *Session) nextRequest(r xo.Reader, pf *prefetch) (*heat.Request, *bodyReader, error) {
+	if pf == nil {
+		return s.readRequest(r)
+	}
+
+	<-pf.done
+	if pf.err != nil {
+		return nil, nil, pf.err
+	}
+
+	s.timer = pf.tm
+	return pf.req, pf.body, nil
+}
@@ -0,0 +1,89 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+// The stalledBody type is a response body ending only once its channel is
+// closed.
+type stalledBody struct {
+	io.Reader
+	release chan struct{}
+}
+
+func (b *stalledBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		<-b.release
+	}
+	return n, err
+}
+
+func (b *stalledBody) Close() error { return nil }
+
+func TestPrefetchRequests(t *testing.T) {
+	for _, prefetch := range []bool{false, true} {
+		release := make(chan struct{})
+		m := new(counters)
+
+		p := &relay.Proxy{
+			Metrics:          m,
+			PrefetchRequests: prefetch,
+			Tolerate:         relay.Tolerance{URISpaces: true},
+			RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+				resp := heat.NewResponse(200, "OK")
+				if req.URI == "/first" {
+					resp.Body = &stalledBody{strings.NewReader(req.URI), release}
+				} else {
+					resp.Body = io.NopCloser(strings.NewReader(req.URI))
+				}
+				return resp, nil
+			},
+		}
+
+		// The second request's header counts a repaired violation when read.
+		conn := serve(t, p)
+		go io.WriteString(conn, "GET http://origin.test/first HTTP/1.1\r\nHost: origin.test\r\n\r\n"+
+			"GET http://origin.test/sec ond HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+
+		r := bufio.NewReader(conn)
+		resp := readFinal(t, conn, r)
+		buf := make([]byte, 6)
+		if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "/first" {
+			t.Fatalf("prefetch %v: got %q", prefetch, buf)
+		}
+
+		// While the first response is being written, the next request is
+		// only read if prefetching.
+		var want int64
+		if prefetch {
+			want = 1
+			deadline := time.Now().Add(time.Second)
+			for m.get("tolerated.uri_spaces") == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+		} else {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if got := m.get("tolerated.uri_spaces"); got != want {
+			t.Errorf("prefetch %v: counted %d repairs before the response was written", prefetch, got)
+		}
+
+		// Either way, the responses arrive in order.
+		close(release)
+		io.ReadAll(resp.Body)
+
+		resp = readFinal(t, conn, r)
+		if body, _ := io.ReadAll(resp.Body); string(body) != "/sec%20ond" {
+			t.Errorf("prefetch %v: got second response %q", prefetch, body)
+		}
+	}
+}
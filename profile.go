@@ -0,0 +1,53 @@
+package relay
+
+import (
+	"context"
+	"net/url"
+	"runtime/pprof"
+
+	"github.com/erkl/heat"
+)
+
+// Phases of serving a client, as labeled in CPU profiles (see
+// Proxy.ProfileLabels).
+const (
+	phaseRead      = "read"      // reading a request from the client
+	phaseHandshake = "handshake" // forging certificates, and TLS handshakes
+	phaseRequest   = "request"   // serving a request, until its response
+	phaseResponse  = "response"  // relaying a response to the client
+	phaseTunnel    = "tunnel"    // relaying tunnels and upgraded connections
+)
+
+// label labels the calling goroutine for CPU profiles with the host being
+// served (unless it's not known yet) and the phase of serving it, if
+// p.ProfileLabels is set. Goroutines started afterwards inherit the labels.
+func (p *Proxy) label(host, phase string) {
+	if !p.ProfileLabels {
+		return
+	}
+
+	labels := pprof.Labels("relay.phase", phase)
+	if host != "" {
+		labels = pprof.Labels("relay.host", host, "relay.phase", phase)
+	}
+
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), labels))
+}
+
+// labelHost returns the host a request read from a client is for, if it's
+// needed for labels.
+func (p *Proxy) labelHost(req *heat.Request) string {
+	if !p.ProfileLabels {
+		return ""
+	}
+	return destination(req)
+}
+
+// destination returns the host a request read from a client is for.
+func destination(req *heat.Request) string {
+	if u, err := url.ParseRequestURI(req.URI); err == nil && u.Host != "" {
+		return hostname(u.Host)
+	}
+	host, _ := fieldValue(req.Fields, "Host")
+	return hostname(host)
+}
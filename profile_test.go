@@ -0,0 +1,91 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"runtime/pprof"
+	"strings"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+// goroutineLabels returns the labels of the goroutines in the profile
+// whose stacks include fn, as printed by the profile.
+func goroutineLabels(t *testing.T, fn string) []string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var labels []string
+	for _, record := range strings.Split(buf.String(), "\n\n") {
+		if !strings.Contains(record, fn) {
+			continue
+		}
+		for _, line := range strings.Split(record, "\n") {
+			if strings.HasPrefix(line, "# labels: ") {
+				labels = append(labels, strings.TrimPrefix(line, "# labels: "))
+			}
+		}
+	}
+
+	return labels
+}
+
+// parkLabeled closes started, and blocks until release is closed. Goroutines
+// running it show up in profiles with the labels they inherited.
+func parkLabeled(started, release chan struct{}) {
+	close(started)
+	<-release
+}
+
+func TestProfileLabels(t *testing.T) {
+	served := make(chan struct{})
+	release := make(chan struct{})
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		close(served)
+		<-release
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	parked, park := make(chan struct{}), make(chan struct{})
+	defer close(park)
+
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels("embedder", "yes")))
+		err := (&relay.Proxy{ProfileLabels: true}).Serve(server)
+
+		// Leave a goroutine behind with the labels this one has now.
+		go parkLabeled(parked, park)
+		done <- err
+	}()
+
+	io.WriteString(client, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\nConnection: close\r\n\r\n")
+	<-served
+
+	// The goroutine serving the request is labeled with its host.
+	labels := strings.Join(goroutineLabels(t, "relay.(*Proxy).serveHTTP"), " ")
+	if !strings.Contains(labels, `"relay.host":"127.0.0.1"`) || !strings.Contains(labels, `"relay.phase":"request"`) {
+		t.Errorf("serving goroutine labeled %s", labels)
+	}
+
+	close(release)
+	readFinal(t, client, bufio.NewReader(client))
+	client.Close()
+	<-done
+	<-parked
+
+	// Serve's caller keeps its own labels.
+	if labels := goroutineLabels(t, "parkLabeled"); len(labels) != 1 || labels[0] != `{"embedder":"yes"}` {
+		t.Errorf("Serve's caller left with labels %q", labels)
+	}
+}
@@ -1,21 +1,855 @@
 package relay
 
 import (
+	"context"
 	"crypto/tls"
 	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
 
 	"github.com/erkl/heat"
 )
 
 type Proxy struct {
 	// If specified, this certificate will be used to sign SSL certificates
-	// for all HTTPS domains. If nil, HTTPS tunneling won't be supported.
+	// for all HTTPS domains. If nil, HTTPS tunneling won't be supported. Use
+	// SetAuthority to replace it while the proxy is running.
 	Authority *tls.Certificate
 
-	// Function used to serve HTTP requests. Must not be nil.
+	// Rules choosing a different authority for some tunnels, such as those
+	// requested by clients in a particular network. The first matching rule
+	// wins; if none match, Authority is used.
+	Authorities []AuthorityRule
+
+	// Secret from which the keys and serial numbers of forged certificates
+	// are derived, together with the host name, so that they stay the same
+	// across restarts without any state being stored. If empty, a digest of
+	// the signing authority's private key is used.
+	ForgeSecret []byte
+
+	// If true, forged certificates get freshly generated keys instead.
+	RandomKeys bool
+
+	// If true, keys and serial numbers are derived from the host name
+	// alone, regardless of the authority. This means every deployment
+	// presents the same key for a given host, and anyone can compute it.
+	// The keys differ from those forged by versions predating ForgeSecret,
+	// which relied on rsa.GenerateKey being deterministic.
+	LegacyForging bool
+
+	// Optional function called with a record of every certificate the proxy
+	// forges, for auditing purposes. See CertAuditLog.
+	AuditCertificate func(r *CertRecord)
+
+	// Rules making the proxy present deliberately defective certificates
+	// for some tunnels, so that clients' handling of certificate errors can
+	// be tested. The first matching rule wins. Never use in production.
+	CertFaults []CertFaultRule
+
+	// Rules signing requests before they're forwarded, such as with cloud
+	// credentials held only by the proxy. The first matching rule applies.
+	// Requests are signed after they've been captured in Flows, such that
+	// the credentials aren't recorded.
+	Signing []SigningRule
+
+	// Rules checking response bodies against the digests they're expected
+	// to have. The first matching rule applies.
+	VerifyRules []VerifyRule
+
+	// Rules having message bodies checked by Scanners, such as antivirus
+	// engines, before they're delivered. The first matching rule applies.
+	ScanRules []ScanRule
+
+	// Optional function called when a response body fails verification.
+	OnIntegrityFailure func(s *Session, req *heat.Request, err *IntegrityError)
+
+	// Provider of the secrets referenced in HeaderRules and Signing, as
+	// "${secret:NAME}". See SecretCache for caching them.
+	Secrets SecretProvider
+
+	// Rules making the proxy act as if upstream servers' clocks were off,
+	// in the certificates it forges and the Date fields of responses. The
+	// first matching rule applies. Never use in production.
+	ClockSkew []ClockSkewRule
+
+	// Rules emulating the bandwidth and latency of other networks, such as
+	// Profile3G, for some requests and tunnels. The first matching rule
+	// applies, on top of any throttling by Quotas or Users.
+	Shaping []ShapingRule
+
+	// Rules making the proxy delay, fail or damage some responses, so that
+	// it can serve as a chaos testing gateway. The first matching rule
+	// decides whether a request is affected. Never use in production.
+	Faults []FaultRule
+
+	// Optional function called when the server name a client sends in its
+	// TLS handshake differs from the host it asked to tunnel to. Returning
+	// a non-nil error aborts the handshake.
+	CheckServerName func(host, sni string) error
+
+	// Optional function deciding whether a CONNECT tunnel to addr should be
+	// intercepted. Tunnels which aren't intercepted are relayed opaquely.
+	// If nil, all tunnels are intercepted.
+	Intercept func(s *Session, addr string) bool
+
+	// If set, decisions about tunnels (whether to intercept them, and the
+	// certificates to present) are remembered per client and host, and
+	// reused when clients reconnect. Counted as "decisions.hit" and
+	// "decisions.miss".
+	Decisions *DecisionCache
+
+	// Transport used to dial opaque tunnels, and to forward requests when
+	// RoundTrip is nil. Defaults to DefaultTransport.
+	Transport *Transport
+
+	// If set, clients must authenticate before making requests or opening
+	// tunnels on plain HTTP connections.
+	Auth *ProxyAuth
+
+	// If set, policies bound to authenticated users are looked up here.
+	Users UserDirectory
+
+	// If true, connections passed to Serve must begin with a PROXY protocol
+	// header (version 1 or 2), as sent by load balancers such as HAProxy.
+	// The client address it contains is reported by Session.ClientAddr.
+	AcceptProxyProtocol bool
+
+	// If true, the protocol of connections passed to Serve is detected from
+	// the first bytes the client sends. Connections beginning with a TLS
+	// handshake (as redirected transparently) are treated like a CONNECT
+	// tunnel to port 443 of the server name in the handshake; everything
+	// else is served as HTTP. If AcceptProxyProtocol is also set, the PROXY
+	// protocol header becomes optional.
+	DetectProtocols bool
+
+	// If true, opaque tunnels begin with a PROXY protocol version 1 header
+	// describing the client's address.
+	SendProxyProtocol bool
+
+	// If true, the client's IP address is appended to the X-Forwarded-For
+	// header field of forwarded requests.
+	ForwardedFor bool
+
+	// Socket options applied to client connections passed to Serve.
+	ClientSocket SocketOptions
+
+	// If set, this name is added to the Via header field of forwarded
+	// requests and responses, and requests already carrying it are rejected
+	// with "508 Loop Detected". It should be unique to the deployment.
+	Via string
+
+	// If positive, requests which have already passed through this many
+	// proxies (according to their Via header fields) are rejected, as with
+	// loops. Only applies when Via is set.
+	MaxHops int
+
+	// If set, Strict-Transport-Security and Public-Key-Pins policies of
+	// HTTPS responses are recorded here. If HSTSUpgrade is also true, plain
+	// HTTP requests for hosts with such a policy are forwarded over HTTPS.
+	HSTS        *HSTSStore
+	HSTSUpgrade bool
+
+	// If true, TRACE requests are rejected with "405 Method Not Allowed".
+	DisableTrace bool
+
+	// If true, requests pipelined by clients (sent before the response to
+	// the previous request) are answered with "400 Bad Request", and the
+	// connection is closed. Otherwise they're served one at a time, in the
+	// order they were sent.
+	RejectPipelining bool
+
+	// If true, the header of the next request on a client connection is
+	// read while the response to the previous one is still being written,
+	// for clients sending requests back to back. HTTP/2 connections, whose
+	// streams could be served concurrently, are left to ServeH2C.
+	PrefetchRequests bool
+
+	// Optional function serving plaintext HTTP/2 connections from clients
+	// with prior knowledge of HTTP/2 support (h2c). The connection is passed
+	// on from its very first byte, and counts as a single request towards
+	// MaxRequests for as long as it's served. If nil, or if Auth is set (as
+	// clients can't authenticate before their connection is handed over),
+	// such clients are told to use HTTP/1.1 instead.
+	ServeH2C func(s *Session, conn net.Conn) error
+
+	// What to do with requests with relative URIs on plain HTTP connections,
+	// and where to send them when acting as a reverse proxy.
+	OriginForm OriginFormPolicy
+	Reverse    *url.URL
+
+	// URI schemes which requests may use, in lower case. Requests using
+	// any other scheme are answered with "501 Not Implemented". If nil,
+	// only "http" and "https" are allowed. The built-in Transport can also
+	// serve "ftp".
+	Schemes []string
+
+	// How request URIs are rewritten before they're forwarded: as they are,
+	// in canonical form (see CanonicalURL), or in canonical form with
+	// ambiguous URIs rejected.
+	URIs URIPolicy
+
+	// What to do with credentials embedded in request URIs.
+	Userinfo UserinfoPolicy
+
+	// If set, requests and responses are forwarded with as few changes as
+	// possible, for observing traffic without leaving a trace: their HTTP
+	// versions, header fields and the order of those fields are kept, and
+	// bodies are only re-framed for clients which can't parse them
+	// otherwise. Only the Proxy-Authorization and Proxy-Connection fields
+	// of requests received in plain HTTP are removed, and the Connection
+	// field of responses is only set when the connection to the client is
+	// closed without it saying so. Features configured to modify messages
+	// still do.
+	Bridge bool
+
+	// Adjusts which header fields are removed from requests forwarded in
+	// plain HTTP, and from their responses. If nil, the hop-by-hop fields
+	// are removed.
+	Scrub *ScrubPolicy
+
+	// Protocol violations tolerated in requests from clients. Repaired
+	// violations are counted as "tolerated.bare_lf", "tolerated.uri_spaces"
+	// and "tolerated.large_header". Those in responses are tolerated
+	// according to the Transport.
+	Tolerate Tolerance
+
+	// Functions serving requests for URLs with particular schemes (given in
+	// lower case), in place of RoundTrip. Registering a handler allows its
+	// scheme.
+	SchemeHandlers map[string]func(ctx context.Context, req *heat.Request) (*heat.Response, error)
+
+	// Function used to serve HTTP requests. If nil, requests are forwarded
+	// using the proxy's Transport.
+	//
+	// When a request asks for a protocol upgrade, and the upstream server
+	// agrees with a "101 Switching Protocols" response, the response's Body
+	// must implement io.ReadWriteCloser, giving access to the upstream
+	// connection.
 	RoundTrip func(req *heat.Request) (*heat.Response, error)
+
+	// Alternative to RoundTrip which also receives the request's context
+	// (see Session.Context). If set, RoundTrip is ignored.
+	RoundTripContext func(ctx context.Context, req *heat.Request) (*heat.Response, error)
+
+	// Name of a trusted header field through which clients may set an upstream
+	// deadline for individual requests, given in seconds or as a duration
+	// string ("1.5", "250ms"). The field is never forwarded. If empty, no
+	// such header field is recognized.
+	TimeoutHeader string
+
+	// Rules overriding the Host header field and upstream TLS server name
+	// of some requests. The first matching rule wins. Applied after
+	// HeaderRules.
+	Routes []RouteRule
+
+	// Rules choosing the local address of upstream connections for some
+	// requests and tunnels, when using the proxy's Transport. The first
+	// matching rule wins; if none match, Transport.LocalAddrs applies.
+	Egress []EgressRule
+
+	// If set, requests to upstream hosts which keep failing are answered
+	// with "502 Bad Gateway" without being forwarded, until the host
+	// recovers.
+	Breaker *CircuitBreaker
+
+	// Rules limiting how long upstream servers may take to respond to some
+	// requests, and when they're considered slow. The first matching rule
+	// wins.
+	Latency []LatencyRule
+
+	// Header modifications applied to every forwarded request and response,
+	// in order, before the OnRequest and OnResponse hooks are called.
+	HeaderRules []HeaderRule
+
+	// Security header policies for forwarded responses, enforced before
+	// HeaderRules are applied. The first matching rule wins.
+	SecurityHeaders []SecurityRule
+
+	// Policies for the Alt-Svc header field of forwarded responses, applied
+	// before HeaderRules. The first matching rule wins; responses matching
+	// none are left alone.
+	AltSvc []AltSvcRule
+
+	// Rules rewriting references to upstream origins in forwarded responses,
+	// such as redirects, to the origins clients see. The first matching rule
+	// wins.
+	Redirects []RedirectRule
+
+	// Rules rewriting the attributes of cookies set by forwarded responses,
+	// applied after Redirects. Each cookie is rewritten by the first rule
+	// matching both the request and the cookie's name.
+	Cookies []CookieRule
+
+	// Rules inserting snippets of markup into forwarded HTML pages. The
+	// first matching rule wins.
+	Injections []InjectRule
+
+	// If set, matching binary responses skip body transformations and
+	// hooks. See PassthroughPolicy.
+	Passthrough *PassthroughPolicy
+
+	// If non-nil, the Accept-Encoding header field of forwarded requests is
+	// restricted to these content codings (such as "gzip"), and responses
+	// using any other coding the proxy knows how to decode are decoded before
+	// reaching the OnResponse hook.
+	AcceptEncoding []string
+
+	// If true, Range and If-Range header fields are removed from forwarded
+	// requests, so that hooks which rewrite response bodies always see the
+	// full representation rather than a fragment of it.
+	StripRanges bool
+
+	// If true, a Server-Timing header field summarizing the time spent
+	// connecting to the upstream server and waiting for its response (see
+	// Timings) is added to responses, so that it shows up in browsers'
+	// developer tools. It's added after header field rules are applied, and
+	// any Server-Timing fields sent by the server are kept.
+	ServerTiming bool
+
+	// Maximum number of bytes of a spooled message body (see
+	// Session.SpoolRequest) to keep in memory. Larger bodies are written to
+	// temporary files in SpoolDir. Defaults to 1 MiB.
+	SpoolMemory int64
+
+	// Directory for temporary spool files. Defaults to os.TempDir().
+	SpoolDir string
+
+	// If positive, forwarded message bodies are relayed through a buffer
+	// holding up to this many bytes, per direction and exchange. Data is
+	// read ahead from the sender while the receiver catches up, but never
+	// further, so that a slow client throttles reads from the upstream
+	// server, and a slow upstream server throttles reads from the client.
+	// Bodies returned by custom RoundTrip functions must then allow Close
+	// to be called while a Read is in progress.
+	BodyBuffer int
+
+	// If set, the memory used by body buffers, spools, and bodies held while
+	// scanned is accounted for, and kept within the budget's ceilings. The
+	// same budget is usually set as Flows.Memory and Decisions.Memory.
+	Memory *MemoryBudget
+
+	// Optional function called whenever serving a request fails. If it
+	// returns a non-nil response, that response is sent to the client in
+	// place of the default error message. Errors which end the connection
+	// are also returned by Serve.
+	ErrorHandler func(s *Session, req *heat.Request, err error) *heat.Response
+
+	// Maximum number of client connections, and requests, served at the same
+	// time. When either limit is hit, further requests are answered with
+	// "503 Service Unavailable". Zero means no limit.
+	MaxConns    int
+	MaxRequests int
+
+	// Value of the Retry-After header field sent along with 503 responses
+	// when shedding load. Defaults to one second.
+	RetryAfter time.Duration
+
+	// Exchanges matching any of these breakpoints are paused, and sent to
+	// the Paused channel. Each Pause must be resolved by calling either its
+	// Continue or Reply method. If Paused is nil, breakpoints are ignored.
+	Breakpoints []Breakpoint
+	Paused      chan<- *Pause
+
+	// If set, every exchange is recorded in this store.
+	Flows *FlowStore
+
+	// If set, removes sensitive data from the exchanges recorded in Flows,
+	// and from the destinations of decision records.
+	Redact *Redactor
+
+	// Clock used for request timeouts, and for backing off in
+	// ServeListener. Defaults to the system clock.
+	Clock Clock
+
+	// If set, receives counters describing the proxy's operation.
+	Metrics Metrics
+
+	// If true, the goroutines serving clients are labeled for CPU profiles
+	// (see runtime/pprof) with "relay.host", the host being served, and
+	// "relay.phase": one of "read", "handshake", "request", "response" and
+	// "tunnel". Goroutines they start, such as those relaying tunnels,
+	// inherit the labels. Each connection is then served on a goroutine of
+	// its own, leaving the labels of the goroutine calling Serve as they
+	// were.
+	ProfileLabels bool
+
+	// If set, told how many bytes each client sends to and receives from
+	// each upstream host, through forwarded messages and tunnels. See
+	// UsageMeter.
+	Usage UsageRecorder
+
+	// If set, requests and tunnels are subject to the quotas in this store.
+	Quotas *QuotaStore
+
+	// Optional function called with a record of every request or tunnel
+	// the proxy's policies allow, deny or rewrite, for auditing purposes.
+	// See DecisionAuditLog.
+	AuditDecision func(r *DecisionRecord)
+
+	// Optional function called once for every new client connection, before
+	// any requests are read. Typically used to populate the session's cookie
+	// jar and sticky header fields.
+	OnSession func(s *Session)
+
+	// Optional function called for every CONNECT request. If it returns a
+	// non-nil response, that response is sent to the client instead of
+	// opening the tunnel.
+	OnConnect func(s *Session, req *heat.Request) *heat.Response
+
+	// Optional function called before a request is passed to RoundTrip. If
+	// it returns a non-nil response, that response will be sent to the
+	// client and RoundTrip won't be called.
+	OnRequest func(s *Session, req *heat.Request) *heat.Response
+
+	// Optional function called with every response returned by RoundTrip,
+	// before it's sent to the client. Responses taking the fast path (see
+	// Passthrough) are skipped.
+	OnResponse func(s *Session, req *heat.Request, resp *heat.Response)
+
+	// Optional function called when an upstream server takes longer to
+	// respond to a request than its LatencyRule considers acceptable, with
+	// the time it took.
+	OnSlowResponse func(s *Session, req *heat.Request, d time.Duration)
+
+	// Optional function called once a response has been written to the
+	// client, with the time each phase of the exchange took, for access
+	// logs and the like. The response's body has been consumed.
+	OnComplete func(s *Session, req *heat.Request, resp *heat.Response, t Timings)
+
+	// If set, OnComplete is only called for the exchanges it samples. The
+	// rest are counted by the "complete.unsampled" metric. Timing metrics
+	// cover all exchanges regardless.
+	LogSample *Sampler
+
+	// Optional function called with every event of text/event-stream
+	// responses, and every line of NDJSON ones, as they're relayed. It may
+	// modify the event, and returns false to drop it. Such responses are
+	// decompressed, and sent chunked. Events larger than 1 MiB are relayed
+	// without being split, along with the rest of their stream.
+	OnStreamEvent func(s *Session, req *heat.Request, resp *heat.Response, e *StreamEvent) bool
+
+	// If set, GraphQL operations are detected in requests.
+	GraphQL *GraphQLConfig
+
+	// Rules modifying the JSON bodies of requests and responses, applied in
+	// order. Bodies larger than MaxJSONBody (1 MiB by default) are left
+	// alone.
+	JSONRules   []JSONRule
+	MaxJSONBody int64
+
+	// Optional function called with every part of multipart/form-data
+	// request bodies, such as uploaded files, as they're forwarded (see
+	// FilterMultipart), from another goroutine. It may modify, drop or
+	// replace the part; returning an error abandons the request.
+	OnFormPart func(s *Session, req *heat.Request, part *FormPart) error
+
+	// Optional function called with every text or binary message relayed
+	// over WebSocket connections, once reassembled from its fragments. It
+	// may modify the message, and returns false to drop it. Control frames
+	// are relayed as they are. When set, WebSocket handshakes are forwarded
+	// without their Sec-WebSocket-Extensions field, so that messages aren't
+	// compressed.
+	OnWebSocketMessage func(s *Session, req *heat.Request, m *WebSocketMessage) bool
+
+	// Maximum size of a WebSocket message passed to OnWebSocketMessage, or
+	// frame recorded in Flows. Connections sending larger ones are closed.
+	// Defaults to 16 MiB.
+	MaxWebSocketMessage int
+
+	conns    int64
+	requests int64
+	draining int32
+	ca       atomic.Value
+}
+
+// SetAuthority replaces the proxy's signing certificate (see Authority)
+// while it's running. Tunnels opened after the call use the new authority;
+// existing ones keep the certificate they were given. Decisions cached by
+// p.Decisions are purged.
+func (p *Proxy) SetAuthority(ca *tls.Certificate) {
+	p.ca.Store(authority{ca})
+	if p.Decisions != nil {
+		p.Decisions.Purge()
+	}
+}
+
+// The authority type wraps certificates stored in Proxy.ca, as atomic.Value
+// can't hold nil.
+type authority struct {
+	cert *tls.Certificate
+}
+
+// authority returns the proxy's current signing certificate.
+func (p *Proxy) authority() *tls.Certificate {
+	if v, ok := p.ca.Load().(authority); ok {
+		return v.cert
+	}
+	return p.Authority
 }
 
 func (p *Proxy) Serve(conn net.Conn) error {
-	return p.serveHTTP(conn)
+	return p.serve(conn, nil)
+}
+
+func (p *Proxy) serve(conn net.Conn, cfg *ListenerConfig) error {
+	// Labels are set on a goroutine of the connection's own, as there's no
+	// way of restoring the calling goroutine's labels afterwards. It starts
+	// out with those labels, however.
+	if p.ProfileLabels {
+		done := make(chan error, 1)
+		go func() {
+			done <- p.serveClient(conn, cfg)
+		}()
+		return <-done
+	}
+
+	return p.serveClient(conn, cfg)
+}
+
+// serveClient serves a connection, reading any PROXY protocol header first.
+func (p *Proxy) serveClient(conn net.Conn, cfg *ListenerConfig) (err error) {
+	defer recoverPanic(&err)
+
+	if err := p.ClientSocket.apply(conn, true); err != nil {
+		return &ClientAbort{err}
+	}
+
+	// Find out who the client really is.
+	if p.AcceptProxyProtocol || (cfg != nil && cfg.AcceptProxyProtocol) {
+		if conn, err = acceptProxyHeader(conn, p.DetectProtocols || (cfg != nil && cfg.DetectProtocols)); err != nil {
+			return &ClientAbort{err}
+		}
+	}
+
+	return p.serveConn(conn, cfg)
+}
+
+// serveConn serves a connection whose client is known, having read any
+// PROXY protocol header.
+func (p *Proxy) serveConn(conn net.Conn, cfg *ListenerConfig) error {
+	detect := p.DetectProtocols || (cfg != nil && cfg.DetectProtocols)
+
+	s := &Session{Conn: conn, ClientAddr: conn.RemoteAddr(), Listener: cfg, proxy: p}
+	defer s.release()
+
+	// Is this connection over the limit?
+	n := atomic.AddInt64(&p.conns, 1)
+	defer atomic.AddInt64(&p.conns, -1)
+
+	s.shed = p.MaxConns > 0 && n > int64(p.MaxConns)
+
+	if p.OnSession != nil {
+		p.OnSession(s)
+	}
+
+	if detect {
+		return clientError(p.serveDetected(s, conn))
+	}
+
+	return clientError(p.serveHTTP(s, conn))
+}
+
+// roundTrip passes a request through the session and any hooks before
+// handing it off to p.RoundTrip. Panics are recovered and returned as errors.
+func (p *Proxy) roundTrip(s *Session, req *heat.Request) (resp *heat.Response, err error) {
+	defer recoverPanic(&err)
+
+	s.begin(p.requestContext(s, req))
+	if !p.Bridge {
+		ensureHost(req)
+	}
+
+	// Don't go around in circles.
+	if err := p.checkVia(req); err != nil {
+		return nil, err
+	}
+
+	if resp := p.maxForwards(s, req); resp != nil {
+		return resp, nil
+	}
+
+	s.prepare(req)
+	p.detectGraphQL(s, req)
+
+	if p.ForwardedFor {
+		s.forwardedFor(req)
+	}
+
+	if err := p.applyRequestRules(s, req); err != nil {
+		return nil, err
+	}
+	ctx := p.route(s.ctx, s, req)
+	if s.Conn != nil {
+		ctx = withInterrupt(ctx, s.interruptClient)
+	}
+	ctx = p.egress(ctx, s, req)
+	ctx = withTimer(ctx, s.timer)
+	if p.Bridge {
+		ctx = withBridge(ctx)
+	}
+
+	if p.OnRequest != nil {
+		if resp := p.OnRequest(s, req); resp != nil {
+			p.decide(s, req, "", &DecisionRecord{Action: "deny", Rule: "OnRequest", Reason: resp.Reason})
+			return resp, nil
+		}
+	}
+
+	if resp, err := p.pauseRequest(s, req); resp != nil || err != nil {
+		return resp, err
+	}
+
+	if p.AcceptEncoding != nil {
+		restrictEncodings(req, p.AcceptEncoding)
+	}
+
+	injection := p.injection(s, req)
+	if injection >= 0 {
+		restrictEncodings(req, injectEncodings)
+	}
+
+	if p.HSTS != nil && p.HSTSUpgrade {
+		if upgradeStrict(p.HSTS, req) {
+			p.decide(s, req, "", &DecisionRecord{Action: "rewrite", Rule: "HSTSUpgrade", Reason: "upgraded to https"})
+		}
+	}
+
+	p.filterForm(s, req)
+	p.patchJSONRequest(s, req)
+
+	_, ranged := fieldValue(req.Fields, "Range")
+	if p.StripRanges {
+		stripRanges(req)
+		ranged = false
+	}
+
+	var f *Flow
+
+	if p.Flows != nil && p.Flows.Capture.Request(s, req) {
+		if !p.Flows.Sample.Sample(s, req) {
+			p.count("flows.unsampled", 1)
+		} else if f, err = p.Flows.begin(s, req, p.Redact); err != nil {
+			return nil, err
+		}
+	}
+
+	// Refuse requests for internal hosts before anything is sent.
+	if req.Remote != "" {
+		if err = p.checkGuard(ctx, s, req, withPort(req.Remote, req.Scheme)); err != nil {
+			if f != nil {
+				p.Flows.finish(s, f, nil, err)
+			}
+			return nil, err
+		}
+	}
+
+	rate, err := p.checkQuota(s, req, req.Remote)
+	if err == nil {
+		rate, err = p.checkUser(s, req, req.Remote, rate)
+	}
+	if err != nil {
+		if f != nil {
+			p.Flows.finish(s, f, nil, err)
+		}
+		return nil, err
+	}
+
+	if err = p.scanRequest(s, req); err != nil {
+		if f != nil {
+			p.Flows.finish(s, f, nil, err)
+		}
+		return nil, err
+	}
+
+	if err = p.sign(s, req); err != nil {
+		if f != nil {
+			p.Flows.finish(s, f, nil, err)
+		}
+		return nil, err
+	}
+
+	if p.metering() {
+		p.meterRequest(s, req)
+	}
+	if rate > 0 && req.Body != nil {
+		req.Body = &throttledBody{req.Body, newThrottle(p, rate)}
+	}
+
+	shaping, err := p.shape(ctx, s, req, req.Remote)
+	if err != nil {
+		if f != nil {
+			p.Flows.finish(s, f, nil, err)
+		}
+		return nil, err
+	}
+	if shaping != nil {
+		shaping.shapeRequest(p, req)
+	}
+	if p.BodyBuffer > 0 && req.Body != nil {
+		buffered := p.buffer(req.Body, false, interrupter(ctx))
+		req.Body = buffered
+
+		// The body may be uploaded for as long as the response's body is
+		// being read, so the buffer is only let go of after that.
+		defer func() {
+			if err == nil && resp != nil && resp.Body != nil && resp.Status != 101 {
+				resp.Body = &closingBody{resp.Body, buffered}
+			} else {
+				buffered.Close()
+			}
+		}()
+	}
+
+	// The breaker is consulted last, as once it has let a request through
+	// (possibly as the probe of a half-open circuit), it must be told how
+	// the request went.
+	if p.Breaker != nil {
+		if !p.Breaker.allow(req.Remote) {
+			err = ErrCircuitOpen
+			if f != nil {
+				p.Flows.finish(s, f, nil, err)
+			}
+			return nil, err
+		}
+	}
+
+	fault := p.fault(s, req)
+
+	sent := s.timer.now()
+	resp, err = p.sendFaulty(ctx, s, req, fault)
+	if err == nil {
+		d := s.timer.since(sent)
+		s.timer.record(func(t *Timings) {
+			t.TTFB = max(d-t.DNS-t.Dial-t.TLS, 0)
+		})
+	}
+	if p.Breaker != nil {
+		p.Breaker.done(req.Remote, err)
+	}
+	if err != nil {
+		if f != nil {
+			p.Flows.finish(s, f, nil, err)
+		}
+		return nil, err
+	}
+
+	if resp.Body != nil && resp.Status != 101 {
+		if p.BodyBuffer > 0 {
+			resp.Body = p.buffer(resp.Body, true, nil)
+		}
+		if s.timer != nil {
+			resp.Body = &timedBody{ReadCloser: resp.Body, tm: s.timer, start: s.timer.now(), phase: func(t *Timings) *time.Duration {
+				return &t.UpstreamBody
+			}}
+		}
+		resp.Body = upstreamBody{resp.Body}
+	}
+
+	if fault >= 0 {
+		p.Faults[fault].apply(resp)
+	}
+
+	if err := p.verify(s, req, resp); err != nil {
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		if f != nil {
+			p.Flows.finish(s, f, nil, err)
+		}
+		return nil, err
+	}
+
+	if err := p.scanResponse(s, req, resp); err != nil {
+		if f != nil {
+			p.Flows.finish(s, f, nil, err)
+		}
+		return nil, err
+	}
+
+	p.watchGraphQL(s, resp)
+
+	if p.metering() {
+		p.meterResponse(s, req, resp)
+	}
+	if rate > 0 {
+		p.throttleResponse(resp, rate)
+	}
+	if shaping != nil {
+		shaping.shapeResponse(p, resp)
+	}
+
+	if err := checkPartial(resp, ranged); err != nil {
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		err = &UpstreamProtocolError{err}
+		if f != nil {
+			p.Flows.finish(s, f, nil, err)
+		}
+		return nil, err
+	}
+
+	if p.HSTS != nil && req.Scheme == "https" {
+		p.HSTS.observe(req.Remote, resp.Fields)
+	}
+
+	fast := p.passthrough(resp)
+
+	if p.AcceptEncoding != nil && !fast {
+		decodeResponse(resp, p.AcceptEncoding)
+	}
+
+	if injection >= 0 && !fast {
+		p.inject(s, req, resp, injection)
+	}
+
+	if !fast {
+		p.patchJSONResponse(s, req, resp)
+	}
+
+	if p.OnStreamEvent != nil && !fast {
+		p.splitEvents(s, req, resp)
+	}
+
+	if p.Via != "" {
+		addVia(&resp.Fields, resp.Major, resp.Minor, p.Via)
+	}
+
+	s.capture(req, resp)
+	p.applySecurityRules(s, req, resp)
+	p.applyAltSvcRules(s, req, resp)
+	p.applyClockSkew(s, req, resp)
+
+	if err := p.applyRedirectRules(s, req, resp); err != nil {
+		if f != nil {
+			p.Flows.finish(s, f, nil, err)
+		}
+		return nil, &UpstreamProtocolError{err}
+	}
+
+	p.applyCookieRules(s, req, resp)
+	p.applyResponseRules(s, req, resp)
+
+	if p.OnResponse != nil && !fast {
+		p.OnResponse(s, req, resp)
+	}
+
+	if !fast {
+		if resp, err = p.pauseResponse(s, req, resp); err != nil {
+			if f != nil {
+				p.Flows.finish(s, f, nil, err)
+			}
+			return nil, err
+		}
+	}
+
+	if f != nil {
+		if fast {
+			p.Flows.skipBody(f)
+		}
+		p.Flows.finish(s, f, resp, nil)
+	}
+
+	return resp, nil
 }
@@ -0,0 +1,183 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errProxyHeader = errors.New("relay: malformed PROXY protocol header")
+
+// The signature with which all PROXY protocol v2 headers begin.
+var proxySignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The proxiedConn type wraps a connection whose addresses were read from a
+// PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, if
+// supported.
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// acceptProxyHeader reads a PROXY protocol header from conn, which is
+// optional if the connection's protocol is to be detected.
+func acceptProxyHeader(conn net.Conn, detect bool) (net.Conn, error) {
+	if detect {
+		return readOptionalProxyHeader(conn)
+	}
+	return readProxyHeader(conn)
+}
+
+// readProxyHeader reads a PROXY protocol (version 1 or 2) header from conn,
+// returning a connection reporting the addresses it contains.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	// Both versions' headers are at least 12 bytes long.
+	var buf = make([]byte, 12, 108)
+
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(buf, proxySignature) {
+		return readProxyHeaderV2(conn)
+	}
+
+	if !bytes.HasPrefix(buf, []byte("PROXY ")) {
+		return nil, errProxyHeader
+	}
+
+	// Read the rest of the line, one byte at a time so we don't consume
+	// anything past it.
+	var b [1]byte
+
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) == cap(buf) {
+			return nil, errProxyHeader
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return nil, err
+		}
+		buf = append(buf, b[0])
+	}
+
+	words := strings.Split(string(buf[6:len(buf)-2]), " ")
+
+	switch {
+	case len(words) == 1 && words[0] == "UNKNOWN":
+		return conn, nil
+	case len(words) == 5 && (words[0] == "TCP4" || words[0] == "TCP6"):
+		remote, err1 := parseTCPAddr(words[1], words[3])
+		local, err2 := parseTCPAddr(words[2], words[4])
+		if err1 != nil || err2 != nil {
+			return nil, errProxyHeader
+		}
+		return &proxiedConn{conn, remote, local}, nil
+	default:
+		return nil, errProxyHeader
+	}
+}
+
+func readProxyHeaderV2(conn net.Conn) (net.Conn, error) {
+	var hdr [4]byte
+
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[0]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL commands are health checks from the load balancer itself, and
+	// should keep the connection's real addresses.
+	if hdr[0]&0xf == 0 {
+		return conn, nil
+	}
+
+	var n int
+
+	switch hdr[1] {
+	case 0x11: // TCP over IPv4.
+		n = 4
+	case 0x21: // TCP over IPv6.
+		n = 16
+	default:
+		return conn, nil
+	}
+
+	if len(body) < 2*n+4 {
+		return nil, errProxyHeader
+	}
+
+	remote := &net.TCPAddr{
+		IP:   net.IP(body[:n]),
+		Port: int(binary.BigEndian.Uint16(body[2*n:])),
+	}
+	local := &net.TCPAddr{
+		IP:   net.IP(body[n : 2*n]),
+		Port: int(binary.BigEndian.Uint16(body[2*n+2:])),
+	}
+
+	return &proxiedConn{conn, remote, local}, nil
+}
+
+func parseTCPAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errProxyHeader
+	}
+
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(n)}, nil
+}
+
+// writeProxyHeader writes a PROXY protocol version 1 header to an upstream
+// connection on behalf of a client.
+func writeProxyHeader(w io.Writer, client, upstream net.Addr) error {
+	src, ok1 := client.(*net.TCPAddr)
+	dst, ok2 := upstream.(*net.TCPAddr)
+
+	if !ok1 || !ok2 || (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+		return err
+	}
+
+	proto := "TCP4"
+	if src.IP.To4() == nil {
+		proto = "TCP6"
+	}
+
+	_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, src.IP, dst.IP, src.Port, dst.Port)
+	return err
+}
@@ -0,0 +1,91 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	// Version 2 header for TCP over IPv4, from 203.0.113.7:51234.
+	v2 := append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c"),
+		203, 0, 113, 7, 192, 0, 2, 1, 0xc8, 0x22, 0, 80)
+
+	headers := map[string]string{
+		"v1": "PROXY TCP4 203.0.113.7 192.0.2.1 51234 80\r\n",
+		"v2": string(v2),
+	}
+
+	for name, header := range headers {
+		t.Run(name, func(t *testing.T) {
+			seen := make(chan *http.Request, 1)
+			addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+				seen <- req
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+			})
+
+			var client net.Addr
+			p := &relay.Proxy{
+				RoundTrip:           roundTrip,
+				AcceptProxyProtocol: true,
+				ForwardedFor:        true,
+				OnSession: func(s *relay.Session) {
+					client = s.ClientAddr
+				},
+			}
+
+			conn := serve(t, p)
+			io.WriteString(conn, header+"GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+			readFinal(t, conn, bufio.NewReader(conn))
+
+			if client == nil || client.String() != "203.0.113.7:51234" {
+				t.Errorf("got client address %v, want 203.0.113.7:51234", client)
+			}
+			if got := (<-seen).Header.Get("X-Forwarded-For"); got != "203.0.113.7" {
+				t.Errorf("X-Forwarded-For: got %q, want 203.0.113.7", got)
+			}
+		})
+	}
+}
+
+func TestAcceptProxyProtocolMalformed(t *testing.T) {
+	conn := serve(t, &relay.Proxy{RoundTrip: roundTrip, AcceptProxyProtocol: true})
+	io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	// The connection is dropped without a response.
+	if buf, err := io.ReadAll(conn); err != nil || len(buf) != 0 {
+		t.Errorf("got %q (%v), want the connection closed", buf, err)
+	}
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	header := make(chan string, 1)
+	addr := rawUpstream(t, func(conn *net.TCPConn) {
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		header <- line
+	})
+
+	p := &relay.Proxy{
+		RoundTrip:           roundTrip,
+		AcceptProxyProtocol: true,
+		SendProxyProtocol:   true,
+		Intercept:           func(s *relay.Session, addr string) bool { return false },
+	}
+
+	conn := serve(t, p)
+	io.WriteString(conn, "PROXY TCP4 203.0.113.7 192.0.2.1 51234 443\r\n"+
+		"CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 200 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	_, port, _ := net.SplitHostPort(addr)
+	want := "PROXY TCP4 203.0.113.7 127.0.0.1 51234 " + port + "\r\n"
+	if got := <-header; got != want {
+		t.Errorf("upstream got header %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,518 @@
+package relay
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// A QuotaPeriod is the interval after which quotas are reset.
+type QuotaPeriod int
+
+const (
+	// Quotas are reset at midnight.
+	QuotaDaily QuotaPeriod = iota
+
+	// Quotas are reset at midnight on the first day of each month.
+	QuotaMonthly
+)
+
+// A QuotaAction decides what happens to clients who have exceeded a quota.
+type QuotaAction int
+
+const (
+	// Requests and tunnels are answered with "429 Too Many Requests".
+	QuotaBlock QuotaAction = iota
+
+	// Requests and tunnels are answered with "403 Forbidden".
+	QuotaDeny
+
+	// Transfers are slowed down to the quota's Rate.
+	QuotaThrottle
+
+	// Nothing happens, other than QuotaStore.OnExceeded being called.
+	QuotaNotify
+)
+
+// A Quota limits the amount of data and number of requests (including
+// tunnels) each client may use per day or month.
+type Quota struct {
+	// Requests and tunnels the quota applies to. Only host and client
+	// conditions are considered. If nil, everything matches.
+	Match *Match
+
+	// How often the quota is reset.
+	Period QuotaPeriod
+
+	// Maximum number of bytes sent and received, and of requests made.
+	// Zero means no limit.
+	Bytes    int64
+	Requests int64
+
+	// What to do once the quota has been exceeded.
+	Action QuotaAction
+
+	// Bytes per second each transfer is limited to when throttling.
+	Rate int64
+}
+
+// A QuotaStore keeps track of how much of their quotas clients have used,
+// and decides what happens to their requests once those run out. It's
+// safe for concurrent use.
+type QuotaStore struct {
+	// The quotas to enforce. Every matching quota applies; when several
+	// have been exceeded, the first one decides what happens.
+	Quotas []Quota
+
+	// Optional function identifying the client of a session. Defaults to
+	// s.User if set, and the IP address in s.ClientAddr otherwise.
+	Identify func(s *Session) string
+
+	// Optional function called when a client first exceeds a quota in a
+	// period.
+	OnExceeded func(s *Session, client string, q *Quota)
+
+	// Clock determining when periods begin, in its local time zone.
+	// Defaults to the system clock.
+	Clock Clock
+
+	// If set, usage is written to Storage under "quota/<index>/<client>"
+	// as it changes, and read back for clients the store hasn't seen yet,
+	// so that it survives restarts and can be shared between proxies.
+	Storage Storage
+
+	// How long changes to usage may go unwritten to Storage, such that
+	// metered transfers don't each cause a write. Usage is written right
+	// away when a quota is exceeded. Zero means 10 seconds.
+	PersistInterval time.Duration
+
+	mu    sync.Mutex
+	state map[quotaKey]*quotaState
+
+	// Usage yet to be written to Storage, and the timer which will.
+	// Writes are serialized by flushing.
+	dirty    map[quotaKey]*quotaState
+	timer    Timer
+	flushing sync.Mutex
+}
+
+type quotaKey struct {
+	quota  int
+	client string
+}
+
+// String returns the key under which the usage is kept in a Storage.
+func (k quotaKey) String() string {
+	return "quota/" + strconv.Itoa(k.quota) + "/" + url.PathEscape(k.client)
+}
+
+type quotaState struct {
+	Start    time.Time `json:"start"`
+	Bytes    int64     `json:"bytes"`
+	Requests int64     `json:"requests"`
+	Exceeded bool      `json:"exceeded,omitempty"`
+
+	key quotaKey
+}
+
+// A QuotaExceeded error is returned for requests and tunnels refused because
+// their client has exceeded a quota.
+type QuotaExceeded struct {
+	Client string
+	Quota  *Quota
+
+	// When the quota will be reset.
+	Reset time.Time
+}
+
+func (e *QuotaExceeded) Error() string {
+	return "relay: quota exceeded by " + e.Client
+}
+
+// RecordUsage counts transferred bytes against the client's quotas. The
+// proxy calls it for stores set as Proxy.Quotas.
+func (qs *QuotaStore) RecordUsage(s *Session, host string, sent, received int64) {
+	qs.each(s, host, func(st *quotaState, q *Quota) {
+		st.Bytes += sent + received
+	})
+}
+
+// admit counts a request or tunnel to host against the client's quotas. It
+// returns the first exceeded quota whose action isn't QuotaNotify, if any.
+// Refused requests aren't counted.
+func (qs *QuotaStore) admit(s *Session, host string) (*Quota, *QuotaExceeded) {
+	var action *Quota
+	var refused *QuotaExceeded
+	var counted []*quotaState
+
+	qs.each(s, host, func(st *quotaState, q *Quota) {
+		if !exceeded(st, q) {
+			counted = append(counted, st)
+			return
+		}
+		if action != nil || q.Action == QuotaNotify {
+			return
+		}
+
+		action = q
+		if q.Action != QuotaThrottle {
+			refused = &QuotaExceeded{qs.identify(s), q, q.Period.next(st.Start)}
+		}
+	})
+
+	if refused == nil {
+		qs.mu.Lock()
+		for _, st := range counted {
+			st.Requests++
+			qs.changed(st)
+		}
+		qs.mu.Unlock()
+	}
+
+	return action, refused
+}
+
+// each calls f with the state of every quota matching the client and host,
+// calling qs.OnExceeded for quotas exceeded for the first time in the current period.
+func (qs *QuotaStore) each(s *Session, host string, f func(st *quotaState, q *Quota)) {
+	client := qs.identify(s)
+	now := qs.now()
+
+	var notices []*Quota
+
+	qs.mu.Lock()
+
+	for i := range qs.Quotas {
+		q := &qs.Quotas[i]
+		if !q.Match.Connect(s, host) {
+			continue
+		}
+
+		st := qs.lookup(quotaKey{i, client}, q.Period.start(now))
+
+		f(st, q)
+
+		if !st.Exceeded && exceeded(st, q) {
+			st.Exceeded = true
+			notices = append(notices, q)
+		}
+
+		qs.changed(st)
+	}
+
+	qs.mu.Unlock()
+
+	if len(notices) > 0 {
+		qs.Flush()
+	}
+
+	if qs.OnExceeded != nil {
+		for _, q := range notices {
+			qs.OnExceeded(s, client, q)
+		}
+	}
+}
+
+// Usage returns how many bytes and requests a client has used of a quota in
+// the current period.
+func (qs *QuotaStore) Usage(client string, q *Quota) (bytes, requests int64) {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	for i := range qs.Quotas {
+		if &qs.Quotas[i] != q {
+			continue
+		}
+		st := qs.lookup(quotaKey{i, client}, q.Period.start(qs.now()))
+		return st.Bytes, st.Requests
+	}
+
+	return 0, 0
+}
+
+// Reset forgets all usage, such as after a client has paid for more.
+func (qs *QuotaStore) Reset() {
+	qs.flushing.Lock()
+	defer qs.flushing.Unlock()
+
+	qs.mu.Lock()
+	qs.state = nil
+	qs.dirty = nil
+	qs.mu.Unlock()
+
+	if qs.Storage != nil {
+		keys, _ := qs.Storage.Keys("quota/")
+		for _, key := range keys {
+			qs.Storage.Delete(key)
+		}
+	}
+}
+
+// lookup returns a client's usage of a quota in the period beginning at
+// start, reading it from qs.Storage if the store hasn't seen the client yet.
+// The caller must hold qs.mu.
+func (qs *QuotaStore) lookup(key quotaKey, start time.Time) *quotaState {
+	st := qs.state[key]
+
+	if st == nil && qs.Storage != nil {
+		if data, err := qs.Storage.Get(key.String()); err == nil {
+			st = new(quotaState)
+			if json.Unmarshal(data, st) != nil {
+				st = nil
+			}
+		}
+	}
+
+	if st == nil || !st.Start.Equal(start) {
+		st = &quotaState{Start: start}
+	}
+
+	if qs.state == nil {
+		qs.state = make(map[quotaKey]*quotaState)
+	}
+
+	st.key = key
+	qs.state[key] = st
+	return st
+}
+
+// changed marks a client's usage of a quota to be written to qs.Storage
+// within qs.PersistInterval. The caller must hold qs.mu.
+func (qs *QuotaStore) changed(st *quotaState) {
+	if qs.Storage == nil {
+		return
+	}
+
+	if qs.dirty == nil {
+		qs.dirty = make(map[quotaKey]*quotaState)
+	}
+	qs.dirty[st.key] = st
+
+	if qs.timer == nil {
+		d := qs.PersistInterval
+		if d <= 0 {
+			d = 10 * time.Second
+		}
+		qs.timer = qs.clock().AfterFunc(d, qs.Flush)
+	}
+}
+
+// Flush writes the usage which has changed since it was last written to
+// Storage, such as before shutting down. Failures are ignored.
+func (qs *QuotaStore) Flush() {
+	qs.flushing.Lock()
+	defer qs.flushing.Unlock()
+
+	qs.mu.Lock()
+	if qs.timer != nil {
+		qs.timer.Stop()
+		qs.timer = nil
+	}
+	states := make([]quotaState, 0, len(qs.dirty))
+	for _, st := range qs.dirty {
+		states = append(states, *st)
+	}
+	qs.dirty = nil
+	qs.mu.Unlock()
+
+	now := qs.now()
+
+	// Each value expires along with its period.
+	for i := range states {
+		st := &states[i]
+		ttl := qs.Quotas[st.key.quota].Period.next(st.Start).Sub(now)
+
+		if data, err := json.Marshal(st); err == nil && ttl > 0 {
+			qs.Storage.Put(st.key.String(), data, ttl)
+		}
+	}
+}
+
+func (qs *QuotaStore) identify(s *Session) string {
+	if qs.Identify != nil {
+		return qs.Identify(s)
+	}
+	if s != nil && s.User != "" {
+		return s.User
+	}
+	if s != nil && s.ClientAddr != nil {
+		return hostname(s.ClientAddr.String())
+	}
+	return ""
+}
+
+func (qs *QuotaStore) now() time.Time {
+	return qs.clock().Now()
+}
+
+func (qs *QuotaStore) clock() Clock {
+	if qs.Clock != nil {
+		return qs.Clock
+	}
+	return realClock{}
+}
+
+// exceeded reports whether a quota has been used up.
+func exceeded(st *quotaState, q *Quota) bool {
+	return (q.Bytes > 0 && st.Bytes >= q.Bytes) ||
+		(q.Requests > 0 && st.Requests >= q.Requests)
+}
+
+// start returns the beginning of the period containing t.
+func (p QuotaPeriod) start(t time.Time) time.Time {
+	y, m, d := t.Date()
+	if p == QuotaMonthly {
+		d = 1
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// next returns the beginning of the period following the one beginning at
+// start.
+func (p QuotaPeriod) next(start time.Time) time.Time {
+	if p == QuotaMonthly {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// checkQuota counts a request (or, if req is nil, a tunnel) to host against
+// the client's quotas, if p.Quotas is set. It returns the rate its transfers
+// should be throttled to (zero meaning no throttling), or an error if it
+// should be refused.
+func (p *Proxy) checkQuota(s *Session, req *heat.Request, host string) (int64, error) {
+	if p.Quotas == nil {
+		return 0, nil
+	}
+
+	q, refused := p.Quotas.admit(s, host)
+	if refused != nil {
+		p.decideDeny(s, req, host, "Quotas", q.Match, refused)
+		return 0, refused
+	}
+	if q != nil && q.Rate > 0 {
+		p.decide(s, req, host, &DecisionRecord{
+			Action:  "throttle",
+			Rule:    "Quotas",
+			Pattern: q.Match.String(),
+			Reason:  "quota exceeded, limited to " + strconv.FormatInt(q.Rate, 10) + " bytes/s",
+		})
+		return q.Rate, nil
+	}
+
+	return 0, nil
+}
+
+// throttleResponse limits the rate at which a response's body is relayed.
+// The bodies of "101 Switching Protocols" responses are throttled in both
+// directions.
+func (p *Proxy) throttleResponse(resp *heat.Response, rate int64) {
+	if resp.Body == nil {
+		return
+	}
+
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.Status == 101 {
+		resp.Body = p.throttleConn(conn, rate)
+		return
+	}
+
+	resp.Body = &throttledBody{resp.Body, newThrottle(p, rate)}
+}
+
+// throttleConn limits the rate at which data passes through the upstream
+// end of a tunnel in either direction.
+func (p *Proxy) throttleConn(upstream io.ReadWriteCloser, rate int64) io.ReadWriteCloser {
+	return &throttledConn{upstream, newThrottle(p, rate), newThrottle(p, rate)}
+}
+
+// The throttledBody type limits the rate at which a message body is read.
+type throttledBody struct {
+	io.ReadCloser
+	t throttle
+}
+
+func (b *throttledBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(b.t.limit(buf))
+	b.t.wait(n)
+	return n, err
+}
+
+// The throttledConn type limits the rate at which data is transferred in
+// each direction through the upstream end of a tunnel.
+type throttledConn struct {
+	io.ReadWriteCloser
+	r, w throttle
+}
+
+func (c *throttledConn) Read(buf []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(c.r.limit(buf))
+	c.r.wait(n)
+	return n, err
+}
+
+func (c *throttledConn) Write(buf []byte) (int, error) {
+	var written int
+
+	for len(buf) > 0 {
+		chunk := c.w.limit(buf)
+		n, err := c.ReadWriteCloser.Write(chunk)
+		written += n
+		c.w.wait(n)
+		if err != nil {
+			return written, err
+		}
+		buf = buf[n:]
+	}
+
+	return written, nil
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, if
+// supported.
+func (c *throttledConn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.ReadWriteCloser.Close()
+}
+
+// A throttle paces a stream of data to a number of bytes per second. A zero
+// rate means no limit.
+type throttle struct {
+	p     *Proxy
+	rate  int64
+	start time.Time
+	total int64
+}
+
+func newThrottle(p *Proxy, rate int64) throttle {
+	return throttle{p: p, rate: rate, start: p.clock().Now()}
+}
+
+// limit shortens buf to at most a second's worth of data.
+func (t *throttle) limit(buf []byte) []byte {
+	if t.rate > 0 && int64(len(buf)) > t.rate {
+		return buf[:t.rate]
+	}
+	return buf
+}
+
+// wait records that n bytes have been transferred, sleeping until doing so
+// no longer exceeds the rate.
+func (t *throttle) wait(n int) {
+	if t.rate <= 0 {
+		return
+	}
+
+	t.total += int64(n)
+
+	due := t.start.Add(time.Duration(float64(t.total) / float64(t.rate) * float64(time.Second)))
+	if d := due.Sub(t.p.clock().Now()); d > 0 {
+		t.p.sleep(d)
+	}
+}
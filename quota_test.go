@@ -0,0 +1,73 @@
+package relay_test
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+	"github.com/erkl/relay/relaytest"
+)
+
+// The quotaStorage type counts the writes made to it, checking that usage
+// can be read while they're made.
+type quotaStorage struct {
+	relay.MemoryStorage
+	qs *relay.QuotaStore
+
+	mu   sync.Mutex
+	puts int
+}
+
+func (s *quotaStorage) Put(key string, value []byte, ttl time.Duration) error {
+	s.qs.Usage("alice", &s.qs.Quotas[0])
+
+	s.mu.Lock()
+	s.puts++
+	s.mu.Unlock()
+
+	return s.MemoryStorage.Put(key, value, ttl)
+}
+
+func (s *quotaStorage) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.puts
+}
+
+func TestQuotaStorePersistence(t *testing.T) {
+	clock := relaytest.NewClock(time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC))
+	qs := &relay.QuotaStore{
+		Quotas:          []relay.Quota{{Bytes: 1000, Action: relay.QuotaNotify}},
+		Clock:           clock,
+		PersistInterval: time.Second,
+	}
+	storage := &quotaStorage{qs: qs}
+	qs.Storage = storage
+
+	s := &relay.Session{User: "alice"}
+	for i := 0; i < 10; i++ {
+		qs.RecordUsage(s, "example.com", 5, 5)
+	}
+	if n := storage.count(); n != 0 {
+		t.Fatalf("usage written %d times before the interval passed", n)
+	}
+
+	clock.Advance(time.Second)
+	if n := storage.count(); n != 1 {
+		t.Fatalf("usage written %d times after the interval passed, want 1", n)
+	}
+
+	var usage struct{ Bytes int64 }
+	data, _ := storage.Get("quota/0/alice")
+	if err := json.Unmarshal(data, &usage); err != nil || usage.Bytes != 100 {
+		t.Fatalf("stored usage %s, want 100 bytes", data)
+	}
+
+	// Exceeding the quota is written right away.
+	qs.RecordUsage(s, "example.com", 1000, 0)
+	if n := storage.count(); n != 2 {
+		t.Fatalf("usage written %d times after exceeding the quota, want 2", n)
+	}
+}
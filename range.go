@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+var (
+	errUnexpectedPartial = errors.New("relay: 206 response to request without Range header field")
+	errContentRange      = errors.New("relay: 206 response with invalid Content-Range header field")
+)
+
+// stripRanges turns a range request into a request for the full
+// representation.
+func stripRanges(req *heat.Request) {
+	req.Fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Range") && !f.Is("If-Range")
+	})
+}
+
+// checkPartial validates the framing of a "206 Partial Content" response,
+// as described in section 4.1 of RFC 7233.
+func checkPartial(resp *heat.Response, ranged bool) error {
+	if resp.Status != 206 {
+		return nil
+	}
+
+	if !ranged {
+		return errUnexpectedPartial
+	}
+
+	// Multiple ranges are delimited by the multipart body itself.
+	if value, ok := fieldValue(resp.Fields, "Content-Type"); ok {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(value)), "multipart/byteranges") {
+			return nil
+		}
+	}
+
+	value, ok := fieldValue(resp.Fields, "Content-Range")
+	if !ok {
+		return errContentRange
+	}
+
+	first, last, ok := parseContentRange(value)
+	if !ok {
+		return errContentRange
+	}
+
+	// The range must agree with the body's length, if known up front.
+	if value, ok := fieldValue(resp.Fields, "Content-Length"); ok {
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || n != last-first+1 {
+			return errContentRange
+		}
+	}
+
+	return nil
+}
+
+// parseContentRange parses a "bytes first-last/complete" Content-Range value,
+// where complete may be "*".
+func parseContentRange(s string) (first, last int64, ok bool) {
+	s = strings.TrimSpace(s)
+	if len(s) < 6 || !strings.EqualFold(s[:6], "bytes ") {
+		return 0, 0, false
+	}
+
+	s = strings.TrimSpace(s[6:])
+
+	i := strings.IndexByte(s, '-')
+	j := strings.IndexByte(s, '/')
+	if i < 0 || j < i {
+		return 0, 0, false
+	}
+
+	first, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, false
+	}
+
+	last, err = strconv.ParseInt(s[i+1:j], 10, 64)
+	if err != nil || last < first {
+		return 0, 0, false
+	}
+
+	if complete := s[j+1:]; complete != "*" {
+		n, err := strconv.ParseInt(complete, 10, 64)
+		if err != nil || n <= last {
+			return 0, 0, false
+		}
+	}
+
+	return first, last, true
+}
@@ -0,0 +1,80 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+func TestPartialResponses(t *testing.T) {
+	responses := map[string]string{
+		"/valid":     "Content-Range: bytes 2-4/10\r\nContent-Length: 3\r\n\r\nabc",
+		"/unknown":   "Content-Range: bytes 2-4/*\r\nContent-Length: 3\r\n\r\nabc",
+		"/multipart": "Content-Type: multipart/byteranges; boundary=x\r\nContent-Length: 0\r\n\r\n",
+		"/length":    "Content-Range: bytes 2-4/10\r\nContent-Length: 5\r\n\r\nabcde",
+		"/beyond":    "Content-Range: bytes 2-4/4\r\nContent-Length: 3\r\n\r\nabc",
+		"/reversed":  "Content-Range: bytes 4-2/10\r\nContent-Length: 0\r\n\r\n",
+		"/missing":   "Content-Length: 3\r\n\r\nabc",
+	}
+
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 206 Partial Content\r\n"+responses[req.URL.Path])
+	})
+
+	tests := []struct {
+		path   string
+		ranged bool
+		status int
+	}{
+		{"/valid", true, 206},
+		{"/unknown", true, 206},
+		{"/multipart", true, 206},
+		{"/length", true, 502},
+		{"/beyond", true, 502},
+		{"/reversed", true, 502},
+		{"/missing", true, 502},
+		{"/valid", false, 502},
+	}
+
+	for _, tt := range tests {
+		// Invalid responses close the connection, so use a new one each
+		// time.
+		conn := serve(t, &relay.Proxy{})
+
+		header := "Host: " + addr + "\r\n"
+		if tt.ranged {
+			header += "Range: bytes=2-4\r\n"
+		}
+		io.WriteString(conn, "GET http://"+addr+tt.path+" HTTP/1.1\r\n"+header+"\r\n")
+
+		if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != tt.status {
+			t.Errorf("%s (ranged: %v): got status %d, want %d", tt.path, tt.ranged, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestStripRanges(t *testing.T) {
+	seen := make(chan http.Header, 1)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		seen <- req.Header
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n0123456789")
+	})
+
+	conn := serve(t, &relay.Proxy{StripRanges: true})
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n"+
+		"Range: bytes=2-4\r\nIf-Range: \"v1\"\r\n\r\n")
+
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+	body, _ := io.ReadAll(resp.Body)
+
+	if h := <-seen; h.Get("Range") != "" || h.Get("If-Range") != "" {
+		t.Errorf("upstream got Range %q and If-Range %q", h.Get("Range"), h.Get("If-Range"))
+	}
+	if resp.StatusCode != 200 || string(body) != "0123456789" {
+		t.Errorf("got status %d with body %q, want the full representation", resp.StatusCode, body)
+	}
+}
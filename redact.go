@@ -0,0 +1,272 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// SensitiveFields lists the header fields which commonly carry credentials,
+// as a starting point for Redactor.Fields.
+var SensitiveFields = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Api-Key",
+}
+
+// A Redactor removes sensitive data, such as credentials and personal
+// information, from the records a proxy keeps: decision audit records and
+// flows captured in its FlowStore, including what's exported from them or
+// archived. The traffic itself is never affected, but requests replayed
+// from redacted flows carry the redacted values.
+//
+// Bodies are only redacted when JSONFields, Patterns or (for form-encoded
+// bodies) QueryParams are set. Compressed bodies are then captured
+// decompressed. Bodies which can't be redacted reliably, such as truncated
+// JSON documents when JSONFields are set, aren't captured at all.
+type Redactor struct {
+	// Names of header fields whose values are replaced. See
+	// SensitiveFields.
+	Fields []string
+
+	// Names of query parameters, and of fields in form-encoded bodies,
+	// whose values are replaced.
+	QueryParams []string
+
+	// Paths of JSON body fields whose values are replaced, such as
+	// "password" or "user.card.number". A "*" segment matches any object
+	// member or array element, such that "items.*.token" matches the token
+	// of every object in the items array.
+	JSONFields []string
+
+	// Patterns replaced wherever they match in header field values, URLs
+	// and bodies, such as card or social security numbers.
+	Patterns []*regexp.Regexp
+
+	// What redacted values are replaced with. Defaults to "[REDACTED]".
+	Replacement string
+}
+
+func (r *Redactor) replacement() string {
+	if r.Replacement == "" {
+		return "[REDACTED]"
+	}
+	return r.Replacement
+}
+
+// Request returns a copy of a request's header with sensitive data removed.
+// The copy's Body field is nil. A nil Redactor just copies the header.
+func (r *Redactor) Request(req *heat.Request) *heat.Request {
+	c := cloneRequest(req)
+	if r != nil {
+		c.URI = r.URL(c.URI)
+		r.fields(c.Fields)
+	}
+	return c
+}
+
+// Response returns a copy of a response's header with sensitive data
+// removed. The copy's Body field is nil. A nil Redactor just copies the
+// header.
+func (r *Redactor) Response(resp *heat.Response) *heat.Response {
+	c := cloneResponse(resp)
+	if r != nil {
+		r.fields(c.Fields)
+	}
+	return c
+}
+
+// URL redacts the query parameters of a URL (or request target), and any
+// matches of r.Patterns.
+func (r *Redactor) URL(uri string) string {
+	if r == nil {
+		return uri
+	}
+
+	if i := strings.IndexByte(uri, '?'); i >= 0 && len(r.QueryParams) > 0 {
+		uri = uri[:i+1] + r.query(uri[i+1:])
+	}
+
+	return r.text(uri)
+}
+
+// fields redacts header field values in place.
+func (r *Redactor) fields(fields heat.Fields) {
+	for i := range fields {
+		f := &fields[i]
+
+		redacted := false
+		for _, name := range r.Fields {
+			if f.Is(name) {
+				redacted = true
+				break
+			}
+		}
+
+		if redacted {
+			f.Value = r.replacement()
+		} else {
+			f.Value = r.text(f.Value)
+		}
+	}
+}
+
+// query redacts the values of the parameters named in r.QueryParams in a
+// query string (or form-encoded body), keeping everything else as it was.
+func (r *Redactor) query(q string) string {
+	pairs := strings.Split(q, "&")
+
+	for i, pair := range pairs {
+		name, _, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if contains(r.QueryParams, name) {
+			pairs[i] = pair[:strings.IndexByte(pair, '=')+1] + url.QueryEscape(r.replacement())
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// text replaces the matches of r.Patterns in s.
+func (r *Redactor) text(s string) string {
+	for _, re := range r.Patterns {
+		s = re.ReplaceAllLiteralString(s, r.replacement())
+	}
+	return s
+}
+
+// redactsBodies reports whether r has any rules for bodies.
+func (r *Redactor) redactsBodies() bool {
+	return r != nil && (len(r.JSONFields) > 0 || len(r.Patterns) > 0 || len(r.QueryParams) > 0)
+}
+
+// body redacts a captured body, given the (already copied) header fields of
+// its message. If the body is compressed, it's decompressed, and the
+// Content-Encoding field removed. Returns nil if the body can't be redacted.
+func (r *Redactor) body(fields *heat.Fields, body []byte) []byte {
+	if !r.redactsBodies() || len(body) == 0 {
+		return body
+	}
+
+	if coding, ok := fieldValue(*fields, "Content-Encoding"); ok {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "identity" {
+			dec, ok := decoder(coding, ioutil.NopCloser(bytes.NewReader(body)))
+			if !ok {
+				return nil
+			}
+
+			// Truncated bodies decode as far as they go.
+			var err error
+			body, err = ioutil.ReadAll(dec)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return nil
+			}
+		}
+		fields.Filter(func(f heat.Field) bool {
+			return !f.Is("Content-Encoding")
+		})
+	}
+
+	var mediaType string
+	if v, ok := fieldValue(*fields, "Content-Type"); ok {
+		mediaType, _, _ = mime.ParseMediaType(v)
+	}
+
+	switch {
+	case len(r.JSONFields) > 0 && isJSONType(mediaType):
+		var v interface{}
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil
+		}
+
+		changed := false
+		for _, path := range r.JSONFields {
+			if r.redactJSON(v, strings.Split(path, ".")) {
+				changed = true
+			}
+		}
+
+		if changed {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return nil
+			}
+			body = data
+		}
+
+	case len(r.QueryParams) > 0 && mediaType == "application/x-www-form-urlencoded":
+		body = []byte(r.query(string(body)))
+	}
+
+	for _, re := range r.Patterns {
+		body = re.ReplaceAllLiteral(body, []byte(r.replacement()))
+	}
+
+	return body
+}
+
+// message redacts the payload of a WebSocket message, which is taken to be
+// JSON if it parses as such.
+func (r *Redactor) message(data []byte) []byte {
+	if !r.redactsBodies() || len(data) == 0 {
+		return data
+	}
+
+	fields := heat.Fields{{Name: "Content-Type", Value: "text/plain"}}
+	if json.Valid(data) {
+		fields[0].Value = "application/json"
+	}
+
+	return r.body(&fields, data)
+}
+
+// redactJSON replaces the values found at path in a decoded JSON value,
+// reporting whether there were any.
+func (r *Redactor) redactJSON(v interface{}, path []string) bool {
+	changed := false
+
+	visit := func(child interface{}, set func(interface{})) {
+		if len(path) == 1 {
+			set(r.replacement())
+			changed = true
+		} else if r.redactJSON(child, path[1:]) {
+			changed = true
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if path[0] == "*" || path[0] == key {
+				key := key
+				visit(child, func(x interface{}) { v[key] = x })
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if path[0] == "*" {
+				i := i
+				visit(child, func(x interface{}) { v[i] = x })
+			}
+		}
+	}
+
+	return changed
+}
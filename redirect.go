@@ -0,0 +1,214 @@
+package relay
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// A RedirectRule rewrites references to an upstream origin in responses to
+// the origin clients see, for reverse proxies and requests mapped to other
+// hosts. Without it, redirects issued by the upstream server send clients
+// straight to it.
+//
+// The Location and Content-Location header fields are always rewritten.
+// Absolute URLs are rewritten if they have From's scheme and host, and
+// begin with its path. Relative ones are only rewritten if From has a path.
+type RedirectRule struct {
+	// Requests whose responses the rule applies to. If nil, everything
+	// matches.
+	Match *Match
+
+	// The upstream origin, optionally with a path, such as
+	// "http://10.0.0.5:8080/app". If empty, the scheme and host the request
+	// was sent to.
+	From string
+
+	// The origin clients see, such as "https://www.example.com", replacing
+	// From's scheme, host and path.
+	To string
+
+	// If true, the href attribute of <base> elements in HTML pages is
+	// rewritten too. Such pages are read into memory.
+	BaseURL bool
+
+	// If true, the Domain attribute of cookies set for From's host is
+	// replaced with To's host.
+	CookieDomain bool
+}
+
+// A redirectMapping maps URLs between two origins.
+type redirectMapping struct {
+	from, to *url.URL
+}
+
+// mapping resolves the rule's origins for a request.
+func (r *RedirectRule) mapping(req *heat.Request) (*redirectMapping, bool) {
+	from := req.Scheme + "://" + req.Remote
+	if r.From != "" {
+		from = r.From
+	}
+
+	fu, err := url.Parse(from)
+	if err != nil {
+		return nil, false
+	}
+	tu, err := url.Parse(r.To)
+	if err != nil {
+		return nil, false
+	}
+
+	fu.Path = strings.TrimSuffix(fu.Path, "/")
+	tu.Path = strings.TrimSuffix(tu.Path, "/")
+
+	return &redirectMapping{fu, tu}, true
+}
+
+// rewrite maps a URL found in a response, reporting whether it changed.
+func (m *redirectMapping) rewrite(ref string) (string, bool) {
+	u, err := url.Parse(ref)
+	if err != nil || u.Opaque != "" {
+		return ref, false
+	}
+
+	if u.IsAbs() {
+		if !strings.EqualFold(u.Scheme, m.from.Scheme) ||
+			!strings.EqualFold(withPort(u.Host, strings.ToLower(u.Scheme)), withPort(m.from.Host, m.from.Scheme)) {
+			return ref, false
+		}
+	} else if m.from.Path == "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return ref, false
+	}
+
+	if !hasPathPrefix(u.Path, m.from.Path) {
+		return ref, false
+	}
+
+	if u.IsAbs() {
+		u.Scheme, u.Host = m.to.Scheme, m.to.Host
+	}
+	u.Path = m.to.Path + u.Path[len(m.from.Path):]
+	u.RawPath = ""
+
+	return u.String(), true
+}
+
+// hasPathPrefix reports whether path begins with the segments of prefix.
+func hasPathPrefix(path, prefix string) bool {
+	return strings.HasPrefix(path, prefix) &&
+		(len(path) == len(prefix) || path[len(prefix)] == '/')
+}
+
+// apply rewrites a response's header fields, and if r.BaseURL is set, its
+// body. It reports whether anything changed.
+func (r *RedirectRule) apply(m *redirectMapping, resp *heat.Response) (bool, error) {
+	changed := false
+
+	for i := range resp.Fields {
+		f := &resp.Fields[i]
+		switch {
+		case f.Is("Location"), f.Is("Content-Location"):
+			if v, ok := m.rewrite(f.Value); ok {
+				f.Value, changed = v, true
+			}
+		case f.Is("Set-Cookie") && r.CookieDomain:
+			if v, ok := m.rewriteCookie(f.Value); ok {
+				f.Value, changed = v, true
+			}
+		}
+	}
+
+	if r.BaseURL && resp.Body != nil && matchContentType([]string{"text/html"}, resp.Fields) {
+		ok, err := m.rewriteBase(resp)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || ok
+	}
+
+	return changed, nil
+}
+
+// rewriteCookie replaces the Domain attribute of a Set-Cookie field value,
+// if it names the upstream host.
+func (m *redirectMapping) rewriteCookie(value string) (string, bool) {
+	c := parseSetCookie(value)
+
+	domain, ok := c.attr("Domain")
+	if !ok || !strings.EqualFold(strings.TrimPrefix(domain, "."), m.from.Hostname()) {
+		return value, false
+	}
+
+	c.set("Domain", m.to.Hostname())
+	return c.String(), true
+}
+
+var baseHref = regexp.MustCompile(`(?i)(<base\b[^>]*?\bhref\s*=\s*)("[^"]*"|'[^']*'|[^\s>]+)`)
+
+// rewriteBase rewrites the href attribute of <base> elements in an HTML
+// page. Pages whose body can't be decoded are left alone.
+func (m *redirectMapping) rewriteBase(resp *heat.Response) (bool, error) {
+	t, err := readText(&resp.Fields, &resp.Body)
+	if err != nil {
+		if resp.Body == nil {
+			return false, err
+		}
+		return false, nil
+	}
+
+	changed := false
+	t.Body = baseHref.ReplaceAllStringFunc(t.Body, func(s string) string {
+		sub := baseHref.FindStringSubmatch(s)
+		href, quote := sub[2], ""
+		if href[0] == '"' || href[0] == '\'' {
+			href, quote = href[1:len(href)-1], href[:1]
+		}
+
+		v, ok := m.rewrite(href)
+		if !ok {
+			return s
+		}
+
+		changed = true
+		return sub[1] + quote + v + quote
+	})
+
+	if !changed {
+		return false, nil
+	}
+
+	return true, writeText(&resp.Fields, &resp.Body, t)
+}
+
+// applyRedirectRules applies the first rule in p.Redirects matching req to
+// its response.
+func (p *Proxy) applyRedirectRules(s *Session, req *heat.Request, resp *heat.Response) error {
+	for i := range p.Redirects {
+		r := &p.Redirects[i]
+		if !r.Match.Request(s, req) {
+			continue
+		}
+
+		m, ok := r.mapping(req)
+		if !ok {
+			return nil
+		}
+
+		changed, err := r.apply(m, resp)
+		if changed {
+			p.decide(s, req, "", &DecisionRecord{
+				Action:  "rewrite",
+				Rule:    "Redirects[" + strconv.Itoa(i) + "]",
+				Pattern: r.Match.String(),
+				Reason:  m.from.String() + " mapped to " + m.to.String(),
+			})
+		}
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestRedirects(t *testing.T) {
+	app, err := relay.ParseMatch("path=/app/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		field string
+		value string
+		want  string
+	}{
+		// Absolute URLs are mapped if they're within From.
+		{"/app/1", "Location", "http://10.0.0.5:8080/app/login?x=1", "https://www.example.com/shop/login?x=1"},
+		{"/app/2", "Content-Location", "HTTP://10.0.0.5:8080/app", "https://www.example.com/shop"},
+		{"/app/3", "Location", "http://10.0.0.5:8080/application", "http://10.0.0.5:8080/application"},
+		{"/app/4", "Location", "https://10.0.0.5:8080/app/", "https://10.0.0.5:8080/app/"},
+		{"/app/5", "Location", "http://other.example/app/", "http://other.example/app/"},
+
+		// So are relative ones, since From has a path.
+		{"/app/6", "Location", "/app/next", "/shop/next"},
+		{"/app/7", "Location", "next", "next"},
+
+		// Cookies set for From's host are moved to To's.
+		{"/app/8", "Set-Cookie", "sid=1; Domain=.10.0.0.5; Path=/", "sid=1; Domain=www.example.com; Path=/"},
+		{"/app/9", "Set-Cookie", "sid=1; Domain=example.org", "sid=1; Domain=example.org"},
+
+		// Without From, the request's own origin is mapped, default ports
+		// and all.
+		{"/other/1", "Location", "http://origin.test:80/y", "https://public.example/y"},
+		{"/other/2", "Location", "/y", "/y"},
+	}
+
+	fields := make(map[string][2]string)
+	for _, tt := range tests {
+		fields[tt.path] = [2]string{tt.field, tt.value}
+	}
+
+	const page = `<html><head><base target="_top" href='http://10.0.0.5:8080/app/'></head></html>`
+
+	var audited []string
+	p := &relay.Proxy{
+		Redirects: []relay.RedirectRule{
+			{
+				Match:        app,
+				From:         "http://10.0.0.5:8080/app/",
+				To:           "https://www.example.com/shop",
+				BaseURL:      true,
+				CookieDomain: true,
+			},
+			{To: "https://public.example"},
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			path := strings.TrimPrefix(req.URI, "http://origin.test")
+			resp := heat.NewResponse(302, "Found")
+			if path == "/app/page" {
+				resp = heat.NewResponse(200, "OK")
+				resp.Fields.Set("Content-Type", "text/html")
+				resp.Fields.Set("Content-Length", strconv.Itoa(len(page)))
+				resp.Body = io.NopCloser(strings.NewReader(page))
+				return resp, nil
+			}
+
+			resp.Fields.Set("Content-Length", "0")
+			resp.Fields.Set(fields[path][0], fields[path][1])
+			return resp, nil
+		},
+		AuditDecision: func(r *relay.DecisionRecord) {
+			audited = append(audited, r.Reason)
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	for _, tt := range tests {
+		io.WriteString(conn, "GET http://origin.test"+tt.path+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		if got := resp.Header.Get(tt.field); got != tt.want {
+			t.Errorf("%s: got %s %q, want %q", tt.path, tt.field, got, tt.want)
+		}
+	}
+
+	// Base URLs in HTML pages are rewritten too.
+	io.WriteString(conn, "GET http://origin.test/app/page HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+	resp := readFinal(t, conn, r)
+	body, _ := io.ReadAll(resp.Body)
+	if want := `<html><head><base target="_top" href='https://www.example.com/shop/'></head></html>`; string(body) != want {
+		t.Errorf("got page %q, want %q", body, want)
+	}
+
+	// Only responses which were changed are audited.
+	mapped := "http://10.0.0.5:8080/app mapped to https://www.example.com/shop"
+	other := "http://origin.test mapped to https://public.example"
+	want := []string{mapped, mapped, mapped, mapped, other, mapped}
+	if strings.Join(audited, "|") != strings.Join(want, "|") {
+		t.Errorf("audited:\n%q\nwant:\n%q", audited, want)
+	}
+}
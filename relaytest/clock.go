@@ -0,0 +1,89 @@
+package relaytest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+// A Clock is a relay.Clock which only moves when told to. Assign it to
+// Proxy.Clock to control request timeouts from tests.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*timer
+}
+
+// NewClock returns a Clock set to a given time.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc schedules f to be called once the clock has been advanced by d.
+func (c *Clock) AfterFunc(d time.Duration, f func()) relay.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &timer{c: c, when: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+
+	return t
+}
+
+// Advance moves the clock forward, calling every function scheduled to run
+// in the meantime, in order.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+
+	var due []*timer
+	var rest []*timer
+
+	for _, t := range c.timers {
+		if !t.when.After(c.now) {
+			due = append(due, t)
+		} else {
+			rest = append(rest, t)
+		}
+	}
+
+	c.timers = rest
+	c.mu.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool {
+		return due[i].when.Before(due[j].when)
+	})
+
+	for _, t := range due {
+		t.f()
+	}
+}
+
+type timer struct {
+	c    *Clock
+	when time.Time
+	f    func()
+}
+
+func (t *timer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+
+	for i, x := range t.c.timers {
+		if x == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
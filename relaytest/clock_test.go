@@ -0,0 +1,42 @@
+package relaytest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/erkl/relay/relaytest"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := relaytest.NewClock(start)
+
+	var fired []int
+	c.AfterFunc(3*time.Second, func() { fired = append(fired, 3) })
+	c.AfterFunc(1*time.Second, func() { fired = append(fired, 1) })
+	stopped := c.AfterFunc(2*time.Second, func() { fired = append(fired, 2) })
+	c.AfterFunc(5*time.Second, func() { fired = append(fired, 5) })
+
+	if !stopped.Stop() {
+		t.Errorf("Stop on a pending timer returned false")
+	}
+
+	// Due functions run in order, and only once.
+	c.Advance(4 * time.Second)
+	c.Advance(0)
+
+	if len(fired) != 2 || fired[0] != 1 || fired[1] != 3 {
+		t.Errorf("got %v, want [1 3]", fired)
+	}
+	if !c.Now().Equal(start.Add(4 * time.Second)) {
+		t.Errorf("got time %v, want %v", c.Now(), start.Add(4*time.Second))
+	}
+	if stopped.Stop() {
+		t.Errorf("Stop on a stopped timer returned true")
+	}
+
+	c.Advance(time.Second)
+	if len(fired) != 3 || fired[2] != 5 {
+		t.Errorf("got %v, want [1 3 5]", fired)
+	}
+}
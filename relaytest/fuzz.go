@@ -0,0 +1,40 @@
+//go:build gofuzz
+// +build gofuzz
+
+package relaytest
+
+import (
+	"bytes"
+
+	"github.com/erkl/relay"
+)
+
+var fuzzProxy = &relay.Proxy{
+	Via:         "fuzz",
+	StripRanges: true,
+}
+
+// Fuzz is the entry point for go-fuzz. The input is split at its first NUL
+// byte into the bytes sent by the client, and the bytes sent by upstream
+// servers, and run through a full session. This exercises request parsing,
+// header scrubbing, CONNECT handling and body framing in both directions.
+func Fuzz(data []byte) int {
+	client, upstream := data, []byte(nil)
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		client, upstream = data[:i], data[i+1:]
+	}
+
+	if fuzzProxy.Authority == nil {
+		ca, err := newAuthority()
+		if err != nil {
+			panic(err)
+		}
+		fuzzProxy.Authority = ca
+	}
+
+	if len(ServeBytes(fuzzProxy, client, upstream)) == 0 {
+		return 0
+	}
+
+	return 1
+}
@@ -0,0 +1,268 @@
+// Package relaytest provides utilities for end-to-end testing of proxies
+// built with relay, in the spirit of net/http/httptest.
+package relaytest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+// A Server runs a Proxy entirely in memory. Clients returned by its Client
+// method reach the proxy through in-memory pipes, and trust certificates it
+// forges.
+type Server struct {
+	// The proxy being served. Must not be modified once the Server has been
+	// created, save for its hooks.
+	Proxy *relay.Proxy
+
+	// Proxy URL through which clients reach the proxy.
+	URL *url.URL
+
+	// The test certificate authority, and a pool containing it.
+	Authority *tls.Certificate
+	Roots     *x509.CertPool
+
+	mu     sync.Mutex
+	routes map[string]string
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewServer starts serving a proxy in memory. If p is nil, a new Proxy is
+// used. Fields left unset are given values suitable for testing:
+//
+//   - Authority is set to a freshly generated test CA.
+//   - Flows is set to a FlowStore capturing up to 1 MiB of every body.
+//   - Transport is set to one which dials through Route's table, and which
+//     doesn't verify upstream certificates (as test servers use
+//     self-signed ones).
+func NewServer(p *relay.Proxy) *Server {
+	if p == nil {
+		p = &relay.Proxy{}
+	}
+
+	s := &Server{
+		Proxy:  p,
+		URL:    &url.URL{Scheme: "http", Host: "relay.test:80"},
+		routes: make(map[string]string),
+		conns:  make(map[net.Conn]struct{}),
+	}
+
+	if p.Authority == nil {
+		ca, err := newAuthority()
+		if err != nil {
+			panic("relaytest: failed to generate CA: " + err.Error())
+		}
+		p.Authority = ca
+	}
+
+	s.Authority = p.Authority
+	s.Roots = x509.NewCertPool()
+
+	if x509ca, err := x509.ParseCertificate(p.Authority.Certificate[0]); err == nil {
+		s.Roots.AddCert(x509ca)
+	}
+
+	if p.Flows == nil {
+		p.Flows = &relay.FlowStore{MaxBodySize: 1 << 20}
+	}
+
+	if p.Transport == nil {
+		p.Transport = &relay.Transport{
+			Dial:      s.dial,
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+
+	return s
+}
+
+// Route makes the proxy's transport connect to addr whenever it would have
+// connected to host, which may be given with or without a port. This lets
+// tests use real host names (and port 443, which is the only port the proxy
+// intercepts) with servers started by net/http/httptest.
+func (s *Server) Route(host, addr string) {
+	s.mu.Lock()
+	s.routes[host] = addr
+	s.mu.Unlock()
+}
+
+// Client returns an HTTP client which sends all requests through the proxy.
+func (s *Server) Client() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(s.URL),
+			DialContext:     s.dialProxy,
+			TLSClientConfig: &tls.Config{RootCAs: s.Roots},
+		},
+	}
+}
+
+// Close closes all connections to the proxy, and waits for them to be done.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+}
+
+// Exchanges returns every flow recorded by the proxy's FlowStore which has
+// finished, oldest first.
+func (s *Server) Exchanges() []relay.Flow {
+	return s.Proxy.Flows.Flows(func(f *relay.Flow) bool {
+		return f.State == relay.FlowDone || f.State == relay.FlowFailed
+	})
+}
+
+// Find returns the most recent finished flow with a given request method
+// and URL.
+func (s *Server) Find(method, rawurl string) (relay.Flow, bool) {
+	list := s.Exchanges()
+
+	for i := len(list) - 1; i >= 0; i-- {
+		f := list[i]
+		if f.Request.Method == method && sameURL(f.URL(), rawurl) {
+			return f, true
+		}
+	}
+
+	return relay.Flow{}, false
+}
+
+// Expect is like Find, but fails the test if no matching flow has finished
+// within a second.
+func (s *Server) Expect(t testing.TB, method, rawurl string) relay.Flow {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+
+	for {
+		if f, ok := s.Find(method, rawurl); ok {
+			return f
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("relaytest: no %s %s exchange was recorded", method, rawurl)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dialProxy connects a client to the proxy through an in-memory pipe.
+func (s *Server) dialProxy(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, server := net.Pipe()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	s.conns[server] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+
+		s.Proxy.Serve(server)
+		server.Close()
+
+		s.mu.Lock()
+		delete(s.conns, server)
+		s.mu.Unlock()
+	}()
+
+	return client, nil
+}
+
+// dial connects the proxy to an upstream server, taking routes into account.
+func (s *Server) dial(network, addr string) (net.Conn, error) {
+	s.mu.Lock()
+	if to, ok := s.routes[addr]; ok {
+		addr = to
+	} else if host, _, err := net.SplitHostPort(addr); err == nil {
+		if to, ok := s.routes[host]; ok {
+			addr = to
+		}
+	}
+	s.mu.Unlock()
+
+	return net.Dial(network, addr)
+}
+
+// sameURL compares two URLs, ignoring default port numbers.
+func sameURL(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(ua.Scheme, ub.Scheme) &&
+		strings.EqualFold(ua.Hostname(), ub.Hostname()) &&
+		port(ua) == port(ub) &&
+		ua.RequestURI() == ub.RequestURI()
+}
+
+func port(u *url.URL) string {
+	if p := u.Port(); p != "" {
+		return p
+	}
+	if strings.EqualFold(u.Scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+// newAuthority generates a short-lived, self-signed CA certificate.
+func newAuthority() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{
+			CommonName:   "relaytest CA",
+			Organization: []string{"relaytest"},
+		},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(24 * time.Hour),
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,70 @@
+package relaytest_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/erkl/relay/relaytest"
+)
+
+func TestServer(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+" "+r.URL.Path)
+	})
+
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+
+	s := relaytest.NewServer(nil)
+	defer s.Close()
+
+	s.Route("example.com", strings.TrimPrefix(secure.URL, "https://"))
+	s.Route("example.org:80", strings.TrimPrefix(plain.URL, "http://"))
+
+	tests := []struct {
+		url, want, recorded string
+	}{
+		{"https://example.com/secure", "example.com /secure", "https://example.com:443/secure"},
+		{"http://example.org/plain", "example.org /plain", "http://example.org/plain"},
+	}
+
+	for _, tt := range tests {
+		resp, err := s.Client().Get(tt.url)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tt.url, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if string(body) != tt.want {
+			t.Errorf("GET %s: got %q, want %q", tt.url, body, tt.want)
+		}
+
+		// Default ports don't matter when looking up exchanges.
+		f := s.Expect(t, "GET", tt.recorded)
+		if string(f.ResponseBody) != tt.want {
+			t.Errorf("GET %s: recorded body %q, want %q", tt.url, f.ResponseBody, tt.want)
+		}
+	}
+
+	if _, ok := s.Find("POST", "https://example.com/secure"); ok {
+		t.Errorf("found an exchange which never happened")
+	}
+	if n := len(s.Exchanges()); n != 2 {
+		t.Errorf("%d exchanges recorded, want 2", n)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	s := relaytest.NewServer(nil)
+	s.Close()
+
+	if _, err := s.Client().Get("http://example.com/"); err == nil {
+		t.Errorf("request succeeded after Close")
+	}
+}
@@ -0,0 +1,73 @@
+package relaytest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+// ServeBytes runs a complete session through a copy of p, without touching
+// the network. The client sends the bytes in client, and every upstream
+// connection the proxy opens replies with the bytes in upstream, whatever
+// it's sent. It returns everything the proxy wrote back to the client.
+//
+// ServeBytes is intended for fuzzing, where both sides of the proxy are
+// under the fuzzer's control.
+func ServeBytes(p *relay.Proxy, client, upstream []byte) []byte {
+	q := *p
+	q.Transport = &relay.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return newScriptConn(upstream), nil
+		},
+	}
+
+	conn := newScriptConn(client)
+	q.Serve(conn)
+
+	return conn.written()
+}
+
+// The scriptConn type is a net.Conn which reads from a fixed script, and
+// records what's written to it.
+type scriptConn struct {
+	r io.Reader
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func newScriptConn(script []byte) *scriptConn {
+	return &scriptConn{r: bytes.NewReader(script)}
+}
+
+func (c *scriptConn) Read(buf []byte) (int, error) {
+	return c.r.Read(buf)
+}
+
+func (c *scriptConn) Write(buf []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(buf)
+}
+
+func (c *scriptConn) written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.buf.Bytes()...)
+}
+
+func (c *scriptConn) Close() error                       { return nil }
+func (c *scriptConn) LocalAddr() net.Addr                { return scriptAddr{} }
+func (c *scriptConn) RemoteAddr() net.Addr               { return scriptAddr{} }
+func (c *scriptConn) SetDeadline(t time.Time) error      { return nil }
+func (c *scriptConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *scriptConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type scriptAddr struct{}
+
+func (scriptAddr) Network() string { return "script" }
+func (scriptAddr) String() string  { return "script" }
@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/erkl/heat"
+)
+
+var errTruncatedFlow = errors.New("relay: can't replay a request with a truncated body")
+
+// Replay issues a recorded request again, passing it through the same hooks,
+// rules and transport as live traffic, and returns the new response. If
+// edit is non-nil, it's given a chance to modify the request first. Requests
+// whose bodies weren't captured in full can't be replayed. The request is
+// framed with a Content-Length matching its (possibly edited) body.
+//
+// The response's body must be closed by the caller. The replayed exchange
+// is recorded in p.Flows like any other.
+func (p *Proxy) Replay(ctx context.Context, f *Flow, edit func(req *heat.Request)) (*heat.Response, error) {
+	if f.RequestTruncated {
+		return nil, errTruncatedFlow
+	}
+
+	req := cloneRequest(f.Request)
+	if len(f.RequestBody) > 0 {
+		req.Body = ioutil.NopCloser(bytes.NewReader(f.RequestBody))
+	}
+
+	if edit != nil {
+		edit(req)
+	}
+
+	s := &Session{ClientAddr: f.ClientAddr, base: ctx, proxy: p, intent: clientIntent(req)}
+
+	// The body may have been edited or redacted since it was framed.
+	if req.Body != nil || framed(req.Fields) {
+		if err := s.reframe(&req.Fields, &req.Body); err != nil {
+			s.release()
+			return nil, err
+		}
+	}
+
+	resp, err := p.roundTrip(s, req)
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+
+	if resp.Body == nil {
+		s.release()
+	} else {
+		resp.Body = &releaseBody{resp.Body, s}
+	}
+
+	return resp, nil
+}
+
+// framed reports whether a message's header fields describe a body.
+func framed(fields heat.Fields) bool {
+	for _, f := range fields {
+		if f.Is("Content-Length") || f.Is("Transfer-Encoding") {
+			return true
+		}
+	}
+	return false
+}
+
+// The releaseBody type releases a session's resources once the response
+// body it wraps is closed.
+type releaseBody struct {
+	io.ReadCloser
+	s *Session
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.s.release()
+	return err
+}
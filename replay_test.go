@@ -0,0 +1,84 @@
+package relay_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func echoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// lastFlow returns the flow recorded last in fs.
+func lastFlow(t *testing.T, fs *relay.FlowStore) relay.Flow {
+	t.Helper()
+
+	flows := fs.Flows(nil)
+	if len(flows) == 0 {
+		t.Fatal("no flows recorded")
+	}
+
+	return flows[len(flows)-1]
+}
+
+func TestReplayEditedBody(t *testing.T) {
+	srv := echoServer(t)
+	p := &relay.Proxy{Flows: &relay.FlowStore{MaxBodySize: 1 << 20}}
+
+	resp, err := proxyClient(t, p).Post(srv.URL+"/echo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	f := lastFlow(t, p.Flows)
+
+	replayed, err := p.Replay(context.Background(), &f, func(req *heat.Request) {
+		req.Body = ioutil.NopCloser(strings.NewReader("goodbye, world"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.Body.Close()
+
+	body, _ := ioutil.ReadAll(replayed.Body)
+	if string(body) != "goodbye, world" {
+		t.Fatalf("replayed body echoed as %q", body)
+	}
+}
+
+func TestReplayUncapturedBody(t *testing.T) {
+	srv := echoServer(t)
+	p := &relay.Proxy{Flows: &relay.FlowStore{}}
+
+	resp, err := proxyClient(t, p).Post(srv.URL+"/echo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	f := lastFlow(t, p.Flows)
+	if !f.RequestTruncated {
+		t.Errorf("flow without a captured body isn't marked as truncated")
+	}
+
+	if resp, err := p.Replay(context.Background(), &f, nil); err == nil {
+		resp.Body.Close()
+		t.Fatal("replayed a flow whose body wasn't captured")
+	}
+}
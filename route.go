@@ -0,0 +1,65 @@
+package relay
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/erkl/heat"
+)
+
+// A RouteRule overrides the Host header field and the upstream TLS server
+// name of matching requests, independently of the address the proxy connects
+// to. This allows domain fronting style routing in test environments.
+type RouteRule struct {
+	// Requests the rule applies to. If nil, all requests match.
+	Match *Match
+
+	// If non-empty, replaces the request's Host header field.
+	Host string
+
+	// If non-empty, the server name sent in the TLS handshake with the
+	// upstream server, instead of the host being connected to.
+	ServerName string
+}
+
+// route applies the first of p.Routes matching a request, returning the
+// context in which the request should be sent.
+func (p *Proxy) route(ctx context.Context, s *Session, req *heat.Request) context.Context {
+	for i, r := range p.Routes {
+		if !r.Match.Request(s, req) {
+			continue
+		}
+
+		if r.Host != "" {
+			req.Fields.Set("Host", r.Host)
+			p.decide(s, req, "", &DecisionRecord{
+				Action:  "rewrite",
+				Rule:    "Routes[" + strconv.Itoa(i) + "]",
+				Pattern: r.Match.String(),
+				Reason:  "Host set to " + r.Host,
+			})
+		}
+		if r.ServerName != "" {
+			ctx = WithServerName(ctx, r.ServerName)
+		}
+
+		break
+	}
+
+	return ctx
+}
+
+type serverNameKey struct{}
+
+// WithServerName returns a context which makes Transport use a particular
+// TLS server name when connecting to upstream servers, rather than the
+// server's host name.
+func WithServerName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, serverNameKey{}, name)
+}
+
+// serverName returns the server name set with WithServerName, if any.
+func serverName(ctx context.Context) string {
+	name, _ := ctx.Value(serverNameKey{}).(string)
+	return name
+}
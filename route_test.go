@@ -0,0 +1,67 @@
+package relay_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+func TestRoutes(t *testing.T) {
+	type seen struct{ sni, host string }
+	requests := make(chan seen, 2)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- seen{r.TLS.ServerName, r.Host}
+	}))
+	srv.StartTLS()
+	defer srv.Close()
+
+	ca, cfg := testAuthority(t)
+	cfg.ServerName = "origin.example"
+
+	match, err := (&relay.Matcher{PathPrefix: "/routed"}).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &relay.Proxy{
+		Authority: ca,
+		Routes: []relay.RouteRule{
+			{Match: match, Host: "backend.internal", ServerName: "front.example"},
+		},
+		Transport: &relay.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial(network, srv.Listener.Addr().String())
+			},
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	conn, err := connect(t, p, "origin.example:443", cfg)
+	if err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	r := bufio.NewReader(conn)
+
+	want := map[string]seen{
+		"/routed": {"front.example", "backend.internal"},
+		"/plain":  {"origin.example", "origin.example"},
+	}
+
+	for _, path := range []string{"/routed", "/plain"} {
+		io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: origin.example\r\n\r\n")
+		if resp := readFinal(t, conn, r); resp.StatusCode != 200 {
+			t.Fatalf("%s: got status %d", path, resp.StatusCode)
+		}
+		if got := <-requests; got != want[path] {
+			t.Errorf("%s: upstream saw server name %q and Host %q, want %q and %q",
+				path, got.sni, got.host, want[path].sni, want[path].host)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// A SampleRule says how much of the traffic it matches a Sampler selects.
+type SampleRule struct {
+	// Requests the rule applies to. If nil, everything matches.
+	Match *Match
+
+	// Fraction of matching requests selected, from 0 (none) to 1 (all).
+	Rate float64
+
+	// Maximum number of matching requests selected per second, in bursts
+	// of up to as many (or one, for lower rates). Zero means no limit.
+	PerSecond float64
+}
+
+// A Sampler selects a portion of a proxy's traffic for detailed recording,
+// such as by a FlowStore or an access log, so that they can be used in
+// production without drowning in data. What isn't selected is only counted.
+//
+// Requests are sampled by the first rule matching them, such that rules for
+// particular hosts should come before general ones. Requests matching no
+// rule are always selected. A Sampler is safe for concurrent use.
+type Sampler struct {
+	Rules []SampleRule
+
+	mu      sync.Mutex
+	buckets []sampleBucket
+}
+
+// A sampleBucket limits the rate at which a rule selects requests.
+type sampleBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Sample decides whether a request is selected. A nil Sampler selects all
+// requests.
+func (sm *Sampler) Sample(s *Session, req *heat.Request) bool {
+	if sm == nil {
+		return true
+	}
+
+	for i := range sm.Rules {
+		r := &sm.Rules[i]
+		if !r.Match.Request(s, req) {
+			continue
+		}
+
+		if r.Rate < 1 && (r.Rate <= 0 || rand.Float64() >= r.Rate) {
+			return false
+		}
+		if r.PerSecond > 0 {
+			return sm.take(i, r.PerSecond)
+		}
+		return true
+	}
+
+	return true
+}
+
+// take spends one of rule i's tokens, if it has any.
+func (sm *Sampler) take(i int, perSecond float64) bool {
+	now := time.Now()
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if len(sm.buckets) != len(sm.Rules) {
+		sm.buckets = make([]sampleBucket, len(sm.Rules))
+	}
+
+	burst := math.Max(perSecond, 1)
+
+	b := &sm.buckets[i]
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*perSecond, burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
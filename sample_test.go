@@ -0,0 +1,121 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestSampler(t *testing.T) {
+	match := func(expr string) *relay.Match {
+		m, err := relay.ParseMatch(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	sm := &relay.Sampler{Rules: []relay.SampleRule{
+		{Match: match("host=none.test"), Rate: 0},
+		{Match: match("host=limited.test"), Rate: 1, PerSecond: 2},
+		{Match: match("host=*.test"), Rate: 0.5},
+	}}
+
+	sample := func(host string, n int) int {
+		req := heat.NewRequest("GET", "/")
+		req.Remote = host
+
+		selected := 0
+		for i := 0; i < n; i++ {
+			if sm.Sample(&relay.Session{}, req) {
+				selected++
+			}
+		}
+		return selected
+	}
+
+	// The first matching rule applies, and requests matching none are
+	// always selected.
+	if n := sample("none.test", 100); n != 0 {
+		t.Errorf("none.test: %d selected, want 0", n)
+	}
+	if n := sample("example.com", 100); n != 100 {
+		t.Errorf("example.com: %d selected, want 100", n)
+	}
+	if n := sample("other.test", 2000); n < 800 || n > 1200 {
+		t.Errorf("other.test: %d of 2000 selected, want about half", n)
+	}
+
+	// Rate limited requests are selected in bursts of up to PerSecond.
+	if n := sample("limited.test", 10); n != 2 {
+		t.Errorf("limited.test: %d selected, want 2", n)
+	}
+
+	var none *relay.Sampler
+	if !none.Sample(&relay.Session{}, heat.NewRequest("GET", "/")) {
+		t.Errorf("a nil Sampler didn't select a request")
+	}
+}
+
+func TestSampledFlows(t *testing.T) {
+	m := new(counters)
+	skip, err := relay.ParseMatch("path=/skip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	never := &relay.Sampler{Rules: []relay.SampleRule{{Match: skip, Rate: 0}}}
+
+	var logged int32
+	fs := &relay.FlowStore{Sample: never}
+	p := &relay.Proxy{
+		Flows:     fs,
+		Metrics:   m,
+		LogSample: never,
+		OnComplete: func(s *relay.Session, req *heat.Request, resp *heat.Response, t relay.Timings) {
+			atomic.AddInt32(&logged, 1)
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			resp := heat.NewResponse(204, "No Content")
+			return resp, nil
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	for _, path := range []string{"/skip", "/keep", "/skip"} {
+		io.WriteString(conn, "GET http://origin.test"+path+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		io.ReadAll(resp.Body)
+		if resp.StatusCode != 204 {
+			t.Fatalf("%s: got status %d", path, resp.StatusCode)
+		}
+	}
+	conn.Close()
+
+	if flows := fs.Flows(nil); len(flows) != 1 || !strings.HasSuffix(flows[0].Request.URI, "/keep") {
+		t.Errorf("got %d flows", len(flows))
+	}
+	if n := m.get("flows.unsampled"); n != 2 {
+		t.Errorf("flows.unsampled = %d, want 2", n)
+	}
+
+	// OnComplete runs once the response has been written, so the last
+	// request may not have been counted yet.
+	for deadline := time.Now().Add(5 * time.Second); m.get("complete.unsampled") < 2 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := m.get("complete.unsampled"); n != 2 {
+		t.Errorf("complete.unsampled = %d, want 2", n)
+	}
+	if n := atomic.LoadInt32(&logged); n != 1 {
+		t.Errorf("OnComplete called %d times, want 1", n)
+	}
+}
@@ -0,0 +1,433 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// A Scanner inspects message bodies, such as for malware, before they're
+// delivered. Scanners for gateway antivirus engines typically pass bodies
+// on to the engine (over ICAP, say) as they arrive.
+type Scanner interface {
+	// Scan reads a body from r, returning a description of the threat it
+	// poses, or "" if it's clean. The response is nil when scanning request
+	// bodies. Bodies are decompressed for the scanner when their content
+	// coding is understood. Scan may return before reading all of r.
+	Scan(s *Session, req *heat.Request, resp *heat.Response, r io.Reader) (threat string, err error)
+}
+
+// A ContentBlocked error is returned when a Scanner finds a threat in a
+// message body.
+type ContentBlocked struct {
+	Threat string
+}
+
+func (e *ContentBlocked) Error() string {
+	return "relay: content blocked: " + e.Threat
+}
+
+// A ScanRule has message bodies checked by a Scanner before they're
+// delivered.
+//
+// Request bodies are spooled (see Session.SpoolRequest) and scanned before
+// the request is forwarded. Response bodies are held until they've been
+// scanned, such that blocked responses can be replaced with an error
+// response (see Proxy.ErrorHandler). Bodies larger than HoldLimit can't be
+// held without clients giving up on them, so the response's header is
+// relayed, and the body trickled to the client while the rest of it is
+// scanned. The last byte is only released once the scan is done, and
+// blocked bodies are cut short.
+type ScanRule struct {
+	// Requests the rule applies to. If nil, everything matches.
+	Match *Match
+
+	Scanner Scanner
+
+	// Which bodies are scanned.
+	Requests  bool
+	Responses bool
+
+	// Number of bytes of a response body held before its header is relayed.
+	// Defaults to 1 MiB.
+	HoldLimit int64
+
+	// Bytes per second trickled to clients while bodies larger than
+	// HoldLimit are being scanned. Zero means none.
+	Trickle int64
+
+	// If set, bodies are delivered when scanning them fails, rather than
+	// blocked.
+	FailOpen bool
+}
+
+// scanRule returns the first of p.ScanRules matching a request, and its
+// index.
+func (p *Proxy) scanRule(s *Session, req *heat.Request) (*ScanRule, int) {
+	for i := range p.ScanRules {
+		if r := &p.ScanRules[i]; r.Match.Request(s, req) {
+			return r, i
+		}
+	}
+	return nil, -1
+}
+
+// verdict turns the outcome of a scan into an error blocking delivery, if
+// there's to be one, reporting it.
+func (p *Proxy) verdict(s *Session, req *heat.Request, i int, threat string, err error) error {
+	r := &p.ScanRules[i]
+
+	switch {
+	case err != nil:
+		p.count("scan.errors", 1)
+		if r.FailOpen {
+			return nil
+		}
+		threat = "scan failed: " + err.Error()
+	case threat == "":
+		p.count("scan.clean", 1)
+		return nil
+	}
+
+	p.count("scan.blocked", 1)
+	p.decide(s, req, "", &DecisionRecord{
+		Action:  "deny",
+		Rule:    "ScanRules[" + strconv.Itoa(i) + "]",
+		Pattern: r.Match.String(),
+		Reason:  threat,
+	})
+
+	return &ContentBlocked{threat}
+}
+
+// scanRequest scans a request's body, if a rule says to.
+func (p *Proxy) scanRequest(s *Session, req *heat.Request) error {
+	r, i := p.scanRule(s, req)
+	if r == nil || !r.Requests || req.Body == nil {
+		return nil
+	}
+
+	sp, err := s.SpoolRequest(req)
+	if err != nil {
+		return err
+	}
+
+	body := scanInput(req.Fields, sp.Open())
+	threat, err := r.Scanner.Scan(s, req, nil, body)
+	body.Close()
+
+	return p.verdict(s, req, i, threat, err)
+}
+
+// scanInput decompresses a body for a scanner, if its coding is understood.
+func scanInput(fields heat.Fields, body io.ReadCloser) io.ReadCloser {
+	if coding, ok := fieldValue(fields, "Content-Encoding"); ok {
+		if dec, ok := decoder(strings.ToLower(strings.TrimSpace(coding)), body); ok {
+			return dec
+		}
+	}
+	return body
+}
+
+// scanResponse scans a response's body, if a rule says to, holding it until
+// it's been scanned or grown past the rule's hold limit.
+func (p *Proxy) scanResponse(s *Session, req *heat.Request, resp *heat.Response) error {
+	if resp.Body == nil || resp.Status == 101 {
+		return nil
+	}
+
+	r, i := p.scanRule(s, req)
+	if r == nil || !r.Responses {
+		return nil
+	}
+
+	mem, dir := int64(defaultSpoolMemory), p.SpoolDir
+	if p.SpoolMemory > 0 {
+		mem = p.SpoolMemory
+	}
+
+	hold := r.HoldLimit
+	if hold <= 0 {
+		hold = 1 << 20
+	}
+
+	pr, pw := io.Pipe()
+	sc := &scan{
+		src:     resp.Body,
+		pipe:    pr,
+		buf:     spillBuffer{limit: mem, dir: dir, prefix: "relay-scan-", budget: p.Memory},
+		trickle: r.Trickle,
+		start:   time.Now(),
+		copied:  make(chan struct{}),
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+
+	go sc.copy(pw)
+	go func() {
+		body := scanInput(resp.Fields, pr)
+		threat, err := r.Scanner.Scan(s, req, resp, body)
+		body.Close()
+
+		sc.finish(p.verdict(s, req, i, threat, err))
+	}()
+
+	// Wait for the scan to finish, or the body to outgrow the hold limit.
+	sc.mu.Lock()
+	for !sc.scanned && sc.buf.size <= hold {
+		sc.cond.Wait()
+	}
+	blocked := sc.blocked
+	sc.mu.Unlock()
+
+	if blocked != nil {
+		sc.Close()
+		return blocked
+	}
+
+	resp.Body = sc
+	return nil
+}
+
+// A scan relays a response body while it's being scanned, copying it from
+// upstream into a buffer, and from the buffer to the client, withholding
+// what the scan hasn't cleared yet.
+type scan struct {
+	src     io.ReadCloser
+	pipe    *io.PipeReader
+	trickle int64
+	start   time.Time
+	copied  chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     spillBuffer
+	done    bool  // the whole body has been copied
+	err     error // reading the body failed
+	scanned bool  // the scan has finished
+	blocked error // the scan blocked the body
+	off     int64 // bytes returned to the client
+	closed  bool
+}
+
+// copy copies the body into the buffer, and into w for the scanner.
+func (sc *scan) copy(w *io.PipeWriter) {
+	defer close(sc.copied)
+
+	buf := make([]byte, 32<<10)
+	feed := true
+
+	for {
+		n, err := sc.src.Read(buf)
+		if n > 0 && feed {
+			// The scanner may have stopped reading.
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				feed = false
+			}
+		}
+
+		sc.mu.Lock()
+		if n > 0 && sc.err == nil {
+			if _, werr := sc.buf.Write(buf[:n]); werr != nil {
+				sc.err = werr
+			}
+		}
+		if err != nil {
+			sc.done = true
+			if err != io.EOF && sc.err == nil {
+				sc.err = err
+			}
+		}
+		stop := sc.done || sc.closed || sc.err != nil
+		sc.cond.Broadcast()
+		sc.mu.Unlock()
+
+		if stop {
+			if err == io.EOF {
+				w.Close()
+			} else {
+				w.CloseWithError(io.ErrUnexpectedEOF)
+			}
+			return
+		}
+	}
+}
+
+// finish records the outcome of the scan.
+func (sc *scan) finish(blocked error) {
+	sc.mu.Lock()
+	sc.scanned, sc.blocked = true, blocked
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+}
+
+// allowance returns the number of bytes which may be returned to the
+// client so far, and how long to wait for the next one, if it's waiting on
+// time rather than data.
+func (sc *scan) allowance() (int64, time.Duration) {
+	if sc.scanned {
+		return sc.buf.size, 0
+	}
+
+	// Never release the last byte before the scan is done.
+	limit := sc.buf.size - 1
+	if sc.trickle <= 0 {
+		return 0, 0
+	}
+
+	elapsed := time.Since(sc.start)
+	n := int64(elapsed.Seconds() * float64(sc.trickle))
+	if n >= limit {
+		return limit, 0
+	}
+
+	next := time.Duration(float64(n+1)/float64(sc.trickle)*float64(time.Second)) - elapsed
+	return n, next
+}
+
+func (sc *scan) Read(p []byte) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for {
+		switch {
+		case sc.blocked != nil:
+			return 0, sc.blocked
+		case sc.scanned && sc.err != nil:
+			return 0, &UpstreamProtocolError{sc.err}
+		case sc.closed:
+			return 0, io.ErrClosedPipe
+		}
+
+		allowed, wait := sc.allowance()
+		if sc.off < allowed {
+			n := int64(len(p))
+			if n > allowed-sc.off {
+				n = allowed - sc.off
+			}
+			k, err := sc.buf.ReadAt(p[:n], sc.off)
+			sc.off += int64(k)
+			return k, err
+		}
+
+		if sc.scanned && sc.done {
+			return 0, io.EOF
+		}
+
+		if wait > 0 {
+			t := time.AfterFunc(wait, func() {
+				sc.mu.Lock()
+				sc.cond.Broadcast()
+				sc.mu.Unlock()
+			})
+			sc.cond.Wait()
+			t.Stop()
+		} else {
+			sc.cond.Wait()
+		}
+	}
+}
+
+func (sc *scan) Close() error {
+	sc.mu.Lock()
+	if sc.closed {
+		sc.mu.Unlock()
+		return nil
+	}
+	sc.closed = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	err := sc.src.Close()
+	sc.pipe.CloseWithError(io.ErrClosedPipe)
+	<-sc.copied
+
+	sc.mu.Lock()
+	sc.buf.Close()
+	sc.mu.Unlock()
+
+	return err
+}
+
+// A spillBuffer holds data in memory up to a limit, or for as long as its
+// budget allows, and in a temporary file beyond it.
+type spillBuffer struct {
+	limit  int64
+	dir    string
+	prefix string
+	budget *MemoryBudget
+
+	mem  []byte
+	file *os.File
+	size int64
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil {
+		spill := b.size+int64(len(p)) > b.limit
+		if !spill && !b.budget.reserve(MemorySpools, int64(len(p))) {
+			b.budget.count("memory.spools.spilled", 1)
+			spill = true
+		}
+		if spill {
+			if err := b.spill(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if b.file != nil {
+		n, err := b.file.WriteAt(p, b.size)
+		b.size += int64(n)
+		return n, err
+	}
+
+	b.mem = append(b.mem, p...)
+	b.size += int64(len(p))
+	return len(p), nil
+}
+
+// spill moves the data held in memory to a temporary file.
+func (b *spillBuffer) spill() error {
+	file, err := ioutil.TempFile(b.dir, b.prefix)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(b.mem); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	b.budget.release(MemorySpools, int64(len(b.mem)))
+	b.file, b.mem = file, nil
+	return nil
+}
+
+func (b *spillBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if b.file != nil {
+		return b.file.ReadAt(p, off)
+	}
+	return bytes.NewReader(b.mem).ReadAt(p, off)
+}
+
+func (b *spillBuffer) Close() error {
+	b.budget.release(MemorySpools, int64(len(b.mem)))
+	b.mem = nil
+
+	if b.file != nil {
+		file := b.file
+		b.file = nil
+
+		file.Close()
+		return os.Remove(file.Name())
+	}
+
+	return nil
+}
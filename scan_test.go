@@ -0,0 +1,216 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+// The scannerFunc type adapts a function to the Scanner interface.
+type scannerFunc func(body string) (string, error)
+
+func (f scannerFunc) Scan(s *relay.Session, req *heat.Request, resp *heat.Response, r io.Reader) (string, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return f(string(body))
+}
+
+// eicar flags bodies containing "EICAR", and fails on ones containing
+// "FAIL".
+var eicar = scannerFunc(func(body string) (string, error) {
+	switch {
+	case strings.Contains(body, "EICAR"):
+		return "EICAR-Test-File", nil
+	case strings.Contains(body, "FAIL"):
+		return "", errors.New("engine unavailable")
+	}
+	return "", nil
+})
+
+func TestScanRules(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	io.WriteString(zw, "gzipped EICAR")
+	zw.Close()
+
+	// Upstream response bodies, by path.
+	bodies := map[string]string{
+		"/clean":    "clean",
+		"/infected": "xx EICAR xx",
+		"/failing":  "FAIL",
+		"/gzip":     gz.String(),
+	}
+
+	sent := make(chan string, 1)
+	decisions := make(chan *relay.DecisionRecord, 1)
+	m := new(counters)
+
+	open, err := relay.ParseMatch("path=/open")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &relay.Proxy{
+		Metrics:       m,
+		AuditDecision: func(r *relay.DecisionRecord) { decisions <- r },
+		ScanRules: []relay.ScanRule{
+			{Match: open, Scanner: eicar, Responses: true, FailOpen: true},
+			{Scanner: eicar, Requests: true, Responses: true},
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			var body []byte
+			if req.Body != nil {
+				body, _ = io.ReadAll(req.Body)
+			}
+			sent <- string(body)
+
+			path := strings.TrimPrefix(req.URI, "/open")
+			resp := heat.NewResponse(200, "OK")
+			if path == "/gzip" {
+				resp.Fields.Set("Content-Encoding", "gzip")
+			}
+			resp.Fields.Set("Content-Length", strconv.Itoa(len(bodies[path])))
+			resp.Body = io.NopCloser(strings.NewReader(bodies[path]))
+			return resp, nil
+		},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		method, path, body string
+		status             int
+		forwarded          bool
+		blocked            string // the decision's reason
+	}{
+		{"GET", "/clean", "", 200, true, ""},
+		{"GET", "/infected", "", 403, true, "EICAR-Test-File"},
+		{"GET", "/gzip", "", 403, true, "EICAR-Test-File"},
+		{"GET", "/failing", "", 403, true, "scan failed: engine unavailable"},
+		{"GET", "/open/failing", "", 200, true, ""},
+		{"POST", "/clean", "some EICAR upload", 403, false, "EICAR-Test-File"},
+		{"POST", "/clean", "a clean upload", 200, true, ""},
+
+		// The first rule doesn't scan requests.
+		{"POST", "/open/clean", "some EICAR upload", 200, true, ""},
+	} {
+		conn := serve(t, p)
+		io.WriteString(conn, tt.method+" http://origin.test"+tt.path+" HTTP/1.1\r\nHost: origin.test\r\n"+
+			"Content-Length: "+strconv.Itoa(len(tt.body))+"\r\n\r\n"+tt.body)
+
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+		got, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, resp.StatusCode, tt.status)
+		} else if tt.status == 200 && string(got) != bodies[strings.TrimPrefix(tt.path, "/open")] {
+			t.Errorf("%s %s: got body %q", tt.method, tt.path, got)
+		}
+
+		select {
+		case body := <-sent:
+			if !tt.forwarded {
+				t.Errorf("%s %s: forwarded", tt.method, tt.path)
+			} else if body != tt.body {
+				t.Errorf("%s %s: forwarded body %q", tt.method, tt.path, body)
+			}
+		default:
+			if tt.forwarded {
+				t.Errorf("%s %s: not forwarded", tt.method, tt.path)
+			}
+		}
+
+		if tt.blocked != "" {
+			d := <-decisions
+			if d.Action != "deny" || d.Rule != "ScanRules[1]" || d.Reason != tt.blocked {
+				t.Errorf("%s %s: got decision %+v", tt.method, tt.path, d)
+			}
+		}
+	}
+
+	for name, want := range map[string]int64{"scan.clean": 4, "scan.blocked": 4, "scan.errors": 2} {
+		if n := m.get(name); n != want {
+			t.Errorf("%s = %d, want %d", name, n, want)
+		}
+	}
+}
+
+// The slowScanner type is a Scanner which doesn't finish until it's told
+// what it found.
+type slowScanner chan string
+
+func (sc slowScanner) Scan(s *relay.Session, req *heat.Request, resp *heat.Response, r io.Reader) (string, error) {
+	io.Copy(io.Discard, r)
+	return <-sc, nil
+}
+
+func TestScanLargeResponses(t *testing.T) {
+	body := strings.Repeat("x", 100)
+
+	for _, tt := range []struct {
+		trickle int64
+		threat  string
+	}{
+		{0, ""},
+		{0, "EICAR-Test-File"},
+		{1000, ""},
+		{1000, "EICAR-Test-File"},
+	} {
+		verdict := make(slowScanner)
+		p := &relay.Proxy{
+			ScanRules: []relay.ScanRule{{Scanner: verdict, Responses: true, HoldLimit: 10, Trickle: tt.trickle}},
+			RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+				resp := heat.NewResponse(200, "OK")
+				resp.Fields.Set("Content-Length", "100")
+				resp.Body = io.NopCloser(strings.NewReader(body))
+				return resp, nil
+			},
+		}
+
+		conn := serve(t, p)
+		io.WriteString(conn, "GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+
+		// The header is relayed before the scan is done.
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+		if resp.StatusCode != 200 {
+			t.Fatalf("got status %d", resp.StatusCode)
+		}
+
+		// Part of the body may be trickled while the scan is running, but
+		// never all of it.
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if tt.trickle > 0 {
+			buf := make([]byte, 20)
+			if _, err := io.ReadFull(resp.Body, buf); err != nil {
+				t.Fatalf("trickle %d: %v", tt.trickle, err)
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		verdict <- tt.threat
+
+		got, err := io.ReadAll(resp.Body)
+		if tt.trickle > 0 {
+			got = append([]byte(body[:20]), got...)
+		}
+
+		if tt.threat == "" && (err != nil || string(got) != body) {
+			t.Errorf("trickle %d: got %d bytes, %v", tt.trickle, len(got), err)
+		}
+		if tt.threat != "" && (err == nil || len(got) >= 100) {
+			t.Errorf("trickle %d: got %d bytes of a blocked body, %v", tt.trickle, len(got), err)
+		}
+	}
+}
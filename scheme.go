@@ -0,0 +1,33 @@
+package relay
+
+import (
+	"context"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// Schemes allowed when Proxy.Schemes is nil.
+var defaultSchemes = []string{"http", "https"}
+
+// allowScheme reports whether requests for URLs with a given scheme may be
+// served.
+func (p *Proxy) allowScheme(scheme string) bool {
+	scheme = strings.ToLower(scheme)
+
+	if _, ok := p.SchemeHandlers[scheme]; ok {
+		return true
+	}
+
+	list := p.Schemes
+	if list == nil {
+		list = defaultSchemes
+	}
+
+	return contains(list, scheme)
+}
+
+// schemeHandler returns the handler registered for a scheme, if any.
+func (p *Proxy) schemeHandler(scheme string) func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+	return p.SchemeHandlers[strings.ToLower(scheme)]
+}
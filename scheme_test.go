@@ -0,0 +1,65 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestSchemes(t *testing.T) {
+	ftp := ftpServer(t)
+
+	var handled string
+	p := &relay.Proxy{
+		Schemes: []string{"ftp"},
+		SchemeHandlers: map[string]func(ctx context.Context, req *heat.Request) (*heat.Response, error){
+			"gopher": func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+				handled = req.Scheme + "://" + req.Remote + req.URI
+				resp := heat.NewResponse(200, "OK")
+				resp.Fields.Set("Content-Length", "0")
+				return resp, nil
+			},
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	get := func(url string) (int, string) {
+		t.Helper()
+		io.WriteString(conn, "GET "+url+" HTTP/1.1\r\nHost: example.com\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// Registered handlers serve their schemes, whatever their case.
+	if status, _ := get("GOPHER://example.com/1/menu"); status != 200 || handled != "gopher://example.com/1/menu" {
+		t.Errorf("got status %d, and handler saw %q", status, handled)
+	}
+
+	// Listed schemes go to the transport, which can serve FTP.
+	if status, body := get("ftp://" + ftp + "/pub/file%20name.txt"); status != 200 || body != "hello world" {
+		t.Errorf("got status %d and body %q for FTP", status, body)
+	}
+
+	// Anything else is refused, including HTTP when not listed.
+	for _, url := range []string{"file:///etc/passwd", "http://example.com/"} {
+		if status, _ := get(url); status != 501 {
+			t.Errorf("%s: got status %d, want 501", url, status)
+		}
+	}
+}
+
+func TestDefaultSchemes(t *testing.T) {
+	conn := serve(t, &relay.Proxy{})
+	io.WriteString(conn, "GET gopher://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 501 {
+		t.Errorf("got status %d, want 501", resp.StatusCode)
+	}
+}
@@ -0,0 +1,59 @@
+package relay
+
+import (
+	"github.com/erkl/heat"
+)
+
+// A ScrubPolicy adjusts which header fields are removed from requests
+// forwarded in plain HTTP, and from their responses. By default these are
+// the hop-by-hop fields (Connection, Keep-Alive, Public, Proxy-Authenticate,
+// Proxy-Authorization, Proxy-Connection, TE, Trailers, Transfer-Encoding and
+// Upgrade), and any fields named in the Connection field. Content-Length is
+// always recomputed, and messages are always sent as HTTP/1.1.
+type ScrubPolicy struct {
+	// If set, no fields are removed, such as for transparent bridges.
+	Disable bool
+
+	// Names of fields removed in addition to the default ones.
+	Remove []string
+
+	// Names of fields kept even though they'd otherwise be removed, such as
+	// Proxy-Authorization, for chaining to a parent proxy expecting the
+	// client's credentials, or Transfer-Encoding, for passing transfer
+	// codings through.
+	Keep []string
+}
+
+// removes reports whether a field is to be removed from a message whose
+// Connection field lists tokens.
+func (sp *ScrubPolicy) removes(f heat.Field, tokens []string) bool {
+	if sp != nil {
+		if sp.Disable {
+			return false
+		}
+		for _, name := range sp.Keep {
+			if f.Is(name) {
+				return false
+			}
+		}
+		for _, name := range sp.Remove {
+			if f.Is(name) {
+				return true
+			}
+		}
+	}
+
+	for _, name := range blacklist {
+		if f.Is(name) {
+			return true
+		}
+	}
+
+	for _, name := range tokens {
+		if f.Is(name) {
+			return true
+		}
+	}
+
+	return false
+}
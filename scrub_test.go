@@ -0,0 +1,107 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestScrubPolicy(t *testing.T) {
+	sent := make(chan heat.Fields, 1)
+	p := &relay.Proxy{
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			if req.Body != nil {
+				io.ReadAll(req.Body)
+			}
+			sent <- req.Fields
+
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			resp.Fields.Set("Keep-Alive", "timeout=5")
+			resp.Fields.Set("X-Internal", "1")
+			return resp, nil
+		},
+	}
+
+	const request = "GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n" +
+		"Connection: X-Hop\r\nX-Hop: 1\r\nProxy-Authorization: Basic Zm9vOmJhcg==\r\n" +
+		"X-Internal: 1\r\nX-Other: 1\r\n\r\n"
+
+	for _, tt := range []struct {
+		name   string
+		policy *relay.ScrubPolicy
+
+		// Fields expected to be kept, in requests and responses.
+		request  []string
+		response []string
+	}{
+		{"default", nil, []string{"X-Internal", "X-Other"}, []string{"X-Internal"}},
+		{"remove", &relay.ScrubPolicy{Remove: []string{"x-internal"}}, []string{"X-Other"}, nil},
+		{"keep", &relay.ScrubPolicy{Keep: []string{"Proxy-Authorization", "X-Hop", "Keep-Alive"}},
+			[]string{"Proxy-Authorization", "X-Hop", "X-Internal", "X-Other"}, []string{"Keep-Alive", "X-Internal"}},
+		{"disable", &relay.ScrubPolicy{Disable: true, Remove: []string{"X-Internal"}},
+			[]string{"Connection", "Proxy-Authorization", "X-Hop", "X-Internal", "X-Other"}, []string{"Keep-Alive", "X-Internal"}},
+	} {
+		p.Scrub = tt.policy
+		if err := p.Validate(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		conn := serve(t, p)
+		io.WriteString(conn, request)
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+		fields := <-sent
+
+		check := func(what string, has func(string) bool, all, kept []string) {
+			for _, name := range all {
+				want := false
+				for _, k := range kept {
+					want = want || k == name
+				}
+				if has(name) != want {
+					t.Errorf("%s: %s has %s: %v, want %v", tt.name, what, name, has(name), want)
+				}
+			}
+		}
+
+		check("request", func(name string) bool { return field(fields, name) != "" },
+			[]string{"Connection", "Proxy-Authorization", "X-Hop", "X-Internal", "X-Other"}, tt.request)
+		check("response", func(name string) bool { return resp.Header.Get(name) != "" },
+			[]string{"Keep-Alive", "X-Internal"}, tt.response)
+	}
+}
+
+func TestScrubTransferEncoding(t *testing.T) {
+	sent := make(chan string, 1)
+	p := &relay.Proxy{
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			sent <- field(req.Fields, "Transfer-Encoding")
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			return resp, nil
+		},
+	}
+
+	// Unless kept, the original Transfer-Encoding field is replaced.
+	for _, tt := range []struct {
+		policy *relay.ScrubPolicy
+		want   string
+	}{
+		{nil, "chunked"},
+		{&relay.ScrubPolicy{Keep: []string{"Transfer-Encoding"}}, "gzip, chunked"},
+	} {
+		p.Scrub = tt.policy
+		conn := serve(t, p)
+		io.WriteString(conn, "POST http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n"+
+			"Transfer-Encoding: gzip, chunked\r\n\r\n0\r\n\r\n")
+		readFinal(t, conn, bufio.NewReader(conn))
+
+		if got := <-sent; got != tt.want {
+			t.Errorf("%+v: got Transfer-Encoding %q, want %q", tt.policy, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSecretNotFound is returned by SecretProviders asked for secrets they
+// don't have.
+var ErrSecretNotFound = errors.New("relay: secret not found")
+
+// A SecretProvider looks up secrets, such as API keys, by name. Secrets are
+// referenced as "${secret:NAME}" in the values of request HeaderRules, and
+// in the credentials of SigV4Signers and HMACSigners, such that they never
+// need to appear in static configuration.
+type SecretProvider interface {
+	Secret(ctx context.Context, name string) (string, error)
+}
+
+// The SecretFunc type adapts a function, such as one querying a vault
+// service, to the SecretProvider interface.
+type SecretFunc func(ctx context.Context, name string) (string, error)
+
+// Secret calls f(ctx, name).
+func (f SecretFunc) Secret(ctx context.Context, name string) (string, error) {
+	return f(ctx, name)
+}
+
+// EnvSecrets provides secrets from environment variables.
+type EnvSecrets struct {
+	// Prefix of the variables' names, such as "RELAY_SECRET_", such that
+	// secrets can't be used to read arbitrary variables.
+	Prefix string
+}
+
+// Secret returns the value of the environment variable named Prefix+name.
+func (es *EnvSecrets) Secret(ctx context.Context, name string) (string, error) {
+	v, ok := os.LookupEnv(es.Prefix + name)
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return v, nil
+}
+
+// FileSecrets provides secrets from files in a directory, one per file, as
+// mounted by container orchestrators. Files are read every time, such that
+// rotated secrets are picked up.
+type FileSecrets struct {
+	Dir string
+}
+
+// Secret returns the contents of the file named name in Dir, without any
+// trailing newline.
+func (fs *FileSecrets) Secret(ctx context.Context, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", ErrSecretNotFound
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(fs.Dir, name))
+	if os.IsNotExist(err) {
+		return "", ErrSecretNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// A SecretCache caches the secrets of another provider, fetching them again
+// once they're older than TTL, such that rotated secrets are picked up
+// without asking the provider for every request. If fetching a secret fails,
+// its previous value keeps being used. A SecretCache is safe for concurrent
+// use.
+type SecretCache struct {
+	Provider SecretProvider
+
+	// How long secrets are cached. Zero means forever (or until
+	// Invalidate is called).
+	TTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value   string
+	fetched time.Time
+}
+
+// Secret returns a cached secret, fetching it if it's missing or stale.
+func (c *SecretCache) Secret(ctx context.Context, name string) (string, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	e, ok := c.entries[name]
+	c.mu.Unlock()
+
+	if ok && (c.TTL <= 0 || now.Sub(e.fetched) < c.TTL) {
+		return e.value, nil
+	}
+
+	v, err := c.Provider.Secret(ctx, name)
+	if err != nil {
+		if ok && err != ErrSecretNotFound {
+			return e.value, nil
+		}
+		return "", err
+	}
+
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]cachedSecret)
+	}
+	c.entries[name] = cachedSecret{v, now}
+	c.mu.Unlock()
+
+	return v, nil
+}
+
+// Invalidate drops a secret from the cache, such that it's fetched again the
+// next time it's needed. An empty name drops all secrets.
+func (c *SecretCache) Invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if name == "" {
+		c.entries = nil
+	} else {
+		delete(c.entries, name)
+	}
+}
+
+// Secret looks up a secret using the proxy's SecretProvider, for use by
+// Signers.
+func (s *Session) Secret(name string) (string, error) {
+	if s.proxy == nil || s.proxy.Secrets == nil {
+		return "", fmt.Errorf("relay: secret %q: no secret provider", name)
+	}
+
+	v, err := s.proxy.Secrets.Secret(s.Context(), name)
+	if err != nil {
+		return "", fmt.Errorf("relay: secret %q: %w", name, err)
+	}
+
+	return v, nil
+}
+
+// expandSecrets replaces the "${secret:NAME}" references in v with the
+// secrets they name.
+func (s *Session) expandSecrets(v string) (string, error) {
+	if !hasSecrets(v) {
+		return v, nil
+	}
+
+	var b strings.Builder
+	for {
+		i := strings.Index(v, "${secret:")
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(v[i:], '}')
+		if j < 0 {
+			break
+		}
+
+		secret, err := s.Secret(v[i+len("${secret:") : i+j])
+		if err != nil {
+			return "", err
+		}
+
+		b.WriteString(v[:i])
+		b.WriteString(secret)
+		v = v[i+j+1:]
+	}
+	b.WriteString(v)
+
+	return b.String(), nil
+}
+
+// hasSecrets reports whether v references any secrets.
+func hasSecrets(v string) bool {
+	return strings.Contains(v, "${secret:")
+}
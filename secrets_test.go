@@ -0,0 +1,213 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+func TestSecretProviders(t *testing.T) {
+	ctx := context.Background()
+
+	t.Setenv("RELAY_TEST_SECRET_token", "from-env")
+	env := &relay.EnvSecrets{Prefix: "RELAY_TEST_SECRET_"}
+	if v, err := env.Secret(ctx, "token"); err != nil || v != "from-env" {
+		t.Errorf("EnvSecrets: got %q, %v", v, err)
+	}
+	if _, err := env.Secret(ctx, "missing"); err != relay.ErrSecretNotFound {
+		t.Errorf("EnvSecrets: got %v for a missing secret", err)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "token"), []byte("from-file\r\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "..token"), []byte("dotted"), 0600)
+
+	files := &relay.FileSecrets{Dir: dir}
+	if v, err := files.Secret(ctx, "token"); err != nil || v != "from-file" {
+		t.Errorf("FileSecrets: got %q, %v", v, err)
+	}
+	if v, err := files.Secret(ctx, "..token"); err != nil || v != "dotted" {
+		t.Errorf("FileSecrets: got %q, %v", v, err)
+	}
+
+	// Names can't reach outside the directory.
+	for _, name := range []string{"missing", "", ".", "..", "../token", "sub/token", `sub\token`} {
+		if _, err := files.Secret(ctx, name); err != relay.ErrSecretNotFound {
+			t.Errorf("FileSecrets: got %v for %q", err, name)
+		}
+	}
+}
+
+// The vault type is a SecretProvider whose secrets can be changed, counting
+// how often it's asked for them.
+type vault struct {
+	mu      sync.Mutex
+	secrets map[string]string
+	fail    error
+	fetches int
+}
+
+func (v *vault) Secret(ctx context.Context, name string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.fetches++
+	if v.fail != nil {
+		return "", v.fail
+	}
+	s, ok := v.secrets[name]
+	if !ok {
+		return "", relay.ErrSecretNotFound
+	}
+	return s, nil
+}
+
+// set changes a secret, removing it if value is empty, and makes the vault
+// fail with err.
+func (v *vault) set(name, value string, err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if value == "" {
+		delete(v.secrets, name)
+	} else {
+		v.secrets[name] = value
+	}
+	v.fail = err
+}
+
+func (v *vault) count() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.fetches
+}
+
+func TestSecretCache(t *testing.T) {
+	ctx := context.Background()
+	v := &vault{secrets: map[string]string{"a": "1"}}
+	c := &relay.SecretCache{Provider: v}
+
+	check := func(want string, fetches int) {
+		t.Helper()
+		got, err := c.Secret(ctx, "a")
+		if err != nil || got != want {
+			t.Errorf("got %q, %v, want %q", got, err, want)
+		}
+		if n := v.count(); n != fetches {
+			t.Errorf("got %d fetches, want %d", n, fetches)
+		}
+	}
+
+	// Without a TTL, secrets are cached until invalidated.
+	check("1", 1)
+	v.set("a", "2", nil)
+	check("1", 1)
+	c.Invalidate("a")
+	check("2", 2)
+	v.set("a", "3", nil)
+	c.Invalidate("")
+	check("3", 3)
+
+	// With one, they're fetched again once stale, and the old value is
+	// used while the provider fails.
+	c.TTL = 20 * time.Millisecond
+	time.Sleep(30 * time.Millisecond)
+	v.set("a", "3", errors.New("unavailable"))
+	if got, err := c.Secret(ctx, "a"); err != nil || got != "3" {
+		t.Errorf("got %q, %v while failing", got, err)
+	}
+
+	// Secrets which are gone aren't.
+	v.set("a", "", nil)
+	if _, err := c.Secret(ctx, "a"); err != relay.ErrSecretNotFound {
+		t.Errorf("got %v for a removed secret", err)
+	}
+	v.set("a", "4", nil)
+	check("4", 6)
+}
+
+func TestSecretInjection(t *testing.T) {
+	v := &vault{secrets: map[string]string{"token": "t0k3n", "key": "k3y", "id": "AKID"}}
+
+	p, sent := signingProxy(t, time.Now())
+	p.Secrets = v
+	p.Signing = []relay.SigningRule{{Signer: &relay.SigV4Signer{
+		AccessKeyID:     "${secret:id}",
+		SecretAccessKey: "${secret:key}",
+		Region:          "us-east-1",
+		Service:         "s3",
+		UnsignedPayload: true,
+	}}}
+	p.HeaderRules = []relay.HeaderRule{
+		{Request: true, Action: relay.SetHeader, Name: "X-Api-Key", Value: "Bearer ${secret:token}; ${secret:id}"},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+	if resp := readFinal(t, conn, r); resp.StatusCode != 200 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	req := <-sent
+	if got := field(req.fields, "X-Api-Key"); got != "Bearer t0k3n; AKID" {
+		t.Errorf("got X-Api-Key %q", got)
+	}
+	if got := field(req.fields, "Authorization"); !strings.Contains(got, "Credential=AKID/") {
+		t.Errorf("got Authorization %q", got)
+	}
+
+	// Requests needing secrets which can't be found aren't forwarded.
+	v.set("token", "", nil)
+	io.WriteString(conn, "GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+	if resp := readFinal(t, conn, r); resp.StatusCode < 500 {
+		t.Errorf("got status %d without the secret", resp.StatusCode)
+	}
+	select {
+	case req := <-sent:
+		t.Errorf("forwarded %+v", req)
+	default:
+	}
+}
+
+func TestHMACSignerKeySecret(t *testing.T) {
+	p, sent := signingProxy(t, time.Now())
+	p.Secrets = relay.SecretFunc(func(ctx context.Context, name string) (string, error) {
+		if name != "hmac" {
+			return "", relay.ErrSecretNotFound
+		}
+		return "secret", nil
+	})
+	p.Signing = []relay.SigningRule{{Signer: &relay.HMACSigner{KeyID: "k", KeySecret: "hmac", Headers: []string{"host"}}}}
+
+	conn := serve(t, p)
+	io.WriteString(conn, "GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 200 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	// The same signature as with the key given directly.
+	want := (<-sent).fields
+	p, sent = signingProxy(t, time.Now(), relay.SigningRule{
+		Signer: &relay.HMACSigner{KeyID: "k", Key: []byte("secret"), Headers: []string{"host"}},
+	})
+
+	conn = serve(t, p)
+	io.WriteString(conn, "GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+	readFinal(t, conn, bufio.NewReader(conn))
+	if got := (<-sent).fields; field(got, "Signature") != field(want, "Signature") {
+		t.Errorf("got Signature %q, want %q", field(got, "Signature"), field(want, "Signature"))
+	}
+}
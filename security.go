@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"strconv"
+
+	"github.com/erkl/heat"
+)
+
+// A SecurityRule enforces a security header policy on the responses to
+// matching requests, such as for hardening legacy applications which don't
+// set the appropriate header fields themselves.
+type SecurityRule struct {
+	// Requests whose responses the rule applies to. If nil, everything
+	// matches.
+	Match *Match
+
+	// Values for the Content-Security-Policy, X-Frame-Options ("DENY" or
+	// "SAMEORIGIN") and Referrer-Policy header fields. Empty values leave
+	// the fields alone.
+	ContentSecurityPolicy string
+	FrameOptions          string
+	ReferrerPolicy        string
+
+	// If true, responses get an "X-Content-Type-Options: nosniff" field.
+	NoSniff bool
+
+	// Value for the Strict-Transport-Security field of responses to HTTPS
+	// requests, such as "max-age=31536000". If StripHSTS is set, the field
+	// is removed from all responses instead.
+	StrictTransportSecurity string
+	StripHSTS               bool
+
+	// If true, the rule's values replace any set by the server. Otherwise
+	// they're only added to responses lacking them.
+	Override bool
+}
+
+// apply enforces the rule on the header of a response to a request with the
+// given scheme.
+func (r *SecurityRule) apply(scheme string, fields *heat.Fields) {
+	set := func(name, value string) {
+		if value == "" {
+			return
+		}
+		if _, ok := fieldValue(*fields, name); ok && !r.Override {
+			return
+		}
+		fields.Set(name, value)
+	}
+
+	set("Content-Security-Policy", r.ContentSecurityPolicy)
+	set("X-Frame-Options", r.FrameOptions)
+	set("Referrer-Policy", r.ReferrerPolicy)
+
+	if r.NoSniff {
+		set("X-Content-Type-Options", "nosniff")
+	}
+
+	if r.StripHSTS {
+		fields.Filter(func(f heat.Field) bool {
+			return !f.Is("Strict-Transport-Security")
+		})
+	} else if scheme == "https" {
+		set("Strict-Transport-Security", r.StrictTransportSecurity)
+	}
+}
+
+// applySecurityRules enforces the first rule in p.SecurityHeaders matching
+// req on its response.
+func (p *Proxy) applySecurityRules(s *Session, req *heat.Request, resp *heat.Response) {
+	for i := range p.SecurityHeaders {
+		r := &p.SecurityHeaders[i]
+		if !r.Match.Request(s, req) {
+			continue
+		}
+
+		r.apply(req.Scheme, &resp.Fields)
+
+		p.decide(s, req, "", &DecisionRecord{
+			Action:  "rewrite",
+			Rule:    "SecurityHeaders[" + strconv.Itoa(i) + "]",
+			Pattern: r.Match.String(),
+		})
+
+		return
+	}
+}
@@ -0,0 +1,96 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	legacy, _ := relay.ParseMatch("path=/legacy")
+	override, _ := relay.ParseMatch("path=/override")
+
+	p := &relay.Proxy{
+		SecurityHeaders: []relay.SecurityRule{
+			{
+				Match:                   legacy,
+				ContentSecurityPolicy:   "default-src 'self'",
+				FrameOptions:            "DENY",
+				NoSniff:                 true,
+				StrictTransportSecurity: "max-age=60",
+			},
+			{Match: override, FrameOptions: "SAMEORIGIN", Override: true},
+			{StripHSTS: true},
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			if !strings.HasSuffix(req.URI, "/bare") {
+				resp.Fields.Set("X-Frame-Options", "ALLOWALL")
+				resp.Fields.Set("Strict-Transport-Security", "max-age=1")
+			}
+			return resp, nil
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	get := func(uri string) http.Header {
+		t.Helper()
+		io.WriteString(conn, "GET "+uri+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		io.ReadAll(resp.Body)
+		return resp.Header
+	}
+
+	tests := []struct {
+		uri  string
+		want map[string]string
+	}{
+		// Fields set by the server are left alone, unless the rule says
+		// otherwise.
+		{"http://origin.test/legacy", map[string]string{
+			"Content-Security-Policy":   "default-src 'self'",
+			"X-Frame-Options":           "ALLOWALL",
+			"X-Content-Type-Options":    "nosniff",
+			"Strict-Transport-Security": "max-age=1",
+		}},
+		{"http://origin.test/override", map[string]string{
+			"Content-Security-Policy":   "",
+			"X-Frame-Options":           "SAMEORIGIN",
+			"Strict-Transport-Security": "max-age=1",
+		}},
+
+		// Strict-Transport-Security is only added to HTTPS responses.
+		{"http://origin.test/legacy/bare", map[string]string{
+			"X-Frame-Options":           "DENY",
+			"Strict-Transport-Security": "",
+		}},
+		{"https://origin.test/legacy/bare", map[string]string{
+			"X-Frame-Options":           "DENY",
+			"Strict-Transport-Security": "max-age=60",
+		}},
+
+		// Only the first matching rule applies.
+		{"http://origin.test/other", map[string]string{
+			"X-Frame-Options":           "ALLOWALL",
+			"Strict-Transport-Security": "",
+		}},
+	}
+
+	for _, tt := range tests {
+		h := get(tt.uri)
+		for name, want := range tt.want {
+			if got := h.Get(name); got != want {
+				t.Errorf("%s: got %s %q, want %q", tt.uri, name, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package relay
+
+import (
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// A ListenerConfig holds settings specific to one of the listeners served
+// by a proxy. Everything not covered here is shared between all listeners.
+type ListenerConfig struct {
+	// Name of the listener, for the benefit of hooks.
+	Name string
+
+	// If set, replaces Proxy.Intercept for connections accepted by this
+	// listener.
+	Intercept func(s *Session, addr string) bool
+
+	// If set, replaces Proxy.OriginForm for connections accepted by this
+	// listener.
+	OriginForm OriginFormPolicy
+
+	// If set, replaces Proxy.Reverse for connections accepted by this
+	// listener. Unless OriginForm says otherwise, it also makes the listener
+	// act as a reverse proxy.
+	Reverse *url.URL
+
+	// If true, connections accepted by this listener must begin with a
+	// PROXY protocol header, regardless of Proxy.AcceptProxyProtocol.
+	AcceptProxyProtocol bool
+
+	// If true, the protocol of connections accepted by this listener is
+	// detected as described for Proxy.DetectProtocols.
+	DetectProtocols bool
+}
+
+// An OriginFormPolicy decides what to do with requests which have relative
+// URIs ("origin-form", as sent to regular web servers rather than proxies)
+// on a plain HTTP connection.
+type OriginFormPolicy int
+
+const (
+	// In a ListenerConfig, defer to the Proxy's policy. In a Proxy, the
+	// same as OriginFormReject.
+	OriginFormDefault OriginFormPolicy = iota
+
+	// Reject such requests with "400 Bad Request".
+	OriginFormReject
+
+	// Forward such requests to the Reverse URL, acting as a reverse proxy.
+	OriginFormReverse
+
+	// Forward such requests to the server named by their Host header
+	// field, as a transparent proxy.
+	OriginFormTransparent
+)
+
+// resolveOriginForm turns a relative request URI into an absolute one,
+// following the session's origin-form policy. Returns nil if the request
+// should be rejected.
+func (p *Proxy) resolveOriginForm(s *Session, req *heat.Request, u *url.URL) *url.URL {
+	policy, reverse := p.OriginForm, p.Reverse
+
+	if l := s.Listener; l != nil {
+		if l.Reverse != nil {
+			policy, reverse = OriginFormReverse, l.Reverse
+		}
+		if l.OriginForm != OriginFormDefault {
+			policy = l.OriginForm
+		}
+	}
+
+	switch policy {
+	case OriginFormReverse:
+		if reverse != nil {
+			return reverse.ResolveReference(u)
+		}
+
+	case OriginFormTransparent:
+		if host, ok := fieldValue(req.Fields, "Host"); ok && host != "" {
+			abs := *u
+			abs.Scheme = "http"
+			abs.Host = host
+			return &abs
+		}
+	}
+
+	return nil
+}
+
+// ServeListener accepts connections from l, serving each in a new goroutine
+// with settings from cfg (which may be nil). It returns once l.Accept fails
+// with a non-temporary error, or immediately if the proxy's configuration
+// is invalid (see Validate).
+func (p *Proxy) ServeListener(l net.Listener, cfg *ListenerConfig) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if cfg != nil {
+		if err := validateOriginForm(cfg.OriginForm, cfg.Reverse); err != nil {
+			return err
+		}
+	}
+
+	return acceptLoop(l, p.sleep, func(conn net.Conn) {
+		p.serve(conn, cfg)
+	})
+}
+
+// acceptLoop accepts connections from l, passing each to serve in a new
+// goroutine and closing it afterwards. It returns once l.Accept fails with a
+// non-temporary error.
+func acceptLoop(l net.Listener, sleep func(d time.Duration), serve func(conn net.Conn)) error {
+	var delay time.Duration
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// Back off when running out of file descriptors and the like.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay *= 2; delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay > time.Second {
+					delay = time.Second
+				}
+
+				sleep(delay)
+				continue
+			}
+
+			return err
+		}
+
+		delay = 0
+
+		go func() {
+			defer conn.Close()
+			serve(conn)
+		}()
+	}
+}
+
+// intercept decides whether a CONNECT tunnel to addr should be intercepted.
+func (p *Proxy) intercept(s *Session, addr string) bool {
+	fn := p.Intercept
+	if s.Listener != nil && s.Listener.Intercept != nil {
+		fn = s.Listener.Intercept
+	}
+	if pol, _ := p.userPolicy(s); pol != nil && pol.Intercept != nil {
+		fn = pol.Intercept
+	}
+
+	return fn == nil || fn(s, addr)
+}
+
+// sleep pauses for a duration according to the proxy's clock.
+func (p *Proxy) sleep(d time.Duration) {
+	wake := make(chan struct{})
+	p.clock().AfterFunc(d, func() { close(wake) })
+	<-wake
+}
@@ -0,0 +1,200 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+	"github.com/erkl/relay/relaytest"
+)
+
+func FuzzConnect(f *testing.F) {
+	f.Add("example.com:443", []byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	f.Add("example.com:80", []byte("SSH-2.0-OpenSSH\r\n"))
+	f.Add("[::1]:443", []byte(nil))
+	f.Add("example.com", []byte(nil))
+	f.Add(":443", []byte(nil))
+	f.Add("exa mple.com:443", []byte(nil))
+	f.Add("example.com:99999", []byte(nil))
+
+	s := relaytest.NewServer(nil)
+	defer s.Close()
+
+	// Only one host is intercepted, and its decision cached, as forging a
+	// certificate for every input would slow fuzzing to a crawl. Others are
+	// tunneled.
+	p := &relay.Proxy{
+		Authority: s.Authority,
+		Decisions: &relay.DecisionCache{},
+		Intercept: func(s *relay.Session, addr string) bool {
+			return addr == "example.com:443"
+		},
+	}
+
+	f.Fuzz(func(t *testing.T, addr string, upstream []byte) {
+		out := relaytest.ServeBytes(p, []byte("CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n"), upstream)
+		if len(out) > 0 && !bytes.HasPrefix(out, []byte("HTTP/1.1 ")) {
+			t.Fatalf("CONNECT %q answered with %q", addr, out)
+		}
+	})
+}
+
+func FuzzServeBytes(f *testing.F) {
+	f.Add([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		[]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+	f.Add([]byte("POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"),
+		[]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"))
+	f.Add([]byte("GET http://example.com/ HTTP/1.0\r\n\r\nGET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		[]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"))
+	f.Add([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nRange: bytes=0-1\r\n\r\n"),
+		[]byte("HTTP/1.1 206 Partial Content\r\nContent-Range: bytes 0-1/5\r\nContent-Length: 2\r\n\r\nhe"))
+	f.Add([]byte("GET / HTTP/1.1\r\n\r\n"), []byte(nil))
+
+	p := &relay.Proxy{Via: "fuzz", StripRanges: true}
+
+	f.Fuzz(func(t *testing.T, client, upstream []byte) {
+		out := relaytest.ServeBytes(p, client, upstream)
+		if len(out) > 0 && !bytes.HasPrefix(out, []byte("HTTP/1.")) {
+			t.Fatalf("answered with %q", out)
+		}
+	})
+}
+
+// listen serves connections from a new TCP listener using p and cfg, and
+// returns a connection to it.
+func listen(t *testing.T, p *relay.Proxy, cfg *relay.ListenerConfig) net.Conn {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- p.ServeListener(l, cfg) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	t.Cleanup(func() {
+		conn.Close()
+		l.Close()
+		<-done
+	})
+
+	return conn
+}
+
+func TestServeListeners(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	names := make(chan string, 2)
+	p := &relay.Proxy{
+		RoundTrip: roundTrip,
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			names <- s.Listener.Name
+			return nil
+		},
+	}
+
+	// The reverse proxy listener accepts relative URIs...
+	reverse := listen(t, p, &relay.ListenerConfig{Name: "reverse", Reverse: &url.URL{Scheme: "http", Host: addr}})
+	io.WriteString(reverse, "GET /index.html HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+	if resp := readFinal(t, reverse, bufio.NewReader(reverse)); resp.StatusCode != 200 {
+		t.Errorf("reverse proxy listener: got status %d, want 200", resp.StatusCode)
+	}
+
+	// ...while one sharing the same proxy, without any overrides, doesn't.
+	forward := listen(t, p, &relay.ListenerConfig{Name: "forward"})
+	io.WriteString(forward, "GET /index.html HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+	if resp := readFinal(t, forward, bufio.NewReader(forward)); resp.StatusCode != 400 {
+		t.Errorf("forward proxy listener: got status %d, want 400", resp.StatusCode)
+	}
+
+	io.WriteString(forward, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	if resp := readFinal(t, forward, bufio.NewReader(forward)); resp.StatusCode != 200 {
+		t.Errorf("forward proxy listener: got status %d, want 200", resp.StatusCode)
+	}
+
+	for _, want := range []string{"reverse", "forward"} {
+		if got := <-names; got != want {
+			t.Errorf("request served by listener %q, want %q", got, want)
+		}
+	}
+}
+
+func TestListenerIntercept(t *testing.T) {
+	ca, _ := testAuthority(t)
+	p := &relay.Proxy{RoundTrip: roundTrip, Authority: ca}
+
+	// The listener's Intercept replaces the proxy's, so the tunnel is
+	// relayed opaquely rather than intercepted.
+	addr := rawUpstream(t, func(conn *net.TCPConn) {
+		io.WriteString(conn, "SSH-2.0-test\r\n")
+	})
+
+	conn := listen(t, p, &relay.ListenerConfig{
+		Intercept: func(s *relay.Session, addr string) bool { return false },
+	})
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	if resp := readFinal(t, conn, r); resp.StatusCode != 200 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if line, _ := r.ReadString('\n'); line != "SSH-2.0-test\r\n" {
+		t.Errorf("got %q from the tunnel, want the upstream server's greeting", line)
+	}
+}
+
+func TestOriginFormPolicies(t *testing.T) {
+	seen := make(chan string, 1)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		seen <- req.Host + req.URL.Path
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	reverse := &url.URL{Scheme: "http", Host: addr}
+
+	tests := []struct {
+		name    string
+		p       *relay.Proxy
+		host    string
+		status  int
+		forward string
+	}{
+		{"default", &relay.Proxy{}, addr, 400, ""},
+		{"reject", &relay.Proxy{OriginForm: relay.OriginFormReject, Reverse: reverse}, addr, 400, ""},
+		{"reverse", &relay.Proxy{OriginForm: relay.OriginFormReverse, Reverse: reverse}, "www.example.com", 200, "www.example.com/page"},
+		{"transparent", &relay.Proxy{OriginForm: relay.OriginFormTransparent}, addr, 200, addr + "/page"},
+		{"transparent without host", &relay.Proxy{OriginForm: relay.OriginFormTransparent}, "", 400, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := serve(t, tt.p)
+			io.WriteString(conn, "GET /page HTTP/1.1\r\nHost: "+tt.host+"\r\n\r\n")
+
+			if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != tt.status {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.forward != "" {
+				if got := <-seen; got != tt.forward {
+					t.Errorf("upstream got %q, want %q", got, tt.forward)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// A Session holds the state shared by all requests a client makes over a
+// single connection to the proxy.
+type Session struct {
+	// The client's connection.
+	Conn net.Conn
+
+	// The client's address. When the proxy accepts PROXY protocol headers,
+	// this is the address reported by the load balancer.
+	ClientAddr net.Addr
+
+	// Configuration of the listener which accepted the connection, or nil
+	// if it was passed directly to Proxy.Serve.
+	Listener *ListenerConfig
+
+	// If non-nil, cookies set by upstream servers will be stored in Jar, and
+	// attached to later requests to the same servers. Clients still see
+	// all Set-Cookie header fields. Jar may be shared between sessions.
+	Jar http.CookieJar
+
+	// Header fields set on every request forwarded on behalf of the client,
+	// replacing any fields of the same name.
+	Header heat.Fields
+
+	// Name of the user the client has authenticated as, when Proxy.Auth is
+	// set.
+	User string
+
+	// Claims of the bearer token the client authenticated with, if any.
+	Claims map[string]interface{}
+
+	proxy  *Proxy
+	spools []*Spool
+	shed   bool
+	base   context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	timer  *timer
+	intent ClientIntent
+
+	// Set once reads from the client's connection have been interrupted.
+	interrupted int32
+
+	// Flow of a WebSocket connection about to be relayed, if recorded.
+	upgraded *Flow
+
+	// GraphQL operations of the current request, if any.
+	graphql *graphqlRequest
+
+	gss        GSSContext
+	authExpiry time.Time
+	policy     *UserPolicy
+	policyUser string
+
+	annotations    map[interface{}]interface{}
+	reqAnnotations map[interface{}]interface{}
+}
+
+// prepare adds sticky header fields and stored cookies to a request.
+func (s *Session) prepare(req *heat.Request) {
+	for _, f := range s.Header {
+		req.Fields.Set(f.Name, f.Value)
+	}
+
+	if s.Jar == nil {
+		return
+	}
+
+	u := requestURL(req)
+	if u == nil {
+		return
+	}
+
+	cookies := s.Jar.Cookies(u)
+	if len(cookies) == 0 {
+		return
+	}
+
+	// Merge the stored cookies with those sent by the client. Cookies
+	// of the same name sent by the client take precedence.
+	var pairs []string
+	var names = make(map[string]bool)
+
+	req.Fields.Split("Cookie", ';', func(v string) bool {
+		if v = strings.TrimSpace(v); v != "" {
+			if i := strings.IndexByte(v, '='); i > 0 {
+				names[v[:i]] = true
+			}
+			pairs = append(pairs, v)
+		}
+		return true
+	})
+
+	for _, c := range cookies {
+		if !names[c.Name] {
+			pairs = append(pairs, c.Name+"="+c.Value)
+		}
+	}
+
+	req.Fields.Set("Cookie", strings.Join(pairs, "; "))
+}
+
+// forwardedFor appends the client's IP address to a request's
+// X-Forwarded-For header field.
+func (s *Session) forwardedFor(req *heat.Request) {
+	ip := hostname(s.ClientAddr.String())
+
+	// In-memory connections and UNIX sockets have no IP address to report.
+	if net.ParseIP(ip) == nil {
+		return
+	}
+
+	if prior, ok := fieldValue(req.Fields, "X-Forwarded-For"); ok {
+		ip = prior + ", " + ip
+	}
+
+	req.Fields.Set("X-Forwarded-For", ip)
+}
+
+// capture stores any cookies set by a response in the session's jar.
+func (s *Session) capture(req *heat.Request, resp *heat.Response) {
+	if s.Jar == nil {
+		return
+	}
+
+	var header = make(http.Header)
+
+	for _, f := range resp.Fields {
+		if f.Is("Set-Cookie") {
+			header.Add("Set-Cookie", f.Value)
+		}
+	}
+
+	if len(header) == 0 {
+		return
+	}
+
+	if u := requestURL(req); u != nil {
+		cookies := (&http.Response{Header: header}).Cookies()
+		s.Jar.SetCookies(u, cookies)
+	}
+}
+
+// requestURL reconstructs the full URL of a request about to be forwarded.
+func requestURL(req *heat.Request) *url.URL {
+	u, err := url.ParseRequestURI(req.URI)
+	if err != nil {
+		return nil
+	}
+
+	u.Scheme = req.Scheme
+	u.Host = req.Remote
+
+	return u
+}
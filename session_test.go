@@ -0,0 +1,97 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestSessionCookiesAndHeader(t *testing.T) {
+	seen := make(chan *http.Request, 2)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		seen <- req
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\n"+
+			"Set-Cookie: token=abc; Path=/\r\n"+
+			"Content-Length: 0\r\n\r\n")
+	})
+
+	p := &relay.Proxy{
+		RoundTrip: roundTrip,
+		OnSession: func(s *relay.Session) {
+			s.Jar, _ = cookiejar.New(nil)
+			s.Header.Set("X-Test-Env", "staging")
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	for i := 0; i < 2; i++ {
+		io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\n"+
+			"Host: "+addr+"\r\n"+
+			"Cookie: theme=dark\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		io.Copy(io.Discard, resp.Body)
+
+		// Clients still see the cookies being set.
+		if resp.Header.Get("Set-Cookie") == "" {
+			t.Errorf("response %d: Set-Cookie was removed", i+1)
+		}
+	}
+
+	first, second := <-seen, <-seen
+
+	if got := first.Header.Get("X-Test-Env"); got != "staging" {
+		t.Errorf("sticky field: got %q, want %q", got, "staging")
+	}
+	if _, err := first.Cookie("token"); err == nil {
+		t.Errorf("first request carried a cookie not yet set")
+	}
+	if c, err := second.Cookie("token"); err != nil || c.Value != "abc" {
+		t.Errorf("second request lacks the stored cookie (header %q)", second.Header.Get("Cookie"))
+	}
+	if c, err := second.Cookie("theme"); err != nil || c.Value != "dark" {
+		t.Errorf("the client's own cookie was lost (header %q)", second.Header.Get("Cookie"))
+	}
+}
+
+func TestSessionHooks(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	})
+
+	p := &relay.Proxy{
+		RoundTrip: roundTrip,
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			if req.URI == "/blocked" {
+				resp := heat.NewResponse(403, "Forbidden")
+				resp.Fields.Set("Content-Length", "0")
+				return resp
+			}
+			return nil
+		},
+		OnResponse: func(s *relay.Session, req *heat.Request, resp *heat.Response) {
+			resp.Fields.Set("X-Seen", "yes")
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET http://"+addr+"/blocked HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	if resp := readFinal(t, conn, r); resp.StatusCode != 403 {
+		t.Errorf("OnRequest's response wasn't used: got status %d", resp.StatusCode)
+	}
+
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	resp := readFinal(t, conn, r)
+	if resp.StatusCode != 200 || resp.Header.Get("X-Seen") != "yes" {
+		t.Errorf("got %d with X-Seen %q, want 200 with X-Seen yes", resp.StatusCode, resp.Header.Get("X-Seen"))
+	}
+}
@@ -0,0 +1,223 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// A NetworkProfile describes network conditions for a ShapingRule to
+// emulate.
+type NetworkProfile struct {
+	Name string
+
+	// Bandwidth from the upstream server to the client, and from the client
+	// to the upstream server, in bytes per second. Zero means no limit.
+	Download int64
+	Upload   int64
+
+	// Round-trip time added to every request, and to the setup of every
+	// tunnel, varied by up to Jitter in either direction.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Fraction of packets lost, from 0 to 1. As the proxy doesn't see
+	// packets, loss is approximated by delaying that fraction of requests
+	// by a retransmission timeout of three round trips, or at least 200 ms.
+	Loss float64
+}
+
+// Common network conditions, roughly matching those emulated by browsers'
+// developer tools, for use in ShapingRules.
+var (
+	Profile2G = NetworkProfile{
+		Name:     "2g",
+		Download: 250000 / 8,
+		Upload:   50000 / 8,
+		Latency:  300 * time.Millisecond,
+		Jitter:   50 * time.Millisecond,
+		Loss:     0.02,
+	}
+
+	ProfileSlow3G = NetworkProfile{
+		Name:     "slow-3g",
+		Download: 400000 / 8,
+		Upload:   400000 / 8,
+		Latency:  400 * time.Millisecond,
+		Jitter:   50 * time.Millisecond,
+		Loss:     0.02,
+	}
+
+	Profile3G = NetworkProfile{
+		Name:     "3g",
+		Download: 750000 / 8,
+		Upload:   250000 / 8,
+		Latency:  100 * time.Millisecond,
+		Jitter:   20 * time.Millisecond,
+		Loss:     0.01,
+	}
+
+	Profile4G = NetworkProfile{
+		Name:     "4g",
+		Download: 4000000 / 8,
+		Upload:   3000000 / 8,
+		Latency:  20 * time.Millisecond,
+		Jitter:   5 * time.Millisecond,
+		Loss:     0.005,
+	}
+
+	ProfileDSL = NetworkProfile{
+		Name:     "dsl",
+		Download: 2000000 / 8,
+		Upload:   1000000 / 8,
+		Latency:  5 * time.Millisecond,
+		Jitter:   2 * time.Millisecond,
+	}
+
+	ProfileWiFi = NetworkProfile{
+		Name:     "wifi",
+		Download: 30000000 / 8,
+		Upload:   15000000 / 8,
+		Latency:  2 * time.Millisecond,
+		Jitter:   1 * time.Millisecond,
+	}
+)
+
+var networkProfiles = []*NetworkProfile{
+	&Profile2G,
+	&ProfileSlow3G,
+	&Profile3G,
+	&Profile4G,
+	&ProfileDSL,
+	&ProfileWiFi,
+}
+
+// LookupNetworkProfile returns the predefined profile with a given name,
+// such as "3g" or "dsl", ignoring case.
+func LookupNetworkProfile(name string) (NetworkProfile, bool) {
+	for _, np := range networkProfiles {
+		if strings.EqualFold(np.Name, name) {
+			return *np, true
+		}
+	}
+	return NetworkProfile{}, false
+}
+
+// A ShapingRule makes requests and tunnels experience the conditions of a
+// network profile, such as for testing how web applications behave on
+// mobile networks.
+//
+// Jitter and loss are drawn from a random number generator seeded with Seed,
+// such that the same sequence of requests experiences the same conditions
+// on every run.
+type ShapingRule struct {
+	// Requests and tunnels the rule applies to. Only host and client
+	// conditions are considered for tunnels (see Match.Connect). If nil,
+	// everything matches.
+	Match *Match
+
+	Profile NetworkProfile
+	Seed    int64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// shaping returns the first of p.Shaping matching a request (or, if req is
+// nil, a tunnel to addr), and its index.
+func (p *Proxy) shaping(s *Session, req *heat.Request, addr string) (*ShapingRule, int) {
+	for i := range p.Shaping {
+		r := &p.Shaping[i]
+		if (req != nil && r.Match.Request(s, req)) || (req == nil && r.Match.Connect(s, addr)) {
+			return r, i
+		}
+	}
+	return nil, -1
+}
+
+// shape applies the first of p.Shaping matching a request or tunnel,
+// returning the rule (or nil). The delay the rule adds is waited out.
+func (p *Proxy) shape(ctx context.Context, s *Session, req *heat.Request, addr string) (*ShapingRule, error) {
+	r, i := p.shaping(s, req, addr)
+	if r == nil {
+		return nil, nil
+	}
+
+	p.decide(s, req, addr, &DecisionRecord{
+		Action:  "throttle",
+		Rule:    "Shaping[" + strconv.Itoa(i) + "]",
+		Pattern: r.Match.String(),
+		Reason:  "emulating " + r.Profile.Name,
+	})
+
+	if d := r.delay(); d > 0 {
+		if err := p.wait(ctx, d); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// delay returns the time to wait before forwarding the next request.
+func (r *ShapingRule) delay() time.Duration {
+	np := &r.Profile
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.rng == nil {
+		r.rng = rand.New(rand.NewSource(r.Seed))
+	}
+
+	d := np.Latency
+	if np.Jitter > 0 {
+		d += time.Duration(r.rng.Int63n(int64(2*np.Jitter)+1)) - np.Jitter
+	}
+
+	if np.Loss > 0 && r.rng.Float64() < np.Loss {
+		d += max(3*np.Latency, 200*time.Millisecond)
+	}
+
+	return max(d, 0)
+}
+
+// shapeRequest limits the rate at which a request's body is sent.
+func (r *ShapingRule) shapeRequest(p *Proxy, req *heat.Request) {
+	if r.Profile.Upload > 0 && req.Body != nil {
+		req.Body = &throttledBody{req.Body, newThrottle(p, r.Profile.Upload)}
+	}
+}
+
+// shapeResponse limits the rate at which a response's body is received. The
+// bodies of "101 Switching Protocols" responses are shaped in both
+// directions.
+func (r *ShapingRule) shapeResponse(p *Proxy, resp *heat.Response) {
+	if resp.Body == nil {
+		return
+	}
+
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.Status == 101 {
+		resp.Body = r.shapeConn(p, conn)
+		return
+	}
+
+	if r.Profile.Download > 0 {
+		resp.Body = &throttledBody{resp.Body, newThrottle(p, r.Profile.Download)}
+	}
+}
+
+// shapeConn limits the rate at which data passes through the upstream end
+// of a tunnel in either direction.
+func (r *ShapingRule) shapeConn(p *Proxy, upstream io.ReadWriteCloser) io.ReadWriteCloser {
+	if r.Profile.Download <= 0 && r.Profile.Upload <= 0 {
+		return upstream
+	}
+	return &throttledConn{upstream, newThrottle(p, r.Profile.Download), newThrottle(p, r.Profile.Upload)}
+}
@@ -0,0 +1,122 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestShaping(t *testing.T) {
+	slow, err := relay.ParseMatch("host=slow.test,127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every request is "lost", adding a 200 ms retransmission delay on top
+	// of the latency.
+	profile := relay.NetworkProfile{Name: "lossy", Latency: 50 * time.Millisecond, Loss: 1, Download: 2000, Upload: 1000}
+
+	forwarded := make(chan time.Time, 2)
+	decisions := make(chan *relay.DecisionRecord, 4)
+
+	p := &relay.Proxy{
+		Shaping:       []relay.ShapingRule{{Match: slow, Profile: profile}},
+		Intercept:     func(s *relay.Session, addr string) bool { return false },
+		AuditDecision: func(r *relay.DecisionRecord) { decisions <- r },
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			forwarded <- time.Now()
+			io.ReadAll(req.Body)
+			forwarded <- time.Now()
+
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "200")
+			resp.Body = io.NopCloser(bytes.NewReader(make([]byte, 200)))
+			return resp, nil
+		},
+	}
+
+	for _, host := range []string{"slow.test", "fast.test"} {
+		conn := serve(t, p)
+		r := bufio.NewReader(conn)
+
+		start := time.Now()
+		io.WriteString(conn, "POST http://"+host+"/ HTTP/1.1\r\nHost: "+host+"\r\nContent-Length: 100\r\n\r\n"+strings.Repeat("x", 100))
+		resp := readFinal(t, conn, r)
+		io.ReadAll(resp.Body)
+		end := time.Now()
+
+		sent, received := <-forwarded, <-forwarded
+		if host == "fast.test" {
+			continue
+		}
+
+		// The request is delayed by 250 ms, its body takes 100 ms to send,
+		// and the response's body another 100 ms to receive.
+		if d := sent.Sub(start); d < 250*time.Millisecond {
+			t.Errorf("request forwarded after %v", d)
+		}
+		if d := received.Sub(sent); d < 90*time.Millisecond {
+			t.Errorf("request body sent in %v", d)
+		}
+		if d := end.Sub(start); d < 450*time.Millisecond {
+			t.Errorf("exchange took %v", d)
+		}
+	}
+
+	// Only the matching request was shaped.
+	if d := <-decisions; d.Rule != "Shaping[0]" || d.Action != "throttle" || d.Reason != "emulating lossy" || !strings.Contains(d.Destination, "slow.test") {
+		t.Errorf("got decision %+v", d)
+	}
+	select {
+	case d := <-decisions:
+		t.Errorf("got decision %+v", d)
+	default:
+	}
+
+	// Tunnels are shaped too.
+	addr := rawUpstream(t, func(conn *net.TCPConn) {
+		conn.Write(make([]byte, 200))
+	})
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	start := time.Now()
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	if resp := readFinal(t, conn, r); resp.StatusCode != 200 {
+		t.Fatalf("CONNECT: got status %d", resp.StatusCode)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("tunnel opened after %v", d)
+	}
+
+	start = time.Now()
+	if n, _ := io.ReadFull(r, make([]byte, 200)); n != 200 {
+		t.Errorf("got %d bytes through the tunnel", n)
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("tunneled data received in %v", d)
+	}
+
+	if d := <-decisions; d.Method != "CONNECT" || d.Rule != "Shaping[0]" {
+		t.Errorf("got decision %+v", d)
+	}
+}
+
+func TestLookupNetworkProfile(t *testing.T) {
+	np, ok := relay.LookupNetworkProfile("Slow-3G")
+	if !ok || np != relay.ProfileSlow3G {
+		t.Errorf("got %+v, %v", np, ok)
+	}
+	if _, ok := relay.LookupNetworkProfile("5g"); ok {
+		t.Errorf("found an unknown profile")
+	}
+}
@@ -0,0 +1,16 @@
+package relay
+
+// Number of shards the state kept per host (cached DNS records, tunnel
+// decisions and idle connections) is split into, each with its own lock, so
+// that concurrent requests for different hosts rarely contend.
+const shardCount = 32
+
+// shardOf returns the index of the shard holding key, using 32-bit FNV-1a.
+func shardOf(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h % shardCount
+}
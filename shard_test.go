@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The benchmarks below exercise state split into shards from many
+// goroutines at once. Each runs against a single host, which always maps to
+// the same shard and so contends for one lock, as all hosts did before the
+// state was sharded, and against many hosts spread over every shard. Run
+// them with -cpu to see how each scales with the number of cores, e.g.:
+//
+//	go test -run XXX -bench Sharded -cpu 1,4,16
+var benchHostCounts = []int{1, 1024}
+
+func benchHosts(n int) []string {
+	hosts := make([]string, n)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("host%d.example.com", i)
+	}
+	return hosts
+}
+
+// benchParallel runs fn from b.RunParallel, passing it one host after
+// another. Goroutines start at different hosts, so that they don't move
+// between shards in lockstep.
+func benchParallel(b *testing.B, hosts []string, fn func(host string)) {
+	var offset uint32
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint32(&offset, 7919))
+		for pb.Next() {
+			fn(hosts[i%len(hosts)])
+			i++
+		}
+	})
+}
+
+func BenchmarkShardedDNSCache(b *testing.B) {
+	for _, n := range benchHostCounts {
+		b.Run(fmt.Sprintf("hosts=%d", n), func(b *testing.B) {
+			c := &DNSCache{
+				Lookup: func(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+					return []net.IP{net.IPv4(192, 0, 2, 1)}, time.Hour, nil
+				},
+			}
+
+			hosts := benchHosts(n)
+			for _, host := range hosts {
+				c.Resolve(context.Background(), host)
+			}
+
+			benchParallel(b, hosts, func(host string) {
+				if _, err := c.Resolve(context.Background(), host); err != nil {
+					b.Fatal(err)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkShardedDecisionCache(b *testing.B) {
+	for _, n := range benchHostCounts {
+		b.Run(fmt.Sprintf("hosts=%d", n), func(b *testing.B) {
+			c := &DecisionCache{MaxEntries: 1 << 20}
+			now := time.Now()
+
+			keys := benchHosts(n)
+			for i, host := range keys {
+				keys[i] = "192.0.2.1  " + host + ":443"
+				c.put(keys[i], &tunnelDecision{created: now})
+			}
+
+			benchParallel(b, keys, func(key string) {
+				if c.get(key, now) == nil {
+					b.Fatal("decision not cached")
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkShardedIdlePool(b *testing.B) {
+	for _, n := range benchHostCounts {
+		b.Run(fmt.Sprintf("hosts=%d", n), func(b *testing.B) {
+			t := &Transport{MaxIdlePerHost: 1 << 20}
+
+			// Take an idle connection and put it back, as a request reusing
+			// it would, creating one when none is idle.
+			benchParallel(b, benchHosts(n), func(host string) {
+				key := "http " + host + ":80"
+				pc := t.getIdle(key)
+				if pc == nil {
+					pc = &persistConn{t: t, key: key, conn: nopConn{}}
+				}
+				t.putIdle(pc)
+			})
+		})
+	}
+}
+
+// The nopConn type stands in for the connections kept in an idle pool.
+type nopConn struct {
+	net.Conn
+}
+
+func (nopConn) Close() error { return nil }
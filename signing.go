@@ -0,0 +1,370 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/erkl/heat"
+)
+
+// A Signer signs requests before they're forwarded, typically by adding
+// header fields. Signers may read a request's body using
+// Session.SpoolRequest.
+type Signer interface {
+	Sign(s *Session, req *heat.Request) error
+}
+
+// A SigningRule has requests signed with credentials held by the proxy, so
+// that clients (and applications behind them) never need to hold them.
+type SigningRule struct {
+	// Requests the rule applies to. If nil, everything matches.
+	Match *Match
+
+	Signer Signer
+}
+
+// sign signs a request with the first of p.Signing matching it.
+func (p *Proxy) sign(s *Session, req *heat.Request) error {
+	for i := range p.Signing {
+		r := &p.Signing[i]
+		if !r.Match.Request(s, req) {
+			continue
+		}
+
+		if err := r.Signer.Sign(s, req); err != nil {
+			return fmt.Errorf("relay: signing request: %w", err)
+		}
+
+		p.count("signing.signed", 1)
+		p.decide(s, req, "", &DecisionRecord{
+			Action:  "rewrite",
+			Rule:    "Signing[" + strconv.Itoa(i) + "]",
+			Pattern: r.Match.String(),
+			Reason:  "signed",
+		})
+		return nil
+	}
+
+	return nil
+}
+
+// signingTime returns the current time according to the session's proxy.
+func signingTime(s *Session) time.Time {
+	if s != nil && s.proxy != nil {
+		return s.proxy.clock().Now()
+	}
+	return time.Now()
+}
+
+// bodyHash returns the SHA-256 digest of a request's body, spooling it so
+// that it can still be sent.
+func bodyHash(s *Session, req *heat.Request) ([]byte, error) {
+	h := sha256.New()
+
+	if req.Body != nil {
+		sp, err := s.SpoolRequest(req)
+		if err != nil {
+			return nil, err
+		}
+
+		body := sp.Open()
+		_, err = io.Copy(h, body)
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h.Sum(nil), nil
+}
+
+// requestHost returns the value of a request's Host field, setting it to
+// req.Remote if it's missing.
+func requestHost(req *heat.Request) string {
+	host, ok := fieldValue(req.Fields, "Host")
+	if !ok {
+		host = req.Remote
+		req.Fields.Set("Host", host)
+	}
+	return host
+}
+
+// A SigV4Signer signs requests to AWS (and compatible) services using
+// Signature Version 4. The credentials may reference secrets provided by
+// Proxy.Secrets, as "${secret:NAME}".
+type SigV4Signer struct {
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Temporary credentials' session token, if any.
+	SessionToken string
+
+	// The region and service requests are signed for, such as "us-east-1"
+	// and "s3".
+	Region  string
+	Service string
+
+	// If set, bodies aren't hashed (and so never spooled), and
+	// "UNSIGNED-PAYLOAD" is signed in their place. Only some services, such
+	// as S3, accept this.
+	UnsignedPayload bool
+}
+
+// Sign adds X-Amz-Date, X-Amz-Content-Sha256 and Authorization fields (and
+// X-Amz-Security-Token, if there's a session token) to a request, replacing
+// any it already has.
+func (sv *SigV4Signer) Sign(s *Session, req *heat.Request) error {
+	var creds [3]string
+	for i, v := range []string{sv.AccessKeyID, sv.SecretAccessKey, sv.SessionToken} {
+		var err error
+		if creds[i], err = s.expandSecrets(v); err != nil {
+			return err
+		}
+	}
+	keyID, secret, token := creds[0], creds[1], creds[2]
+
+	now := signingTime(s).UTC()
+	stamp := now.Format("20060102T150405Z")
+	date := stamp[:8]
+
+	payload := "UNSIGNED-PAYLOAD"
+	if !sv.UnsignedPayload {
+		sum, err := bodyHash(s, req)
+		if err != nil {
+			return err
+		}
+		payload = hex.EncodeToString(sum)
+	}
+
+	req.Fields.Set("X-Amz-Date", stamp)
+	req.Fields.Set("X-Amz-Content-Sha256", payload)
+	if token != "" {
+		req.Fields.Set("X-Amz-Security-Token", token)
+	}
+
+	// Sign the host, every X-Amz-* field, and the content type.
+	signed := map[string]string{"host": requestHost(req)}
+	for _, f := range req.Fields {
+		name := strings.ToLower(f.Name)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			value := strings.Join(strings.Fields(f.Value), " ")
+			if prev, ok := signed[name]; ok {
+				value = prev + "," + value
+			}
+			signed[name] = value
+		}
+	}
+
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path, query, _ := strings.Cut(req.URI, "?")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		sv.canonicalPath(path),
+		canonicalQuery(query),
+		headers.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	scope := date + "/" + sv.Region + "/" + sv.Service + "/aws4_request"
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, sv.Region)
+	key = hmacSHA256(key, sv.Service)
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Fields.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+keyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+
+	return nil
+}
+
+// canonicalPath encodes a request path as SigV4 requires: each segment
+// URI-encoded, and (for services other than S3) encoded twice.
+func (sv *SigV4Signer) canonicalPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		if plain, err := url.PathUnescape(seg); err == nil {
+			seg = plain
+		}
+		seg = awsEscape(seg)
+		if sv.Service != "s3" {
+			seg = awsEscape(seg)
+		}
+		segs[i] = seg
+	}
+
+	return strings.Join(segs, "/")
+}
+
+// canonicalQuery encodes a query string as SigV4 requires: parameters
+// URI-encoded and sorted.
+func canonicalQuery(query string) string {
+	if query == "" {
+		return ""
+	}
+
+	var pairs []string
+	for _, pair := range strings.Split(query, "&") {
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		if n, err := url.QueryUnescape(name); err == nil {
+			name = n
+		}
+		if v, err := url.QueryUnescape(value); err == nil {
+			value = v
+		}
+		pairs = append(pairs, awsEscape(name)+"="+awsEscape(value))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but unreserved characters.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// An HMACSigner signs requests with a shared secret key, using the
+// hmac-sha256 algorithm of the "Signing HTTP Messages" draft
+// (draft-cavage-http-signatures).
+type HMACSigner struct {
+	KeyID string
+	Key   []byte
+
+	// Name of the secret provided by Proxy.Secrets holding the key, used
+	// when Key is empty.
+	KeySecret string
+
+	// Names of the header fields covered by the signature, in lower case,
+	// along with "(request-target)" for the method and URI. Missing Date
+	// and Host fields are added. Defaults to "(request-target)", "host" and
+	// "date".
+	Headers []string
+
+	// If set, a Digest field holding the SHA-256 digest of the body is added
+	// and covered by the signature, such that the body can't be altered.
+	Digest bool
+
+	// If set, the signature is sent in an Authorization field using the
+	// Signature scheme, rather than in a Signature field.
+	Authorization bool
+}
+
+// Sign adds a signature to a request, along with any fields it covers which
+// the signer adds.
+func (hs *HMACSigner) Sign(s *Session, req *heat.Request) error {
+	key := hs.Key
+	if len(key) == 0 {
+		secret, err := s.Secret(hs.KeySecret)
+		if err != nil {
+			return err
+		}
+		key = []byte(secret)
+	}
+
+	headers := hs.Headers
+	if len(headers) == 0 {
+		headers = []string{"(request-target)", "host", "date"}
+	}
+
+	if hs.Digest {
+		sum, err := bodyHash(s, req)
+		if err != nil {
+			return err
+		}
+		req.Fields.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum))
+		if !contains(headers, "digest") {
+			headers = append(headers[:len(headers):len(headers)], "digest")
+		}
+	}
+
+	lines := make([]string, len(headers))
+	for i, name := range headers {
+		var value string
+
+		switch name {
+		case "(request-target)":
+			value = strings.ToLower(req.Method) + " " + req.URI
+		case "host":
+			value = requestHost(req)
+		case "date":
+			v, ok := fieldValue(req.Fields, "Date")
+			if !ok {
+				v = signingTime(s).UTC().Format(http.TimeFormat)
+				req.Fields.Set("Date", v)
+			}
+			value = v
+		default:
+			var values []string
+			for _, f := range req.Fields {
+				if f.Is(name) {
+					values = append(values, strings.TrimSpace(f.Value))
+				}
+			}
+			if len(values) == 0 {
+				return fmt.Errorf("missing %s field", name)
+			}
+			value = strings.Join(values, ", ")
+		}
+
+		lines[i] = name + ": " + value
+	}
+
+	sig := hmacSHA256(key, strings.Join(lines, "\n"))
+	value := fmt.Sprintf(`keyId=%q,algorithm="hmac-sha256",headers=%q,signature=%q`,
+		hs.KeyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig))
+
+	if hs.Authorization {
+		req.Fields.Set("Authorization", "Signature "+value)
+	} else {
+		req.Fields.Set("Signature", value)
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package relay
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// SocketOptions holds settings applied to TCP connections.
+type SocketOptions struct {
+	// Time a connection must be idle before TCP keep-alive probes are sent,
+	// the interval between probes, and the number of unanswered probes after
+	// which the connection is considered dead. Zero values leave the system
+	// defaults in place. A negative KeepAliveIdle disables keep-alive probes.
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+
+	// If true, Nagle's algorithm is enabled (i.e. TCP_NODELAY is cleared,
+	// which it otherwise is by default).
+	Delay bool
+
+	// Sizes of the operating system's receive and send buffers. Zero values
+	// leave the system defaults in place.
+	ReadBuffer  int
+	WriteBuffer int
+
+	// Optional function for setting raw socket options, such as SO_MARK or
+	// SO_BINDTODEVICE. For upstream connections dialed by the proxy itself
+	// it's called before connecting.
+	Control func(network, address string, c syscall.RawConn) error
+}
+
+// apply applies the socket options to a connection. Connections which aren't
+// TCP connections are left untouched. If control is false, o.Control is not
+// called.
+func (o *SocketOptions) apply(conn net.Conn, control bool) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case o.KeepAliveIdle < 0:
+		if err := tc.SetKeepAlive(false); err != nil {
+			return err
+		}
+	case o.KeepAliveIdle > 0 || o.KeepAliveInterval > 0 || o.KeepAliveCount > 0:
+		err := tc.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     o.KeepAliveIdle,
+			Interval: o.KeepAliveInterval,
+			Count:    o.KeepAliveCount,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.Delay {
+		if err := tc.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+
+	if o.ReadBuffer > 0 {
+		if err := tc.SetReadBuffer(o.ReadBuffer); err != nil {
+			return err
+		}
+	}
+
+	if o.WriteBuffer > 0 {
+		if err := tc.SetWriteBuffer(o.WriteBuffer); err != nil {
+			return err
+		}
+	}
+
+	if control && o.Control != nil {
+		raw, err := tc.SyscallConn()
+		if err != nil {
+			return err
+		}
+		if err := o.Control("tcp", tc.RemoteAddr().String(), raw); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+// The sockopts type holds socket options read back from a connection.
+type sockopts struct {
+	keepAlive, keepIdle, noDelay, readBuffer int
+}
+
+func readSockopts(raw syscall.RawConn) (o sockopts, err error) {
+	get := func(fd, level, opt int, dst *int) {
+		if err == nil {
+			*dst, err = syscall.GetsockoptInt(fd, level, opt)
+		}
+	}
+
+	cerr := raw.Control(func(fd uintptr) {
+		get(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, &o.keepAlive)
+		get(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, &o.keepIdle)
+		get(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY, &o.noDelay)
+		get(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, &o.readBuffer)
+	})
+	if cerr != nil {
+		return o, cerr
+	}
+
+	return o, err
+}
+
+func checkSockopts(t *testing.T, o sockopts) {
+	t.Helper()
+
+	if o.keepAlive == 0 || o.keepIdle != 42 {
+		t.Errorf("keep-alive %d with idle time %d, want enabled with 42", o.keepAlive, o.keepIdle)
+	}
+	if o.noDelay != 0 {
+		t.Errorf("TCP_NODELAY set despite Delay")
+	}
+	if o.readBuffer < 64<<10 {
+		t.Errorf("SO_RCVBUF is %d, want at least %d", o.readBuffer, 64<<10)
+	}
+}
+
+var testSocketOptions = relay.SocketOptions{
+	KeepAliveIdle: 42 * time.Second,
+	Delay:         true,
+	ReadBuffer:    64 << 10,
+}
+
+func TestClientSocketOptions(t *testing.T) {
+	seen := make(chan sockopts, 1)
+
+	// The Control function runs after the other options have been applied.
+	opts := testSocketOptions
+	opts.Control = func(network, address string, c syscall.RawConn) error {
+		o, err := readSockopts(c)
+		if err != nil {
+			t.Error(err)
+		}
+		seen <- o
+		return nil
+	}
+
+	serveTCP(t, &relay.Proxy{ClientSocket: opts})
+
+	select {
+	case o := <-seen:
+		checkSockopts(t, o)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Control wasn't called")
+	}
+}
+
+func TestUpstreamSocketOptions(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	dialed := make(chan *net.TCPConn, 1)
+	controlled := make(chan string, 1)
+
+	opts := testSocketOptions
+	opts.Control = func(network, address string, c syscall.RawConn) error {
+		controlled <- address
+		return nil
+	}
+
+	p := &relay.Proxy{
+		Transport: &relay.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				conn, err := net.Dial(network, addr)
+				if err == nil {
+					dialed <- conn.(*net.TCPConn)
+				}
+				return conn, err
+			},
+			Socket: opts,
+		},
+	}
+
+	conn := serve(t, p)
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 200 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	if got := <-controlled; got != addr {
+		t.Errorf("Control called for %q, want %q", got, addr)
+	}
+
+	raw, err := (<-dialed).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := readSockopts(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSockopts(t, o)
+}
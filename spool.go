@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/erkl/heat"
+)
+
+// The default number of bytes a Spool will keep in memory.
+const defaultSpoolMemory = 1 << 20
+
+// A Spool holds a replayable copy of a message body. Small bodies are kept
+// in memory, while larger ones are written to a temporary file.
+type Spool struct {
+	buf spillBuffer
+}
+
+// newSpool reads r until EOF, keeping at most mem bytes in memory (or as
+// many as budget allows) before spilling to a temporary file in dir.
+func newSpool(r io.Reader, mem int64, dir string, budget *MemoryBudget) (*Spool, error) {
+	sp := &Spool{buf: spillBuffer{limit: mem, dir: dir, prefix: "relay-spool-", budget: budget}}
+
+	if _, err := io.Copy(&sp.buf, r); err != nil {
+		sp.Close()
+		return nil, err
+	}
+
+	return sp, nil
+}
+
+// Size returns the length of the spooled body.
+func (sp *Spool) Size() int64 {
+	return sp.buf.size
+}
+
+// Open returns a new reader positioned at the beginning of the body.
+func (sp *Spool) Open() io.ReadCloser {
+	return ioutil.NopCloser(io.NewSectionReader(&sp.buf, 0, sp.buf.size))
+}
+
+// Close releases the resources held by the spool. Readers returned by
+// Open must not be used afterwards.
+func (sp *Spool) Close() error {
+	return sp.buf.Close()
+}
+
+// SpoolRequest reads the request's body into a Spool, and replaces it with
+// a reader of the copy. The spool is closed automatically once the response
+// has been sent to the client. Returns nil if the request has no body.
+func (s *Session) SpoolRequest(req *heat.Request) (*Spool, error) {
+	sp, err := s.spool(req.Body)
+	if sp != nil {
+		req.Body = sp.Open()
+	}
+	return sp, err
+}
+
+// SpoolResponse is like SpoolRequest, but for responses.
+func (s *Session) SpoolResponse(resp *heat.Response) (*Spool, error) {
+	sp, err := s.spool(resp.Body)
+	if sp != nil {
+		resp.Body = sp.Open()
+	}
+	return sp, err
+}
+
+func (s *Session) spool(body io.ReadCloser) (*Spool, error) {
+	if body == nil {
+		return nil, nil
+	}
+
+	defer body.Close()
+
+	mem, dir := int64(defaultSpoolMemory), ""
+	var budget *MemoryBudget
+	if s.proxy != nil {
+		if s.proxy.SpoolMemory > 0 {
+			mem = s.proxy.SpoolMemory
+		}
+		dir, budget = s.proxy.SpoolDir, s.proxy.Memory
+	}
+
+	sp, err := newSpool(body, mem, dir, budget)
+	if err != nil {
+		return nil, err
+	}
+
+	s.spools = append(s.spools, sp)
+	return sp, nil
+}
+
+// release cleans up after the request currently being served in the session,
+// canceling its context and closing all of its spools.
+func (s *Session) release() {
+	s.end()
+
+	for _, sp := range s.spools {
+		sp.Close()
+	}
+	s.spools = nil
+}
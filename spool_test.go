@@ -0,0 +1,94 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestSpoolToDisk(t *testing.T) {
+	body := strings.Repeat("0123456789", 10)
+
+	received := make(chan string, 1)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		buf, _ := io.ReadAll(req.Body)
+		received <- string(buf)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello")
+	})
+
+	dir := t.TempDir()
+	spooled := make(chan int, 2)
+
+	inspect := func(sp *relay.Spool, err error, want string) {
+		if err != nil {
+			t.Errorf("spooling: %v", err)
+			return
+		}
+		buf, _ := io.ReadAll(sp.Open())
+		if string(buf) != want || sp.Size() != int64(len(want)) {
+			t.Errorf("spool holds %q (size %d), want %q", buf, sp.Size(), want)
+		}
+		files, _ := os.ReadDir(dir)
+		spooled <- len(files)
+	}
+
+	p := &relay.Proxy{
+		RoundTrip:   roundTrip,
+		SpoolMemory: 16,
+		SpoolDir:    dir,
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			sp, err := s.SpoolRequest(req)
+			inspect(sp, err, body)
+			return nil
+		},
+		OnResponse: func(s *relay.Session, req *heat.Request, resp *heat.Response) {
+			sp, err := s.SpoolResponse(resp)
+			inspect(sp, err, "hello")
+		},
+	}
+
+	conn := serve(t, p)
+	io.WriteString(conn, "POST http://"+addr+"/ HTTP/1.1\r\n"+
+		"Host: "+addr+"\r\n"+
+		"Content-Length: 100\r\n\r\n"+body)
+
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+	got, _ := io.ReadAll(resp.Body)
+
+	if string(got) != "hello" {
+		t.Errorf("client got %q, want %q", got, "hello")
+	}
+	if got := <-received; got != body {
+		t.Errorf("upstream got %q, want the whole body", got)
+	}
+
+	// The request body was too large to keep in memory; the response body
+	// was not.
+	if n := <-spooled; n != 1 {
+		t.Errorf("%d files spooled for the request, want 1", n)
+	}
+	if n := <-spooled; n != 1 {
+		t.Errorf("%d files spooled along with the response, want 1", n)
+	}
+
+	// Spools are removed once the response has been sent.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, _ := os.ReadDir(dir)
+		if len(files) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d spool files left behind", len(files))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
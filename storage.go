@@ -0,0 +1,312 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Storage implementations for keys which have no
+// value, or whose value has expired.
+var ErrNotFound = errors.New("relay: not found")
+
+// A Storage persists the state of the proxy's stateful components, such as
+// HSTSStore, QuotaStore and FlowStore, so that it survives restarts and can
+// be shared between them. Keys are slash-separated paths, such as
+// "hsts/example.com". Implementations must be safe for concurrent use.
+type Storage interface {
+	// Get returns the value stored under key.
+	Get(key string) ([]byte, error)
+
+	// Put stores a value under key, replacing any previous one. If ttl is
+	// positive, the value expires after that long.
+	Put(key string, value []byte, ttl time.Duration) error
+
+	// Delete removes the value stored under key, if any.
+	Delete(key string) error
+
+	// Keys lists the keys beginning with prefix which have unexpired
+	// values, in lexical order.
+	Keys(prefix string) ([]string, error)
+
+	// Create returns a writer storing a large value under key once it's
+	// closed, for values which are better streamed than held in memory.
+	Create(key string, ttl time.Duration) (io.WriteCloser, error)
+
+	// Open returns a reader for the value stored under key.
+	Open(key string) (io.ReadCloser, error)
+}
+
+// MemoryStorage is a Storage keeping values in memory, for tests and for
+// sharing state between components without persisting it.
+type MemoryStorage struct {
+	mu     sync.Mutex
+	values map[string]memoryValue
+	puts   int
+}
+
+type memoryValue struct {
+	data    []byte
+	expires time.Time
+}
+
+// Get implements Storage.
+func (ms *MemoryStorage) Get(key string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	v, ok := ms.values[key]
+	if !ok || expired(v.expires, time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	return append([]byte(nil), v.data...), nil
+}
+
+// Put implements Storage.
+func (ms *MemoryStorage) Put(key string, value []byte, ttl time.Duration) error {
+	v := memoryValue{data: append([]byte(nil), value...)}
+	if ttl > 0 {
+		v.expires = time.Now().Add(ttl)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.values == nil {
+		ms.values = make(map[string]memoryValue)
+	}
+
+	// Every so often, take the chance to forget expired values.
+	if ms.puts++; ms.puts%1024 == 0 {
+		now := time.Now()
+		for k, old := range ms.values {
+			if expired(old.expires, now) {
+				delete(ms.values, k)
+			}
+		}
+	}
+
+	ms.values[key] = v
+	return nil
+}
+
+// Delete implements Storage.
+func (ms *MemoryStorage) Delete(key string) error {
+	ms.mu.Lock()
+	delete(ms.values, key)
+	ms.mu.Unlock()
+	return nil
+}
+
+// Keys implements Storage.
+func (ms *MemoryStorage) Keys(prefix string) ([]string, error) {
+	now := time.Now()
+
+	ms.mu.Lock()
+	var keys []string
+	for k, v := range ms.values {
+		if strings.HasPrefix(k, prefix) && !expired(v.expires, now) {
+			keys = append(keys, k)
+		}
+	}
+	ms.mu.Unlock()
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Create implements Storage.
+func (ms *MemoryStorage) Create(key string, ttl time.Duration) (io.WriteCloser, error) {
+	return &memoryWriter{ms: ms, key: key, ttl: ttl}, nil
+}
+
+// Open implements Storage.
+func (ms *MemoryStorage) Open(key string) (io.ReadCloser, error) {
+	data, err := ms.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// The memoryWriter type buffers a value written through
+// MemoryStorage.Create.
+type memoryWriter struct {
+	bytes.Buffer
+	ms  *MemoryStorage
+	key string
+	ttl time.Duration
+}
+
+func (w *memoryWriter) Close() error {
+	return w.ms.Put(w.key, w.Bytes(), w.ttl)
+}
+
+// DirStorage is a Storage keeping each value in a file of its own, in the
+// directory Dir (which must exist). Values are written to temporary files
+// first, so that readers never see partial values.
+type DirStorage struct {
+	Dir string
+}
+
+// File names are escaped keys. Files begin with the value's expiry time in
+// nanoseconds since the Unix epoch, or zero if it never expires.
+const storageHeaderSize = 8
+
+func (ds *DirStorage) path(key string) string {
+	return filepath.Join(ds.Dir, url.PathEscape(key))
+}
+
+// Get implements Storage.
+func (ds *DirStorage) Get(key string) ([]byte, error) {
+	r, err := ds.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// Put implements Storage.
+func (ds *DirStorage) Put(key string, value []byte, ttl time.Duration) error {
+	w, err := ds.Create(key, ttl)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(value); err != nil {
+		w.(*dirWriter).abort()
+		return err
+	}
+
+	return w.Close()
+}
+
+// Delete implements Storage.
+func (ds *DirStorage) Delete(key string) error {
+	if err := os.Remove(ds.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Keys implements Storage.
+func (ds *DirStorage) Keys(prefix string) ([]string, error) {
+	entries, err := ioutil.ReadDir(ds.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+
+	for _, fi := range entries {
+		key, err := url.PathUnescape(fi.Name())
+		if err != nil || fi.IsDir() || strings.HasPrefix(fi.Name(), ".") || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		// Skip (and clean up) expired values.
+		r, err := ds.Open(key)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		r.Close()
+
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Create implements Storage.
+func (ds *DirStorage) Create(key string, ttl time.Duration) (io.WriteCloser, error) {
+	f, err := ioutil.TempFile(ds.Dir, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr [storageHeaderSize]byte
+	if ttl > 0 {
+		binary.BigEndian.PutUint64(hdr[:], uint64(time.Now().Add(ttl).UnixNano()))
+	}
+
+	if _, err := f.Write(hdr[:]); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return &dirWriter{f: f, path: ds.path(key)}, nil
+}
+
+// Open implements Storage.
+func (ds *DirStorage) Open(key string) (io.ReadCloser, error) {
+	f, err := os.Open(ds.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var hdr [storageHeaderSize]byte
+	if _, err := io.ReadFull(f, hdr[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if ns := int64(binary.BigEndian.Uint64(hdr[:])); ns != 0 && expired(time.Unix(0, ns), time.Now()) {
+		f.Close()
+		os.Remove(ds.path(key))
+		return nil, ErrNotFound
+	}
+
+	return f, nil
+}
+
+// The dirWriter type writes a value to a temporary file, which replaces the
+// value's file once closed.
+type dirWriter struct {
+	f    *os.File
+	path string
+}
+
+func (w *dirWriter) Write(buf []byte) (int, error) {
+	return w.f.Write(buf)
+}
+
+func (w *dirWriter) Close() error {
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		os.Remove(w.f.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *dirWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// expired reports whether a value with the given expiry time (zero meaning
+// never) has expired by now.
+func expired(expires, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
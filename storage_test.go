@@ -0,0 +1,170 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestStorage(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		st   relay.Storage
+	}{
+		{"memory", new(relay.MemoryStorage)},
+		{"dir", &relay.DirStorage{Dir: t.TempDir()}},
+	} {
+		st := tt.st
+
+		if _, err := st.Get("hsts/example.com"); err != relay.ErrNotFound {
+			t.Errorf("%s: got %v for a missing key", tt.name, err)
+		}
+
+		st.Put("hsts/example.com", []byte("a"), 0)
+		st.Put("hsts/example.org", []byte("b"), time.Hour)
+		st.Put("hsts/expired.example", []byte("c"), time.Millisecond)
+		st.Put("quota/0/alice", []byte("d"), 0)
+		st.Put("hsts/example.com", []byte("e"), 0)
+
+		time.Sleep(10 * time.Millisecond)
+
+		if v, err := st.Get("hsts/example.com"); err != nil || string(v) != "e" {
+			t.Errorf("%s: got %q, %v", tt.name, v, err)
+		}
+		if _, err := st.Get("hsts/expired.example"); err != relay.ErrNotFound {
+			t.Errorf("%s: got %v for an expired key", tt.name, err)
+		}
+
+		// Keys are listed in order, without expired ones.
+		keys, err := st.Keys("hsts/")
+		if err != nil || strings.Join(keys, " ") != "hsts/example.com hsts/example.org" {
+			t.Errorf("%s: got keys %q, %v", tt.name, keys, err)
+		}
+
+		st.Delete("hsts/example.org")
+		if err := st.Delete("hsts/missing"); err != nil {
+			t.Errorf("%s: deleting a missing key: %v", tt.name, err)
+		}
+		if keys, _ := st.Keys(""); strings.Join(keys, " ") != "hsts/example.com quota/0/alice" {
+			t.Errorf("%s: got keys %q after deleting", tt.name, keys)
+		}
+
+		// Streamed values only appear once they're complete.
+		w, err := st.Create("flows/1", 0)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		io.WriteString(w, "large ")
+		if _, err := st.Open("flows/1"); err != relay.ErrNotFound {
+			t.Errorf("%s: got %v for a value being written", tt.name, err)
+		}
+		io.WriteString(w, "value")
+		w.Close()
+
+		r, err := st.Open("flows/1")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if v, _ := io.ReadAll(r); string(v) != "large value" {
+			t.Errorf("%s: got %q", tt.name, v)
+		}
+		r.Close()
+	}
+}
+
+func TestDirStorageFiles(t *testing.T) {
+	ds := &relay.DirStorage{Dir: t.TempDir()}
+	ds.Put("hsts/example.com", []byte("a"), time.Millisecond)
+	w, _ := ds.Create("flows/1", 0)
+	defer w.Close()
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Listing keys cleans up expired values, and skips temporary files.
+	if keys, err := ds.Keys(""); err != nil || len(keys) != 0 {
+		t.Errorf("got keys %q, %v", keys, err)
+	}
+	entries, _ := os.ReadDir(ds.Dir)
+	if len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), ".") {
+		t.Errorf("directory holds %v", entries)
+	}
+}
+
+func TestHSTSStorage(t *testing.T) {
+	st := new(relay.MemoryStorage)
+	st.Put("hsts/gone.example", []byte(`{"expires": "2999-01-01T00:00:00Z"}`), 0)
+
+	store := &relay.HSTSStore{Storage: st}
+	err := store.Load(bytes.NewBufferString(`{
+		"example.com": {"expires": "2999-01-01T00:00:00Z", "include_subdomains": true},
+		"gone.example": {"expires": "2000-01-01T00:00:00Z"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another store sharing the storage sees the same policies.
+	restored := &relay.HSTSStore{Storage: st}
+	if !restored.Strict("example.com") || restored.Strict("gone.example") {
+		t.Errorf("policies weren't shared through storage")
+	}
+	if keys, _ := st.Keys("hsts/"); strings.Join(keys, " ") != "hsts/example.com" {
+		t.Errorf("storage holds %q", keys)
+	}
+}
+
+func TestFlowArchive(t *testing.T) {
+	st := new(relay.MemoryStorage)
+	fs := &relay.FlowStore{MaxFlows: 1, MaxBodySize: 100, Storage: st}
+	p := &relay.Proxy{
+		Flows: fs,
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "2")
+			resp.Body = io.NopCloser(strings.NewReader("ok"))
+			return resp, nil
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	var ids []uint64
+	for _, path := range []string{"/first", "/second"} {
+		io.WriteString(conn, "GET http://origin.test"+path+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		io.ReadAll(resp.Body)
+
+		flows := fs.Flows(nil)
+		ids = append(ids, flows[len(flows)-1].ID)
+	}
+
+	// The first flow is evicted from memory, and archived in the background.
+	for i := 0; ; i++ {
+		if keys, _ := st.Keys("flows/"); len(keys) == 1 {
+			break
+		} else if i == 100 {
+			t.Fatalf("storage holds %q", keys)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := len(fs.Flows(nil)); n != 1 {
+		t.Errorf("%d flows retained, want 1", n)
+	}
+	f, ok := fs.Get(ids[0])
+	if !ok {
+		t.Fatal("archived flow not found")
+	}
+	if !strings.HasSuffix(f.Request.URI, "/first") || f.Response.Status != 200 || string(f.ResponseBody) != "ok" {
+		t.Errorf("archived flow has request %q, status %d and body %q", f.Request.URI, f.Response.Status, f.ResponseBody)
+	}
+}
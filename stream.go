@@ -0,0 +1,181 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// Media types of streamed responses split into events for
+// Proxy.OnStreamEvent.
+var (
+	sseTypes    = []string{"text/event-stream"}
+	ndjsonTypes = []string{"application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines"}
+)
+
+// Records larger than this are relayed without being passed to
+// Proxy.OnStreamEvent, along with the rest of their stream.
+const maxStreamEvent = 1 << 20
+
+// A StreamEvent is a single record of a streamed response: an event of a
+// text/event-stream (see the HTML Living Standard, section 9.2), or a line
+// of NDJSON.
+type StreamEvent struct {
+	// Set for server-sent events, rather than NDJSON lines.
+	SSE bool
+
+	// The record, without the newline (or, for events, the blank line)
+	// terminating it. Events consist of lines such as "event: update" and
+	// "data: {...}", separated by newlines.
+	Data []byte
+}
+
+// Field returns the value of an event's field, such as "event" or "id". The
+// values of multiple "data" fields are joined by newlines, as clients do.
+func (e *StreamEvent) Field(name string) (string, bool) {
+	var values []string
+
+	for _, line := range strings.Split(string(e.Data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		n, value, _ := strings.Cut(line, ":")
+		if n == name {
+			values = append(values, strings.TrimPrefix(value, " "))
+		}
+	}
+
+	return strings.Join(values, "\n"), len(values) > 0
+}
+
+// splitEvents arranges for a streamed response's events (or lines) to be
+// passed through p.OnStreamEvent as they're relayed.
+func (p *Proxy) splitEvents(s *Session, req *heat.Request, resp *heat.Response) {
+	if resp.Body == nil || req.Method == "HEAD" || resp.Status < 200 || resp.Status >= 300 || resp.Status == 206 {
+		return
+	}
+
+	sse := matchContentType(sseTypes, resp.Fields)
+	if !sse && !matchContentType(ndjsonTypes, resp.Fields) {
+		return
+	}
+
+	body := resp.Body
+	if coding, ok := fieldValue(resp.Fields, "Content-Encoding"); ok {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "identity" {
+			if body, ok = decoder(coding, body); !ok {
+				return
+			}
+		}
+	}
+
+	resp.Body = &eventBody{
+		body: body,
+		r:    bufio.NewReader(body),
+		sse:  sse,
+		hook: func(e *StreamEvent) bool {
+			return p.OnStreamEvent(s, req, resp, e)
+		},
+	}
+	resp.Fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Content-Encoding") && !f.Is("Content-Length") &&
+			!f.Is("Content-MD5") && !f.Is("Digest")
+	})
+	resp.Fields.Set("Transfer-Encoding", "chunked")
+
+	weakenETag(&resp.Fields)
+}
+
+// The eventBody type splits a streamed body into records as they arrive,
+// passing each through a hook.
+type eventBody struct {
+	body io.ReadCloser
+	r    *bufio.Reader
+	sse  bool
+	hook func(e *StreamEvent) bool
+
+	out []byte // data processed, but not yet returned
+	raw bool   // relaying the rest of the body as it is
+	err error
+}
+
+func (b *eventBody) Read(buf []byte) (int, error) {
+	for len(b.out) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if b.raw {
+			return b.r.Read(buf)
+		}
+		b.next()
+	}
+
+	n := copy(buf, b.out)
+	b.out = b.out[n:]
+
+	return n, nil
+}
+
+func (b *eventBody) Close() error {
+	return b.body.Close()
+}
+
+// next reads the next record, and passes it to the hook.
+func (b *eventBody) next() {
+	var rec []byte
+
+	for {
+		line, err := b.r.ReadSlice('\n')
+		rec = append(rec, line...)
+
+		if len(rec) > maxStreamEvent {
+			b.out, b.raw = rec, true
+			return
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err != nil:
+			// Pass on whatever came before the end of the stream.
+			if len(rec) > 0 {
+				b.event(rec)
+			}
+			b.err = err
+			return
+		case !b.sse:
+			b.event(rec)
+			return
+		case isBlankLine(line):
+			// Blank lines between events aren't events of their own.
+			if isBlankLine(rec) {
+				b.out = rec
+			} else {
+				b.event(rec)
+			}
+			return
+		}
+	}
+}
+
+// event passes a record to the hook, queuing it for output unless dropped.
+func (b *eventBody) event(rec []byte) {
+	data := bytes.TrimRight(rec, "\r\n")
+	term := rec[len(data):]
+
+	// Keep the hook from overwriting the terminator by appending to data.
+	data = data[:len(data):len(data)]
+
+	e := &StreamEvent{SSE: b.sse, Data: data}
+	if !b.hook(e) {
+		return
+	}
+
+	b.out = append(append([]byte(nil), e.Data...), term...)
+}
+
+func isBlankLine(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
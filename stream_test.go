@@ -0,0 +1,197 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestStreamEvents(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	io.WriteString(zw, "{\"n\": 1}\n{\"n\": 2}\n")
+	zw.Close()
+
+	streams := map[string]struct {
+		ctype, encoding, body string
+	}{
+		"/sse": {"text/event-stream; charset=utf-8", "", ": comment\n\n" +
+			"event: update\ndata: a\ndata: b\n\n" +
+			"\r\n" +
+			"event: drop\r\ndata: c\r\n\r\n" +
+			"id: 7\ndata: last"},
+		"/ndjson": {"application/x-ndjson", "", "{\"n\": 1}\r\n{\"drop\": true}\n\n{\"n\": 3}"},
+		"/gzip":   {"application/jsonl", "gzip", gz.String()},
+		"/plain":  {"text/plain", "", "data: x\n\n"},
+	}
+
+	var mu sync.Mutex
+	var seen []string
+
+	p := &relay.Proxy{
+		OnStreamEvent: func(s *relay.Session, req *heat.Request, resp *heat.Response, e *relay.StreamEvent) bool {
+			mu.Lock()
+			seen = append(seen, fmt.Sprintf("%v %q", e.SSE, e.Data))
+			mu.Unlock()
+
+			if ev, _ := e.Field("event"); ev == "drop" || bytes.Contains(e.Data, []byte("drop")) {
+				return false
+			}
+			if data, ok := e.Field("data"); ok {
+				e.Data = append(e.Data, "\ndata: ("+strings.ReplaceAll(data, "\n", "+")+")"...)
+			} else if !e.SSE {
+				e.Data = bytes.ToUpper(e.Data)
+			}
+			return true
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			st := streams[strings.TrimPrefix(req.URI, "http://origin.test")]
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Type", st.ctype)
+			resp.Fields.Set("Content-Length", strconv.Itoa(len(st.body)))
+			resp.Fields.Set("ETag", `"v1"`)
+			if st.encoding != "" {
+				resp.Fields.Set("Content-Encoding", st.encoding)
+			}
+			resp.Body = io.NopCloser(iotest.OneByteReader(strings.NewReader(st.body)))
+			return resp, nil
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	for _, tt := range []struct {
+		path, body string
+		events     []string
+	}{
+		{"/sse", ": comment\n\n" +
+			"event: update\ndata: a\ndata: b\ndata: (a+b)\n\n" +
+			"\r\n" +
+			"id: 7\ndata: last\ndata: (last)",
+			[]string{
+				`true ": comment"`,
+				`true "event: update\ndata: a\ndata: b"`,
+				`true "event: drop\r\ndata: c"`,
+				`true "id: 7\ndata: last"`,
+			},
+		},
+		{"/ndjson", "{\"N\": 1}\r\n\n{\"N\": 3}", []string{
+			`false "{\"n\": 1}"`,
+			`false "{\"drop\": true}"`,
+			`false ""`,
+			`false "{\"n\": 3}"`,
+		}},
+		{"/gzip", "{\"N\": 1}\n{\"N\": 2}\n", []string{
+			`false "{\"n\": 1}"`,
+			`false "{\"n\": 2}"`,
+		}},
+		{"/plain", "data: x\n\n", nil},
+	} {
+		mu.Lock()
+		seen = nil
+		mu.Unlock()
+
+		io.WriteString(conn, "GET http://origin.test"+tt.path+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		body, _ := io.ReadAll(resp.Body)
+
+		if string(body) != tt.body {
+			t.Errorf("%s: got body %q, want %q", tt.path, body, tt.body)
+		}
+
+		mu.Lock()
+		if strings.Join(seen, "\n") != strings.Join(tt.events, "\n") {
+			t.Errorf("%s: hook saw:\n%s\nwant:\n%s", tt.path, strings.Join(seen, "\n"), strings.Join(tt.events, "\n"))
+		}
+		mu.Unlock()
+
+		// Split streams are decompressed, reframed, and no longer have a
+		// strong ETag.
+		split := tt.events != nil
+		if te := resp.TransferEncoding; split != (len(te) == 1 && te[0] == "chunked") {
+			t.Errorf("%s: got Transfer-Encoding %q", tt.path, te)
+		}
+		if etag := resp.Header.Get("ETag"); split != (etag == `W/"v1"`) {
+			t.Errorf("%s: got ETag %q", tt.path, etag)
+		}
+		if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+			t.Errorf("%s: got Content-Encoding %q", tt.path, ce)
+		}
+	}
+}
+
+func TestStreamEventsIncremental(t *testing.T) {
+	pr, pw := io.Pipe()
+	events := make(chan string, 2)
+
+	p := &relay.Proxy{
+		OnStreamEvent: func(s *relay.Session, req *heat.Request, resp *heat.Response, e *relay.StreamEvent) bool {
+			events <- string(e.Data)
+			return true
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Type", "text/event-stream")
+			resp.Fields.Set("Transfer-Encoding", "chunked")
+			resp.Body = pr
+			return resp, nil
+		},
+	}
+
+	conn := serve(t, p)
+	io.WriteString(conn, "GET http://origin.test/events HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+
+	go io.WriteString(pw, "data: one\n\n")
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+
+	// The first event is relayed before the second has been sent.
+	buf := make([]byte, len("data: one\n\n"))
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "data: one\n\n" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+	if e := <-events; e != "data: one" {
+		t.Errorf("hook got %q", e)
+	}
+
+	go func() {
+		io.WriteString(pw, "data: two\n\n")
+		pw.Close()
+	}()
+
+	if rest, _ := io.ReadAll(resp.Body); string(rest) != "data: two\n\n" {
+		t.Errorf("got %q", rest)
+	}
+	if e := <-events; e != "data: two" {
+		t.Errorf("hook got %q", e)
+	}
+}
+
+func TestStreamEventField(t *testing.T) {
+	e := &relay.StreamEvent{SSE: true, Data: []byte("event: tick\r\ndata:1\ndata:  2\nid\n:data: x")}
+
+	for _, tt := range []struct {
+		name, value string
+		ok          bool
+	}{
+		{"event", "tick", true},
+		{"data", "1\n 2", true},
+		{"id", "", true},
+		{"retry", "", false},
+	} {
+		if v, ok := e.Field(tt.name); v != tt.value || ok != tt.ok {
+			t.Errorf("Field(%q) = %q, %v, want %q, %v", tt.name, v, ok, tt.value, tt.ok)
+		}
+	}
+}
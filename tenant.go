@@ -0,0 +1,250 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Tenant is one of the proxies served by a Tenants value, along with the
+// connections it's responsible for. A connection belongs to the tenant if it
+// satisfies all of its non-empty conditions.
+type Tenant struct {
+	Proxy *Proxy
+
+	// Names of the listeners (see ListenerConfig.Name) whose connections
+	// the tenant serves.
+	Listeners []string
+
+	// IP addresses or CIDR blocks of the clients the tenant serves. When
+	// PROXY protocol headers are accepted, the addresses they report count.
+	Clients []string
+
+	// Glob patterns (see path.Match) for the server name requested by
+	// connections which begin with a TLS handshake, as received by
+	// listeners detecting protocols (see Proxy.DetectProtocols). Other
+	// connections don't match.
+	ServerNames []string
+
+	nets []*net.IPNet
+}
+
+// Tenants serves connections from shared listeners with one of several
+// proxies, each with its own authority, policies and hooks, so that a single
+// process can act as many logical proxies.
+//
+// Tenants whose proxies use the same Transport share its pool of upstream
+// connections and its Resolver. Proxies without a Transport all share
+// DefaultTransport.
+type Tenants struct {
+	// Tenants in order of precedence. The first one a connection belongs
+	// to serves it.
+	List []Tenant
+
+	// Proxy serving connections which belong to no tenant. If nil, they're
+	// closed.
+	Default *Proxy
+
+	// As the tenant isn't known until a connection's client has been
+	// identified, these replace the ClientSocket and AcceptProxyProtocol
+	// settings of the tenants' proxies.
+	ClientSocket        SocketOptions
+	AcceptProxyProtocol bool
+
+	once      sync.Once
+	err       error
+	sniffName bool
+}
+
+// Validate reports the first problem found in the configuration of the
+// tenants or their proxies.
+func (t *Tenants) Validate() error {
+	t.once.Do(t.compile)
+	if t.err != nil {
+		return t.err
+	}
+
+	for i := range t.List {
+		if err := t.List[i].Proxy.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if t.Default != nil {
+		return t.Default.Validate()
+	}
+
+	return nil
+}
+
+// compile parses the tenants' conditions.
+func (t *Tenants) compile() {
+	for i := range t.List {
+		tn := &t.List[i]
+
+		if tn.Proxy == nil {
+			t.err = configError("Tenants.List[%d] has no proxy", i)
+			return
+		}
+
+		for _, client := range tn.Clients {
+			n, err := parseNet(client)
+			if err != nil {
+				t.err = err
+				return
+			}
+			tn.nets = append(tn.nets, n)
+		}
+
+		for _, pattern := range tn.ServerNames {
+			if _, err := path.Match(pattern, ""); err != nil {
+				t.err = configError("Tenants.List[%d] has invalid server name pattern %q", i, pattern)
+				return
+			}
+		}
+
+		if len(tn.ServerNames) > 0 {
+			t.sniffName = true
+		}
+	}
+}
+
+// Serve serves a single connection, as accepted by a listener with settings
+// from cfg (which may be nil).
+func (t *Tenants) Serve(conn net.Conn, cfg *ListenerConfig) (err error) {
+	defer recoverPanic(&err)
+
+	t.once.Do(t.compile)
+	if t.err != nil {
+		return t.err
+	}
+
+	if err := t.ClientSocket.apply(conn, true); err != nil {
+		return &ClientAbort{err}
+	}
+
+	detect := cfg != nil && cfg.DetectProtocols
+
+	// Find out who the client really is.
+	if t.AcceptProxyProtocol || (cfg != nil && cfg.AcceptProxyProtocol) {
+		if conn, err = acceptProxyHeader(conn, detect); err != nil {
+			return &ClientAbort{err}
+		}
+	}
+
+	var name string
+	if t.sniffName {
+		if name, conn, err = peekServerName(conn); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return &ClientAbort{err}
+		}
+	}
+
+	p := t.tenant(cfg, conn.RemoteAddr(), name)
+	if p == nil {
+		return nil
+	}
+
+	return p.serveConn(conn, cfg)
+}
+
+// ServeListener is like Proxy.ServeListener, serving each connection with
+// the proxy of the tenant it belongs to.
+func (t *Tenants) ServeListener(l net.Listener, cfg *ListenerConfig) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	if cfg != nil {
+		if err := validateOriginForm(cfg.OriginForm, cfg.Reverse); err != nil {
+			return err
+		}
+	}
+
+	return acceptLoop(l, time.Sleep, func(conn net.Conn) {
+		t.Serve(conn, cfg)
+	})
+}
+
+// tenant returns the proxy which should serve a connection.
+func (t *Tenants) tenant(cfg *ListenerConfig, addr net.Addr, name string) *Proxy {
+	for i := range t.List {
+		if tn := &t.List[i]; tn.match(cfg, addr, name) {
+			return tn.Proxy
+		}
+	}
+	return t.Default
+}
+
+// match reports whether a connection belongs to the tenant.
+func (tn *Tenant) match(cfg *ListenerConfig, addr net.Addr, name string) bool {
+	if len(tn.Listeners) > 0 && (cfg == nil || !contains(tn.Listeners, cfg.Name)) {
+		return false
+	}
+
+	if len(tn.nets) > 0 {
+		ip := net.ParseIP(hostname(addr.String()))
+		if ip == nil {
+			return false
+		}
+
+		found := false
+		for _, n := range tn.nets {
+			if n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(tn.ServerNames) > 0 {
+		if name == "" {
+			return false
+		}
+
+		found := false
+		for _, pattern := range tn.ServerNames {
+			if ok, _ := path.Match(pattern, strings.ToLower(name)); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// peekServerName returns the server name requested by a connection, if it
+// begins with a TLS handshake, along with a connection replaying the data
+// read.
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	var b [1]byte
+
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return "", nil, err
+	}
+
+	conn = &prefixed{conn, []byte{b[0]}}
+
+	// Handshake records begin with content type 22.
+	if b[0] != 0x16 {
+		return "", conn, nil
+	}
+
+	hello, conn, err := sniffClientHello(conn)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return hello.ServerName, conn, nil
+}
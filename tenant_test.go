@@ -0,0 +1,155 @@
+package relay_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+// tenantProxy returns a proxy answering every request with its name.
+func tenantProxy(name string) *relay.Proxy {
+	return &relay.Proxy{
+		OnRequest: func(s *relay.Session, req *heat.Request) *heat.Response {
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "1")
+			resp.Body = io.NopCloser(strings.NewReader(name))
+			return resp
+		},
+	}
+}
+
+// serveTenants serves ts on a new listener configured by cfg, returning its
+// address.
+func serveTenants(t *testing.T, ts *relay.Tenants, cfg *relay.ListenerConfig) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ts.ServeListener(l, cfg)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+
+	return l.Addr().String()
+}
+
+func TestTenants(t *testing.T) {
+	ca, cfg := testAuthority(t)
+
+	pc := tenantProxy("C")
+	pc.Authority = ca
+
+	ts := &relay.Tenants{
+		List: []relay.Tenant{
+			{Proxy: tenantProxy("A"), Listeners: []string{"a"}},
+			{Proxy: tenantProxy("B"), Clients: []string{"10.0.0.0/8"}},
+			{Proxy: pc, ServerNames: []string{"*.tenant-c.test"}},
+		},
+		Default: tenantProxy("D"),
+	}
+
+	a := serveTenants(t, ts, &relay.ListenerConfig{Name: "a"})
+	b := serveTenants(t, ts, &relay.ListenerConfig{Name: "b", AcceptProxyProtocol: true, DetectProtocols: true})
+
+	// tenant returns the name of the tenant serving a request sent over a
+	// connection to addr, after prefix.
+	tenant := func(addr, prefix string, wrap func(net.Conn) net.Conn) string {
+		t.Helper()
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		io.WriteString(conn, prefix)
+		if wrap != nil {
+			conn = wrap(conn)
+		}
+
+		io.WriteString(conn, "GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// Tenants are picked by listener, by client address (as reported by a
+	// PROXY protocol header), and by server name.
+	if got := tenant(a, "", nil); got != "A" {
+		t.Errorf("listener a: served by %q", got)
+	}
+	if got := tenant(b, "PROXY TCP4 10.1.2.3 127.0.0.1 1234 80\r\n", nil); got != "B" {
+		t.Errorf("client 10.1.2.3: served by %q", got)
+	}
+	if got := tenant(b, "", nil); got != "D" {
+		t.Errorf("other connection: served by %q", got)
+	}
+
+	cfg = cfg.Clone()
+	cfg.ServerName = "www.tenant-c.test"
+	var peer *x509.Certificate
+	got := tenant(b, "", func(conn net.Conn) net.Conn {
+		tc := tls.Client(conn, cfg)
+		if err := tc.Handshake(); err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		peer = tc.ConnectionState().PeerCertificates[0]
+		return tc
+	})
+	if got != "C" || peer.VerifyHostname("www.tenant-c.test") != nil {
+		t.Errorf("TLS connection to www.tenant-c.test: served by %q with certificate for %q", got, peer.DNSNames)
+	}
+}
+
+func TestTenantsNoDefault(t *testing.T) {
+	ts := &relay.Tenants{List: []relay.Tenant{{Proxy: tenantProxy("A"), Listeners: []string{"a"}}}}
+	addr := serveTenants(t, ts, &relay.ListenerConfig{Name: "b"})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Connections belonging to no tenant are closed.
+	io.WriteString(conn, "GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %d bytes and error %v, want EOF", n, err)
+	}
+}
+
+func TestTenantsValidate(t *testing.T) {
+	for _, ts := range []*relay.Tenants{
+		{List: []relay.Tenant{{Listeners: []string{"a"}}}},
+		{List: []relay.Tenant{{Proxy: &relay.Proxy{}, Clients: []string{"10.0.0.0/33"}}}},
+		{List: []relay.Tenant{{Proxy: &relay.Proxy{}, ServerNames: []string{"[a-"}}}},
+		{List: []relay.Tenant{{Proxy: &relay.Proxy{MaxConns: -1}}}},
+		{Default: &relay.Proxy{MaxConns: -1}},
+	} {
+		if err := ts.Validate(); err == nil {
+			t.Errorf("%+v validated", ts)
+		}
+	}
+
+	if err := (&relay.Tenants{List: []relay.Tenant{{Proxy: &relay.Proxy{}}}}).Validate(); err != nil {
+		t.Errorf("got %v for a valid configuration", err)
+	}
+}
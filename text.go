@@ -0,0 +1,196 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/erkl/heat"
+)
+
+// A Text is a message body decoded to UTF-8, for hooks which inspect or
+// rewrite textual content. See Session.ResponseText.
+type Text struct {
+	// The decoded body.
+	Body string
+
+	// The charset the body is encoded in on the wire, such as "utf-8" or
+	// "windows-1252". Hooks may change it to have the body re-encoded in
+	// another charset, which is then declared in the Content-Type field.
+	Charset string
+
+	// Charset originally found, and whether it was declared with a byte
+	// order mark.
+	orig string
+	bom  bool
+
+	// Whether the body is HTML or XML, in which case characters the charset
+	// can't represent are written as numeric character references.
+	markup bool
+}
+
+// RequestText reads a request's body and decodes it to UTF-8, replacing it
+// with an undecoded copy. Returns nil if the request has no body.
+func (s *Session) RequestText(req *heat.Request) (*Text, error) {
+	return readText(&req.Fields, &req.Body)
+}
+
+// ResponseText reads a response's body and decodes it to UTF-8, replacing it
+// with an undecoded copy. Returns nil if the response has no body.
+//
+// The charset is taken from a byte order mark, the Content-Type field, or
+// for HTML, a <meta> element. Bodies without a known charset are decoded as
+// UTF-8 if valid, and as Windows-1252 otherwise. Bodies compressed using
+// gzip or deflate are decompressed. The whole body is read into memory.
+func (s *Session) ResponseText(resp *heat.Response) (*Text, error) {
+	return readText(&resp.Fields, &resp.Body)
+}
+
+// SetRequestText replaces a request's body with text, encoded in its
+// charset.
+func (s *Session) SetRequestText(req *heat.Request, t *Text) error {
+	return writeText(&req.Fields, &req.Body, t)
+}
+
+// SetResponseText replaces a response's body with text, encoded in its
+// charset.
+func (s *Session) SetResponseText(resp *heat.Response, t *Text) error {
+	return writeText(&resp.Fields, &resp.Body, t)
+}
+
+func readText(fields *heat.Fields, body *io.ReadCloser) (*Text, error) {
+	if *body == nil {
+		return nil, nil
+	}
+
+	var mediaType string
+	var params map[string]string
+	if value, ok := fieldValue(*fields, "Content-Type"); ok {
+		mediaType, params, _ = mime.ParseMediaType(value)
+	}
+
+	// Undo any content coding.
+	r := *body
+	decoded := false
+
+	if coding, ok := fieldValue(*fields, "Content-Encoding"); ok {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "identity" {
+			if r, ok = decoder(coding, r); !ok {
+				return nil, fmt.Errorf("relay: unsupported content coding %q", coding)
+			}
+			decoded = true
+		}
+	}
+
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		*body = nil
+		return nil, err
+	}
+
+	setBody(fields, body, data, decoded)
+
+	t := &Text{markup: isMarkup(mediaType)}
+
+	cs, n := detectBOM(data)
+	t.bom = cs != nil
+
+	if cs == nil {
+		label := params["charset"]
+		if label == "" && mediaType == "text/html" {
+			head := data
+			if len(head) > 1024 {
+				head = head[:1024]
+			}
+			label = sniffCharset(head)
+		}
+
+		switch {
+		case label != "":
+			var ok bool
+			if cs, ok = lookupCharset(label); !ok {
+				return nil, fmt.Errorf("relay: unsupported charset %q", label)
+			}
+		case utf8.Valid(data):
+			cs = charsetUTF8
+		default:
+			cs = charsetWindows1252
+		}
+	}
+
+	t.Body = cs.decode(data[n:])
+	t.Charset, t.orig = cs.name, cs.name
+
+	return t, nil
+}
+
+func writeText(fields *heat.Fields, body *io.ReadCloser, t *Text) error {
+	cs, ok := lookupCharset(t.Charset)
+	if !ok {
+		return fmt.Errorf("relay: unsupported charset %q", t.Charset)
+	}
+
+	data, err := cs.encode(t.Body, t.markup)
+	if err != nil {
+		return err
+	}
+
+	if t.bom {
+		data = append(cs.byteOrderMark(), data...)
+	}
+
+	// Declare the new charset, if it was changed.
+	if cs.name != t.orig {
+		if value, ok := fieldValue(*fields, "Content-Type"); ok {
+			if mediaType, params, err := mime.ParseMediaType(value); err == nil {
+				params["charset"] = cs.name
+				fields.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+			}
+		}
+	}
+
+	if *body != nil {
+		(*body).Close()
+	}
+
+	setBody(fields, body, data, true)
+	return nil
+}
+
+// setBody replaces a message's body with data, sent without any content or
+// transfer coding. If changed is true, the new body differs from what the
+// server sent, so header fields describing the original are updated.
+func setBody(fields *heat.Fields, body *io.ReadCloser, data []byte, changed bool) {
+	fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Content-Encoding") && !f.Is("Content-Length") && !f.Is("Transfer-Encoding") &&
+			!(changed && (f.Is("Content-MD5") || f.Is("Digest")))
+	})
+	fields.Set("Content-Length", strconv.Itoa(len(data)))
+
+	if changed {
+		weakenETag(fields)
+	}
+
+	*body = ioutil.NopCloser(bytes.NewReader(data))
+}
+
+// weakenETag turns a strong entity tag into a weak one, for messages whose
+// body has been modified.
+func weakenETag(fields *heat.Fields) {
+	if etag, ok := fieldValue(*fields, "ETag"); ok && !strings.HasPrefix(etag, "W/") {
+		fields.Set("ETag", "W/"+etag)
+	}
+}
+
+// isMarkup reports whether a media type is HTML or XML.
+func isMarkup(mediaType string) bool {
+	return mediaType == "text/html" || mediaType == "text/xml" ||
+		mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml")
+}
@@ -0,0 +1,144 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestResponseText(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	io.WriteString(w, "caf\xe9")
+	w.Close()
+
+	tests := []struct {
+		path     string
+		ctype    string
+		encoding string
+		body     string
+
+		// What the hook sees, what the client gets, and the Content-Type
+		// declared to it if changed.
+		text     string
+		out      string
+		declared string
+	}{
+		// Charsets declared in the header, by a byte order mark, or in a
+		// <meta> element.
+		{"/latin1", "text/plain; charset=ISO-8859-1", "", "caf\xe9",
+			"windows-1252 café", "CAF\xc9", ""},
+		{"/bom", "text/plain", "", "\xff\xfeh\x00\xe9\x00",
+			"utf-16le hé", "\xff\xfeH\x00\xc9\x00", ""},
+		{"/meta", "text/html", "", `<meta charset="iso-8859-15">` + "\xa4",
+			`iso-8859-15 <meta charset="iso-8859-15">€`, `<META CHARSET="ISO-8859-15">` + "\xa4", ""},
+
+		// Without a declaration, valid UTF-8 is taken as such.
+		{"/utf8", "text/plain", "", "né", "utf-8 né", "NÉ", ""},
+		{"/guess", "text/plain", "", "n\xe9", "windows-1252 né", "N\xc9", ""},
+
+		// Compressed bodies are decompressed.
+		{"/gzip", "text/plain; charset=latin1", "gzip", gz.String(), "windows-1252 café", "CAF\xc9", ""},
+
+		// Hooks may change the charset, which is then declared.
+		{"/recode", "text/plain; charset=latin1", "", "caf\xe9",
+			"windows-1252 café", "CAFÉ", "text/plain; charset=utf-8"},
+
+		// Characters the charset lacks are written as character references
+		// in markup, and are an error elsewhere.
+		{"/markup", "text/html; charset=latin1", "", "x", "windows-1252 x", "&#10003;", ""},
+		{"/plain", "text/plain; charset=latin1", "", "x", "windows-1252 x",
+			"error: relay: U+2713 can't be encoded in windows-1252", ""},
+
+		{"/unknown", "text/plain; charset=koi8-r", "", "x", `error: relay: unsupported charset "koi8-r"`, "x", ""},
+	}
+
+	pages := make(map[string]int)
+	for i, tt := range tests {
+		pages[tt.path] = i
+	}
+
+	seen := make(chan string, 1)
+	p := &relay.Proxy{
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			tt := tests[pages[strings.TrimPrefix(req.URI, "http://origin.test")]]
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Type", tt.ctype)
+			resp.Fields.Set("Content-Length", strconv.Itoa(len(tt.body)))
+			resp.Fields.Set("ETag", `"v1"`)
+			if tt.encoding != "" {
+				resp.Fields.Set("Content-Encoding", tt.encoding)
+			}
+			resp.Body = io.NopCloser(strings.NewReader(tt.body))
+			return resp, nil
+		},
+		OnResponse: func(s *relay.Session, req *heat.Request, resp *heat.Response) {
+			text, err := s.ResponseText(resp)
+			if err != nil {
+				seen <- "error: " + err.Error()
+				return
+			}
+
+			var result string
+			defer func() { seen <- result }()
+
+			result = text.Charset + " " + text.Body
+			text.Body = strings.ToUpper(strings.ReplaceAll(text.Body, "x", "✓"))
+			if strings.HasSuffix(req.URI, "/recode") {
+				text.Charset = "utf-8"
+			}
+
+			if err := s.SetResponseText(resp, text); err != nil {
+				// The hook's outcome stands in for the body.
+				resp.Body = io.NopCloser(strings.NewReader("error: " + err.Error()))
+				resp.Fields.Set("Content-Length", strconv.Itoa(len("error: "+err.Error())))
+			}
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	for _, tt := range tests {
+		io.WriteString(conn, "GET http://origin.test"+tt.path+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+
+		if got := <-seen; got != tt.text {
+			t.Errorf("%s: hook saw %q, want %q", tt.path, got, tt.text)
+		}
+		if string(body) != tt.out {
+			t.Errorf("%s: got %q, want %q", tt.path, body, tt.out)
+		}
+
+		want := tt.ctype
+		if tt.declared != "" {
+			want = tt.declared
+		}
+		if got := resp.Header.Get("Content-Type"); got != want {
+			t.Errorf("%s: got Content-Type %q, want %q", tt.path, got, want)
+		}
+		if resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s: got Content-Encoding %q", tt.path, resp.Header.Get("Content-Encoding"))
+		}
+		// Bodies left as they were keep their strong validator.
+		unchanged := tt.path == "/unknown" || tt.path == "/plain"
+		if etag := resp.Header.Get("ETag"); (etag == `W/"v1"`) == unchanged {
+			t.Errorf("%s: got ETag %q", tt.path, etag)
+		}
+		if resp.ContentLength != int64(len(body)) {
+			t.Errorf("%s: got Content-Length %d for %d bytes", tt.path, resp.ContentLength, len(body))
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/xo"
+)
+
+// Timings break down the time taken to serve a request into phases. Phases
+// which didn't take place, such as connecting to the upstream server when an
+// idle connection was reused, are zero.
+type Timings struct {
+	// When the first byte of the request arrived.
+	Start time.Time
+
+	// Reading the request header from the client, and the request body
+	// after it, until it was read in full or closed.
+	ClientHeader time.Duration
+	ClientBody   time.Duration
+
+	// Resolving the upstream server's address, connecting to it, and the
+	// TLS handshake. Lookups are only timed separately when the Transport
+	// has a Resolver; otherwise they count towards Dial.
+	DNS  time.Duration
+	Dial time.Duration
+	TLS  time.Duration
+
+	// Waiting for the response header once connected, and reading the
+	// response body after it. When RoundTrip or RoundTripContext is set,
+	// connecting counts towards TTFB.
+	TTFB         time.Duration
+	UpstreamBody time.Duration
+
+	// Writing the response to the client, and the exchange as a whole.
+	ClientWrite time.Duration
+	Total       time.Duration
+}
+
+// Timings returns the phase timings of the request currently being served
+// in the session. Phases still in progress, such as writing the response
+// when called from OnResponse, are zero.
+func (s *Session) Timings() Timings {
+	return s.timer.get()
+}
+
+// The timer type collects the Timings of an exchange. Phases are recorded
+// from several goroutines, such as the one uploading the request body.
+type timer struct {
+	clock Clock
+
+	mu sync.Mutex
+	t  Timings
+}
+
+func (tm *timer) get() Timings {
+	if tm == nil {
+		return Timings{}
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.t
+}
+
+// record updates the timings, if tm is non-nil.
+func (tm *timer) record(f func(t *Timings)) {
+	if tm == nil {
+		return
+	}
+
+	tm.mu.Lock()
+	f(&tm.t)
+	tm.mu.Unlock()
+}
+
+// since returns the time elapsed since start, or zero if tm is nil.
+func (tm *timer) since(start time.Time) time.Duration {
+	if tm == nil {
+		return 0
+	}
+	return tm.clock.Now().Sub(start)
+}
+
+func (tm *timer) now() time.Time {
+	if tm == nil {
+		return time.Time{}
+	}
+	return tm.clock.Now()
+}
+
+type timerKey struct{}
+
+// withTimer returns a context through which Transport records the phases
+// of connecting to the upstream server.
+func withTimer(ctx context.Context, tm *timer) context.Context {
+	if tm == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, timerKey{}, tm)
+}
+
+// contextTimer returns the timer set with withTimer, if any.
+func contextTimer(ctx context.Context) *timer {
+	tm, _ := ctx.Value(timerKey{}).(*timer)
+	return tm
+}
+
+// readRequest reads the next request in the session, timing it from the
+// arrival of its first byte so that time spent idle between requests isn't
+// counted.
+func (s *Session) readRequest(r xo.Reader) (*heat.Request, *bodyReader, error) {
+	req, body, tm, err := s.readTimedRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.timer = tm
+	return req, body, nil
+}
+
+// readTimedRequest is like readRequest, but returns the request's timer
+// rather than making it the session's.
+func (s *Session) readTimedRequest(r xo.Reader) (*heat.Request, *bodyReader, *timer, error) {
+	if _, err := r.Peek(1); err != nil {
+		return nil, nil, nil, err
+	}
+
+	tm := &timer{clock: s.proxy.clock()}
+	start := tm.now()
+
+	req, body, repairs, err := readRequest(r, &s.proxy.Tolerate)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, name := range repairs {
+		s.proxy.count("tolerated."+name, 1)
+	}
+
+	tm.t.Start = start
+	tm.t.ClientHeader = tm.since(start)
+
+	if req.Body != nil {
+		req.Body = &timedBody{ReadCloser: req.Body, tm: tm, start: tm.now(), phase: func(t *Timings) *time.Duration {
+			return &t.ClientBody
+		}}
+	}
+
+	return req, body, tm, nil
+}
+
+// complete finishes timing an exchange once its response has been written,
+// starting at write, then reports the timings.
+func (p *Proxy) complete(s *Session, req *heat.Request, resp *heat.Response, write time.Time) {
+	tm := s.timer
+	if tm == nil {
+		return
+	}
+	s.timer = nil
+
+	tm.record(func(t *Timings) {
+		t.ClientWrite = tm.since(write)
+		t.Total = tm.since(t.Start)
+	})
+
+	t := tm.get()
+
+	if p.Metrics != nil {
+		p.count("time.exchanges", 1)
+		p.count("time.client_header", t.ClientHeader.Microseconds())
+		p.count("time.client_body", t.ClientBody.Microseconds())
+		p.count("time.dns", t.DNS.Microseconds())
+		p.count("time.dial", t.Dial.Microseconds())
+		p.count("time.tls", t.TLS.Microseconds())
+		p.count("time.ttfb", t.TTFB.Microseconds())
+		p.count("time.upstream_body", t.UpstreamBody.Microseconds())
+		p.count("time.client_write", t.ClientWrite.Microseconds())
+		p.count("time.total", t.Total.Microseconds())
+	}
+
+	p.countGraphQL(s, t.Total)
+
+	if p.OnComplete != nil {
+		if p.LogSample.Sample(s, req) {
+			p.OnComplete(s, req, resp, t)
+		} else {
+			p.count("complete.unsampled", 1)
+		}
+	}
+
+	s.graphql = nil
+}
+
+// The timedBody type records how long it takes for a message body to be
+// read in full, or closed.
+type timedBody struct {
+	io.ReadCloser
+	tm    *timer
+	start time.Time
+	phase func(t *Timings) *time.Duration
+	once  sync.Once
+}
+
+func (b *timedBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	if err == io.EOF {
+		b.stop()
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.stop()
+	return b.ReadCloser.Close()
+}
+
+func (b *timedBody) stop() {
+	b.once.Do(func() {
+		d := b.tm.since(b.start)
+		b.tm.record(func(t *Timings) {
+			*b.phase(t) = d
+		})
+	})
+}
+
+// addServerTiming describes the upstream phases of an exchange in a
+// Server-Timing header field. Phases which didn't take place are left out.
+func addServerTiming(resp *heat.Response, t Timings) {
+	var metrics []string
+
+	for _, m := range []struct {
+		name, desc string
+		d          time.Duration
+	}{
+		{"dns", "Proxy DNS lookup", t.DNS},
+		{"connect", "Proxy connect", t.Dial},
+		{"tls", "Proxy TLS handshake", t.TLS},
+		{"ttfb", "Upstream response", t.TTFB},
+	} {
+		if m.d > 0 {
+			ms := strconv.FormatFloat(float64(m.d)/float64(time.Millisecond), 'f', 1, 64)
+			metrics = append(metrics, m.name+";desc=\""+m.desc+"\";dur="+ms)
+		}
+	}
+
+	if len(metrics) > 0 {
+		resp.Fields.Add("Server-Timing", strings.Join(metrics, ", "))
+	}
+}
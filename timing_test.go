@@ -0,0 +1,200 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+	"github.com/erkl/relay/relaytest"
+)
+
+func TestTimings(t *testing.T) {
+	clock := relaytest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	arrived := make(chan struct{})
+	proceed := make(chan struct{})
+	body, upstreamBody := io.Pipe()
+
+	m := new(counters)
+	timings := make(chan relay.Timings, 2)
+
+	p := &relay.Proxy{
+		Clock:   clock,
+		Metrics: m,
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			arrived <- struct{}{}
+			<-proceed
+			io.ReadAll(req.Body)
+
+			arrived <- struct{}{}
+			<-proceed
+
+			resp := heat.NewResponse(200, "OK")
+			resp.Body = body
+			return resp, nil
+		},
+		OnResponse: func(s *relay.Session, req *heat.Request, resp *heat.Response) {
+			timings <- s.Timings()
+		},
+		OnComplete: func(s *relay.Session, req *heat.Request, resp *heat.Response, t relay.Timings) {
+			timings <- t
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	io.WriteString(conn, "POST http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\nContent-Length: 5\r\n\r\nhello")
+
+	// The request body takes 2 seconds to be read, the response header 3
+	// more to arrive, and the response body 4 more after that.
+	<-arrived
+	clock.Advance(2 * time.Second)
+	proceed <- struct{}{}
+	<-arrived
+	clock.Advance(3 * time.Second)
+	proceed <- struct{}{}
+
+	resp := readFinal(t, conn, r)
+	clock.Advance(4 * time.Second)
+	go func() {
+		io.WriteString(upstreamBody, "done")
+		upstreamBody.Close()
+	}()
+	if b, _ := io.ReadAll(resp.Body); string(b) != "done" {
+		t.Fatalf("got body %q", b)
+	}
+
+	// Phases still in progress are zero while OnResponse runs.
+	if got := <-timings; got.TTFB != 5*time.Second || got.UpstreamBody != 0 || got.Total != 0 {
+		t.Errorf("OnResponse got %+v", got)
+	}
+
+	got := <-timings
+	want := relay.Timings{
+		Start:        clock.Now().Add(-9 * time.Second),
+		ClientBody:   2 * time.Second,
+		TTFB:         5 * time.Second,
+		UpstreamBody: 4 * time.Second,
+		ClientWrite:  4 * time.Second,
+		Total:        9 * time.Second,
+	}
+	if !got.Start.Equal(want.Start) {
+		t.Errorf("got start %v, want %v", got.Start, want.Start)
+	}
+	got.Start = want.Start
+	if got != want {
+		t.Errorf("got timings\n%+v\nwant\n%+v", got, want)
+	}
+
+	if m.get("time.exchanges") != 1 || m.get("time.total") != 9e6 || m.get("time.ttfb") != 5e6 {
+		t.Errorf("got %d exchanges taking %dµs, %dµs to first byte",
+			m.get("time.exchanges"), m.get("time.total"), m.get("time.ttfb"))
+	}
+}
+
+func TestTimingsTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	l := &lookups{}
+	l.ip.Store(net.ParseIP("127.0.0.1"))
+	lookup := func(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+		time.Sleep(20 * time.Millisecond)
+		return l.lookup(ctx, host)
+	}
+
+	timings := make(chan relay.Timings, 2)
+	p := &relay.Proxy{
+		Transport: &relay.Transport{
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+			Resolver:  &relay.DNSCache{Lookup: lookup},
+		},
+		OnComplete: func(s *relay.Session, req *heat.Request, resp *heat.Response, t relay.Timings) {
+			timings <- t
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	for i := 0; i < 2; i++ {
+		io.WriteString(conn, "GET https://upstream.test:"+port+"/ HTTP/1.1\r\nHost: upstream.test\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		io.ReadAll(resp.Body)
+		if resp.StatusCode != 200 {
+			t.Fatalf("got status %d", resp.StatusCode)
+		}
+	}
+
+	// The first request connects, and the second reuses its connection.
+	first, second := <-timings, <-timings
+	if first.DNS < 20*time.Millisecond || first.Dial <= 0 || first.TLS <= 0 || first.TTFB <= 0 {
+		t.Errorf("first request took %+v", first)
+	}
+	if second.DNS != 0 || second.Dial != 0 || second.TLS != 0 || second.TTFB <= 0 {
+		t.Errorf("second request took %+v", second)
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	clock := relaytest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	arrived := make(chan struct{})
+
+	scrubbed, _ := relay.ParseMatch("path=/scrubbed")
+	p := &relay.Proxy{
+		Clock:        clock,
+		ServerTiming: true,
+		HeaderRules: []relay.HeaderRule{
+			{Response: true, Match: scrubbed, Action: relay.RemoveHeader, Name: "Server-Timing"},
+		},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			arrived <- struct{}{}
+			<-arrived
+
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "0")
+			resp.Fields.Set("Server-Timing", "db;dur=53")
+			return resp, nil
+		},
+	}
+
+	conn := serve(t, p)
+	r := bufio.NewReader(conn)
+
+	tests := []struct {
+		path  string
+		delay time.Duration
+		want  []string
+	}{
+		// The proxy's own field is added after header rules are applied.
+		{"/scrubbed", 1500 * time.Millisecond, []string{`ttfb;desc="Upstream response";dur=1500.0`}},
+
+		// The server's field is kept, and phases which took no time are
+		// left out.
+		{"/kept", 0, []string{"db;dur=53"}},
+	}
+
+	for _, tt := range tests {
+		io.WriteString(conn, "GET http://origin.test"+tt.path+" HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+
+		<-arrived
+		clock.Advance(tt.delay)
+		arrived <- struct{}{}
+
+		resp := readFinal(t, conn, r)
+		if got := resp.Header.Values("Server-Timing"); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: got Server-Timing %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
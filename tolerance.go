@@ -0,0 +1,213 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/xo"
+)
+
+// A Tolerance selects protocol violations commonly found in real-world
+// traffic which are to be repaired on a best-effort basis, rather than
+// rejected. Messages are only rewritten when they need repairing.
+type Tolerance struct {
+	// Accept header lines terminated by a bare LF rather than CRLF.
+	BareLF bool
+
+	// Accept request URIs containing spaces, which are escaped as "%20".
+	// Only applies to requests.
+	URISpaces bool
+
+	// Accept status lines without a reason phrase, supplying the standard
+	// one for the status code. Only applies to responses.
+	MissingReason bool
+
+	// Maximum size of a message header in bytes, if larger than the
+	// default of 4 KiB.
+	MaxHeaderBytes int
+}
+
+// defaultMaxHeader is the size of the buffers headers are usually read with.
+const defaultMaxHeader = 4096
+
+var errHeaderTooLarge = errors.New("relay: message header too large")
+
+// enabled reports whether any violations are tolerated.
+func (t *Tolerance) enabled() bool {
+	return t != nil && (t.BareLF || t.URISpaces || t.MissingReason || t.MaxHeaderBytes > defaultMaxHeader)
+}
+
+// readRequestHeader reads a request header, repairing the violations t
+// tolerates, and returning the names of those found.
+func readRequestHeader(r xo.Reader, t *Tolerance) (*heat.Request, []string, error) {
+	if !t.enabled() {
+		req, err := heat.ReadRequestHeader(r)
+		return req, nil, err
+	}
+
+	head, repairs, err := t.repair(r, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := heat.ReadRequestHeader(xo.NewReader(bytes.NewReader(head), make([]byte, len(head))))
+	return req, repairs, err
+}
+
+// readResponseHeader reads a response header, repairing the violations t
+// tolerates.
+func readResponseHeader(r xo.Reader, t *Tolerance) (*heat.Response, error) {
+	if !t.enabled() {
+		return heat.ReadResponseHeader(r)
+	}
+
+	head, _, err := t.repair(r, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return heat.ReadResponseHeader(xo.NewReader(bytes.NewReader(head), make([]byte, len(head))))
+}
+
+// repair consumes a message header from r, returning it with the violations
+// t tolerates repaired, along with their names. Violations which aren't
+// tolerated are left for the header parser to reject.
+func (t *Tolerance) repair(r xo.Reader, request bool) ([]byte, []string, error) {
+	limit := defaultMaxHeader
+	if t.MaxHeaderBytes > limit {
+		limit = t.MaxHeaderBytes
+	}
+
+	var head []byte
+
+	for {
+		if _, err := r.Peek(1); err != nil {
+			return nil, nil, err
+		}
+		buf, _ := r.Peek(0)
+
+		n := len(head)
+		head = append(head, buf...)
+
+		if end := headerEnd(head, n); end >= 0 {
+			if end > limit {
+				return nil, nil, errHeaderTooLarge
+			}
+			r.Consume(end - n)
+			head = head[:end]
+			break
+		}
+
+		if len(head) > limit {
+			return nil, nil, errHeaderTooLarge
+		}
+		r.Consume(len(buf))
+	}
+
+	var repairs []string
+	if len(head) > defaultMaxHeader {
+		repairs = append(repairs, "large_header")
+	}
+
+	lines := bytes.Split(head[:len(head)-1], []byte("\n"))
+	bare := false
+	for i, line := range lines {
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			lines[i] = line[:len(line)-1]
+		} else {
+			bare = true
+		}
+	}
+	if bare {
+		if !t.BareLF {
+			return head, repairs, nil
+		}
+		repairs = append(repairs, "bare_lf")
+	}
+
+	if request && t.URISpaces {
+		if line, ok := escapeURISpaces(lines[0]); ok {
+			lines[0] = line
+			repairs = append(repairs, "uri_spaces")
+		}
+	}
+	if !request && t.MissingReason {
+		if line, ok := addReasonPhrase(lines[0]); ok {
+			lines[0] = line
+			repairs = append(repairs, "missing_reason")
+		}
+	}
+
+	if len(repairs) == 0 {
+		return head, nil, nil
+	}
+
+	out := bytes.Join(lines, []byte("\r\n"))
+	out = append(out, "\r\n"...)
+	return out, repairs, nil
+}
+
+// headerEnd returns the offset just past the empty line ending a message
+// header, or -1 if it hasn't arrived yet. Bytes before from have already
+// been searched.
+func headerEnd(head []byte, from int) int {
+	if from -= 2; from < 0 {
+		from = 0
+	}
+
+	for i := from; i < len(head); i++ {
+		if head[i] != '\n' || i == 0 {
+			continue
+		}
+		if head[i-1] == '\n' {
+			return i + 1
+		}
+		if i >= 2 && head[i-1] == '\r' && head[i-2] == '\n' {
+			return i + 1
+		}
+	}
+
+	return -1
+}
+
+// escapeURISpaces escapes spaces within the URI of a request line.
+func escapeURISpaces(line []byte) ([]byte, bool) {
+	i := bytes.IndexByte(line, ' ')
+	j := bytes.LastIndexByte(line, ' ')
+	if i < 0 || i == j || !bytes.HasPrefix(line[j+1:], []byte("HTTP/")) {
+		return line, false
+	}
+
+	uri := line[i+1 : j]
+	if bytes.IndexByte(uri, ' ') < 0 {
+		return line, false
+	}
+
+	out := append([]byte(nil), line[:i+1]...)
+	out = append(out, bytes.ReplaceAll(uri, []byte(" "), []byte("%20"))...)
+	out = append(out, line[j:]...)
+	return out, true
+}
+
+// addReasonPhrase adds the standard reason phrase to a status line without
+// one.
+func addReasonPhrase(line []byte) ([]byte, bool) {
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 || bytes.IndexByte(line[i+1:], ' ') >= 0 {
+		return line, false
+	}
+
+	status, err := strconv.Atoi(string(line[i+1:]))
+	if err != nil {
+		return line, false
+	}
+
+	reason := heat.ReasonPhrase(status)
+	if reason == "" {
+		reason = "Unknown"
+	}
+
+	return append(append(line[:len(line):len(line)], ' '), reason...), true
+}
@@ -0,0 +1,102 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestToleratedRequests(t *testing.T) {
+	sent := make(chan string, 1)
+	m := new(counters)
+
+	p := &relay.Proxy{
+		Metrics: m,
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			sent <- req.URI + " " + field(req.Fields, "X-Pad")[:1]
+			return heat.NewResponse(204, "No Content"), nil
+		},
+	}
+
+	pad := strings.Repeat("x", 6000)
+
+	for _, tt := range []struct {
+		tolerate relay.Tolerance
+		request  string
+		status   int
+		uri      string
+	}{
+		{relay.Tolerance{}, "GET http://origin.test/a HTTP/1.1\r\nHost: origin.test\r\nX-Pad: y\r\n\r\n", 204, "/a y"},
+		{relay.Tolerance{BareLF: true}, "GET http://origin.test/a HTTP/1.1\nHost: origin.test\r\nX-Pad: y\n\n", 204, "/a y"},
+		{relay.Tolerance{}, "GET http://origin.test/a b HTTP/1.1\r\nHost: origin.test\r\nX-Pad: y\r\n\r\n", 404, ""},
+		{relay.Tolerance{URISpaces: true}, "GET http://origin.test/a b?c d HTTP/1.1\r\nHost: origin.test\r\nX-Pad: y\r\n\r\n", 204, "/a%20b?c%20d y"},
+		{relay.Tolerance{MaxHeaderBytes: 8192}, "GET http://origin.test/a HTTP/1.1\r\nHost: origin.test\r\nX-Pad: " + pad + "\r\n\r\n", 204, "/a x"},
+		{relay.Tolerance{MaxHeaderBytes: 5000}, "GET http://origin.test/a HTTP/1.1\r\nHost: origin.test\r\nX-Pad: " + pad + "\r\n\r\n", 431, ""},
+	} {
+		p.Tolerate = tt.tolerate
+		conn := serve(t, p)
+		go io.WriteString(conn, tt.request)
+
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+		if resp.StatusCode != tt.status {
+			t.Errorf("%+v %.40q: got status %d, want %d", tt.tolerate, tt.request, resp.StatusCode, tt.status)
+			continue
+		}
+		if tt.status == 204 {
+			if got := <-sent; got != tt.uri {
+				t.Errorf("%+v %.40q: forwarded %s, want %s", tt.tolerate, tt.request, got, tt.uri)
+			}
+		}
+	}
+
+	for name, want := range map[string]int64{
+		"tolerated.bare_lf":      1,
+		"tolerated.uri_spaces":   1,
+		"tolerated.large_header": 1,
+	} {
+		if n := m.get(name); n != want {
+			t.Errorf("%s = %d, want %d", name, n, want)
+		}
+	}
+}
+
+func TestToleratedResponses(t *testing.T) {
+	for _, tt := range []struct {
+		tolerate relay.Tolerance
+		response string
+		status   int
+		reason   string
+	}{
+		{relay.Tolerance{}, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok", 200, "OK"},
+		{relay.Tolerance{}, "HTTP/1.1 200\r\nContent-Length: 2\r\n\r\nok", 502, ""},
+		{relay.Tolerance{MissingReason: true}, "HTTP/1.1 404\r\nContent-Length: 2\r\n\r\nok", 404, "Not Found"},
+		{relay.Tolerance{MissingReason: true}, "HTTP/1.1 299\r\nContent-Length: 2\r\n\r\nok", 299, "Unknown"},
+		{relay.Tolerance{}, "HTTP/1.1 200 OK\nContent-Length: 2\n\nok", 502, ""},
+		{relay.Tolerance{BareLF: true, MissingReason: true}, "HTTP/1.1 200\nContent-Length: 2\n\nok", 200, "OK"},
+	} {
+		addr := rawUpstream(t, func(conn *net.TCPConn) {
+			http.ReadRequest(bufio.NewReader(conn))
+			io.WriteString(conn, tt.response)
+		})
+
+		p := &relay.Proxy{Transport: &relay.Transport{Tolerate: tt.tolerate}}
+		conn := serve(t, p)
+		io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+		if resp.StatusCode != tt.status {
+			t.Errorf("%+v %q: got status %d, want %d", tt.tolerate, tt.response, resp.StatusCode, tt.status)
+			continue
+		}
+		if body, _ := io.ReadAll(resp.Body); tt.status < 500 && (string(body) != "ok" || !strings.HasSuffix(resp.Status, " "+tt.reason)) {
+			t.Errorf("%+v %q: got %s %q", tt.tolerate, tt.response, resp.Status, body)
+		}
+	}
+}
@@ -0,0 +1,879 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/xo"
+)
+
+// DefaultTransport is used by proxies without a Transport of their own.
+var DefaultTransport = &Transport{}
+
+// A Transport forwards requests to upstream servers over HTTP/1.1 (or h2c,
+// see H2CHosts), keeping idle connections around for reuse. It's used by
+// proxies without a custom RoundTrip function, and for dialing opaque
+// tunnels. The zero value is ready to use. Transports are safe for
+// concurrent use.
+type Transport struct {
+	// Function used to connect to upstream servers. Defaults to dialing with
+	// a net.Dialer, applying the options in Socket.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// Socket options applied to upstream connections.
+	Socket SocketOptions
+
+	// Local addresses to connect to upstream servers from, used in turn.
+	// Overridden by WithLocalAddr. If empty, the system picks one. Ignored
+	// when Dial is set.
+	LocalAddrs []net.IP
+
+	// If set, host names are resolved through this cache rather than by the
+	// net.Dialer. Ignored when Dial is set.
+	Resolver *DNSCache
+
+	// If set, connections to addresses it doesn't permit are refused with a
+	// PolicyDenied error. Proxies using the transport also check the
+	// destinations of requests and tunnels up front, resolving host names
+	// locally, which covers destinations reached through Proxy. The parent
+	// proxy itself and UNIX sockets are exempt.
+	Guard *AddressGuard
+
+	// Maps upstream hosts (either "host" or "host:port") to UNIX domain
+	// sockets which should be dialed in their place. Upstream addresses of
+	// the form "unix:/path/to/socket" are always dialed as UNIX sockets.
+	UnixSockets map[string]string
+
+	// Upstream hosts (either "host" or "host:port") which speak HTTP/2 over
+	// plain connections, such as internal services. Plain HTTP requests to
+	// them are sent using HTTP/2 with prior knowledge (h2c), over
+	// connections dialed as usual, and their responses are passed on as
+	// HTTP/1.1. Trailers aren't passed on.
+	H2CHosts map[string]bool
+
+	// If set, requests are forwarded through this HTTP proxy, and tunnels
+	// are opened through it with CONNECT requests. Credentials in the URL
+	// are sent to it using basic authentication.
+	Proxy *url.URL
+
+	// If true, the credentials in Proxy are sent using NTLM rather than
+	// basic authentication, with the user name given as "DOMAIN\user"
+	// (escaped as "DOMAIN%5Cuser" in the URL). NTLM authenticates
+	// connections, so this happens once for every new connection.
+	ProxyNTLM bool
+
+	// Configuration for TLS connections to upstream servers. If ServerName
+	// is empty, it's set to the upstream server's hostname.
+	TLSConfig *tls.Config
+
+	// Maximum number of idle connections kept per upstream server. Zero
+	// means two.
+	MaxIdlePerHost int
+
+	// If positive, connections are closed instead of being reused once
+	// they've been idle for, or open for, this long, respectively.
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+
+	// If positive, how long upstream servers may take to start responding
+	// once a request's header has been sent, failing with
+	// ErrResponseTimeout.
+	ResponseHeaderTimeout time.Duration
+
+	// If positive, how long reading a response body may take as a whole,
+	// and how long upstream servers may go without sending any of it,
+	// respectively, failing with ErrBodyTimeout. Long downloads are best
+	// limited by BodyIdleTimeout alone, which only catches silent servers.
+	BodyTimeout     time.Duration
+	BodyIdleTimeout time.Duration
+
+	// Protocol violations tolerated in responses from upstream servers.
+	Tolerate Tolerance
+
+	idle      [shardCount]idleShard
+	nextLocal uint32
+
+	// Client for H2CHosts, created when first needed.
+	h2cOnce   sync.Once
+	h2cClient *http.Transport
+}
+
+// An idleShard holds the idle connections for some of a Transport's keys.
+type idleShard struct {
+	mu    sync.Mutex
+	conns map[string][]*persistConn
+}
+
+// transport returns the proxy's transport.
+func (p *Proxy) transport() *Transport {
+	if p.Transport != nil {
+		return p.Transport
+	}
+	return DefaultTransport
+}
+
+// RoundTrip forwards a request to the upstream server described by its Scheme
+// and Remote fields.
+func (t *Transport) RoundTrip(req *heat.Request) (*heat.Response, error) {
+	return t.RoundTripContext(context.Background(), req)
+}
+
+// RoundTripContext is like RoundTrip, but aborts the request when ctx is
+// done. The context must stay alive until the response body is closed.
+func (t *Transport) RoundTripContext(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+	if req.Scheme == "ftp" {
+		return t.ftp(ctx, req)
+	}
+	if req.Scheme == "http" && t.isH2CHost(req.Remote) {
+		return t.h2c(ctx, req)
+	}
+
+	addr := withPort(req.Remote, req.Scheme)
+
+	for {
+		pc, err := t.getConn(ctx, req.Scheme, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := pc.roundTrip(ctx, req)
+		if err == nil {
+			return resp, nil
+		}
+
+		// Idle connections may have been closed by the server while they sat
+		// in the pool. Retry on a new connection, as long as that's safe.
+		if !pc.reused || req.Body != nil || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// getConn returns an idle connection to addr, or dials a new one.
+func (t *Transport) getConn(ctx context.Context, scheme, addr string) (*persistConn, error) {
+	key := scheme + "://" + addr
+
+	// Connections using another server name can't be shared...
+	sni := serverName(ctx)
+	if sni != "" && scheme == "https" {
+		key += " " + sni
+	}
+
+	// Plain HTTP requests to all hosts can share connections to a parent
+	// proxy.
+	absolute := t.Proxy != nil && scheme != "https"
+	if absolute {
+		key = "proxy"
+	}
+
+	// Nor can connections from other local addresses.
+	if ip, ok := ctx.Value(localAddrKey{}).(net.IP); ok {
+		key += " from " + ip.String()
+	}
+
+	if pc := t.getIdle(key); pc != nil {
+		return pc, nil
+	}
+
+	var conn net.Conn
+	var err error
+
+	tm := contextTimer(ctx)
+	start := time.Now()
+
+	if absolute {
+		conn, err = t.dialProxy(ctx)
+	} else {
+		conn, err = t.dialTunnel(ctx, addr)
+	}
+
+	d := time.Since(start)
+	tm.record(func(ts *Timings) { ts.Dial += d })
+
+	if err != nil {
+		return nil, err
+	}
+
+	if scheme == "https" {
+		var cfg *tls.Config
+		if t.TLSConfig != nil {
+			cfg = t.TLSConfig.Clone()
+		} else {
+			cfg = &tls.Config{}
+		}
+
+		if sni != "" {
+			cfg.ServerName = sni
+		} else if cfg.ServerName == "" {
+			cfg.ServerName = hostname(addr)
+		}
+
+		tlsConn := tls.Client(conn, cfg)
+		start := time.Now()
+		err := tlsConn.HandshakeContext(ctx)
+		d := time.Since(start)
+		tm.record(func(ts *Timings) { ts.TLS += d })
+
+		if err != nil {
+			conn.Close()
+			return nil, &TLSHandshakeError{Host: addr, Upstream: true, Err: err}
+		}
+
+		conn = tlsConn
+	}
+
+	if absolute {
+		scheme, addr = t.Proxy.Scheme, withPort(t.Proxy.Host, t.Proxy.Scheme)
+	}
+
+	return &persistConn{
+		t:        t,
+		key:      key,
+		scheme:   scheme,
+		addr:     addr,
+		conn:     conn,
+		r:        xo.NewReader(conn, make([]byte, 4096)),
+		w:        xo.NewWriter(conn, make([]byte, 4096)),
+		created:  time.Now(),
+		absolute: absolute,
+	}, nil
+}
+
+func (t *Transport) getIdle(key string) *persistConn {
+	sh := &t.idle[shardOf(key)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	now := time.Now()
+
+	for list := sh.conns[key]; len(list) > 0; list = sh.conns[key] {
+		pc := list[len(list)-1]
+		sh.conns[key] = list[:len(list)-1]
+
+		if t.expired(pc, now) {
+			pc.conn.Close()
+			continue
+		}
+
+		pc.reused = true
+		return pc
+	}
+
+	return nil
+}
+
+func (t *Transport) putIdle(pc *persistConn) {
+	sh := &t.idle[shardOf(pc.key)]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	max := t.MaxIdlePerHost
+	if max <= 0 {
+		max = 2
+	}
+
+	if len(sh.conns[pc.key]) >= max || (t.MaxLifetime > 0 && time.Since(pc.created) >= t.MaxLifetime) {
+		pc.conn.Close()
+		return
+	}
+
+	if sh.conns == nil {
+		sh.conns = make(map[string][]*persistConn)
+	}
+
+	pc.idleSince = time.Now()
+	sh.conns[pc.key] = append(sh.conns[pc.key], pc)
+}
+
+// expired reports whether an idle connection has been around for too long.
+func (t *Transport) expired(pc *persistConn, now time.Time) bool {
+	return (t.IdleTimeout > 0 && now.Sub(pc.idleSince) >= t.IdleTimeout) ||
+		(t.MaxLifetime > 0 && now.Sub(pc.created) >= t.MaxLifetime)
+}
+
+// dial connects to an upstream address, using t.Dial if set.
+func (t *Transport) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return t.dialGuarded(ctx, network, addr, t.Guard)
+}
+
+// dialProxy connects to t.Proxy, which is exempt from t.Guard.
+func (t *Transport) dialProxy(ctx context.Context) (net.Conn, error) {
+	return t.dialGuarded(ctx, "tcp", withPort(t.Proxy.Host, t.Proxy.Scheme), nil)
+}
+
+// dialGuarded is like dial, refusing addresses not permitted by guard (if
+// non-nil).
+func (t *Transport) dialGuarded(ctx context.Context, network, addr string, guard *AddressGuard) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+
+	if path, ok := t.unixSocket(addr); ok {
+		conn, err = net.Dial("unix", path)
+	} else if t.Dial != nil {
+		conn, err = t.Dial(network, addr)
+		if err == nil && guard != nil {
+			if err = guard.checkConn(conn); err != nil {
+				conn.Close()
+			}
+		}
+	} else {
+		d := &net.Dialer{Control: t.Socket.Control}
+		if guard != nil {
+			d.Control = guard.control(t.Socket.Control)
+		}
+		if t.Socket.KeepAliveIdle < 0 {
+			d.KeepAlive = -1
+		}
+		if ip := t.localAddr(ctx); ip != nil {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+		if t.Resolver != nil {
+			conn, err = t.dialResolved(ctx, d, network, addr)
+		} else {
+			conn, err = d.DialContext(ctx, network, addr)
+		}
+	}
+
+	if err != nil {
+		return nil, &DialError{addr, err}
+	}
+
+	// Only call the Control function ourselves if the net.Dialer didn't.
+	if err := t.Socket.apply(conn, t.Dial != nil); err != nil {
+		conn.Close()
+		return nil, &DialError{addr, err}
+	}
+
+	return conn, nil
+}
+
+// dialResolved looks up addr's host through t.Resolver, then dials each of
+// its addresses in turn until a connection is established.
+func (t *Transport) dialResolved(ctx context.Context, d *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	ips, err := t.Resolver.Resolve(ctx, host)
+
+	// The lookup is part of dialing, which getConn times as a whole.
+	elapsed := time.Since(start)
+	contextTimer(ctx).record(func(ts *Timings) {
+		ts.DNS += elapsed
+		ts.Dial -= elapsed
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+
+	for _, ip := range ips {
+		conn, e := d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if e == nil {
+			return conn, nil
+		}
+		err = e
+	}
+
+	return nil, err
+}
+
+// dialTunnel opens a connection to addr, through t.Proxy if set.
+func (t *Transport) dialTunnel(ctx context.Context, addr string) (net.Conn, error) {
+	if t.Proxy == nil {
+		return t.dial(ctx, "tcp", addr)
+	}
+
+	conn, err := t.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rw := xo.NewReadWriter(
+		xo.NewReader(conn, make([]byte, 1024)),
+		xo.NewWriter(conn, make([]byte, 1024)),
+	)
+
+	req := heat.NewRequest("CONNECT", addr)
+	req.Major, req.Minor = 1, 1
+	req.Fields.Set("Host", addr)
+	t.proxyAuthorization(req)
+
+	var resp *heat.Response
+	if t.ProxyNTLM {
+		resp, err = ntlmHandshake(rw, rw, req, t.Proxy.User)
+	} else {
+		resp, err = exchange(rw, rw, req)
+	}
+	if err == nil && resp.Status != 200 {
+		err = fmt.Errorf("proxy responded with %d %s", resp.Status, resp.Reason)
+	}
+
+	var peek []byte
+	if err == nil {
+		peek, err = rw.Peek(0)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, &DialError{addr, err}
+	}
+
+	if len(peek) > 0 {
+		conn = &prefixed{conn, peek}
+	}
+
+	return conn, nil
+}
+
+// proxyAuthorization adds basic credentials for t.Proxy to a request.
+func (t *Transport) proxyAuthorization(req *heat.Request) {
+	if u := t.Proxy.User; u != nil && !t.ProxyNTLM {
+		pass, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Fields.Set("Proxy-Authorization", "Basic "+auth)
+	}
+}
+
+// unixSocket returns the path of the UNIX domain socket to dial in place of
+// addr, if any.
+func (t *Transport) unixSocket(addr string) (string, bool) {
+	if strings.HasPrefix(addr, "unix:") {
+		return strings.TrimPrefix(addr[5:], "//"), true
+	}
+
+	if path, ok := t.UnixSockets[addr]; ok {
+		return path, true
+	}
+
+	path, ok := t.UnixSockets[hostname(addr)]
+	return path, ok
+}
+
+// The persistConn type represents a connection to an upstream server.
+type persistConn struct {
+	t      *Transport
+	key    string
+	scheme string
+	addr   string
+	conn   net.Conn
+	r      xo.Reader
+	w      xo.Writer
+	reused bool
+
+	created   time.Time
+	idleSince time.Time
+
+	// Whether the connection leads to a parent proxy, which expects requests
+	// with absolute URIs, and whether it has been authenticated using NTLM.
+	absolute bool
+	authed   bool
+}
+
+// roundTrip sends a request over the connection and reads the response
+// header. The connection is closed when anything goes wrong, and put back
+// in the idle pool once the response body has been read in full.
+func (pc *persistConn) roundTrip(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+	stop := context.AfterFunc(ctx, func() {
+		pc.conn.Close()
+	})
+
+	fail := func(err error) (*heat.Response, error) {
+		stop()
+		pc.conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	size, err := heat.RequestBodySize(req)
+	if err != nil {
+		return fail(err)
+	}
+
+	if pc.absolute {
+		uri := req.URI
+		req.URI = req.Scheme + "://" + req.Remote + uri
+		pc.t.proxyAuthorization(req)
+		defer func() {
+			req.URI = uri
+		}()
+	}
+
+	// Keeping the connection open is up to the transport, regardless of
+	// whether the client means to (see ClientIntent), except in bridge mode,
+	// where requests are sent as they are.
+	if heat.Closing(req.Major, req.Minor, req.Fields) && upgradeProtocol(req.Fields) == "" && !bridging(ctx) {
+		fields := req.Fields
+		req.Fields = append(heat.Fields(nil), fields...)
+		req.Fields.Set("Connection", "keep-alive")
+		defer func() {
+			req.Fields = fields
+		}()
+	}
+
+	var resp *heat.Response
+
+	// NTLM authenticates connections rather than requests, so new
+	// connections to the parent proxy go through the handshake first.
+	if pc.absolute && pc.t.ProxyNTLM && !pc.authed {
+		if resp, err = pc.authenticate(req); err != nil {
+			return fail(&UpstreamProtocolError{err})
+		}
+	}
+
+	var up *uploader
+
+	if resp == nil {
+		if err := heat.WriteRequestHeader(pc.w, req); err != nil {
+			return fail(err)
+		}
+		if err := pc.w.Flush(); err != nil {
+			return fail(err)
+		}
+
+		// Send the body while waiting for the response, as servers may
+		// answer before they've read all of it.
+		if size != 0 {
+			up = pc.upload(req.Body, size, interrupter(ctx))
+		}
+
+		// Read the response header, skipping any informational responses.
+		if pc.t.ResponseHeaderTimeout > 0 {
+			pc.conn.SetReadDeadline(time.Now().Add(pc.t.ResponseHeaderTimeout))
+		}
+		if resp, err = readFinalResponse(pc.r, &pc.t.Tolerate); err != nil {
+			if up != nil {
+				if up.done() && up.err != nil {
+					return fail(up.err)
+				}
+				up.stop()
+				up.wait()
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return fail(ErrResponseTimeout)
+			}
+			return fail(&UpstreamProtocolError{err})
+		}
+		if pc.t.ResponseHeaderTimeout > 0 {
+			pc.conn.SetReadDeadline(time.Time{})
+		}
+	}
+
+	closing := heat.Closing(resp.Major, resp.Minor, resp.Fields)
+
+	// A response arriving before the whole body has been sent means the
+	// server doesn't want the rest, unless it's accepting the request while
+	// still reading. Stop sending in the former case; the connection can't
+	// be reused, as the request's framing is incomplete.
+	if up != nil && !up.done() && (resp.Status >= 300 || resp.Status == 101 || closing) {
+		up.stop()
+		up.wait()
+		closing = true
+	}
+
+	// Hand over the connection itself when switching protocols.
+	if resp.Status == 101 && !closing {
+		resp.Body = &upgradedConn{pc}
+		return resp, nil
+	}
+
+	size, err = heat.ResponseBodySize(resp, req.Method)
+	if err != nil {
+		if up != nil {
+			up.stop()
+			up.wait()
+		}
+		return fail(&UpstreamProtocolError{err})
+	}
+
+	reuse := size != heat.Unbounded && !closing &&
+		!heat.Closing(req.Major, req.Minor, req.Fields)
+
+	body := &transportBody{pc: pc, reuse: reuse, stop: stop, up: up}
+	if pc.t.BodyTimeout > 0 {
+		body.deadline = time.Now().Add(pc.t.BodyTimeout)
+	}
+
+	if size == 0 {
+		body.finish(true)
+		return resp, nil
+	}
+
+	if body.r, err = heat.OpenBody(pc.r, size); err != nil {
+		if up != nil {
+			up.stop()
+			up.wait()
+		}
+		return fail(&UpstreamProtocolError{err})
+	}
+
+	resp.Body = body
+	return resp, nil
+}
+
+// authenticate performs an NTLM handshake with the parent proxy. The
+// handshake is carried by req itself if it has no body, in which case the
+// response to it is returned. Otherwise a HEAD request for the same URI is
+// used in its place, and nil is returned.
+func (pc *persistConn) authenticate(req *heat.Request) (*heat.Response, error) {
+	probe := req
+	if req.Body != nil {
+		probe = heat.NewRequest("HEAD", req.URI)
+		probe.Major, probe.Minor = 1, 1
+		if host, ok := fieldValue(req.Fields, "Host"); ok {
+			probe.Fields.Set("Host", host)
+		}
+	}
+
+	resp, err := ntlmHandshake(pc.r, pc.w, probe, pc.t.Proxy.User)
+	if err != nil {
+		return nil, err
+	}
+
+	pc.authed = resp.Status != 407
+	if probe == req {
+		return resp, nil
+	}
+
+	if !pc.authed {
+		return nil, errors.New("parent proxy rejected the NTLM credentials")
+	}
+	if heat.Closing(resp.Major, resp.Minor, resp.Fields) {
+		return nil, errors.New("parent proxy closed the connection after NTLM authentication")
+	}
+
+	return nil, nil
+}
+
+// The transportBody type wraps the body of a response read by a Transport,
+// releasing the connection once it's done.
+type transportBody struct {
+	pc    *persistConn
+	r     io.Reader
+	reuse bool
+	stop  func() bool
+	up    *uploader
+	done  bool
+
+	// When reading the body must be done by, if ever.
+	deadline time.Time
+
+	// Guards done against abort.
+	mu      sync.Mutex
+	aborted bool
+}
+
+func (b *transportBody) Read(buf []byte) (int, error) {
+	if b.done {
+		return 0, errReadAfterClose
+	}
+
+	timed := b.setDeadline()
+
+	n, err := b.r.Read(buf)
+	if err != nil {
+		if timed && errors.Is(err, os.ErrDeadlineExceeded) {
+			err = ErrBodyTimeout
+		}
+		b.finish(err == io.EOF)
+	}
+
+	return n, err
+}
+
+// setDeadline sets the connection's read deadline for the next read from
+// the body, reporting whether there is one.
+func (b *transportBody) setDeadline() bool {
+	deadline := b.deadline
+	if idle := b.pc.t.BodyIdleTimeout; idle > 0 {
+		if d := time.Now().Add(idle); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	if deadline.IsZero() {
+		return false
+	}
+	b.pc.conn.SetReadDeadline(deadline)
+	return true
+}
+
+func (b *transportBody) Close() error {
+	if !b.done {
+		b.finish(false)
+	}
+	return nil
+}
+
+// abort interrupts a read in progress by closing the connection, unless the
+// body has already been finished. Unlike the other methods, it may be called
+// concurrently with Read.
+func (b *transportBody) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.done {
+		b.aborted = true
+		b.pc.conn.Close()
+	}
+}
+
+// finish returns the connection to the idle pool if the whole body was read
+// and the connection can be reused, and closes it otherwise. A request body
+// still being sent is waited for, or abandoned if the response wasn't read
+// in full.
+func (b *transportBody) finish(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.done = true
+	ok = ok && !b.aborted
+
+	if b.up != nil {
+		if !ok {
+			b.up.stop()
+		}
+		ok = b.up.wait() == nil && ok
+	}
+
+	if b.stop() && ok && b.reuse {
+		b.pc.conn.SetReadDeadline(time.Time{})
+		b.pc.t.putIdle(b.pc)
+	} else {
+		b.pc.conn.Close()
+	}
+}
+
+var errUploadStopped = errors.New("relay: upload stopped")
+
+// An uploader sends a request body upstream in the background, so that the
+// response can be read as soon as it arrives.
+type uploader struct {
+	pc        *persistConn
+	interrupt func()
+	halt      int32
+	ch        chan error
+	err       error
+	over      bool
+}
+
+// upload starts sending a request body over the connection. If interrupt
+// is non-nil, it interrupts a read of the body in progress.
+func (pc *persistConn) upload(body io.Reader, size heat.BodySize, interrupt func()) *uploader {
+	u := &uploader{pc: pc, interrupt: interrupt, ch: make(chan error, 1)}
+
+	go func() {
+		err := heat.WriteBody(pc.w, haltReader{body, &u.halt}, size)
+		if err == nil {
+			err = pc.w.Flush()
+		}
+		u.ch <- err
+	}()
+
+	return u
+}
+
+// done reports whether the upload has ended.
+func (u *uploader) done() bool {
+	if !u.over {
+		select {
+		case u.err = <-u.ch:
+			u.over = true
+		default:
+		}
+	}
+	return u.over
+}
+
+// wait waits for the upload to end, returning its error.
+func (u *uploader) wait() error {
+	if !u.over {
+		u.err, u.over = <-u.ch, true
+	}
+	return u.err
+}
+
+// stop makes the upload end as soon as possible, without reading any more
+// of the body, and interrupting a read in progress. The connection is left
+// in an unusable state.
+func (u *uploader) stop() {
+	atomic.StoreInt32(&u.halt, 1)
+	u.pc.conn.SetWriteDeadline(time.Unix(1, 0))
+	if u.interrupt != nil && !u.done() {
+		u.interrupt()
+	}
+}
+
+// The haltReader type stops reading from its underlying reader once halt
+// has been set.
+type haltReader struct {
+	r    io.Reader
+	halt *int32
+}
+
+func (r haltReader) Read(buf []byte) (int, error) {
+	if atomic.LoadInt32(r.halt) != 0 {
+		return 0, errUploadStopped
+	}
+	return r.r.Read(buf)
+}
+
+// The upgradedConn type gives access to an upstream connection after it has
+// switched protocols.
+type upgradedConn struct {
+	pc *persistConn
+}
+
+func (c *upgradedConn) Read(buf []byte) (int, error) {
+	return c.pc.r.Read(buf)
+}
+
+func (c *upgradedConn) Write(buf []byte) (int, error) {
+	return c.pc.conn.Write(buf)
+}
+
+func (c *upgradedConn) Close() error {
+	return c.pc.conn.Close()
+}
+
+func (c *upgradedConn) CloseWrite() error {
+	if cw, ok := c.pc.conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.pc.conn.Close()
+}
+
+// withPort adds the scheme's default port to a host address without one.
+func withPort(host, scheme string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil || strings.HasPrefix(host, "unix:") {
+		return host
+	}
+
+	port := "80"
+	switch scheme {
+	case "https":
+		port = "443"
+	case "ftp":
+		port = "21"
+	}
+
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
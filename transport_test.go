@@ -0,0 +1,182 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestUnixSockets(t *testing.T) {
+	dir := t.TempDir()
+
+	// An upstream server listening on a UNIX domain socket, like Docker's.
+	ul, err := net.Listen("unix", dir+"/docker.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ul.Close()
+
+	go http.Serve(ul, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+r.URL.Path)
+	}))
+
+	p := &relay.Proxy{
+		Transport: &relay.Transport{
+			UnixSockets: map[string]string{"docker.local": dir + "/docker.sock"},
+		},
+	}
+
+	// The proxy itself listens on a UNIX domain socket too.
+	l, err := relay.Listen("unix:" + dir + "/relay.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go p.ServeListener(l, nil)
+
+	conn, err := net.Dial("unix", dir+"/relay.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET http://docker.local/v1.43/info HTTP/1.1\r\nHost: docker.local\r\n\r\n")
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != 200 || string(body) != "docker.local/v1.43/info" {
+		t.Errorf("got status %d with body %q", resp.StatusCode, body)
+	}
+}
+
+func TestExpectContinueEarlyResponse(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		if req.Header.Get("Expect") != "" {
+			t.Errorf("Expect was forwarded: %q", req.Header.Get("Expect"))
+		}
+		io.WriteString(conn, "HTTP/1.1 417 Expectation Failed\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	conn := serve(t, &relay.Proxy{})
+	io.WriteString(conn, "POST http://"+addr+"/upload HTTP/1.1\r\n"+
+		"Host: "+addr+"\r\n"+
+		"Content-Length: 1024\r\n"+
+		"Expect: 100-continue\r\n\r\n")
+
+	// The body is never sent.
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+	if resp.StatusCode != 417 {
+		t.Fatalf("got status %d, want 417", resp.StatusCode)
+	}
+	if !resp.Close {
+		t.Errorf("connection kept alive with the request body unread")
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+string(body))
+	})
+
+	conn := serve(t, &relay.Proxy{})
+	r := bufio.NewReader(conn)
+	io.WriteString(conn, "POST http://"+addr+"/ HTTP/1.1\r\n"+
+		"Host: "+addr+"\r\n"+
+		"Content-Length: 5\r\n"+
+		"Expect: 100-continue\r\n\r\n")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 100 {
+		t.Fatalf("got status %d, want 100", resp.StatusCode)
+	}
+
+	io.WriteString(conn, "hello")
+
+	resp = readFinal(t, conn, r)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || string(body) != "hello" {
+		t.Fatalf("got %d %q, want 200 \"hello\"", resp.StatusCode, body)
+	}
+}
+
+func TestExpectUnknown(t *testing.T) {
+	conn := serve(t, &relay.Proxy{})
+	io.WriteString(conn, "POST http://example.com/ HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Content-Length: 5\r\n"+
+		"Expect: something-else\r\n\r\n")
+
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+	if resp.StatusCode != 417 {
+		t.Fatalf("got status %d, want 417", resp.StatusCode)
+	}
+}
+
+func TestTransportTimeouts(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		switch req.URL.Path {
+		case "/slow-header":
+			time.Sleep(300 * time.Millisecond)
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		case "/stall":
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello")
+			time.Sleep(300 * time.Millisecond)
+			io.WriteString(conn, "world")
+		case "/trickle":
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n")
+			for _, c := range "helloworld" {
+				time.Sleep(30 * time.Millisecond)
+				io.WriteString(conn, string(c))
+			}
+		}
+	})
+
+	for i, tt := range []struct {
+		tr   *relay.Transport
+		path string
+		body string
+		err  error
+	}{
+		{&relay.Transport{ResponseHeaderTimeout: 100 * time.Millisecond}, "/slow-header", "", relay.ErrResponseTimeout},
+		{&relay.Transport{ResponseHeaderTimeout: 100 * time.Millisecond}, "/trickle", "helloworld", nil},
+
+		// Bodies may take long, as long as they keep coming.
+		{&relay.Transport{BodyIdleTimeout: 100 * time.Millisecond}, "/stall", "hello", relay.ErrBodyTimeout},
+		{&relay.Transport{BodyIdleTimeout: 100 * time.Millisecond}, "/trickle", "helloworld", nil},
+		{&relay.Transport{BodyTimeout: 150 * time.Millisecond}, "/trickle", "hel", relay.ErrBodyTimeout},
+	} {
+		req := heat.NewRequest("GET", tt.path)
+		req.Scheme, req.Remote = "http", addr
+		req.Fields.Set("Host", addr)
+
+		resp, err := tt.tr.RoundTripContext(context.Background(), req)
+		var body []byte
+		if err == nil {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		// Timed out bodies may have been cut short a little later than
+		// expected, but not after they were complete.
+		cut := tt.err != nil && len(body) < 10
+		if !errors.Is(err, tt.err) || !strings.HasPrefix(string(body), tt.body) || (tt.err == nil) == cut {
+			t.Errorf("%d, %s: got %q, %v, want %q, %v", i, tt.path, body, err, tt.body, tt.err)
+		}
+	}
+}
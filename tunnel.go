@@ -0,0 +1,235 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/xo"
+)
+
+// tunnel serves a CONNECT request by opening an opaque tunnel to the
+// requested address, without intercepting its contents.
+func (p *Proxy) tunnel(s *Session, conn net.Conn, rw xo.ReadWriter, req *heat.Request) error {
+	upstream, err := p.dialOpaque(s, req.URI)
+	if err != nil {
+		resp := p.errorResponse(s, req, err)
+		return writeLast(rw, resp, req.Method)
+	}
+
+	// Grab the currently buffered data.
+	peek, err := rw.Peek(0)
+	if err != nil {
+		upstream.Close()
+		return &ClientAbort{err}
+	}
+
+	if len(peek) > 0 {
+		conn = &prefixed{conn, peek}
+	}
+
+	// Indicate that the tunnel is ready.
+	if _, err = rw.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")); err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		upstream.Close()
+		return &ClientAbort{err}
+	}
+
+	p.label(hostname(req.URI), phaseTunnel)
+	return splice(conn, upstream)
+}
+
+// dialOpaque connects to the upstream end of an opaque tunnel to addr,
+// wrapped for metering and throttling as needed.
+func (p *Proxy) dialOpaque(s *Session, addr string) (io.ReadWriteCloser, error) {
+	ctx := p.egressTunnel(context.Background(), s, addr)
+	if err := p.checkGuard(ctx, s, nil, addr); err != nil {
+		return nil, err
+	}
+
+	rate, err := p.checkQuota(s, nil, addr)
+	if err == nil {
+		rate, err = p.checkUser(s, nil, addr, rate)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	upstream, err := p.transport().dialTunnel(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tell the upstream server who the client is.
+	if p.SendProxyProtocol {
+		if err := writeProxyHeader(upstream, s.ClientAddr, upstream.RemoteAddr()); err != nil {
+			upstream.Close()
+			return nil, &DialError{addr, err}
+		}
+	}
+
+	rwc := p.meter(s, addr, upstream)
+	if rate > 0 {
+		rwc = p.throttleConn(rwc, rate)
+	}
+
+	shaping, err := p.shape(ctx, s, nil, addr)
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	if shaping != nil {
+		rwc = shaping.shapeConn(p, rwc)
+	}
+
+	return rwc, nil
+}
+
+// upgrade takes over a client connection after a "101 Switching Protocols"
+// response, relaying data between it and the upstream connection stored in
+// the response's body. WebSocket messages are passed through
+// p.OnWebSocketMessage, and recorded in p.Flows, if set.
+func (p *Proxy) upgrade(s *Session, conn net.Conn, rw xo.ReadWriter, req *heat.Request, resp *heat.Response) error {
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp := statusResponse(502, "Protocol upgrade without an upstream connection.")
+		return writeLast(rw, resp, "")
+	}
+
+	// Write the response header, but leave the body alone.
+	resp.Body = nil
+
+	if err := heat.WriteResponseHeader(rw, resp); err != nil {
+		upstream.Close()
+		return &ClientAbort{err}
+	}
+	if err := rw.Flush(); err != nil {
+		upstream.Close()
+		return &ClientAbort{err}
+	}
+
+	// The client may already have sent data using the new protocol.
+	peek, err := rw.Peek(0)
+	if err != nil {
+		upstream.Close()
+		return &ClientAbort{err}
+	}
+
+	if len(peek) > 0 {
+		conn = &prefixed{conn, peek}
+	}
+
+	p.label(hostname(req.Remote), phaseTunnel)
+
+	if (p.OnWebSocketMessage != nil || s.upgraded != nil) && isWebSocket(resp.Fields) {
+		return p.relayWebSocket(s, req, conn, upstream)
+	}
+
+	return splice(conn, upstream)
+}
+
+// upgradeProtocol returns the value of a message's Upgrade header field, if
+// the message also lists "upgrade" as a connection option.
+func upgradeProtocol(fields heat.Fields) string {
+	var upgrade bool
+
+	fields.Split("Connection", ',', func(s string) bool {
+		upgrade = strings.EqualFold(strings.TrimSpace(s), "upgrade")
+		return !upgrade
+	})
+
+	if upgrade {
+		if value, ok := fieldValue(fields, "Upgrade"); ok {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// The closeWriter interface is implemented by connections supporting
+// half-closes, like *net.TCPConn and *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// splice copies data in both directions between a and b. When one direction
+// reaches EOF, the write side of its destination is shut down, leaving the
+// other direction running until it's done too. If either direction fails,
+// both connections are aborted immediately.
+func splice(a, b io.ReadWriteCloser) error {
+	return spliceWith(a, b, io.Copy, io.Copy)
+}
+
+// A copyFunc copies data from src to dst until src reaches EOF.
+type copyFunc func(dst io.Writer, src io.Reader) (int64, error)
+
+// spliceWith is like splice, copying data from a to b with aToB, and from b
+// to a with bToA.
+func spliceWith(a, b io.ReadWriteCloser, aToB, bToA copyFunc) error {
+	errc := make(chan error, 2)
+
+	go pipe(a, b, bToA, errc)
+	go pipe(b, a, aToB, errc)
+
+	var first error
+
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil && first == nil {
+			first = err
+			abort(a)
+			abort(b)
+		}
+	}
+
+	a.Close()
+	b.Close()
+
+	return first
+}
+
+// pipe copies data from src to dst, propagating a clean EOF as a half-close
+// when dst supports it.
+func pipe(dst io.ReadWriteCloser, src io.Reader, copyData copyFunc, errc chan<- error) {
+	_, err := copyData(dst, src)
+	if err == nil {
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	errc <- err
+}
+
+// abort closes a connection, discarding any unsent data. For TCP connections
+// this causes a reset to be sent to the peer.
+func abort(c io.Closer) {
+	if tc, ok := underlying(c).(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.Close()
+}
+
+// underlying strips away the proxy's own connection wrappers.
+func underlying(c io.Closer) io.Closer {
+	for {
+		switch w := c.(type) {
+		case *prefixed:
+			c = w.Conn
+		case *proxiedConn:
+			c = w.Conn
+		case *meteredConn:
+			c = w.ReadWriteCloser
+		case *throttledConn:
+			c = w.ReadWriteCloser
+		default:
+			return c
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package relay_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/erkl/relay"
+)
+
+// rawUpstream starts a TCP server handing its first connection to handle,
+// and returns its address.
+func rawUpstream(t *testing.T, handle func(conn *net.TCPConn)) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		handle(conn.(*net.TCPConn))
+		conn.Close()
+	}()
+
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+
+	return l.Addr().String()
+}
+
+// openTunnel sends a CONNECT request for addr through a proxy relaying
+// tunnels opaquely, and returns the client's end of the tunnel.
+func openTunnel(t *testing.T, addr string) (*net.TCPConn, *bufio.Reader) {
+	t.Helper()
+
+	conn := serveTCP(t, &relay.Proxy{
+		RoundTrip: roundTrip,
+		Intercept: func(s *relay.Session, addr string) bool { return false },
+	})
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	if resp := readFinal(t, conn, r); resp.StatusCode != 200 {
+		t.Fatalf("CONNECT %s: got status %d", addr, resp.StatusCode)
+	}
+
+	return conn, r
+}
+
+func TestTunnelHalfClose(t *testing.T) {
+	addr := rawUpstream(t, func(conn *net.TCPConn) {
+		// Only answer once the client is done sending.
+		buf, err := io.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, "got "+string(buf))
+	})
+
+	conn, r := openTunnel(t, addr)
+	io.WriteString(conn, "hello")
+	conn.CloseWrite()
+
+	buf, err := io.ReadAll(r)
+	if err != nil || string(buf) != "got hello" {
+		t.Fatalf("got %q (%v), want %q", buf, err, "got hello")
+	}
+}
+
+func TestTunnelAbort(t *testing.T) {
+	addr := rawUpstream(t, func(conn *net.TCPConn) {
+		buf := make([]byte, 5)
+		io.ReadFull(conn, buf)
+
+		// Reset the connection rather than close it cleanly.
+		conn.SetLinger(0)
+	})
+
+	conn, r := openTunnel(t, addr)
+	io.WriteString(conn, "hello")
+
+	if _, err := io.ReadAll(r); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("got error %v, want a connection reset", err)
+	}
+}
@@ -0,0 +1,248 @@
+package relay
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/erkl/heat"
+)
+
+// A UsageRecorder is told how many bytes are transferred between clients and
+// upstream hosts, such as for enforcing quotas. Implementations must be safe
+// for concurrent use.
+type UsageRecorder interface {
+	// RecordUsage is called repeatedly as data is transferred, with the
+	// number of bytes sent by the client to host, and received from host,
+	// since the last call.
+	RecordUsage(s *Session, host string, sent, received int64)
+}
+
+// A Usage describes the amount of data transferred between a client and an
+// upstream host.
+type Usage struct {
+	Client   string
+	Host     string
+	Sent     int64
+	Received int64
+}
+
+// A UsageMeter is a UsageRecorder which keeps running totals in memory. It's
+// safe for concurrent use.
+type UsageMeter struct {
+	// Optional function identifying the client of a session. Defaults to
+	// s.User if set, and the IP address in s.ClientAddr otherwise.
+	Identify func(s *Session) string
+
+	mu    sync.Mutex
+	usage map[[2]string]*Usage
+}
+
+// RecordUsage adds to the totals of a session's client and host.
+func (m *UsageMeter) RecordUsage(s *Session, host string, sent, received int64) {
+	client := ""
+	if m.Identify != nil {
+		client = m.Identify(s)
+	} else if s.User != "" {
+		client = s.User
+	} else if s.ClientAddr != nil {
+		client = hostname(s.ClientAddr.String())
+	}
+
+	key := [2]string{client, host}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.usage[key]
+	if u == nil {
+		if m.usage == nil {
+			m.usage = make(map[[2]string]*Usage)
+		}
+		u = &Usage{Client: client, Host: host}
+		m.usage[key] = u
+	}
+
+	u.Sent += sent
+	u.Received += received
+}
+
+// Lookup returns the totals of a client and host. If host is empty, the
+// client's totals across all hosts are returned instead.
+func (m *UsageMeter) Lookup(client, host string) Usage {
+	total := Usage{Client: client, Host: host}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, u := range m.usage {
+		if u.Client == client && (host == "" || u.Host == host) {
+			total.Sent += u.Sent
+			total.Received += u.Received
+		}
+	}
+
+	return total
+}
+
+// Snapshot returns the totals of every client and host seen, ordered by
+// client and host.
+func (m *UsageMeter) Snapshot() []Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.snapshot()
+}
+
+// Reset is like Snapshot, but also resets all totals to zero. It's useful
+// for periodically exporting usage elsewhere.
+func (m *UsageMeter) Reset() []Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	list := m.snapshot()
+	m.usage = nil
+
+	return list
+}
+
+func (m *UsageMeter) snapshot() []Usage {
+	list := make([]Usage, 0, len(m.usage))
+	for _, u := range m.usage {
+		list = append(list, *u)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Client != list[j].Client {
+			return list[i].Client < list[j].Client
+		}
+		return list[i].Host < list[j].Host
+	})
+
+	return list
+}
+
+// meterRequest records the size of a request's header, and makes sure the
+// bytes of its body are recorded as they're sent.
+func (p *Proxy) meterRequest(s *Session, req *heat.Request) {
+	host := usageHost(req.Remote)
+	size := len(req.Method) + len(req.URI) + len("  HTTP/1.1\r\n")
+	p.recordUsage(s, host, int64(size+fieldsSize(req.Fields)), 0)
+
+	if req.Body != nil {
+		req.Body = &meteredBody{req.Body, func(n int64) {
+			p.recordUsage(s, host, n, 0)
+		}}
+	}
+}
+
+// meterResponse is like meterRequest, for a response. The bodies of "101
+// Switching Protocols" responses are metered in both directions.
+func (p *Proxy) meterResponse(s *Session, req *heat.Request, resp *heat.Response) {
+	host := usageHost(req.Remote)
+	size := len(resp.Reason) + len("HTTP/1.1 000 \r\n")
+	p.recordUsage(s, host, 0, int64(size+fieldsSize(resp.Fields)))
+
+	if resp.Body == nil {
+		return
+	}
+
+	if conn, ok := resp.Body.(io.ReadWriteCloser); ok && resp.Status == 101 {
+		resp.Body = p.meter(s, host, conn)
+		return
+	}
+
+	resp.Body = &meteredBody{resp.Body, func(n int64) {
+		p.recordUsage(s, host, 0, n)
+	}}
+}
+
+// meter wraps the upstream end of a tunnel to addr so that data passing
+// through it is recorded, if the proxy is metering.
+func (p *Proxy) meter(s *Session, addr string, upstream io.ReadWriteCloser) io.ReadWriteCloser {
+	if !p.metering() {
+		return upstream
+	}
+
+	host := usageHost(addr)
+
+	return &meteredConn{upstream, func(sent, received int64) {
+		p.recordUsage(s, host, sent, received)
+	}}
+}
+
+// metering reports whether the proxy needs to count transferred bytes.
+func (p *Proxy) metering() bool {
+	return p.Usage != nil || p.Quotas != nil
+}
+
+// recordUsage passes transferred byte counts on to p.Usage and p.Quotas.
+func (p *Proxy) recordUsage(s *Session, host string, sent, received int64) {
+	if p.Usage != nil {
+		p.Usage.RecordUsage(s, host, sent, received)
+	}
+	if p.Quotas != nil {
+		p.Quotas.RecordUsage(s, host, sent, received)
+	}
+}
+
+// usageHost returns the host under which transfers to addr are recorded.
+func usageHost(addr string) string {
+	return strings.ToLower(hostname(addr))
+}
+
+// fieldsSize returns the number of bytes a set of header fields takes up on
+// the wire, including the empty line which ends the header.
+func fieldsSize(fields heat.Fields) int {
+	n := len("\r\n")
+	for _, f := range fields {
+		n += len(f.Name) + len(f.Value) + len(": \r\n")
+	}
+	return n
+}
+
+// The meteredBody type reports the number of bytes read from a message body.
+type meteredBody struct {
+	io.ReadCloser
+	add func(n int64)
+}
+
+func (b *meteredBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	if n > 0 {
+		b.add(int64(n))
+	}
+	return n, err
+}
+
+// The meteredConn type reports the number of bytes written to and read from
+// the upstream end of a tunnel.
+type meteredConn struct {
+	io.ReadWriteCloser
+	add func(sent, received int64)
+}
+
+func (c *meteredConn) Read(buf []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(buf)
+	if n > 0 {
+		c.add(0, int64(n))
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(buf []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(buf)
+	if n > 0 {
+		c.add(int64(n), 0)
+	}
+	return n, err
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, if
+// supported.
+func (c *meteredConn) CloseWrite() error {
+	if cw, ok := c.ReadWriteCloser.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.ReadWriteCloser.Close()
+}
@@ -0,0 +1,93 @@
+package relay_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+func TestUsageMeter(t *testing.T) {
+	m := new(relay.UsageMeter)
+
+	alice := &relay.Session{User: "alice"}
+	anon := &relay.Session{ClientAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}}
+
+	m.RecordUsage(alice, "example.com", 10, 100)
+	m.RecordUsage(alice, "example.com", 5, 50)
+	m.RecordUsage(alice, "example.org", 1, 2)
+	m.RecordUsage(anon, "example.com", 7, 0)
+
+	// Clients are identified by user name, or else address.
+	if u := m.Lookup("alice", "example.com"); u.Sent != 15 || u.Received != 150 {
+		t.Errorf("got %+v for alice at example.com", u)
+	}
+	if u := m.Lookup("alice", ""); u.Sent != 16 || u.Received != 152 {
+		t.Errorf("got %+v for alice in total", u)
+	}
+	if u := m.Lookup("192.0.2.1", "example.com"); u.Sent != 7 {
+		t.Errorf("got %+v for an anonymous client", u)
+	}
+
+	want := "[{192.0.2.1 example.com 7 0} {alice example.com 15 150} {alice example.org 1 2}]"
+	if got := fmt.Sprint(m.Snapshot()); got != want {
+		t.Errorf("got snapshot %s, want %s", got, want)
+	}
+
+	// Resetting returns the totals one last time.
+	if got := fmt.Sprint(m.Reset()); got != want {
+		t.Errorf("got %s when resetting, want %s", got, want)
+	}
+	if list := m.Snapshot(); len(list) != 0 {
+		t.Errorf("got %v after resetting", list)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 11\r\n\r\nhello world")
+	})
+	echo := rawUpstream(t, func(conn *net.TCPConn) {
+		buf := make([]byte, 4)
+		io.ReadFull(conn, buf)
+		io.WriteString(conn, "pong!")
+	})
+
+	m := &relay.UsageMeter{Identify: func(s *relay.Session) string { return "client" }}
+	p := &relay.Proxy{
+		Usage:     m,
+		Intercept: func(s *relay.Session, addr string) bool { return false },
+	}
+
+	// Forwarded messages count with their headers and bodies.
+	conn := serve(t, p)
+	io.WriteString(conn, "POST http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\nContent-Length: 100\r\n\r\n")
+	io.WriteString(conn, fmt.Sprintf("%0100d", 0))
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+	io.ReadAll(resp.Body)
+
+	if u := m.Lookup("client", "127.0.0.1"); u.Sent <= 100 || u.Received <= 11 || u.Received > 100 {
+		t.Errorf("got %+v for a 100 byte request and 11 byte response", u)
+	}
+	m.Reset()
+
+	// Tunnels count the bytes passing through them.
+	conn = serve(t, p)
+	io.WriteString(conn, "CONNECT "+echo+" HTTP/1.1\r\nHost: "+echo+"\r\n\r\n")
+	r := bufio.NewReader(conn)
+	readFinal(t, conn, r)
+
+	io.WriteString(conn, "ping")
+	if buf, _ := io.ReadAll(r); string(buf) != "pong!" {
+		t.Fatalf("got %q through the tunnel", buf)
+	}
+
+	if u := m.Lookup("client", "127.0.0.1"); u.Sent != 4 || u.Received != 5 {
+		t.Errorf("got %+v for a tunnel, want 4 bytes sent and 5 received", u)
+	}
+}
@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"strconv"
+
+	"github.com/erkl/heat"
+)
+
+// A UserPolicy holds settings bound to an authenticated user, taking
+// precedence over the proxy's own where they overlap.
+type UserPolicy struct {
+	// Destinations the user may reach, and may not reach. Requests and
+	// tunnels outside Allow (if non-nil), or inside Deny (if non-nil), are
+	// answered with "403 Forbidden". For tunnels, only host and client
+	// conditions are considered.
+	Allow *Match
+	Deny  *Match
+
+	// If positive, the user's transfers are limited to this many bytes per
+	// second each.
+	Rate int64
+
+	// Optional function deciding whether the user's tunnels should be
+	// intercepted, in place of Proxy.Intercept.
+	Intercept func(s *Session, addr string) bool
+}
+
+// A UserDirectory looks up the policies bound to authenticated users, such
+// as from an LDAP directory or a configuration file.
+type UserDirectory interface {
+	// Policy returns the policy of the user authenticated in s (see
+	// Session.User and Session.Claims), or nil if the proxy's defaults
+	// should apply.
+	Policy(s *Session) (*UserPolicy, error)
+}
+
+// UserPolicies is a UserDirectory with a fixed policy per user name. The
+// policy stored under "*" applies to users without one of their own.
+type UserPolicies map[string]*UserPolicy
+
+// Policy implements UserDirectory.
+func (m UserPolicies) Policy(s *Session) (*UserPolicy, error) {
+	if pol, ok := m[s.User]; ok {
+		return pol, nil
+	}
+	return m["*"], nil
+}
+
+// userPolicy returns the policy bound to a session's user, if any, looking
+// it up the first time it's needed.
+func (p *Proxy) userPolicy(s *Session) (*UserPolicy, error) {
+	if p.Users == nil || s.User == "" {
+		return nil, nil
+	}
+
+	if s.policyUser != s.User {
+		pol, err := p.Users.Policy(s)
+		if err != nil {
+			return nil, err
+		}
+		s.policy, s.policyUser = pol, s.User
+	}
+
+	return s.policy, nil
+}
+
+// checkUser applies the policy bound to a session's user to a request (or,
+// if req is nil, a tunnel) to addr. It returns the rate its transfers should
+// be throttled to, given the rate imposed so far (zero meaning none), or an
+// error if it should be refused.
+func (p *Proxy) checkUser(s *Session, req *heat.Request, addr string, rate int64) (int64, error) {
+	pol, err := p.userPolicy(s)
+	if err != nil || pol == nil {
+		return rate, err
+	}
+
+	match := func(m *Match) bool {
+		if req != nil {
+			return m.Request(s, req)
+		}
+		return m.Connect(s, addr)
+	}
+
+	var denied *Match
+	if pol.Allow != nil && !match(pol.Allow) {
+		denied = pol.Allow
+	} else if pol.Deny != nil && match(pol.Deny) {
+		denied = pol.Deny
+	}
+
+	if denied != nil {
+		err := &PolicyDenied{s.User + " may not access " + hostname(addr)}
+		p.decideDeny(s, req, addr, "Users", denied, err)
+		return 0, err
+	}
+
+	if pol.Allow != nil {
+		p.decide(s, req, addr, &DecisionRecord{Action: "allow", Rule: "Users", Pattern: pol.Allow.String()})
+	}
+
+	if pol.Rate > 0 && (rate == 0 || pol.Rate < rate) {
+		rate = pol.Rate
+		p.decide(s, req, addr, &DecisionRecord{
+			Action: "throttle",
+			Rule:   "Users",
+			Reason: "limited to " + strconv.FormatInt(rate, 10) + " bytes/s",
+		})
+	}
+
+	return rate, nil
+}
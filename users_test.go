@@ -0,0 +1,153 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+// The countingDirectory type is a UserDirectory counting its lookups.
+type countingDirectory struct {
+	relay.UserPolicies
+
+	mu      sync.Mutex
+	lookups map[string]int
+}
+
+func (d *countingDirectory) Policy(s *relay.Session) (*relay.UserPolicy, error) {
+	d.mu.Lock()
+	d.lookups[s.User]++
+	d.mu.Unlock()
+	return d.UserPolicies.Policy(s)
+}
+
+func (d *countingDirectory) count(user string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lookups[user]
+}
+
+func TestUserPolicies(t *testing.T) {
+	origin, err := (&relay.Matcher{Hosts: []string{"origin.test"}}).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := &countingDirectory{
+		UserPolicies: relay.UserPolicies{
+			"alice": {Allow: origin, Rate: 1000},
+			"*":     {Deny: origin},
+		},
+		lookups: make(map[string]int),
+	}
+
+	p := &relay.Proxy{
+		Auth:  &relay.ProxyAuth{Basic: func(user, password string) bool { return password == "secret" }},
+		Users: dir,
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Content-Length", "250")
+			resp.Body = io.NopCloser(strings.NewReader(strings.Repeat("x", 250)))
+			return resp, nil
+		},
+	}
+
+	for _, tt := range []struct {
+		user   string
+		host   string
+		status int
+	}{
+		{"alice", "origin.test", 200},
+		{"alice", "other.test", 403},
+		{"bob", "origin.test", 403},
+		{"bob", "other.test", 200},
+	} {
+		conn := serve(t, p)
+		r := bufio.NewReader(conn)
+
+		// The second request is sent without credentials, relying on the
+		// session being authenticated.
+		for i, auth := range []string{"Proxy-Authorization: " + basic(tt.user, "secret") + "\r\n", ""} {
+			start := time.Now()
+			io.WriteString(conn, "GET http://"+tt.host+"/ HTTP/1.1\r\nHost: "+tt.host+"\r\n"+auth+"\r\n")
+			resp := readFinal(t, conn, r)
+			io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("%s, %s (request %d): got status %d, want %d", tt.user, tt.host, i+1, resp.StatusCode, tt.status)
+			}
+
+			// Alice's 250 bytes are relayed at 1000 bytes per second.
+			if d := time.Since(start); tt.user == "alice" && tt.status == 200 && d < 200*time.Millisecond {
+				t.Errorf("%s, %s: response took %v, want it throttled", tt.user, tt.host, d)
+			}
+		}
+
+		conn.Close()
+	}
+
+	// Policies are looked up once per session.
+	if a, b := dir.count("alice"), dir.count("bob"); a != 2 || b != 2 {
+		t.Errorf("got %d and %d lookups, want 2 each", a, b)
+	}
+}
+
+func TestUserPolicyTunnel(t *testing.T) {
+	origin, err := (&relay.Matcher{Hosts: []string{"origin.test"}}).Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := rawUpstream(t, func(conn *net.TCPConn) {
+		io.WriteString(conn, "hi")
+	})
+
+	intercepted := make(chan string, 1)
+	p := &relay.Proxy{
+		Auth: &relay.ProxyAuth{Basic: func(user, password string) bool { return true }},
+		Users: relay.UserPolicies{
+			"alice": {Intercept: func(s *relay.Session, addr string) bool {
+				intercepted <- addr
+				return false
+			}},
+			"bob": {Deny: origin},
+		},
+	}
+
+	connect := func(user, addr string) (*http.Response, *bufio.Reader, net.Conn) {
+		conn := serve(t, p)
+		r := bufio.NewReader(conn)
+		io.WriteString(conn, "CONNECT "+addr+" HTTP/1.1\r\nHost: "+addr+"\r\n"+
+			"Proxy-Authorization: "+basic(user, "x")+"\r\n\r\n")
+		return readFinal(t, conn, r), r, conn
+	}
+
+	// Alice's own Intercept function decides to leave her tunnel alone.
+	resp, r, conn := connect("alice", addr)
+	if resp.StatusCode != 200 {
+		t.Fatalf("alice: got status %d", resp.StatusCode)
+	}
+	if got := <-intercepted; got != addr {
+		t.Errorf("Intercept called for %q, want %q", got, addr)
+	}
+	if buf, _ := io.ReadAll(io.LimitReader(r, 2)); string(buf) != "hi" {
+		t.Errorf("got %q through the tunnel", buf)
+	}
+	conn.Close()
+
+	// Bob may not connect to origin.test.
+	resp, _, conn = connect("bob", "origin.test:443")
+	if resp.StatusCode != 403 {
+		t.Errorf("bob: got status %d, want 403", resp.StatusCode)
+	}
+	conn.Close()
+}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/erkl/heat"
 	"github.com/erkl/xo"
@@ -29,16 +30,17 @@ func statusResponse(status int, format string, args ...interface{}) *heat.Respon
 	return resp
 }
 
-// readRequest reads an HTTP request.
-func readRequest(r xo.Reader) (*heat.Request, *bodyReader, error) {
-	req, err := heat.ReadRequestHeader(r)
+// readRequest reads an HTTP request, repairing the protocol violations t
+// tolerates, and returning the names of those found.
+func readRequest(r xo.Reader, t *Tolerance) (*heat.Request, *bodyReader, []string, error) {
+	req, repairs, err := readRequestHeader(r, t)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	size, err := heat.RequestBodySize(req)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	var body *bodyReader
@@ -49,7 +51,14 @@ func readRequest(r xo.Reader) (*heat.Request, *bodyReader, error) {
 		req.Body = body
 	}
 
-	return req, body, nil
+	return req, body, repairs, nil
+}
+
+// writeLast writes the last response sent over a connection, telling the
+// client that the connection is about to be closed.
+func writeLast(w xo.Writer, resp *heat.Response, method string) error {
+	resp.Fields.Set("Connection", "close")
+	return writeResponse(w, resp, method)
 }
 
 // writeResponse writes an HTTP response.
@@ -60,9 +69,11 @@ func writeResponse(w xo.Writer, resp *heat.Response, method string) error {
 
 	size, err := heat.ResponseBodySize(resp, method)
 	if err != nil {
-		return err
+		return &UpstreamProtocolError{err}
 	}
 
+	// Send the response header on its way before touching the body, which
+	// may take a while to arrive.
 	if err = heat.WriteResponseHeader(w, resp); err != nil {
 		return err
 	}
@@ -71,34 +82,64 @@ func writeResponse(w xo.Writer, resp *heat.Response, method string) error {
 	}
 
 	if size != 0 {
-		if err = heat.WriteBody(w, resp.Body, size); err != nil {
-			return err
-		}
-		if err = w.Flush(); err != nil {
-			return err
-		}
+		return writeBody(w, resp.Body, size)
 	}
 
 	return nil
 }
 
+// writeBody copies a message body from r to w, flushing w whenever r might
+// block, so that the client receives data as soon as it's available.
+func writeBody(w xo.Writer, r io.Reader, size heat.BodySize) error {
+	if err := heat.WriteBody(w, &flushReader{r, w}, size); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// The flushReader type flushes a writer before every read from the wrapped
+// reader.
+type flushReader struct {
+	r io.Reader
+	w xo.Writer
+}
+
+func (fr *flushReader) Read(buf []byte) (int, error) {
+	if err := fr.w.Flush(); err != nil {
+		return 0, &ClientAbort{err}
+	}
+	return fr.r.Read(buf)
+}
+
 var errReadAfterClose = errors.New("relay: read after close")
 
-// The bodyReader type wraps the body of a request or response.
+// The bodyReader type wraps the body of a request or response. A request
+// body may still be read by a transport sending it upstream after the
+// response has arrived, so the persisted error is guarded by a mutex.
 type bodyReader struct {
 	r io.Reader
-	e error
+
+	mu sync.Mutex
+	e  error
 }
 
 func (br *bodyReader) Read(buf []byte) (int, error) {
-	if br.e != nil {
-		return 0, br.e
+	br.mu.Lock()
+	e := br.e
+	br.mu.Unlock()
+
+	if e != nil {
+		return 0, e
 	}
 
 	n, err := br.r.Read(buf)
 	if err != nil {
 		// Persist errors.
-		br.e = err
+		br.mu.Lock()
+		if br.e == nil {
+			br.e = err
+		}
+		br.mu.Unlock()
 
 		// If the call yielded any data, delay the error.
 		if n > 0 {
@@ -110,6 +151,9 @@ func (br *bodyReader) Read(buf []byte) (int, error) {
 }
 
 func (br *bodyReader) Close() error {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
 	if br.e != nil {
 		br.e = errReadAfterClose
 	}
@@ -117,6 +161,9 @@ func (br *bodyReader) Close() error {
 }
 
 func (br *bodyReader) LastError() error {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
 	if br.e == errReadAfterClose {
 		return nil
 	}
@@ -144,3 +191,37 @@ func (c *prefixed) Read(buf []byte) (int, error) {
 
 	return c.Conn.Read(buf)
 }
+
+// hostname strips any port number from a host address.
+func hostname(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, if
+// supported.
+func (c *prefixed) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// fieldValue returns the value of the first header field with a given name.
+func fieldValue(fields heat.Fields, name string) (string, bool) {
+	for _, f := range fields {
+		if f.Is(name) {
+			return f.Value, true
+		}
+	}
+	return "", false
+}
+
+// pipelined reports whether a client has already sent data beyond the
+// request being served, which means it's pipelining requests.
+func pipelined(r xo.Reader) bool {
+	buf, err := r.Peek(0)
+	return err == nil && len(buf) > 0
+}
@@ -0,0 +1,280 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+	"github.com/erkl/xo"
+)
+
+// upstream starts a server which answers every request on a connection by
+// calling handle with the connection and the request's header.
+func upstream(t *testing.T, handle func(conn net.Conn, r *bufio.Reader, req *http.Request)) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(r)
+					if err != nil {
+						return
+					}
+					handle(conn, r, req)
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// serve runs a session of p over an in-memory connection, returning the
+// client's end.
+func serve(t *testing.T, p *relay.Proxy) net.Conn {
+	t.Helper()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		p.Serve(server)
+		server.Close()
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+
+	return client
+}
+
+// readFinal reads responses from r until a final one arrives, failing the
+// test if that takes more than a few seconds.
+func readFinal(t *testing.T, conn net.Conn, r *bufio.Reader) *http.Response {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for {
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		if resp.StatusCode >= 200 {
+			return resp
+		}
+	}
+}
+
+// serveTCP runs a session of p over a loopback TCP connection, which unlike
+// an in-memory one can be half-closed and reset, returning the client's end.
+func serveTCP(t *testing.T, p *relay.Proxy) *net.TCPConn {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		p.Serve(conn)
+		conn.Close()
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+
+	return client.(*net.TCPConn)
+}
+
+// proxyClient serves p on a loopback listener, and returns an HTTP client
+// sending its requests through it.
+func proxyClient(t *testing.T, p *relay.Proxy) *http.Client {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				p.Serve(conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	tr := &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: l.Addr().String()})}
+	t.Cleanup(func() {
+		tr.CloseIdleConnections()
+		l.Close()
+	})
+
+	return &http.Client{Transport: tr}
+}
+
+// closedAddr returns an address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	return addr
+}
+
+// roundTrip sends a request over a new connection to the server it names,
+// standing in for a proper RoundTrip implementation.
+func roundTrip(req *heat.Request) (*heat.Response, error) {
+	return send(req.Remote, req)
+}
+
+// routeTo returns a RoundTrip implementation like roundTrip, except that
+// requests are sent to addr whichever server they name.
+func routeTo(addr string) func(req *heat.Request) (*heat.Response, error) {
+	return func(req *heat.Request) (*heat.Response, error) {
+		return send(addr, req)
+	}
+}
+
+func send(addr string, req *heat.Request) (*heat.Response, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, &relay.DialError{Addr: addr, Err: err}
+	}
+
+	resp, err := exchange(conn, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// exchange writes a request to conn and reads the response, which keeps
+// conn open until its body is closed.
+func exchange(conn net.Conn, req *heat.Request) (*heat.Response, error) {
+	rw := xo.NewReadWriter(
+		xo.NewReader(conn, make([]byte, 4096)),
+		xo.NewWriter(conn, make([]byte, 4096)),
+	)
+
+	size, err := heat.RequestBodySize(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := heat.WriteRequestHeader(rw, req); err != nil {
+		return nil, err
+	}
+	if req.Body != nil {
+		if err := heat.WriteBody(rw, req.Body, size); err != nil {
+			return nil, err
+		}
+	}
+	if err := rw.Flush(); err != nil {
+		return nil, err
+	}
+
+	resp, err := heat.ReadResponseHeader(rw)
+	if err != nil {
+		return nil, &relay.UpstreamProtocolError{Err: err}
+	}
+	if size, err = heat.ResponseBodySize(resp, req.Method); err != nil {
+		return nil, &relay.UpstreamProtocolError{Err: err}
+	}
+	body, err := heat.OpenBody(rw, size)
+	if err != nil {
+		return nil, &relay.UpstreamProtocolError{Err: err}
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, conn}
+
+	return resp, nil
+}
+
+func TestResponseStreaming(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nfirst\r\n")
+		<-release
+		io.WriteString(conn, "4\r\nlast\r\n0\r\n\r\n")
+	})
+
+	conn := serve(t, &relay.Proxy{RoundTrip: roundTrip})
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+
+	// The header and the first chunk arrive while the upstream server is
+	// still holding back the rest.
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "first" {
+		t.Fatalf("got %q (%v), want the first chunk", buf, err)
+	}
+}
+
+func TestResponseBadBodySize(t *testing.T) {
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: lots\r\n\r\nhello")
+	})
+
+	conn := serve(t, &relay.Proxy{RoundTrip: roundTrip})
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 502 {
+		t.Errorf("got status %d, want 502", resp.StatusCode)
+	}
+}
@@ -0,0 +1,512 @@
+package relay
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Validate reports the first problem found in the proxy's configuration,
+// catching combinations of settings which would otherwise be silently
+// ignored. ServeListener calls it before accepting any connections.
+func (p *Proxy) Validate() error {
+	if ca := p.authority(); ca != nil {
+		if err := validateAuthority("Authority", ca); err != nil {
+			return err
+		}
+	}
+
+	for i, r := range p.Authorities {
+		if r.Authority == nil {
+			return configError("Authorities[%d] has no authority", i)
+		}
+		if err := validateAuthority(fmt.Sprintf("Authorities[%d]", i), r.Authority); err != nil {
+			return err
+		}
+	}
+
+	if a := p.Auth; a != nil {
+		if a.Basic == nil && a.Negotiate == nil && a.Bearer == nil {
+			return configError("Auth offers no authentication scheme")
+		}
+		if b := a.Bearer; b != nil && b.Issuer == "" && b.JWKSURL == "" && b.Keys == nil {
+			return configError("Auth.Bearer has no Issuer, JWKSURL or Keys")
+		}
+	}
+
+	if p.RandomKeys && p.LegacyForging {
+		return configError("both RandomKeys and LegacyForging are set")
+	}
+
+	if p.MaxHops < 0 {
+		return configError("MaxHops is negative")
+	}
+	if p.MaxHops > 0 && p.Via == "" {
+		return configError("MaxHops is set, but Via is empty")
+	}
+
+	if err := validateOriginForm(p.OriginForm, p.Reverse); err != nil {
+		return err
+	}
+
+	if p.URIs < URIPreserve || p.URIs > URIStrict {
+		return configError("unknown URIs policy")
+	}
+	if p.Userinfo < UserinfoStrip || p.Userinfo > UserinfoAuthorize {
+		return configError("unknown Userinfo policy")
+	}
+
+	if c := p.Decisions; c != nil {
+		if c.TTL < 0 || c.MaxEntries < 0 {
+			return configError("Decisions has a negative TTL or MaxEntries")
+		}
+		if err := validateMemory("Decisions.Memory", c.Memory); err != nil {
+			return err
+		}
+	}
+	if err := validateMemory("Memory", p.Memory); err != nil {
+		return err
+	}
+
+	if p.Bridge && p.Scrub != nil {
+		return configError("Scrub is ignored in Bridge mode")
+	}
+
+	if sp := p.Scrub; sp != nil {
+		for _, name := range sp.Remove {
+			if !isToken(name) {
+				return configError("Scrub removes invalid field %q", name)
+			}
+		}
+		for _, name := range sp.Keep {
+			if !isToken(name) {
+				return configError("Scrub keeps invalid field %q", name)
+			}
+			for _, other := range sp.Remove {
+				if strings.EqualFold(name, other) {
+					return configError("Scrub both keeps and removes %q", name)
+				}
+			}
+		}
+	}
+
+	if p.Tolerate.MaxHeaderBytes < 0 {
+		return configError("Tolerate.MaxHeaderBytes is negative")
+	}
+
+	if p.HSTSUpgrade && p.HSTS == nil {
+		return configError("HSTSUpgrade is set, but HSTS is nil")
+	}
+
+	if p.RoundTrip != nil && p.RoundTripContext != nil {
+		return configError("both RoundTrip and RoundTripContext are set")
+	}
+
+	if p.TimeoutHeader != "" && !isToken(p.TimeoutHeader) {
+		return configError("TimeoutHeader %q is not a valid field name", p.TimeoutHeader)
+	}
+
+	for _, coding := range p.AcceptEncoding {
+		if !isToken(coding) {
+			return configError("AcceptEncoding contains invalid coding %q", coding)
+		}
+	}
+
+	for i, r := range p.HeaderRules {
+		switch {
+		case !r.Request && !r.Response:
+			return configError("HeaderRules[%d] applies to neither requests nor responses", i)
+		case r.Action < AddHeader || r.Action > RenameHeader:
+			return configError("HeaderRules[%d] has an unknown action", i)
+		case !isToken(r.Name):
+			return configError("HeaderRules[%d] has invalid field name %q", i, r.Name)
+		case r.Action == RenameHeader && !isToken(r.Value):
+			return configError("HeaderRules[%d] renames to invalid field name %q", i, r.Value)
+		case hasSecrets(r.Value) && r.Response:
+			return configError("HeaderRules[%d] references secrets in responses", i)
+		case hasSecrets(r.Value) && p.Secrets == nil:
+			return configError("HeaderRules[%d] references secrets, but Secrets is nil", i)
+		}
+	}
+
+	for i, r := range p.JSONRules {
+		if !r.Request && !r.Response {
+			return configError("JSONRules[%d] applies to neither requests nor responses", i)
+		}
+		for _, c := range r.When {
+			if c.Equals != "" && !json.Valid([]byte(c.Equals)) {
+				return configError("JSONRules[%d] has a condition on %q with invalid JSON", i, c.Path)
+			}
+		}
+		for _, patch := range r.Patches {
+			switch {
+			case patch.Action < JSONSet || patch.Action > JSONRemove:
+				return configError("JSONRules[%d] has an unknown action", i)
+			case patch.Path == "" && patch.Action == JSONRemove:
+				return configError("JSONRules[%d] removes the whole document", i)
+			case patch.Action == JSONSet && !validateJSONValue(patch.Value):
+				return configError("JSONRules[%d] sets %q to invalid JSON", i, patch.Path)
+			}
+		}
+	}
+	if p.MaxJSONBody < 0 {
+		return configError("MaxJSONBody is negative")
+	}
+
+	if p.GraphQL != nil && p.GraphQL.MaxBody < 0 {
+		return configError("GraphQL.MaxBody is negative")
+	}
+
+	for i, r := range p.Injections {
+		switch {
+		case r.Snippet == "":
+			return configError("Injections[%d] has no snippet", i)
+		case r.Position != InjectHead && r.Position != InjectBody:
+			return configError("Injections[%d] has an unknown position", i)
+		}
+	}
+
+	for i, r := range p.AltSvc {
+		switch {
+		case r.Action < AltSvcPass || r.Action > AltSvcFilter:
+			return configError("AltSvc[%d] has an unknown action", i)
+		case r.Action == AltSvcFilter && len(r.Protocols) == 0:
+			return configError("AltSvc[%d] filters without any Protocols", i)
+		case r.Action != AltSvcFilter && len(r.Protocols) > 0:
+			return configError("AltSvc[%d] has Protocols, but doesn't filter", i)
+		}
+	}
+
+	for i, r := range p.Redirects {
+		if u, err := url.Parse(r.To); err != nil || u.Scheme == "" || u.Host == "" {
+			return configError("Redirects[%d] has invalid To %q", i, r.To)
+		}
+		if r.From != "" {
+			if u, err := url.Parse(r.From); err != nil || u.Scheme == "" || u.Host == "" {
+				return configError("Redirects[%d] has invalid From %q", i, r.From)
+			}
+		}
+	}
+
+	for i, r := range p.Cookies {
+		switch {
+		case r.StripDomain && r.Domain != "":
+			return configError("Cookies[%d] both strips and sets Domain", i)
+		case r.Secure < CookieKeep || r.Secure > CookieClear:
+			return configError("Cookies[%d] has an unknown Secure action", i)
+		case r.SameSite != "" && !strings.EqualFold(r.SameSite, "Strict") && !strings.EqualFold(r.SameSite, "Lax") && !strings.EqualFold(r.SameSite, "None"):
+			return configError("Cookies[%d] has invalid SameSite %q", i, r.SameSite)
+		case strings.EqualFold(r.SameSite, "None") && r.Secure == CookieClear:
+			return configError("Cookies[%d] sets SameSite=None on cookies which aren't Secure", i)
+		}
+	}
+
+	if r := p.Redact; r != nil {
+		for i, path := range r.JSONFields {
+			if path == "" || strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+				return configError("Redact.JSONFields[%d] has invalid path %q", i, path)
+			}
+		}
+		for i, re := range r.Patterns {
+			if re == nil {
+				return configError("Redact.Patterns[%d] is nil", i)
+			}
+		}
+	}
+
+	if err := validateSampler("LogSample", p.LogSample); err != nil {
+		return err
+	}
+
+	for i := range p.Shaping {
+		np := &p.Shaping[i].Profile
+		switch {
+		case np.Download < 0 || np.Upload < 0 || np.Latency < 0 || np.Jitter < 0:
+			return configError("Shaping[%d] has a negative setting", i)
+		case np.Loss < 0 || np.Loss > 1:
+			return configError("Shaping[%d] has a Loss outside [0, 1]", i)
+		}
+	}
+
+	for i, r := range p.Faults {
+		switch {
+		case r.Probability < 0 || r.Probability > 1:
+			return configError("Faults[%d] has a Probability outside [0, 1]", i)
+		case r.Delay < 0 || r.AbortAfter < 0 || r.Corrupt < 0:
+			return configError("Faults[%d] has a negative setting", i)
+		case r.Status != 0 && (r.Status < 200 || r.Status > 599):
+			return configError("Faults[%d] has invalid status %d", i, r.Status)
+		}
+	}
+
+	for i, r := range p.Signing {
+		switch sg := r.Signer.(type) {
+		case nil:
+			return configError("Signing[%d] has no Signer", i)
+		case *SigV4Signer:
+			if sg.AccessKeyID == "" || sg.SecretAccessKey == "" || sg.Region == "" || sg.Service == "" {
+				return configError("Signing[%d] has incomplete SigV4 credentials", i)
+			}
+			if p.Secrets == nil && (hasSecrets(sg.AccessKeyID) || hasSecrets(sg.SecretAccessKey) || hasSecrets(sg.SessionToken)) {
+				return configError("Signing[%d] references secrets, but Secrets is nil", i)
+			}
+		case *HMACSigner:
+			if len(sg.Key) == 0 && sg.KeySecret == "" {
+				return configError("Signing[%d] has an empty HMAC key", i)
+			}
+			if p.Secrets == nil && sg.KeySecret != "" {
+				return configError("Signing[%d] references secrets, but Secrets is nil", i)
+			}
+		}
+	}
+
+	for i, r := range p.VerifyRules {
+		if !r.Fields && r.SHA256 == "" {
+			return configError("VerifyRules[%d] has no digest to check", i)
+		}
+		if sum, err := hex.DecodeString(r.SHA256); r.SHA256 != "" && (err != nil || len(sum) != sha256.Size) {
+			return configError("VerifyRules[%d] has malformed SHA256 %q", i, r.SHA256)
+		}
+	}
+
+	for i, r := range p.ScanRules {
+		switch {
+		case r.Scanner == nil:
+			return configError("ScanRules[%d] has no Scanner", i)
+		case !r.Requests && !r.Responses:
+			return configError("ScanRules[%d] applies to neither requests nor responses", i)
+		case r.HoldLimit < 0 || r.Trickle < 0:
+			return configError("ScanRules[%d] has a negative setting", i)
+		}
+	}
+
+	for i, r := range p.ClockSkew {
+		if !r.Certificates && !r.Date {
+			return configError("ClockSkew[%d] sets neither Certificates nor Date", i)
+		}
+	}
+
+	for i, r := range p.SecurityHeaders {
+		switch {
+		case r.FrameOptions != "" && !strings.EqualFold(r.FrameOptions, "DENY") && !strings.EqualFold(r.FrameOptions, "SAMEORIGIN"):
+			return configError("SecurityHeaders[%d] has invalid FrameOptions %q", i, r.FrameOptions)
+		case r.StripHSTS && r.StrictTransportSecurity != "":
+			return configError("SecurityHeaders[%d] both strips and sets Strict-Transport-Security", i)
+		}
+	}
+
+	switch {
+	case p.SpoolMemory < 0:
+		return configError("SpoolMemory is negative")
+	case p.BodyBuffer < 0:
+		return configError("BodyBuffer is negative")
+	case p.MaxConns < 0:
+		return configError("MaxConns is negative")
+	case p.MaxRequests < 0:
+		return configError("MaxRequests is negative")
+	case p.RetryAfter < 0:
+		return configError("RetryAfter is negative")
+	case p.MaxWebSocketMessage < 0:
+		return configError("MaxWebSocketMessage is negative")
+	}
+
+	for i, r := range p.Latency {
+		if r.Timeout < 0 || r.Slow < 0 || r.BodyTimeout < 0 || r.IdleTimeout < 0 {
+			return configError("Latency[%d] has a negative limit", i)
+		}
+	}
+
+	if p.Quotas != nil {
+		for i, q := range p.Quotas.Quotas {
+			switch {
+			case q.Period < QuotaDaily || q.Period > QuotaMonthly:
+				return configError("Quotas[%d] has an unknown period", i)
+			case q.Action < QuotaBlock || q.Action > QuotaNotify:
+				return configError("Quotas[%d] has an unknown action", i)
+			case q.Bytes < 0 || q.Requests < 0:
+				return configError("Quotas[%d] has a negative limit", i)
+			case q.Action == QuotaThrottle && q.Rate <= 0:
+				return configError("Quotas[%d] throttles, but has no Rate", i)
+			}
+		}
+	}
+
+	if len(p.Breakpoints) > 0 && p.Paused == nil {
+		return configError("Breakpoints are set, but Paused is nil")
+	}
+
+	if p.Transport != nil {
+		if err := p.Transport.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if p.Flows != nil {
+		if err := p.Flows.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate reports the first problem found in the transport's
+// configuration.
+func (t *Transport) Validate() error {
+	if t.Proxy != nil && t.Proxy.Scheme != "http" && t.Proxy.Scheme != "https" {
+		return configError("Transport.Proxy must be an http or https URL")
+	}
+
+	if t.ProxyNTLM && (t.Proxy == nil || t.Proxy.User == nil) {
+		return configError("Transport.ProxyNTLM is set, but Transport.Proxy has no credentials")
+	}
+
+	if t.Dial != nil && t.Resolver != nil {
+		return configError("Transport.Resolver is ignored when Transport.Dial is set")
+	}
+
+	if t.MaxIdlePerHost < 0 {
+		return configError("Transport.MaxIdlePerHost is negative")
+	}
+
+	if t.IdleTimeout < 0 || t.MaxLifetime < 0 {
+		return configError("Transport.IdleTimeout and MaxLifetime must not be negative")
+	}
+	if t.ResponseHeaderTimeout < 0 || t.BodyTimeout < 0 || t.BodyIdleTimeout < 0 {
+		return configError("Transport timeouts must not be negative")
+	}
+
+	if g := t.Guard; g != nil {
+		for _, nets := range [][]*net.IPNet{g.Allow, g.Deny} {
+			for _, n := range nets {
+				if n == nil {
+					return configError("Transport.Guard contains a nil network")
+				}
+			}
+		}
+	}
+
+	if r := t.Resolver; r != nil {
+		if r.MinTTL < 0 || r.MaxTTL < 0 || r.Refresh < 0 {
+			return configError("Transport.Resolver has a negative TTL setting")
+		}
+		if r.MinTTL > 0 && r.MaxTTL > 0 && r.MinTTL > r.MaxTTL {
+			return configError("Transport.Resolver.MinTTL exceeds MaxTTL")
+		}
+	}
+
+	return nil
+}
+
+// Validate reports the first problem found in the flow store's
+// configuration.
+func (fs *FlowStore) Validate() error {
+	switch {
+	case fs.MaxFlows < 0:
+		return configError("Flows.MaxFlows is negative")
+	case fs.MaxBytes < 0:
+		return configError("Flows.MaxBytes is negative")
+	case fs.MaxBodySize < 0:
+		return configError("Flows.MaxBodySize is negative")
+	case fs.MaxMessages < 0:
+		return configError("Flows.MaxMessages is negative")
+	}
+
+	if err := validateMemory("Flows.Memory", fs.Memory); err != nil {
+		return err
+	}
+
+	return validateSampler("Flows.Sample", fs.Sample)
+}
+
+// validateAuthority checks that a certificate can sign forged certificates.
+func validateAuthority(name string, ca *tls.Certificate) error {
+	if len(ca.Certificate) == 0 {
+		return configError("%s has no certificate", name)
+	}
+
+	x509ca, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return configError("%s certificate is invalid: %s", name, err)
+	}
+	if !x509ca.IsCA {
+		return configError("%s certificate is not a CA certificate", name)
+	}
+
+	if _, ok := ca.PrivateKey.(crypto.Signer); !ok {
+		return configError("%s has no usable private key", name)
+	}
+
+	return nil
+}
+
+// validateOriginForm checks an origin-form policy against the reverse proxy
+// URL it would use.
+func validateOriginForm(policy OriginFormPolicy, reverse *url.URL) error {
+	if policy < OriginFormDefault || policy > OriginFormTransparent {
+		return configError("unknown OriginForm policy")
+	}
+
+	if policy == OriginFormReverse && reverse == nil {
+		return configError("OriginForm is OriginFormReverse, but Reverse is nil")
+	}
+
+	if reverse != nil && ((reverse.Scheme != "http" && reverse.Scheme != "https") || reverse.Host == "") {
+		return configError("Reverse must be an absolute http or https URL")
+	}
+
+	return nil
+}
+
+func configError(format string, args ...interface{}) error {
+	return fmt.Errorf("relay: invalid configuration: "+format, args...)
+}
+
+// isToken reports whether s is a valid HTTP token, as used for header field
+// names.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateSampler checks the rules of a Sampler, which may be nil.
+func validateMemory(name string, m *MemoryBudget) error {
+	if m != nil && (m.Total < 0 || m.Buffers < 0 || m.Captures < 0 || m.Caches < 0 || m.Spools < 0) {
+		return configError("%s has a negative ceiling", name)
+	}
+	return nil
+}
+
+func validateSampler(name string, sm *Sampler) error {
+	if sm == nil {
+		return nil
+	}
+
+	for i, r := range sm.Rules {
+		switch {
+		case r.Rate < 0 || r.Rate > 1:
+			return configError("%s.Rules[%d] has a Rate outside [0, 1]", name, i)
+		case r.PerSecond < 0:
+			return configError("%s.Rules[%d] has a negative PerSecond", name, i)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+package relay_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+// leafCertificate returns a self-signed certificate which isn't a CA.
+func leafCertificate(t *testing.T) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "leaf.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestValidate(t *testing.T) {
+	ca, _ := testAuthority(t)
+	leaf := leafCertificate(t)
+
+	tests := []struct {
+		name string
+		p    *relay.Proxy
+	}{
+		{"empty authority", &relay.Proxy{Authority: &tls.Certificate{}}},
+		{"invalid authority", &relay.Proxy{Authority: &tls.Certificate{Certificate: [][]byte{[]byte("junk")}}}},
+		{"leaf authority", &relay.Proxy{Authority: leaf}},
+		{"keyless authority", &relay.Proxy{Authority: &tls.Certificate{Certificate: ca.Certificate}}},
+		{"negative MaxHops", &relay.Proxy{MaxHops: -1, Via: "relay"}},
+		{"MaxHops without Via", &relay.Proxy{MaxHops: 3}},
+		{"both round trippers", &relay.Proxy{
+			RoundTrip:        func(req *heat.Request) (*heat.Response, error) { return nil, nil },
+			RoundTripContext: (&relay.Transport{}).RoundTripContext,
+		}},
+		{"invalid TimeoutHeader", &relay.Proxy{TimeoutHeader: "X Timeout"}},
+		{"invalid AcceptEncoding", &relay.Proxy{AcceptEncoding: []string{"gzip;q=1"}}},
+		{"directionless header rule", &relay.Proxy{HeaderRules: []relay.HeaderRule{
+			{Action: relay.RemoveHeader, Name: "Cookie"},
+		}}},
+		{"unknown header action", &relay.Proxy{HeaderRules: []relay.HeaderRule{
+			{Request: true, Action: 99, Name: "Cookie"},
+		}}},
+		{"invalid header name", &relay.Proxy{HeaderRules: []relay.HeaderRule{
+			{Request: true, Action: relay.RemoveHeader, Name: "Set Cookie"},
+		}}},
+		{"invalid rename", &relay.Proxy{HeaderRules: []relay.HeaderRule{
+			{Request: true, Action: relay.RenameHeader, Name: "Cookie", Value: ""},
+		}}},
+		{"negative SpoolMemory", &relay.Proxy{SpoolMemory: -1}},
+		{"negative MaxConns", &relay.Proxy{MaxConns: -1}},
+		{"negative MaxRequests", &relay.Proxy{MaxRequests: -1}},
+		{"negative RetryAfter", &relay.Proxy{RetryAfter: -1}},
+		{"negative MaxWebSocketMessage", &relay.Proxy{MaxWebSocketMessage: -1}},
+		{"breakpoints without Paused", &relay.Proxy{Breakpoints: []relay.Breakpoint{{}}}},
+		{"non-http upstream proxy", &relay.Proxy{Transport: &relay.Transport{
+			Proxy: &url.URL{Scheme: "socks5", Host: "localhost:1080"},
+		}}},
+		{"resolver with Dial", &relay.Proxy{Transport: &relay.Transport{
+			Dial:     net.Dial,
+			Resolver: &relay.DNSCache{},
+		}}},
+		{"negative MaxIdlePerHost", &relay.Proxy{Transport: &relay.Transport{MaxIdlePerHost: -1}}},
+		{"negative resolver TTL", &relay.Proxy{Transport: &relay.Transport{Resolver: &relay.DNSCache{MinTTL: -1}}}},
+		{"inverted resolver TTLs", &relay.Proxy{Transport: &relay.Transport{Resolver: &relay.DNSCache{MinTTL: 60e9, MaxTTL: 1e9}}}},
+		{"negative MaxFlows", &relay.Proxy{Flows: &relay.FlowStore{MaxFlows: -1}}},
+		{"negative MaxBytes", &relay.Proxy{Flows: &relay.FlowStore{MaxBytes: -1}}},
+		{"negative MaxBodySize", &relay.Proxy{Flows: &relay.FlowStore{MaxBodySize: -1}}},
+		{"negative MaxMessages", &relay.Proxy{Flows: &relay.FlowStore{MaxMessages: -1}}},
+		{"invalid FrameOptions", &relay.Proxy{SecurityHeaders: []relay.SecurityRule{{FrameOptions: "ALLOWALL"}}}},
+		{"contradictory HSTS rule", &relay.Proxy{SecurityHeaders: []relay.SecurityRule{
+			{StripHSTS: true, StrictTransportSecurity: "max-age=60"},
+		}}},
+		{"empty snippet", &relay.Proxy{Injections: []relay.InjectRule{{}}}},
+		{"unknown injection position", &relay.Proxy{Injections: []relay.InjectRule{{Snippet: "<x>", Position: 9}}}},
+		{"unknown Alt-Svc action", &relay.Proxy{AltSvc: []relay.AltSvcRule{{Action: 9}}}},
+		{"Alt-Svc filter without protocols", &relay.Proxy{AltSvc: []relay.AltSvcRule{{Action: relay.AltSvcFilter}}}},
+		{"Alt-Svc protocols without filter", &relay.Proxy{AltSvc: []relay.AltSvcRule{
+			{Action: relay.AltSvcStrip, Protocols: []string{"h2"}},
+		}}},
+		{"relative redirect target", &relay.Proxy{Redirects: []relay.RedirectRule{{To: "/shop"}}}},
+		{"relative redirect source", &relay.Proxy{Redirects: []relay.RedirectRule{
+			{From: "10.0.0.5/app", To: "https://www.example.com"},
+		}}},
+		{"cookie domain stripped and set", &relay.Proxy{Cookies: []relay.CookieRule{{StripDomain: true, Domain: "app.test"}}}},
+		{"unknown cookie Secure action", &relay.Proxy{Cookies: []relay.CookieRule{{Secure: 9}}}},
+		{"invalid SameSite", &relay.Proxy{Cookies: []relay.CookieRule{{SameSite: "Sometimes"}}}},
+		{"insecure SameSite=None", &relay.Proxy{Cookies: []relay.CookieRule{{SameSite: "none", Secure: relay.CookieClear}}}},
+		{"sample rate above 1", &relay.Proxy{LogSample: &relay.Sampler{Rules: []relay.SampleRule{{Rate: 1.5}}}}},
+		{"negative sample rate", &relay.Proxy{Flows: &relay.FlowStore{Sample: &relay.Sampler{Rules: []relay.SampleRule{{Rate: -1}}}}}},
+		{"negative PerSecond", &relay.Proxy{LogSample: &relay.Sampler{Rules: []relay.SampleRule{{Rate: 1, PerSecond: -1}}}}},
+		{"negative shaping latency", &relay.Proxy{Shaping: []relay.ShapingRule{{Profile: relay.NetworkProfile{Latency: -1}}}}},
+		{"shaping loss above 1", &relay.Proxy{Shaping: []relay.ShapingRule{{Profile: relay.NetworkProfile{Loss: 1.5}}}}},
+		{"clock skew without effect", &relay.Proxy{ClockSkew: []relay.ClockSkewRule{{Skew: time.Hour}}}},
+		{"fault probability above 1", &relay.Proxy{Faults: []relay.FaultRule{{Probability: 2}}}},
+		{"negative fault delay", &relay.Proxy{Faults: []relay.FaultRule{{Delay: -1}}}},
+		{"invalid fault status", &relay.Proxy{Faults: []relay.FaultRule{{Status: 99}}}},
+		{"unknown URIs policy", &relay.Proxy{URIs: 9}},
+		{"unknown Userinfo policy", &relay.Proxy{Userinfo: 9}},
+		{"signing rule without Signer", &relay.Proxy{Signing: []relay.SigningRule{{}}}},
+		{"incomplete SigV4 credentials", &relay.Proxy{Signing: []relay.SigningRule{
+			{Signer: &relay.SigV4Signer{AccessKeyID: "id", SecretAccessKey: "key", Region: "us-east-1"}},
+		}}},
+		{"empty HMAC key", &relay.Proxy{Signing: []relay.SigningRule{{Signer: &relay.HMACSigner{KeyID: "k"}}}}},
+		{"secrets in response header rule", &relay.Proxy{Secrets: &relay.EnvSecrets{}, HeaderRules: []relay.HeaderRule{
+			{Response: true, Action: relay.SetHeader, Name: "X-Key", Value: "${secret:key}"},
+		}}},
+		{"header secrets without Secrets", &relay.Proxy{HeaderRules: []relay.HeaderRule{
+			{Request: true, Action: relay.SetHeader, Name: "X-Key", Value: "${secret:key}"},
+		}}},
+		{"SigV4 secrets without Secrets", &relay.Proxy{Signing: []relay.SigningRule{{Signer: &relay.SigV4Signer{
+			AccessKeyID: "id", SecretAccessKey: "${secret:key}", Region: "us-east-1", Service: "s3",
+		}}}}},
+		{"HMAC KeySecret without Secrets", &relay.Proxy{Signing: []relay.SigningRule{{Signer: &relay.HMACSigner{KeySecret: "key"}}}}},
+		{"verify rule without digest", &relay.Proxy{VerifyRules: []relay.VerifyRule{{Require: true}}}},
+		{"malformed verify SHA256", &relay.Proxy{VerifyRules: []relay.VerifyRule{{SHA256: "abc"}}}},
+		{"scan rule without Scanner", &relay.Proxy{ScanRules: []relay.ScanRule{{Requests: true}}}},
+		{"scan rule scanning nothing", &relay.Proxy{ScanRules: []relay.ScanRule{{Scanner: slowScanner(nil)}}}},
+		{"negative HoldLimit", &relay.Proxy{ScanRules: []relay.ScanRule{{Scanner: slowScanner(nil), Responses: true, HoldLimit: -1}}}},
+		{"JSON rule applying to nothing", &relay.Proxy{JSONRules: []relay.JSONRule{{}}}},
+		{"invalid JSON condition", &relay.Proxy{JSONRules: []relay.JSONRule{
+			{Request: true, When: []relay.JSONCondition{{Path: "a", Equals: "{"}}},
+		}}},
+		{"unknown JSON action", &relay.Proxy{JSONRules: []relay.JSONRule{
+			{Request: true, Patches: []relay.JSONPatch{{Action: 9, Path: "a"}}},
+		}}},
+		{"JSON document removed", &relay.Proxy{JSONRules: []relay.JSONRule{
+			{Request: true, Patches: []relay.JSONPatch{{Action: relay.JSONRemove}}},
+		}}},
+		{"invalid JSON value", &relay.Proxy{JSONRules: []relay.JSONRule{
+			{Request: true, Patches: []relay.JSONPatch{{Path: "a", Value: "{x}"}}},
+		}}},
+		{"unknown JSON template", &relay.Proxy{JSONRules: []relay.JSONRule{
+			{Request: true, Patches: []relay.JSONPatch{{Path: "a", Value: `"${cookie:id}"`}}},
+		}}},
+		{"negative MaxJSONBody", &relay.Proxy{MaxJSONBody: -1}},
+		{"negative GraphQL.MaxBody", &relay.Proxy{GraphQL: &relay.GraphQLConfig{MaxBody: -1}}},
+		{"negative MaxHeaderBytes", &relay.Proxy{Tolerate: relay.Tolerance{MaxHeaderBytes: -1}}},
+		{"negative body timeout", &relay.Proxy{Latency: []relay.LatencyRule{{IdleTimeout: -1}}}},
+		{"negative transport body timeout", &relay.Proxy{Transport: &relay.Transport{BodyIdleTimeout: -1}}},
+		{"invalid Scrub.Remove", &relay.Proxy{Scrub: &relay.ScrubPolicy{Remove: []string{"X Bad"}}}},
+		{"invalid Scrub.Keep", &relay.Proxy{Scrub: &relay.ScrubPolicy{Keep: []string{""}}}},
+		{"Scrub keeps and removes", &relay.Proxy{Scrub: &relay.ScrubPolicy{Keep: []string{"TE"}, Remove: []string{"te"}}}},
+		{"Scrub in Bridge mode", &relay.Proxy{Bridge: true, Scrub: &relay.ScrubPolicy{}}},
+		{"negative Decisions.TTL", &relay.Proxy{Decisions: &relay.DecisionCache{TTL: -time.Second}}},
+		{"negative Decisions.MaxEntries", &relay.Proxy{Decisions: &relay.DecisionCache{MaxEntries: -1}}},
+		{"negative Memory.Total", &relay.Proxy{Memory: &relay.MemoryBudget{Total: -1}}},
+		{"negative Flows.Memory.Captures", &relay.Proxy{Flows: &relay.FlowStore{Memory: &relay.MemoryBudget{Captures: -1}}}},
+		{"negative Decisions.Memory.Caches", &relay.Proxy{Decisions: &relay.DecisionCache{Memory: &relay.MemoryBudget{Caches: -1}}}},
+		{"unknown OriginForm", &relay.Proxy{OriginForm: 99}},
+		{"reverse without URL", &relay.Proxy{OriginForm: relay.OriginFormReverse}},
+		{"relative reverse URL", &relay.Proxy{OriginForm: relay.OriginFormReverse, Reverse: &url.URL{Path: "/app"}}},
+	}
+
+	for _, tt := range tests {
+		err := tt.p.Validate()
+		if err == nil || !strings.Contains(err.Error(), "invalid configuration") {
+			t.Errorf("%s: got %v, want a configuration error", tt.name, err)
+		}
+	}
+
+	// A zero Proxy is valid, as is one with a working authority.
+	for _, p := range []*relay.Proxy{{}, {Authority: ca}} {
+		if err := p.Validate(); err != nil {
+			t.Errorf("got %v for a valid configuration", err)
+		}
+	}
+}
+
+func TestServeListenerValidates(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	p := &relay.Proxy{MaxConns: -1}
+	if err := p.ServeListener(l, nil); err == nil || err.Error() != p.Validate().Error() {
+		t.Errorf("got %v, want the validation error", err)
+	}
+}
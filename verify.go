@@ -0,0 +1,263 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// An IntegrityError is returned when a response body doesn't match a digest
+// it was expected to have.
+type IntegrityError struct {
+	// Where the expected digest came from, such as "Digest" (a header
+	// field) or "VerifyRules[0]", and its algorithm, such as "sha-256".
+	Source    string
+	Algorithm string
+
+	// The reason, if the expected digest couldn't be established.
+	Reason string
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Reason != "" {
+		return "relay: integrity check failed: " + e.Source + ": " + e.Reason
+	}
+	return "relay: integrity check failed: body doesn't match " + e.Algorithm + " digest from " + e.Source
+}
+
+// A VerifyRule has the bodies of responses checked against the digests they
+// were expected to have, such as for downloads of software packages.
+//
+// Bodies are checked as they're relayed; the last byte of a body which
+// fails verification is withheld, and the connection to the client closed,
+// such that it doesn't receive a complete body. With Buffer set, bodies are
+// read in full first, and failures answered with "502 Bad Gateway".
+//
+// Only successful responses, other than "206 Partial Content", are checked.
+type VerifyRule struct {
+	// Requests whose responses the rule applies to. If nil, everything
+	// matches.
+	Match *Match
+
+	// If set, bodies are checked against their Content-MD5, Digest
+	// (RFC 3230), Content-Digest and Repr-Digest (RFC 9530) fields.
+	Fields bool
+
+	// Hex-encoded SHA-256 digest bodies must have, if any.
+	SHA256 string
+
+	// If set, responses with no digest to check against are rejected.
+	Require bool
+
+	// If set, bodies are spooled (see Session.SpoolResponse) and checked
+	// before they're relayed.
+	Buffer bool
+}
+
+// A digestCheck is a digest a body is expected to have.
+type digestCheck struct {
+	source    string
+	algorithm string
+	expected  []byte
+	h         hash.Hash
+}
+
+// Hash functions by their names in Digest and Content-Digest fields.
+var digestHashes = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha":     sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// checks returns the digests a response's body is expected to have.
+func (r *VerifyRule) checks(rule string, fields heat.Fields) ([]*digestCheck, error) {
+	var checks []*digestCheck
+
+	add := func(source, algorithm, value string, decode func(string) ([]byte, error)) error {
+		newHash, ok := digestHashes[algorithm]
+		if !ok {
+			return nil
+		}
+		expected, err := decode(value)
+		if err != nil || len(expected) != newHash().Size() {
+			return &IntegrityError{Source: source, Reason: "malformed " + algorithm + " digest"}
+		}
+		checks = append(checks, &digestCheck{source, algorithm, expected, newHash()})
+		return nil
+	}
+
+	if r.SHA256 != "" {
+		if err := add(rule, "sha-256", r.SHA256, hex.DecodeString); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.Fields {
+		for _, f := range fields {
+			var err error
+
+			switch {
+			case f.Is("Content-MD5"):
+				err = add("Content-MD5", "md5", strings.TrimSpace(f.Value), base64.StdEncoding.DecodeString)
+
+			case f.Is("Digest"):
+				for _, item := range strings.Split(f.Value, ",") {
+					alg, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+					if err = add("Digest", strings.ToLower(alg), value, base64.StdEncoding.DecodeString); err != nil {
+						break
+					}
+				}
+
+			case f.Is("Content-Digest"), f.Is("Repr-Digest"):
+				for _, item := range strings.Split(f.Value, ",") {
+					alg, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+					value = strings.TrimSuffix(strings.TrimPrefix(value, ":"), ":")
+					if err = add(f.Name, strings.ToLower(alg), value, base64.StdEncoding.DecodeString); err != nil {
+						break
+					}
+				}
+			}
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(checks) == 0 && r.Require {
+		return nil, &IntegrityError{Source: rule, Reason: "no digest to check"}
+	}
+
+	return checks, nil
+}
+
+// verify arranges for a response's body to be checked according to the
+// first of p.VerifyRules matching its request.
+func (p *Proxy) verify(s *Session, req *heat.Request, resp *heat.Response) error {
+	if resp.Body == nil || resp.Status < 200 || resp.Status >= 300 || resp.Status == 206 {
+		return nil
+	}
+
+	for i := range p.VerifyRules {
+		r := &p.VerifyRules[i]
+		if !r.Match.Request(s, req) {
+			continue
+		}
+
+		checks, err := r.checks("VerifyRules["+strconv.Itoa(i)+"]", resp.Fields)
+		if err != nil {
+			p.integrityFailure(s, req, err.(*IntegrityError))
+			return err
+		}
+		if len(checks) == 0 {
+			return nil
+		}
+
+		resp.Body = &verifyingBody{
+			body:   resp.Body,
+			checks: checks,
+			fail: func(err *IntegrityError) {
+				p.integrityFailure(s, req, err)
+			},
+		}
+
+		if r.Buffer {
+			if _, err := s.SpoolResponse(resp); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+// integrityFailure reports a failed integrity check.
+func (p *Proxy) integrityFailure(s *Session, req *heat.Request, err *IntegrityError) {
+	p.count("verify.failed", 1)
+	if p.OnIntegrityFailure != nil {
+		p.OnIntegrityFailure(s, req, err)
+	}
+}
+
+// The verifyingBody type checks a body against its expected digests as it's
+// read, holding back the last byte until they've been checked.
+type verifyingBody struct {
+	body   io.ReadCloser
+	checks []*digestCheck
+	fail   func(err *IntegrityError)
+
+	buf     []byte
+	pending []byte // read from body, but not yet returned
+	eof     bool
+	err     error
+}
+
+func (b *verifyingBody) Read(p []byte) (int, error) {
+	for {
+		if b.err != nil {
+			return 0, b.err
+		}
+
+		if len(b.pending) > 1 || (b.eof && len(b.pending) > 0) {
+			limit := len(b.pending)
+			if !b.eof {
+				limit--
+			}
+			n := copy(p, b.pending[:limit])
+			b.pending = b.pending[n:]
+			return n, nil
+		}
+
+		if b.eof {
+			return 0, io.EOF
+		}
+
+		if b.buf == nil {
+			b.buf = make([]byte, 32<<10)
+		}
+
+		k := copy(b.buf, b.pending)
+		n, err := b.body.Read(b.buf[k:])
+		for _, c := range b.checks {
+			c.h.Write(b.buf[k : k+n])
+		}
+		b.pending = b.buf[:k+n]
+
+		switch {
+		case err == io.EOF:
+			b.eof = true
+			b.err = b.check()
+		case err != nil:
+			b.err = err
+		}
+	}
+}
+
+func (b *verifyingBody) Close() error {
+	return b.body.Close()
+}
+
+// check compares the body's digests with the expected ones.
+func (b *verifyingBody) check() error {
+	for _, c := range b.checks {
+		if !bytes.Equal(c.h.Sum(nil), c.expected) {
+			err := &IntegrityError{Source: c.source, Algorithm: c.algorithm}
+			b.fail(err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package relay_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+func TestVerifyRules(t *testing.T) {
+	const body = "hello world"
+	sha := sha256.Sum256([]byte(body))
+	sha512sum := sha512.Sum512([]byte(body))
+	md := md5.Sum([]byte(body))
+	b64 := base64.StdEncoding.EncodeToString
+
+	// Upstream responses' header fields, by path (without any "/buffered"
+	// prefix).
+	responses := map[string]string{
+		"/digest":         "Digest: SHA-256=" + b64(sha[:]),
+		"/digests":        "Digest: unixsum=30637, sha-512=" + b64(sha512sum[:]) + ", md5=" + b64(md[:]),
+		"/content-digest": "Content-Digest: sha-256=:" + b64(sha[:]) + ":",
+		"/md5":            "Content-MD5: " + b64(md[:]),
+		"/bad-md5":        "Content-MD5: " + b64(make([]byte, 16)),
+		"/bad-repr":       "Repr-Digest: sha-256=:" + b64(make([]byte, 32)) + ":",
+		"/unknown":        "Digest: unixsum=30637",
+		"/none":           "",
+		"/partial":        "Content-MD5: " + b64(make([]byte, 16)),
+	}
+
+	m := new(counters)
+	failures := make(chan *relay.IntegrityError, 1)
+
+	p := &relay.Proxy{
+		Metrics: m,
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			path := strings.TrimPrefix(req.URI, "/buffered")
+			resp := heat.NewResponse(200, "OK")
+			if path == "/partial" {
+				resp = heat.NewResponse(206, "Partial Content")
+				resp.Fields.Set("Content-Range", "bytes 0-10/11")
+			}
+			if name, value, ok := strings.Cut(responses[path], ": "); ok {
+				resp.Fields.Set(name, value)
+			}
+			resp.Fields.Set("Content-Length", "11")
+			resp.Body = io.NopCloser(strings.NewReader(body))
+			return resp, nil
+		},
+		OnIntegrityFailure: func(s *relay.Session, req *heat.Request, err *relay.IntegrityError) {
+			failures <- err
+		},
+	}
+
+	buffered, err := relay.ParseMatch("path=/buffered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned, err := relay.ParseMatch("path=/pinned")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.VerifyRules = []relay.VerifyRule{
+		{Match: buffered, Fields: true, Require: true, Buffer: true},
+		{Match: pinned, SHA256: hex.EncodeToString(sha[:])},
+		{Fields: true},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		body   string
+		failed string // the failure's source and algorithm, or reason
+	}{
+		{"/digest", 200, body, ""},
+		{"/digests", 200, body, ""},
+		{"/content-digest", 200, body, ""},
+		{"/md5", 200, body, ""},
+		{"/unknown", 200, body, ""},
+		{"/none", 200, body, ""},
+		{"/partial", 206, body, ""},
+		{"/pinned", 200, body, ""},
+
+		// Failures are noticed at the end of the body, whose last byte is
+		// withheld.
+		{"/bad-md5", 200, body[:10], "Content-MD5 md5"},
+		{"/bad-repr", 200, body[:10], "Repr-Digest sha-256"},
+
+		// Unless bodies are buffered.
+		{"/buffered/digest", 200, body, ""},
+		{"/buffered/bad-md5", 502, "", "Content-MD5 md5"},
+		{"/buffered/none", 502, "", "no digest to check"},
+	} {
+		conn := serve(t, p)
+		io.WriteString(conn, "GET http://origin.test"+tt.path+" HTTP/1.1\r\nHost: origin.test\r\nRange: bytes=0-\r\n\r\n")
+
+		resp := readFinal(t, conn, bufio.NewReader(conn))
+		got, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tt.status || (tt.status < 300 && string(got) != tt.body) {
+			t.Errorf("%s: got %d %q, want %d %q", tt.path, resp.StatusCode, got, tt.status, tt.body)
+		}
+
+		var failed string
+		select {
+		case err := <-failures:
+			if failed = err.Source + " " + err.Algorithm; err.Reason != "" {
+				failed = err.Reason
+			}
+		default:
+		}
+		if failed != tt.failed {
+			t.Errorf("%s: got failure %q, want %q", tt.path, failed, tt.failed)
+		}
+	}
+
+	if n := m.get("verify.failed"); n != 4 {
+		t.Errorf("verify.failed = %d, want 4", n)
+	}
+}
+
+func TestVerifyMalformedDigest(t *testing.T) {
+	p := &relay.Proxy{
+		VerifyRules: []relay.VerifyRule{{Fields: true}},
+		RoundTripContext: func(ctx context.Context, req *heat.Request) (*heat.Response, error) {
+			resp := heat.NewResponse(200, "OK")
+			resp.Fields.Set("Digest", "sha-256=short")
+			resp.Fields.Set("Content-Length", "2")
+			resp.Body = io.NopCloser(strings.NewReader("ok"))
+			return resp, nil
+		},
+	}
+
+	conn := serve(t, p)
+	io.WriteString(conn, "GET http://origin.test/ HTTP/1.1\r\nHost: origin.test\r\n\r\n")
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 502 {
+		t.Errorf("got status %d, want 502", resp.StatusCode)
+	}
+
+	err := &relay.IntegrityError{Source: "Digest", Reason: "malformed sha-256 digest"}
+	if got := err.Error(); got != "relay: integrity check failed: Digest: malformed sha-256 digest" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,51 @@
+package relay
+
+import (
+	"net"
+
+	"github.com/erkl/heat"
+)
+
+// fitResponse adapts a response to the HTTP version of the client it's being
+// sent to. HTTP/1.0 clients don't understand chunked encoding, so for them
+// such responses are buffered if the connection is to be kept alive, or
+// delimited by closing the connection otherwise. Returns true if the
+// connection must be closed after writing the response.
+func (s *Session) fitResponse(resp *heat.Response, major, minor int, method string, closing bool) (bool, error) {
+	if major > 1 || (major == 1 && minor >= 1) || resp.Status == 101 {
+		return closing, nil
+	}
+
+	size, err := heat.ResponseBodySize(resp, method)
+	if err != nil || size != heat.Chunked {
+		return closing, nil
+	}
+
+	if !closing {
+		return false, s.reframe(&resp.Fields, &resp.Body)
+	}
+
+	resp.Fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Transfer-Encoding")
+	})
+
+	return true, nil
+}
+
+// ensureHost adds a Host header field to requests without one, as is allowed
+// in HTTP/1.0, since all requests sent upstream are HTTP/1.1.
+func ensureHost(req *heat.Request) {
+	if _, ok := fieldValue(req.Fields, "Host"); ok {
+		return
+	}
+
+	host := req.Remote
+	if withPort(hostname(host), req.Scheme) == host {
+		host = hostname(host)
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+	}
+
+	req.Fields.Set("Host", host)
+}
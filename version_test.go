@@ -0,0 +1,65 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+// chunked starts an upstream server answering every request with a chunked
+// response, and reporting the request's Host field on seen.
+func chunked(t *testing.T, seen chan<- string) string {
+	return upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		seen <- req.Host
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"+
+			"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n")
+	})
+}
+
+func TestHTTP10Close(t *testing.T) {
+	seen := make(chan string, 1)
+	addr := chunked(t, seen)
+
+	conn := serve(t, &relay.Proxy{})
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.0\r\n\r\n")
+
+	// The body is delimited by closing the connection.
+	resp := readFinal(t, conn, bufio.NewReader(conn))
+	body, err := io.ReadAll(resp.Body)
+
+	if len(resp.TransferEncoding) > 0 || resp.ContentLength != -1 {
+		t.Errorf("got Transfer-Encoding %q and Content-Length %d", resp.TransferEncoding, resp.ContentLength)
+	}
+	if err != nil || string(body) != "hello world" {
+		t.Errorf("got body %q (%v), want %q", body, err, "hello world")
+	}
+
+	// The request gained a Host field on its way upstream.
+	if host := <-seen; host != addr {
+		t.Errorf("upstream got Host %q, want %q", host, addr)
+	}
+}
+
+func TestHTTP10KeepAlive(t *testing.T) {
+	seen := make(chan string, 2)
+	addr := chunked(t, seen)
+
+	conn := serve(t, &relay.Proxy{})
+	r := bufio.NewReader(conn)
+
+	// Responses are buffered, so that the connection can be kept alive.
+	for i := 0; i < 2; i++ {
+		io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.0\r\nHost: "+addr+"\r\nConnection: keep-alive\r\n\r\n")
+		resp := readFinal(t, conn, r)
+		body, _ := io.ReadAll(resp.Body)
+
+		if len(resp.TransferEncoding) > 0 || resp.ContentLength != 11 || string(body) != "hello world" {
+			t.Fatalf("response %d: got Transfer-Encoding %q, Content-Length %d and body %q",
+				i+1, resp.TransferEncoding, resp.ContentLength, body)
+		}
+	}
+}
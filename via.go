@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+// ErrLoopDetected is returned when a request has already passed through the
+// proxy, or through too many proxies.
+var ErrLoopDetected = errors.New("relay: forwarding loop detected")
+
+// checkVia inspects a request's Via header fields for signs of a forwarding
+// loop, and adds the proxy's own entry.
+func (p *Proxy) checkVia(req *heat.Request) error {
+	if p.Via == "" {
+		return nil
+	}
+
+	var hops int
+	var loop bool
+
+	req.Fields.Split("Via", ',', func(entry string) bool {
+		hops++
+		if words := strings.Fields(entry); len(words) >= 2 && words[1] == p.Via {
+			loop = true
+		}
+		return !loop
+	})
+
+	if loop || (p.MaxHops > 0 && hops >= p.MaxHops) {
+		return ErrLoopDetected
+	}
+
+	addVia(&req.Fields, req.Major, req.Minor, p.Via)
+	return nil
+}
+
+// addVia appends an entry to a message's Via header fields.
+func addVia(fields *heat.Fields, major, minor int, name string) {
+	entry := strconv.Itoa(major) + "." + strconv.Itoa(minor) + " " + name
+
+	if prior, ok := fieldValue(*fields, "Via"); ok {
+		entry = prior + ", " + entry
+	}
+
+	fields.Set("Via", entry)
+}
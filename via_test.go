@@ -0,0 +1,69 @@
+package relay_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/erkl/relay"
+)
+
+func TestVia(t *testing.T) {
+	seen := make(chan string, 1)
+	addr := upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		seen <- req.Header.Get("Via")
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nVia: 1.1 origin\r\nContent-Length: 0\r\n\r\n")
+	})
+
+	conn := serve(t, &relay.Proxy{Via: "relay-test", MaxHops: 3})
+	r := bufio.NewReader(conn)
+
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\nVia: 1.0 first\r\n\r\n")
+	resp := readFinal(t, conn, r)
+
+	if got := <-seen; got != "1.0 first, 1.1 relay-test" {
+		t.Errorf("upstream got Via %q", got)
+	}
+	if got := resp.Header.Get("Via"); got != "1.1 origin, 1.1 relay-test" {
+		t.Errorf("client got Via %q", got)
+	}
+
+	// One more proxy would be one too many.
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\nVia: 1.1 a, 1.1 b\r\nVia: 1.1 c\r\n\r\n")
+	if resp := readFinal(t, conn, r); resp.StatusCode != 508 {
+		t.Errorf("request past MaxHops: got status %d, want 508", resp.StatusCode)
+	}
+}
+
+func TestViaLoop(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The proxy forwards everything to itself.
+	p := &relay.Proxy{
+		Via:       "relay-test",
+		Transport: &relay.Transport{Proxy: &url.URL{Scheme: "http", Host: l.Addr().String()}},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.ServeListener(l, nil)
+		close(done)
+	}()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	conn := serve(t, p)
+	io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	if resp := readFinal(t, conn, bufio.NewReader(conn)); resp.StatusCode != 508 {
+		t.Errorf("got status %d, want 508", resp.StatusCode)
+	}
+}
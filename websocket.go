@@ -0,0 +1,324 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/erkl/heat"
+)
+
+var (
+	errWebSocketFrame    = errors.New("relay: malformed WebSocket frame")
+	errWebSocketTooLarge = errors.New("relay: WebSocket message too large")
+)
+
+// A WebSocketMessage is a complete text or binary message relayed over a
+// WebSocket connection, reassembled from its fragments.
+type WebSocketMessage struct {
+	// Set for messages sent by the client, rather than the server.
+	FromClient bool
+
+	// Set for binary messages, rather than text ones.
+	Binary bool
+
+	Data []byte
+}
+
+// WebSocket opcodes, as defined in section 5.2 of RFC 6455.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+)
+
+// A wsFrame is a single WebSocket frame, with its payload unmasked.
+type wsFrame struct {
+	fin     bool
+	rsv     byte
+	opcode  byte
+	payload []byte
+}
+
+// readWebSocketFrame reads a frame whose payload is at most max bytes.
+func readWebSocketFrame(r *bufio.Reader, max int) (*wsFrame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	f := &wsFrame{
+		fin:    hdr[0]&0x80 != 0,
+		rsv:    hdr[0] & 0x70,
+		opcode: hdr[0] & 0x0f,
+	}
+
+	masked := hdr[1]&0x80 != 0
+	size := uint64(hdr[1] & 0x7f)
+
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, unexpected(err)
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+
+	// Control frames must be short, and can't be fragmented.
+	if f.opcode >= wsClose && (size > 125 || !f.fin) {
+		return nil, errWebSocketFrame
+	}
+	if size > uint64(max) {
+		return nil, errWebSocketTooLarge
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, unexpected(err)
+		}
+	}
+
+	f.payload = make([]byte, size)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, unexpected(err)
+	}
+
+	if masked {
+		for i := range f.payload {
+			f.payload[i] ^= key[i%4]
+		}
+	}
+
+	return f, nil
+}
+
+// writeWebSocketFrame writes a frame, masking its payload with a fresh key
+// if mask is set, as required for frames sent by clients.
+func writeWebSocketFrame(w *bufio.Writer, f *wsFrame, mask bool) error {
+	hdr := []byte{f.rsv | f.opcode, 0}
+	if f.fin {
+		hdr[0] |= 0x80
+	}
+
+	payload := f.payload
+
+	switch n := len(payload); {
+	case n <= 125:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = append(hdr, byte(n>>8), byte(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+
+	if mask {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+
+		hdr[1] |= 0x80
+		hdr = append(hdr, key[:]...)
+
+		masked := make([]byte, len(payload))
+		for i := range payload {
+			masked[i] = payload[i] ^ key[i%4]
+		}
+		payload = masked
+	}
+
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// unexpected turns io.EOF into io.ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// isWebSocket reports whether a message upgrades its connection to the
+// WebSocket protocol.
+func isWebSocket(fields heat.Fields) bool {
+	return strings.EqualFold(upgradeProtocol(fields), "websocket")
+}
+
+// prepareWebSocket keeps the WebSocket connection a request may open from
+// negotiating extensions, such as compression, if p.OnWebSocketMessage
+// needs to see its messages.
+func (p *Proxy) prepareWebSocket(req *heat.Request) {
+	if p.OnWebSocketMessage == nil || !isWebSocket(req.Fields) {
+		return
+	}
+
+	req.Fields.Filter(func(f heat.Field) bool {
+		return !f.Is("Sec-WebSocket-Extensions")
+	})
+}
+
+// relayWebSocket relays frames between the client and upstream ends of a
+// WebSocket connection, passing each message through p.OnWebSocketMessage,
+// if set, and recording it in the connection's flow, if any.
+func (p *Proxy) relayWebSocket(s *Session, req *heat.Request, client, upstream io.ReadWriteCloser) error {
+	f := s.upgraded
+	s.upgraded = nil
+
+	max := p.MaxWebSocketMessage
+	if max <= 0 {
+		max = 16 << 20
+	}
+
+	relay := func(fromClient bool) copyFunc {
+		return func(dst io.Writer, src io.Reader) (int64, error) {
+			ws := &wsRelay{p: p, s: s, req: req, flow: f, fromClient: fromClient, max: max}
+			return 0, ws.run(dst, src)
+		}
+	}
+
+	err := spliceWith(client, upstream, relay(true), relay(false))
+	if f != nil {
+		p.Flows.closeUpgraded(f, err)
+	}
+
+	return err
+}
+
+// A wsRelay relays WebSocket frames in one direction.
+type wsRelay struct {
+	p          *Proxy
+	s          *Session
+	req        *heat.Request
+	flow       *Flow
+	fromClient bool
+	max        int
+
+	// The message being reassembled, and its opcode.
+	data   []byte
+	opcode byte
+}
+
+// run relays frames from src to dst until src reaches EOF. Without
+// p.OnWebSocketMessage, frames are relayed as they are, extensions and all;
+// otherwise, messages are reassembled, and relayed as single frames.
+func (ws *wsRelay) run(dst io.Writer, src io.Reader) error {
+	r := bufio.NewReader(src)
+	w := bufio.NewWriter(dst)
+	hook := ws.p.OnWebSocketMessage
+
+	for {
+		f, err := readWebSocketFrame(r, ws.max)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Messages can't be modified without knowing their extensions,
+		// which are disabled when there's a hook.
+		if hook != nil && f.rsv != 0 {
+			return errWebSocketFrame
+		}
+
+		// Control frames can come between a message's fragments.
+		if f.opcode >= wsClose {
+			ws.record(f.opcode, f.payload, false)
+			if err := writeWebSocketFrame(w, f, ws.fromClient); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch {
+		case f.opcode == wsContinuation && ws.opcode != 0:
+			if len(ws.data)+len(f.payload) > ws.max {
+				return errWebSocketTooLarge
+			}
+			ws.data = append(ws.data, f.payload...)
+		case (f.opcode == wsText || f.opcode == wsBinary) && ws.opcode == 0:
+			ws.opcode, ws.data = f.opcode, f.payload
+		default:
+			return errWebSocketFrame
+		}
+
+		if hook == nil {
+			if err := writeWebSocketFrame(w, f, ws.fromClient); err != nil {
+				return err
+			}
+		}
+
+		if !f.fin {
+			continue
+		}
+
+		m := &WebSocketMessage{
+			FromClient: ws.fromClient,
+			Binary:     ws.opcode == wsBinary,
+			Data:       ws.data,
+		}
+		ws.opcode, ws.data = 0, nil
+
+		ws.p.count("websocket.messages", 1)
+
+		if hook == nil {
+			ws.record(opcode(m), m.Data, false)
+			continue
+		}
+
+		if !hook(ws.s, ws.req, m) {
+			ws.p.count("websocket.dropped", 1)
+			ws.record(opcode(m), m.Data, true)
+			continue
+		}
+
+		ws.record(opcode(m), m.Data, false)
+
+		msg := &wsFrame{fin: true, opcode: opcode(m), payload: m.Data}
+		if err := writeWebSocketFrame(w, msg, ws.fromClient); err != nil {
+			return err
+		}
+	}
+}
+
+// record adds a message to the connection's flow, if any.
+func (ws *wsRelay) record(op byte, data []byte, dropped bool) {
+	if ws.flow == nil {
+		return
+	}
+
+	ws.p.Flows.message(ws.flow, FlowMessage{
+		FromClient: ws.fromClient,
+		Opcode:     int(op),
+		Data:       data,
+		Dropped:    dropped,
+	})
+}
+
+// opcode returns the opcode with which a message is sent.
+func opcode(m *WebSocketMessage) byte {
+	if m.Binary {
+		return wsBinary
+	}
+	return wsText
+}
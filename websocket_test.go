@@ -0,0 +1,416 @@
+package relay_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/erkl/heat"
+	"github.com/erkl/relay"
+)
+
+// A wsFrame is a WebSocket frame, as seen on the wire.
+type wsFrame struct {
+	fin     bool
+	rsv     byte
+	opcode  byte
+	masked  bool
+	payload []byte
+}
+
+func (f wsFrame) String() string {
+	return fmt.Sprintf("%x:%v:%v:%q", f.opcode, f.fin, f.masked, f.payload)
+}
+
+// writeFrame writes a frame, masking it with a fixed key if f.masked is set.
+func writeFrame(w io.Writer, f wsFrame) {
+	hdr := []byte{f.rsv | f.opcode, 0}
+	if f.fin {
+		hdr[0] |= 0x80
+	}
+
+	switch n := len(f.payload); {
+	case n <= 125:
+		hdr[1] = byte(n)
+	case n <= 0xffff:
+		hdr[1] = 126
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr[1] = 127
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+
+	payload := f.payload
+	if f.masked {
+		key := []byte{1, 2, 3, 4}
+		hdr[1] |= 0x80
+		hdr = append(hdr, key...)
+
+		payload = make([]byte, len(f.payload))
+		for i := range payload {
+			payload[i] = f.payload[i] ^ key[i%4]
+		}
+	}
+
+	w.Write(append(hdr, payload...))
+}
+
+// readFrame reads a frame, unmasking its payload.
+func readFrame(r *bufio.Reader) (wsFrame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return wsFrame{}, err
+	}
+
+	f := wsFrame{
+		fin:    hdr[0]&0x80 != 0,
+		rsv:    hdr[0] & 0x70,
+		opcode: hdr[0] & 0x0f,
+		masked: hdr[1]&0x80 != 0,
+	}
+
+	size := uint64(hdr[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+
+	var key [4]byte
+	if f.masked {
+		io.ReadFull(r, key[:])
+	}
+
+	f.payload = make([]byte, size)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return wsFrame{}, err
+	}
+	if f.masked {
+		for i := range f.payload {
+			f.payload[i] ^= key[i%4]
+		}
+	}
+
+	return f, nil
+}
+
+// wsUpstream starts a WebSocket server accepting a single connection, whose
+// handshake's extensions are sent to exts before handle is called.
+func wsUpstream(t *testing.T, exts chan<- string, handle func(r *bufio.Reader, w io.Writer)) string {
+	return rawUpstream(t, func(conn *net.TCPConn) {
+		r := bufio.NewReader(conn)
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			t.Errorf("reading handshake: %v", err)
+			return
+		}
+		exts <- req.Header.Get("Sec-WebSocket-Extensions")
+
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n\r\n")
+
+		handle(r, conn)
+	})
+}
+
+// wsConnect opens a WebSocket connection to addr through p.
+func wsConnect(t *testing.T, p *relay.Proxy, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn := serve(t, p)
+	io.WriteString(conn, "GET http://"+addr+"/chat HTTP/1.1\r\nHost: "+addr+"\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate\r\n\r\n")
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 101 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	return conn, r
+}
+
+func TestWebSocketMessages(t *testing.T) {
+	exts := make(chan string, 1)
+	received := make(chan []wsFrame, 1)
+
+	addr := wsUpstream(t, exts, func(r *bufio.Reader, w io.Writer) {
+		writeFrame(w, wsFrame{fin: false, opcode: 1, payload: []byte("hi ")})
+		writeFrame(w, wsFrame{fin: true, opcode: 0, payload: []byte("there")})
+
+		// Read until the client's close frame, and answer it.
+		var frames []wsFrame
+		for {
+			f, err := readFrame(r)
+			if err != nil {
+				t.Errorf("upstream: %v", err)
+				break
+			}
+			frames = append(frames, f)
+			if f.opcode == 8 {
+				writeFrame(w, wsFrame{fin: true, opcode: 8, payload: f.payload})
+				break
+			}
+		}
+		received <- frames
+	})
+
+	m := new(counters)
+
+	var mu sync.Mutex
+	var seen []string
+
+	p := &relay.Proxy{
+		Metrics: m,
+		OnWebSocketMessage: func(s *relay.Session, req *heat.Request, msg *relay.WebSocketMessage) bool {
+			mu.Lock()
+			seen = append(seen, fmt.Sprintf("%v:%v:%s:%s", msg.FromClient, msg.Binary, req.URI, msg.Data))
+			mu.Unlock()
+
+			if string(msg.Data) == "drop" {
+				return false
+			}
+			if !msg.Binary {
+				msg.Data = bytes.ToUpper(msg.Data)
+			}
+			return true
+		},
+	}
+
+	conn, r := wsConnect(t, p, addr)
+
+	// Extensions aren't negotiated when messages are intercepted.
+	if e := <-exts; e != "" {
+		t.Errorf("upstream server got extensions %q", e)
+	}
+
+	// The server's fragmented message arrives as a single frame, unmasked.
+	if f, err := readFrame(r); err != nil || f.String() != (wsFrame{fin: true, opcode: 1, payload: []byte("HI THERE")}).String() {
+		t.Errorf("got frame %v, %v", f, err)
+	}
+
+	// Control frames may come between fragments, and are relayed at once.
+	writeFrame(conn, wsFrame{fin: false, opcode: 1, masked: true, payload: []byte("hel")})
+	writeFrame(conn, wsFrame{fin: true, opcode: 9, masked: true, payload: []byte("ping")})
+	writeFrame(conn, wsFrame{fin: true, opcode: 0, masked: true, payload: []byte("lo")})
+	writeFrame(conn, wsFrame{fin: true, opcode: 1, masked: true, payload: []byte("drop")})
+	writeFrame(conn, wsFrame{fin: true, opcode: 2, masked: true, payload: []byte("bin")})
+	writeFrame(conn, wsFrame{fin: true, opcode: 8, masked: true, payload: []byte{3, 232}})
+
+	if f, err := readFrame(r); err != nil || f.opcode != 8 {
+		t.Errorf("got frame %v, %v, want the close frame", f, err)
+	}
+
+	var got []string
+	for _, f := range <-received {
+		got = append(got, f.String())
+	}
+	want := []string{
+		wsFrame{fin: true, opcode: 9, masked: true, payload: []byte("ping")}.String(),
+		wsFrame{fin: true, opcode: 1, masked: true, payload: []byte("HELLO")}.String(),
+		wsFrame{fin: true, opcode: 2, masked: true, payload: []byte("bin")}.String(),
+		wsFrame{fin: true, opcode: 8, masked: true, payload: []byte{3, 232}}.String(),
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("upstream server got:\n%v\nwant:\n%v", got, want)
+	}
+
+	mu.Lock()
+	if s := strings.Join(seen, " "); s != "false:false:/chat:hi there true:false:/chat:hello true:false:/chat:drop true:true:/chat:bin" {
+		t.Errorf("hook saw %q", seen)
+	}
+	mu.Unlock()
+
+	if n, d := m.get("websocket.messages"), m.get("websocket.dropped"); n != 4 || d != 1 {
+		t.Errorf("got %d messages and %d dropped, want 4 and 1", n, d)
+	}
+}
+
+func TestWebSocketMessageTooLarge(t *testing.T) {
+	exts := make(chan string, 1)
+	addr := wsUpstream(t, exts, func(r *bufio.Reader, w io.Writer) {
+		if f, err := readFrame(r); err == nil {
+			t.Errorf("upstream server got frame %v", f)
+		}
+	})
+
+	p := &relay.Proxy{
+		MaxWebSocketMessage: 4,
+		OnWebSocketMessage: func(s *relay.Session, req *heat.Request, m *relay.WebSocketMessage) bool {
+			t.Errorf("hook called with %q", m.Data)
+			return true
+		},
+	}
+
+	conn, r := wsConnect(t, p, addr)
+	<-exts
+
+	// The limit applies to whole messages, not single fragments.
+	writeFrame(conn, wsFrame{fin: false, opcode: 1, masked: true, payload: []byte("abc")})
+	writeFrame(conn, wsFrame{fin: true, opcode: 0, masked: true, payload: []byte("def")})
+
+	if f, err := readFrame(r); err == nil {
+		t.Errorf("got frame %v, want the connection closed", f)
+	}
+}
+
+func TestWebSocketPassthrough(t *testing.T) {
+	exts := make(chan string, 1)
+	addr := wsUpstream(t, exts, func(r *bufio.Reader, w io.Writer) {
+		// Compressed frames are relayed as they are.
+		writeFrame(w, wsFrame{fin: false, rsv: 0x40, opcode: 1, payload: []byte("abc")})
+		writeFrame(w, wsFrame{fin: true, opcode: 0, payload: []byte("def")})
+	})
+
+	conn, r := wsConnect(t, &relay.Proxy{}, addr)
+	defer conn.Close()
+
+	if e := <-exts; e != "permessage-deflate" {
+		t.Errorf("upstream server got extensions %q", e)
+	}
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		f, err := readFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%x %v", f.rsv, f))
+	}
+	if s := strings.Join(got, " "); s != `40 1:false:false:"abc" 0 0:true:false:"def"` {
+		t.Errorf("got frames %s", s)
+	}
+}
+
+// waitMessages waits for a store's first flow to have n messages.
+func waitMessages(t *testing.T, fs *relay.FlowStore, n int) relay.Flow {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if flows := fs.Flows(nil); len(flows) > 0 && len(flows[0].Messages) >= n {
+			return flows[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("flow didn't get %d messages", n)
+	return relay.Flow{}
+}
+
+func TestWebSocketFlows(t *testing.T) {
+	exts := make(chan string, 1)
+	addr := wsUpstream(t, exts, func(r *bufio.Reader, w io.Writer) {
+		writeFrame(w, wsFrame{fin: true, opcode: 1, payload: []byte("welcome")})
+		for {
+			f, err := readFrame(r)
+			if err != nil {
+				return
+			}
+			if f.opcode == 8 {
+				writeFrame(w, wsFrame{fin: true, opcode: 8})
+				return
+			}
+		}
+	})
+
+	st := new(relay.MemoryStorage)
+	fs := &relay.FlowStore{MaxFlows: 1, MaxBodySize: 12, MaxMessages: 3, Storage: st}
+	p := &relay.Proxy{
+		Flows:  fs,
+		Redact: &relay.Redactor{Patterns: []*regexp.Regexp{regexp.MustCompile(`\d+`)}},
+	}
+
+	conn, r := wsConnect(t, p, addr)
+	<-exts
+
+	if f, err := readFrame(r); err != nil || string(f.payload) != "welcome" {
+		t.Fatalf("got frame %v, %v", f, err)
+	}
+
+	// Messages are recorded once relayed, so wait for this one to keep
+	// them in order.
+	waitMessages(t, fs, 1)
+
+	writeFrame(conn, wsFrame{fin: true, opcode: 9, masked: true, payload: []byte("p")})
+	writeFrame(conn, wsFrame{fin: true, opcode: 1, masked: true, payload: []byte("secret 1234")})
+
+	// The flow stays active while the connection is open.
+	if f := waitMessages(t, fs, 3); f.State != relay.FlowActive {
+		t.Errorf("flow is %v while the connection is open", f.State)
+	}
+
+	writeFrame(conn, wsFrame{fin: true, opcode: 8, masked: true})
+	readFrame(r)
+	conn.Close()
+
+	f := waitDone(t, fs)
+	if f.Response.Status != 101 || !f.MessagesTruncated {
+		t.Errorf("got status %d, truncated %v", f.Response.Status, f.MessagesTruncated)
+	}
+
+	check := func(f relay.Flow) {
+		t.Helper()
+
+		var got []string
+		for _, m := range f.Messages {
+			if m.Time.IsZero() {
+				t.Errorf("message %q has no time", m.Data)
+			}
+			got = append(got, fmt.Sprintf("%v %d %q %d %v", m.FromClient, m.Opcode, m.Data, m.Size, m.Truncated))
+		}
+		want := []string{
+			`false 1 "welcome" 7 false`,
+			`true 9 "p" 1 false`,
+			`true 1 "secret [REDA" 11 true`,
+		}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("got messages:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+	check(f)
+
+	// Messages are archived along with the rest of the flow.
+	addr = upstream(t, func(conn net.Conn, r *bufio.Reader, req *http.Request) {
+		io.WriteString(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+	})
+	conn = serve(t, p)
+	io.WriteString(conn, "GET http://"+addr+"/ HTTP/1.1\r\nHost: "+addr+"\r\n\r\n")
+	readFinal(t, conn, bufio.NewReader(conn))
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if keys, _ := st.Keys("flows/"); len(keys) == 1 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("storage holds %q", keys)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	archived, ok := fs.Get(f.ID)
+	if !ok || !archived.MessagesTruncated {
+		t.Fatalf("got archived flow %+v, %v", archived, ok)
+	}
+	check(archived)
+}